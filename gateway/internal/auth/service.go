@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -13,11 +14,15 @@ import (
 	"magnetm3u8-gateway/internal/user"
 )
 
+// ErrGuestExpired is returned when a guest account is past its expiry.
+var ErrGuestExpired = errors.New("访客账号已过期")
+
 // Service encapsulates registration, authentication, and session workflows.
 type Service struct {
 	users    *user.Repository
 	sessions *session.Store
 	ttl      time.Duration
+	now      func() time.Time
 }
 
 func NewService(userRepo *user.Repository, sessionStore *session.Store, ttl time.Duration) *Service {
@@ -25,24 +30,44 @@ func NewService(userRepo *user.Repository, sessionStore *session.Store, ttl time
 		users:    userRepo,
 		sessions: sessionStore,
 		ttl:      ttl,
+		now:      time.Now,
 	}
 }
 
 func (s *Service) Register(ctx context.Context, username, password string) (*user.User, error) {
+	username, hash, err := validateCredentials(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return s.users.Create(ctx, username, hash, user.RoleUser)
+}
+
+// CreateGuest creates a guest account that can log in until expiresAt.
+func (s *Service) CreateGuest(ctx context.Context, username, password string, expiresAt time.Time, submitDisabled bool) (*user.User, error) {
+	if !expiresAt.After(s.now()) {
+		return nil, fmt.Errorf("过期时间必须晚于当前时间")
+	}
+	username, hash, err := validateCredentials(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return s.users.CreateGuest(ctx, username, hash, expiresAt, submitDisabled)
+}
+
+func validateCredentials(username, password string) (string, string, error) {
 	username = strings.TrimSpace(username)
 	if len(username) < 3 {
-		return nil, fmt.Errorf("用户名至少3个字符")
+		return "", "", fmt.Errorf("用户名至少3个字符")
 	}
 	if len(password) < 6 {
-		return nil, fmt.Errorf("密码至少6个字符")
+		return "", "", fmt.Errorf("密码至少6个字符")
 	}
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-
-	return s.users.Create(ctx, username, string(hash), user.RoleUser)
+	return username, string(hash), nil
 }
 
 func (s *Service) Login(ctx context.Context, username, password string) (string, *user.User, error) {
@@ -59,6 +84,10 @@ func (s *Service) Login(ctx context.Context, username, password string) (string,
 		return "", nil, errors.New("用户名或密码错误")
 	}
 
+	if account.Expired(s.now()) {
+		return "", nil, ErrGuestExpired
+	}
+
 	session, err := s.sessions.Create(ctx, account.ID, s.ttl)
 	if err != nil {
 		return "", nil, err
@@ -88,7 +117,40 @@ func (s *Service) UserFromToken(ctx context.Context, token string) (*user.User,
 	if errors.Is(err, user.ErrNotFound) {
 		return nil, nil
 	}
-	return account, err
+	if err != nil {
+		return nil, err
+	}
+
+	if account.Expired(s.now()) {
+		_ = s.sessions.Delete(ctx, token)
+		return nil, ErrGuestExpired
+	}
+	return account, nil
+}
+
+// PurgeExpiredGuests deletes expired guest accounts and everything they own.
+func (s *Service) PurgeExpiredGuests(ctx context.Context) (int64, error) {
+	return s.users.DeleteExpiredGuests(ctx, s.now())
+}
+
+// RunGuestCleanup purges expired guests every interval until ctx is done.
+func (s *Service) RunGuestCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.PurgeExpiredGuests(ctx)
+			if err != nil {
+				log.Printf("清理过期访客账号失败: %v", err)
+			} else if deleted > 0 {
+				log.Printf("已清理 %d 个过期访客账号", deleted)
+			}
+		}
+	}
 }
 
 // EnsureDefaultAdmin creates or updates the default admin account.
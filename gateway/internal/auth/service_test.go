@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"magnetm3u8-gateway/internal/database"
+	"magnetm3u8-gateway/internal/session"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/user"
+)
+
+func TestGuestAccountsExpireAndArePurged(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	ctx := context.Background()
+	users := user.NewRepository(db)
+	tasks := task.NewRepository(db)
+	service := NewService(users, session.NewStore(db), time.Hour)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	if _, err := service.CreateGuest(ctx, "past", "secret1", now.Add(-time.Minute), false); err == nil {
+		t.Fatalf("expected guest with an expiry in the past to be rejected")
+	}
+
+	guest, err := service.CreateGuest(ctx, "weekend", "secret1", now.Add(48*time.Hour), true)
+	if err != nil {
+		t.Fatalf("create guest: %v", err)
+	}
+	if !guest.IsGuest() || guest.CanSubmit() {
+		t.Fatalf("expected submit-disabled guest, got %+v", guest)
+	}
+	kept, err := service.CreateGuest(ctx, "kept", "secret1", now.Add(24*time.Hour), true)
+	if err != nil {
+		t.Fatalf("create guest: %v", err)
+	}
+	if err := users.SetExpiry(ctx, kept.ID, time.Time{}); err != nil {
+		t.Fatalf("convert guest: %v", err)
+	}
+	// Converted guests and regular accounts cannot be given an expiry.
+	if err := users.SetExpiry(ctx, kept.ID, now.Add(time.Hour)); !errors.Is(err, user.ErrNotGuest) {
+		t.Fatalf("expected ErrNotGuest for a converted account, got %v", err)
+	}
+	admin, err := users.Create(ctx, "admin", "hash", user.RoleAdmin)
+	if err != nil {
+		t.Fatalf("create admin: %v", err)
+	}
+	if err := users.SetExpiry(ctx, admin.ID, now.Add(time.Hour)); !errors.Is(err, user.ErrNotGuest) {
+		t.Fatalf("expected ErrNotGuest for an admin, got %v", err)
+	}
+	if stored, _ := users.GetByID(ctx, admin.ID); stored.IsGuest() {
+		t.Fatalf("expected the admin to stay permanent, got %+v", stored)
+	}
+	if err := users.SetExpiry(ctx, 9999, now.Add(time.Hour)); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing account, got %v", err)
+	}
+
+	token, _, err := service.Login(ctx, "weekend", "secret1")
+	if err != nil {
+		t.Fatalf("login before expiry: %v", err)
+	}
+	if err := tasks.Upsert(ctx, "task-1", "worker-1", "ready", &guest.ID); err != nil {
+		t.Fatalf("upsert task: %v", err)
+	}
+
+	now = now.Add(72 * time.Hour)
+	if _, _, err := service.Login(ctx, "weekend", "secret1"); !errors.Is(err, ErrGuestExpired) {
+		t.Fatalf("expected expired guest login to fail with ErrGuestExpired, got %v", err)
+	}
+	if _, err := service.UserFromToken(ctx, token); !errors.Is(err, ErrGuestExpired) {
+		t.Fatalf("expected expired guest session to be rejected, got %v", err)
+	}
+
+	deleted, err := service.PurgeExpiredGuests(ctx)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected one expired guest to be deleted, got %d", deleted)
+	}
+	if _, err := users.GetByID(ctx, guest.ID); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected guest to be deleted, got %v", err)
+	}
+
+	var sessions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE user_id = ?`, guest.ID).Scan(&sessions); err != nil {
+		t.Fatalf("count sessions: %v", err)
+	}
+	if sessions != 0 {
+		t.Fatalf("expected guest sessions to be deleted, found %d", sessions)
+	}
+	record, err := tasks.Get(ctx, "task-1")
+	if err != nil {
+		t.Fatalf("get task: %v", err)
+	}
+	if record.OwnerID != nil {
+		t.Fatalf("expected task to lose its deleted owner, got %d", *record.OwnerID)
+	}
+
+	converted, err := users.GetByID(ctx, kept.ID)
+	if err != nil {
+		t.Fatalf("expected converted guest to survive the purge: %v", err)
+	}
+	if converted.IsGuest() || !converted.CanSubmit() {
+		t.Fatalf("expected a permanent user with submission enabled, got %+v", converted)
+	}
+}
@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultClockSkewThreshold is the skew above which a worker's clock is
+// flagged when no threshold is configured.
+const DefaultClockSkewThreshold = 30 * time.Second
+
+// ClockSkewChange describes a worker's clock after a new sample. Changed is
+// set when the sample moved the skew across the warning threshold, in either
+// direction; samples for unknown nodes return the zero value.
+type ClockSkewChange struct {
+	Skew    time.Duration
+	RTT     time.Duration
+	Warning bool
+	Changed bool
+}
+
+// ClockSkewStats summarizes worker clock skew for the status endpoint.
+type ClockSkewStats struct {
+	ThresholdMs int64 `json:"threshold_ms"`
+	// Nodes maps each worker with a known skew to its skew in milliseconds,
+	// positive when the worker's clock runs ahead of the gateway's.
+	Nodes    map[string]int64 `json:"nodes"`
+	Warnings int              `json:"warnings"`
+}
+
+// SetClockSkewThreshold sets the skew above which a worker's clock is flagged.
+// Zero disables the warning; negative values restore the default.
+func (m *Manager) SetClockSkewThreshold(threshold time.Duration) {
+	if threshold < 0 {
+		threshold = DefaultClockSkewThreshold
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clockSkewThreshold = threshold
+}
+
+// RecordClockSync stores the skew measured by a two-way exchange: the gateway
+// sent its clock at sentAt, the worker answered with its own clock at
+// workerClock and the answer arrived at receivedAt. The worker's reading is
+// assumed to have been taken halfway through the round trip.
+func (m *Manager) RecordClockSync(nodeID string, sentAt, workerClock, receivedAt time.Time) ClockSkewChange {
+	rtt := receivedAt.Sub(sentAt)
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return ClockSkewChange{}
+	}
+	node.ClockRTTMs = rtt.Milliseconds()
+	return m.setClockSkew(node, workerClock.Sub(sentAt.Add(rtt/2)))
+}
+
+// RecordClockSample stores the skew from a timestamp the worker sent one way,
+// with a registration or heartbeat. Half the last measured round trip is
+// taken as the transport latency.
+func (m *Manager) RecordClockSample(nodeID string, workerClock, receivedAt time.Time) ClockSkewChange {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return ClockSkewChange{}
+	}
+	latency := time.Duration(node.ClockRTTMs) * time.Millisecond / 2
+	return m.setClockSkew(node, workerClock.Sub(receivedAt.Add(-latency)))
+}
+
+// setClockSkew stores skew on node and updates its warning. Callers must hold
+// the mutex.
+func (m *Manager) setClockSkew(node *WorkerNode, skew time.Duration) ClockSkewChange {
+	threshold := m.clockSkewThreshold
+	wasWarning := node.ClockSkewWarning != ""
+	node.ClockSkewMs = skew.Milliseconds()
+	node.ClockSkewKnown = true
+	node.ClockSkewWarning = ""
+	if threshold > 0 && (skew > threshold || skew < -threshold) {
+		direction := "ahead of"
+		if skew < 0 {
+			direction = "behind"
+		}
+		node.ClockSkewWarning = fmt.Sprintf("worker clock is %s %s the gateway", absDuration(skew).Round(time.Second), direction)
+	}
+
+	warning := node.ClockSkewWarning != ""
+	return ClockSkewChange{
+		Skew:    skew,
+		RTT:     time.Duration(node.ClockRTTMs) * time.Millisecond,
+		Warning: warning,
+		Changed: warning != wasWarning,
+	}
+}
+
+// WorkerTime converts a gateway time into nodeID's clock, so deadlines sent to
+// the worker expire when intended on its clock. Times for unknown nodes are
+// returned unchanged.
+func (m *Manager) WorkerTime(nodeID string, t time.Time) time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if node, exists := m.nodes[nodeID]; exists {
+		return t.Add(time.Duration(node.ClockSkewMs) * time.Millisecond)
+	}
+	return t
+}
+
+// ClockSkewStats reports the clock skew of every worker with a measurement.
+func (m *Manager) ClockSkewStats() ClockSkewStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stats := ClockSkewStats{
+		ThresholdMs: m.clockSkewThreshold.Milliseconds(),
+		Nodes:       make(map[string]int64),
+	}
+	for id, node := range m.nodes {
+		if !node.ClockSkewKnown {
+			continue
+		}
+		stats.Nodes[id] = node.ClockSkewMs
+		if node.ClockSkewWarning != "" {
+			stats.Warnings++
+		}
+	}
+	return stats
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClockSyncEstimatesSkewFromRoundTrip(t *testing.T) {
+	m := &Manager{nodes: make(map[string]*WorkerNode), clockSkewThreshold: DefaultClockSkewThreshold}
+	m.RegisterNode(&WorkerNode{ID: "worker-1"})
+
+	// The worker runs 40s ahead; the exchange took 200ms and the worker read
+	// its clock halfway through.
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	change := m.RecordClockSync("worker-1", sent, sent.Add(40*time.Second+100*time.Millisecond), sent.Add(200*time.Millisecond))
+	if change.Skew != 40*time.Second || !change.Warning || !change.Changed {
+		t.Fatalf("expected a new 40s warning, got %+v", change)
+	}
+	node, _ := m.GetNode("worker-1")
+	if node.ClockRTTMs != 200 || !strings.Contains(node.ClockSkewWarning, "40s ahead of") {
+		t.Fatalf("expected rtt and warning on the node, got %+v", node)
+	}
+	if got := m.WorkerTime("worker-1", sent); !got.Equal(sent.Add(40 * time.Second)) {
+		t.Fatalf("expected gateway time converted to the worker clock, got %s", got)
+	}
+
+	// A heartbeat after the worker fixed its clock clears the warning; half
+	// the round trip is taken as the latency.
+	received := sent.Add(time.Minute)
+	change = m.RecordClockSample("worker-1", received.Add(-100*time.Millisecond-2*time.Second), received)
+	if change.Skew != -2*time.Second || change.Warning || !change.Changed {
+		t.Fatalf("expected the warning to clear at -2s, got %+v", change)
+	}
+
+	stats := m.ClockSkewStats()
+	if stats.Nodes["worker-1"] != -2000 || stats.Warnings != 0 || stats.ThresholdMs != 30000 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if change := m.RecordClockSample("missing", received, received); change.Changed {
+		t.Fatalf("expected no change for an unknown node, got %+v", change)
+	}
+}
+
+func TestClockSkewWarningCanBeDisabled(t *testing.T) {
+	m := NewManager()
+	m.SetClockSkewThreshold(0)
+	m.RegisterNode(&WorkerNode{ID: "worker-1"})
+
+	now := time.Now()
+	if change := m.RecordClockSample("worker-1", now.Add(-time.Hour), now); change.Warning || change.Skew != -time.Hour {
+		t.Fatalf("expected skew without a warning, got %+v", change)
+	}
+}
@@ -3,6 +3,8 @@ package cluster
 import (
 	"sync"
 	"time"
+
+	"magnetm3u8-gateway/internal/timefmt"
 )
 
 // WorkerNode represents a worker that can register with the gateway.
@@ -11,33 +13,79 @@ type WorkerNode struct {
 	Name         string            `json:"name"`
 	Address      string            `json:"address"`
 	Status       string            `json:"status"`
-	LastSeen     time.Time         `json:"last_seen"`
+	LastSeen     timefmt.Time      `json:"last_seen"`
 	Capabilities []string          `json:"capabilities"`
 	Resources    map[string]int    `json:"resources"`
 	Metadata     map[string]string `json:"metadata"`
+	// Metrics holds the latest values reported with the worker heartbeat.
+	Metrics map[string]interface{} `json:"metrics,omitempty"`
+	// ProtocolVersion is announced by the worker on registration and replaced
+	// by the negotiated version once the handshake succeeds.
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version,omitempty"`
+	// ActiveDownloads and DiskFreeGB come from the latest heartbeat and feed
+	// SelectWorker.
+	ActiveDownloads int     `json:"active_downloads"`
+	DiskFreeGB      float64 `json:"disk_free_gb"`
+	// DiskShort is set while the worker's free space is still below what its
+	// last download rejected for lack of space needed; SelectWorker routes new
+	// submissions elsewhere until it clears.
+	DiskShort bool `json:"disk_short,omitempty"`
+	// Quiet is set while the worker reports the quiet state from its quiet
+	// hours or a pause_all; SelectWorker avoids it for new submissions.
+	Quiet bool `json:"quiet,omitempty"`
+	// ClockSkewMs is how far the worker's clock runs ahead of the gateway's,
+	// negative when behind, from the clock_sync exchange after registration
+	// and the timestamps of later heartbeats. ClockRTTMs is the round trip of
+	// that exchange. ClockSkewWarning is set while the skew exceeds the
+	// configured threshold.
+	ClockSkewMs      int64  `json:"clock_skew_ms"`
+	ClockRTTMs       int64  `json:"clock_rtt_ms,omitempty"`
+	ClockSkewWarning string `json:"clock_skew_warning,omitempty"`
+	ClockSkewKnown   bool   `json:"-"`
 }
 
 // SignalingSession captures metadata for active WebRTC sessions.
 type SignalingSession struct {
-	SessionID string    `json:"session_id"`
-	ClientID  string    `json:"client_id"`
-	WorkerID  string    `json:"worker_id"`
-	CreatedAt time.Time `json:"created_at"`
-	Status    string    `json:"status"`
+	SessionID string       `json:"session_id"`
+	ClientID  string       `json:"client_id"`
+	WorkerID  string       `json:"worker_id"`
+	TaskID    string       `json:"task_id,omitempty"` // task being played, used to find a replica on failover
+	CreatedAt timefmt.Time `json:"created_at"`
+	Status    string       `json:"status"`
+	// Probe marks a short-lived speed probe session; probes are not counted as
+	// active sessions and are not migrated.
+	Probe bool `json:"probe,omitempty"`
 }
 
 // Manager orchestrates registered worker nodes and WebRTC sessions.
 type Manager struct {
-	nodes    map[string]*WorkerNode
-	sessions map[string]*SignalingSession
-	mutex    sync.RWMutex
+	nodes      map[string]*WorkerNode
+	sessions   map[string]*SignalingSession
+	taskNodes  map[string]map[string]bool // task ID -> nodes advertising it
+	migrations MigrationStats
+	// lastSeen is the latest registration or heartbeat of every worker seen
+	// since startup; unlike nodes it outlives RemoveNode.
+	lastSeen map[string]timefmt.Time
+	// scheduling is the SelectWorker algorithm; scheduleTurn rotates among
+	// equally scored nodes.
+	scheduling   string
+	scheduleTurn int
+	// clockSkewThreshold is the skew above which a worker's clock is flagged;
+	// zero disables the warning.
+	clockSkewThreshold time.Duration
+	mutex              sync.RWMutex
 }
 
 // NewManager constructs a Manager and starts background cleanup tasks.
 func NewManager() *Manager {
 	m := &Manager{
-		nodes:    make(map[string]*WorkerNode),
-		sessions: make(map[string]*SignalingSession),
+		nodes:      make(map[string]*WorkerNode),
+		sessions:   make(map[string]*SignalingSession),
+		taskNodes:  make(map[string]map[string]bool),
+		scheduling: SchedulingWeighted,
+
+		clockSkewThreshold: DefaultClockSkewThreshold,
 	}
 
 	go m.startCleanupTask()
@@ -50,9 +98,10 @@ func (m *Manager) RegisterNode(node *WorkerNode) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	node.LastSeen = time.Now()
+	node.LastSeen = timefmt.Now()
 	node.Status = "online"
 	m.nodes[node.ID] = node
+	m.recordSeenLocked(node)
 }
 
 // UpdateNodeHeartbeat refreshes the LastSeen timestamp of a worker.
@@ -61,13 +110,56 @@ func (m *Manager) UpdateNodeHeartbeat(nodeID string) bool {
 	defer m.mutex.Unlock()
 
 	if node, exists := m.nodes[nodeID]; exists {
-		node.LastSeen = time.Now()
+		node.LastSeen = timefmt.Now()
 		node.Status = "online"
+		m.recordSeenLocked(node)
 		return true
 	}
 	return false
 }
 
+// recordSeenLocked remembers node.LastSeen beyond the node's removal. The
+// caller holds m.mutex.
+func (m *Manager) recordSeenLocked(node *WorkerNode) {
+	if m.lastSeen == nil {
+		m.lastSeen = make(map[string]timefmt.Time)
+	}
+	m.lastSeen[node.ID] = node.LastSeen
+}
+
+// LastSeen reports when a worker last registered or sent a heartbeat, also
+// after it disconnected and was removed. It is false for workers not seen
+// since the gateway started.
+func (m *Manager) LastSeen(nodeID string) (timefmt.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	seen, ok := m.lastSeen[nodeID]
+	return seen, ok
+}
+
+// UpdateNodeMetrics stores the metrics reported with a heartbeat.
+func (m *Manager) UpdateNodeMetrics(nodeID string, metrics map[string]interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if node, exists := m.nodes[nodeID]; exists {
+		node.Metrics = metrics
+		if active, ok := metrics["active_downloads"].(float64); ok {
+			node.ActiveDownloads = int(active)
+		}
+		if free, ok := metrics["disk_free_gb"].(float64); ok {
+			node.DiskFreeGB = free
+		}
+		required, short := metrics["disk_required_bytes"].(float64)
+		if available, ok := metrics["disk_available_bytes"].(float64); ok && short {
+			short = required > available
+		}
+		node.DiskShort = short
+		node.Quiet = metrics["state"] == "quiet"
+	}
+}
+
 // GetOnlineNodes returns all nodes whose status is "online".
 func (m *Manager) GetOnlineNodes() []*WorkerNode {
 	m.mutex.RLock()
@@ -91,12 +183,13 @@ func (m *Manager) GetNode(nodeID string) (*WorkerNode, bool) {
 	return node, exists
 }
 
-// RemoveNode deletes a worker.
+// RemoveNode deletes a worker and forgets the tasks it advertised.
 func (m *Manager) RemoveNode(nodeID string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	delete(m.nodes, nodeID)
+	m.forgetNodeTasks(nodeID)
 }
 
 // CreateSignalingSession registers a WebRTC signaling session.
@@ -108,7 +201,7 @@ func (m *Manager) CreateSignalingSession(sessionID, clientID, workerID string) *
 		SessionID: sessionID,
 		ClientID:  clientID,
 		WorkerID:  workerID,
-		CreatedAt: time.Now(),
+		CreatedAt: timefmt.Now(),
 		Status:    "negotiating",
 	}
 
@@ -116,6 +209,16 @@ func (m *Manager) CreateSignalingSession(sessionID, clientID, workerID string) *
 	return session
 }
 
+// CreateProbeSession registers a speed probe session.
+func (m *Manager) CreateProbeSession(sessionID, clientID, workerID string) *SignalingSession {
+	session := m.CreateSignalingSession(sessionID, clientID, workerID)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session.Probe = true
+	return session
+}
+
 // CreateWebRTCSession is an alias for CreateSignalingSession.
 func (m *Manager) CreateWebRTCSession(sessionID, clientID, workerID string) *SignalingSession {
 	return m.CreateSignalingSession(sessionID, clientID, workerID)
@@ -153,13 +256,50 @@ func (m *Manager) RemoveSignalingSession(sessionID string) {
 	delete(m.sessions, sessionID)
 }
 
+// SessionStatusClosed is set on sessions closed because their client went away.
+const SessionStatusClosed = "closed"
+
+// GetSessionsByClient returns copies of the sessions opened by a client.
+func (m *Manager) GetSessionsByClient(clientID string) []SignalingSession {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var sessions []SignalingSession
+	for _, session := range m.sessions {
+		if session.ClientID == clientID {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions
+}
+
+// CloseSession marks a session closed and removes it, so it no longer counts
+// as active. It returns the closed session and false when the session was
+// already gone, letting concurrent callers notify its worker only once.
+func (m *Manager) CloseSession(sessionID string) (SignalingSession, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return SignalingSession{}, false
+	}
+	session.Status = SessionStatusClosed
+	delete(m.sessions, sessionID)
+	return *session, true
+}
+
 // Stats returns counts for total nodes, currently online nodes, and active sessions.
 func (m *Manager) Stats() (totalNodes int, onlineNodes int, activeSessions int) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
 	totalNodes = len(m.nodes)
-	activeSessions = len(m.sessions)
+	for _, session := range m.sessions {
+		if !session.Probe {
+			activeSessions++
+		}
+	}
 	for _, node := range m.nodes {
 		if node.Status == "online" {
 			onlineNodes++
@@ -168,6 +308,42 @@ func (m *Manager) Stats() (totalNodes int, onlineNodes int, activeSessions int)
 	return
 }
 
+// WebRTCStats aggregates the WebRTC serving statistics of the online workers.
+type WebRTCStats struct {
+	TotalBytesSent     int64   `json:"total_bytes_sent"`
+	AvgRTTMs           float64 `json:"avg_rtt_ms" desc:"Round-trip time averaged over the sessions of all workers, weighted by session count"`
+	ActiveSessionCount int     `json:"active_session_count" desc:"Sessions open on the workers"`
+}
+
+// WebRTCStats sums the WebRTC metrics reported with the online workers'
+// heartbeats. Workers that do not report them are skipped.
+func (m *Manager) WebRTCStats() WebRTCStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var stats WebRTCStats
+	var rttWeighted float64
+	var rttSessions int
+	for _, node := range m.nodes {
+		if node.Status != "online" {
+			continue
+		}
+		sessions, _ := node.Metrics["webrtc_sessions"].(float64)
+		sent, _ := node.Metrics["webrtc_bytes_sent"].(float64)
+		rtt, _ := node.Metrics["webrtc_avg_rtt_ms"].(float64)
+		stats.ActiveSessionCount += int(sessions)
+		stats.TotalBytesSent += int64(sent)
+		if rtt > 0 && sessions > 0 {
+			rttWeighted += rtt * sessions
+			rttSessions += int(sessions)
+		}
+	}
+	if rttSessions > 0 {
+		stats.AvgRTTMs = rttWeighted / float64(rttSessions)
+	}
+	return stats
+}
+
 func (m *Manager) startCleanupTask() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -184,11 +360,11 @@ func (m *Manager) cleanupOfflineNodes() {
 
 	now := time.Now()
 	for nodeID, node := range m.nodes {
-		if now.Sub(node.LastSeen) > 2*time.Minute {
+		if now.Sub(node.LastSeen.Time) > 2*time.Minute {
 			if node.Status != "offline" {
 				node.Status = "offline"
 			}
-			if now.Sub(node.LastSeen) > 10*time.Minute {
+			if now.Sub(node.LastSeen.Time) > 10*time.Minute {
 				delete(m.nodes, nodeID)
 			}
 		}
@@ -201,7 +377,7 @@ func (m *Manager) cleanupExpiredSessions() {
 
 	now := time.Now()
 	for sessionID, session := range m.sessions {
-		if now.Sub(session.CreatedAt) > time.Hour {
+		if now.Sub(session.CreatedAt.Time) > time.Hour {
 			delete(m.sessions, sessionID)
 		}
 	}
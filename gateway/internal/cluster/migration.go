@@ -0,0 +1,127 @@
+package cluster
+
+import "sort"
+
+// Session statuses set when the serving worker disconnects.
+const (
+	SessionStatusMigrated = "migrated"
+	SessionStatusFailed   = "failed"
+)
+
+// MigrationStats counts playback failovers after worker disconnects.
+type MigrationStats struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// Migration describes a session moved from a disconnected worker to a replica.
+type Migration struct {
+	Session     SignalingSession
+	OldWorkerID string
+	NewWorkerID string // empty when no replica was available
+}
+
+// AdvertiseTask records that a node holds a task, as reported in its task
+// status updates and task lists.
+func (m *Manager) AdvertiseTask(nodeID, taskID string) {
+	if nodeID == "" || taskID == "" {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	nodes, ok := m.taskNodes[taskID]
+	if !ok {
+		nodes = make(map[string]bool)
+		m.taskNodes[taskID] = nodes
+	}
+	nodes[nodeID] = true
+}
+
+// WithdrawTask records that a node no longer holds a task.
+func (m *Manager) WithdrawTask(nodeID, taskID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.taskNodes[taskID], nodeID)
+	if len(m.taskNodes[taskID]) == 0 {
+		delete(m.taskNodes, taskID)
+	}
+}
+
+// forgetNodeTasks drops every advertisement of a node. Callers hold the lock.
+func (m *Manager) forgetNodeTasks(nodeID string) {
+	for taskID, nodes := range m.taskNodes {
+		delete(nodes, nodeID)
+		if len(nodes) == 0 {
+			delete(m.taskNodes, taskID)
+		}
+	}
+}
+
+// SetSessionTask attaches the task being played to a session.
+func (m *Manager) SetSessionTask(sessionID, taskID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if session, exists := m.sessions[sessionID]; exists {
+		session.TaskID = taskID
+	}
+}
+
+// MigrateSessions moves the sessions served by a disconnected worker to an
+// online replica advertising the same task. Sessions with a replica are marked
+// migrated (the client negotiates a new session with the replica); the rest are
+// marked failed. Call it after RemoveNode so the disconnected worker is no
+// longer a candidate.
+func (m *Manager) MigrateSessions(workerID string) []Migration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var migrations []Migration
+	for _, session := range m.sessions {
+		if session.WorkerID != workerID || session.Probe || session.Status == SessionStatusMigrated || session.Status == SessionStatusFailed {
+			continue
+		}
+
+		migration := Migration{OldWorkerID: workerID, NewWorkerID: m.replicaFor(session.TaskID, workerID)}
+		if migration.NewWorkerID == "" {
+			session.Status = SessionStatusFailed
+			m.migrations.Failed++
+		} else {
+			session.Status = SessionStatusMigrated
+			m.migrations.Succeeded++
+		}
+		migration.Session = *session
+		migrations = append(migrations, migration)
+	}
+	return migrations
+}
+
+// replicaFor picks an online node other than exclude that advertises the task,
+// preferring the lowest node ID so the choice is stable. Callers hold the lock.
+func (m *Manager) replicaFor(taskID, exclude string) string {
+	if taskID == "" {
+		return ""
+	}
+
+	var candidates []string
+	for nodeID := range m.taskNodes[taskID] {
+		if node, ok := m.nodes[nodeID]; ok && nodeID != exclude && node.Status == "online" {
+			candidates = append(candidates, nodeID)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+// Migrations returns the failover counters.
+func (m *Manager) Migrations() MigrationStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.migrations
+}
@@ -0,0 +1,79 @@
+package cluster
+
+import "testing"
+
+func TestMigrateSessionsToReplica(t *testing.T) {
+	m := &Manager{
+		nodes:     make(map[string]*WorkerNode),
+		sessions:  make(map[string]*SignalingSession),
+		taskNodes: make(map[string]map[string]bool),
+	}
+	for _, id := range []string{"worker-a", "worker-b", "worker-c"} {
+		m.RegisterNode(&WorkerNode{ID: id})
+	}
+	m.AdvertiseTask("worker-a", "task-1")
+	m.AdvertiseTask("worker-c", "task-1")
+	m.AdvertiseTask("worker-a", "task-2")
+
+	m.CreateWebRTCSession("s1", "client-1", "worker-a")
+	m.SetSessionTask("s1", "task-1")
+	m.CreateWebRTCSession("s2", "client-2", "worker-a")
+	m.SetSessionTask("s2", "task-2")
+	m.CreateWebRTCSession("s3", "client-3", "worker-b")
+	m.SetSessionTask("s3", "task-1")
+
+	m.RemoveNode("worker-a")
+	migrations := m.MigrateSessions("worker-a")
+	if len(migrations) != 2 {
+		t.Fatalf("expected both sessions of worker-a to be handled, got %+v", migrations)
+	}
+
+	for _, migration := range migrations {
+		switch migration.Session.SessionID {
+		case "s1":
+			if migration.NewWorkerID != "worker-c" || migration.Session.Status != SessionStatusMigrated {
+				t.Fatalf("expected s1 to migrate to worker-c, got %+v", migration)
+			}
+		case "s2":
+			if migration.NewWorkerID != "" || migration.Session.Status != SessionStatusFailed {
+				t.Fatalf("expected s2 without replica to fail, got %+v", migration)
+			}
+		default:
+			t.Fatalf("unexpected migration %+v", migration)
+		}
+	}
+
+	if s3, _ := m.GetWebRTCSession("s3"); s3.Status != "negotiating" {
+		t.Fatalf("expected sessions on other workers to be untouched, got %s", s3.Status)
+	}
+	if stats := m.Migrations(); stats.Succeeded != 1 || stats.Failed != 1 {
+		t.Fatalf("unexpected migration stats: %+v", stats)
+	}
+	if again := m.MigrateSessions("worker-a"); len(again) != 0 {
+		t.Fatalf("expected sessions to be migrated only once, got %+v", again)
+	}
+}
+
+func TestWebRTCStatsAggregatesOnlineWorkers(t *testing.T) {
+	m := &Manager{
+		nodes:     make(map[string]*WorkerNode),
+		sessions:  make(map[string]*SignalingSession),
+		taskNodes: make(map[string]map[string]bool),
+	}
+	for _, id := range []string{"worker-a", "worker-b", "worker-c", "worker-d"} {
+		m.RegisterNode(&WorkerNode{ID: id})
+	}
+	m.UpdateNodeMetrics("worker-a", map[string]interface{}{"webrtc_sessions": 3.0, "webrtc_bytes_sent": 3000.0, "webrtc_avg_rtt_ms": 10.0})
+	m.UpdateNodeMetrics("worker-b", map[string]interface{}{"webrtc_sessions": 1.0, "webrtc_bytes_sent": 500.0, "webrtc_avg_rtt_ms": 50.0})
+	m.UpdateNodeMetrics("worker-c", map[string]interface{}{"webrtc_sessions": 5.0, "webrtc_bytes_sent": 9000.0})
+	m.nodes["worker-c"].Status = "offline"
+	// worker-d does not report WebRTC metrics yet
+
+	stats := m.WebRTCStats()
+	if stats.ActiveSessionCount != 4 || stats.TotalBytesSent != 3500 {
+		t.Fatalf("expected 4 sessions and 3500 bytes from the online workers, got %+v", stats)
+	}
+	if stats.AvgRTTMs != 20 {
+		t.Fatalf("expected the session-weighted RTT 20ms, got %v", stats.AvgRTTMs)
+	}
+}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the gateway/worker protocol version spoken by this
+// gateway; MinProtocolVersion is the oldest worker version still accepted.
+// Version 2 added task logs, policy checks, summaries, pruning, traffic
+// reports, piece maps, pinning and local media transcoding; version 3 added
+// task_submit_response acknowledgements for task submissions; version 4 added
+// task_retry for manually retrying failed tasks; version 5 added ice_resend for
+// re-sending the local ICE candidates of a stuck session; version 6 added
+// file_fetch for ranged reads of task output files; version 7 added
+// set_priority for reordering a worker's download queue; version 8 added
+// close_session for releasing the sessions of clients that went away;
+// version 9 added boost_task for moving a watched task ahead in the
+// transcode queue; version 10 added repair_segment for verifying and
+// regenerating a single corrupted segment; version 11 added
+// get_session_stats for the transport statistics of a WebRTC session;
+// version 12 added task_pause, task_resume and task_remove; version 13 added
+// get_queues for the contents of the download and transcode queues; version
+// 14 added pause_all and resume_all for manual quiet mode; version 15 added
+// webrtc_offer_failed, sent by workers when an offer cannot connect; version
+// 16 added get_torrent_info for listing a torrent's files without
+// downloading it; version 17 added clock_sync, the worker's answer to the
+// gateway clock sent with registration_confirmed; version 18 added
+// get_task_access for per-task segment access statistics; version 19 added
+// webrtc_probe for speed probe sessions, answered with probe_result; version
+// 20 added select_files for changing the files a download fetches; version 21
+// added get_stream_token for per-task stream tokens, which file_fetch checks
+// when it carries stream_token, and file_fetch names in rendition
+// sub-directories; version 22 added purge_files to task_remove for keeping a
+// removed task's files; version 23 added set_rate_limit for changing a
+// worker's torrent rate limits at runtime, and srts in tasks_response and
+// task_detail_response changed from subtitle paths to {path, language, index,
+// format} objects; version 24 added sequential to task_submit for turning
+// sequential streaming on or off per task.
+const (
+	ProtocolVersion    = 24
+	MinProtocolVersion = 1
+)
+
+// LegacyProtocolVersion is assumed for workers that do not announce a version.
+const LegacyProtocolVersion = 1
+
+// ErrIncompatibleProtocol is returned when the version ranges do not overlap.
+var ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+
+// messageVersions lists message types introduced after protocol version 1.
+var messageVersions = map[string]int{
+	"get_task_log":      2,
+	"task_policy_check": 2,
+	"prune_task_data":   2,
+	"get_task_pieces":   2,
+	"task_pin":          2,
+	"list_local_media":  2,
+	"transcode_local":   2,
+
+	"task_submit_response": 3,
+
+	"task_retry": 4,
+
+	"ice_resend": 5,
+
+	"file_fetch": 6,
+
+	"set_priority": 7,
+
+	"close_session": 8,
+
+	"boost_task": 9,
+
+	"repair_segment": 10,
+
+	"get_session_stats": 11,
+
+	"task_pause":  12,
+	"task_resume": 12,
+	"task_remove": 12,
+
+	"get_queues": 13,
+
+	"pause_all":  14,
+	"resume_all": 14,
+
+	"get_torrent_info": 16,
+
+	"get_task_access": 18,
+
+	"webrtc_probe": 19,
+
+	"select_files": 20,
+
+	"get_stream_token": 21,
+
+	"set_rate_limit": 23,
+}
+
+// fieldVersions lists optional fields added to existing messages after the
+// message itself, keyed by "<message>.<field>". Workers older than the listed
+// version ignore the field, or for fields they send, send its older format.
+var fieldVersions = map[string]int{
+	"task_remove.purge_files": 22,
+
+	"tasks_response.srts":       23,
+	"task_detail_response.srts": 23,
+
+	"task_submit.sequential": 24,
+}
+
+// NegotiateProtocol picks the highest version supported by both the gateway
+// and a worker announcing the range [minVersion, version]. Zero values are
+// treated as a legacy worker.
+func NegotiateProtocol(version, minVersion int) (int, error) {
+	if version <= 0 {
+		version = LegacyProtocolVersion
+	}
+	if minVersion <= 0 || minVersion > version {
+		minVersion = version
+	}
+
+	negotiated := version
+	if negotiated > ProtocolVersion {
+		negotiated = ProtocolVersion
+	}
+	if negotiated < MinProtocolVersion || negotiated < minVersion {
+		return 0, fmt.Errorf("%w: worker supports %d-%d, gateway supports %d-%d",
+			ErrIncompatibleProtocol, minVersion, version, MinProtocolVersion, ProtocolVersion)
+	}
+	return negotiated, nil
+}
+
+// SupportsMessage reports whether a message type may be sent to a worker
+// that negotiated the given protocol version.
+func SupportsMessage(version int, msgType string) bool {
+	required, ok := messageVersions[msgType]
+	if !ok {
+		required = LegacyProtocolVersion
+	}
+	return version >= required
+}
+
+// SupportsField reports whether a worker that negotiated the given protocol
+// version honours an optional field of a message type.
+func SupportsField(version int, msgType, field string) bool {
+	required, ok := fieldVersions[msgType+"."+field]
+	if !ok {
+		return SupportsMessage(version, msgType)
+	}
+	return version >= required
+}
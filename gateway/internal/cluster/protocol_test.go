@@ -0,0 +1,63 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	cases := []struct {
+		name       string
+		version    int
+		minVersion int
+		want       int
+		wantErr    bool
+	}{
+		{name: "same version", version: ProtocolVersion, minVersion: MinProtocolVersion, want: ProtocolVersion},
+		{name: "legacy worker", version: 0, minVersion: 0, want: LegacyProtocolVersion},
+		{name: "newer worker downgrades", version: ProtocolVersion + 1, minVersion: MinProtocolVersion, want: ProtocolVersion},
+		{name: "worker requires newer gateway", version: ProtocolVersion + 2, minVersion: ProtocolVersion + 1, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NegotiateProtocol(tc.version, tc.minVersion)
+			if tc.wantErr {
+				if !errors.Is(err, ErrIncompatibleProtocol) {
+					t.Fatalf("expected incompatible protocol error, got %d, %v", got, err)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("expected version %d, got %d, %v", tc.want, got, err)
+			}
+		})
+	}
+}
+
+func TestSupportsMessage(t *testing.T) {
+	if !SupportsMessage(LegacyProtocolVersion, "get_tasks") {
+		t.Fatalf("expected legacy workers to support get_tasks")
+	}
+	if SupportsMessage(LegacyProtocolVersion, "get_task_pieces") {
+		t.Fatalf("expected legacy workers not to support get_task_pieces")
+	}
+	if !SupportsMessage(ProtocolVersion, "get_task_pieces") {
+		t.Fatalf("expected current workers to support get_task_pieces")
+	}
+}
+
+func TestSupportsField(t *testing.T) {
+	if SupportsField(21, "task_remove", "purge_files") {
+		t.Fatalf("expected version 21 workers to ignore purge_files")
+	}
+	if !SupportsField(22, "task_remove", "purge_files") {
+		t.Fatalf("expected version 22 workers to honour purge_files")
+	}
+	if !SupportsField(12, "task_pause", "task_id") || SupportsField(11, "task_pause", "task_id") {
+		t.Fatalf("expected unlisted fields to follow their message")
+	}
+	if SupportsField(22, "task_detail_response", "srts") || !SupportsField(23, "tasks_response", "srts") {
+		t.Fatalf("expected srts objects from version 23 workers only")
+	}
+}
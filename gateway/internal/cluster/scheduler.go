@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+// Scheduling algorithms used by SelectWorker.
+const (
+	// SchedulingWeighted picks the online node with the highest score, taking
+	// turns among nodes with the same score.
+	SchedulingWeighted = "weighted"
+	// SchedulingRandom picks any eligible online node, for A/B comparisons.
+	SchedulingRandom = "random"
+)
+
+// ErrNoWorkerAvailable is returned by SelectWorker when no online node has the
+// required capabilities.
+var ErrNoWorkerAvailable = errors.New("no online worker with the required capabilities")
+
+// SetSchedulingAlgorithm selects how SelectWorker picks a node. Unknown values
+// fall back to SchedulingWeighted.
+func (m *Manager) SetSchedulingAlgorithm(algorithm string) {
+	if algorithm != SchedulingRandom {
+		algorithm = SchedulingWeighted
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.scheduling = algorithm
+}
+
+// SelectWorker picks an online node that has every capability in requiredCaps.
+// Nodes that recently rejected a download for lack of disk space are skipped
+// unless every eligible node is in that state. With the weighted algorithm the
+// node with the highest nodeScore wins and nodes with equal scores are picked
+// in turn.
+func (m *Manager) SelectWorker(requiredCaps []string) (*WorkerNode, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var eligible []*WorkerNode
+	for _, node := range m.nodes {
+		if node.Status == "online" && node.HasCapabilities(requiredCaps) {
+			eligible = append(eligible, node)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, ErrNoWorkerAvailable
+	}
+	eligible = withoutDiskShort(withoutQuiet(eligible))
+	sort.Slice(eligible, func(i, j int) bool { return eligible[i].ID < eligible[j].ID })
+
+	if m.scheduling == SchedulingRandom {
+		return eligible[rand.Intn(len(eligible))], nil
+	}
+
+	var best []*WorkerNode
+	var bestScore float64
+	for _, node := range eligible {
+		score := nodeScore(node)
+		switch {
+		case len(best) == 0 || score > bestScore:
+			best, bestScore = []*WorkerNode{node}, score
+		case score == bestScore:
+			best = append(best, node)
+		}
+	}
+	node := best[m.scheduleTurn%len(best)]
+	m.scheduleTurn++
+	return node, nil
+}
+
+// nodeScore weighs free disk space against free download slots:
+// disk_free_gb * 0.4 + (max_downloads - active_downloads) * 0.6. Free disk
+// comes from the heartbeat, or the announced disk_space_gb before the first one.
+func nodeScore(node *WorkerNode) float64 {
+	diskFree := node.DiskFreeGB
+	if _, reported := node.Metrics["disk_free_gb"]; !reported {
+		diskFree = float64(node.Resources["disk_space_gb"])
+	}
+	freeSlots := node.Resources["max_downloads"] - node.ActiveDownloads
+	return diskFree*0.4 + float64(freeSlots)*0.6
+}
+
+// withoutQuiet drops nodes in their quiet hours, keeping all of them when
+// every node is quiet so the submission queues on one until it wakes up.
+func withoutQuiet(nodes []*WorkerNode) []*WorkerNode {
+	var awake []*WorkerNode
+	for _, node := range nodes {
+		if !node.Quiet {
+			awake = append(awake, node)
+		}
+	}
+	if len(awake) == 0 {
+		return nodes
+	}
+	return awake
+}
+
+// withoutDiskShort drops nodes flagged DiskShort, keeping all of them when
+// none has enough space so the submission still lands somewhere.
+func withoutDiskShort(nodes []*WorkerNode) []*WorkerNode {
+	var roomy []*WorkerNode
+	for _, node := range nodes {
+		if !node.DiskShort {
+			roomy = append(roomy, node)
+		}
+	}
+	if len(roomy) == 0 {
+		return nodes
+	}
+	return roomy
+}
+
+// HasCapabilities reports whether the node offers every required capability.
+func (node *WorkerNode) HasCapabilities(required []string) bool {
+	for _, capability := range required {
+		found := false
+		for _, offered := range node.Capabilities {
+			if offered == capability {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newSchedulingManager registers ten workers with increasing free disk and
+// decreasing free download slots; worker-9 has the highest score.
+func newSchedulingManager() *Manager {
+	m := &Manager{
+		nodes:     make(map[string]*WorkerNode),
+		sessions:  make(map[string]*SignalingSession),
+		taskNodes: make(map[string]map[string]bool),
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("worker-%d", i)
+		m.RegisterNode(&WorkerNode{
+			ID:           id,
+			Capabilities: []string{"torrent", "transcode", "webrtc"},
+			Resources:    map[string]int{"max_downloads": 10},
+		})
+		m.UpdateNodeMetrics(id, map[string]interface{}{
+			"disk_free_gb":     float64(10 * i),
+			"active_downloads": float64(i * i / 4),
+		})
+	}
+	return m
+}
+
+func TestSelectWorkerPicksHighestScore(t *testing.T) {
+	m := newSchedulingManager()
+
+	// worker-9: 90*0.4 + (10-20)*0.6 = 30; worker-8: 80*0.4 + (10-16)*0.6 = 28.4
+	node, err := m.SelectWorker([]string{"torrent"})
+	if err != nil {
+		t.Fatalf("select worker: %v", err)
+	}
+	if node.ID != "worker-9" {
+		t.Fatalf("expected worker-9, got %s (score %.1f)", node.ID, nodeScore(node))
+	}
+
+	// A busier heartbeat moves the choice to the next best node.
+	m.UpdateNodeMetrics("worker-9", map[string]interface{}{"disk_free_gb": float64(90), "active_downloads": float64(30)})
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-8" {
+		t.Fatalf("expected worker-8 once worker-9 is busy, got %s", node.ID)
+	}
+	if got := m.nodes["worker-9"].ActiveDownloads; got != 30 {
+		t.Fatalf("expected active downloads from the heartbeat, got %d", got)
+	}
+}
+
+func TestSelectWorkerFiltersCapabilitiesAndOfflineNodes(t *testing.T) {
+	m := newSchedulingManager()
+	m.nodes["worker-9"].Status = "offline"
+	m.nodes["worker-3"].Capabilities = append(m.nodes["worker-3"].Capabilities, "torrent_v2")
+
+	node, err := m.SelectWorker([]string{"torrent", "torrent_v2"})
+	if err != nil || node.ID != "worker-3" {
+		t.Fatalf("expected the only torrent_v2 worker, got %v (%v)", node, err)
+	}
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-8" {
+		t.Fatalf("expected offline worker-9 to be skipped, got %s", node.ID)
+	}
+	if _, err := m.SelectWorker([]string{"gpu"}); err != ErrNoWorkerAvailable {
+		t.Fatalf("expected ErrNoWorkerAvailable, got %v", err)
+	}
+}
+
+func TestSelectWorkerAvoidsNodesShortOfDisk(t *testing.T) {
+	m := newSchedulingManager()
+	m.UpdateNodeMetrics("worker-9", map[string]interface{}{
+		"disk_free_gb":         float64(90),
+		"active_downloads":     float64(20),
+		"disk_available_bytes": float64(1 << 30),
+		"disk_required_bytes":  float64(4 << 30),
+	})
+	if !m.nodes["worker-9"].DiskShort {
+		t.Fatal("expected worker-9 to be flagged short of disk")
+	}
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-8" {
+		t.Fatalf("expected worker-8 while worker-9 is short of disk, got %s", node.ID)
+	}
+
+	// Once enough space is free again the node is picked as before.
+	m.UpdateNodeMetrics("worker-9", map[string]interface{}{
+		"disk_free_gb":         float64(90),
+		"active_downloads":     float64(20),
+		"disk_available_bytes": float64(8 << 30),
+		"disk_required_bytes":  float64(4 << 30),
+	})
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-9" {
+		t.Fatalf("expected worker-9 after space was freed, got %s", node.ID)
+	}
+
+	// When every node is short the best one is still picked.
+	for _, node := range m.nodes {
+		node.DiskShort = true
+	}
+	if node, err := m.SelectWorker(nil); err != nil || node.ID != "worker-9" {
+		t.Fatalf("expected worker-9 when every node is short, got %v (%v)", node, err)
+	}
+}
+
+func TestSelectWorkerAvoidsQuietNodes(t *testing.T) {
+	m := newSchedulingManager()
+	m.UpdateNodeMetrics("worker-9", map[string]interface{}{
+		"disk_free_gb":     float64(90),
+		"active_downloads": float64(20),
+		"state":            "quiet",
+	})
+	if !m.nodes["worker-9"].Quiet {
+		t.Fatal("expected worker-9 to be flagged quiet")
+	}
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-8" {
+		t.Fatalf("expected worker-8 while worker-9 is quiet, got %s", node.ID)
+	}
+
+	m.UpdateNodeMetrics("worker-9", map[string]interface{}{
+		"disk_free_gb":     float64(90),
+		"active_downloads": float64(20),
+		"state":            "active",
+	})
+	if node, _ := m.SelectWorker(nil); node.ID != "worker-9" {
+		t.Fatalf("expected worker-9 after its quiet hours, got %s", node.ID)
+	}
+
+	// When every node is quiet the best one is still picked.
+	for _, node := range m.nodes {
+		node.Quiet = true
+	}
+	if node, err := m.SelectWorker(nil); err != nil || node.ID != "worker-9" {
+		t.Fatalf("expected worker-9 when every node is quiet, got %v (%v)", node, err)
+	}
+}
+
+func TestSelectWorkerRotatesAmongEqualScores(t *testing.T) {
+	m := newSchedulingManager()
+	for _, node := range m.nodes {
+		m.UpdateNodeMetrics(node.ID, map[string]interface{}{"disk_free_gb": float64(50), "active_downloads": float64(2)})
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		node, err := m.SelectWorker(nil)
+		if err != nil {
+			t.Fatalf("select worker: %v", err)
+		}
+		picked[node.ID]++
+	}
+	if len(picked) != 10 {
+		t.Fatalf("expected equally scored workers to take turns, got %v", picked)
+	}
+	for id, count := range picked {
+		if count != 2 {
+			t.Fatalf("expected two picks each, %s got %d", id, count)
+		}
+	}
+}
+
+func TestSelectWorkerRandomStaysEligible(t *testing.T) {
+	m := newSchedulingManager()
+	m.SetSchedulingAlgorithm(SchedulingRandom)
+	m.nodes["worker-0"].Status = "offline"
+
+	for i := 0; i < 50; i++ {
+		node, err := m.SelectWorker([]string{"webrtc"})
+		if err != nil {
+			t.Fatalf("select worker: %v", err)
+		}
+		if node.ID == "worker-0" {
+			t.Fatal("random scheduling picked an offline worker")
+		}
+	}
+}
@@ -3,18 +3,51 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Config captures runtime options for the gateway service.
+// Config captures runtime options for the gateway service. Struct tags describe
+// each option for Schema: env is the overriding variable, default the value used
+// when it is unset, flag an optional command-line override.
 type Config struct {
-	Port              string
-	DBPath            string
-	SessionCookieName string
-	SessionTTL        time.Duration
-	StaticDir         string
-	AdminUsername     string
-	AdminPassword     string
+	Port              string        `json:"port" env:"GATEWAY_PORT" flag:"port" default:"8080" desc:"HTTP listen port"`
+	DBPath            string        `json:"db_path" env:"GATEWAY_DB_PATH" default:"gateway.db" desc:"SQLite database file"`
+	SessionCookieName string        `json:"session_cookie_name" env:"SESSION_COOKIE_NAME" default:"gateway_session" desc:"Name of the session cookie"`
+	SessionTTL        time.Duration `json:"session_ttl_hours" env:"SESSION_TTL_HOURS" default:"168" type:"hours" desc:"Session lifetime in hours"`
+	StaticDir         string        `json:"static_dir" env:"STATIC_DIR" default:"./static" desc:"Directory with the web UI files"`
+	AdminUsername     string        `json:"admin_username" env:"DEFAULT_ADMIN_USERNAME" default:"admin" desc:"Username of the admin account created on first start"`
+	AdminPassword     string        `json:"admin_password" env:"DEFAULT_ADMIN_PASSWORD" secret:"true" desc:"Password of the admin account created on first start"`
+	// Blocked requests within PolicyFlagWindow before a user is flagged for review (0 disables).
+	PolicyFlagThreshold int           `json:"policy_flag_threshold" env:"POLICY_FLAG_THRESHOLD" default:"3" desc:"Blocked submissions within the flag window before a user is flagged for review; 0 disables"`
+	PolicyFlagWindow    time.Duration `json:"policy_flag_window_hours" env:"POLICY_FLAG_WINDOW_HOURS" default:"24" type:"hours" desc:"Window for counting blocked submissions, in hours"`
+	// Outbound request limiting per worker, so dashboards polling task lists cannot starve small nodes.
+	NodeRequestRate       int `json:"node_request_rate" env:"NODE_REQUEST_RATE" default:"5" desc:"Requests per second the gateway sends to a single worker; 0 disables limiting"`
+	NodeRequestBurst      int `json:"node_request_burst" env:"NODE_REQUEST_BURST" default:"10" desc:"Burst of requests allowed above the per-worker rate"`
+	NodeRequestMaxDelayMS int `json:"node_request_max_delay_ms" env:"NODE_REQUEST_MAX_DELAY_MS" default:"2000" desc:"Longest a request waits for a rate-limited worker before cached data or a busy error is returned, in milliseconds"`
+	// What to do when a submitted magnet's info hash is already active on some worker.
+	DuplicateSubmitMode string `json:"duplicate_submit_mode" env:"DUPLICATE_SUBMIT_MODE" default:"existing" desc:"Handling of magnets already active in the cluster: existing returns the existing task, route submits to the worker holding it, off disables cluster-wide dedupe"`
+	// What to do with submissions when every worker is at its max_downloads.
+	AdmissionMode              string `json:"admission_mode" env:"ADMISSION_MODE" default:"queue" desc:"Handling of submissions when every worker is at capacity: queue holds them at the gateway as pending_dispatch, reject answers 503 with Retry-After, off submits anyway"`
+	AdmissionRetryAfterSeconds int    `json:"admission_retry_after_seconds" env:"ADMISSION_RETRY_AFTER_SECONDS" default:"30" desc:"Retry-After sent with rejected submissions in reject mode, in seconds"`
+	// How the gateway picks a worker when a submission or offer names none.
+	SchedulingAlgorithm string `json:"scheduling_algorithm" env:"SCHEDULING_ALGORITHM" default:"weighted" desc:"Worker selection when a request has no worker_id: weighted scores free disk and download slots, random picks any eligible worker"`
+	// Worker clock skew above which the gateway logs a warning and flags the node.
+	ClockSkewWarnSeconds int `json:"clock_skew_warn_seconds" env:"CLOCK_SKEW_WARN_SECONDS" default:"30" desc:"Difference between a worker's clock and the gateway's above which the node is flagged and a warning logged, in seconds; 0 disables"`
+	// Submissions allowed per client IP within a sliding window, so one client cannot flood the worker queues.
+	RateLimitRequests  int `json:"rate_limit_requests" env:"RATE_LIMIT_REQUESTS" default:"10" desc:"Task submissions allowed per client IP within the rate limit window; 0 disables limiting"`
+	RateLimitWindowSec int `json:"rate_limit_window_sec" env:"RATE_LIMIT_WINDOW_SEC" default:"60" desc:"Length of the sliding window for submission rate limiting, in seconds; must be positive, 0 or invalid values fall back to 60"`
+	// Reverse proxies whose X-Forwarded-For header names the client IP; without them clients could pick their own rate limit key.
+	TrustedProxies string `json:"trusted_proxies" env:"TRUSTED_PROXIES" default:"" desc:"Comma-separated IPs or CIDRs of reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted for the client IP; empty uses the connection's remote address"`
+	// HTTP server timeouts, so slow clients cannot hold connections open indefinitely.
+	// WebSocket connections clear them once upgraded.
+	HTTPReadHeaderTimeoutSeconds int `json:"http_read_header_timeout_seconds" env:"HTTP_READ_HEADER_TIMEOUT_SECONDS" default:"10" desc:"Time allowed to read request headers, in seconds; 0 disables"`
+	HTTPReadTimeoutSeconds       int `json:"http_read_timeout_seconds" env:"HTTP_READ_TIMEOUT_SECONDS" default:"30" desc:"Time allowed to read a whole request including the body, in seconds; 0 disables"`
+	HTTPWriteTimeoutSeconds      int `json:"http_write_timeout_seconds" env:"HTTP_WRITE_TIMEOUT_SECONDS" default:"60" desc:"Time allowed to write a response, in seconds; must exceed the longest wait for worker responses; 0 disables"`
+	HTTPIdleTimeoutSeconds       int `json:"http_idle_timeout_seconds" env:"HTTP_IDLE_TIMEOUT_SECONDS" default:"120" desc:"How long an idle keep-alive connection stays open, in seconds; 0 disables"`
+	// Retries of signaling and task messages the gateway fails to write to a worker or client.
+	ForwardMaxRetries     int `json:"forward_max_retries" env:"FORWARD_MAX_RETRIES" default:"2" desc:"Retries of a message whose write to a worker or client failed, made on the peer's new connection after it reconnects; 0 disables"`
+	ForwardRetryBackoffMS int `json:"forward_retry_backoff_ms" env:"FORWARD_RETRY_BACKOFF_MS" default:"50" desc:"Wait before the first forwarding retry, doubled for each further retry, in milliseconds"`
 }
 
 // Load assembles configuration from flags and environment variables.
@@ -29,6 +62,25 @@ func Load(portFlag string) Config {
 	}
 
 	cfg.SessionTTL = parseDurationHours(pickFirst(os.Getenv("SESSION_TTL_HOURS"), "168")) // one week
+	cfg.PolicyFlagThreshold = parseNonNegativeInt(pickFirst(os.Getenv("POLICY_FLAG_THRESHOLD"), "3"), 3)
+	cfg.PolicyFlagWindow = parseDurationHours(pickFirst(os.Getenv("POLICY_FLAG_WINDOW_HOURS"), "24"))
+	cfg.NodeRequestRate = parseNonNegativeInt(pickFirst(os.Getenv("NODE_REQUEST_RATE"), "5"), 5)
+	cfg.NodeRequestBurst = parseNonNegativeInt(pickFirst(os.Getenv("NODE_REQUEST_BURST"), "10"), 10)
+	cfg.NodeRequestMaxDelayMS = parseNonNegativeInt(pickFirst(os.Getenv("NODE_REQUEST_MAX_DELAY_MS"), "2000"), 2000)
+	cfg.DuplicateSubmitMode = parseChoice(os.Getenv("DUPLICATE_SUBMIT_MODE"), "existing", "existing", "route", "off")
+	cfg.AdmissionMode = parseChoice(os.Getenv("ADMISSION_MODE"), "queue", "queue", "reject", "off")
+	cfg.AdmissionRetryAfterSeconds = parseNonNegativeInt(pickFirst(os.Getenv("ADMISSION_RETRY_AFTER_SECONDS"), "30"), 30)
+	cfg.SchedulingAlgorithm = parseChoice(os.Getenv("SCHEDULING_ALGORITHM"), "weighted", "weighted", "random")
+	cfg.ClockSkewWarnSeconds = parseNonNegativeInt(pickFirst(os.Getenv("CLOCK_SKEW_WARN_SECONDS"), "30"), 30)
+	cfg.RateLimitRequests = parseNonNegativeInt(pickFirst(os.Getenv("RATE_LIMIT_REQUESTS"), "10"), 10)
+	cfg.RateLimitWindowSec = parsePositiveInt(pickFirst(os.Getenv("RATE_LIMIT_WINDOW_SEC"), "60"), 60)
+	cfg.TrustedProxies = os.Getenv("TRUSTED_PROXIES")
+	cfg.HTTPReadHeaderTimeoutSeconds = parseNonNegativeInt(pickFirst(os.Getenv("HTTP_READ_HEADER_TIMEOUT_SECONDS"), "10"), 10)
+	cfg.HTTPReadTimeoutSeconds = parseNonNegativeInt(pickFirst(os.Getenv("HTTP_READ_TIMEOUT_SECONDS"), "30"), 30)
+	cfg.HTTPWriteTimeoutSeconds = parseNonNegativeInt(pickFirst(os.Getenv("HTTP_WRITE_TIMEOUT_SECONDS"), "60"), 60)
+	cfg.HTTPIdleTimeoutSeconds = parseNonNegativeInt(pickFirst(os.Getenv("HTTP_IDLE_TIMEOUT_SECONDS"), "120"), 120)
+	cfg.ForwardMaxRetries = parseNonNegativeInt(pickFirst(os.Getenv("FORWARD_MAX_RETRIES"), "2"), 2)
+	cfg.ForwardRetryBackoffMS = parseNonNegativeInt(pickFirst(os.Getenv("FORWARD_RETRY_BACKOFF_MS"), "50"), 50)
 
 	return cfg
 }
@@ -49,3 +101,41 @@ func parseDurationHours(raw string) time.Duration {
 	}
 	return time.Duration(hours) * time.Hour
 }
+
+// parseChoice returns raw when it is one of choices and fallback otherwise.
+func parseChoice(raw, fallback string, choices ...string) string {
+	for _, choice := range choices {
+		if raw == choice {
+			return raw
+		}
+	}
+	return fallback
+}
+
+func parseNonNegativeInt(raw string, fallback int) int {
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// parsePositiveInt is parseNonNegativeInt for options where zero is not meaningful.
+func parsePositiveInt(raw string, fallback int) int {
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// ProxyList splits TrustedProxies into its entries, dropping blanks.
+func (c Config) ProxyList() []string {
+	var proxies []string
+	for _, entry := range strings.Split(c.TrustedProxies, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			proxies = append(proxies, entry)
+		}
+	}
+	return proxies
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SchemaField describes one configuration option for operators and provisioning tools.
+type SchemaField struct {
+	Field       string  `json:"field"`
+	Type        string  `json:"type"`
+	Default     *string `json:"default"` // as written in the environment; null for secrets
+	Env         string  `json:"env"`
+	Flag        string  `json:"flag,omitempty"`
+	Secret      bool    `json:"secret,omitempty"`
+	Description string  `json:"description"`
+}
+
+// Schema lists every Config option from its struct tags.
+func Schema() []SchemaField {
+	t := reflect.TypeOf(Config{})
+	fields := make([]SchemaField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		entry := SchemaField{
+			Field:       name,
+			Type:        field.Tag.Get("type"),
+			Env:         field.Tag.Get("env"),
+			Flag:        field.Tag.Get("flag"),
+			Secret:      field.Tag.Get("secret") == "true",
+			Description: field.Tag.Get("desc"),
+		}
+		if entry.Type == "" {
+			entry.Type = schemaType(field.Type.Kind())
+		}
+		if value, ok := field.Tag.Lookup("default"); ok && !entry.Secret {
+			entry.Default = &value
+		}
+		fields = append(fields, entry)
+	}
+	return fields
+}
+
+func schemaType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	default:
+		return kind.String()
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEveryConfigFieldIsDocumented(t *testing.T) {
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Tag.Get("desc") == "" {
+			t.Errorf("Config.%s has no desc tag", field.Name)
+		}
+		if field.Tag.Get("env") == "" {
+			t.Errorf("Config.%s has no env tag", field.Name)
+		}
+	}
+}
+
+func TestSchemaDefaultsMatchLoad(t *testing.T) {
+	byEnv := make(map[string]SchemaField)
+	for _, field := range Schema() {
+		t.Setenv(field.Env, "")
+		byEnv[field.Env] = field
+	}
+
+	cfg := reflect.ValueOf(Load(""))
+	typ := cfg.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := byEnv[typ.Field(i).Tag.Get("env")]
+		if field.Secret {
+			if field.Default != nil {
+				t.Errorf("%s: secret default must not be exposed", field.Field)
+			}
+			continue
+		}
+		if field.Default == nil {
+			t.Errorf("%s: missing default", field.Field)
+			continue
+		}
+
+		var got string
+		switch value := cfg.Field(i).Interface().(type) {
+		case time.Duration:
+			got = fmt.Sprint(int(value.Hours()))
+		default:
+			got = fmt.Sprint(value)
+		}
+		if got != *field.Default {
+			t.Errorf("%s: schema default %q, Load uses %q", field.Field, *field.Default, got)
+		}
+	}
+}
+
+func TestRateLimitWindowMustBePositive(t *testing.T) {
+	for raw, want := range map[string]int{"0": 60, "-5": 60, "abc": 60, "30": 30} {
+		t.Setenv("RATE_LIMIT_WINDOW_SEC", raw)
+		if got := Load("").RateLimitWindowSec; got != want {
+			t.Errorf("RATE_LIMIT_WINDOW_SEC=%q: expected %d, got %d", raw, want, got)
+		}
+	}
+}
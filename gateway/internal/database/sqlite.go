@@ -40,6 +40,34 @@ func Migrate(db *sql.DB) error {
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS tasks (
+			task_id TEXT PRIMARY KEY,
+			worker_id TEXT NOT NULL,
+			owner_id INTEGER,
+			status TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY(owner_id) REFERENCES users(id) ON DELETE SET NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS blocklist_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			pattern TEXT NOT NULL,
+			created_by INTEGER,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(kind, pattern)
+		);`,
+		`CREATE TABLE IF NOT EXISTS policy_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			task_id TEXT NOT NULL DEFAULT '',
+			info_hash TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL DEFAULT '',
+			rule_id INTEGER,
+			reason TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
 	}
 
 	for _, stmt := range schema {
@@ -48,6 +76,28 @@ func Migrate(db *sql.DB) error {
 		}
 	}
 
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"users", "flagged_for_review", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "expires_at", "DATETIME"},
+		{"users", "submit_disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "preferences", "TEXT"},
+		{"tasks", "summary", "TEXT"},
+		{"tasks", "bytes_downloaded", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "bytes_served", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "info_hash", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if err := addColumnIfMissing(db, col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_info_hash ON tasks(info_hash)`); err != nil {
+		return err
+	}
+
 	// simple vacuum to keep file compact
 	_, _ = db.Exec("PRAGMA journal_mode=WAL;")
 	_, _ = db.Exec("PRAGMA busy_timeout=5000;")
@@ -55,3 +105,35 @@ func Migrate(db *sql.DB) error {
 
 	return nil
 }
+
+// addColumnIfMissing adds a column to an existing table; SQLite lacks ADD COLUMN IF NOT EXISTS.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
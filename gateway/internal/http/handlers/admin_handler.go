@@ -1,21 +1,33 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"magnetm3u8-gateway/internal/auth"
+	"magnetm3u8-gateway/internal/config"
 	"magnetm3u8-gateway/internal/user"
 )
 
 // AdminHandler serves admin-only APIs.
 type AdminHandler struct {
-	users *user.Repository
+	users   *user.Repository
+	service *auth.Service
+	now     func() time.Time
 }
 
-func NewAdminHandler(repo *user.Repository) *AdminHandler {
-	return &AdminHandler{users: repo}
+func NewAdminHandler(repo *user.Repository, service *auth.Service) *AdminHandler {
+	return &AdminHandler{users: repo, service: service, now: time.Now}
+}
+
+// adminUser adds the remaining validity of guest accounts to the user list.
+type adminUser struct {
+	user.User
+	RemainingSeconds *int64 `json:"remaining_seconds,omitempty"`
 }
 
 func (h *AdminHandler) ListUsers(c *gin.Context) {
@@ -25,7 +37,79 @@ func (h *AdminHandler) ListUsers(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "data": accounts})
+	now := h.now()
+	result := make([]adminUser, 0, len(accounts))
+	for _, account := range accounts {
+		entry := adminUser{User: account}
+		if account.IsGuest() {
+			remaining := int64(account.ExpiresAt.Sub(now).Seconds())
+			if remaining < 0 {
+				remaining = 0
+			}
+			entry.RemainingSeconds = &remaining
+		}
+		result = append(result, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": result})
+}
+
+// CreateGuest creates a time-limited guest account.
+func (h *AdminHandler) CreateGuest(c *gin.Context) {
+	var payload CreateGuestRequest
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
+		return
+	}
+	if payload.ExpiresAt.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "访客账号必须设置过期时间"})
+		return
+	}
+
+	account, err := h.service.CreateGuest(c.Request.Context(), payload.Username, payload.Password, payload.ExpiresAt.Time, payload.SubmitDisabled)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"success": true, "data": sanitizeUser(account)})
+}
+
+// UpdateExpiry extends a guest account, or converts it to a permanent user when
+// expires_at is null. Regular accounts cannot be given an expiry.
+func (h *AdminHandler) UpdateExpiry(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "用户ID无效"})
+		return
+	}
+
+	var payload ExpiryRequest
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
+		return
+	}
+	if !payload.ExpiresAt.IsZero() && !payload.ExpiresAt.After(h.now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "过期时间必须晚于当前时间"})
+		return
+	}
+
+	if err := h.users.SetExpiry(c.Request.Context(), userID, payload.ExpiresAt.Time); err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "用户不存在"})
+			return
+		}
+		if errors.Is(err, user.ErrNotGuest) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "只能修改访客账号的有效期"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "更新状态失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func (h *AdminHandler) UpdateBanState(c *gin.Context) {
@@ -36,9 +120,7 @@ func (h *AdminHandler) UpdateBanState(c *gin.Context) {
 		return
 	}
 
-	var payload struct {
-		Banned bool `json:"banned"`
-	}
+	var payload BanRequest
 
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
@@ -52,3 +134,53 @@ func (h *AdminHandler) UpdateBanState(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
+
+// UpdateFlagState clears or sets the repeat-offender review flag.
+func (h *AdminHandler) UpdateFlagState(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "用户ID无效"})
+		return
+	}
+
+	var payload FlagRequest
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
+		return
+	}
+
+	if err := h.users.SetFlagged(c.Request.Context(), userID, payload.Flagged); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "更新状态失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// UserPreferences shows a user's submission defaults for support; admins
+// cannot change them.
+func (h *AdminHandler) UserPreferences(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "用户ID无效"})
+		return
+	}
+
+	preferences, err := h.users.GetPreferences(c.Request.Context(), userID)
+	if errors.Is(err, user.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "无法加载偏好设置"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": preferences})
+}
+
+// ConfigSchema describes every gateway configuration option (env variable, default, description).
+func (h *AdminHandler) ConfigSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": config.Schema()})
+}
@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+// AdmissionMode 决定集群所有节点的下载名额都用完时如何处理新的提交
+type AdmissionMode string
+
+const (
+	// AdmissionQueue 在网关排队（pending_dispatch），有节点空出名额后再分派
+	AdmissionQueue AdmissionMode = "queue"
+	// AdmissionReject 返回503和Retry-After，由客户端稍后重试
+	AdmissionReject AdmissionMode = "reject"
+	// AdmissionOff 不检查容量，直接提交给节点
+	AdmissionOff AdmissionMode = "off"
+)
+
+// StatusPendingDispatch 在网关排队、尚未分派到节点的任务状态
+const StatusPendingDispatch = "pending_dispatch"
+
+// dispatchInterval 检查分派队列的间隔；节点心跳、上报任务状态时也会立即检查
+const dispatchInterval = 2 * time.Second
+
+// defaultAdmissionRetryAfter reject模式下未配置时建议客户端等待的时长
+const defaultAdmissionRetryAfter = 30 * time.Second
+
+// AdmissionOptions 集群满载时的准入控制
+type AdmissionOptions struct {
+	Mode       AdmissionMode
+	RetryAfter time.Duration // reject模式下Retry-After的时长
+}
+
+// DispatchStats 网关分派队列的统计
+type DispatchStats struct {
+	Mode          AdmissionMode `json:"mode"`
+	QueueDepth    int           `json:"queue_depth"`     // 正在排队的任务数
+	QueuedByOwner map[int64]int `json:"queued_by_owner"` // 各用户排队的任务数
+	Dispatched    int64         `json:"dispatched"`      // 排队后成功分派的任务数
+	Failed        int64         `json:"failed"`          // 分派后被节点拒绝的任务数
+	Rejected      int64         `json:"rejected"`        // reject模式下拒绝的提交数
+	OldestWaitMS  int64         `json:"oldest_wait_ms"`  // 队列中最早的任务已等待的时长
+	LastWaitMS    int64         `json:"last_wait_ms"`    // 最近一次分派的任务排队的时长
+	AvgWaitMS     int64         `json:"avg_wait_ms"`     // 已分派任务的平均排队时长
+	MaxWaitMS     int64         `json:"max_wait_ms"`     // 已分派任务的最长排队时长
+}
+
+// queuedSubmission 在网关排队的提交，payload即发给节点的task_submit内容
+type queuedSubmission struct {
+	ID       string // 排队期间的任务ID，分派后由节点分配的ID取代
+	OwnerID  int64
+	WorkerID string // 提交时指定的节点，有空闲名额时优先分派到该节点
+	InfoHash string
+	TraceID  string
+	Payload  map[string]interface{}
+	QueuedAt time.Time
+}
+
+// dispatchQueue 按用户轮转出队的提交队列：每个用户各自先进先出，
+// 用户之间轮流分派，一个用户一次提交很多任务也不会让其他用户一直等待
+type dispatchQueue struct {
+	mu      sync.Mutex
+	owners  []int64 // 有排队任务的用户，按首次排队的顺序
+	next    int     // 下一个出队的用户在owners中的位置
+	pending map[int64][]*queuedSubmission
+
+	dispatched int64
+	failed     int64
+	rejected   int64
+	lastWait   time.Duration
+	totalWait  time.Duration
+	maxWait    time.Duration
+}
+
+func newDispatchQueue() *dispatchQueue {
+	return &dispatchQueue{pending: make(map[int64][]*queuedSubmission)}
+}
+
+// push 加入队列，返回按轮转顺序的排队位置（从1开始）
+func (q *dispatchQueue) push(item *queuedSubmission) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[item.OwnerID]; !ok {
+		q.owners = append(q.owners, item.OwnerID)
+	}
+	q.pending[item.OwnerID] = append(q.pending[item.OwnerID], item)
+	return q.position(item.ID)
+}
+
+// pop 取出下一个分派的任务，队列为空时返回nil
+func (q *dispatchQueue) pop() *queuedSubmission {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.owners) == 0 {
+		return nil
+	}
+	if q.next >= len(q.owners) {
+		q.next = 0
+	}
+	owner := q.owners[q.next]
+	items := q.pending[owner]
+	item := items[0]
+	if len(items) == 1 {
+		delete(q.pending, owner)
+		q.owners = append(q.owners[:q.next], q.owners[q.next+1:]...)
+	} else {
+		q.pending[owner] = items[1:]
+		q.next++
+	}
+	return item
+}
+
+// requeue 分派失败的任务放回原位：回到该用户队列的最前面，并由该用户先出队
+func (q *dispatchQueue) requeue(item *queuedSubmission) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.next >= len(q.owners) {
+		q.next = 0
+	}
+	for i, owner := range q.owners {
+		if owner == item.OwnerID {
+			q.pending[owner] = append([]*queuedSubmission{item}, q.pending[owner]...)
+			q.next = i
+			return
+		}
+	}
+	q.owners = append(q.owners[:q.next], append([]int64{item.OwnerID}, q.owners[q.next:]...)...)
+	q.pending[item.OwnerID] = []*queuedSubmission{item}
+}
+
+// len 排队的任务数
+func (q *dispatchQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for _, items := range q.pending {
+		count += len(items)
+	}
+	return count
+}
+
+// list 按分派顺序列出排队的任务
+func (q *dispatchQueue) list() []*queuedSubmission {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.order()
+}
+
+// order 模拟轮转出队得到的分派顺序，调用方持有锁
+func (q *dispatchQueue) order() []*queuedSubmission {
+	offsets := make([]int, len(q.owners))
+	var ordered []*queuedSubmission
+	for remaining := true; remaining; {
+		remaining = false
+		for i := range q.owners {
+			index := (q.next + i) % len(q.owners)
+			items := q.pending[q.owners[index]]
+			if offsets[index] < len(items) {
+				ordered = append(ordered, items[offsets[index]])
+				offsets[index]++
+				remaining = true
+			}
+		}
+	}
+	return ordered
+}
+
+// position 任务在分派顺序中的位置（从1开始），调用方持有锁
+func (q *dispatchQueue) position(id string) int {
+	for i, item := range q.order() {
+		if item.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// recordDispatched 记录一次成功分派及其排队时长
+func (q *dispatchQueue) recordDispatched(wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.dispatched++
+	q.lastWait = wait
+	q.totalWait += wait
+	if wait > q.maxWait {
+		q.maxWait = wait
+	}
+}
+
+func (q *dispatchQueue) recordFailed() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failed++
+}
+
+func (q *dispatchQueue) recordRejected() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rejected++
+}
+
+// stats 队列深度与排队时长统计
+func (q *dispatchQueue) stats(now time.Time) DispatchStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := DispatchStats{
+		QueuedByOwner: make(map[int64]int, len(q.pending)),
+		Dispatched:    q.dispatched,
+		Failed:        q.failed,
+		Rejected:      q.rejected,
+		LastWaitMS:    q.lastWait.Milliseconds(),
+		MaxWaitMS:     q.maxWait.Milliseconds(),
+	}
+	if q.dispatched > 0 {
+		stats.AvgWaitMS = (q.totalWait / time.Duration(q.dispatched)).Milliseconds()
+	}
+	for owner, items := range q.pending {
+		stats.QueueDepth += len(items)
+		stats.QueuedByOwner[owner] = len(items)
+		if wait := now.Sub(items[0].QueuedAt).Milliseconds(); wait > stats.OldestWaitMS {
+			stats.OldestWaitMS = wait
+		}
+	}
+	return stats
+}
+
+// SetAdmission 设置集群满载时的处理方式，未知的取值按queue处理
+func (gc *GatewayController) SetAdmission(options AdmissionOptions) {
+	switch options.Mode {
+	case AdmissionQueue, AdmissionReject, AdmissionOff:
+	default:
+		options.Mode = AdmissionQueue
+	}
+	if options.RetryAfter <= 0 {
+		options.RetryAfter = defaultAdmissionRetryAfter
+	}
+	gc.admission = options
+}
+
+// failStaleQueuedTasks 排队只保存在内存中，网关重启后把上次遗留的排队任务标记为失败，用户可以重新提交
+func (gc *GatewayController) failStaleQueuedTasks() {
+	if gc.tasks == nil {
+		return
+	}
+	count, err := gc.tasks.ReplaceStatus(context.Background(), StatusPendingDispatch, "error")
+	if err != nil {
+		log.Printf("Failed to clear queued tasks left from the last run: %v", err)
+		return
+	}
+	if count > 0 {
+		log.Printf("Marked %d queued tasks left from the last run as failed", count)
+	}
+}
+
+// nodeHeadroom 节点还能接收的下载任务数：注册时上报的max_downloads减去正在下载的任务数。
+// 正在下载的任务数取心跳上报值与网关任务登记中的较大者，心跳有延迟，登记随任务状态及时更新。
+// 没有上报max_downloads的节点不限。
+func nodeHeadroom(node *WorkerNode, registered int) int {
+	limit := node.Resources["max_downloads"]
+	if limit <= 0 {
+		return math.MaxInt32
+	}
+	active := registered
+	if reported, ok := node.Metrics["active_downloads"].(float64); ok && int(reported) > active {
+		active = int(reported)
+	}
+	return limit - active
+}
+
+// clusterHeadroom 各在线节点的剩余下载名额
+func (gc *GatewayController) clusterHeadroom() map[string]int {
+	counts := map[string]int{}
+	if gc.tasks != nil {
+		registered, err := gc.tasks.CountActiveByWorker(context.Background())
+		if err != nil {
+			log.Printf("Failed to count active tasks per worker: %v", err)
+		} else {
+			counts = registered
+		}
+	}
+
+	headroom := make(map[string]int)
+	for _, node := range gc.gateway.GetOnlineNodes() {
+		if !gc.nodeConns.has(node.ID) {
+			continue
+		}
+		headroom[node.ID] = nodeHeadroom(node, counts[node.ID])
+	}
+	return headroom
+}
+
+// clusterSaturated 所有在线节点都没有剩余名额
+func clusterSaturated(headroom map[string]int) bool {
+	for _, free := range headroom {
+		if free > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pickDispatchTarget 优先分派到提交时指定的节点，该节点没有名额时选剩余名额最多的节点
+func pickDispatchTarget(headroom map[string]int, preferred string) string {
+	if headroom[preferred] > 0 {
+		return preferred
+	}
+	nodeIDs := make([]string, 0, len(headroom))
+	for nodeID := range headroom {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	target := ""
+	for _, nodeID := range nodeIDs {
+		if headroom[nodeID] > 0 && (target == "" || headroom[nodeID] > headroom[target]) {
+			target = nodeID
+		}
+	}
+	return target
+}
+
+// shouldQueue 新的提交是否不能直接发给节点：集群满载，或者已有任务在排队（新提交不插队）
+func (gc *GatewayController) shouldQueue() bool {
+	if gc.admission.Mode == AdmissionOff {
+		return false
+	}
+	if gc.admission.Mode == AdmissionQueue && gc.queue.len() > 0 {
+		return true
+	}
+	return clusterSaturated(gc.clusterHeadroom())
+}
+
+// admitSaturated 集群满载时的提交：reject模式返回503，queue模式在网关排队并返回202
+func (gc *GatewayController) admitSaturated(c *gin.Context, item *queuedSubmission) {
+	if gc.admission.Mode == AdmissionReject {
+		gc.queue.recordRejected()
+		log.Printf("[trace %s] Rejected submission for user %d: all workers are at capacity", item.TraceID, item.OwnerID)
+		c.Header("Retry-After", strconv.Itoa(int(gc.admission.RetryAfter.Seconds())))
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "All worker nodes are at capacity, please retry later",
+			"code":    "cluster_saturated",
+		})
+		return
+	}
+
+	// 排队的任务也登记到网关，任务详情与重复提交检查都能找到它
+	if gc.tasks != nil {
+		ownerID := item.OwnerID
+		if err := gc.tasks.Upsert(c.Request.Context(), item.ID, item.WorkerID, StatusPendingDispatch, &ownerID); err != nil {
+			log.Printf("Failed to record queued task %s: %v", item.ID, err)
+		}
+		gc.recordInfoHash(c.Request.Context(), item.ID, item.InfoHash)
+	}
+	position := gc.queue.push(item)
+	gc.wakeDispatcher()
+
+	log.Printf("[trace %s] All workers are at capacity, queued task %s at position %d", item.TraceID, item.ID, position)
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"message": "All worker nodes are busy, task queued",
+		"data": gin.H{
+			"task_id":        item.ID,
+			"worker_id":      item.WorkerID,
+			"status":         StatusPendingDispatch,
+			"queue_position": position,
+			"duplicate":      false,
+			"trace_id":       item.TraceID,
+		},
+	})
+}
+
+// queuedTasks 排队中的任务，格式与节点上报的任务列表一致，合并到任务列表中
+func (gc *GatewayController) queuedTasks() []map[string]interface{} {
+	items := gc.queue.list()
+	tasks := make([]map[string]interface{}, 0, len(items))
+	for i, item := range items {
+		magnetURL, _ := item.Payload["magnet_url"].(string)
+		tasks = append(tasks, map[string]interface{}{
+			"id":             item.ID,
+			"magnet_url":     magnetURL,
+			"status":         StatusPendingDispatch,
+			"worker_id":      item.WorkerID,
+			"owner_id":       item.OwnerID,
+			"trace_id":       item.TraceID,
+			"queue_position": i + 1,
+			"created_at":     timefmt.Format(item.QueuedAt),
+			"updated_at":     timefmt.Format(item.QueuedAt),
+		})
+	}
+	return tasks
+}
+
+// wakeDispatcher 节点容量可能有变化时（心跳、任务状态更新、节点上线）立即检查分派队列
+func (gc *GatewayController) wakeDispatcher() {
+	select {
+	case gc.dispatchWake <- struct{}{}:
+	default:
+	}
+}
+
+// runDispatcher 定时以及被唤醒时分派排队的任务
+func (gc *GatewayController) runDispatcher() {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-gc.dispatchWake:
+		}
+		gc.dispatchQueued()
+	}
+}
+
+// dispatchQueued 按用户轮转把排队的任务分派到有空闲名额的节点，直到队列为空或名额用完。
+// 名额在一轮分派开始时计算一次，每分派一个任务扣减一个，下一轮再按节点上报的最新数据计算。
+func (gc *GatewayController) dispatchQueued() {
+	if gc.queue.len() == 0 {
+		return
+	}
+
+	headroom := gc.clusterHeadroom()
+	for !clusterSaturated(headroom) {
+		item := gc.queue.pop()
+		if item == nil {
+			return
+		}
+		target := pickDispatchTarget(headroom, item.WorkerID)
+		if !gc.dispatch(item, target) {
+			gc.queue.requeue(item)
+			return
+		}
+		headroom[target]--
+	}
+}
+
+// dispatch 把排队的任务提交给节点。节点无法送达时返回false，任务放回队列稍后重试；
+// 节点拒绝任务时任务标记为失败。
+func (gc *GatewayController) dispatch(item *queuedSubmission, workerID string) bool {
+	node, exists := gc.gateway.GetNode(workerID)
+	if !exists {
+		return false
+	}
+
+	response, err := gc.sendSubmission(node, item.Payload)
+	if err != nil {
+		log.Printf("[trace %s] Failed to dispatch queued task %s to %s: %v", item.TraceID, item.ID, workerID, err)
+		return false
+	}
+
+	ctx := context.Background()
+	if response != nil {
+		if success, _ := response["success"].(bool); !success {
+			log.Printf("[trace %s] Worker %s rejected queued task %s: %v", item.TraceID, workerID, item.ID, response["error"])
+			gc.queue.recordFailed()
+			if gc.tasks != nil {
+				ownerID := item.OwnerID
+				if err := gc.tasks.Upsert(ctx, item.ID, workerID, "error", &ownerID); err != nil {
+					log.Printf("Failed to record queued task %s: %v", item.ID, err)
+				}
+			}
+			return true
+		}
+	}
+
+	wait := time.Since(item.QueuedAt)
+	gc.queue.recordDispatched(wait)
+
+	// 排队期间的登记由节点分配的任务取代；旧版节点不回复任务ID，等其上报任务状态时登记
+	if gc.tasks != nil {
+		if err := gc.tasks.Delete(ctx, item.ID); err != nil {
+			log.Printf("Failed to delete queued task %s from registry: %v", item.ID, err)
+		}
+	}
+	taskID, _ := response["task_id"].(string)
+	gc.recordInfoHash(ctx, taskID, item.InfoHash)
+
+	log.Printf("[trace %s] Queued task %s dispatched to %s as %s after %s", item.TraceID, item.ID, workerID, taskID, wait.Round(time.Millisecond))
+	return true
+}
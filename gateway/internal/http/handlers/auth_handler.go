@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -8,29 +9,29 @@ import (
 
 	"magnetm3u8-gateway/internal/auth"
 	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/timefmt"
 	"magnetm3u8-gateway/internal/user"
 )
 
 // AuthHandler exposes HTTP handlers for authentication flows.
 type AuthHandler struct {
 	service    *auth.Service
+	users      *user.Repository
 	cookieName string
 	sessionTTL time.Duration
 }
 
-func NewAuthHandler(service *auth.Service, cookieName string, ttl time.Duration) *AuthHandler {
+func NewAuthHandler(service *auth.Service, users *user.Repository, cookieName string, ttl time.Duration) *AuthHandler {
 	return &AuthHandler{
 		service:    service,
+		users:      users,
 		cookieName: cookieName,
 		sessionTTL: ttl,
 	}
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
-	var payload struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
+	var payload Credentials
 
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
@@ -47,10 +48,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
-	var payload struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
+	var payload Credentials
 
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
@@ -58,6 +56,10 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	}
 
 	token, user, err := h.service.Login(c.Request.Context(), payload.Username, payload.Password)
+	if errors.Is(err, auth.ErrGuestExpired) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": err.Error(), "code": middleware.CodeGuestExpired})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": err.Error()})
 		return
@@ -94,6 +96,46 @@ func (h *AuthHandler) Profile(c *gin.Context) {
 	c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": "未登录"})
 }
 
+// Preferences returns the logged-in user's submission defaults.
+func (h *AuthHandler) Preferences(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok || account == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": "未登录"})
+		return
+	}
+
+	preferences, err := h.users.GetPreferences(c.Request.Context(), account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "无法加载偏好设置"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": preferences})
+}
+
+// UpdatePreferences replaces the logged-in user's submission defaults. Unknown
+// fields and invalid values are rejected; an empty object clears them.
+func (h *AuthHandler) UpdatePreferences(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok || account == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": "未登录"})
+		return
+	}
+
+	preferences, err := user.ParsePreferences(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	if err := h.users.SetPreferences(c.Request.Context(), account.ID, preferences); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存偏好设置失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": preferences})
+}
+
 func (h *AuthHandler) setSessionCookie(c *gin.Context, token string) {
 	http.SetCookie(c.Writer, &http.Cookie{
 		Name:     h.cookieName,
@@ -106,19 +148,23 @@ func (h *AuthHandler) setSessionCookie(c *gin.Context, token string) {
 }
 
 type userDTO struct {
-	ID        int64     `json:"id"`
-	Username  string    `json:"username"`
-	Role      string    `json:"role"`
-	IsBanned  bool      `json:"is_banned"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int64        `json:"id"`
+	Username       string       `json:"username"`
+	Role           string       `json:"role"`
+	IsBanned       bool         `json:"is_banned"`
+	ExpiresAt      timefmt.Time `json:"expires_at"`
+	SubmitDisabled bool         `json:"submit_disabled"`
+	CreatedAt      timefmt.Time `json:"created_at"`
 }
 
 func sanitizeUser(u *user.User) userDTO {
 	return userDTO{
-		ID:        u.ID,
-		Username:  u.Username,
-		Role:      u.Role,
-		IsBanned:  u.IsBanned,
-		CreatedAt: u.CreatedAt,
+		ID:             u.ID,
+		Username:       u.Username,
+		Role:           u.Role,
+		IsBanned:       u.IsBanned,
+		ExpiresAt:      u.ExpiresAt,
+		SubmitDisabled: u.SubmitDisabled,
+		CreatedAt:      u.CreatedAt,
 	}
 }
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/task"
+)
+
+// BoostTask 用户打开任务页面时调用：通知任务所在节点有观众在等待，
+// 节点将任务的转码排到普通任务之前，还在下载的任务在转码时同样优先
+func (gc *GatewayController) BoostTask(c *gin.Context) {
+	if _, ok := middleware.CurrentUser(c); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	taskID := c.Param("id")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "boost_task", map[string]interface{}{
+		"task_id": taskID,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if found, _ := response["found"].(bool); !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return
+	}
+
+	data := gin.H{"task_id": taskID}
+	if position, ok := response["queue_position"].(float64); ok && position > 0 {
+		data["queue_position"] = int(position)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    data,
+	})
+}
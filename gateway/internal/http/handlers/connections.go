@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout 单次写入的期限，对端不读取时写入在此之后失败，不会一直占着写锁
+const wsWriteTimeout = 10 * time.Second
+
+// 节点连接的存活检查：网关每nodePingInterval发送一次ping，nodePongWait内收不到pong或任何消息时
+// 读取超时并断开；同一节点ID的新连接只能替换超过nodePongWait没有动静的旧连接
+const (
+	nodePongWait     = 60 * time.Second
+	nodePingInterval = nodePongWait / 3
+)
+
+// wsConn 一个已注册的WebSocket连接。gorilla/websocket的连接同一时间只允许一个写入者，
+// 而网关会同时从HTTP处理函数、调度协程和读循环向同一连接写消息，因此写入经由写锁串行化
+type wsConn struct {
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	writeErr error // 连接层面的写入错误。gorilla/websocket写入失败后连接不再可用，之后的写入直接返回该错误
+
+	id       string
+	userID   int64 // 建立客户端连接的登录用户，匿名连接与节点连接为0
+	registry *connRegistry
+	lastSeen atomic.Int64 // 最近一次收到pong或消息的时间（UnixNano），用于判断节点连接是否已半开
+}
+
+// touch 记录对端仍然存活
+func (c *wsConn) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// stale 超过nodePongWait没有收到pong或消息，连接很可能已经半开
+func (c *wsConn) stale(now time.Time) bool {
+	return now.Sub(time.Unix(0, c.lastSeen.Load())) > nodePongWait
+}
+
+// WriteJSON 写入一条JSON消息，与同一连接上的其它写入互斥。每次写入都设置写入期限
+func (c *wsConn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	// 先编码再写：gorilla的WriteJSON在编码失败时仍会发出一个空帧
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		if isConnWriteError(err) {
+			c.writeErr = err
+		}
+		return err
+	}
+	return nil
+}
+
+// keepAlive 设置读取期限并定期发送ping，收到pong或消息时由读循环延长期限，直到stop关闭。
+// WriteControl可与其它写入并发，不占写锁
+func (c *wsConn) keepAlive(stop <-chan struct{}) {
+	c.conn.SetReadDeadline(time.Now().Add(nodePongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.touch()
+		return c.conn.SetReadDeadline(time.Now().Add(nodePongWait))
+	})
+
+	ticker := time.NewTicker(nodePingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// replacement 同一ID在本连接之后注册的连接（对端已重连），没有时返回false
+func (c *wsConn) replacement() (jsonWriter, bool) {
+	if c.registry == nil {
+		return nil, false
+	}
+	current, exists := c.registry.get(c.id)
+	if !exists || current == c {
+		return nil, false
+	}
+	return current, true
+}
+
+// connRegistry 按节点ID或客户端ID索引的WebSocket连接。各连接的读循环注册和删除连接，
+// HTTP处理函数并发查找连接，所有访问都经过读写锁
+type connRegistry struct {
+	mu    sync.RWMutex
+	conns map[string]*wsConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[string]*wsConn)}
+}
+
+// get 返回ID对应的连接
+func (r *connRegistry) get(id string) (*wsConn, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conn, exists := r.conns[id]
+	return conn, exists
+}
+
+// has 判断ID是否有连接
+func (r *connRegistry) has(id string) bool {
+	_, exists := r.get(id)
+	return exists
+}
+
+// register 注册连接，ID已有连接时新连接替换旧连接（对端重连），返回被替换的旧连接
+func (r *connRegistry) register(id string, conn *websocket.Conn) (registered, replaced *wsConn) {
+	return r.registerUser(id, 0, conn)
+}
+
+// registerLive 注册节点连接。ID已有仍然存活的连接时不注册，返回false，防止任意连接顶掉在线的节点；
+// 已有的连接超过nodePongWait没有动静（半开）时新连接替换它，返回被替换的旧连接
+func (r *connRegistry) registerLive(id string, conn *websocket.Conn) (registered, replaced *wsConn, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replaced = r.conns[id]
+	if replaced != nil && !replaced.stale(time.Now()) {
+		return nil, nil, false
+	}
+	registered = &wsConn{conn: conn, id: id, registry: r}
+	registered.touch()
+	r.conns[id] = registered
+	return registered, replaced, true
+}
+
+// registerUser 与register相同，同时记录建立连接的登录用户
+func (r *connRegistry) registerUser(id string, userID int64, conn *websocket.Conn) (registered, replaced *wsConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replaced = r.conns[id]
+	registered = &wsConn{conn: conn, id: id, userID: userID, registry: r}
+	r.conns[id] = registered
+	return registered, replaced
+}
+
+// ownedBy 判断ID的连接是否由该登录用户建立
+func (r *connRegistry) ownedBy(id string, userID int64) bool {
+	conn, exists := r.get(id)
+	return exists && userID != 0 && conn.userID == userID
+}
+
+// remove 删除ID的连接。ID已指向其它连接（已被重连替换）时保留，返回false
+func (r *connRegistry) remove(id string, conn *wsConn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[id] != conn {
+		return false
+	}
+	delete(r.conns, id)
+	return true
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"magnetm3u8-gateway/internal/task"
+)
+
+// DuplicateSubmitMode 决定提交集群中已有的磁力链接（按info hash判断）时的处理方式
+type DuplicateSubmitMode string
+
+const (
+	// DuplicateSubmitExisting 不再提交，直接返回已有任务及其所在节点
+	DuplicateSubmitExisting DuplicateSubmitMode = "existing"
+	// DuplicateSubmitRoute 提交到已有任务所在的节点，由节点按info hash去重
+	DuplicateSubmitRoute DuplicateSubmitMode = "route"
+	// DuplicateSubmitOff 不做集群范围的去重
+	DuplicateSubmitOff DuplicateSubmitMode = "off"
+)
+
+// SetDuplicateSubmitMode 设置重复提交的处理方式，未知的取值按existing处理
+func (gc *GatewayController) SetDuplicateSubmitMode(mode DuplicateSubmitMode) {
+	switch mode {
+	case DuplicateSubmitExisting, DuplicateSubmitRoute, DuplicateSubmitOff:
+		gc.duplicateMode = mode
+	default:
+		gc.duplicateMode = DuplicateSubmitExisting
+	}
+}
+
+// lockInfoHash 串行化同一info hash的提交，避免两个并发请求都查不到已有任务而被分到不同节点。
+// 返回的函数用于释放。
+func (gc *GatewayController) lockInfoHash(infoHash string) func() {
+	for {
+		gc.submitMu.Lock()
+		busy, ok := gc.submitting[infoHash]
+		if !ok {
+			done := make(chan struct{})
+			gc.submitting[infoHash] = done
+			gc.submitMu.Unlock()
+			return func() {
+				gc.submitMu.Lock()
+				delete(gc.submitting, infoHash)
+				gc.submitMu.Unlock()
+				close(done)
+			}
+		}
+		gc.submitMu.Unlock()
+		<-busy
+	}
+}
+
+// findDuplicateTask 查找集群中同一info hash、未失败且所在节点在线的任务
+func (gc *GatewayController) findDuplicateTask(ctx context.Context, infoHash string) (*task.Record, bool) {
+	if gc.tasks == nil || infoHash == "" || gc.duplicateMode == DuplicateSubmitOff {
+		return nil, false
+	}
+
+	record, err := gc.tasks.FindActiveByInfoHash(ctx, infoHash)
+	if err != nil {
+		if !errors.Is(err, task.ErrNotFound) {
+			log.Printf("Failed to look up tasks for info hash %s: %v", infoHash, err)
+		}
+		return nil, false
+	}
+
+	node, exists := gc.gateway.GetNode(record.WorkerID)
+	if !exists || node.Status != "online" {
+		return nil, false
+	}
+	return record, true
+}
+
+// recordInfoHash 在网关登记任务的info hash
+func (gc *GatewayController) recordInfoHash(ctx context.Context, taskID, infoHash string) {
+	if gc.tasks == nil || taskID == "" || infoHash == "" {
+		return
+	}
+	if err := gc.tasks.SetInfoHash(ctx, taskID, infoHash); err != nil {
+		log.Printf("Failed to record info hash of task %s: %v", taskID, err)
+	}
+}
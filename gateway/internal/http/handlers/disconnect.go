@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+// clientReconnectGrace 客户端WebSocket断开后等待重连的时长。播放器断开5秒后自动重连，
+// 宽限期内重连的客户端保留其WebRTC会话
+const clientReconnectGrace = 30 * time.Second
+
+// clientReconnected 客户端（重新）连接，取消等待中的会话清理
+func (gc *GatewayController) clientReconnected(clientID string) {
+	gc.disconnectMu.Lock()
+	defer gc.disconnectMu.Unlock()
+
+	if timer, exists := gc.disconnectTimers[clientID]; exists {
+		timer.Stop()
+		delete(gc.disconnectTimers, clientID)
+		log.Printf("Client %s reconnected within the grace period", clientID)
+	}
+}
+
+// clientDisconnected 客户端断开后开始计时，宽限期内没有重连则关闭其全部会话
+func (gc *GatewayController) clientDisconnected(clientID string) {
+	gc.disconnectMu.Lock()
+	defer gc.disconnectMu.Unlock()
+
+	if timer, exists := gc.disconnectTimers[clientID]; exists {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(gc.clientGrace, func() {
+		gc.disconnectMu.Lock()
+		current := gc.disconnectTimers[clientID]
+		if current == timer {
+			delete(gc.disconnectTimers, clientID)
+		}
+		gc.disconnectMu.Unlock()
+		// 计时器触发前客户端已重连或再次断开
+		if current != timer {
+			return
+		}
+		gc.closeClientSessions(clientID)
+	})
+	gc.disconnectTimers[clientID] = timer
+}
+
+// closeClientSessions 关闭客户端的全部会话：标记为closed并从活跃会话中移除，
+// 再通知所在节点释放PeerConnection。每个会话只通知一次
+func (gc *GatewayController) closeClientSessions(clientID string) {
+	for _, session := range gc.gateway.GetSessionsByClient(clientID) {
+		closed, ok := gc.gateway.CloseSession(session.SessionID)
+		if !ok {
+			continue
+		}
+		log.Printf("Closing session %s of disconnected client %s on worker %s", closed.SessionID, clientID, closed.WorkerID)
+		gc.notifySessionClosed(closed)
+	}
+}
+
+// notifySessionClosed 通知节点关闭会话，节点未连接或不支持close_session时跳过，
+// 节点上的会话之后会因连接失败而自行清理
+func (gc *GatewayController) notifySessionClosed(session cluster.SignalingSession) {
+	conn, exists := gc.nodeConns.get(session.WorkerID)
+	if !exists {
+		return
+	}
+	if node, ok := gc.gateway.GetNode(session.WorkerID); ok && !cluster.SupportsMessage(node.ProtocolVersion, "close_session") {
+		return
+	}
+
+	if err := gc.forward(conn, session.WorkerID, Message{
+		Type: "close_session",
+		Payload: map[string]interface{}{
+			"session_id": session.SessionID,
+			"reason":     "client_disconnected",
+			"timestamp":  timefmt.Format(time.Now()),
+		},
+	}); err != nil {
+		log.Printf("Failed to send close_session for %s to worker %s: %v", session.SessionID, session.WorkerID, err)
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import "log"
+
+// awaitNodesLocked 记录请求已发往的节点。已经回复的节点不再等待，发送后已经断开的节点
+// 不计入ExpectedNodes。调用方持有gc.mutex和req.mutex
+func (gc *GatewayController) awaitNodesLocked(req *PendingRequest, nodeIDs []string) {
+	responded := make(map[string]bool, len(req.Responses))
+	for _, response := range req.Responses {
+		if nodeID, ok := response["node_id"].(string); ok {
+			responded[nodeID] = true
+		}
+	}
+
+	req.ExpectedNodes = len(nodeIDs)
+	req.TargetNodes = nodeSet(nodeIDs)
+	req.WaitingNodes = make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		if responded[nodeID] {
+			continue
+		}
+		if !gc.nodeConns.has(nodeID) {
+			log.Printf("Worker %s disconnected before answering %s request %s", nodeID, req.RequestType, req.RequestID)
+			req.ExpectedNodes--
+			continue
+		}
+		req.WaitingNodes[nodeID] = true
+	}
+}
+
+// completeIfAnsweredLocked 所有期待的节点都已回复（或已断开）时把结果交给等待的调用方。
+// 调用方持有gc.mutex和req.mutex
+func (gc *GatewayController) completeIfAnsweredLocked(req *PendingRequest) {
+	if len(req.Responses) < req.ExpectedNodes {
+		return
+	}
+	switch req.RequestType {
+	case "get_tasks":
+		gc.finishTasksRequest(req)
+	case "get_task_detail":
+		gc.finishTaskDetailRequest(req, req.Responses)
+	default:
+		select {
+		case req.ResponseChan <- req.Responses:
+		default:
+		}
+		gc.removeRequestLocked(req.RequestID)
+	}
+}
+
+// releaseNodeRequests 节点断开后不再等待它的回复：等待该节点的请求减少一个期待的节点，
+// 其余节点都已回复的请求立即完成，不必等到超时
+func (gc *GatewayController) releaseNodeRequests(nodeID string) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	for _, req := range gc.pendingRequests {
+		req.mutex.Lock()
+		if req.WaitingNodes[nodeID] {
+			delete(req.WaitingNodes, nodeID)
+			req.ExpectedNodes--
+			log.Printf("Worker %s disconnected during %s request %s, waiting for %d more", nodeID, req.RequestType, req.RequestID, len(req.WaitingNodes))
+			gc.completeIfAnsweredLocked(req)
+		}
+		req.mutex.Unlock()
+	}
+}
+
+// acceptResponseLocked 把节点的响应加入请求，返回加入的响应（带node_id）。
+// 同一节点的重复响应、未被询问的节点的响应，以及断开后已不再等待的节点的响应都被丢弃，
+// 避免提前凑够ExpectedNodes。调用方持有gc.mutex和req.mutex
+func (gc *GatewayController) acceptResponseLocked(req *PendingRequest, nodeID string, payload map[string]interface{}) (map[string]interface{}, bool) {
+	for _, response := range req.Responses {
+		if response["node_id"] == nodeID {
+			log.Printf("Dropped duplicate %s response from %s for request %s", req.RequestType, nodeID, req.RequestID)
+			return nil, false
+		}
+	}
+	// WaitingNodes在请求发出后才确定，此前按可能收到请求的节点判断
+	if (req.WaitingNodes != nil && !req.WaitingNodes[nodeID]) || (req.TargetNodes != nil && !req.TargetNodes[nodeID]) {
+		log.Printf("Dropped unsolicited %s response from %s for request %s", req.RequestType, nodeID, req.RequestID)
+		return nil, false
+	}
+
+	responseData := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		responseData[k] = v
+	}
+	responseData["node_id"] = nodeID
+	req.Responses = append(req.Responses, responseData)
+	delete(req.WaitingNodes, nodeID)
+	return responseData, true
+}
+
+// dropUnmatchedResponseLocked 丢弃没有等待中请求的响应。已完成或超时的请求迟到的响应很常见，
+// 只记录一行；从未见过的请求ID才视为异常。调用方持有gc.mutex
+func (gc *GatewayController) dropUnmatchedResponseLocked(requestID, nodeID string) {
+	if gc.finished.contains(requestID) {
+		log.Printf("Dropped late response from %s for finished request %s", nodeID, requestID)
+		return
+	}
+	log.Printf("Received response for unknown request %s from %s", requestID, nodeID)
+}
+
+// removeRequestLocked 结束请求并记住其ID，之后到达的响应按迟到处理。调用方持有gc.mutex
+func (gc *GatewayController) removeRequestLocked(requestID string) {
+	delete(gc.pendingRequests, requestID)
+	gc.finished.add(requestID)
+}
+
+// finishedRequestsSize 记住的最近结束的请求数
+const finishedRequestsSize = 256
+
+// finishedRequests 最近结束的请求ID，容量满时淘汰最早的。零值可用，由gc.mutex保护
+type finishedRequests struct {
+	ids  [finishedRequestsSize]string
+	next int
+	set  map[string]bool
+}
+
+func (f *finishedRequests) add(requestID string) {
+	if f.set == nil {
+		f.set = make(map[string]bool, finishedRequestsSize)
+	}
+	if f.set[requestID] {
+		return
+	}
+	delete(f.set, f.ids[f.next])
+	f.ids[f.next] = requestID
+	f.set[requestID] = true
+	f.next = (f.next + 1) % finishedRequestsSize
+}
+
+func (f *finishedRequests) contains(requestID string) bool {
+	return f.set[requestID]
+}
+
+// nodeSet 节点ID集合
+func nodeSet(nodeIDs []string) map[string]bool {
+	set := make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		set[nodeID] = true
+	}
+	return set
+}
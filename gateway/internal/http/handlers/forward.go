@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ForwardOptions bounds how the controller retries a message it fails to
+// write to a worker or client connection.
+type ForwardOptions struct {
+	// MaxRetries is how often a failed write is retried on a new connection of
+	// the same worker or client; 0 disables retrying.
+	MaxRetries int
+	// Backoff is the wait before the first retry; it doubles for each further retry.
+	Backoff time.Duration
+}
+
+// 默认的转发重试策略
+const (
+	defaultForwardMaxRetries = 2
+	defaultForwardBackoff    = 50 * time.Millisecond
+)
+
+// ForwardStats counts messages the gateway could not deliver.
+type ForwardStats struct {
+	Retried     int64            `json:"retried"`
+	DeadLetters int64            `json:"dead_letters"`
+	ByType      map[string]int64 `json:"dead_letters_by_type"`
+}
+
+// jsonWriter 可写入JSON消息的连接，*wsConn满足该接口
+type jsonWriter interface {
+	WriteJSON(v interface{}) error
+	// replacement 写入失败后，同一对端重新连接的新连接
+	replacement() (jsonWriter, bool)
+}
+
+// forwardStats 转发重试与最终投递失败的计数
+type forwardStats struct {
+	mu          sync.Mutex
+	retried     int64
+	deadLetters int64
+	byType      map[string]int64
+}
+
+func (s *forwardStats) snapshot() ForwardStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byType := make(map[string]int64, len(s.byType))
+	for msgType, count := range s.byType {
+		byType[msgType] = count
+	}
+	return ForwardStats{Retried: s.retried, DeadLetters: s.deadLetters, ByType: byType}
+}
+
+// SetForwardOptions 设置消息转发失败时的重试次数与退避时长
+func (gc *GatewayController) SetForwardOptions(options ForwardOptions) {
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	}
+	gc.forwardOptions = options
+}
+
+// forward 向连接写入消息。写入失败的连接不再可用，退避等待后对端已重连时在新连接上重试，
+// 最多MaxRetries次；没有新连接、消息无法编码或重试用完时记录死信日志并计数，返回最后一次的错误
+func (gc *GatewayController) forward(conn jsonWriter, target string, message Message) error {
+	backoff := gc.forwardOptions.Backoff
+	for attempt := 0; ; attempt++ {
+		err := conn.WriteJSON(message)
+		if err == nil {
+			return nil
+		}
+		if attempt >= gc.forwardOptions.MaxRetries || !isConnWriteError(err) {
+			gc.deadLetter(target, message, attempt+1, err)
+			return err
+		}
+
+		// 等待期间不占用任何连接的写锁
+		time.Sleep(backoff)
+		backoff *= 2
+		next, reconnected := conn.replacement()
+		if !reconnected {
+			gc.deadLetter(target, message, attempt+1, err)
+			return err
+		}
+
+		gc.forwardStats.mu.Lock()
+		gc.forwardStats.retried++
+		gc.forwardStats.mu.Unlock()
+		log.Printf("Retrying %s to %s on its new connection after write error: %v", message.Type, target, err)
+		conn = next
+	}
+}
+
+// deadLetter 记录一条最终无法投递的消息
+func (gc *GatewayController) deadLetter(target string, message Message, attempts int, err error) {
+	gc.forwardStats.mu.Lock()
+	gc.forwardStats.deadLetters++
+	gc.forwardStats.byType[message.Type]++
+	gc.forwardStats.mu.Unlock()
+
+	sessionID, _ := message.Payload["session_id"].(string)
+	taskID, _ := message.Payload["task_id"].(string)
+	log.Printf("DEAD LETTER: %s to %s undeliverable after %d attempt(s) (session=%q task=%q): %v",
+		message.Type, target, attempts, sessionID, taskID, err)
+}
+
+// isConnWriteError 连接层面的写入错误（写超时、连接已关闭），换到对端的新连接后可能成功；
+// 消息无法编码的错误重试无意义
+func isConnWriteError(err error) bool {
+	if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
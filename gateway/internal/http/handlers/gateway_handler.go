@@ -1,9 +1,15 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,6 +19,15 @@ import (
 	"magnetm3u8-gateway/internal/cluster"
 	"magnetm3u8-gateway/internal/http/middleware"
 	"magnetm3u8-gateway/internal/ice"
+	"magnetm3u8-gateway/internal/policy"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/timefmt"
+	"magnetm3u8-gateway/internal/user"
+)
+
+const (
+	defaultTaskLogKB = 64
+	maxTaskLogKB     = 1024
 )
 
 var upgrader = websocket.Upgrader{
@@ -30,9 +45,27 @@ type Message struct {
 	Payload map[string]interface{} `json:"payload"`
 }
 
+// GatewayOptions tunes the controller built by RegisterGatewayRoutes.
+type GatewayOptions struct {
+	NodeRequests     NodeRequestLimits
+	DuplicateSubmits DuplicateSubmitMode
+	Admission        AdmissionOptions
+	Forwarding       ForwardOptions
+	// SubmitLimiter limits task submissions per client IP; nil disables it.
+	SubmitLimiter *middleware.RateLimiter
+	// Users supplies the submission preferences applied to omitted fields; nil disables them.
+	Users *user.Repository
+}
+
 // RegisterGatewayRoutes wires all node/task/WebRTC endpoints.
-func RegisterGatewayRoutes(router *gin.Engine, manager *cluster.Manager, provider *ice.IceServerProvider) {
-	controller := NewGatewayController(manager, provider)
+func RegisterGatewayRoutes(router *gin.Engine, manager *cluster.Manager, provider *ice.IceServerProvider, tasks *task.Repository, blocklist *policy.Blocklist, options GatewayOptions) {
+	controller := NewGatewayController(manager, provider, tasks, blocklist)
+	controller.SetNodeRequestLimits(options.NodeRequests)
+	controller.SetDuplicateSubmitMode(options.DuplicateSubmits)
+	controller.SetAdmission(options.Admission)
+	controller.SetForwardOptions(options.Forwarding)
+	controller.SetUserRepository(options.Users)
+	controller.failStaleQueuedTasks()
 
 	// API路由组
 	api := router.Group("/api")
@@ -40,20 +73,68 @@ func RegisterGatewayRoutes(router *gin.Engine, manager *cluster.Manager, provide
 		// 节点管理API
 		api.GET("/nodes", controller.GetOnlineNodes)
 		api.GET("/nodes/:id", controller.GetNodeDetail)
+		api.GET("/nodes/:id/queues", controller.GetNodeQueues)
 
 		// WebRTC信令API
 		api.GET("/webrtc/ice-servers", controller.GetICEServers)
 		api.POST("/webrtc/offer", controller.HandleWebRTCOffer)
 		api.POST("/webrtc/answer", controller.HandleWebRTCAnswer)
 		api.POST("/webrtc/ice", controller.HandleICECandidate)
+		api.POST("/webrtc/ice/resend", controller.ResendICECandidates)
+		api.GET("/webrtc/sessions/:id/stats", controller.GetSessionStats)
+		api.POST("/webrtc/probe", controller.StartProbe)
+		api.GET("/webrtc/probe", controller.GetProbeResults)
 
 		// 任务路由API
-		api.POST("/tasks/submit", controller.SubmitTask)
+		if options.SubmitLimiter != nil {
+			api.POST("/tasks/submit", options.SubmitLimiter.Middleware(), controller.SubmitTask)
+			api.POST("/tasks/preview", options.SubmitLimiter.Middleware(), controller.PreviewTask)
+		} else {
+			api.POST("/tasks/submit", controller.SubmitTask)
+			api.POST("/tasks/preview", controller.PreviewTask)
+		}
 		api.GET("/tasks", controller.GetAllTasks)
 		api.GET("/tasks/:id", controller.GetTaskDetail)
+		api.GET("/tasks/:id/location", controller.GetTaskLocation)
+		api.GET("/tasks/:id/log", controller.GetTaskLog)
+		api.GET("/tasks/:id/access", controller.GetTaskAccess)
+		api.GET("/tasks/:id/pieces", controller.GetTaskPieces)
+		api.PUT("/tasks/:id/pin", controller.SetTaskPinned)
+		api.POST("/tasks/:id/retry", controller.RetryTask)
+		api.POST("/tasks/:id/pause", controller.PauseTask)
+		api.POST("/tasks/:id/resume", controller.ResumeTask)
+		api.DELETE("/tasks/:id", controller.RemoveTask)
+		api.POST("/tasks/:id/boost", controller.BoostTask)
+		api.PATCH("/tasks/:id/files", controller.SelectTaskFiles)
+		api.GET("/tasks/:id/segments/*name", controller.GetTaskSegment)
+		api.GET("/tasks/:id/stream-token", controller.GetStreamToken)
+		api.GET("/tasks/:id/stream/*path", controller.GetTaskStream)
 
 		// 系统状态API
 		api.GET("/status", controller.GetSystemStatus)
+
+		// 当前用户的任务事件流
+		api.GET("/events", controller.StreamEvents)
+
+		// 管理员：清理失败任务的下载残留
+		api.POST("/admin/tasks/:id/prune", middleware.RequireAdmin(), controller.PruneTaskData)
+
+		// 管理员：检查并重新生成任务的一个损坏切片
+		api.POST("/admin/tasks/:id/segments/:name/repair", middleware.RequireAdmin(), controller.RepairTaskSegment)
+
+		// 管理员：调整任务在节点下载队列中的优先级
+		api.PATCH("/tasks/:id/priority", middleware.RequireAdmin(), controller.SetTaskPriority)
+
+		// 管理员：转码节点本地（额外媒体目录中）的文件
+		api.GET("/nodes/:id/transcode-local", middleware.RequireAdmin(), controller.ListLocalMedia)
+		api.POST("/nodes/:id/transcode-local", middleware.RequireAdmin(), controller.TranscodeLocal)
+
+		// 管理员：手动让节点进入或结束静默
+		api.POST("/nodes/:id/pause-all", middleware.RequireAdmin(), controller.PauseNode)
+		api.POST("/nodes/:id/resume-all", middleware.RequireAdmin(), controller.ResumeNode)
+
+		// 管理员：运行中调整节点的种子下载与上传限速
+		api.PUT("/nodes/:id/rate-limit", middleware.RequireAdmin(), controller.SetNodeRateLimit)
 	}
 
 	// WebSocket路由
@@ -64,40 +145,112 @@ func RegisterGatewayRoutes(router *gin.Engine, manager *cluster.Manager, provide
 // GatewayController 网关控制器
 type GatewayController struct {
 	gateway         *cluster.Manager
-	nodeConns       map[string]*websocket.Conn // 节点WebSocket连接
-	clientConns     map[string]*websocket.Conn // 客户端WebSocket连接
+	nodeConns       *connRegistry              // 节点WebSocket连接
+	clientConns     *connRegistry              // 客户端WebSocket连接
 	pendingRequests map[string]*PendingRequest // 等待响应的请求
+	finished        finishedRequests           // 最近结束的请求，用于识别迟到的响应
 	iceProvider     *ice.IceServerProvider
-	mutex           sync.RWMutex // 并发控制
+	tasks           *task.Repository  // 任务归属与所在节点
+	blocklist       *policy.Blocklist // 内容黑名单
+	mutex           sync.RWMutex      // 并发控制
+
+	piecesMu    sync.Mutex
+	piecesCache map[string]cachedPieces // 分片可用性短时缓存，按任务ID索引
+
+	throttle    *nodeThrottle // 发往各节点的请求限速
+	sharedMu    sync.Mutex
+	sharedCalls map[string]*sharedCall // 进行中的可合并请求
+
+	duplicateMode DuplicateSubmitMode // 集群范围重复提交的处理方式
+	submitMu      sync.Mutex
+	submitting    map[string]chan struct{} // 正在提交的info hash
+
+	admission    AdmissionOptions // 集群满载时的准入控制
+	queue        *dispatchQueue   // 集群满载时在网关排队的提交
+	dispatchWake chan struct{}
+
+	clientGrace      time.Duration // 客户端断开后等待重连的时长，超时后关闭其会话
+	disconnectMu     sync.Mutex
+	disconnectTimers map[string]*time.Timer // 已断开、等待重连的客户端
+
+	forwardOptions ForwardOptions // 转发失败时的重试策略
+	forwardStats   forwardStats   // 转发重试与死信计数
+
+	probes *probeCache // 按用户与节点缓存的测速结果
+
+	users    *user.Repository // 用户的提交偏好，由mutex保护
+	notifier *notifier        // 任务事件的事件流订阅者与webhook投递
+}
+
+// cachedPieces 缓存的分片可用性响应
+type cachedPieces struct {
+	data      gin.H
+	fetchedAt time.Time
 }
 
+// taskSubmitTimeout 等待节点确认任务提交的时长
+const taskSubmitTimeout = 10 * time.Second
+
+// taskDetailTimeout 等待节点返回任务详情的时长
+const taskDetailTimeout = 10 * time.Second
+
+// taskPiecesCacheTTL 分片可用性缓存时长，避免播放器轮询时每次都请求节点
+const taskPiecesCacheTTL = 2 * time.Second
+
 // PendingRequest 等待中的请求
 type PendingRequest struct {
 	RequestID     string                        `json:"request_id"`
 	RequestType   string                        `json:"request_type"`
+	TaskID        string                        `json:"task_id,omitempty"` // get_task_detail查询的任务，用于匹配不带request_id的旧版节点响应
 	Responses     []map[string]interface{}      `json:"responses"`
 	ExpectedNodes int                           `json:"expected_nodes"`
+	WaitingNodes  map[string]bool               `json:"-"` // 已发送请求但尚未回复的节点，节点断开时不再等待
+	TargetNodes   map[string]bool               `json:"-"` // 可能收到请求的节点，其它节点的响应被丢弃
 	ResponseChan  chan []map[string]interface{} `json:"-"`
 	CreatedAt     time.Time                     `json:"created_at"`
+	Timeout       time.Duration                 `json:"-"` // 调用方等待的时长，超过30秒时清理也等到这之后
 	mutex         sync.Mutex                    `json:"-"`
 }
 
 // NewGatewayController 创建新的网关控制器
-func NewGatewayController(gateway *cluster.Manager, provider *ice.IceServerProvider) *GatewayController {
+func NewGatewayController(gateway *cluster.Manager, provider *ice.IceServerProvider, tasks *task.Repository, blocklist *policy.Blocklist) *GatewayController {
 	controller := &GatewayController{
-		gateway:         gateway,
-		nodeConns:       make(map[string]*websocket.Conn),
-		clientConns:     make(map[string]*websocket.Conn),
-		pendingRequests: make(map[string]*PendingRequest),
-		iceProvider:     provider,
+		gateway:          gateway,
+		nodeConns:        newConnRegistry(),
+		clientConns:      newConnRegistry(),
+		pendingRequests:  make(map[string]*PendingRequest),
+		iceProvider:      provider,
+		tasks:            tasks,
+		blocklist:        blocklist,
+		piecesCache:      make(map[string]cachedPieces),
+		throttle:         newNodeThrottle(NodeRequestLimits{}),
+		sharedCalls:      make(map[string]*sharedCall),
+		duplicateMode:    DuplicateSubmitExisting,
+		submitting:       make(map[string]chan struct{}),
+		admission:        AdmissionOptions{Mode: AdmissionQueue, RetryAfter: defaultAdmissionRetryAfter},
+		queue:            newDispatchQueue(),
+		dispatchWake:     make(chan struct{}, 1),
+		clientGrace:      clientReconnectGrace,
+		disconnectTimers: make(map[string]*time.Timer),
+		forwardOptions:   ForwardOptions{MaxRetries: defaultForwardMaxRetries, Backoff: defaultForwardBackoff},
+		forwardStats:     forwardStats{byType: make(map[string]int64)},
+		probes:           newProbeCache(),
+		notifier:         newNotifier(),
 	}
 
 	// 启动清理任务
 	go controller.cleanupExpiredRequests()
+	// 分派在网关排队的任务
+	go controller.runDispatcher()
 
 	return controller
 }
 
+// SetNodeRequestLimits 设置发往单个节点的请求限速，已有的限速状态会被重置
+func (gc *GatewayController) SetNodeRequestLimits(limits NodeRequestLimits) {
+	gc.throttle = newNodeThrottle(limits)
+}
+
 // GetOnlineNodes 获取在线节点列表
 func (gc *GatewayController) GetOnlineNodes(c *gin.Context) {
 	nodes := gc.gateway.GetOnlineNodes()
@@ -147,10 +300,16 @@ func (gc *GatewayController) GetICEServers(c *gin.Context) {
 		return
 	}
 
+	// expires_at按请求节点的时钟偏差换算为该节点的时钟
+	expiresAt := time.Now().Add(ttl)
+	if nodeID := c.Query("node_id"); nodeID != "" {
+		expiresAt = gc.gateway.WorkerTime(nodeID, expiresAt)
+	}
 	response := gin.H{
 		"success":    true,
 		"iceServers": iceServers,
 		"ttl":        int(ttl.Seconds()),
+		"expires_at": timefmt.Format(expiresAt),
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -158,12 +317,7 @@ func (gc *GatewayController) GetICEServers(c *gin.Context) {
 
 // HandleWebRTCOffer 处理WebRTC Offer
 func (gc *GatewayController) HandleWebRTCOffer(c *gin.Context) {
-	var request struct {
-		WorkerID  string `json:"worker_id"`
-		ClientID  string `json:"client_id"`
-		SessionID string `json:"session_id"`
-		SDP       string `json:"sdp"`
-	}
+	var request WebRTCOfferRequest
 
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -173,11 +327,27 @@ func (gc *GatewayController) HandleWebRTCOffer(c *gin.Context) {
 		return
 	}
 
+	// 未指定节点时发给任务所在节点，没有任务时由调度算法选择
+	if request.WorkerID == "" {
+		workerID, err := gc.offerTarget(c.Request.Context(), request.TaskID)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"success": false,
+				"error":   "No worker node available",
+			})
+			return
+		}
+		request.WorkerID = workerID
+	}
+
 	// 创建WebRTC会话
 	session := gc.gateway.CreateWebRTCSession(request.SessionID, request.ClientID, request.WorkerID)
+	if request.TaskID != "" {
+		gc.gateway.SetSessionTask(session.SessionID, request.TaskID)
+	}
 
 	// 转发Offer到对应的工作节点
-	if conn, exists := gc.nodeConns[request.WorkerID]; exists {
+	if conn, exists := gc.nodeConns.get(request.WorkerID); exists {
 		message := Message{
 			Type: "webrtc_offer",
 			Payload: map[string]interface{}{
@@ -187,7 +357,7 @@ func (gc *GatewayController) HandleWebRTCOffer(c *gin.Context) {
 			},
 		}
 
-		if err := conn.WriteJSON(message); err != nil {
+		if err := gc.forward(conn, request.WorkerID, message); err != nil {
 			log.Printf("Failed to forward offer to worker %s: %v", request.WorkerID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"success": false,
@@ -211,10 +381,7 @@ func (gc *GatewayController) HandleWebRTCOffer(c *gin.Context) {
 
 // HandleWebRTCAnswer 处理WebRTC Answer
 func (gc *GatewayController) HandleWebRTCAnswer(c *gin.Context) {
-	var request struct {
-		SessionID string `json:"session_id"`
-		SDP       string `json:"sdp"`
-	}
+	var request WebRTCAnswerRequest
 
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -235,7 +402,7 @@ func (gc *GatewayController) HandleWebRTCAnswer(c *gin.Context) {
 	}
 
 	// 转发Answer到对应的客户端
-	if conn, exists := gc.clientConns[session.ClientID]; exists {
+	if conn, exists := gc.clientConns.get(session.ClientID); exists {
 		message := Message{
 			Type: "webrtc_answer",
 			Payload: map[string]interface{}{
@@ -244,7 +411,7 @@ func (gc *GatewayController) HandleWebRTCAnswer(c *gin.Context) {
 			},
 		}
 
-		if err := conn.WriteJSON(message); err != nil {
+		if err := gc.forward(conn, session.ClientID, message); err != nil {
 			log.Printf("Failed to forward answer to client %s: %v", session.ClientID, err)
 		}
 	}
@@ -259,11 +426,7 @@ func (gc *GatewayController) HandleWebRTCAnswer(c *gin.Context) {
 
 // HandleICECandidate 处理ICE候选者
 func (gc *GatewayController) HandleICECandidate(c *gin.Context) {
-	var request struct {
-		SessionID string `json:"session_id"`
-		Candidate string `json:"candidate"`
-		IsClient  bool   `json:"is_client"`
-	}
+	var request ICECandidateRequest
 
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -284,16 +447,16 @@ func (gc *GatewayController) HandleICECandidate(c *gin.Context) {
 	}
 
 	// 根据来源转发ICE候选者
-	var targetConn *websocket.Conn
+	var targetConn *wsConn
 	var targetID string
 
 	if request.IsClient {
 		// 来自客户端，转发到工作节点
-		targetConn = gc.nodeConns[session.WorkerID]
+		targetConn, _ = gc.nodeConns.get(session.WorkerID)
 		targetID = session.WorkerID
 	} else {
 		// 来自工作节点，转发到客户端
-		targetConn = gc.clientConns[session.ClientID]
+		targetConn, _ = gc.clientConns.get(session.ClientID)
 		targetID = session.ClientID
 	}
 
@@ -306,7 +469,7 @@ func (gc *GatewayController) HandleICECandidate(c *gin.Context) {
 			},
 		}
 
-		if err := targetConn.WriteJSON(message); err != nil {
+		if err := gc.forward(targetConn, targetID, message); err != nil {
 			log.Printf("Failed to forward ICE candidate to %s: %v", targetID, err)
 		}
 	}
@@ -316,21 +479,102 @@ func (gc *GatewayController) HandleICECandidate(c *gin.Context) {
 	})
 }
 
-// SubmitTask 提交任务到指定节点
+// ResendICECandidates 请求会话所在节点重新发送已收集的本地ICE候选者，
+// 用于恢复因候选者丢失而卡在协商阶段的会话，无需重新发送Offer
+func (gc *GatewayController) ResendICECandidates(c *gin.Context) {
+	var request ICEResendRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid request format",
+		})
+		return
+	}
+
+	session, exists := gc.gateway.GetWebRTCSession(request.SessionID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Session not found",
+		})
+		return
+	}
+
+	response, err := gc.resendICECandidates(session)
+	if err != nil {
+		gc.respondNodeRequestError(c, session.WorkerID, err)
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    iceResendResult(session, response),
+	})
+}
+
+// resendICECandidates 向会话所在节点发送ice_resend。节点先以ice_candidate消息重发候选者
+// （照常转发给客户端），再回复结果，因此结果返回时候选者已经转发完毕
+func (gc *GatewayController) resendICECandidates(session *SignalingSession) (map[string]interface{}, error) {
+	return gc.requestFromNode(session.WorkerID, "ice_resend", map[string]interface{}{
+		"session_id": session.SessionID,
+	}, 10*time.Second)
+}
+
+// iceResendResult 重发结果中返回给调用方的字段
+func iceResendResult(session *SignalingSession, response map[string]interface{}) gin.H {
+	return gin.H{
+		"session_id":      session.SessionID,
+		"worker_id":       session.WorkerID,
+		"candidates":      response["candidates"],
+		"gathering_state": response["gathering_state"],
+	}
+}
+
+// submitCapabilities 接收提交的节点必须具备的能力
+var submitCapabilities = []string{"torrent", "transcode"}
+
+// offerTarget 未指定节点的WebRTC Offer的目标节点：任务所在的节点，没有任务时为调度算法选择的支持WebRTC的节点
+func (gc *GatewayController) offerTarget(ctx context.Context, taskID string) (string, error) {
+	if taskID != "" && gc.tasks != nil {
+		if record, err := gc.tasks.Get(ctx, taskID); err == nil && record.WorkerID != "" {
+			return record.WorkerID, nil
+		}
+	}
+	node, err := gc.gateway.SelectWorker([]string{"webrtc"})
+	if err != nil {
+		return "", err
+	}
+	return node.ID, nil
+}
+
+// SubmitTask 提交任务到指定节点，未指定时由调度算法选择节点
 func (gc *GatewayController) SubmitTask(c *gin.Context) {
-	if _, ok := middleware.CurrentUser(c); !ok {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"success": false,
 			"error":   "请先登录后再提交任务",
 		})
 		return
 	}
-
-	var request struct {
-		WorkerID  string `json:"worker_id"`
-		MagnetURL string `json:"magnet_url"`
+	if !account.CanSubmit() {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "该访客账号不能提交任务",
+			"code":    "submit_disabled",
+		})
+		return
 	}
 
+	var request SubmitTaskRequest
+
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -339,6 +583,119 @@ func (gc *GatewayController) SubmitTask(c *gin.Context) {
 		return
 	}
 
+	// 请求中省略的字段使用用户的偏好设置，请求中给出的值总是优先
+	preferences := gc.submitPreferences(c.Request.Context(), account.ID)
+	burnSubtitles, requireComplete := preferences.BurnSubtitles, preferences.RequireComplete
+	if request.BurnSubtitles != nil {
+		burnSubtitles = *request.BurnSubtitles
+	}
+	if request.RequireComplete != nil {
+		requireComplete = *request.RequireComplete
+	}
+	// sequential没有给出时不发送，由节点的streaming_mode决定
+	sequential := preferences.Sequential
+	if request.Sequential != nil {
+		sequential = request.Sequential
+	}
+	if request.SubtitleLanguage == "" {
+		request.SubtitleLanguage = preferences.SubtitleLanguage
+	}
+	if request.HLSQuality == "" {
+		request.HLSQuality = preferences.HLSQuality
+	}
+
+	if request.HLSQuality != "" && request.HLSQuality != "single" && request.HLSQuality != "multi" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "hls_quality must be single or multi",
+		})
+		return
+	}
+
+	if request.Priority != 0 {
+		if account.Role != user.RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   "只有管理员可以指定下载优先级",
+			})
+			return
+		}
+		if request.Priority < 1 || request.Priority > 10 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "priority must be an integer between 1 and 10",
+			})
+			return
+		}
+	}
+
+	// 追踪ID随任务传到节点，贯穿下载、转码与状态上报，用户报告问题时可以引用
+	traceID := newTraceID()
+
+	// 黑名单检查：磁力链接中的info hash与dn
+	infoHash, name := policy.ParseMagnet(request.MagnetURL)
+	if gc.blocklist != nil {
+		if verdict := gc.blocklist.Check(infoHash, name); !verdict.Allowed {
+			ownerID := account.ID
+			gc.blocklist.RecordBlocked(c.Request.Context(), &ownerID, "", infoHash, name, verdict)
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   "Content is not allowed by the blocklist",
+				"code":    "policy_blocked",
+			})
+			return
+		}
+	}
+
+	// 集群范围去重：同一info hash已有任务时返回该任务，或提交到其所在节点。
+	// 提交到已有任务所在节点的由节点去重，不占下载名额，不经过准入控制
+	routed := false
+	if infoHash != "" && gc.duplicateMode != DuplicateSubmitOff {
+		release := gc.lockInfoHash(infoHash)
+		defer release()
+
+		if existing, found := gc.findDuplicateTask(c.Request.Context(), infoHash); found {
+			// 已有任务还在网关排队时无法由节点去重，同样直接返回
+			if gc.duplicateMode == DuplicateSubmitExisting || existing.Status == StatusPendingDispatch {
+				log.Printf("[trace %s] Magnet %s already active as task %s on %s", traceID, infoHash, existing.TaskID, existing.WorkerID)
+				c.JSON(http.StatusOK, gin.H{
+					"success": true,
+					"message": "Task already exists in cluster",
+					"data": gin.H{
+						"task_id":   existing.TaskID,
+						"worker_id": existing.WorkerID,
+						"status":    existing.Status,
+						"duplicate": true,
+						"trace_id":  traceID,
+					},
+				})
+				return
+			}
+			if request.WorkerID != existing.WorkerID {
+				log.Printf("[trace %s] Routing duplicate magnet %s to %s instead of %s", traceID, infoHash, existing.WorkerID, request.WorkerID)
+				request.WorkerID = existing.WorkerID
+			}
+			routed = true
+		}
+	}
+
+	// 未指定节点时使用偏好的节点，没有偏好或该节点不在线时由调度算法选择
+	if request.WorkerID == "" {
+		request.WorkerID = gc.preferredWorker(preferences)
+	}
+	if request.WorkerID == "" {
+		selected, err := gc.gateway.SelectWorker(submitCapabilities)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"success": false,
+				"error":   "No worker node available",
+			})
+			return
+		}
+		request.WorkerID = selected.ID
+		log.Printf("[trace %s] Scheduled submission to %s", traceID, request.WorkerID)
+	}
+
 	// 检查节点是否在线
 	node, exists := gc.gateway.GetNode(request.WorkerID)
 	if !exists || node.Status != "online" {
@@ -349,52 +706,196 @@ func (gc *GatewayController) SubmitTask(c *gin.Context) {
 		return
 	}
 
-	// 转发任务到工作节点
-	if conn, exists := gc.nodeConns[request.WorkerID]; exists {
-		message := Message{
-			Type: "task_submit",
-			Payload: map[string]interface{}{
-				"magnet_url": request.MagnetURL,
-				"timestamp":  time.Now().Unix(),
-			},
-		}
+	payload := map[string]interface{}{
+		"magnet_url": request.MagnetURL,
+		"owner_id":   account.ID,
+		"trace_id":   traceID,
+		"timestamp":  timefmt.Format(time.Now()),
+	}
+	log.Printf("[trace %s] Submitting magnet %s to %s for user %d", traceID, infoHash, request.WorkerID, account.ID)
+	if burnSubtitles {
+		payload["burn_subtitles"] = true
+		payload["subtitle_language"] = request.SubtitleLanguage
+	}
+	if request.AllowPrivate {
+		payload["allow_private"] = true
+	}
+	if len(request.SelectedFiles) > 0 {
+		payload["selected_files"] = request.SelectedFiles
+	}
+	if request.Priority != 0 {
+		payload["priority"] = request.Priority
+	}
+	if request.HLSQuality == "multi" {
+		payload["hls_quality"] = request.HLSQuality
+	}
+	if request.Interactive {
+		payload["interactive"] = true
+	}
+	if requireComplete {
+		payload["require_complete"] = true
+	}
+	if sequential != nil {
+		payload["sequential"] = *sequential
+	}
 
-		if err := conn.WriteJSON(message); err != nil {
-			log.Printf("Failed to submit task to worker %s: %v", request.WorkerID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{
+	// 准入控制：所有节点的下载名额都用完时在网关排队或拒绝
+	if !routed && gc.shouldQueue() {
+		gc.admitSaturated(c, &queuedSubmission{
+			ID:       "queued-" + traceID,
+			OwnerID:  account.ID,
+			WorkerID: request.WorkerID,
+			InfoHash: infoHash,
+			TraceID:  traceID,
+			Payload:  payload,
+			QueuedAt: time.Now(),
+		})
+		return
+	}
+
+	response, err := gc.sendSubmission(node, payload)
+	if err != nil {
+		gc.respondNodeRequestError(c, request.WorkerID, err)
+		return
+	}
+	// 旧版节点不回复提交结果
+	if response == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "Task submitted successfully",
+			"data":    gin.H{"trace_id": traceID},
+		})
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		// 节点上同一磁力链接已有任务，返回该任务
+		if duplicate, _ := response["duplicate"].(bool); duplicate {
+			existingID, _ := response["task_id"].(string)
+			log.Printf("[trace %s] Worker %s already has task %s for this magnet", traceID, request.WorkerID, existingID)
+			c.JSON(http.StatusConflict, gin.H{
 				"success": false,
-				"error":   "Failed to submit task to worker",
+				"error":   response["error"],
+				"code":    "duplicate_task",
+				"data": gin.H{
+					"task_id":   existingID,
+					"worker_id": request.WorkerID,
+					"duplicate": true,
+				},
 			})
 			return
 		}
-	} else {
-		c.JSON(http.StatusNotFound, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"error":   "Worker node not connected",
+			"error":   response["error"],
 		})
 		return
 	}
 
+	// 节点重启后重复提交的任务视为提交成功
+	duplicate, _ := response["duplicate"].(bool)
+	message := "Task submitted successfully"
+	if duplicate {
+		message = "Task already exists on worker"
+	}
+	taskID, _ := response["task_id"].(string)
+	gc.recordInfoHash(c.Request.Context(), taskID, infoHash)
+
+	// 节点侧去重时返回已有任务的追踪ID
+	if existingTrace, _ := response["trace_id"].(string); existingTrace != "" {
+		traceID = existingTrace
+	}
+	log.Printf("[trace %s] Task %s accepted by %s (duplicate=%v)", traceID, taskID, request.WorkerID, duplicate)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "Task submitted successfully",
+		"message": message,
+		"data": gin.H{
+			"task_id":   taskID,
+			"worker_id": request.WorkerID,
+			"duplicate": duplicate,
+			"trace_id":  traceID,
+		},
 	})
 }
 
-// GetAllTasks 获取所有任务列表
+// sendSubmission 把任务提交给节点并等待提交结果。旧版节点不回复提交结果，直接转发并返回nil
+func (gc *GatewayController) sendSubmission(node *WorkerNode, payload map[string]interface{}) (map[string]interface{}, error) {
+	if cluster.SupportsMessage(node.ProtocolVersion, "task_submit_response") {
+		return gc.requestFromNode(node.ID, "task_submit", payload, taskSubmitTimeout)
+	}
+
+	conn, exists := gc.nodeConns.get(node.ID)
+	if !exists {
+		return nil, errNodeNotConnected
+	}
+	if err := gc.forward(conn, node.ID, Message{Type: "task_submit", Payload: payload}); err != nil {
+		return nil, fmt.Errorf("send task_submit to worker %s: %w", node.ID, err)
+	}
+	return nil, nil
+}
+
+// GetAllTasks 获取所有任务列表，可选的status只列出该状态的任务（如paused）
 func (gc *GatewayController) GetAllTasks(c *gin.Context) {
+	taskStatus := c.Query("status")
+
 	// 从所有连接的worker节点获取任务状态
 	nodes := gc.gateway.GetOnlineNodes()
 	if len(nodes) == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"success": true,
 			"data": gin.H{
-				"tasks": []map[string]interface{}{},
+				"tasks": filterTasksByStatus(gc.queuedTasks(), taskStatus),
 			},
 		})
 		return
 	}
 
+	// 并发的任务列表请求共享同一次广播，不同状态过滤分别广播
+	status, body, shared := gc.shareCall("get_tasks?status="+taskStatus, func() (int, interface{}) {
+		return gc.collectTasks(nodes, taskStatus)
+	})
+	if shared {
+		nodeIDs := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			nodeIDs = append(nodeIDs, node.ID)
+		}
+		gc.throttle.coalesced(nodeIDs...)
+	}
+	c.JSON(status, body)
+}
+
+// collectTasks 向在线节点广播任务列表请求并合并响应。超出限速的节点不再请求，
+// 改用网关任务登记中该节点的任务，并在cached_nodes中列出这些节点。
+// taskStatus非空时节点只返回该状态的任务，登记和排队的任务同样过滤
+func (gc *GatewayController) collectTasks(nodes []*WorkerNode, taskStatus string) (int, gin.H) {
+	var targets, cachedNodes []string
+	var delay time.Duration
+	for _, node := range nodes {
+		if !gc.nodeConns.has(node.ID) {
+			continue
+		}
+		wait, ok := gc.throttle.reserve(node.ID)
+		if !ok {
+			cachedNodes = append(cachedNodes, node.ID)
+			continue
+		}
+		if wait > delay {
+			delay = wait
+		}
+		targets = append(targets, node.ID)
+	}
+	cachedTasks := filterTasksByStatus(gc.registryTasks(cachedNodes), taskStatus)
+
+	result := func(tasks []map[string]interface{}) gin.H {
+		data := gin.H{"tasks": append(append(tasks, cachedTasks...), filterTasksByStatus(gc.queuedTasks(), taskStatus)...)}
+		if len(cachedNodes) > 0 {
+			data["cached_nodes"] = cachedNodes
+		}
+		return gin.H{
+			"success": true,
+			"data":    data,
+		}
+	}
+
 	// 创建请求ID和等待响应的通道
 	requestID := generateRequestID()
 	responseChan := make(chan []map[string]interface{}, 1)
@@ -405,151 +906,842 @@ func (gc *GatewayController) GetAllTasks(c *gin.Context) {
 		RequestID:     requestID,
 		RequestType:   "get_tasks",
 		Responses:     make([]map[string]interface{}, 0),
-		ExpectedNodes: len(nodes),
+		ExpectedNodes: len(targets),
+		TargetNodes:   nodeSet(targets),
 		ResponseChan:  responseChan,
 		CreatedAt:     time.Now(),
 	}
 	gc.mutex.Unlock()
 
-	// 向所有在线节点发送任务列表请求
-	sentCount := 0
-	for _, node := range nodes {
-		if conn, exists := gc.nodeConns[node.ID]; exists {
+	// 等待各节点的配额后向其发送任务列表请求
+	gc.throttle.sleep(delay, targets...)
+	var sent []string
+	for _, nodeID := range targets {
+		if conn, exists := gc.nodeConns.get(nodeID); exists {
 			message := Message{
 				Type: "get_tasks",
 				Payload: map[string]interface{}{
 					"request_id": requestID,
-					"timestamp":  time.Now().Unix(),
+					"timestamp":  timefmt.Format(time.Now()),
 				},
 			}
+			if taskStatus != "" {
+				message.Payload["status"] = taskStatus
+			}
 
-			if err := conn.WriteJSON(message); err != nil {
-				log.Printf("Failed to request tasks from worker %s: %v", node.ID, err)
+			if err := gc.forward(conn, nodeID, message); err != nil {
+				log.Printf("Failed to request tasks from worker %s: %v", nodeID, err)
 				continue
 			}
-			sentCount++
+			sent = append(sent, nodeID)
 		}
 	}
 
-	// 如果没有成功发送任何请求，直接返回空结果
-	if sentCount == 0 {
+	// 如果没有成功发送任何请求，直接返回缓存的结果
+	if len(sent) == 0 {
 		gc.mutex.Lock()
-		delete(gc.pendingRequests, requestID)
+		gc.removeRequestLocked(requestID)
 		gc.mutex.Unlock()
 
-		c.JSON(http.StatusOK, gin.H{
-			"success": true,
-			"data": gin.H{
-				"tasks": []map[string]interface{}{},
-			},
-		})
-		return
+		return http.StatusOK, result([]map[string]interface{}{})
 	}
 
-	// 更新期待的节点数量
+	// 更新期待的节点，此前已到达的响应和已断开的节点按新数量重新判断
 	gc.mutex.Lock()
 	if req, exists := gc.pendingRequests[requestID]; exists {
-		req.ExpectedNodes = sentCount
+		req.mutex.Lock()
+		gc.awaitNodesLocked(req, sent)
+		gc.completeIfAnsweredLocked(req)
+		req.mutex.Unlock()
 	}
 	gc.mutex.Unlock()
 
 	// 等待响应或超时
 	select {
 	case allTasks := <-responseChan:
-		c.JSON(http.StatusOK, gin.H{
-			"success": true,
-			"data": gin.H{
-				"tasks": allTasks,
-			},
-		})
+		return http.StatusOK, result(allTasks)
 	case <-time.After(10 * time.Second):
 		// 超时处理
 		gc.mutex.Lock()
-		delete(gc.pendingRequests, requestID)
+		gc.removeRequestLocked(requestID)
 		gc.mutex.Unlock()
 
-		c.JSON(http.StatusRequestTimeout, gin.H{
+		return http.StatusRequestTimeout, gin.H{
 			"success": false,
 			"error":   "Request timeout while waiting for worker responses",
-		})
+		}
 	}
 }
 
-// GetTaskDetail 获取任务详情
-func (gc *GatewayController) GetTaskDetail(c *gin.Context) {
-	taskID := c.Param("id")
-
-	// 从worker节点获取任务详情
-	nodes := gc.gateway.GetOnlineNodes()
-	for _, node := range nodes {
-		if conn, exists := gc.nodeConns[node.ID]; exists {
-			message := Message{
-				Type: "get_task_detail",
-				Payload: map[string]interface{}{
-					"task_id":   taskID,
-					"timestamp": time.Now().Unix(),
-				},
-			}
+// filterTasksByStatus 只保留指定状态的任务，status为空时原样返回
+func filterTasksByStatus(tasks []map[string]interface{}, status string) []map[string]interface{} {
+	if status == "" {
+		return tasks
+	}
+	filtered := []map[string]interface{}{}
+	for _, task := range tasks {
+		if fmt.Sprint(task["status"]) == status {
+			filtered = append(filtered, task)
+		}
+	}
+	return filtered
+}
 
-			if err := conn.WriteJSON(message); err != nil {
-				log.Printf("Failed to request task detail from worker %s: %v", node.ID, err)
+// registryTasks 网关任务登记中这些节点的任务，用于节点被限速时代替实时数据，
+// 只包含登记的状态与流量，带有cached标记
+func (gc *GatewayController) registryTasks(nodeIDs []string) []map[string]interface{} {
+	tasks := []map[string]interface{}{}
+	if gc.tasks == nil {
+		return tasks
+	}
+	for _, nodeID := range nodeIDs {
+		records, err := gc.tasks.ListByWorker(context.Background(), nodeID)
+		if err != nil {
+			log.Printf("Failed to list registered tasks of worker %s: %v", nodeID, err)
+			continue
+		}
+		for _, record := range records {
+			// 排队中的任务由分派队列列出
+			if record.Status == StatusPendingDispatch {
 				continue
 			}
+			tasks = append(tasks, map[string]interface{}{
+				"id":               record.TaskID,
+				"magnet_url":       "",
+				"status":           record.Status,
+				"worker_id":        record.WorkerID,
+				"bytes_downloaded": record.BytesDownloaded,
+				"bytes_served":     record.BytesServed,
+				"created_at":       record.CreatedAt,
+				"updated_at":       record.UpdatedAt,
+				"cached":           true,
+			})
 		}
 	}
-
-	// 暂时返回未找到
-	c.JSON(http.StatusNotFound, gin.H{
-		"success": false,
-		"error":   "Task not found",
-	})
+	return tasks
 }
 
-// GetSystemStatus 获取系统状态
-func (gc *GatewayController) GetSystemStatus(c *gin.Context) {
-	totalNodes, onlineNodes, activeSessions := gc.gateway.Stats()
-
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"data": gin.H{
-			"online_nodes":    onlineNodes,
-			"total_nodes":     totalNodes,
-			"active_sessions": activeSessions,
-		},
-	})
-}
+// GetTaskDetail 获取任务详情。已登记的任务（仅限所有者或管理员）向其所在节点查询实时详情，
+// 附上网关保存的完成摘要；节点离线或已没有该任务时返回登记的信息。未登记的任务向所有在线节点查询
+func (gc *GatewayController) GetTaskDetail(c *gin.Context) {
+	taskID := c.Param("id")
 
-// HandleNodeWebSocket 处理工作节点WebSocket连接
-func (gc *GatewayController) HandleNodeWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
+	var record *task.Record
+	if gc.tasks != nil {
+		if _, err := gc.tasks.Get(c.Request.Context(), taskID); err == nil {
+			var ok bool
+			if record, ok = gc.ownedTask(c); !ok {
+				return
+			}
+		} else if !errors.Is(err, task.ErrNotFound) {
+			log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		}
 	}
-	defer conn.Close()
 
-	// 等待节点注册消息
-	var nodeInfo WorkerNode
-	if err := conn.ReadJSON(&nodeInfo); err != nil {
-		log.Printf("Failed to read node registration: %v", err)
-		return
+	var candidates []string
+	if record != nil {
+		if gc.nodeConns.has(record.WorkerID) {
+			candidates = []string{record.WorkerID}
+		}
+	} else {
+		for _, node := range gc.gateway.GetOnlineNodes() {
+			if gc.nodeConns.has(node.ID) {
+				candidates = append(candidates, node.ID)
+			}
+		}
 	}
 
-	// 注册节点
-	gc.gateway.RegisterNode(&nodeInfo)
-	gc.nodeConns[nodeInfo.ID] = conn
-
-	log.Printf("Worker node %s connected: %s", nodeInfo.ID, nodeInfo.Name)
-
-	// 发送注册确认
-	confirmMsg := Message{
+	detail, err := gc.requestTaskDetail(taskID, candidates)
+	switch {
+	case errors.Is(err, errNodeTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"success": false,
+			"error":   "Request timeout while waiting for worker responses",
+		})
+	case detail != nil:
+		if record != nil && len(record.Summary) > 0 {
+			detail["summary"] = record.Summary
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    detail,
+		})
+	case record != nil:
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    record,
+		})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+	}
+}
+
+// requestTaskDetail 向候选节点发送get_task_detail，返回第一个找到该任务的节点的详情；
+// 没有节点找到时返回nil，未全部回复时返回errNodeTimeout
+func (gc *GatewayController) requestTaskDetail(taskID string, candidates []string) (map[string]interface{}, error) {
+	requestID := generateRequestID()
+	responseChan := make(chan []map[string]interface{}, 1)
+
+	gc.mutex.Lock()
+	gc.pendingRequests[requestID] = &PendingRequest{
+		RequestID:    requestID,
+		RequestType:  "get_task_detail",
+		TaskID:       taskID,
+		Responses:    make([]map[string]interface{}, 0),
+		TargetNodes:  nodeSet(candidates),
+		ResponseChan: responseChan,
+		CreatedAt:    time.Now(),
+	}
+	gc.mutex.Unlock()
+
+	var sent []string
+	for _, nodeID := range candidates {
+		if conn, exists := gc.nodeConns.get(nodeID); exists {
+			if !gc.throttle.wait(nodeID) {
+				continue
+			}
+			message := Message{
+				Type: "get_task_detail",
+				Payload: map[string]interface{}{
+					"request_id": requestID,
+					"task_id":    taskID,
+					"timestamp":  timefmt.Format(time.Now()),
+				},
+			}
+
+			if err := gc.forward(conn, nodeID, message); err != nil {
+				log.Printf("Failed to request task detail from worker %s: %v", nodeID, err)
+				continue
+			}
+			sent = append(sent, nodeID)
+		}
+	}
+
+	// 没有节点可以询问
+	if len(sent) == 0 {
+		gc.mutex.Lock()
+		gc.removeRequestLocked(requestID)
+		gc.mutex.Unlock()
+		return nil, nil
+	}
+
+	// 更新期待的节点，此前已到达的响应和已断开的节点按新数量重新判断
+	gc.mutex.Lock()
+	if req, exists := gc.pendingRequests[requestID]; exists {
+		req.mutex.Lock()
+		gc.awaitNodesLocked(req, sent)
+		gc.completeIfAnsweredLocked(req)
+		req.mutex.Unlock()
+	}
+	gc.mutex.Unlock()
+
+	select {
+	case responses := <-responseChan:
+		for _, response := range responses {
+			if found, _ := response["found"].(bool); !found {
+				continue
+			}
+			detail, _ := response["task"].(map[string]interface{})
+			if detail == nil {
+				continue
+			}
+			timefmt.NormalizeFields(detail, "created_at", "updated_at")
+			nodeID, _ := response["node_id"].(string)
+			gc.normalizeSrts(nodeID, "task_detail_response", detail)
+			if _, ok := detail["worker_id"]; !ok {
+				detail["worker_id"] = response["node_id"]
+			}
+			return detail, nil
+		}
+		return nil, nil
+	case <-time.After(taskDetailTimeout):
+		gc.mutex.Lock()
+		gc.removeRequestLocked(requestID)
+		gc.mutex.Unlock()
+		return nil, errNodeTimeout
+	}
+}
+
+// GetTaskLocation 查询任务所在的节点及其是否在线，节点离线时附带最后在线时间
+func (gc *GatewayController) GetTaskLocation(c *gin.Context) {
+	taskID := c.Param("id")
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	location := gin.H{
+		"task_id":   taskID,
+		"worker_id": record.WorkerID,
+		"online":    false,
+	}
+	if node, exists := gc.gateway.GetNode(record.WorkerID); exists && node.Status == "online" {
+		location["online"] = true
+	} else if seen, ok := gc.gateway.LastSeen(record.WorkerID); ok {
+		// 断开的节点已被移除，最后一次注册或心跳的时间仍有记录
+		location["last_seen"] = seen
+	} else {
+		// 网关启动以来没有见过该节点，最后在线时间未知
+		location["last_seen"] = nil
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    location,
+	})
+}
+
+// GetTaskLog 下载任务日志的末尾部分（仅限任务所有者或管理员）
+func (gc *GatewayController) GetTaskLog(c *gin.Context) {
+	record, ok := gc.ownedTask(c)
+	if !ok {
+		return
+	}
+	taskID := record.TaskID
+
+	kb, err := strconv.Atoi(c.DefaultQuery("kb", strconv.Itoa(defaultTaskLogKB)))
+	if err != nil || kb <= 0 {
+		kb = defaultTaskLogKB
+	}
+	if kb > maxTaskLogKB {
+		kb = maxTaskLogKB
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "get_task_log", map[string]interface{}{
+		"task_id":   taskID,
+		"max_bytes": kb * 1024,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if found, _ := response["found"].(bool); !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task log not found",
+		})
+		return
+	}
+
+	content, _ := response["content"].(string)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", taskID+".log"))
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(content))
+}
+
+// PruneTaskData 让任务所在节点删除其下载残留数据，dry_run=true时只返回将被删除的文件
+func (gc *GatewayController) PruneTaskData(c *gin.Context) {
+	taskID := c.Param("id")
+	dryRun := c.Query("dry_run") == "true" || c.Query("dry_run") == "1"
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if err != nil {
+		if errors.Is(err, task.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Task not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "prune_task_data", map[string]interface{}{
+		"task_id": taskID,
+		"dry_run": dryRun,
+	}, 30*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id":         taskID,
+			"dry_run":         dryRun,
+			"files":           response["files"],
+			"reclaimed_bytes": response["reclaimed_bytes"],
+		},
+	})
+}
+
+// SetTaskPriority 修改任务的下载优先级（1-10，仅限管理员）。节点下载名额用完时，
+// 排队的任务按优先级从高到低开始，已开始下载的任务只记录新的优先级
+func (gc *GatewayController) SetTaskPriority(c *gin.Context) {
+	var req SetPriorityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "priority must be an integer between 1 and 10",
+		})
+		return
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	taskID := c.Param("id")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "set_priority", map[string]interface{}{
+		"task_id":  taskID,
+		"priority": req.Priority,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id":  taskID,
+			"priority": req.Priority,
+		},
+	})
+}
+
+// GetTaskPieces 获取任务视频文件的分片可用性（游程编码），供播放器显示已缓冲的时间范围
+func (gc *GatewayController) GetTaskPieces(c *gin.Context) {
+	taskID := c.Param("id")
+
+	gc.piecesMu.Lock()
+	cached, ok := gc.piecesCache[taskID]
+	gc.piecesMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < taskPiecesCacheTTL {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    cached.data,
+		})
+		return
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if err != nil {
+		if errors.Is(err, task.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Task not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "get_task_pieces", map[string]interface{}{
+		"task_id": taskID,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if found, _ := response["found"].(bool); !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return
+	}
+	if message, ok := response["error"].(string); ok && message != "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   message,
+		})
+		return
+	}
+
+	data := gin.H{
+		"task_id":           taskID,
+		"pieces":            response["pieces"],
+		"duration_seconds":  response["duration_seconds"],
+		"seconds_per_piece": response["seconds_per_piece"],
+	}
+
+	gc.piecesMu.Lock()
+	for id, entry := range gc.piecesCache {
+		if time.Since(entry.fetchedAt) >= taskPiecesCacheTTL {
+			delete(gc.piecesCache, id)
+		}
+	}
+	gc.piecesCache[taskID] = cachedPieces{data: data, fetchedAt: time.Now()}
+	gc.piecesMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    data,
+	})
+}
+
+// SetTaskPinned 置顶或取消置顶任务（仅限任务所有者或管理员），置顶的任务不会被节点自动清理
+func (gc *GatewayController) SetTaskPinned(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	var req PinTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid request body",
+		})
+		return
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	taskID := c.Param("id")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	if account.Role != user.RoleAdmin && !record.IsOwnedBy(account.ID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "无权修改该任务",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "task_pin", map[string]interface{}{
+		"task_id": taskID,
+		"pinned":  req.Pinned,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id": taskID,
+			"pinned":  req.Pinned,
+		},
+	})
+}
+
+// RetryTask 手动重试失败或永久失败的任务（仅限任务所有者或管理员），节点会将自动重试计数清零
+func (gc *GatewayController) RetryTask(c *gin.Context) {
+	record, ok := gc.ownedTask(c)
+	if !ok {
+		return
+	}
+	taskID := record.TaskID
+
+	// 请求体可选，allow_private确认重试被节点拒绝的私有种子
+	var request RetryTaskRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "Invalid request format",
+			})
+			return
+		}
+	}
+
+	retryPayload := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if request.AllowPrivate {
+		retryPayload["allow_private"] = true
+	}
+	response, err := gc.requestFromNode(record.WorkerID, "task_retry", retryPayload, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id": taskID,
+		},
+	})
+}
+
+// ListLocalMedia 列出节点额外媒体目录中可转码的视频文件
+func (gc *GatewayController) ListLocalMedia(c *gin.Context) {
+	nodeID := c.Param("id")
+
+	response, err := gc.requestFromNode(nodeID, "list_local_media", map[string]interface{}{}, 30*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, nodeID, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"node_id":   nodeID,
+			"roots":     response["roots"],
+			"files":     response["files"],
+			"truncated": response["truncated"],
+		},
+	})
+}
+
+// TranscodeLocal 为节点额外媒体目录中的文件创建转码任务
+func (gc *GatewayController) TranscodeLocal(c *gin.Context) {
+	nodeID := c.Param("id")
+
+	var req TranscodeLocalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid request body",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(nodeID, "transcode_local", map[string]interface{}{
+		"path": req.Path,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, nodeID, err)
+		return
+	}
+
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"node_id": nodeID,
+			"task_id": response["task_id"],
+		},
+	})
+}
+
+// GetSystemStatus 获取系统状态
+func (gc *GatewayController) GetSystemStatus(c *gin.Context) {
+	totalNodes, onlineNodes, activeSessions := gc.gateway.Stats()
+	dispatch := gc.queue.stats(time.Now())
+	dispatch.Mode = gc.admission.Mode
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"online_nodes":       onlineNodes,
+			"total_nodes":        totalNodes,
+			"active_sessions":    activeSessions,
+			"session_migrations": gc.gateway.Migrations(),
+			"node_requests":      gc.throttle.stats(),
+			"dispatch_queue":     dispatch,
+			"webrtc":             gc.gateway.WebRTCStats(),
+			"forwarding":         gc.forwardStats.snapshot(),
+			"clock_skew":         gc.gateway.ClockSkewStats(),
+		},
+	})
+}
+
+// HandleNodeWebSocket 处理工作节点WebSocket连接
+func (gc *GatewayController) HandleNodeWebSocket(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// 等待节点注册消息，clock_ms为节点发送时的本机时钟
+	var registration struct {
+		WorkerNode
+		ClockMs int64 `json:"clock_ms"`
+	}
+	conn.SetReadDeadline(time.Now().Add(nodePongWait))
+	if err := conn.ReadJSON(&registration); err != nil {
+		log.Printf("Failed to read node registration: %v", err)
+		return
+	}
+	receivedAt := time.Now()
+	nodeInfo := registration.WorkerNode
+
+	// 协商协议版本，拒绝版本不兼容的节点
+	version, err := cluster.NegotiateProtocol(nodeInfo.ProtocolVersion, nodeInfo.MinProtocolVersion)
+	if err != nil {
+		log.Printf("Rejecting worker node %s: %v", nodeInfo.ID, err)
+		conn.WriteJSON(Message{
+			Type: "registration_rejected",
+			Payload: map[string]interface{}{
+				"node_id":              nodeInfo.ID,
+				"reason":               err.Error(),
+				"protocol_version":     cluster.ProtocolVersion,
+				"min_protocol_version": cluster.MinProtocolVersion,
+			},
+		})
+		return
+	}
+	nodeInfo.ProtocolVersion = version
+
+	// 同一节点ID已有存活的连接时拒绝新连接，并正常关闭，节点据此等待后重连而不是当作错误。
+	// 旧连接已错过ping期限（半开）时新连接替换它并关闭旧连接，旧连接的读循环发现已被替换，不会注销节点
+	nodeConn, replaced, registered := gc.nodeConns.registerLive(nodeInfo.ID, conn)
+	if !registered {
+		log.Printf("Rejecting worker node %s: already connected", nodeInfo.ID)
+		rejectConnection(conn, nodeInfo.ID, rejectAlreadyConnected)
+		return
+	}
+	if replaced != nil {
+		log.Printf("Worker node %s reconnected, closing its stale connection", nodeInfo.ID)
+		replaced.conn.Close()
+	}
+	stopKeepAlive := make(chan struct{})
+	defer close(stopKeepAlive)
+	go nodeConn.keepAlive(stopKeepAlive)
+
+	// 注册节点
+	gc.gateway.RegisterNode(&nodeInfo)
+	if registration.ClockMs > 0 {
+		gc.recordClockSkew(nodeInfo.ID, gc.gateway.RecordClockSample(nodeInfo.ID, time.UnixMilli(registration.ClockMs), receivedAt))
+	}
+	gc.wakeDispatcher()
+
+	log.Printf("Worker node %s connected: %s (protocol v%d)", nodeInfo.ID, nodeInfo.Name, version)
+
+	// 发送注册确认，gateway_clock_ms由节点在clock_sync中原样带回，用于测量往返时间和时钟偏差
+	confirmMsg := Message{
 		Type: "registration_confirmed",
 		Payload: map[string]interface{}{
-			"node_id": nodeInfo.ID,
-			"status":  "registered",
+			"node_id":          nodeInfo.ID,
+			"status":           "registered",
+			"protocol_version": version,
+			"gateway_clock_ms": time.Now().UnixMilli(),
 		},
 	}
-	conn.WriteJSON(confirmMsg)
+	nodeConn.WriteJSON(confirmMsg)
 
 	// 处理来自节点的消息
 	for {
@@ -558,13 +1750,81 @@ func (gc *GatewayController) HandleNodeWebSocket(c *gin.Context) {
 			log.Printf("Worker node %s disconnected: %v", nodeInfo.ID, err)
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(nodePongWait))
+		nodeConn.touch()
 
 		gc.handleNodeMessage(nodeInfo.ID, &message)
 	}
 
-	// 清理连接
-	delete(gc.nodeConns, nodeInfo.ID)
+	// 清理连接；已被重连替换时节点仍在线，只关闭本连接
+	if !gc.nodeConns.remove(nodeInfo.ID, nodeConn) {
+		return
+	}
 	gc.gateway.RemoveNode(nodeInfo.ID)
+	gc.throttle.forget(nodeInfo.ID)
+	gc.releaseNodeRequests(nodeInfo.ID)
+
+	// 将该节点上的播放会话转移到副本节点
+	gc.migrateSessions(nodeInfo.ID)
+}
+
+// recordClockSkew 节点时钟偏差越过告警阈值或恢复正常时记录日志
+func (gc *GatewayController) recordClockSkew(nodeID string, change cluster.ClockSkewChange) {
+	if !change.Changed {
+		return
+	}
+	if change.Warning {
+		log.Printf("Worker node %s clock skew is %s (round trip %s), exceeding the warning threshold", nodeID, change.Skew, change.RTT)
+		return
+	}
+	log.Printf("Worker node %s clock skew is back to %s", nodeID, change.Skew)
+}
+
+// rejectAlreadyConnected 节点ID已有连接时connection_rejected的原因
+const rejectAlreadyConnected = "already_connected"
+
+// rejectConnection 发送connection_rejected后以1013（稍后重试）关闭帧关闭连接
+func rejectConnection(conn *websocket.Conn, nodeID, reason string) {
+	conn.WriteJSON(Message{
+		Type: "connection_rejected",
+		Payload: map[string]interface{}{
+			"node_id": nodeID,
+			"reason":  reason,
+		},
+	})
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+	conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+// migrateSessions 节点断开后通知其会话的客户端改连持有同一任务的其它节点
+func (gc *GatewayController) migrateSessions(nodeID string) {
+	for _, migration := range gc.gateway.MigrateSessions(nodeID) {
+		session := migration.Session
+		if migration.NewWorkerID == "" {
+			log.Printf("No replica for session %s (task %s) after worker %s disconnected", session.SessionID, session.TaskID, nodeID)
+			continue
+		}
+
+		clientConn, exists := gc.clientConns.get(session.ClientID)
+		if !exists {
+			log.Printf("Client %s of migrated session %s is not connected", session.ClientID, session.SessionID)
+			continue
+		}
+
+		log.Printf("Migrating session %s (task %s) from worker %s to %s", session.SessionID, session.TaskID, nodeID, migration.NewWorkerID)
+		if err := gc.forward(clientConn, session.ClientID, Message{
+			Type: "session_migrate",
+			Payload: map[string]interface{}{
+				"session_id":    session.SessionID,
+				"task_id":       session.TaskID,
+				"old_worker_id": migration.OldWorkerID,
+				"new_worker_id": migration.NewWorkerID,
+				"timestamp":     timefmt.Format(time.Now()),
+			},
+		}); err != nil {
+			log.Printf("Failed to send session_migrate to client %s: %v", session.ClientID, err)
+		}
+	}
 }
 
 // HandleClientWebSocket 处理客户端WebSocket连接
@@ -582,7 +1842,12 @@ func (gc *GatewayController) HandleClientWebSocket(c *gin.Context) {
 		return
 	}
 
-	gc.clientConns[clientID] = conn
+	var userID int64
+	if account, ok := middleware.CurrentUser(c); ok {
+		userID = account.ID
+	}
+	clientConn, _ := gc.clientConns.registerUser(clientID, userID, conn)
+	gc.clientReconnected(clientID)
 	log.Printf("Client %s connected", clientID)
 
 	// 处理来自客户端的消息
@@ -596,8 +1861,10 @@ func (gc *GatewayController) HandleClientWebSocket(c *gin.Context) {
 		gc.handleClientMessage(clientID, &message)
 	}
 
-	// 清理连接
-	delete(gc.clientConns, clientID)
+	// 清理连接。同一客户端已用新连接重连时保留新连接
+	if gc.clientConns.remove(clientID, clientConn) {
+		gc.clientDisconnected(clientID)
+	}
 }
 
 // handleNodeMessage 处理来自工作节点的消息
@@ -605,6 +1872,20 @@ func (gc *GatewayController) handleNodeMessage(nodeID string, message *Message)
 	switch message.Type {
 	case "heartbeat":
 		gc.gateway.UpdateNodeHeartbeat(nodeID)
+		if metrics, ok := message.Payload["metrics"].(map[string]interface{}); ok {
+			gc.gateway.UpdateNodeMetrics(nodeID, metrics)
+		}
+		if clock, ok := message.Payload["clock_ms"].(float64); ok {
+			gc.recordClockSkew(nodeID, gc.gateway.RecordClockSample(nodeID, time.UnixMilli(int64(clock)), time.Now()))
+		}
+		gc.wakeDispatcher()
+
+	case "clock_sync":
+		sent, sentOK := message.Payload["gateway_clock_ms"].(float64)
+		clock, clockOK := message.Payload["clock_ms"].(float64)
+		if sentOK && clockOK {
+			gc.recordClockSkew(nodeID, gc.gateway.RecordClockSync(nodeID, time.UnixMilli(int64(sent)), time.UnixMilli(int64(clock)), time.Now()))
+		}
 
 	case "webrtc_answer":
 		// 转发WebRTC Answer到客户端
@@ -613,9 +1894,9 @@ func (gc *GatewayController) handleNodeMessage(nodeID string, message *Message)
 			log.Printf("Looking for session: %s", sessionID)
 			if session, exists := gc.gateway.GetWebRTCSession(sessionID); exists {
 				log.Printf("Found session %s, client: %s", sessionID, session.ClientID)
-				if clientConn, exists := gc.clientConns[session.ClientID]; exists {
+				if clientConn, exists := gc.clientConns.get(session.ClientID); exists {
 					log.Printf("Forwarding webrtc_answer to client %s", session.ClientID)
-					if err := clientConn.WriteJSON(message); err != nil {
+					if err := gc.forward(clientConn, session.ClientID, *message); err != nil {
 						log.Printf("Failed to forward webrtc_answer: %v", err)
 					}
 				} else {
@@ -628,6 +1909,33 @@ func (gc *GatewayController) handleNodeMessage(nodeID string, message *Message)
 			log.Printf("No session_id in webrtc_answer payload")
 		}
 
+	case "webrtc_offer_failed":
+		// 节点无法应答Offer或没有收集到ICE候选者，节点已关闭会话：
+		// 先从活跃会话中移除，再转发原因给客户端
+		log.Printf("WebRTC offer failed on node %s: %v", nodeID, message.Payload)
+		sessionID, _ := message.Payload["session_id"].(string)
+		session, exists := gc.gateway.GetWebRTCSession(sessionID)
+		if !exists || session.WorkerID != nodeID {
+			log.Printf("Session not found: %s", sessionID)
+			break
+		}
+		closed, ok := gc.gateway.CloseSession(sessionID)
+		if !ok {
+			break
+		}
+		if closed.Probe {
+			gc.probes.forget(sessionID)
+		}
+		if clientConn, exists := gc.clientConns.get(closed.ClientID); exists {
+			if err := gc.forward(clientConn, closed.ClientID, *message); err != nil {
+				log.Printf("Failed to forward webrtc_offer_failed: %v", err)
+			}
+		}
+
+	case "probe_result":
+		// 测速完成，缓存结果并转发给客户端
+		gc.handleProbeResult(nodeID, message.Payload)
+
 	case "ice_candidate":
 		// 转发ICE候选者到客户端
 		log.Printf("Received ice_candidate from node %s: %v", nodeID, message.Payload)
@@ -635,9 +1943,9 @@ func (gc *GatewayController) handleNodeMessage(nodeID string, message *Message)
 			log.Printf("Looking for session: %s", sessionID)
 			if session, exists := gc.gateway.GetWebRTCSession(sessionID); exists {
 				log.Printf("Found session %s, client: %s", sessionID, session.ClientID)
-				if clientConn, exists := gc.clientConns[session.ClientID]; exists {
+				if clientConn, exists := gc.clientConns.get(session.ClientID); exists {
 					log.Printf("Forwarding ice_candidate to client %s", session.ClientID)
-					if err := clientConn.WriteJSON(message); err != nil {
+					if err := gc.forward(clientConn, session.ClientID, *message); err != nil {
 						log.Printf("Failed to forward ice_candidate: %v", err)
 					}
 				} else {
@@ -651,8 +1959,34 @@ func (gc *GatewayController) handleNodeMessage(nodeID string, message *Message)
 		}
 
 	case "task_status":
-		// 任务状态更新，可以存储或转发给相关客户端
+		// 任务状态更新，记录任务所在节点与归属
 		log.Printf("Task status update from node %s: %v", nodeID, message.Payload)
+		gc.recordTaskStatus(nodeID, message.Payload)
+		gc.wakeDispatcher()
+
+	case "task_submit_response", "task_log_response", "prune_task_data_response", "task_pieces_response", "task_pin_response",
+		"local_media_list", "transcode_local_response", "task_retry_response", "ice_resend_response", "file_fetch_response",
+		"set_priority_response", "boost_task_response", "repair_segment_response", "session_stats_response", "queues_response",
+		"pause_all_response", "resume_all_response", "torrent_info_response", "task_access_response", "select_files_response",
+		"task_pause_response", "task_resume_response", "task_remove_response", "stream_token_response",
+		"set_rate_limit_response":
+		gc.handleNodeResponse(nodeID, message.Payload)
+
+	case "task_completed":
+		// 任务完成摘要
+		gc.recordTaskSummary(nodeID, message.Payload)
+
+	case "task_removed":
+		// 节点按保留策略删除了任务
+		gc.removeTaskRecord(nodeID, message.Payload)
+
+	case "task_traffic":
+		// 任务流量统计
+		gc.recordTaskTraffic(nodeID, message.Payload)
+
+	case "task_policy_check":
+		// 节点获取到种子元数据后复查黑名单
+		gc.handleTaskPolicyCheck(nodeID, message.Payload)
 
 	case "tasks_response":
 		// 处理任务列表响应
@@ -673,15 +2007,18 @@ func (gc *GatewayController) handleClientMessage(clientID string, message *Messa
 	case "webrtc_offer":
 		// 转发WebRTC Offer到指定工作节点
 		if workerID, ok := message.Payload["worker_id"].(string); ok {
-			if workerConn, exists := gc.nodeConns[workerID]; exists {
+			if workerConn, exists := gc.nodeConns.get(workerID); exists {
 				// 使用客户端提供的session_id，而不是创建新的
 				sessionID, _ := message.Payload["session_id"].(string)
 				if sessionID == "" {
 					sessionID = fmt.Sprintf("session_%s_%s_%d", clientID, workerID, time.Now().UnixNano())
 				}
 
-				// 创建WebRTC会话
+				// 创建WebRTC会话，记录播放的任务以便节点断开时转移
 				session := gc.gateway.CreateWebRTCSession(sessionID, clientID, workerID)
+				if taskID, _ := message.Payload["task_id"].(string); taskID != "" {
+					gc.gateway.SetSessionTask(session.SessionID, taskID)
+				}
 
 				// 确保消息中的session_id是正确的
 				message.Payload["session_id"] = session.SessionID
@@ -690,7 +2027,7 @@ func (gc *GatewayController) handleClientMessage(clientID string, message *Messa
 				log.Printf("Created WebRTC session %s between client %s and worker %s",
 					session.SessionID, clientID, workerID)
 
-				if err := workerConn.WriteJSON(message); err != nil {
+				if err := gc.forward(workerConn, workerID, *message); err != nil {
 					log.Printf("Failed to forward offer to worker %s: %v", workerID, err)
 				}
 			} else {
@@ -704,11 +2041,48 @@ func (gc *GatewayController) handleClientMessage(clientID string, message *Messa
 		// 转发ICE候选者到工作节点
 		if sessionID, ok := message.Payload["session_id"].(string); ok {
 			if session, exists := gc.gateway.GetWebRTCSession(sessionID); exists {
-				if workerConn, exists := gc.nodeConns[session.WorkerID]; exists {
-					workerConn.WriteJSON(message)
+				if workerConn, exists := gc.nodeConns.get(session.WorkerID); exists {
+					if err := gc.forward(workerConn, session.WorkerID, *message); err != nil {
+						log.Printf("Failed to forward ice_candidate to worker %s: %v", session.WorkerID, err)
+					}
+				}
+			}
+		}
+
+	case "ice_resend":
+		// 请求节点重发ICE候选者，等待节点响应期间不阻塞客户端的读循环
+		sessionID, _ := message.Payload["session_id"].(string)
+		reply := func(payload map[string]interface{}) {
+			if clientConn, exists := gc.clientConns.get(clientID); exists {
+				if err := gc.forward(clientConn, clientID, Message{Type: "ice_resend_response", Payload: payload}); err != nil {
+					log.Printf("Failed to send ice_resend_response to client %s: %v", clientID, err)
 				}
 			}
 		}
+		session, exists := gc.gateway.GetWebRTCSession(sessionID)
+		if !exists || session.ClientID != clientID {
+			reply(map[string]interface{}{
+				"session_id": sessionID,
+				"success":    false,
+				"error":      "Session not found",
+			})
+			return
+		}
+		go func() {
+			payload := gin.H{"success": true}
+			response, err := gc.resendICECandidates(session)
+			switch {
+			case err != nil:
+				log.Printf("Failed to re-send ICE candidates for session %s: %v", sessionID, err)
+				payload = gin.H{"success": false, "error": err.Error()}
+			case response["success"] != true:
+				payload = gin.H{"success": false, "error": response["error"]}
+			}
+			for k, v := range iceResendResult(session, response) {
+				payload[k] = v
+			}
+			reply(payload)
+		}()
 
 	default:
 		log.Printf("Unknown message type from client %s: %s", clientID, message.Type)
@@ -735,54 +2109,402 @@ func (gc *GatewayController) handleTasksResponse(nodeID string, payload map[stri
 
 	req, exists := gc.pendingRequests[requestID]
 	if !exists {
-		log.Printf("Received response for unknown request %s from %s", requestID, nodeID)
+		gc.dropUnmatchedResponseLocked(requestID, nodeID)
 		return
 	}
 
 	req.mutex.Lock()
 	defer req.mutex.Unlock()
 
-	// 添加节点信息到响应中
-	responseData := make(map[string]interface{})
-	for k, v := range payload {
-		responseData[k] = v
+	if _, accepted := gc.acceptResponseLocked(req, nodeID, payload); !accepted {
+		return
 	}
-	responseData["node_id"] = nodeID
-
-	req.Responses = append(req.Responses, responseData)
 
 	// 检查是否收集到所有响应
-	if len(req.Responses) >= req.ExpectedNodes {
-		// 合并所有任务
-		allTasks := make([]map[string]interface{}, 0)
-		for _, response := range req.Responses {
-			if tasks, ok := response["tasks"].([]interface{}); ok {
-				for _, task := range tasks {
-					if taskMap, ok := task.(map[string]interface{}); ok {
-						allTasks = append(allTasks, taskMap)
-					}
+	gc.completeIfAnsweredLocked(req)
+}
+
+// finishTasksRequest 合并各节点的任务列表交给等待的调用方并清理请求。调用方持有gc.mutex和req.mutex
+func (gc *GatewayController) finishTasksRequest(req *PendingRequest) {
+	allTasks := make([]map[string]interface{}, 0)
+	for _, response := range req.Responses {
+		if tasks, ok := response["tasks"].([]interface{}); ok {
+			for _, task := range tasks {
+				if taskMap, ok := task.(map[string]interface{}); ok {
+					taskID, _ := taskMap["id"].(string)
+					status, _ := taskMap["status"].(string)
+					responseNode, _ := response["node_id"].(string)
+					gc.advertiseTask(responseNode, taskID, status)
+
+					// 旧版节点可能上报其它时间格式，统一为RFC3339 UTC
+					timefmt.NormalizeFields(taskMap, "created_at", "updated_at")
+					gc.normalizeSrts(responseNode, "tasks_response", taskMap)
+					allTasks = append(allTasks, taskMap)
 				}
 			}
 		}
+	}
+
+	// 发送合并后的结果
+	select {
+	case req.ResponseChan <- allTasks:
+		// 成功发送
+	default:
+		// 通道已关闭或缓冲区满
+	}
+
+	// 清理请求
+	gc.removeRequestLocked(req.RequestID)
+}
+
+// handleTaskDetailResponse 处理任务详情响应。第一个found=true的响应立即返回给调用方，
+// 所有节点都回复found=false时返回未找到
+func (gc *GatewayController) handleTaskDetailResponse(nodeID string, payload map[string]interface{}) {
+	requestID, _ := payload["request_id"].(string)
+	taskID, _ := payload["task_id"].(string)
+
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
 
-		// 发送合并后的结果
-		select {
-		case req.ResponseChan <- allTasks:
-			// 成功发送
-		default:
-			// 通道已关闭或缓冲区满
+	req, exists := gc.pendingRequests[requestID]
+	if requestID == "" {
+		// 旧版节点不回传request_id，按任务ID匹配
+		for _, pending := range gc.pendingRequests {
+			if pending.RequestType == "get_task_detail" && pending.TaskID == taskID {
+				req, exists = pending, true
+				break
+			}
 		}
+	}
+	if !exists || req.RequestType != "get_task_detail" {
+		if requestID != "" && gc.finished.contains(requestID) {
+			gc.dropUnmatchedResponseLocked(requestID, nodeID)
+			return
+		}
+		log.Printf("Received task detail response for unknown request %q (task %s) from %s", requestID, taskID, nodeID)
+		return
+	}
+
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
 
-		// 清理请求
-		delete(gc.pendingRequests, requestID)
+	responseData, accepted := gc.acceptResponseLocked(req, nodeID, payload)
+	if !accepted {
+		return
+	}
+
+	if found, _ := responseData["found"].(bool); found {
+		gc.finishTaskDetailRequest(req, []map[string]interface{}{responseData})
+		return
+	}
+	// ExpectedNodes为0表示请求仍在发送中
+	if req.ExpectedNodes > 0 && len(req.Responses) >= req.ExpectedNodes {
+		gc.finishTaskDetailRequest(req, req.Responses)
 	}
 }
 
-// handleTaskDetailResponse 处理任务详情响应
-func (gc *GatewayController) handleTaskDetailResponse(nodeID string, payload map[string]interface{}) {
-	// 简单实现：找到第一个匹配的任务并返回
-	// 在实际应用中，可能需要更复杂的逻辑来处理多个worker节点
-	log.Printf("Received task detail response from %s: %v", nodeID, payload)
+// finishTaskDetailRequest 将结果交给等待的调用方并清理请求。调用方持有gc.mutex和req.mutex
+func (gc *GatewayController) finishTaskDetailRequest(req *PendingRequest, responses []map[string]interface{}) {
+	select {
+	case req.ResponseChan <- responses:
+	default:
+	}
+	gc.removeRequestLocked(req.RequestID)
+}
+
+// recordTaskStatus 将任务状态写入网关任务登记表
+func (gc *GatewayController) recordTaskStatus(nodeID string, payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	if taskID == "" {
+		return
+	}
+
+	status, _ := payload["status"].(string)
+	gc.advertiseTask(nodeID, taskID, status)
+	if gc.tasks == nil {
+		return
+	}
+
+	var ownerID *int64
+	if raw, ok := payload["owner_id"].(float64); ok {
+		id := int64(raw)
+		ownerID = &id
+	}
+
+	previous, _ := gc.tasks.Get(context.Background(), taskID)
+	if err := gc.tasks.Upsert(context.Background(), taskID, nodeID, status, ownerID); err != nil {
+		log.Printf("Failed to record task %s from node %s: %v", taskID, nodeID, err)
+	}
+	gc.notifyStatusChange(previous, nodeID, taskID, status, ownerID)
+	if infoHash, ok := payload["info_hash"].(string); ok {
+		if normalized, err := policy.NormalizeInfoHash(infoHash); err == nil {
+			gc.recordInfoHash(context.Background(), taskID, normalized)
+		}
+	}
+}
+
+// advertiseTask 记录节点上可播放（ready）的任务，供会话故障转移时查找副本
+func (gc *GatewayController) advertiseTask(nodeID, taskID, status string) {
+	if status == "ready" {
+		gc.gateway.AdvertiseTask(nodeID, taskID)
+	} else if status != "" {
+		gc.gateway.WithdrawTask(nodeID, taskID)
+	}
+}
+
+// removeTaskRecord 节点删除任务后同步删除网关登记的记录
+func (gc *GatewayController) removeTaskRecord(nodeID string, payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	if taskID == "" || gc.tasks == nil {
+		return
+	}
+
+	gc.gateway.WithdrawTask(nodeID, taskID)
+
+	reason, _ := payload["reason"].(string)
+	log.Printf("Node %s removed task %s (%s)", nodeID, taskID, reason)
+	if err := gc.tasks.Delete(context.Background(), taskID); err != nil {
+		log.Printf("Failed to delete task %s from registry: %v", taskID, err)
+	}
+}
+
+// handleTaskPolicyCheck 使用解析出的info hash与名称复查黑名单，并将结论回传节点
+func (gc *GatewayController) handleTaskPolicyCheck(nodeID string, payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	if taskID == "" || gc.blocklist == nil {
+		return
+	}
+
+	infoHash, _ := payload["info_hash"].(string)
+	name, _ := payload["name"].(string)
+
+	verdict := gc.blocklist.Check(infoHash, name)
+	if !verdict.Allowed {
+		var ownerID *int64
+		if gc.tasks != nil {
+			if record, err := gc.tasks.Get(context.Background(), taskID); err == nil {
+				ownerID = record.OwnerID
+			}
+		}
+		gc.blocklist.RecordBlocked(context.Background(), ownerID, taskID, infoHash, name, verdict)
+	}
+
+	conn, exists := gc.nodeConns.get(nodeID)
+	if !exists {
+		return
+	}
+
+	message := Message{
+		Type: "task_policy_verdict",
+		Payload: map[string]interface{}{
+			"task_id":   taskID,
+			"allowed":   verdict.Allowed,
+			"reason":    verdict.Reason,
+			"timestamp": timefmt.Format(time.Now()),
+		},
+	}
+	if err := gc.forward(conn, nodeID, message); err != nil {
+		log.Printf("Failed to send policy verdict for task %s to node %s: %v", taskID, nodeID, err)
+	}
+}
+
+// recordTaskSummary 保存节点上报的任务完成摘要
+func (gc *GatewayController) recordTaskSummary(nodeID string, payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	if taskID == "" || gc.tasks == nil {
+		return
+	}
+
+	// 旧版节点以Unix秒上报完成时间
+	if summary, ok := payload["summary"].(map[string]interface{}); ok {
+		timefmt.NormalizeFields(summary, "completed_at")
+	}
+	summary, err := json.Marshal(payload["summary"])
+	if err != nil {
+		log.Printf("Invalid summary for task %s from node %s: %v", taskID, nodeID, err)
+		return
+	}
+
+	status, _ := payload["status"].(string)
+	if status == "" {
+		status = "ready"
+	}
+
+	if err := gc.tasks.SaveSummary(context.Background(), taskID, nodeID, status, summary); err != nil {
+		log.Printf("Failed to store summary for task %s from node %s: %v", taskID, nodeID, err)
+	}
+}
+
+// recordTaskTraffic 保存节点上报的任务下载/服务流量
+func (gc *GatewayController) recordTaskTraffic(nodeID string, payload map[string]interface{}) {
+	entries, _ := payload["tasks"].([]interface{})
+	if gc.tasks == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		traffic, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		taskID, _ := traffic["task_id"].(string)
+		if taskID == "" {
+			continue
+		}
+		downloaded, _ := traffic["bytes_downloaded"].(float64)
+		served, _ := traffic["bytes_served"].(float64)
+
+		if err := gc.tasks.UpdateTraffic(context.Background(), taskID, int64(downloaded), int64(served)); err != nil {
+			log.Printf("Failed to store traffic for task %s from node %s: %v", taskID, nodeID, err)
+		}
+	}
+}
+
+// handleNodeResponse 将带request_id的节点响应交给等待中的请求
+func (gc *GatewayController) handleNodeResponse(nodeID string, payload map[string]interface{}) {
+	requestID, _ := payload["request_id"].(string)
+	if requestID == "" {
+		log.Printf("Received response from %s without request_id", nodeID)
+		return
+	}
+
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	req, exists := gc.pendingRequests[requestID]
+	if !exists {
+		gc.dropUnmatchedResponseLocked(requestID, nodeID)
+		return
+	}
+
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+
+	if _, accepted := gc.acceptResponseLocked(req, nodeID, payload); !accepted {
+		return
+	}
+
+	gc.completeIfAnsweredLocked(req)
+}
+
+var (
+	errNodeNotConnected = errors.New("worker node not connected")
+	errNodeTimeout      = errors.New("request timeout while waiting for worker response")
+	errNodeUnsupported  = errors.New("worker node protocol does not support this request")
+	errNodeBusy         = errors.New("worker node request rate limit exceeded")
+)
+
+// requestFromNode 向单个节点发送请求，并等待带相同request_id的响应
+func (gc *GatewayController) requestFromNode(nodeID, msgType string, payload map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	return gc.nodeRequest(nodeID, msgType, payload, timeout, true)
+}
+
+// nodeRequest 发送请求并等待响应。throttled为false时不占用节点的请求配额，
+// 用于同一次文件传输中的后续分块，限速只作用于传输的开始
+func (gc *GatewayController) nodeRequest(nodeID, msgType string, payload map[string]interface{}, timeout time.Duration, throttled bool) (map[string]interface{}, error) {
+	conn, exists := gc.nodeConns.get(nodeID)
+	if !exists {
+		return nil, errNodeNotConnected
+	}
+	if node, ok := gc.gateway.GetNode(nodeID); ok && !cluster.SupportsMessage(node.ProtocolVersion, msgType) {
+		return nil, errNodeUnsupported
+	}
+	if throttled && !gc.throttle.wait(nodeID) {
+		return nil, errNodeBusy
+	}
+
+	requestID := generateRequestID()
+	responseChan := make(chan []map[string]interface{}, 1)
+
+	gc.mutex.Lock()
+	gc.pendingRequests[requestID] = &PendingRequest{
+		RequestID:     requestID,
+		RequestType:   msgType,
+		Responses:     make([]map[string]interface{}, 0, 1),
+		ExpectedNodes: 1,
+		TargetNodes:   nodeSet([]string{nodeID}),
+		ResponseChan:  responseChan,
+		CreatedAt:     time.Now(),
+		Timeout:       timeout,
+	}
+	gc.mutex.Unlock()
+
+	payload["request_id"] = requestID
+	payload["timestamp"] = timefmt.Format(time.Now())
+
+	if err := gc.forward(conn, nodeID, Message{Type: msgType, Payload: payload}); err != nil {
+		gc.mutex.Lock()
+		gc.removeRequestLocked(requestID)
+		gc.mutex.Unlock()
+		return nil, fmt.Errorf("send %s to worker %s: %w", msgType, nodeID, err)
+	}
+	gc.mutex.Lock()
+	if req, exists := gc.pendingRequests[requestID]; exists {
+		req.mutex.Lock()
+		gc.awaitNodesLocked(req, []string{nodeID})
+		gc.completeIfAnsweredLocked(req)
+		req.mutex.Unlock()
+	}
+	gc.mutex.Unlock()
+
+	select {
+	case responses, ok := <-responseChan:
+		if !ok {
+			return nil, errNodeTimeout
+		}
+		if len(responses) == 0 {
+			// 节点在回复前断开
+			return nil, errNodeNotConnected
+		}
+		return responses[0], nil
+	case <-time.After(timeout):
+		gc.mutex.Lock()
+		gc.removeRequestLocked(requestID)
+		gc.mutex.Unlock()
+		return nil, errNodeTimeout
+	}
+}
+
+// respondNodeRequestError 将节点请求失败映射为HTTP响应
+func (gc *GatewayController) respondNodeRequestError(c *gin.Context, nodeID string, err error) {
+	switch {
+	case errors.Is(err, errNodeNotConnected):
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Worker node not connected",
+		})
+	case errors.Is(err, errNodeTimeout):
+		c.JSON(http.StatusRequestTimeout, gin.H{
+			"success": false,
+			"error":   "Request timeout while waiting for worker responses",
+		})
+	case errors.Is(err, errNodeBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Worker node is busy, please retry later",
+		})
+	case errors.Is(err, errNodeUnsupported):
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"success": false,
+			"error":   "Worker node is too old for this request, please upgrade it",
+		})
+	default:
+		log.Printf("Request to worker %s failed: %v", nodeID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to contact worker",
+		})
+	}
+}
+
+// newTraceID 生成任务追踪ID：16字节随机数的十六进制，与OpenTelemetry的trace ID格式一致
+func newTraceID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return generateRequestID()
+	}
+	return hex.EncodeToString(buf)
 }
 
 // generateRequestID 生成请求ID
@@ -800,10 +2522,14 @@ func (gc *GatewayController) cleanupExpiredRequests() {
 		now := time.Now()
 
 		for requestID, req := range gc.pendingRequests {
-			// 清理超过30秒的请求
-			if now.Sub(req.CreatedAt) > 30*time.Second {
+			// 清理超过30秒的请求，等待时长更长的请求（如获取种子元数据）到期后再清理
+			expiry := 30 * time.Second
+			if req.Timeout > expiry {
+				expiry = req.Timeout
+			}
+			if now.Sub(req.CreatedAt) > expiry {
 				close(req.ResponseChan)
-				delete(gc.pendingRequests, requestID)
+				gc.removeRequestLocked(requestID)
 				log.Printf("Cleaned up expired request: %s", requestID)
 			}
 		}
@@ -0,0 +1,3282 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/database"
+	"magnetm3u8-gateway/internal/policy"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/user"
+)
+
+func dialNodeWebSocket(t *testing.T, registration map[string]interface{}) (*cluster.Manager, Message) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/nodes"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(registration); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return manager, reply
+}
+
+func TestNodeHandshakeNegotiatesProtocolVersion(t *testing.T) {
+	manager, reply := dialNodeWebSocket(t, map[string]interface{}{
+		"id":                   "worker-1",
+		"protocol_version":     cluster.ProtocolVersion + 1,
+		"min_protocol_version": cluster.MinProtocolVersion,
+	})
+
+	if reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %s: %v", reply.Type, reply.Payload)
+	}
+	if version, _ := reply.Payload["protocol_version"].(float64); int(version) != cluster.ProtocolVersion {
+		t.Fatalf("expected negotiated version %d, got %v", cluster.ProtocolVersion, reply.Payload["protocol_version"])
+	}
+	node, ok := manager.GetNode("worker-1")
+	if !ok || node.ProtocolVersion != cluster.ProtocolVersion {
+		t.Fatalf("expected node registered with version %d, got %+v", cluster.ProtocolVersion, node)
+	}
+}
+
+func TestNodeHandshakeRejectsIncompatibleWorker(t *testing.T) {
+	manager, reply := dialNodeWebSocket(t, map[string]interface{}{
+		"id":                   "worker-2",
+		"protocol_version":     cluster.ProtocolVersion + 2,
+		"min_protocol_version": cluster.ProtocolVersion + 1,
+	})
+
+	if reply.Type != "registration_rejected" {
+		t.Fatalf("expected registration_rejected, got %s: %v", reply.Type, reply.Payload)
+	}
+	if reason, _ := reply.Payload["reason"].(string); !strings.Contains(reason, "incompatible") {
+		t.Fatalf("expected incompatibility reason, got %v", reply.Payload["reason"])
+	}
+	if _, ok := manager.GetNode("worker-2"); ok {
+		t.Fatalf("expected incompatible worker not to be registered")
+	}
+}
+
+func TestNodeHandshakeRejectsSecondConnectionOfSameNode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/nodes"
+
+	connect := func() (*websocket.Conn, Message) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": "worker-3", "protocol_version": cluster.ProtocolVersion}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return conn, reply
+	}
+
+	first, reply := connect()
+	if reply.Type != "registration_confirmed" {
+		t.Fatalf("expected the first connection to register, got %s", reply.Type)
+	}
+
+	second, reply := connect()
+	if reply.Type != "connection_rejected" || reply.Payload["reason"] != "already_connected" || reply.Payload["node_id"] != "worker-3" {
+		t.Fatalf("expected a structured already_connected rejection, got %s: %v", reply.Type, reply.Payload)
+	}
+	// 拒绝后以关闭帧正常关闭，而不是直接断开
+	_, _, err := second.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("expected a try-again-later close frame, got %v", err)
+	}
+
+	// 原有连接不受影响
+	first.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var netErr net.Error
+	if _, _, err := first.ReadMessage(); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected the first connection to stay open, got %v", err)
+	}
+	if _, ok := manager.GetNode("worker-3"); !ok {
+		t.Fatal("expected the first connection to stay registered")
+	}
+}
+
+func TestNodeReconnectReplacesStaleConnection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/nodes"
+
+	connect := func() (*websocket.Conn, Message) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": "worker-3", "protocol_version": cluster.ProtocolVersion}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return conn, reply
+	}
+
+	first, reply := connect()
+	if reply.Type != "registration_confirmed" {
+		t.Fatalf("expected the first connection to register, got %s", reply.Type)
+	}
+	firstConn, _ := controller.nodeConns.get("worker-3")
+	// 旧连接错过了ping期限（半开）
+	firstConn.lastSeen.Store(time.Now().Add(-2 * nodePongWait).UnixNano())
+
+	// 节点重连，新连接注册成功并替换旧连接
+	_, reply = connect()
+	if reply.Type != "registration_confirmed" {
+		t.Fatalf("expected the reconnecting node to register, got %s: %v", reply.Type, reply.Payload)
+	}
+	if _, _, err := first.ReadMessage(); err == nil {
+		t.Fatal("expected the replaced connection to be closed")
+	}
+
+	// 旧连接的读循环退出后节点仍在线，新连接保持注册
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for {
+		current, _ := controller.nodeConns.get("worker-3")
+		if _, ok := manager.GetNode("worker-3"); !ok || current == firstConn {
+			t.Fatalf("expected the new connection to stay registered, node present %v", ok)
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGetTaskLocationAttributesWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	ctx := context.Background()
+	if err := tasks.Upsert(ctx, "task-1", "worker-1", "downloading", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := tasks.Upsert(ctx, "task-2", "worker-2", "ready", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := tasks.Upsert(ctx, "task-3", "worker-3", "ready", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := tasks.Upsert(ctx, "task-4", "worker-4", "ready", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	manager := cluster.NewManager()
+	manager.RegisterNode(&cluster.WorkerNode{ID: "worker-1"})
+	manager.RegisterNode(&cluster.WorkerNode{ID: "worker-2"})
+	offline, _ := manager.GetNode("worker-2")
+	offline.Status = "offline"
+	// worker-3 断开连接后被移除
+	manager.RegisterNode(&cluster.WorkerNode{ID: "worker-3"})
+	manager.UpdateNodeHeartbeat("worker-3")
+	seen, _ := manager.LastSeen("worker-3")
+	manager.RemoveNode("worker-3")
+
+	router := gin.New()
+	router.GET("/api/tasks/:id/location", NewGatewayController(manager, nil, tasks, nil).GetTaskLocation)
+
+	get := func(taskID string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tasks/"+taskID+"/location", nil))
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		return recorder.Code, body.Data
+	}
+
+	code, data := get("task-1")
+	if code != 200 || data["worker_id"] != "worker-1" || data["online"] != true {
+		t.Fatalf("expected task-1 on online worker-1, got %d %v", code, data)
+	}
+	if _, ok := data["last_seen"]; ok {
+		t.Fatalf("expected no last_seen for an online worker, got %v", data["last_seen"])
+	}
+
+	code, data = get("task-2")
+	if code != 200 || data["worker_id"] != "worker-2" || data["online"] != false || data["last_seen"] == nil {
+		t.Fatalf("expected task-2 on offline worker-2 with last_seen, got %d %v", code, data)
+	}
+
+	code, data = get("task-3")
+	if want, _ := json.Marshal(seen); code != 200 || data["online"] != false || data["last_seen"] != strings.Trim(string(want), `"`) {
+		t.Fatalf("expected task-3 on disconnected worker-3 last seen at its heartbeat %s, got %d %v", want, code, data)
+	}
+
+	code, data = get("task-4")
+	if lastSeen, ok := data["last_seen"]; code != 200 || !ok || lastSeen != nil {
+		t.Fatalf("expected a null last_seen for a worker never seen, got %d %v", code, data)
+	}
+
+	if code, _ = get("missing"); code != 404 {
+		t.Fatalf("expected 404 for unknown task, got %d", code)
+	}
+}
+
+func TestGetAllTasksCoalescesAndFallsBackToRegistry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	if err := tasks.Upsert(context.Background(), "task-1", "worker-1", "downloading", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	controller.SetNodeRequestLimits(NodeRequestLimits{PerSecond: 1, Burst: 1})
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks", controller.GetAllTasks)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 节点稍后才应答，期间到达的请求应复用同一次广播
+	requests := make(chan int, 10)
+	go func() {
+		received := 0
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "get_tasks" {
+				continue
+			}
+			received++
+			requests <- received
+			time.Sleep(100 * time.Millisecond)
+			conn.WriteJSON(Message{Type: "tasks_response", Payload: map[string]interface{}{
+				"request_id": message.Payload["request_id"],
+				"tasks":      []interface{}{map[string]interface{}{"id": "task-1", "status": "downloading", "progress": 42}},
+			}})
+		}
+	}()
+
+	get := func() map[string]interface{} {
+		resp, err := server.Client().Get(server.URL + "/api/tasks")
+		if err != nil {
+			t.Errorf("get tasks: %v", err)
+			return nil
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Data
+	}
+
+	results := make(chan map[string]interface{}, 2)
+	go func() { results <- get() }()
+	time.Sleep(30 * time.Millisecond)
+	go func() { results <- get() }()
+	for i := 0; i < 2; i++ {
+		data := <-results
+		list, _ := data["tasks"].([]interface{})
+		if len(list) != 1 || list[0].(map[string]interface{})["progress"] != float64(42) {
+			t.Fatalf("expected live task list, got %v", data)
+		}
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected concurrent requests to share one broadcast, worker received %d", len(requests))
+	}
+
+	// 配额用尽时不再请求节点，改用网关登记的数据
+	data := get()
+	list, _ := data["tasks"].([]interface{})
+	if len(list) != 1 || list[0].(map[string]interface{})["cached"] != true {
+		t.Fatalf("expected cached registry task, got %v", data)
+	}
+	if nodes, _ := data["cached_nodes"].([]interface{}); len(nodes) != 1 || nodes[0] != "worker-1" {
+		t.Fatalf("expected worker-1 to be served from cache, got %v", data["cached_nodes"])
+	}
+
+	stats := controller.throttle.stats()["worker-1"]
+	if stats.Coalesced != 1 || stats.Throttled != 1 || stats.QueueDepth != 0 {
+		t.Fatalf("unexpected request stats: %+v", stats)
+	}
+}
+
+func TestSubmitTaskDedupesMagnetAcrossWorkers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/submit", controller.SubmitTask)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// 模拟节点：收到提交后先上报任务状态（含info hash），再回复提交结果；
+	// 已有同一info hash的任务时按节点侧去重回复duplicate
+	var mu sync.Mutex
+	submitted := make(map[string]int)
+	connectWorker := func(workerID string) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": workerID, "protocol_version": cluster.ProtocolVersion}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+
+		go func() {
+			tasksByHash := make(map[string]string)
+			for {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				if message.Type != "task_submit" {
+					continue
+				}
+				mu.Lock()
+				submitted[workerID]++
+				count := submitted[workerID]
+				mu.Unlock()
+
+				infoHash, _ := policy.ParseMagnet(message.Payload["magnet_url"].(string))
+				taskID, duplicate := tasksByHash[infoHash]
+				if !duplicate {
+					taskID = fmt.Sprintf("%s-task-%d", workerID, count)
+					tasksByHash[infoHash] = taskID
+					conn.WriteJSON(Message{Type: "task_status", Payload: map[string]interface{}{
+						"task_id":   taskID,
+						"status":    "downloading",
+						"owner_id":  message.Payload["owner_id"],
+						"info_hash": strings.ToUpper(infoHash),
+					}})
+				}
+				conn.WriteJSON(Message{Type: "task_submit_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"success":    true,
+					"task_id":    taskID,
+					"duplicate":  duplicate,
+				}})
+			}
+		}()
+	}
+	connectWorker("worker-1")
+	connectWorker("worker-2")
+
+	submit := func(workerID, magnet string) map[string]interface{} {
+		body := fmt.Sprintf(`{"worker_id":%q,"magnet_url":%q}`, workerID, magnet)
+		resp, err := server.Client().Post(server.URL+"/api/tasks/submit", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("submit: %v", err)
+		}
+		defer resp.Body.Close()
+		var decoded struct {
+			Success bool                   `json:"success"`
+			Data    map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		if !decoded.Success {
+			t.Fatalf("submit to %s failed with status %d", workerID, resp.StatusCode)
+		}
+		return decoded.Data
+	}
+	submissions := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return submitted["worker-1"], submitted["worker-2"]
+	}
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	magnet := "magnet:?xt=urn:btih:" + hash + "&dn=Movie"
+
+	first := submit("worker-1", magnet)
+	if first["task_id"] != "worker-1-task-1" || first["duplicate"] != false {
+		t.Fatalf("expected a new task on worker-1, got %v", first)
+	}
+	if traceID, _ := first["trace_id"].(string); len(traceID) != 32 {
+		t.Fatalf("expected a 32 hex digit trace id in the submit response, got %v", first["trace_id"])
+	}
+	record, err := tasks.Get(context.Background(), "worker-1-task-1")
+	if err != nil || record.InfoHash != hash {
+		t.Fatalf("expected registry to hold the normalized info hash, got %+v %v", record, err)
+	}
+
+	// 默认模式：同一磁力链接提交到另一个节点时直接返回已有任务
+	second := submit("worker-2", "magnet:?xt=urn:btih:"+strings.ToUpper(hash))
+	if second["task_id"] != "worker-1-task-1" || second["worker_id"] != "worker-1" || second["duplicate"] != true {
+		t.Fatalf("expected the existing task on worker-1, got %v", second)
+	}
+	if w1, w2 := submissions(); w1 != 1 || w2 != 0 {
+		t.Fatalf("expected a single submission cluster-wide, got worker-1=%d worker-2=%d", w1, w2)
+	}
+
+	// route模式：提交改发到已有任务所在的节点，由节点去重
+	controller.SetDuplicateSubmitMode(DuplicateSubmitRoute)
+	routed := submit("worker-2", magnet)
+	if routed["task_id"] != "worker-1-task-1" || routed["worker_id"] != "worker-1" || routed["duplicate"] != true {
+		t.Fatalf("expected the submission to be routed to worker-1, got %v", routed)
+	}
+	if w1, w2 := submissions(); w1 != 2 || w2 != 0 {
+		t.Fatalf("expected the duplicate to reach worker-1 only, got worker-1=%d worker-2=%d", w1, w2)
+	}
+
+	// 关闭去重后按请求的节点提交
+	controller.SetDuplicateSubmitMode(DuplicateSubmitOff)
+	if other := submit("worker-2", magnet); other["task_id"] != "worker-2-task-1" {
+		t.Fatalf("expected a new task on worker-2 with dedupe disabled, got %v", other)
+	}
+}
+
+func TestSubmitTaskRejectsMagnetDuplicateOnWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/submit", controller.SubmitTask)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 节点上同一磁力链接已有任务，拒绝提交并返回已有任务
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type == "task_submit" {
+				conn.WriteJSON(Message{Type: "task_submit_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"success":    false,
+					"task_id":    "task-existing",
+					"duplicate":  true,
+					"code":       "duplicate_task",
+					"error":      "a task for this magnet URL already exists",
+				}})
+			}
+		}
+	}()
+
+	body := `{"worker_id":"worker-1","magnet_url":"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"}`
+	resp, err := server.Client().Post(server.URL+"/api/tasks/submit", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	defer resp.Body.Close()
+	var decoded struct {
+		Success bool                   `json:"success"`
+		Code    string                 `json:"code"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	if resp.StatusCode != http.StatusConflict || decoded.Success || decoded.Code != "duplicate_task" {
+		t.Fatalf("expected 409 duplicate_task, got %d %+v", resp.StatusCode, decoded)
+	}
+	if decoded.Data["task_id"] != "task-existing" || decoded.Data["worker_id"] != "worker-1" {
+		t.Fatalf("expected the existing task in the response, got %v", decoded.Data)
+	}
+}
+
+func TestSubmitTaskQueuesWhenClusterSaturated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.GetHeader("X-Test-User"), 10, 64)
+		c.Set("currentUser", &user.User{ID: id, Username: "user", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/submit", controller.SubmitTask)
+	router.GET("/api/tasks", controller.GetAllTasks)
+	router.GET("/api/status", controller.GetSystemStatus)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// 模拟只有一个下载名额的节点：收到提交后上报downloading并回复提交结果，
+	// 提交按到达顺序送到submissions
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{
+		"id":               "worker-1",
+		"protocol_version": cluster.ProtocolVersion,
+		"resources":        map[string]int{"max_downloads": 1},
+	}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	var writeMu sync.Mutex
+	send := func(message Message) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.WriteJSON(message)
+	}
+	type submission struct {
+		taskID  string
+		ownerID int64
+		magnet  string
+	}
+	submissions := make(chan submission, 10)
+	go func() {
+		count := 0
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			switch message.Type {
+			case "get_tasks":
+				send(Message{Type: "tasks_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"tasks":      []interface{}{},
+				}})
+			case "task_submit":
+				count++
+				taskID := fmt.Sprintf("worker-1-task-%d", count)
+				send(Message{Type: "task_status", Payload: map[string]interface{}{
+					"task_id":  taskID,
+					"status":   "downloading",
+					"owner_id": message.Payload["owner_id"],
+				}})
+				send(Message{Type: "task_submit_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"success":    true,
+					"task_id":    taskID,
+				}})
+				owner, _ := message.Payload["owner_id"].(float64)
+				magnet, _ := message.Payload["magnet_url"].(string)
+				submissions <- submission{taskID: taskID, ownerID: int64(owner), magnet: magnet}
+			}
+		}
+	}()
+	nextSubmission := func() submission {
+		select {
+		case s := <-submissions:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a submission to reach the worker")
+			return submission{}
+		}
+	}
+	finish := func(taskID string) {
+		send(Message{Type: "task_status", Payload: map[string]interface{}{"task_id": taskID, "status": "transcoding"}})
+	}
+
+	submitted := 0
+	submit := func(ownerID int64, name string) (int, http.Header, map[string]interface{}) {
+		submitted++
+		magnet := fmt.Sprintf("magnet:?xt=urn:btih:%040x&dn=%s", submitted, name)
+		body := fmt.Sprintf(`{"worker_id":"worker-1","magnet_url":%q}`, magnet)
+		request, _ := http.NewRequest("POST", server.URL+"/api/tasks/submit", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Test-User", strconv.FormatInt(ownerID, 10))
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("submit: %v", err)
+		}
+		defer resp.Body.Close()
+		var decoded struct {
+			Data map[string]interface{} `json:"data"`
+			Code string                 `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		if decoded.Code != "" {
+			decoded.Data = map[string]interface{}{"code": decoded.Code}
+		}
+		return resp.StatusCode, resp.Header, decoded.Data
+	}
+
+	// 节点有名额时直接提交
+	if code, _, data := submit(7, "first"); code != http.StatusOK || data["task_id"] != "worker-1-task-1" {
+		t.Fatalf("expected a direct submission, got %d %v", code, data)
+	}
+	first := nextSubmission()
+
+	// 名额用完后排队；用户之间轮转，用户9的任务排在用户7的第二个任务之前
+	var queued []string
+	for _, s := range []struct {
+		owner    int64
+		name     string
+		position float64
+	}{{7, "second", 1}, {7, "third", 2}, {9, "other", 2}} {
+		code, _, data := submit(s.owner, s.name)
+		if code != http.StatusAccepted || data["status"] != StatusPendingDispatch || data["queue_position"] != s.position {
+			t.Fatalf("expected %s to be queued at position %v, got %d %v", s.name, s.position, code, data)
+		}
+		queued = append(queued, data["task_id"].(string))
+		record, err := tasks.Get(context.Background(), data["task_id"].(string))
+		if err != nil || record.Status != StatusPendingDispatch {
+			t.Fatalf("expected a pending_dispatch registry record, got %+v %v", record, err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tasks", nil))
+	var list struct {
+		Data struct {
+			Tasks []map[string]interface{} `json:"tasks"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &list)
+	if len(list.Data.Tasks) != 3 || list.Data.Tasks[1]["id"] != queued[2] || list.Data.Tasks[1]["status"] != StatusPendingDispatch {
+		t.Fatalf("expected the queued tasks in dispatch order in the task list, got %v", list.Data.Tasks)
+	}
+
+	// 每空出一个名额分派一个任务，按用户轮转
+	finish(first.taskID)
+	var order []string
+	for i := 0; i < 3; i++ {
+		dispatched := nextSubmission()
+		order = append(order, fmt.Sprintf("%d:%s", dispatched.ownerID, dispatched.magnet[strings.LastIndex(dispatched.magnet, "=")+1:]))
+		select {
+		case extra := <-submissions:
+			t.Fatalf("expected one dispatch per free slot, also got %+v", extra)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if i < 2 {
+			finish(dispatched.taskID)
+		}
+	}
+	if strings.Join(order, ",") != "7:second,9:other,7:third" {
+		t.Fatalf("expected round-robin dispatch across owners, got %v", order)
+	}
+	for _, id := range queued {
+		if _, err := tasks.Get(context.Background(), id); err != task.ErrNotFound {
+			t.Fatalf("expected queued record %s to be replaced by the worker task, got %v", id, err)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/status", nil))
+	var status struct {
+		Data struct {
+			DispatchQueue DispatchStats `json:"dispatch_queue"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	if stats := status.Data.DispatchQueue; stats.Dispatched != 3 || stats.QueueDepth != 0 || stats.MaxWaitMS < stats.LastWaitMS {
+		t.Fatalf("unexpected dispatch stats %+v", stats)
+	}
+
+	// reject模式：节点满载时返回503和Retry-After
+	controller.SetAdmission(AdmissionOptions{Mode: AdmissionReject, RetryAfter: 45 * time.Second})
+	code, header, data := submit(9, "rejected")
+	if code != http.StatusServiceUnavailable || header.Get("Retry-After") != "45" || data["code"] != "cluster_saturated" {
+		t.Fatalf("expected 503 with Retry-After, got %d %q %v", code, header.Get("Retry-After"), data)
+	}
+}
+
+func TestSubmitTaskAppliesUserPreferences(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	users := user.NewRepository(db)
+	account, err := users.Create(context.Background(), "alice", "hash", user.RoleUser)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, task.NewRepository(db), nil)
+	controller.SetUserRepository(users)
+	authHandler := NewAuthHandler(nil, users, "session", time.Hour)
+	adminHandler := NewAdminHandler(users, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("currentUser", account) })
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/submit", controller.SubmitTask)
+	router.GET("/api/auth/preferences", authHandler.Preferences)
+	router.PUT("/api/auth/preferences", authHandler.UpdatePreferences)
+	router.GET("/api/admin/users/:id/preferences", adminHandler.UserPreferences)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	submissions := make(chan Message, 4)
+	// worker-3不具备提交所需的能力
+	for workerID, capabilities := range map[string][]string{"worker-1": submitCapabilities, "worker-2": submitCapabilities, "worker-3": nil} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{
+			"id":               workerID,
+			"protocol_version": cluster.ProtocolVersion,
+			"capabilities":     capabilities,
+		}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+		go func(workerID string) {
+			for {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				if message.Type != "task_submit" {
+					continue
+				}
+				message.Payload["worker"] = workerID
+				submissions <- message
+				conn.WriteJSON(Message{Type: "task_submit_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"success":    true,
+					"task_id":    workerID + "-task",
+				}})
+			}
+		}(workerID)
+	}
+
+	send := func(method, path, body string) (int, map[string]interface{}) {
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+	submit := func(body string) map[string]interface{} {
+		if status, decoded := send("POST", "/api/tasks/submit", body); status != http.StatusOK {
+			t.Fatalf("submit %s failed with %d: %v", body, status, decoded)
+		}
+		select {
+		case message := <-submissions:
+			return message.Payload
+		case <-time.After(2 * time.Second):
+			t.Fatalf("submission %s never reached a worker", body)
+			return nil
+		}
+	}
+
+	// 不合法的偏好设置被拒绝
+	for _, body := range []string{
+		`{"hls_quality":"ultra"}`,
+		`{"default_worker":"worker 1"}`,
+		`{"sequentially":true}`,
+		`{"subtitle_language":"../x"}`,
+		`{"notifications":{"events":["task_started"]}}`,
+		`{"notifications":{"events":["task_ready"],"webhook":"ftp://example.com/hook"}}`,
+	} {
+		if status, _ := send("PUT", "/api/auth/preferences", body); status != http.StatusBadRequest {
+			t.Fatalf("expected %s to be rejected, got %d", body, status)
+		}
+	}
+
+	status, decoded := send("PUT", "/api/auth/preferences", `{"default_worker":"worker-2","hls_quality":"multi","burn_subtitles":true,"subtitle_language":"chi","require_complete":true,"sequential":true}`)
+	if status != http.StatusOK {
+		t.Fatalf("save preferences failed with %d: %v", status, decoded)
+	}
+	if _, decoded := send("GET", "/api/auth/preferences", ""); decoded["data"].(map[string]interface{})["default_worker"] != "worker-2" {
+		t.Fatalf("expected saved preferences, got %v", decoded)
+	}
+	if status, decoded := send("GET", fmt.Sprintf("/api/admin/users/%d/preferences", account.ID), ""); status != http.StatusOK ||
+		decoded["data"].(map[string]interface{})["hls_quality"] != "multi" {
+		t.Fatalf("expected admins to see the preferences, got %d %v", status, decoded)
+	}
+	if status, _ := send("GET", "/api/admin/users/999/preferences", ""); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d", status)
+	}
+
+	// 省略的字段使用偏好
+	payload := submit(`{"magnet_url":"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"}`)
+	if payload["worker"] != "worker-2" || payload["hls_quality"] != "multi" || payload["burn_subtitles"] != true ||
+		payload["subtitle_language"] != "chi" || payload["require_complete"] != true || payload["sequential"] != true {
+		t.Fatalf("expected the preferences to fill omitted fields, got %v", payload)
+	}
+
+	// 请求中给出的值优先，包括显式的false
+	payload = submit(`{"worker_id":"worker-1","magnet_url":"magnet:?xt=urn:btih:1123456789abcdef0123456789abcdef01234567","hls_quality":"single","burn_subtitles":false,"require_complete":false,"sequential":false}`)
+	if payload["worker"] != "worker-1" || payload["hls_quality"] != nil || payload["burn_subtitles"] != nil || payload["require_complete"] != nil ||
+		payload["sequential"] != false {
+		t.Fatalf("expected explicit request values to win, got %v", payload)
+	}
+
+	// 偏好的节点不在线时由调度算法选择
+	if _, decoded := send("PUT", "/api/auth/preferences", `{"default_worker":"worker-9"}`); decoded["success"] != true {
+		t.Fatalf("save preferences failed: %v", decoded)
+	}
+	payload = submit(`{"magnet_url":"magnet:?xt=urn:btih:2123456789abcdef0123456789abcdef01234567"}`)
+	if worker := payload["worker"]; worker != "worker-1" && worker != "worker-2" {
+		t.Fatalf("expected an offline preferred worker to fall back to scheduling, got %v", payload)
+	}
+	if payload["hls_quality"] != nil || payload["require_complete"] != nil || payload["sequential"] != nil {
+		t.Fatalf("expected replaced preferences to drop the old defaults, got %v", payload)
+	}
+
+	// 偏好的节点不具备提交所需的能力时同样由调度算法选择
+	if _, decoded := send("PUT", "/api/auth/preferences", `{"default_worker":"worker-3"}`); decoded["success"] != true {
+		t.Fatalf("save preferences failed: %v", decoded)
+	}
+	payload = submit(`{"magnet_url":"magnet:?xt=urn:btih:3123456789abcdef0123456789abcdef01234567"}`)
+	if worker := payload["worker"]; worker != "worker-1" && worker != "worker-2" {
+		t.Fatalf("expected a preferred worker without capabilities to fall back to scheduling, got %v", payload)
+	}
+}
+
+func TestTaskStatusChangesNotifyTheOwner(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	users := user.NewRepository(db)
+	account, err := users.Create(context.Background(), "alice", "hash", user.RoleUser)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	delivered := make(chan TaskEvent, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event TaskEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		delivered <- event
+	}))
+	t.Cleanup(webhook.Close)
+
+	if err := users.SetPreferences(context.Background(), account.ID, user.Preferences{Notifications: &user.Notifications{
+		Events:  []string{user.EventTaskReady, user.EventTaskFailed},
+		Webhook: webhook.URL,
+		SSE:     true,
+	}}); err != nil {
+		t.Fatalf("save preferences: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, task.NewRepository(db), nil)
+	controller.SetUserRepository(users)
+	// 默认的客户端拒绝连接回环地址上的测试服务器
+	if err := publicAddressOnly("tcp", strings.TrimPrefix(webhook.URL, "http://"), nil); !errors.Is(err, errPrivateWebhook) {
+		t.Fatalf("expected the webhook client to refuse loopback addresses, got %v", err)
+	}
+	controller.notifier.client = webhook.Client()
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("currentUser", account) })
+	router.GET("/api/events", controller.StreamEvents)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+	resp, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("open event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	streamed := make(chan string, 8)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event:"); ok {
+				streamed <- name
+			}
+		}
+	}()
+
+	owner := float64(account.ID)
+	controller.recordTaskStatus("worker-1", map[string]interface{}{"task_id": "task-1", "status": "downloading", "owner_id": owner})
+	controller.recordTaskStatus("worker-1", map[string]interface{}{"task_id": "task-1", "status": "ready", "owner_id": owner})
+	// 状态未变化时不重复通知；不带owner_id的状态使用登记的所属用户
+	controller.recordTaskStatus("worker-1", map[string]interface{}{"task_id": "task-1", "status": "ready"})
+	controller.recordTaskStatus("worker-1", map[string]interface{}{"task_id": "task-1", "status": "error"})
+
+	for _, want := range []string{user.EventTaskReady, user.EventTaskFailed} {
+		select {
+		case name := <-streamed:
+			if name != want {
+				t.Fatalf("expected %s on the event stream, got %s", want, name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %s on the event stream", want)
+		}
+	}
+
+	received := map[string]TaskEvent{}
+	for len(received) < 2 {
+		select {
+		case event := <-delivered:
+			received[event.Event] = event
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected both events at the webhook, got %v", received)
+		}
+	}
+	if event := received[user.EventTaskReady]; event.TaskID != "task-1" || event.WorkerID != "worker-1" || event.Status != "ready" {
+		t.Fatalf("unexpected webhook event %+v", event)
+	}
+	select {
+	case event := <-delivered:
+		t.Fatalf("expected one delivery per status change, got an extra %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebRTCOfferFailureIsForwardedToClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	node, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	if err := node.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := node.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟收集不到ICE候选者的节点：收到Offer后报告失败
+	go func() {
+		for {
+			var message Message
+			if err := node.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type == "webrtc_offer" {
+				node.WriteJSON(Message{Type: "webrtc_offer_failed", Payload: map[string]interface{}{
+					"session_id": message.Payload["session_id"],
+					"reason":     "no ICE candidates gathered",
+				}})
+			}
+		}
+	}()
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/clients?client_id=client-1", nil)
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.WriteJSON(Message{Type: "webrtc_offer", Payload: map[string]interface{}{
+		"session_id": "session-1",
+		"worker_id":  "worker-1",
+		"sdp":        "offer",
+	}}); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	if err := client.ReadJSON(&message); err != nil {
+		t.Fatalf("read client message: %v", err)
+	}
+	if message.Type != "webrtc_offer_failed" || message.Payload["session_id"] != "session-1" || message.Payload["reason"] != "no ICE candidates gathered" {
+		t.Fatalf("expected the failure with its reason, got %v", message)
+	}
+
+	// 节点已关闭会话，网关也不再把它计为活跃会话
+	if _, exists := manager.GetWebRTCSession("session-1"); exists {
+		t.Fatal("expected the failed session to be removed")
+	}
+	if _, _, active := manager.Stats(); active != 0 {
+		t.Fatalf("expected no active sessions, got %d", active)
+	}
+}
+
+func TestSpeedProbeResultIsCachedPerUserAndWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	router.POST("/api/webrtc/probe", controller.StartProbe)
+	router.GET("/api/webrtc/probe", controller.GetProbeResults)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	node, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	if err := node.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := node.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：收到测速Offer后确认测速会话不计入活跃会话，再上报结果
+	activeDuringProbe := make(chan int, 1)
+	go func() {
+		for {
+			var message Message
+			if err := node.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type == "webrtc_probe" {
+				_, _, active := manager.Stats()
+				activeDuringProbe <- active
+				node.WriteJSON(Message{Type: "probe_result", Payload: map[string]interface{}{
+					"session_id":      message.Payload["session_id"],
+					"bytes":           2097152,
+					"duration_ms":     1000,
+					"throughput_kbps": 16777.216,
+					"rtt_ms":          12.5,
+				}})
+			}
+		}
+	}()
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/clients?client_id=client-1", nil)
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	probe := func() map[string]interface{} {
+		body := strings.NewReader(`{"worker_id":"worker-1","client_id":"client-1","sdp":"offer"}`)
+		resp, err := http.Post(server.URL+"/api/webrtc/probe", "application/json", body)
+		if err != nil {
+			t.Fatalf("post probe: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the probe to start, got %d %v %v", resp.StatusCode, result, err)
+		}
+		return result
+	}
+
+	started := probe()
+	if started["cached"] != false || started["session_id"] == "" {
+		t.Fatalf("expected a new probe session, got %v", started)
+	}
+	if active := <-activeDuringProbe; active != 0 {
+		t.Fatalf("expected probe sessions to be excluded from active sessions, got %d", active)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	if err := client.ReadJSON(&message); err != nil {
+		t.Fatalf("read client message: %v", err)
+	}
+	if message.Type != "probe_result" || message.Payload["worker_id"] != "worker-1" || message.Payload["throughput_kbps"] != 16777.216 {
+		t.Fatalf("expected the probe result to be forwarded, got %v", message)
+	}
+	if _, exists := manager.GetWebRTCSession(started["session_id"].(string)); exists {
+		t.Fatal("expected the probe session to be removed after its result")
+	}
+
+	cached := probe()
+	result, _ := cached["result"].(map[string]interface{})
+	if cached["cached"] != true || result["rtt_ms"] != 12.5 {
+		t.Fatalf("expected the second probe to be answered from the cache, got %v", cached)
+	}
+
+	resp, err := http.Get(server.URL + "/api/webrtc/probe")
+	if err != nil {
+		t.Fatalf("get probes: %v", err)
+	}
+	defer resp.Body.Close()
+	var listed struct {
+		Data []ProbeResult `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(listed.Data) != 1 || listed.Data[0].WorkerID != "worker-1" || listed.Data[0].Bytes != 2097152 {
+		t.Fatalf("expected one cached result for worker-1, got %+v", listed.Data)
+	}
+}
+
+func TestStartProbeRejectsClientsAndSessionsOfOtherUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.GetHeader("X-User"), 10, 64)
+		c.Set("currentUser", &user.User{ID: id, Username: "user-" + c.GetHeader("X-User"), Role: user.RoleUser})
+	})
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	router.POST("/api/webrtc/probe", controller.StartProbe)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/clients?client_id=client-1", http.Header{"X-User": {"7"}})
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	for !controller.clientConns.has("client-1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	manager.CreateWebRTCSession("session-1", "client-2", "worker-1")
+
+	probe := func(userID, body string) int {
+		request, _ := http.NewRequest("POST", server.URL+"/api/webrtc/probe", strings.NewReader(body))
+		request.Header.Set("X-User", userID)
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("post probe: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := probe("8", `{"worker_id":"worker-1","client_id":"client-1","sdp":"offer"}`); status != http.StatusForbidden {
+		t.Fatalf("expected another user's client to be refused, got %d", status)
+	}
+	if status := probe("7", `{"worker_id":"worker-1","client_id":"client-1","session_id":"session-1","sdp":"offer"}`); status != http.StatusConflict {
+		t.Fatalf("expected an existing session ID to be refused, got %d", status)
+	}
+	if session, _ := manager.GetWebRTCSession("session-1"); session.ClientID != "client-2" || session.Probe {
+		t.Fatalf("expected the existing session to be left alone, got %+v", session)
+	}
+	// 校验通过后才检查节点
+	if status := probe("7", `{"worker_id":"worker-1","client_id":"client-1","sdp":"offer"}`); status != http.StatusNotFound {
+		t.Fatalf("expected the owner's probe to reach the node lookup, got %d", status)
+	}
+}
+
+func TestResendICECandidatesForwardsWorkerCandidatesToClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	router.POST("/api/webrtc/ice/resend", controller.ResendICECandidates)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	node, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	if err := node.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := node.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：收到ice_resend后先重发候选者，再回复结果
+	offers := make(chan string, 1)
+	go func() {
+		for {
+			var message Message
+			if err := node.ReadJSON(&message); err != nil {
+				return
+			}
+			switch message.Type {
+			case "webrtc_offer":
+				offers <- message.Payload["session_id"].(string)
+			case "ice_resend":
+				sessionID := message.Payload["session_id"]
+				node.WriteJSON(Message{Type: "ice_candidate", Payload: map[string]interface{}{
+					"session_id": sessionID,
+					"candidate":  "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host",
+				}})
+				node.WriteJSON(Message{Type: "ice_resend_response", Payload: map[string]interface{}{
+					"request_id":      message.Payload["request_id"],
+					"session_id":      sessionID,
+					"success":         true,
+					"candidates":      1,
+					"gathering_state": "complete",
+				}})
+			}
+		}
+	}()
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/clients?client_id=client-1", nil)
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.WriteJSON(Message{Type: "webrtc_offer", Payload: map[string]interface{}{
+		"session_id": "session-1",
+		"worker_id":  "worker-1",
+		"sdp":        "offer",
+	}}); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("offer was not forwarded to the worker")
+	}
+
+	readClient := func() Message {
+		t.Helper()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var message Message
+		if err := client.ReadJSON(&message); err != nil {
+			t.Fatalf("read client message: %v", err)
+		}
+		return message
+	}
+
+	// 通过客户端WebSocket请求重发
+	if err := client.WriteJSON(Message{Type: "ice_resend", Payload: map[string]interface{}{"session_id": "session-1"}}); err != nil {
+		t.Fatalf("send ice_resend: %v", err)
+	}
+	if message := readClient(); message.Type != "ice_candidate" || message.Payload["session_id"] != "session-1" {
+		t.Fatalf("expected the re-sent candidate first, got %v", message)
+	}
+	if message := readClient(); message.Type != "ice_resend_response" || message.Payload["success"] != true || message.Payload["candidates"] != float64(1) {
+		t.Fatalf("expected a successful ice_resend_response, got %v", message)
+	}
+
+	// 通过HTTP接口请求重发
+	resp, err := server.Client().Post(server.URL+"/api/webrtc/ice/resend", "application/json", strings.NewReader(`{"session_id":"session-1"}`))
+	if err != nil {
+		t.Fatalf("post resend: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Success bool                   `json:"success"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || !body.Success || body.Data["candidates"] != float64(1) || body.Data["gathering_state"] != "complete" {
+		t.Fatalf("unexpected resend response %d %+v", resp.StatusCode, body)
+	}
+	if message := readClient(); message.Type != "ice_candidate" {
+		t.Fatalf("expected the candidate forwarded to the client, got %v", message)
+	}
+
+	resp, err = server.Client().Post(server.URL+"/api/webrtc/ice/resend", "application/json", strings.NewReader(`{"session_id":"missing"}`))
+	if err != nil {
+		t.Fatalf("post resend: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetTaskDetailReturnsFirstWorkerThatFindsTask(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks/:id", controller.GetTaskDetail)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// worker-1没有任何任务；worker-2持有task-1，模拟不回传request_id、srts仍是路径列表的旧版节点
+	for _, workerID := range []string{"worker-1", "worker-2"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		version := cluster.ProtocolVersion
+		if workerID == "worker-2" {
+			version = 22
+		}
+		if err := conn.WriteJSON(map[string]interface{}{"id": workerID, "protocol_version": version}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+
+		workerID := workerID
+		go func() {
+			for {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				if message.Type != "get_task_detail" {
+					continue
+				}
+				taskID := message.Payload["task_id"]
+				response := map[string]interface{}{"task_id": taskID, "found": false}
+				if workerID == "worker-1" {
+					response["request_id"] = message.Payload["request_id"]
+				} else if taskID == "task-1" {
+					response["found"] = true
+					response["task"] = map[string]interface{}{"id": taskID, "status": "downloading", "progress": 42.5, "srts": []string{"data/m3u8/task-1/subtitle.srt"}}
+				}
+				conn.WriteJSON(Message{Type: "task_detail_response", Payload: response})
+			}
+		}()
+	}
+
+	get := func(taskID string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := server.Client().Get(server.URL + "/api/tasks/" + taskID)
+		if err != nil {
+			t.Fatalf("get task: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Data
+	}
+
+	status, detail := get("task-1")
+	if status != http.StatusOK || detail["status"] != "downloading" || detail["progress"] != 42.5 || detail["worker_id"] != "worker-2" {
+		t.Fatalf("expected the detail reported by worker-2, got %d %v", status, detail)
+	}
+	srts, _ := detail["srts"].([]interface{})
+	if len(srts) != 1 {
+		t.Fatalf("expected one subtitle, got %v", detail["srts"])
+	}
+	if entry, _ := srts[0].(map[string]interface{}); entry["path"] != "data/m3u8/task-1/subtitle.srt" || entry["format"] != "srt" {
+		t.Fatalf("expected the legacy path converted to an object, got %v", srts[0])
+	}
+	if status, _ := get("task-missing"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 when no worker has the task, got %d", status)
+	}
+
+	controller.mutex.Lock()
+	pending := len(controller.pendingRequests)
+	controller.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected finished requests to be cleaned up, %d left", pending)
+	}
+}
+
+func TestGetTaskDetailAsksTheRegisteredWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	owner := int64(7)
+	if err := tasks.Upsert(context.Background(), "task-1", "worker-2", "ready", &owner); err != nil {
+		t.Fatalf("register task: %v", err)
+	}
+	if err := tasks.SaveSummary(context.Background(), "task-1", "worker-2", "ready", json.RawMessage(`{"duration":12}`)); err != nil {
+		t.Fatalf("save summary: %v", err)
+	}
+	if err := tasks.Upsert(context.Background(), "task-2", "worker-9", "ready", &owner); err != nil {
+		t.Fatalf("register task: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.GetHeader("X-User"), 10, 64)
+		c.Set("currentUser", &user.User{ID: id, Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks/:id", controller.GetTaskDetail)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// 两个节点都声称持有task-1，只有登记的worker-2应被询问
+	asked := make(chan string, 4)
+	for _, workerID := range []string{"worker-1", "worker-2"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": workerID, "protocol_version": cluster.ProtocolVersion}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+
+		workerID := workerID
+		go func() {
+			for {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				if message.Type != "get_task_detail" {
+					continue
+				}
+				asked <- workerID
+				conn.WriteJSON(Message{Type: "task_detail_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"task_id":    message.Payload["task_id"],
+					"found":      true,
+					"task":       map[string]interface{}{"id": message.Payload["task_id"], "status": "ready", "files": []string{"movie.mkv"}},
+				}})
+			}
+		}()
+	}
+
+	get := func(taskID, userID string) (int, map[string]interface{}) {
+		t.Helper()
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/tasks/"+taskID, nil)
+		request.Header.Set("X-User", userID)
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("get task: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Data
+	}
+
+	status, detail := get("task-1", "7")
+	if status != http.StatusOK || detail["worker_id"] != "worker-2" || detail["files"] == nil {
+		t.Fatalf("expected the live detail of worker-2, got %d %v", status, detail)
+	}
+	if summary, _ := detail["summary"].(map[string]interface{}); summary["duration"] != float64(12) {
+		t.Fatalf("expected the stored summary merged into the detail, got %v", detail["summary"])
+	}
+	if worker := <-asked; worker != "worker-2" {
+		t.Fatalf("expected only worker-2 to be asked, got %s", worker)
+	}
+	select {
+	case worker := <-asked:
+		t.Fatalf("expected only worker-2 to be asked, %s was asked too", worker)
+	default:
+	}
+
+	if status, _ := get("task-1", "8"); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's task, got %d", status)
+	}
+
+	// 所在节点离线时返回登记的信息
+	status, detail = get("task-2", "7")
+	if status != http.StatusOK || detail["task_id"] != "task-2" || detail["worker_id"] != "worker-9" {
+		t.Fatalf("expected the registry record while the worker is offline, got %d %v", status, detail)
+	}
+}
+
+func TestGetAllTasksStopsWaitingForDisconnectedWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks", controller.GetAllTasks)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// worker-1稍后回复任务列表；worker-2收到请求后不回复就断开
+	for _, workerID := range []string{"worker-1", "worker-2"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": workerID, "protocol_version": cluster.ProtocolVersion}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+
+		workerID := workerID
+		go func() {
+			for {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				if message.Type != "get_tasks" {
+					continue
+				}
+				if workerID == "worker-2" {
+					conn.Close()
+					return
+				}
+				time.Sleep(200 * time.Millisecond)
+				conn.WriteJSON(Message{Type: "tasks_response", Payload: map[string]interface{}{
+					"request_id": message.Payload["request_id"],
+					"tasks":      []interface{}{map[string]interface{}{"id": "task-1", "status": "downloading"}},
+				}})
+			}
+		}()
+	}
+
+	start := time.Now()
+	resp, err := server.Client().Get(server.URL + "/api/tasks")
+	if err != nil {
+		t.Fatalf("get tasks: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Data struct {
+			Tasks []map[string]interface{} `json:"tasks"`
+		} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	if resp.StatusCode != http.StatusOK || len(body.Data.Tasks) != 1 || body.Data.Tasks[0]["id"] != "task-1" {
+		t.Fatalf("expected worker-1's task, got %d %v", resp.StatusCode, body.Data.Tasks)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the request to finish once worker-1 answered, took %v", elapsed)
+	}
+
+	controller.mutex.Lock()
+	pending := len(controller.pendingRequests)
+	controller.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected the finished request to be cleaned up, %d left", pending)
+	}
+}
+
+func TestRequestBrokerDropsDuplicateLateAndUnsolicitedResponses(t *testing.T) {
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	controller.nodeConns.register("worker-1", nil)
+	controller.nodeConns.register("worker-2", nil)
+
+	responseChan := make(chan []map[string]interface{}, 1)
+	req := &PendingRequest{
+		RequestID:     "req-tasks",
+		RequestType:   "get_tasks",
+		ExpectedNodes: 2,
+		TargetNodes:   nodeSet([]string{"worker-1", "worker-2"}),
+		ResponseChan:  responseChan,
+		CreatedAt:     time.Now(),
+	}
+	controller.mutex.Lock()
+	controller.pendingRequests[req.RequestID] = req
+	controller.mutex.Unlock()
+
+	respond := func(nodeID, taskID string) {
+		controller.handleTasksResponse(nodeID, map[string]interface{}{
+			"request_id": "req-tasks",
+			"tasks":      []interface{}{map[string]interface{}{"id": taskID, "status": "downloading"}},
+		})
+	}
+
+	// 请求发出前已到达的响应按可能收到请求的节点判断
+	respond("worker-1", "task-1")
+	respond("worker-3", "task-3")
+	controller.mutex.Lock()
+	req.mutex.Lock()
+	controller.awaitNodesLocked(req, []string{"worker-1", "worker-2"})
+	controller.completeIfAnsweredLocked(req)
+	req.mutex.Unlock()
+	controller.mutex.Unlock()
+
+	// 重连的节点重复回复同一请求不计入ExpectedNodes
+	respond("worker-1", "task-1")
+	respond("worker-3", "task-3")
+	select {
+	case tasks := <-responseChan:
+		t.Fatalf("request completed early with %v", tasks)
+	default:
+	}
+
+	respond("worker-2", "task-2")
+	select {
+	case tasks := <-responseChan:
+		if len(tasks) != 2 || tasks[0]["id"] != "task-1" || tasks[1]["id"] != "task-2" {
+			t.Fatalf("expected one task from each asked worker, got %v", tasks)
+		}
+	default:
+		t.Fatal("expected the request to complete once both workers answered")
+	}
+
+	// 已完成请求的迟到响应被识别并丢弃
+	respond("worker-2", "task-2")
+	controller.mutex.Lock()
+	pending := len(controller.pendingRequests)
+	late := controller.finished.contains("req-tasks")
+	controller.mutex.Unlock()
+	if pending != 0 || !late {
+		t.Fatalf("expected the finished request to be remembered, pending %d, late %v", pending, late)
+	}
+
+	// 单节点请求只接受被询问的节点
+	single := make(chan []map[string]interface{}, 1)
+	controller.mutex.Lock()
+	controller.pendingRequests["req-single"] = &PendingRequest{
+		RequestID:     "req-single",
+		RequestType:   "get_queues",
+		ExpectedNodes: 1,
+		TargetNodes:   nodeSet([]string{"worker-2"}),
+		ResponseChan:  single,
+		CreatedAt:     time.Now(),
+	}
+	controller.mutex.Unlock()
+	controller.handleNodeResponse("worker-1", map[string]interface{}{"request_id": "req-single", "success": true})
+	if len(single) != 0 {
+		t.Fatal("a response from a worker that was not asked must be dropped")
+	}
+	controller.handleNodeResponse("worker-2", map[string]interface{}{"request_id": "req-single", "success": true})
+	if responses := <-single; len(responses) != 1 || responses[0]["node_id"] != "worker-2" {
+		t.Fatalf("expected worker-2's response, got %v", responses)
+	}
+}
+
+func TestFinishedRequestsEvictsOldest(t *testing.T) {
+	var finished finishedRequests
+	for i := 0; i < finishedRequestsSize+1; i++ {
+		finished.add(fmt.Sprintf("req-%d", i))
+	}
+	if finished.contains("req-0") || !finished.contains("req-1") || !finished.contains(fmt.Sprintf("req-%d", finishedRequestsSize)) {
+		t.Fatal("expected only the oldest request ID to be evicted")
+	}
+	if len(finished.set) != finishedRequestsSize {
+		t.Fatalf("expected %d remembered IDs, got %d", finishedRequestsSize, len(finished.set))
+	}
+}
+
+func TestClientDisconnectClosesSessionsOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	manager := cluster.NewManager()
+	controller := NewGatewayController(manager, nil, nil, nil)
+	controller.clientGrace = 50 * time.Millisecond
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	node, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	if err := node.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := node.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	offers := make(chan string, 2)
+	closes := make(chan string, 8)
+	go func() {
+		for {
+			var message Message
+			if err := node.ReadJSON(&message); err != nil {
+				return
+			}
+			switch message.Type {
+			case "webrtc_offer":
+				offers <- message.Payload["session_id"].(string)
+			case "close_session":
+				closes <- message.Payload["session_id"].(string)
+			}
+		}
+	}()
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/clients?client_id=client-1", nil)
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	for _, sessionID := range []string{"session-1", "session-2"} {
+		if err := client.WriteJSON(Message{Type: "webrtc_offer", Payload: map[string]interface{}{
+			"session_id": sessionID,
+			"worker_id":  "worker-1",
+			"sdp":        "offer",
+		}}); err != nil {
+			t.Fatalf("send offer: %v", err)
+		}
+		select {
+		case <-offers:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("offer %s was not forwarded to the worker", sessionID)
+		}
+	}
+	if sessions := manager.GetSessionsByClient("client-1"); len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions for the client, got %d", len(sessions))
+	}
+
+	client.Close()
+	closed := map[string]int{}
+	for len(closed) < 2 {
+		select {
+		case sessionID := <-closes:
+			closed[sessionID]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("workers were not notified, got %v", closed)
+		}
+	}
+
+	// 再次清理（例如计时器与手动清理并发）不会重复通知
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			controller.closeClientSessions("client-1")
+		}()
+	}
+	wg.Wait()
+	select {
+	case sessionID := <-closes:
+		t.Fatalf("session %s was closed twice", sessionID)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if closed["session-1"] != 1 || closed["session-2"] != 1 {
+		t.Fatalf("expected one close_session per session, got %v", closed)
+	}
+	if _, _, active := manager.Stats(); active != 0 {
+		t.Fatalf("expected no active sessions, got %d", active)
+	}
+}
+
+func TestClientReconnectKeepsSessions(t *testing.T) {
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	controller.clientGrace = 20 * time.Millisecond
+	controller.gateway.CreateSignalingSession("session-1", "client-1", "worker-1")
+
+	controller.clientDisconnected("client-1")
+	controller.clientReconnected("client-1")
+	time.Sleep(100 * time.Millisecond)
+
+	if sessions := controller.gateway.GetSessionsByClient("client-1"); len(sessions) != 1 {
+		t.Fatalf("session of a reconnected client was closed")
+	}
+}
+
+func TestGetTaskSegmentServesRangesFromWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	if err := tasks.Upsert(context.Background(), "task-1", "worker-1", "ready", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks/:id/segments/*name", controller.GetTaskSegment)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点上一个300MB的虚拟切片，内容由偏移量计算，不占内存
+	const size = 300 << 20
+	byteAt := func(offset int64) byte { return byte(offset % 251) }
+	var fetchedMu sync.Mutex
+	var fetched int64
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "file_fetch" {
+				continue
+			}
+			response := map[string]interface{}{"request_id": message.Payload["request_id"]}
+			if message.Payload["stream_token"] != "secret" {
+				response["success"] = false
+				response["forbidden"] = true
+				conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+				continue
+			}
+			if name := message.Payload["name"]; name != "index0.ts" && name != "720p/index0.ts" {
+				response["success"] = false
+				response["not_found"] = true
+				conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+				continue
+			}
+			offset := int64(message.Payload["offset"].(float64))
+			length := int64(message.Payload["length"].(float64))
+			if offset+length > size {
+				length = size - offset
+			}
+			data := make([]byte, length)
+			for i := range data {
+				data[i] = byteAt(offset + int64(i))
+			}
+			fetchedMu.Lock()
+			fetched += length
+			fetchedMu.Unlock()
+			response["success"] = true
+			response["size"] = size
+			response["mod_time"] = "2024-05-01T12:30:00Z"
+			response["offset"] = offset
+			response["data"] = data
+			conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+		}
+	}()
+
+	get := func(name string, headers map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/tasks/task-1/segments/"+name, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		return resp
+	}
+	expectBody := func(resp *http.Response, start, end int64) {
+		t.Helper()
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		if int64(len(body)) != end-start+1 {
+			t.Fatalf("expected %d bytes, got %d", end-start+1, len(body))
+		}
+		for i, b := range body {
+			if b != byteAt(start+int64(i)) {
+				t.Fatalf("byte %d of the range differs", i)
+			}
+		}
+	}
+
+	// 后缀范围
+	resp := get("index0.ts", map[string]string{"Range": "bytes=-1000"})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes %d-%d/%d", size-1000, size-1, size) {
+		t.Fatalf("unexpected suffix range response %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if resp.Header.Get("Content-Type") != "video/mp2t" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected headers %v", resp.Header)
+	}
+	etag := resp.Header.Get("ETag")
+	expectBody(resp, size-1000, size-1)
+
+	// 跨越多个分块的范围
+	resp = get("index0.ts", map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", fileFetchChunkSize-10, 2*fileFetchChunkSize+10)})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", resp.StatusCode)
+	}
+	expectBody(resp, fileFetchChunkSize-10, 2*fileFetchChunkSize+10)
+
+	// 缓存校验
+	resp = get("index0.ts", map[string]string{"If-None-Match": etag})
+	resp.Body.Close()
+	if etag == "" || resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 for ETag %q, got %d", etag, resp.StatusCode)
+	}
+
+	// 无效范围；超出文件范围时Content-Range给出文件大小
+	for _, rangeHeader := range []string{"bytes=500-100", fmt.Sprintf("bytes=%d-", size), "bytes=abc"} {
+		resp = get("index0.ts", map[string]string{"Range": rangeHeader})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("expected 416 for %q, got %d", rangeHeader, resp.StatusCode)
+		}
+	}
+	resp = get("index0.ts", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)})
+	resp.Body.Close()
+	if resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", size) {
+		t.Fatalf("expected the file size in Content-Range, got %q", resp.Header.Get("Content-Range"))
+	}
+
+	resp = get("missing.ts", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing file, got %d", resp.StatusCode)
+	}
+
+	// 多码率输出的码流子目录中的文件同样可以读取，跳出任务目录的路径不转发给节点
+	resp = get("720p/index0.ts", map[string]string{"Range": "bytes=0-99"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected a file in a rendition directory to be served, got %d", resp.StatusCode)
+	}
+	expectBody(resp, 0, 99)
+	resp = get("720p/..%2Findex0.ts", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a path leaving the task directory, got %d", resp.StatusCode)
+	}
+
+	// 与/stream/一样需要任务的播放令牌
+	for authorization, status := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusForbidden} {
+		resp = get("index0.ts", map[string]string{"Authorization": authorization})
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expected %d for authorization %q, got %d", status, authorization, resp.StatusCode)
+		}
+	}
+
+	// 整个文件边拉边写：客户端读了开头就断开时，网关只向节点拉取了一小部分
+	fetchedMu.Lock()
+	fetched = 0
+	fetchedMu.Unlock()
+	resp = get("index0.ts", nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size {
+		t.Fatalf("expected the whole file to be announced, got %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+	head := make([]byte, 2<<20)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatalf("read head: %v", err)
+	}
+	for i, b := range head {
+		if b != byteAt(int64(i)) {
+			t.Fatalf("byte %d of the stream differs", i)
+		}
+	}
+	resp.Body.Close()
+	time.Sleep(200 * time.Millisecond)
+	fetchedMu.Lock()
+	defer fetchedMu.Unlock()
+	if fetched > 64<<20 {
+		t.Fatalf("expected the gateway to stream without buffering the file, fetched %d bytes", fetched)
+	}
+}
+
+func TestGetTaskStreamRequiresTokenAndServesRanges(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	owner := int64(7)
+	if err := tasks.Upsert(context.Background(), "task-1", "worker-1", "ready", &owner); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks/:id/stream/*path", controller.GetTaskStream)
+	router.GET("/api/tasks/:id/stream-token", func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	}, controller.GetStreamToken)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	segment := make([]byte, 4000)
+	for i := range segment {
+		segment[i] = byte(i % 251)
+	}
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			response := map[string]interface{}{"request_id": message.Payload["request_id"]}
+			switch {
+			case message.Type == "get_stream_token":
+				response["success"] = true
+				response["token"] = "secret"
+				conn.WriteJSON(Message{Type: "stream_token_response", Payload: response})
+			case message.Type != "file_fetch":
+			case message.Payload["stream_token"] != "secret":
+				response["success"] = false
+				response["forbidden"] = true
+				conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+			case message.Payload["name"] != "720p/index0.ts":
+				response["success"] = false
+				response["not_found"] = true
+				conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+			default:
+				offset := int64(message.Payload["offset"].(float64))
+				end := offset + int64(message.Payload["length"].(float64))
+				if end > int64(len(segment)) {
+					end = int64(len(segment))
+				}
+				response["success"] = true
+				response["size"] = len(segment)
+				response["mod_time"] = "2024-05-01T12:30:00Z"
+				response["data"] = segment[offset:end]
+				conn.WriteJSON(Message{Type: "file_fetch_response", Payload: response})
+			}
+		}
+	}()
+
+	get := func(path, token string, headers map[string]string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("/api/tasks/task-1/stream-token", "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"token":"secret"`) || !strings.Contains(string(body), "/api/tasks/task-1/stream/index.m3u8") {
+		t.Fatalf("unexpected stream token response %d %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := get("/api/tasks/task-1/stream/720p/index0.ts", "", nil); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/api/tasks/task-1/stream/720p/index0.ts", "wrong", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong token, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/api/tasks/task-1/stream/720p/../index0.ts", "secret", nil); resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a path leaving the task directory to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/api/tasks/task-1/stream/missing.ts", "secret", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing file, got %d", resp.StatusCode)
+	}
+
+	resp, body = get("/api/tasks/task-1/stream/720p/index0.ts", "secret", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(segment) {
+		t.Fatalf("expected the whole segment, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Content-Type") != "video/mp2t" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected headers %v", resp.Header)
+	}
+
+	resp, body = get("/api/tasks/task-1/stream/720p/index0.ts", "secret", map[string]string{"Range": "bytes=1000-1999"})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 1000-1999/4000" || string(body) != string(segment[1000:2000]) {
+		t.Fatalf("unexpected range response %d %q with %d bytes", resp.StatusCode, resp.Header.Get("Content-Range"), len(body))
+	}
+	resp, body = get("/api/tasks/task-1/stream/720p/index0.ts", "secret", map[string]string{"Range": "bytes=-500"})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != string(segment[3500:]) {
+		t.Fatalf("unexpected suffix range response %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, _ := get("/api/tasks/task-1/stream/720p/index0.ts", "secret", map[string]string{"Range": "bytes=5000-"}); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416 for a range past the end, got %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp, _ := get("/api/tasks/task-1/stream/720p/index0.ts", "secret", map[string]string{"If-None-Match": etag}); etag == "" || resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 for a cached copy, got %d", resp.StatusCode)
+	}
+}
+
+func TestSetTaskPriorityForwardsToOwningWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	for taskID, workerID := range map[string]string{"task-1": "worker-1", "task-old": "worker-old"} {
+		if err := tasks.Upsert(context.Background(), taskID, workerID, "pending", nil); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.PATCH("/api/tasks/:id/priority", controller.SetTaskPriority)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	connect := func(id string, version int) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]interface{}{"id": id, "protocol_version": version}); err != nil {
+			t.Fatalf("send registration: %v", err)
+		}
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+			t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+		}
+		return conn
+	}
+	conn := connect("worker-1", cluster.ProtocolVersion)
+	connect("worker-old", 6)
+
+	received := make(chan map[string]interface{}, 1)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "set_priority" {
+				continue
+			}
+			received <- message.Payload
+			conn.WriteJSON(Message{Type: "set_priority_response", Payload: map[string]interface{}{
+				"request_id": message.Payload["request_id"],
+				"success":    true,
+			}})
+		}
+	}()
+
+	patch := func(taskID, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPatch, server.URL+"/api/tasks/"+taskID+"/priority", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch priority: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := patch("task-1", `{"priority": 9}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	select {
+	case payload := <-received:
+		if payload["task_id"] != "task-1" || payload["priority"] != float64(9) {
+			t.Fatalf("unexpected set_priority payload: %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not receive set_priority")
+	}
+
+	for _, body := range []string{`{"priority": 0}`, `{"priority": 11}`, `{}`} {
+		if resp := patch("task-1", body); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, resp.StatusCode)
+		}
+	}
+	if resp := patch("missing", `{"priority": 3}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown task, got %d", resp.StatusCode)
+	}
+	if resp := patch("task-old", `{"priority": 3}`); resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 for a worker without set_priority, got %d", resp.StatusCode)
+	}
+}
+
+func TestTaskControlForwardsToOwningWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	owner := int64(7)
+	for _, taskID := range []string{"task-1", "task-busy", "task-keep"} {
+		if err := tasks.Upsert(context.Background(), taskID, "worker-1", "downloading", &owner); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+	other := int64(8)
+	if err := tasks.Upsert(context.Background(), "task-other", "worker-1", "downloading", &other); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := tasks.Upsert(context.Background(), "task-old", "worker-old", "downloading", &owner); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/:id/pause", controller.PauseTask)
+	router.POST("/api/tasks/:id/resume", controller.ResumeTask)
+	router.DELETE("/api/tasks/:id", controller.RemoveTask)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：转码中的任务不能删除，其他请求按类型回复新状态
+	received := make(chan string, 8)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			taskID, _ := message.Payload["task_id"].(string)
+			response := map[string]interface{}{"request_id": message.Payload["request_id"], "task_id": taskID, "success": true}
+			switch message.Type {
+			case "task_pause":
+				response["status"] = "paused"
+			case "task_resume":
+				response["status"] = "pending"
+			case "task_remove":
+				response["status"] = "removed"
+				if taskID == "task-busy" {
+					response["success"] = false
+					response["status"] = "transcoding"
+					response["error"] = "task task-busy is transcoding and cannot be removed"
+				}
+				taskID = fmt.Sprintf("%s purge=%v", taskID, message.Payload["purge_files"])
+			default:
+				continue
+			}
+			received <- message.Type + " " + taskID
+			conn.WriteJSON(Message{Type: message.Type + "_response", Payload: response})
+		}
+	}()
+
+	do := func(method, path string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	for _, step := range []struct {
+		method, path, message, status string
+	}{
+		{http.MethodPost, "/api/tasks/task-1/pause", "task_pause task-1", "paused"},
+		{http.MethodPost, "/api/tasks/task-1/resume", "task_resume task-1", "pending"},
+		{http.MethodDelete, "/api/tasks/task-1", "task_remove task-1 purge=true", "removed"},
+		{http.MethodDelete, "/api/tasks/task-keep?purge_files=false", "task_remove task-keep purge=false", "removed"},
+	} {
+		code, body := do(step.method, step.path)
+		data, _ := body["data"].(map[string]interface{})
+		if code != http.StatusOK || data["status"] != step.status {
+			t.Fatalf("%s %s: expected 200 with status %s, got %d %v", step.method, step.path, step.status, code, body)
+		}
+		select {
+		case got := <-received:
+			if got != step.message {
+				t.Fatalf("expected worker to receive %q, got %q", step.message, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("worker did not receive %s", step.message)
+		}
+	}
+	if _, err := tasks.Get(context.Background(), "task-1"); !errors.Is(err, task.ErrNotFound) {
+		t.Fatalf("expected the removed task to leave the registry, got %v", err)
+	}
+
+	if code, _ := do(http.MethodDelete, "/api/tasks/task-busy"); code != http.StatusConflict {
+		t.Fatalf("expected 409 when the worker refuses, got %d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/api/tasks/task-keep?purge_files=nope"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid purge_files, got %d", code)
+	}
+
+	// 不认识purge_files的旧节点总会删除文件，要求保留文件时拒绝
+	old, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { old.Close() })
+	if err := old.WriteJSON(map[string]interface{}{"id": "worker-old", "protocol_version": 21}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	if err := old.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+	if code, _ := do(http.MethodDelete, "/api/tasks/task-old?purge_files=false"); code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 when an old worker cannot keep the files, got %d", code)
+	}
+	if _, err := tasks.Get(context.Background(), "task-old"); err != nil {
+		t.Fatalf("a task the old worker was not asked to remove must stay registered: %v", err)
+	}
+	if _, err := tasks.Get(context.Background(), "task-busy"); err != nil {
+		t.Fatalf("a task the worker kept must stay registered: %v", err)
+	}
+	if code, _ := do(http.MethodPost, "/api/tasks/task-other/pause"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's task, got %d", code)
+	}
+	if code, _ := do(http.MethodPost, "/api/tasks/missing/pause"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown task, got %d", code)
+	}
+}
+
+func TestSelectTaskFilesForwardsSelection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	owner, other := int64(7), int64(8)
+	for taskID, ownerID := range map[string]*int64{"task-1": &owner, "task-done": &owner, "task-other": &other} {
+		if err := tasks.Upsert(context.Background(), taskID, "worker-1", "downloading", ownerID); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.PATCH("/api/tasks/:id/files", controller.SelectTaskFiles)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	received := make(chan map[string]interface{}, 4)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "select_files" {
+				continue
+			}
+			received <- message.Payload
+			response := map[string]interface{}{"request_id": message.Payload["request_id"], "task_id": message.Payload["task_id"], "success": true}
+			if message.Payload["task_id"] == "task-done" {
+				response["success"] = false
+				response["error"] = "cannot change the file selection of a ready task"
+			} else {
+				response["size"] = 700
+				response["files"] = []map[string]interface{}{
+					{"file_name": "Show/e01.mkv", "file_path": "Show/e01.mkv", "file_size": 700, "is_selected": true},
+					{"file_name": "Show/e02.mkv", "file_path": "Show/e02.mkv", "file_size": 800, "is_selected": false},
+				}
+			}
+			conn.WriteJSON(Message{Type: "select_files_response", Payload: response})
+		}
+	}()
+
+	patch := func(taskID, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(http.MethodPatch, server.URL+"/api/tasks/"+taskID+"/files", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch files: %v", err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+
+	code, body := patch("task-1", `{"selected_files": ["Show/e01.mkv"]}`)
+	data, _ := body["data"].(map[string]interface{})
+	if code != http.StatusOK || data["size"] != float64(700) || len(data["files"].([]interface{})) != 2 {
+		t.Fatalf("expected the new selection in the answer, got %d %v", code, body)
+	}
+	select {
+	case payload := <-received:
+		files, _ := payload["selected_files"].([]interface{})
+		if payload["task_id"] != "task-1" || len(files) != 1 || files[0] != "Show/e01.mkv" {
+			t.Fatalf("unexpected select_files payload: %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not receive select_files")
+	}
+
+	for _, body := range []string{`{"selected_files": []}`, `{}`, `not json`} {
+		if code, _ := patch("task-1", body); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+	if code, _ := patch("task-done", `{"selected_files": ["a"]}`); code != http.StatusConflict {
+		t.Fatalf("expected 409 when the worker refuses, got %d", code)
+	}
+	if code, _ := patch("task-other", `{"selected_files": ["a"]}`); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's task, got %d", code)
+	}
+	if code, _ := patch("missing", `{"selected_files": ["a"]}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown task, got %d", code)
+	}
+}
+
+func TestGetNodeQueuesReportsWorkerQueues(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/nodes/:id/queues", controller.GetNodeQueues)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：一个任务在下载，两个排队；一个任务在转码，一个排队
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "get_queues" {
+				continue
+			}
+			conn.WriteJSON(Message{Type: "queues_response", Payload: map[string]interface{}{
+				"request_id": message.Payload["request_id"],
+				"success":    true,
+				"download": map[string]interface{}{
+					"max_tasks": 1,
+					"running":   []interface{}{map[string]interface{}{"task_id": "task-a", "priority": 5}},
+					"pending": []interface{}{
+						map[string]interface{}{"task_id": "task-b", "priority": 9, "position": 1},
+						map[string]interface{}{"task_id": "task-c", "priority": 5, "position": 2},
+					},
+				},
+				"transcode": map[string]interface{}{
+					"max_tasks": 1,
+					"running":   []interface{}{map[string]interface{}{"transcode_id": "t-1", "task_id": "task-x", "progress": 40}},
+					"pending":   []interface{}{map[string]interface{}{"transcode_id": "t-2", "task_id": "task-y", "position": 1, "progress": 0}},
+				},
+			}})
+		}
+	}()
+
+	get := func(path string) (int, map[string]interface{}) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		data, _ := body["data"].(map[string]interface{})
+		return resp.StatusCode, data
+	}
+
+	code, data := get("/api/nodes/worker-1/queues")
+	download, _ := data["download"].(map[string]interface{})
+	pending, _ := download["pending"].([]interface{})
+	if code != http.StatusOK || data["node_id"] != "worker-1" || len(pending) != 2 {
+		t.Fatalf("expected both download queue entries, got %d %v", code, data)
+	}
+	if first, _ := pending[0].(map[string]interface{}); first["task_id"] != "task-b" {
+		t.Fatalf("expected task-b first in the download queue, got %v", pending)
+	}
+
+	for _, tc := range []struct {
+		taskID, queue string
+		running       bool
+		position      float64
+		depth         float64
+	}{
+		{"task-c", "download", false, 2, 2},
+		{"task-a", "download", true, 0, 2},
+		{"task-y", "transcode", false, 1, 1},
+	} {
+		code, data := get("/api/nodes/worker-1/queues?task_id=" + tc.taskID)
+		located, _ := data["task"].(map[string]interface{})
+		if code != http.StatusOK || located["queue"] != tc.queue || located["running"] != tc.running ||
+			located["position"] != tc.position || located["depth"] != tc.depth {
+			t.Fatalf("%s: expected %s queue position %v of %v, got %d %v", tc.taskID, tc.queue, tc.position, tc.depth, code, located)
+		}
+	}
+
+	if code, _ := get("/api/nodes/worker-1/queues?task_id=missing"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a task in neither queue, got %d", code)
+	}
+	if code, _ := get("/api/nodes/worker-2/queues"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown node, got %d", code)
+	}
+}
+
+func TestPauseAndResumeNodeForwardQuietRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/nodes/:id/pause-all", controller.PauseNode)
+	router.POST("/api/nodes/:id/resume-all", controller.ResumeNode)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：收到pause_all后静默，resume_all后恢复
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "pause_all" && message.Type != "resume_all" {
+				continue
+			}
+			conn.WriteJSON(Message{Type: message.Type + "_response", Payload: map[string]interface{}{
+				"request_id": message.Payload["request_id"],
+				"success":    true,
+				"quiet":      message.Type == "pause_all",
+			}})
+		}
+	}()
+
+	post := func(path string) (int, map[string]interface{}) {
+		resp, err := http.Post(server.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		data, _ := body["data"].(map[string]interface{})
+		return resp.StatusCode, data
+	}
+
+	if code, data := post("/api/nodes/worker-1/pause-all"); code != http.StatusOK || data["quiet"] != true {
+		t.Fatalf("expected the node to report quiet, got %d %v", code, data)
+	}
+	if code, data := post("/api/nodes/worker-1/resume-all"); code != http.StatusOK || data["quiet"] != false {
+		t.Fatalf("expected the node to report active, got %d %v", code, data)
+	}
+	if code, _ := post("/api/nodes/worker-2/pause-all"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown node, got %d", code)
+	}
+}
+
+func TestSetNodeRateLimitForwardsLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.PUT("/api/nodes/:id/rate-limit", controller.SetNodeRateLimit)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：未给出的方向按配置的1000kbps限速
+	received := make(chan map[string]interface{}, 1)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "set_rate_limit" {
+				continue
+			}
+			received <- message.Payload
+			response := map[string]interface{}{
+				"request_id": message.Payload["request_id"],
+				"success":    true,
+				"down_kbps":  1000,
+				"up_kbps":    1000,
+			}
+			if down, ok := message.Payload["down_kbps"]; ok {
+				response["down_kbps"] = down
+			}
+			if up, ok := message.Payload["up_kbps"]; ok {
+				response["up_kbps"] = up
+			}
+			conn.WriteJSON(Message{Type: "set_rate_limit_response", Payload: response})
+		}
+	}()
+
+	put := func(path, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		data, _ := decoded["data"].(map[string]interface{})
+		return resp.StatusCode, data
+	}
+
+	code, data := put("/api/nodes/worker-1/rate-limit", `{"down_kbps": 0}`)
+	if code != http.StatusOK || data["down_kbps"] != float64(0) || data["up_kbps"] != float64(1000) {
+		t.Fatalf("expected unlimited downloads and the configured upload limit, got %d %v", code, data)
+	}
+	if payload := <-received; payload["down_kbps"] != float64(0) || payload["up_kbps"] != nil {
+		t.Fatalf("expected only down_kbps to be forwarded, got %v", payload)
+	}
+	if code, _ := put("/api/nodes/worker-1/rate-limit", `{"up_kbps": -5}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", code)
+	}
+	if code, _ := put("/api/nodes/worker-2/rate-limit", `{}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown node, got %d", code)
+	}
+}
+
+func TestGetTaskAccessForwardsToOwningWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tasks := task.NewRepository(db)
+	owner := int64(7)
+	for _, taskID := range []string{"task-1", "task-gone"} {
+		if err := tasks.Upsert(context.Background(), taskID, "worker-1", "ready", &owner); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+	other := int64(8)
+	if err := tasks.Upsert(context.Background(), "task-other", "worker-1", "ready", &other); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, tasks, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/api/tasks/:id/access", controller.GetTaskAccess)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：task-gone已不在节点上
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "get_task_access" {
+				continue
+			}
+			taskID, _ := message.Payload["task_id"].(string)
+			response := map[string]interface{}{"request_id": message.Payload["request_id"], "task_id": taskID, "success": false, "found": false}
+			if taskID == "task-1" {
+				response["success"] = true
+				response["found"] = true
+				response["access"] = map[string]interface{}{"task_id": taskID, "sessions": 2, "segments": 5, "bytes": 5000}
+			}
+			conn.WriteJSON(Message{Type: "task_access_response", Payload: response})
+		}
+	}()
+
+	get := func(taskID string) (int, map[string]interface{}) {
+		resp, err := server.Client().Get(server.URL + "/api/tasks/" + taskID + "/access")
+		if err != nil {
+			t.Fatalf("get access: %v", err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		data, _ := decoded["data"].(map[string]interface{})
+		return resp.StatusCode, data
+	}
+
+	code, data := get("task-1")
+	access, _ := data["access"].(map[string]interface{})
+	if code != http.StatusOK || data["worker_id"] != "worker-1" || access["sessions"] != float64(2) || access["segments"] != float64(5) {
+		t.Fatalf("expected the worker's access statistics, got %d %v", code, data)
+	}
+	for taskID, want := range map[string]int{
+		"task-gone":    http.StatusNotFound,
+		"task-missing": http.StatusNotFound,
+		"task-other":   http.StatusForbidden,
+	} {
+		if code, _ := get(taskID); code != want {
+			t.Fatalf("%s: expected %d, got %d", taskID, want, code)
+		}
+	}
+}
+
+func TestOwnedTaskRoutesWithoutRegistryAreUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	})
+	router.GET("/api/tasks/:id/log", controller.GetTaskLog)
+	router.POST("/api/tasks/:id/retry", controller.RetryTask)
+
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/tasks/task-1/log", nil),
+		httptest.NewRequest(http.MethodPost, "/api/tasks/task-1/retry", nil),
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s %s: expected 503 without a task registry, got %d", request.Method, request.URL.Path, recorder.Code)
+		}
+	}
+}
+
+func TestConnectionRegistryIsSafeForConcurrentUse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.GET("/ws/clients", controller.HandleClientWebSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	const senders, perSender = 16, 50
+	received := make(chan string, senders*perSender)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			sessionID, _ := message.Payload["session_id"].(string)
+			received <- sessionID
+		}
+	}()
+
+	// 所有协程同时开始，使注册表与连接的每种访问都与其它访问并发，
+	// 缺少注册表的锁或连接的写锁时 go test -race 报告数据竞争
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	// 读循环注册和删除连接，同时HTTP处理函数查找连接
+	const churners, churnRounds = 8, 200
+	for i := 0; i < churners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			userID := int64(i + 1)
+			for j := 0; j < churnRounds; j++ {
+				id := fmt.Sprintf("churn-%d", j%4)
+				registered, _ := controller.clientConns.registerUser(id, userID, nil)
+				controller.clientConns.has(id)
+				controller.clientConns.ownedBy(id, userID)
+				registered.replacement()
+				controller.clientConns.remove(id, registered)
+			}
+		}(i)
+	}
+	// 真实的客户端连接反复连接和断开
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 10; j++ {
+				client, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/ws/clients?client_id=client-%d", wsURL, i), nil)
+				if err != nil {
+					t.Errorf("dial client: %v", err)
+					return
+				}
+				controller.clientConns.has(fmt.Sprintf("client-%d", i))
+				client.Close()
+			}
+		}(i)
+	}
+	// 多个协程同时向同一节点连接写消息
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			for j := 0; j < perSender; j++ {
+				nodeConn, exists := controller.nodeConns.get("worker-1")
+				if !exists {
+					t.Errorf("worker-1 is not registered")
+					return
+				}
+				message := Message{Type: "ice_candidate", Payload: map[string]interface{}{
+					"session_id": fmt.Sprintf("session-%d-%d", i, j),
+					"candidate":  strings.Repeat("c", 512),
+				}}
+				if err := controller.forward(nodeConn, "worker-1", message); err != nil {
+					t.Errorf("forward: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	// 每个连接都由注册它的协程删除，最后注册的连接也不例外
+	for i := 0; i < 4; i++ {
+		if id := fmt.Sprintf("churn-%d", i); controller.clientConns.has(id) {
+			t.Fatalf("expected %s to be removed by its last registration", id)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < senders*perSender {
+		select {
+		case sessionID := <-received:
+			seen[sessionID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d intact messages, got %d", senders*perSender, len(seen))
+		}
+	}
+	if stats := controller.forwardStats.snapshot(); stats.DeadLetters != 0 {
+		t.Fatalf("expected no dead letters, got %+v", stats)
+	}
+}
+
+func TestForwardRetriesOnlyOnTheReconnectedConnection(t *testing.T) {
+	// 服务端接受的连接，客户端读到的消息按连接顺序编号
+	accepted := make(chan *websocket.Conn, 2)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	received := make(chan string, 4)
+	dial := func(name string) *websocket.Conn {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		go func() {
+			for {
+				var message Message
+				if err := client.ReadJSON(&message); err != nil {
+					return
+				}
+				received <- name + " " + message.Type
+			}
+		}()
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection was not accepted")
+			return nil
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %q to be delivered", want)
+		}
+	}
+
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	controller.SetForwardOptions(ForwardOptions{MaxRetries: 2, Backoff: time.Millisecond})
+	registry := newConnRegistry()
+	first, _ := registry.register("client-1", dial("first"))
+
+	if err := controller.forward(first, "client-1", Message{Type: "webrtc_answer"}); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	expect("first webrtc_answer")
+
+	// 写入失败后连接不再使用，对端没有重连时不重试
+	first.conn.Close()
+	err := controller.forward(first, "client-1", Message{Type: "ice_candidate"})
+	if err == nil {
+		t.Fatal("expected the write to the broken connection to fail")
+	}
+	if again := first.WriteJSON(Message{Type: "ice_candidate"}); again != err {
+		t.Fatalf("expected the write error to stick to the connection, got %v", again)
+	}
+
+	// 对端重连后在新连接上重试
+	registry.register("client-1", dial("second"))
+	if err := controller.forward(first, "client-1", Message{Type: "ice_candidate"}); err != nil {
+		t.Fatalf("expected the message to reach the new connection, got %v", err)
+	}
+	expect("second ice_candidate")
+
+	// 无法编码的消息不重试
+	second, _ := registry.get("client-1")
+	if err := controller.forward(second, "client-1", Message{Type: "bad", Payload: map[string]interface{}{"value": make(chan int)}}); err == nil {
+		t.Fatal("expected an unencodable message to fail")
+	}
+	if err := controller.forward(second, "client-1", Message{Type: "webrtc_answer"}); err != nil {
+		t.Fatalf("expected an encoding error to leave the connection usable, got %v", err)
+	}
+	expect("second webrtc_answer")
+
+	stats := controller.forwardStats.snapshot()
+	if stats.Retried != 1 || stats.DeadLetters != 2 || stats.ByType["ice_candidate"] != 1 || stats.ByType["bad"] != 1 {
+		t.Fatalf("unexpected forwarding stats %+v", stats)
+	}
+}
+
+func TestPreviewTaskReturnsTorrentFilesFromWorker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := NewGatewayController(cluster.NewManager(), nil, nil, nil)
+	router := gin.New()
+	router.GET("/ws/nodes", controller.HandleNodeWebSocket)
+	router.POST("/api/tasks/preview", func(c *gin.Context) {
+		c.Set("currentUser", &user.User{ID: 7, Username: "alice", Role: user.RoleUser})
+	}, controller.PreviewTask)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/nodes", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"id": "worker-1", "protocol_version": cluster.ProtocolVersion}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var reply Message
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "registration_confirmed" {
+		t.Fatalf("expected registration_confirmed, got %v %v", reply, err)
+	}
+
+	// 模拟节点：只有一个磁力链接能拿到元数据
+	known := "magnet:?xt=urn:btih:" + strings.Repeat("a", 40)
+	go func() {
+		for {
+			var message Message
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type != "get_torrent_info" {
+				continue
+			}
+			response := map[string]interface{}{"request_id": message.Payload["request_id"]}
+			if message.Payload["magnet_url"] == known {
+				response["success"] = true
+				response["name"] = "Movie"
+				response["size"] = 300
+				response["files"] = []interface{}{
+					map[string]interface{}{"file_name": "Movie/movie.mkv", "file_path": "movie.mkv", "file_size": 200},
+					map[string]interface{}{"file_name": "Movie/extras.mkv", "file_path": "extras.mkv", "file_size": 100},
+				}
+			} else {
+				response["success"] = false
+				response["error"] = "no metadata after 2m0s"
+				response["error_code"] = "metadata_timeout"
+			}
+			conn.WriteJSON(Message{Type: "torrent_info_response", Payload: response})
+		}
+	}()
+
+	preview := func(magnet string) (int, map[string]interface{}) {
+		body, _ := json.Marshal(map[string]interface{}{"worker_id": "worker-1", "magnet_url": magnet})
+		resp, err := http.Post(server.URL+"/api/tasks/preview", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("POST preview: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	code, result := preview(known)
+	data, _ := result["data"].(map[string]interface{})
+	files, _ := data["files"].([]interface{})
+	if code != http.StatusOK || data["worker_id"] != "worker-1" || data["name"] != "Movie" || len(files) != 2 {
+		t.Fatalf("expected the worker's file list, got %d %v", code, result)
+	}
+
+	code, result = preview("magnet:?xt=urn:btih:" + strings.Repeat("b", 40))
+	if code != http.StatusGatewayTimeout || result["code"] != "metadata_timeout" {
+		t.Fatalf("expected 504 metadata_timeout, got %d %v", code, result)
+	}
+}
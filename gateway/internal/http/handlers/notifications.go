@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/timefmt"
+	"magnetm3u8-gateway/internal/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookTimeout 投递一次webhook的最长时间
+const webhookTimeout = 10 * time.Second
+
+// eventStreamBuffer 每个事件流订阅者缓冲的事件数，读取过慢时丢弃新事件
+const eventStreamBuffer = 16
+
+// eventStreamKeepAlive 事件流没有事件时发送注释行的间隔，防止代理断开空闲连接
+const eventStreamKeepAlive = 30 * time.Second
+
+// TaskEvent 通知用户的任务事件，既是webhook的请求体，也是事件流中的data
+type TaskEvent struct {
+	Event    string       `json:"event"`
+	TaskID   string       `json:"task_id"`
+	WorkerID string       `json:"worker_id"`
+	Status   string       `json:"status"`
+	At       timefmt.Time `json:"at"`
+}
+
+// errPrivateWebhook webhook地址解析为回环、内网等非公网地址
+var errPrivateWebhook = errors.New("webhook address is not public")
+
+// notifier 按用户分发任务事件：事件流的订阅者与webhook
+type notifier struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan TaskEvent]struct{}
+	client      *http.Client // 投递webhook，只连接公网地址
+}
+
+func newNotifier() *notifier {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: publicAddressOnly}
+	return &notifier{
+		subscribers: make(map[int64]map[chan TaskEvent]struct{}),
+		client: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+}
+
+// publicAddressOnly 拒绝连接非公网地址，webhook由用户填写，不能借网关访问内网。
+// 在解析之后、连接之前检查，重定向与DNS重绑定同样受限
+func publicAddressOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return errPrivateWebhook
+	}
+	return nil
+}
+
+// subscribe 订阅用户的事件，返回的函数取消订阅
+func (n *notifier) subscribe(userID int64) (<-chan TaskEvent, func()) {
+	events := make(chan TaskEvent, eventStreamBuffer)
+
+	n.mu.Lock()
+	if n.subscribers[userID] == nil {
+		n.subscribers[userID] = make(map[chan TaskEvent]struct{})
+	}
+	n.subscribers[userID][events] = struct{}{}
+	n.mu.Unlock()
+
+	return events, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subscribers[userID], events)
+		if len(n.subscribers[userID]) == 0 {
+			delete(n.subscribers, userID)
+		}
+	}
+}
+
+// publish 把事件发给用户的所有事件流，缓冲已满的订阅者丢弃该事件
+func (n *notifier) publish(userID int64, event TaskEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for events := range n.subscribers[userID] {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Event stream of user %d is full, dropping %s of task %s", userID, event.Event, event.TaskID)
+		}
+	}
+}
+
+// deliver 以JSON POST投递webhook，失败只记录日志，不重试
+func (n *notifier) deliver(webhook string, event TaskEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to build webhook request for task %s: %v", event.TaskID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		log.Printf("Failed to deliver %s of task %s to webhook: %v", event.Event, event.TaskID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("Webhook rejected %s of task %s: %s", event.Event, event.TaskID, resp.Status)
+	}
+}
+
+// taskEventFor 状态对应的通知事件，不需要通知的状态返回空串
+func taskEventFor(status string) string {
+	switch status {
+	case "ready":
+		return user.EventTaskReady
+	case "error", "permanently_failed":
+		return user.EventTaskFailed
+	}
+	return ""
+}
+
+// notifyStatusChange 任务进入ready或失败状态时按所属用户的偏好发送通知，
+// previous为登记的上一条记录，状态未变化时不重复通知
+func (gc *GatewayController) notifyStatusChange(previous *task.Record, nodeID, taskID, status string, ownerID *int64) {
+	event := taskEventFor(status)
+	if event == "" || (previous != nil && previous.Status == status) {
+		return
+	}
+	if ownerID == nil && previous != nil {
+		ownerID = previous.OwnerID
+	}
+	if ownerID == nil {
+		return
+	}
+
+	preferences := gc.submitPreferences(context.Background(), *ownerID)
+	if !preferences.Notifies(event) {
+		return
+	}
+	taskEvent := TaskEvent{Event: event, TaskID: taskID, WorkerID: nodeID, Status: status, At: timefmt.Now()}
+	if preferences.Notifications.SSE {
+		gc.notifier.publish(*ownerID, taskEvent)
+	}
+	if webhook := preferences.Notifications.Webhook; webhook != "" {
+		go gc.notifier.deliver(webhook, taskEvent)
+	}
+}
+
+// StreamEvents 以server-sent events推送当前用户选择通过事件流接收的任务事件
+func (gc *GatewayController) StreamEvents(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	events, cancel := gc.notifier.subscribe(account.ID)
+	defer cancel()
+
+	// 事件流长期保持，不受服务器写超时限制
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-events:
+			c.SSEvent(event.Event, event)
+			c.Writer.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
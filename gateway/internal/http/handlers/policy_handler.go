@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/policy"
+)
+
+const (
+	defaultPolicyEventLimit = 100
+	maxPolicyEventLimit     = 1000
+)
+
+// PolicyHandler exposes admin APIs for the content blocklist.
+type PolicyHandler struct {
+	blocklist *policy.Blocklist
+}
+
+func NewPolicyHandler(blocklist *policy.Blocklist) *PolicyHandler {
+	return &PolicyHandler{blocklist: blocklist}
+}
+
+func (h *PolicyHandler) ListRules(c *gin.Context) {
+	rules, err := h.blocklist.Rules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "无法加载黑名单"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": rules})
+}
+
+func (h *PolicyHandler) CreateRule(c *gin.Context) {
+	var payload BlocklistRuleRequest
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求格式不正确"})
+		return
+	}
+
+	var createdBy *int64
+	if account, ok := middleware.CurrentUser(c); ok {
+		id := account.ID
+		createdBy = &id
+	}
+
+	rule, err := h.blocklist.AddRule(c.Request.Context(), payload.Kind, payload.Pattern, createdBy)
+	if err != nil {
+		if errors.Is(err, policy.ErrInvalidRule) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存黑名单规则失败"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"success": true, "data": rule})
+}
+
+func (h *PolicyHandler) DeleteRule(c *gin.Context) {
+	ruleID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "规则ID无效"})
+		return
+	}
+
+	if err := h.blocklist.RemoveRule(c.Request.Context(), ruleID); err != nil {
+		if errors.Is(err, policy.ErrRuleNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "规则不存在"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "删除黑名单规则失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *PolicyHandler) ListEvents(c *gin.Context) {
+	limit := defaultPolicyEventLimit
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit参数无效"})
+			return
+		}
+		if parsed > maxPolicyEventLimit {
+			parsed = maxPolicyEventLimit
+		}
+		limit = parsed
+	}
+
+	events, err := h.blocklist.Events(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "无法加载审计日志"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": events})
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"magnetm3u8-gateway/internal/user"
+)
+
+// SetUserRepository 设置用户存储，提交任务时读取用户的偏好设置；为nil时不应用偏好
+func (gc *GatewayController) SetUserRepository(users *user.Repository) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	gc.users = users
+}
+
+// submitPreferences 返回用户的提交偏好，读取失败时按没有偏好处理，不影响提交
+func (gc *GatewayController) submitPreferences(ctx context.Context, userID int64) user.Preferences {
+	gc.mutex.RLock()
+	users := gc.users
+	gc.mutex.RUnlock()
+	if users == nil {
+		return user.Preferences{}
+	}
+
+	preferences, err := users.GetPreferences(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load preferences of user %d: %v", userID, err)
+		return user.Preferences{}
+	}
+	return preferences
+}
+
+// preferredWorker 偏好的节点在线且具备submitCapabilities时返回它，否则返回空串，
+// 与SelectWorker一样不把任务交给不能接收提交的节点，由调度算法选择
+func (gc *GatewayController) preferredWorker(preferences user.Preferences) string {
+	workerID := preferences.Worker()
+	if workerID == "" {
+		return ""
+	}
+	if node, exists := gc.gateway.GetNode(workerID); !exists || node.Status != "online" || !node.HasCapabilities(submitCapabilities) {
+		log.Printf("Preferred worker %s is not available, scheduling instead", workerID)
+		return ""
+	}
+	return workerID
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/timefmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// probeCacheTTL 测速结果的缓存时间，期间同一用户对同一节点的测速直接返回缓存
+const probeCacheTTL = 10 * time.Minute
+
+// ProbeResult 一次测速的结果，按用户与节点缓存，供播放器选择最快的副本
+type ProbeResult struct {
+	WorkerID       string       `json:"worker_id"`
+	Bytes          int64        `json:"bytes"`
+	DurationMs     int64        `json:"duration_ms"`
+	ThroughputKbps float64      `json:"throughput_kbps"`
+	RTTMs          float64      `json:"rtt_ms"`
+	MeasuredAt     timefmt.Time `json:"measured_at"`
+}
+
+type probeKey struct {
+	userID   int64
+	workerID string
+}
+
+// probeCache 按（用户, 节点）缓存的测速结果，以及进行中的测速会话所属的用户
+type probeCache struct {
+	mu       sync.Mutex
+	results  map[probeKey]ProbeResult
+	sessions map[string]probeSession // 进行中的测速会话，按会话ID索引
+	now      func() time.Time
+}
+
+type probeSession struct {
+	userID    int64
+	startedAt time.Time
+}
+
+func newProbeCache() *probeCache {
+	return &probeCache{
+		results:  make(map[probeKey]ProbeResult),
+		sessions: make(map[string]probeSession),
+		now:      time.Now,
+	}
+}
+
+// get 返回未过期的缓存结果
+func (p *probeCache) get(userID int64, workerID string) (ProbeResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, ok := p.results[probeKey{userID, workerID}]
+	if !ok || p.now().Sub(result.MeasuredAt.Time) >= probeCacheTTL {
+		return ProbeResult{}, false
+	}
+	return result, true
+}
+
+// list 返回用户所有未过期的结果，吞吐量高的在前
+func (p *probeCache) list(userID int64) []ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	results := []ProbeResult{}
+	for key, result := range p.results {
+		if p.now().Sub(result.MeasuredAt.Time) >= probeCacheTTL {
+			delete(p.results, key)
+			continue
+		}
+		if key.userID == userID {
+			results = append(results, result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ThroughputKbps > results[j].ThroughputKbps })
+	return results
+}
+
+// start 记录测速会话所属的用户，并丢弃早已超时却没有结果的会话
+func (p *probeCache) start(sessionID string, userID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for id, session := range p.sessions {
+		if now.Sub(session.startedAt) >= probeCacheTTL {
+			delete(p.sessions, id)
+		}
+	}
+	p.sessions[sessionID] = probeSession{userID: userID, startedAt: now}
+}
+
+// finish 结束测速会话并缓存结果，会话未知时返回false
+func (p *probeCache) finish(sessionID string, result ProbeResult) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	session, ok := p.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	delete(p.sessions, sessionID)
+	result.MeasuredAt = timefmt.From(p.now())
+	p.results[probeKey{session.userID, result.WorkerID}] = result
+	return true
+}
+
+// forget 测速会话失败时丢弃
+func (p *probeCache) forget(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, sessionID)
+}
+
+// StartProbe 与节点建立短时的测速会话：节点通过数据通道发送2MB随机数据，
+// 测得吞吐量与RTT后以probe_result通过客户端WebSocket返回。
+// 同一用户对同一节点10分钟内的结果直接返回缓存，force为true时重新测速
+func (gc *GatewayController) StartProbe(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	var request ProbeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.WorkerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "worker_id is required",
+		})
+		return
+	}
+
+	if !request.Force {
+		if result, ok := gc.probes.get(account.ID, request.WorkerID); ok {
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"cached":  true,
+				"result":  result,
+			})
+			return
+		}
+	}
+	if request.ClientID == "" || request.SDP == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "client_id and sdp are required",
+		})
+		return
+	}
+
+	// 测速结果发给client_id的连接，只接受当前用户自己建立的客户端连接
+	if !gc.clientConns.ownedBy(request.ClientID, account.ID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "client_id is not connected as the current user",
+		})
+		return
+	}
+	// 不允许沿用已有会话的ID，否则会覆盖其它用户正在进行的会话
+	if request.SessionID != "" {
+		if _, exists := gc.gateway.GetWebRTCSession(request.SessionID); exists {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   "session_id is already in use",
+			})
+			return
+		}
+	}
+
+	conn, exists := gc.nodeConns.get(request.WorkerID)
+	if !exists {
+		gc.respondNodeRequestError(c, request.WorkerID, errNodeNotConnected)
+		return
+	}
+	if node, ok := gc.gateway.GetNode(request.WorkerID); ok && !cluster.SupportsMessage(node.ProtocolVersion, "webrtc_probe") {
+		gc.respondNodeRequestError(c, request.WorkerID, errNodeUnsupported)
+		return
+	}
+
+	if request.SessionID == "" {
+		request.SessionID = "probe_" + generateRequestID()
+	}
+	session := gc.gateway.CreateProbeSession(request.SessionID, request.ClientID, request.WorkerID)
+	gc.probes.start(session.SessionID, account.ID)
+
+	message := Message{
+		Type: "webrtc_probe",
+		Payload: map[string]interface{}{
+			"session_id": session.SessionID,
+			"client_id":  session.ClientID,
+			"sdp":        request.SDP,
+		},
+	}
+	if err := gc.forward(conn, request.WorkerID, message); err != nil {
+		log.Printf("Failed to forward probe offer to worker %s: %v", request.WorkerID, err)
+		gc.gateway.RemoveSignalingSession(session.SessionID)
+		gc.probes.forget(session.SessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to forward offer to worker",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"cached":     false,
+		"session_id": session.SessionID,
+	})
+}
+
+// GetProbeResults 返回当前用户10分钟内各节点的测速结果，吞吐量高的在前
+func (gc *GatewayController) GetProbeResults(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    gc.probes.list(account.ID),
+	})
+}
+
+// handleProbeResult 缓存节点上报的测速结果，转发给发起测速的客户端并结束会话
+func (gc *GatewayController) handleProbeResult(nodeID string, payload map[string]interface{}) {
+	sessionID, _ := payload["session_id"].(string)
+	session, exists := gc.gateway.GetWebRTCSession(sessionID)
+	if !exists || !session.Probe || session.WorkerID != nodeID {
+		log.Printf("Ignoring probe result for unknown session %s from node %s", sessionID, nodeID)
+		return
+	}
+	gc.gateway.RemoveSignalingSession(sessionID)
+
+	result := ProbeResult{WorkerID: nodeID}
+	if value, ok := payload["bytes"].(float64); ok {
+		result.Bytes = int64(value)
+	}
+	if value, ok := payload["duration_ms"].(float64); ok {
+		result.DurationMs = int64(value)
+	}
+	result.ThroughputKbps, _ = payload["throughput_kbps"].(float64)
+	result.RTTMs, _ = payload["rtt_ms"].(float64)
+	if !gc.probes.finish(sessionID, result) {
+		return
+	}
+
+	if clientConn, exists := gc.clientConns.get(session.ClientID); exists {
+		message := Message{
+			Type: "probe_result",
+			Payload: map[string]interface{}{
+				"session_id":      sessionID,
+				"worker_id":       nodeID,
+				"bytes":           result.Bytes,
+				"duration_ms":     result.DurationMs,
+				"throughput_kbps": result.ThroughputKbps,
+				"rtt_ms":          result.RTTMs,
+			},
+		}
+		if err := gc.forward(clientConn, session.ClientID, message); err != nil {
+			log.Printf("Failed to forward probe result to client %s: %v", session.ClientID, err)
+		}
+	}
+}
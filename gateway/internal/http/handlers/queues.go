@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetNodeQueues 向节点查询下载队列与转码队列的内容：占用名额的任务和按先后排列的等待任务。
+// 带task_id参数时另外返回该任务所在的队列与位置
+func (gc *GatewayController) GetNodeQueues(c *gin.Context) {
+	nodeID := c.Param("id")
+	if _, exists := gc.gateway.GetNode(nodeID); !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Node not found",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(nodeID, "get_queues", map[string]interface{}{}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, nodeID, err)
+		return
+	}
+
+	data := gin.H{
+		"node_id":   nodeID,
+		"download":  response["download"],
+		"transcode": response["transcode"],
+	}
+	if taskID := c.Query("task_id"); taskID != "" {
+		position, found := findQueuePosition(taskID, response)
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Task not queued on node",
+			})
+			return
+		}
+		data["task"] = position
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    data,
+	})
+}
+
+// findQueuePosition 在节点回复的队列中查找任务，先找转码队列，再找下载队列
+func findQueuePosition(taskID string, response map[string]interface{}) (gin.H, bool) {
+	for _, queue := range []string{"transcode", "download"} {
+		snapshot, _ := response[queue].(map[string]interface{})
+		pending, _ := snapshot["pending"].([]interface{})
+		for _, state := range []string{"running", "pending"} {
+			entries, _ := snapshot[state].([]interface{})
+			for _, item := range entries {
+				entry, _ := item.(map[string]interface{})
+				if entry["task_id"] != taskID {
+					continue
+				}
+				position, _ := entry["position"].(float64)
+				return gin.H{
+					"task_id":  taskID,
+					"queue":    queue,
+					"running":  state == "running",
+					"position": int(position),
+					"depth":    len(pending),
+				}, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PauseNode 让节点立即进入静默：暂停下载与转码，已转码内容的播放不受影响，直到resume-all
+func (gc *GatewayController) PauseNode(c *gin.Context) {
+	gc.setNodeQuiet(c, "pause_all")
+}
+
+// ResumeNode 结束节点的静默；在计划静默时段内调用时本次时段剩余时间也不再静默
+func (gc *GatewayController) ResumeNode(c *gin.Context) {
+	gc.setNodeQuiet(c, "resume_all")
+}
+
+// setNodeQuiet 向节点发送pause_all或resume_all并返回节点回复的静默状态
+func (gc *GatewayController) setNodeQuiet(c *gin.Context, msgType string) {
+	nodeID := c.Param("id")
+	if _, exists := gc.gateway.GetNode(nodeID); !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Node not found",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(nodeID, msgType, map[string]interface{}{}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, nodeID, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"node_id": nodeID,
+			"quiet":   response["quiet"],
+		},
+	})
+}
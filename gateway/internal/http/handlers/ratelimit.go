@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetNodeRateLimit 运行中调整节点的种子下载与上传限速（kbps），0表示不限速。
+// 未给出的方向由节点恢复为自己配置的限速；调整不持久化，节点重启后按配置限速
+func (gc *GatewayController) SetNodeRateLimit(c *gin.Context) {
+	var req SetRateLimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "down_kbps and up_kbps must be non-negative integers",
+		})
+		return
+	}
+
+	nodeID := c.Param("id")
+	if _, exists := gc.gateway.GetNode(nodeID); !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Node not found",
+		})
+		return
+	}
+
+	payload := map[string]interface{}{}
+	if req.DownKbps != nil {
+		payload["down_kbps"] = *req.DownKbps
+	}
+	if req.UpKbps != nil {
+		payload["up_kbps"] = *req.UpKbps
+	}
+	response, err := gc.requestFromNode(nodeID, "set_rate_limit", payload, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, nodeID, err)
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"node_id":   nodeID,
+			"down_kbps": response["down_kbps"],
+			"up_kbps":   response["up_kbps"],
+		},
+	})
+}
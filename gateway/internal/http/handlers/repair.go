@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/task"
+)
+
+// repairSegmentTimeout 节点重新生成切片需要运行一次ffmpeg，留出比普通请求更长的时间
+const repairSegmentTimeout = 2 * time.Minute
+
+// RepairTaskSegment 管理员报告任务的一个损坏切片：节点检查切片（大小、时长、记录的校验和），
+// 损坏时从源文件重新生成。force=true时即使检查通过也重新生成。源文件已删除时任务被标记为需要重新转码
+func (gc *GatewayController) RepairTaskSegment(c *gin.Context) {
+	force, _ := strconv.ParseBool(c.Query("force"))
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	taskID := c.Param("id")
+	name := c.Param("name")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "repair_segment", map[string]interface{}{
+		"task_id": taskID,
+		"name":    name,
+		"force":   force,
+	}, repairSegmentTimeout)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if notFound, _ := response["not_found"].(bool); notFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Segment not found",
+		})
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id": taskID,
+			"name":    name,
+			"status":  response["status"],
+			"check":   response["check"],
+		},
+	})
+}
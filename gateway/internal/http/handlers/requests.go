@@ -0,0 +1,129 @@
+package handlers
+
+import "magnetm3u8-gateway/internal/timefmt"
+
+// 各接口绑定的请求体。OpenAPI文档直接引用这些类型，desc标签是文档中的字段说明，
+// binding标签中的required同时标记为必填字段
+
+// Credentials 注册与登录
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SubmitTaskRequest 提交磁力链接。可选的布尔项为nil时使用用户偏好
+type SubmitTaskRequest struct {
+	WorkerID         string   `json:"worker_id" desc:"Worker to submit to; the user's default worker, else picked by SCHEDULING_ALGORITHM, when empty"`
+	MagnetURL        string   `json:"magnet_url"`
+	BurnSubtitles    *bool    `json:"burn_subtitles" desc:"Burn subtitles into the picture; the user's preference when absent"`
+	SubtitleLanguage string   `json:"subtitle_language" desc:"Language of the burned subtitles; the user's preference, then the first track, when empty"`
+	AllowPrivate     bool     `json:"allow_private" desc:"Confirm downloading a private torrent when the worker requires it"`
+	SelectedFiles    []string `json:"selected_files" desc:"Paths of the files to download, as listed in the task's file list; every file when empty"`
+	Priority         int      `json:"priority" desc:"Download priority from 1 to 10, admins only; the worker's default (5) when absent"`
+	HLSQuality       string   `json:"hls_quality" desc:"single or multi for a multi-bitrate HLS ladder with a master playlist; the user's preference, else single, when empty"`
+	Interactive      bool     `json:"interactive" desc:"Someone is waiting to watch; the worker transcodes the task ahead of regular tasks"`
+	RequireComplete  *bool    `json:"require_complete" desc:"Withhold ready until the download has finished and every segment of the output exists; the user's preference when absent"`
+	Sequential       *bool    `json:"sequential" desc:"Download the video in order and transcode while it downloads (true) or wait for the download (false); the user's preference, else the worker's transcode.streaming_mode, when absent"`
+}
+
+// PreviewTaskRequest 提交前获取种子的文件列表
+type PreviewTaskRequest struct {
+	WorkerID  string `json:"worker_id" desc:"Worker that fetches the metadata; picked by SCHEDULING_ALGORITHM when empty"`
+	MagnetURL string `json:"magnet_url"`
+}
+
+// RetryTaskRequest 重试的可选请求体
+type RetryTaskRequest struct {
+	AllowPrivate bool `json:"allow_private"`
+}
+
+// SetPriorityRequest 修改任务的下载优先级
+type SetPriorityRequest struct {
+	Priority int `json:"priority" binding:"required,min=1,max=10" desc:"1 (lowest) to 10 (highest); queued downloads with a higher priority start first"`
+}
+
+// SetRateLimitRequest 修改节点的种子限速
+type SetRateLimitRequest struct {
+	DownKbps *int `json:"down_kbps,omitempty" binding:"omitempty,min=0" desc:"Download limit of the whole node in kbps, 0 for unlimited; left out restores the worker's network.max_bandwidth_kbps"`
+	UpKbps   *int `json:"up_kbps,omitempty" binding:"omitempty,min=0" desc:"Upload limit of the whole node in kbps, 0 for unlimited; left out restores the worker's network.max_bandwidth_kbps"`
+}
+
+// SelectFilesRequest 多文件种子中要下载的文件
+type SelectFilesRequest struct {
+	SelectedFiles []string `json:"selected_files" desc:"file_path (or file_name) of each file to download; at least one"`
+}
+
+// PinTaskRequest 置顶或取消置顶任务
+type PinTaskRequest struct {
+	Pinned bool `json:"pinned"`
+}
+
+// TranscodeLocalRequest 转码节点额外媒体目录中的文件
+type TranscodeLocalRequest struct {
+	Path string `json:"path" binding:"required"`
+}
+
+// WebRTCOfferRequest 通过HTTP转发的SDP Offer
+type WebRTCOfferRequest struct {
+	WorkerID  string `json:"worker_id" desc:"The task's worker or a scheduled one when empty"`
+	ClientID  string `json:"client_id"`
+	SessionID string `json:"session_id"`
+	TaskID    string `json:"task_id" desc:"Task being played, used for failover"`
+	SDP       string `json:"sdp"`
+}
+
+// WebRTCAnswerRequest SDP Answer
+type WebRTCAnswerRequest struct {
+	SessionID string `json:"session_id"`
+	SDP       string `json:"sdp"`
+}
+
+// ICECandidateRequest 逐个发送的ICE候选者
+type ICECandidateRequest struct {
+	SessionID string `json:"session_id"`
+	Candidate string `json:"candidate"`
+	IsClient  bool   `json:"is_client"`
+}
+
+// ICEResendRequest 要求节点重新发送候选者的会话
+type ICEResendRequest struct {
+	SessionID string `json:"session_id" binding:"required"`
+}
+
+// ProbeRequest 与节点开始一次测速
+type ProbeRequest struct {
+	WorkerID  string `json:"worker_id"`
+	ClientID  string `json:"client_id" desc:"Client WebSocket of the same user receiving the answer, ICE candidates and probe_result"`
+	SessionID string `json:"session_id,omitempty" desc:"Generated when empty; must not be in use"`
+	SDP       string `json:"sdp" desc:"Offer with a filePathChannel data channel"`
+	Force     bool   `json:"force,omitempty" desc:"Probe again even when a cached result exists"`
+}
+
+// CreateGuestRequest 创建有时限的访客账号
+type CreateGuestRequest struct {
+	Username       string       `json:"username"`
+	Password       string       `json:"password"`
+	ExpiresAt      timefmt.Time `json:"expires_at"`
+	SubmitDisabled bool         `json:"submit_disabled"`
+}
+
+// ExpiryRequest 修改访客的有效期，null表示转为永久账号
+type ExpiryRequest struct {
+	ExpiresAt timefmt.Time `json:"expires_at"`
+}
+
+// BanRequest 封禁或解封用户
+type BanRequest struct {
+	Banned bool `json:"banned"`
+}
+
+// FlagRequest 设置或清除复查标记
+type FlagRequest struct {
+	Flagged bool `json:"flagged"`
+}
+
+// BlocklistRuleRequest 添加黑名单规则
+type BlocklistRuleRequest struct {
+	Kind    string `json:"kind" desc:"info_hash or name"`
+	Pattern string `json:"pattern"`
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+const (
+	// fileFetchChunkSize 每次向节点拉取的字节数，大文件按块边拉边写，网关不缓存整个文件
+	fileFetchChunkSize = 512 * 1024
+	// fileFetchTimeout 等待节点返回一个分块的时长
+	fileFetchTimeout = 10 * time.Second
+	// segmentWriteTimeout 写出一个分块的时长，每个分块都会顺延写超时，长时间的传输不受服务器WriteTimeout限制
+	segmentWriteTimeout = 30 * time.Second
+)
+
+// fileChunk 节点file_fetch返回的文件信息与数据
+type fileChunk struct {
+	Size    int64
+	ModTime time.Time
+	Data    []byte
+}
+
+// GetTaskSegment 通过网关以HTTP方式读取任务的播放列表、切片等输出文件，与/stream/一样需要任务的Bearer播放令牌，
+// 文件名可以带码流子目录（如720p/index0.ts）。Range、If-None-Match与/stream/相同，由serveNodeFile处理
+func (gc *GatewayController) GetTaskSegment(c *gin.Context) {
+	taskID := c.Param("id")
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	record, token, ok := gc.streamTask(c, taskID, validStreamPath(name))
+	if !ok {
+		return
+	}
+	gc.serveNodeFile(c, record.WorkerID, taskID, name, token)
+}
+
+// registeredTask 读取任务登记中的任务记录，失败时已写入响应
+func (gc *GatewayController) registeredTask(c *gin.Context, taskID string) (*task.Record, bool) {
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return nil, false
+	}
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return nil, false
+	}
+	return record, true
+}
+
+var (
+	errFileNotFound    = errors.New("file not found on worker")
+	errStreamForbidden = errors.New("stream token rejected by worker")
+)
+
+// fetchFileChunk 向节点请求文件从offset开始的至多length字节，length为0时只取文件信息。
+// token非空时由节点核对任务的播放令牌
+func (gc *GatewayController) fetchFileChunk(nodeID, taskID, name, token string, offset, length int64, throttled bool) (*fileChunk, error) {
+	payload := map[string]interface{}{
+		"task_id": taskID,
+		"name":    name,
+		"offset":  offset,
+		"length":  length,
+	}
+	if token != "" {
+		payload["stream_token"] = token
+	}
+	response, err := gc.nodeRequest(nodeID, "file_fetch", payload, fileFetchTimeout, throttled)
+	if err != nil {
+		return nil, err
+	}
+	if success, _ := response["success"].(bool); !success {
+		if notFound, _ := response["not_found"].(bool); notFound {
+			return nil, errFileNotFound
+		}
+		if forbidden, _ := response["forbidden"].(bool); forbidden {
+			return nil, errStreamForbidden
+		}
+		return nil, fmt.Errorf("worker could not read %s: %v", name, response["error"])
+	}
+
+	size, _ := response["size"].(float64)
+	chunk := &fileChunk{Size: int64(size)}
+	chunk.ModTime, _ = timefmt.Parse(response["mod_time"])
+	if encoded, _ := response["data"].(string); encoded != "" {
+		if chunk.Data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("decode %s from worker: %w", name, err)
+		}
+	}
+	return chunk, nil
+}
+
+// fileETag 由文件大小和修改时间生成强ETag，文件替换后两者至少有一个会变化
+func fileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.Unix(), size)
+}
+
+// segmentContentType 按扩展名返回HLS相关文件的Content-Type
+func segmentContentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".vtt":
+		return "text/vtt; charset=utf-8"
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSessionStats 向会话所在节点查询WebRTC会话的传输统计（收发字节数、RTT、丢包率），
+// 节点每5秒采集一次，查询时会立即刷新
+func (gc *GatewayController) GetSessionStats(c *gin.Context) {
+	sessionID := c.Param("id")
+	session, exists := gc.gateway.GetWebRTCSession(sessionID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Session not found",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(session.WorkerID, "get_session_stats", map[string]interface{}{
+		"session_id": sessionID,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, session.WorkerID, err)
+		return
+	}
+	if found, _ := response["found"].(bool); !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Session not found on worker",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"session_id": sessionID,
+			"worker_id":  session.WorkerID,
+			"stats":      response["stats"],
+		},
+	})
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/task"
+)
+
+// GetStreamToken 返回任务的HTTP播放令牌，只有任务所有者和管理员可以获取。
+// 令牌由节点在创建任务时生成并保存，旧任务在首次请求时生成
+func (gc *GatewayController) GetStreamToken(c *gin.Context) {
+	record, ok := gc.ownedTask(c)
+	if !ok {
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "get_stream_token", map[string]interface{}{
+		"task_id": record.TaskID,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+	token, _ := response["token"].(string)
+	if success, _ := response["success"].(bool); !success || token == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id":  record.TaskID,
+			"token":    token,
+			"playlist": "/api/tasks/" + record.TaskID + "/stream/index.m3u8",
+		},
+	})
+}
+
+// GetTaskStream 以Bearer播放令牌通过HTTP读取任务的播放列表和切片，供不支持WebRTC的播放器使用。
+// path可以带码流子目录（如720p/index0.ts），节点只在任务自己的目录中查找文件并核对令牌
+func (gc *GatewayController) GetTaskStream(c *gin.Context) {
+	taskID := c.Param("id")
+	name := strings.TrimPrefix(c.Param("path"), "/")
+	record, token, ok := gc.streamTask(c, taskID, validStreamPath(name))
+	if !ok {
+		return
+	}
+	gc.serveNodeFile(c, record.WorkerID, taskID, name, token)
+}
+
+// serveNodeFile 先向节点取文件信息，再按块拉取文件内容写出。Range、If-None-Match等交给http.ServeContent处理，
+// ETag由节点上报的文件大小和修改时间生成。失败时已写入响应
+func (gc *GatewayController) serveNodeFile(c *gin.Context, nodeID, taskID, name, token string) {
+	info, ok := gc.fetchStreamInfo(c, nodeID, taskID, name, token)
+	if !ok {
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", segmentContentType(name))
+	header.Set("ETag", fileETag(info.Size, info.ModTime))
+	controller := http.NewResponseController(c.Writer)
+	file := &nodeFile{
+		fetch: func(offset, length int64) (*fileChunk, error) {
+			return gc.fetchFileChunk(nodeID, taskID, name, token, offset, length, false)
+		},
+		size:    info.Size,
+		modTime: info.ModTime,
+		// 每个分块都顺延写超时，长时间的传输不受服务器WriteTimeout限制
+		onChunk: func() { controller.SetWriteDeadline(time.Now().Add(segmentWriteTimeout)) },
+	}
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime, file)
+}
+
+// streamTask 核对经由HTTP读取任务输出的请求：需要Bearer播放令牌（401），文件名合法（400），
+// 任务已登记，且节点支持播放令牌（501，旧版节点不核对stream_token）。失败时已写入响应
+func (gc *GatewayController) streamTask(c *gin.Context, taskID string, validName bool) (*task.Record, string, bool) {
+	token, ok := bearerToken(c.GetHeader("Authorization"))
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer realm="stream"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Stream token required",
+		})
+		return nil, "", false
+	}
+	if !validName {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid file name",
+		})
+		return nil, "", false
+	}
+
+	record, ok := gc.registeredTask(c, taskID)
+	if !ok {
+		return nil, "", false
+	}
+	if node, ok := gc.gateway.GetNode(record.WorkerID); ok && !cluster.SupportsMessage(node.ProtocolVersion, "get_stream_token") {
+		gc.respondNodeRequestError(c, record.WorkerID, errNodeUnsupported)
+		return nil, "", false
+	}
+	return record, token, true
+}
+
+// fetchStreamInfo 带令牌向节点取文件信息，节点拒绝令牌时返回403，文件不存在时返回404。失败时已写入响应
+func (gc *GatewayController) fetchStreamInfo(c *gin.Context, nodeID, taskID, name, token string) (*fileChunk, bool) {
+	info, err := gc.fetchFileChunk(nodeID, taskID, name, token, 0, 0, true)
+	switch {
+	case errors.Is(err, errStreamForbidden):
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "Invalid stream token",
+		})
+		return nil, false
+	case errors.Is(err, errFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "File not found",
+		})
+		return nil, false
+	case err != nil:
+		gc.respondNodeRequestError(c, nodeID, err)
+		return nil, false
+	}
+	return info, true
+}
+
+// bearerToken 解析Authorization: Bearer <token>
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// validStreamPath 文件名可以带子目录，任何一段为空、为.或含有..，或出现反斜杠时不合法
+func validStreamPath(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || strings.Contains(part, "..") {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeFile 以io.ReadSeeker的形式读取节点上的任务输出文件，供http.ServeContent使用。
+// 读取时按fileFetchChunkSize向节点拉取并缓存一块，文件在传输期间变化时返回错误
+type nodeFile struct {
+	fetch   func(offset, length int64) (*fileChunk, error)
+	size    int64
+	modTime time.Time
+	onChunk func()
+
+	offset   int64
+	buf      []byte
+	bufStart int64
+}
+
+func (f *nodeFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.offset < f.bufStart || f.offset >= f.bufStart+int64(len(f.buf)) {
+		length := f.size - f.offset
+		if length > fileFetchChunkSize {
+			length = fileFetchChunkSize
+		}
+		chunk, err := f.fetch(f.offset, length)
+		if err != nil {
+			return 0, err
+		}
+		if chunk.Size != f.size || !chunk.ModTime.Equal(f.modTime) || len(chunk.Data) == 0 {
+			return 0, fmt.Errorf("file changed during transfer")
+		}
+		f.buf, f.bufStart = chunk.Data, f.offset
+		if f.onChunk != nil {
+			f.onChunk()
+		}
+	}
+	n := copy(p, f.buf[f.offset-f.bufStart:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *nodeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
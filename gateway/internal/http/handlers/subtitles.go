@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+
+	"magnetm3u8-gateway/internal/cluster"
+)
+
+// normalizeSrts 把协议版本23之前的节点上报的字幕路径列表转换为与新版节点相同的
+// {path, format}对象，客户端只需处理一种格式。旧版节点没有保存语言与流序号
+func (gc *GatewayController) normalizeSrts(nodeID, msgType string, task map[string]interface{}) {
+	if node, exists := gc.gateway.GetNode(nodeID); exists && cluster.SupportsField(node.ProtocolVersion, msgType, "srts") {
+		return
+	}
+	srts, ok := task["srts"].([]interface{})
+	if !ok {
+		return
+	}
+	for i, entry := range srts {
+		if subtitlePath, ok := entry.(string); ok {
+			srts[i] = map[string]interface{}{
+				"path":   subtitlePath,
+				"format": strings.TrimPrefix(path.Ext(subtitlePath), "."),
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetTaskAccess 向任务所在节点查询切片访问统计（观看会话数、已发送切片数和字节数），
+// 统计从节点启动时开始累计（仅限任务所有者或管理员）
+func (gc *GatewayController) GetTaskAccess(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return
+	}
+
+	taskID := c.Param("id")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return
+	}
+
+	if account.Role != user.RoleAdmin && !record.IsOwnedBy(account.ID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "无权查看该任务的访问统计",
+		})
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "get_task_access", map[string]interface{}{
+		"task_id": taskID,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+	if found, _ := response["found"].(bool); !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id":   taskID,
+			"worker_id": record.WorkerID,
+			"access":    response["access"],
+		},
+	})
+}
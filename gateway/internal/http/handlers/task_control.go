@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/user"
+)
+
+// PauseTask 暂停排队或下载中的任务（仅限任务所有者或管理员）
+func (gc *GatewayController) PauseTask(c *gin.Context) {
+	gc.controlTask(c, "task_pause")
+}
+
+// ResumeTask 恢复暂停的任务（仅限任务所有者或管理员），下载名额用完时任务在节点上排队
+func (gc *GatewayController) ResumeTask(c *gin.Context) {
+	gc.controlTask(c, "task_resume")
+}
+
+// RemoveTask 删除任务（仅限任务所有者或管理员），节点默认一并删除下载的文件与转码输出，
+// purge_files=false时保留文件。转码中的任务不能删除
+func (gc *GatewayController) RemoveTask(c *gin.Context) {
+	purgeFiles := true
+	if value := c.Query("purge_files"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "purge_files must be true or false",
+			})
+			return
+		}
+		purgeFiles = parsed
+	}
+
+	record, ok := gc.ownedTask(c)
+	if !ok {
+		return
+	}
+	// 旧节点忽略purge_files，总是删除文件
+	if node, ok := gc.gateway.GetNode(record.WorkerID); ok && !purgeFiles && !cluster.SupportsField(node.ProtocolVersion, "task_remove", "purge_files") {
+		gc.respondNodeRequestError(c, record.WorkerID, errNodeUnsupported)
+		return
+	}
+	if !gc.controlOwnedTask(c, record, "task_remove", map[string]interface{}{"purge_files": purgeFiles}) {
+		return
+	}
+	gc.removeTaskRecord(record.WorkerID, map[string]interface{}{
+		"task_id": record.TaskID,
+		"reason":  "removed_by_user",
+	})
+}
+
+// SelectTaskFiles 修改多文件种子中要下载的文件（仅限任务所有者或管理员），节点立即按新的选择
+// 调整正在下载的文件，取消选择的文件不再下载，进度只按选中的文件计算。下载完成后不能再修改
+func (gc *GatewayController) SelectTaskFiles(c *gin.Context) {
+	var req SelectFilesRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.SelectedFiles) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "selected_files must list at least one file",
+		})
+		return
+	}
+
+	record, ok := gc.ownedTask(c)
+	if !ok {
+		return
+	}
+
+	response, err := gc.requestFromNode(record.WorkerID, "select_files", map[string]interface{}{
+		"task_id":        record.TaskID,
+		"selected_files": req.SelectedFiles,
+	}, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return
+	}
+
+	if notFound, _ := response["not_found"].(bool); notFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id": record.TaskID,
+			"size":    response["size"],
+			"files":   response["files"],
+		},
+	})
+}
+
+// ownedTask 读取路径中的任务记录，只有任务所有者或管理员可以继续操作；失败时已写入响应
+func (gc *GatewayController) ownedTask(c *gin.Context) (*task.Record, bool) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "需要登录后才能操作",
+		})
+		return nil, false
+	}
+
+	if gc.tasks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"error":   "Task registry unavailable",
+		})
+		return nil, false
+	}
+
+	taskID := c.Param("id")
+	record, err := gc.tasks.Get(c.Request.Context(), taskID)
+	if errors.Is(err, task.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s from registry: %v", taskID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to load task",
+		})
+		return nil, false
+	}
+
+	if account.Role != user.RoleAdmin && !record.IsOwnedBy(account.ID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "无权修改该任务",
+		})
+		return nil, false
+	}
+
+	return record, true
+}
+
+// controlTask 检查任务权限后将暂停/恢复请求转发给任务所在节点
+func (gc *GatewayController) controlTask(c *gin.Context, msgType string) {
+	if record, ok := gc.ownedTask(c); ok {
+		gc.controlOwnedTask(c, record, msgType, nil)
+	}
+}
+
+// controlOwnedTask 将暂停/恢复/删除请求连同fields转发给任务所在节点，并按节点的确认回复操作后的状态，
+// 失败时返回false
+func (gc *GatewayController) controlOwnedTask(c *gin.Context, record *task.Record, msgType string, fields map[string]interface{}) bool {
+	taskID := record.TaskID
+
+	payload := map[string]interface{}{
+		"task_id": taskID,
+	}
+	for key, value := range fields {
+		payload[key] = value
+	}
+	response, err := gc.requestFromNode(record.WorkerID, msgType, payload, 10*time.Second)
+	if err != nil {
+		gc.respondNodeRequestError(c, record.WorkerID, err)
+		return false
+	}
+
+	if notFound, _ := response["not_found"].(bool); notFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Task not found on worker",
+		})
+		return false
+	}
+	if success, _ := response["success"].(bool); !success {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   response["error"],
+		})
+		return false
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"task_id": taskID,
+			"status":  response["status"],
+		},
+	})
+	return true
+}
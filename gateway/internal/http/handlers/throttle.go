@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// NodeRequestLimits 网关发往单个节点的请求限速
+type NodeRequestLimits struct {
+	PerSecond int           // 每个节点每秒的请求数，0表示不限速
+	Burst     int           // 允许的突发请求数
+	MaxDelay  time.Duration // 排队超过该时长的请求不再发送，改用网关缓存的数据应答或返回节点繁忙
+}
+
+// NodeRequestStats 单个节点的请求限速统计
+type NodeRequestStats struct {
+	QueueDepth int   `json:"queue_depth"` // 正在排队等待配额的请求数
+	Coalesced  int64 `json:"coalesced"`   // 与进行中的相同请求合并、未单独发送的请求数
+	Throttled  int64 `json:"throttled"`   // 因等待过久而未发送的请求数
+}
+
+// nodeThrottle 按节点限制网关主动发出的请求（任务列表、详情、日志等），
+// 避免仪表盘轮询压垮树莓派之类的小节点。WebRTC信令不经过这里。
+type nodeThrottle struct {
+	limits NodeRequestLimits
+
+	mu    sync.Mutex
+	nodes map[string]*nodeThrottleState
+}
+
+type nodeThrottleState struct {
+	limiter *rate.Limiter
+	stats   NodeRequestStats
+}
+
+func newNodeThrottle(limits NodeRequestLimits) *nodeThrottle {
+	if limits.Burst <= 0 {
+		limits.Burst = 1
+	}
+	return &nodeThrottle{
+		limits: limits,
+		nodes:  make(map[string]*nodeThrottleState),
+	}
+}
+
+func (t *nodeThrottle) state(nodeID string) *nodeThrottleState {
+	state, ok := t.nodes[nodeID]
+	if !ok {
+		limit := rate.Inf
+		if t.limits.PerSecond > 0 {
+			limit = rate.Limit(t.limits.PerSecond)
+		}
+		state = &nodeThrottleState{limiter: rate.NewLimiter(limit, t.limits.Burst)}
+		t.nodes[nodeID] = state
+	}
+	return state
+}
+
+// reserve 为发往节点的一个请求预留配额，返回发送前需要等待的时长。
+// 需要等待超过MaxDelay时不占用配额并返回false。
+func (t *nodeThrottle) reserve(nodeID string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.state(nodeID)
+	reservation := state.limiter.Reserve()
+	delay := reservation.Delay()
+	if !reservation.OK() || delay > t.limits.MaxDelay {
+		reservation.Cancel()
+		state.stats.Throttled++
+		return 0, false
+	}
+	return delay, true
+}
+
+// wait 等待发往节点的一个请求的配额，需要等待过久时返回false
+func (t *nodeThrottle) wait(nodeID string) bool {
+	delay, ok := t.reserve(nodeID)
+	if !ok {
+		return false
+	}
+	t.sleep(delay, nodeID)
+	return true
+}
+
+// sleep 排队等待，期间计入节点的队列深度
+func (t *nodeThrottle) sleep(delay time.Duration, nodeIDs ...string) {
+	if delay <= 0 {
+		return
+	}
+	t.adjustQueue(nodeIDs, 1)
+	time.Sleep(delay)
+	t.adjustQueue(nodeIDs, -1)
+}
+
+func (t *nodeThrottle) adjustQueue(nodeIDs []string, delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, nodeID := range nodeIDs {
+		t.state(nodeID).stats.QueueDepth += delta
+	}
+}
+
+// coalesced 记录发往这些节点的请求与进行中的相同请求合并
+func (t *nodeThrottle) coalesced(nodeIDs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, nodeID := range nodeIDs {
+		t.state(nodeID).stats.Coalesced++
+	}
+}
+
+// forget 节点断开后丢弃其限速状态
+func (t *nodeThrottle) forget(nodeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.nodes, nodeID)
+}
+
+// stats 各节点的请求限速统计
+func (t *nodeThrottle) stats() map[string]NodeRequestStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make(map[string]NodeRequestStats, len(t.nodes))
+	for nodeID, state := range t.nodes {
+		stats[nodeID] = state.stats
+	}
+	return stats
+}
+
+// sharedCall 进行中的可合并请求，相同请求的调用方共享同一个结果
+type sharedCall struct {
+	done   chan struct{}
+	status int
+	body   interface{}
+}
+
+// shareCall 合并相同key的并发请求：只有第一个调用方执行fn，其余调用方等待并复用其结果。
+// 返回的shared表示结果来自其它调用方。
+func (gc *GatewayController) shareCall(key string, fn func() (int, interface{})) (int, interface{}, bool) {
+	gc.sharedMu.Lock()
+	if call, ok := gc.sharedCalls[key]; ok {
+		gc.sharedMu.Unlock()
+		<-call.done
+		return call.status, call.body, true
+	}
+	call := &sharedCall{done: make(chan struct{})}
+	gc.sharedCalls[key] = call
+	gc.sharedMu.Unlock()
+
+	call.status, call.body = fn()
+
+	gc.sharedMu.Lock()
+	delete(gc.sharedCalls, key)
+	gc.sharedMu.Unlock()
+	close(call.done)
+
+	return call.status, call.body, false
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/policy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// torrentInfoTimeout 等待节点获取种子元数据的时长，比节点自身的2分钟上限略长
+const torrentInfoTimeout = 2*time.Minute + 15*time.Second
+
+// PreviewTask 让节点只获取种子的元数据并返回文件列表，不创建任务、不下载数据。
+// 用户据此选择文件后，带selected_files和返回的worker_id提交任务，节点可直接使用缓存的元数据
+func (gc *GatewayController) PreviewTask(c *gin.Context) {
+	account, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "请先登录后再预览任务",
+		})
+		return
+	}
+	if !account.CanSubmit() {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "该访客账号不能提交任务",
+			"code":    "submit_disabled",
+		})
+		return
+	}
+
+	var request PreviewTaskRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.MagnetURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid request format",
+		})
+		return
+	}
+
+	infoHash, name := policy.ParseMagnet(request.MagnetURL)
+	if gc.blocklist != nil {
+		if verdict := gc.blocklist.Check(infoHash, name); !verdict.Allowed {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   "Content is not allowed by the blocklist",
+				"code":    "policy_blocked",
+			})
+			return
+		}
+	}
+
+	if request.WorkerID == "" {
+		selected, err := gc.gateway.SelectWorker(submitCapabilities)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"success": false,
+				"error":   "No worker node available",
+			})
+			return
+		}
+		request.WorkerID = selected.ID
+	}
+	if node, exists := gc.gateway.GetNode(request.WorkerID); !exists || node.Status != "online" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Worker node not available",
+		})
+		return
+	}
+
+	// 等待时间超过服务器的写超时，为本次响应单独延长
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(torrentInfoTimeout + 5*time.Second))
+
+	response, err := gc.requestFromNode(request.WorkerID, "get_torrent_info", map[string]interface{}{
+		"magnet_url": request.MagnetURL,
+	}, torrentInfoTimeout)
+	if err != nil {
+		gc.respondNodeRequestError(c, request.WorkerID, err)
+		return
+	}
+	if success, _ := response["success"].(bool); !success {
+		status := http.StatusBadRequest
+		if response["error_code"] == "metadata_timeout" {
+			status = http.StatusGatewayTimeout
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   response["error"],
+			"code":    response["error_code"],
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"worker_id": request.WorkerID,
+			"info_hash": response["info_hash"],
+			"name":      response["name"],
+			"size":      response["size"],
+			"private":   response["private"],
+			"files":     response["files"],
+		},
+	})
+}
@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
@@ -11,12 +13,29 @@ import (
 
 const contextUserKey = "currentUser"
 
+// CodeGuestExpired is the error code returned to expired guest accounts.
+const CodeGuestExpired = "guest_expired"
+
 // Session attaches the authenticated user to the Gin context via cookie lookup.
+// Sessions of expired guests are cleared; API requests carrying one are rejected
+// with CodeGuestExpired so the UI can tell the guest why they were logged out.
 func Session(authService *auth.Service, cookieName string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token, err := c.Cookie(cookieName)
 		if err == nil && token != "" {
-			if account, fetchErr := authService.UserFromToken(c.Request.Context(), token); fetchErr == nil && account != nil {
+			account, fetchErr := authService.UserFromToken(c.Request.Context(), token)
+			switch {
+			case errors.Is(fetchErr, auth.ErrGuestExpired):
+				http.SetCookie(c.Writer, &http.Cookie{Name: cookieName, Value: "", Path: "/", HttpOnly: true, MaxAge: -1})
+				if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+						"success": false,
+						"error":   fetchErr.Error(),
+						"code":    CodeGuestExpired,
+					})
+					return
+				}
+			case fetchErr == nil && account != nil:
 				c.Set(contextUserKey, account)
 			}
 		}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitEvictInterval is how often Run drops the counters of idle clients.
+const RateLimitEvictInterval = 5 * time.Minute
+
+// RateLimiter limits requests per client IP with a sliding-window counter: the
+// count of the previous fixed window is weighted by how much of it still
+// overlaps the sliding window, and added to the count of the current one.
+type RateLimiter struct {
+	limit   int
+	window  time.Duration
+	clients sync.Map // client IP -> *clientWindow
+	now     func() time.Time
+}
+
+// clientWindow holds the counters of one client IP.
+type clientWindow struct {
+	mu       sync.Mutex
+	start    time.Time // start of the current fixed window
+	current  int
+	previous int
+}
+
+// NewRateLimiter allows limit requests per window and client IP. A limit or
+// window of zero disables limiting.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, now: time.Now}
+}
+
+// Middleware answers 429 with a Retry-After header once the client IP has used
+// up its requests, before the handler runs.
+func (l *RateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowed, retryAfter := l.Allow(c.ClientIP()); !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"success": false,
+				"error":   "Too many submissions, try again later",
+				"code":    "rate_limited",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Allow counts a request from ip. When the limit is reached it returns false
+// and how long the client has to wait, at least one second.
+func (l *RateLimiter) Allow(ip string) (bool, time.Duration) {
+	if l.limit <= 0 || l.window <= 0 {
+		return true, 0
+	}
+
+	now := l.now()
+	value, _ := l.clients.LoadOrStore(ip, &clientWindow{start: now})
+	client := value.(*clientWindow)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.advance(now, l.window)
+	if client.estimate(now, l.window)+1 <= float64(l.limit) {
+		client.current++
+		return true, 0
+	}
+	return false, client.retryAfter(now, l.window, l.limit)
+}
+
+// Run evicts the counters of clients idle for two windows every interval,
+// until ctx is done.
+func (l *RateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.evict()
+		}
+	}
+}
+
+// evict drops clients whose counters no longer affect any decision.
+func (l *RateLimiter) evict() {
+	now := l.now()
+	l.clients.Range(func(key, value interface{}) bool {
+		client := value.(*clientWindow)
+		client.mu.Lock()
+		stale := now.Sub(client.start) >= 2*l.window
+		client.mu.Unlock()
+		if stale {
+			l.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+// advance moves the fixed window forward to the one containing now.
+func (w *clientWindow) advance(now time.Time, window time.Duration) {
+	elapsed := now.Sub(w.start)
+	if elapsed < window {
+		return
+	}
+	if elapsed < 2*window {
+		w.previous = w.current
+	} else {
+		w.previous = 0
+	}
+	w.current = 0
+	w.start = w.start.Add(elapsed / window * window)
+}
+
+// estimate is the number of requests in the sliding window ending at now.
+func (w *clientWindow) estimate(now time.Time, window time.Duration) float64 {
+	overlap := 1 - float64(now.Sub(w.start))/float64(window)
+	return float64(w.previous)*overlap + float64(w.current)
+}
+
+// retryAfter is how long until estimate leaves room for one more request.
+func (w *clientWindow) retryAfter(now time.Time, window time.Duration, limit int) time.Duration {
+	free := limit - 1
+	var wait time.Duration
+	if w.current <= free && w.previous > 0 {
+		// The previous window's share shrinks enough within the current window.
+		slide := window * time.Duration(w.previous-free+w.current) / time.Duration(w.previous)
+		wait = w.start.Add(slide).Sub(now)
+	} else {
+		// The current window becomes the previous one and has to shrink in turn.
+		slide := window * time.Duration(w.current-free) / time.Duration(w.current)
+		wait = w.start.Add(window + slide).Sub(now)
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeClock lets tests move the limiter's time.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestLimiter(limit int, window time.Duration) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	limiter := NewRateLimiter(limit, window)
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+func TestRateLimiterSlidingWindowBoundary(t *testing.T) {
+	limiter, clock := newTestLimiter(10, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("10.0.0.1")
+	if ok || retryAfter != time.Minute+6*time.Second {
+		// The full window's 10 requests only leave room once the next window
+		// has moved a tenth of the way past them.
+		t.Fatalf("expected the 11th request to wait 66s, got %v %v", ok, retryAfter)
+	}
+	if ok, _ := limiter.Allow("10.0.0.2"); !ok {
+		t.Fatal("another client IP has its own limit")
+	}
+
+	// Just past the fixed window boundary the previous window still counts fully.
+	clock.Advance(time.Minute)
+	if ok, _ := limiter.Allow("10.0.0.1"); ok {
+		t.Fatal("requests right after the boundary should still be limited")
+	}
+	// Half way through, half of the previous window's requests have slid out.
+	clock.Advance(30 * time.Second)
+	for i := 0; i < 5; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+			t.Fatalf("request %d half way through the window should be allowed", i+1)
+		}
+	}
+	if ok, retryAfter := limiter.Allow("10.0.0.1"); ok || retryAfter != 6*time.Second {
+		t.Fatalf("expected a 6s wait once the slid-out share is used, got %v %v", ok, retryAfter)
+	}
+
+	// Two idle windows later nothing counts any more.
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+			t.Fatalf("request %d after idling should be allowed", i+1)
+		}
+	}
+}
+
+func TestRateLimiterConcurrentRequestsFromOneIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter, _ := newTestLimiter(10, time.Minute)
+	var handled int32
+	router := gin.New()
+	router.POST("/api/tasks/submit", limiter.Middleware(), func(c *gin.Context) {
+		atomic.AddInt32(&handled, 1)
+		c.Status(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	var limited int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/tasks/submit", nil)
+			req.RemoteAddr = "192.0.2.7:40000"
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code == http.StatusTooManyRequests {
+				atomic.AddInt32(&limited, 1)
+				if rec.Header().Get("Retry-After") != "66" {
+					t.Errorf("expected Retry-After: 66, got %q", rec.Header().Get("Retry-After"))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if handled != 10 || limited != 40 {
+		t.Fatalf("expected 10 handled and 40 limited, got %d and %d", handled, limited)
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	limiter, clock := newTestLimiter(10, time.Minute)
+	limiter.Allow("10.0.0.1")
+	clock.Advance(90 * time.Second)
+	limiter.Allow("10.0.0.2")
+
+	count := func() int {
+		n := 0
+		limiter.clients.Range(func(_, _ interface{}) bool { n++; return true })
+		return n
+	}
+
+	limiter.evict()
+	if count() != 2 {
+		t.Fatalf("clients within two windows must be kept, got %d", count())
+	}
+	clock.Advance(45 * time.Second)
+	limiter.evict()
+	if _, ok := limiter.clients.Load("10.0.0.1"); ok || count() != 1 {
+		t.Fatalf("expected only the idle client to be evicted, got %d left", count())
+	}
+
+	// The eviction loop runs on its own until stopped.
+	clock.Advance(time.Hour)
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		limiter.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not evict the idle client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
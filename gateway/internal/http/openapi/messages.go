@@ -0,0 +1,451 @@
+package openapi
+
+import (
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/policy"
+)
+
+// WebSocketProtocol lists the messages exchanged on a WebSocket endpoint.
+// Every frame after the handshake is a WebSocketMessage envelope.
+type WebSocketProtocol struct {
+	Inbound  []MessageDoc // sent by the peer to the gateway
+	Outbound []MessageDoc // sent by the gateway to the peer
+}
+
+// MessageDoc documents one message type and its payload.
+type MessageDoc struct {
+	Type        string
+	Description string
+	Payload     interface{}
+}
+
+// WebSocketMessage is the envelope of every WebSocket frame.
+type WebSocketMessage struct {
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// RegistrationAck answers a worker registration.
+type RegistrationAck struct {
+	NodeID             string `json:"node_id"`
+	Status             string `json:"status,omitempty" desc:"registered on success"`
+	ProtocolVersion    int    `json:"protocol_version" desc:"Negotiated version on success, the gateway's version on rejection"`
+	MinProtocolVersion int    `json:"min_protocol_version,omitempty"`
+	Reason             string `json:"reason,omitempty" desc:"Why the worker was rejected"`
+	GatewayClockMs     int64  `json:"gateway_clock_ms,omitempty" desc:"Gateway clock in Unix milliseconds when the confirmation was sent; workers on protocol 17 echo it in clock_sync"`
+}
+
+// ConnectionRejected refuses a connection that is otherwise valid.
+type ConnectionRejected struct {
+	NodeID string `json:"node_id"`
+	Reason string `json:"reason" desc:"already_connected while another live connection of the same node ID is open"`
+}
+
+// Heartbeat keeps a worker online and carries its latest metrics.
+type Heartbeat struct {
+	ClockMs int64                  `json:"clock_ms" desc:"Worker clock in Unix milliseconds, for the clock skew estimate"`
+	Metrics map[string]interface{} `json:"metrics" desc:"e.g. active_downloads, active_transcodes, torrent_listen_port, ready, readiness_issues, disk_available_bytes, disk_required_bytes"`
+}
+
+// ClockSync answers the gateway clock in registration_confirmed; the round
+// trip and the worker clock give the worker's clock skew.
+type ClockSync struct {
+	GatewayClockMs int64 `json:"gateway_clock_ms" desc:"Echo of registration_confirmed's gateway_clock_ms"`
+	ClockMs        int64 `json:"clock_ms" desc:"Worker clock in Unix milliseconds when the answer was sent"`
+}
+
+// NodeRequest is a gateway request answered by a message with the same request_id.
+type NodeRequest struct {
+	RequestID string `json:"request_id"`
+	Timestamp string `json:"timestamp"`
+	TaskID    string `json:"task_id,omitempty"`
+	Status    string `json:"status,omitempty"` // get_tasks: only tasks in this status
+}
+
+// NodeResponse answers a NodeRequest; the remaining fields depend on the request.
+type NodeResponse struct {
+	RequestID string `json:"request_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TaskSubmit asks a worker to start downloading a magnet.
+type TaskSubmit struct {
+	RequestID        string   `json:"request_id,omitempty" desc:"Absent for workers older than protocol 3, which do not answer"`
+	MagnetURL        string   `json:"magnet_url"`
+	OwnerID          int64    `json:"owner_id"`
+	TraceID          string   `json:"trace_id"`
+	BurnSubtitles    bool     `json:"burn_subtitles,omitempty"`
+	SubtitleLanguage string   `json:"subtitle_language,omitempty"`
+	AllowPrivate     bool     `json:"allow_private,omitempty"`
+	SelectedFiles    []string `json:"selected_files,omitempty"`
+	Priority         int      `json:"priority,omitempty" desc:"1 to 10, 5 when absent"`
+	HLSQuality       string   `json:"hls_quality,omitempty" desc:"multi for a multi-bitrate ladder; a single stream when absent"`
+	Timestamp        string   `json:"timestamp"`
+}
+
+// TaskStatus reports a task's state change.
+type TaskStatus struct {
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"`
+	OwnerID  *int64 `json:"owner_id,omitempty"`
+	InfoHash string `json:"info_hash,omitempty"`
+	TraceID  string `json:"trace_id,omitempty"`
+	// Failed tasks carry the error classification and reason.
+	ErrorCode string `json:"error_code,omitempty" desc:"Failure class: magnet_invalid, metadata_timeout, insufficient_disk, torrent_rejected, policy_blocked, transcode_failed or internal"`
+	Error     string `json:"error,omitempty"`
+	Retryable *bool  `json:"retryable,omitempty" desc:"Whether the worker retries the failed task automatically"`
+}
+
+// TaskCompleted carries the summary of a finished task.
+type TaskCompleted struct {
+	TaskID  string                 `json:"task_id"`
+	Status  string                 `json:"status"`
+	Summary map[string]interface{} `json:"summary"`
+}
+
+// TaskRemoved reports a task deleted by the worker's retention policy.
+type TaskRemoved struct {
+	TaskID string `json:"task_id"`
+	Reason string `json:"reason"`
+}
+
+// TaskTraffic reports cumulative traffic per task.
+type TaskTraffic struct {
+	Tasks []TaskTrafficEntry `json:"tasks"`
+}
+
+// TaskTrafficEntry is the traffic of one task.
+type TaskTrafficEntry struct {
+	TaskID          string `json:"task_id"`
+	BytesDownloaded int64  `json:"bytes_downloaded"`
+	BytesServed     int64  `json:"bytes_served"`
+}
+
+// TaskPolicyCheck asks the gateway to check a task against the blocklist once
+// its metadata is known.
+type TaskPolicyCheck struct {
+	TaskID   string `json:"task_id"`
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+}
+
+// TaskPolicyVerdict answers a TaskPolicyCheck.
+type TaskPolicyVerdict struct {
+	TaskID string `json:"task_id"`
+	policy.Verdict
+	Timestamp string `json:"timestamp"`
+}
+
+// TasksResponse answers get_tasks.
+type TasksResponse struct {
+	RequestID string                   `json:"request_id"`
+	Tasks     []map[string]interface{} `json:"tasks"`
+}
+
+// WebRTCOffer starts a WebRTC session with a worker.
+type WebRTCOffer struct {
+	SessionID string `json:"session_id"`
+	ClientID  string `json:"client_id"`
+	WorkerID  string `json:"worker_id,omitempty" desc:"Required over the client WebSocket; over HTTP the task's worker or a scheduled one when empty. Stripped before forwarding"`
+	TaskID    string `json:"task_id,omitempty" desc:"Task being played, used for failover"`
+	SDP       string `json:"sdp"`
+}
+
+// WebRTCAnswer is the worker's answer to an offer.
+type WebRTCAnswer struct {
+	SessionID string `json:"session_id"`
+	SDP       string `json:"sdp"`
+}
+
+// WebRTCOfferFailed reports an offer the worker could not answer or that
+// gathered no ICE candidates.
+type WebRTCOfferFailed struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason" desc:"e.g. no ICE candidates gathered"`
+}
+
+// ICECandidate is a trickled ICE candidate for a session.
+type ICECandidate struct {
+	SessionID string `json:"session_id"`
+	Candidate string `json:"candidate"`
+}
+
+// ICEResend asks a worker to re-send the local ICE candidates of a session.
+type ICEResend struct {
+	RequestID string `json:"request_id,omitempty" desc:"Set on requests to workers, absent from clients"`
+	SessionID string `json:"session_id"`
+}
+
+// GetSessionStats asks the worker holding a session for its transport statistics.
+type GetSessionStats struct {
+	RequestID string `json:"request_id"`
+	SessionID string `json:"session_id"`
+}
+
+// ICEResendResponse answers ice_resend once the candidates were re-sent.
+type ICEResendResponse struct {
+	RequestID      string `json:"request_id,omitempty" desc:"Echoed by workers, absent on answers to clients"`
+	SessionID      string `json:"session_id"`
+	WorkerID       string `json:"worker_id,omitempty"`
+	Success        bool   `json:"success"`
+	Error          string `json:"error,omitempty"`
+	Candidates     int    `json:"candidates"`
+	GatheringState string `json:"gathering_state" desc:"new, gathering or complete"`
+}
+
+// FileFetch asks a worker for a byte range of a task output file.
+type FileFetch struct {
+	RequestID string `json:"request_id"`
+	TaskID    string `json:"task_id"`
+	Name      string `json:"name" desc:"File name inside the task's HLS directory"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length" desc:"At most 1 MiB is returned; 0 only reports size and mod_time"`
+	// StreamToken is set for reads through /api/tasks/:id/stream/ (protocol 21).
+	StreamToken string `json:"stream_token,omitempty" desc:"Checked against the task's stream token; a mismatch is answered with forbidden"`
+}
+
+// FileFetchResponse answers file_fetch.
+type FileFetchResponse struct {
+	RequestID string `json:"request_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	NotFound  bool   `json:"not_found,omitempty"`
+	Forbidden bool   `json:"forbidden,omitempty" desc:"stream_token did not match"`
+	Size      int64  `json:"size"`
+	ModTime   string `json:"mod_time"`
+	Offset    int64  `json:"offset"`
+	Data      []byte `json:"data" desc:"Base64-encoded bytes"`
+}
+
+// SetPriority changes a task's download priority on its worker.
+type SetPriority struct {
+	RequestID string `json:"request_id"`
+	TaskID    string `json:"task_id"`
+	Priority  int    `json:"priority"`
+}
+
+// SetRateLimit changes a worker's torrent rate limits.
+type SetRateLimit struct {
+	RequestID string `json:"request_id"`
+	DownKbps  *int   `json:"down_kbps,omitempty" desc:"0 for unlimited; left out restores network.max_bandwidth_kbps"`
+	UpKbps    *int   `json:"up_kbps,omitempty" desc:"0 for unlimited; left out restores network.max_bandwidth_kbps"`
+}
+
+// SelectFiles changes the files a task downloads on its worker.
+type SelectFiles struct {
+	RequestID     string   `json:"request_id"`
+	TaskID        string   `json:"task_id"`
+	SelectedFiles []string `json:"selected_files" desc:"file_path or file_name of each file to download"`
+}
+
+// SelectFilesResponse answers select_files.
+type SelectFilesResponse struct {
+	RequestID string        `json:"request_id"`
+	TaskID    string        `json:"task_id"`
+	Success   bool          `json:"success"`
+	Error     string        `json:"error,omitempty"`
+	NotFound  bool          `json:"not_found,omitempty"`
+	Size      int64         `json:"size,omitempty" desc:"Total size of the selected files"`
+	Files     []TorrentFile `json:"files,omitempty" desc:"Empty until the torrent's metadata arrives"`
+}
+
+// StreamTokenResponse answers get_stream_token.
+type StreamTokenResponse struct {
+	RequestID string `json:"request_id"`
+	TaskID    string `json:"task_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	NotFound  bool   `json:"not_found,omitempty"`
+	Token     string `json:"token,omitempty" desc:"Generated when the task is created, or on the first request for older tasks"`
+}
+
+// ProbeResultMessage reports a finished speed probe.
+type ProbeResultMessage struct {
+	SessionID      string  `json:"session_id"`
+	WorkerID       string  `json:"worker_id,omitempty" desc:"Set on messages to clients"`
+	Bytes          int64   `json:"bytes"`
+	DurationMs     int64   `json:"duration_ms"`
+	ThroughputKbps float64 `json:"throughput_kbps"`
+	RTTMs          float64 `json:"rtt_ms"`
+}
+
+// GetTorrentInfo asks a worker to fetch a torrent's metadata without downloading it.
+type GetTorrentInfo struct {
+	RequestID string `json:"request_id"`
+	Timestamp string `json:"timestamp"`
+	MagnetURL string `json:"magnet_url"`
+}
+
+// TorrentFile is one file of a torrent as listed by a worker.
+type TorrentFile struct {
+	FileName   string `json:"file_name" desc:"Display path, including the torrent name for multi-file torrents"`
+	FileSize   int64  `json:"file_size"`
+	FilePath   string `json:"file_path" desc:"Path to pass in selected_files"`
+	IsSelected bool   `json:"is_selected"`
+}
+
+// TorrentInfoResponse answers get_torrent_info.
+type TorrentInfoResponse struct {
+	RequestID string        `json:"request_id"`
+	Success   bool          `json:"success"`
+	Error     string        `json:"error,omitempty"`
+	ErrorCode string        `json:"error_code,omitempty" desc:"magnet_invalid, metadata_timeout or torrent_rejected"`
+	InfoHash  string        `json:"info_hash,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Size      int64         `json:"size,omitempty"`
+	Private   bool          `json:"private,omitempty"`
+	Files     []TorrentFile `json:"files,omitempty"`
+}
+
+// RepairSegment asks a worker to verify and, when corrupted or forced, regenerate one segment.
+type RepairSegment struct {
+	RequestID string `json:"request_id"`
+	TaskID    string `json:"task_id"`
+	Name      string `json:"name"`
+	Force     bool   `json:"force"`
+}
+
+// CloseSession tells a worker to release a session whose client went away.
+type CloseSession struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason"`
+	Timestamp string `json:"timestamp"`
+}
+
+// SessionMigrate tells a client to reconnect to another worker holding the same task.
+type SessionMigrate struct {
+	SessionID   string `json:"session_id"`
+	TaskID      string `json:"task_id"`
+	OldWorkerID string `json:"old_worker_id"`
+	NewWorkerID string `json:"new_worker_id"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// nodeProtocol is spoken on /ws/nodes. The first frame from the worker is
+// its registration, a bare WorkerNode rather than an envelope.
+var nodeProtocol = &WebSocketProtocol{
+	Inbound: []MessageDoc{
+		{"registration", "First frame: the worker's identity, resources and protocol range, plus clock_ms with its clock in Unix milliseconds (not wrapped in an envelope)", cluster.WorkerNode{}},
+		{"heartbeat", "Sent periodically; workers missing heartbeats go offline", Heartbeat{}},
+		{"clock_sync", "Answer to registration_confirmed's gateway_clock_ms, for measuring clock skew (protocol 17)", ClockSync{}},
+		{"task_status", "A task changed state", TaskStatus{}},
+		{"task_completed", "A task finished, with its summary", TaskCompleted{}},
+		{"task_removed", "A task was deleted by the retention policy", TaskRemoved{}},
+		{"task_traffic", "Cumulative traffic per task", TaskTraffic{}},
+		{"task_policy_check", "Metadata is known, check it against the blocklist", TaskPolicyCheck{}},
+		{"tasks_response", "Answer to get_tasks", TasksResponse{}},
+		{"task_submit_response", "Answer to task_submit, with task_id, duplicate and trace_id; success false with duplicate and code duplicate_task when the magnet already has a task", NodeResponse{}},
+		{"task_detail_response", "Answer to get_task_detail", NodeResponse{}},
+		{"task_log_response", "Answer to get_task_log", NodeResponse{}},
+		{"task_pieces_response", "Answer to get_task_pieces", NodeResponse{}},
+		{"task_pin_response", "Answer to task_pin", NodeResponse{}},
+		{"task_retry_response", "Answer to task_retry", NodeResponse{}},
+		{"prune_task_data_response", "Answer to prune_task_data", NodeResponse{}},
+		{"local_media_list", "Answer to list_local_media", NodeResponse{}},
+		{"transcode_local_response", "Answer to transcode_local", NodeResponse{}},
+		{"webrtc_answer", "Answer to a client's offer, forwarded to the client", WebRTCAnswer{}},
+		{"webrtc_offer_failed", "The offer cannot connect, forwarded to the client (protocol 15)", WebRTCOfferFailed{}},
+		{"ice_candidate", "Worker ICE candidate, forwarded to the client", ICECandidate{}},
+		{"ice_resend_response", "Answer to ice_resend, sent after the candidates", ICEResendResponse{}},
+		{"file_fetch_response", "Answer to file_fetch", FileFetchResponse{}},
+		{"set_priority_response", "Answer to set_priority", NodeResponse{}},
+		{"boost_task_response", "Answer to boost_task, with found and the transcode queue_position when queued", NodeResponse{}},
+		{"repair_segment_response", "Answer to repair_segment, with status, the segment check and not_found", NodeResponse{}},
+		{"session_stats_response", "Answer to get_session_stats, with found and stats", NodeResponse{}},
+		{"task_pause_response", "Answer to task_pause, with the task's status and not_found", NodeResponse{}},
+		{"task_resume_response", "Answer to task_resume, with the task's status and not_found", NodeResponse{}},
+		{"task_remove_response", "Answer to task_remove, with status removed on success and not_found", NodeResponse{}},
+		{"queues_response", "Answer to get_queues, with the download and transcode queues", NodeResponse{}},
+		{"pause_all_response", "Answer to pause_all, with whether the node is now quiet", NodeResponse{}},
+		{"resume_all_response", "Answer to resume_all, with whether the node is still quiet", NodeResponse{}},
+		{"torrent_info_response", "Answer to get_torrent_info, with the torrent's name, size and files", TorrentInfoResponse{}},
+		{"task_access_response", "Answer to get_task_access, with found and access", NodeResponse{}},
+		{"probe_result", "A speed probe finished; cached and forwarded to the client (protocol 19)", ProbeResultMessage{}},
+		{"select_files_response", "Answer to select_files, with the task's size and files", SelectFilesResponse{}},
+		{"stream_token_response", "Answer to get_stream_token", StreamTokenResponse{}},
+		{"set_rate_limit_response", "Answer to set_rate_limit, with the limits now in effect", NodeResponse{}},
+	},
+	Outbound: []MessageDoc{
+		{"registration_confirmed", "Registration accepted; when the node ID's previous connection missed its ping deadline, it is replaced and closed", RegistrationAck{}},
+		{"registration_rejected", "Protocol versions do not overlap; the connection is closed", RegistrationAck{}},
+		{"connection_rejected", "Sent to any protocol version when the node ID already has a live connection, followed by a 1013 (try again later) close frame; back off and reconnect", ConnectionRejected{}},
+		{"task_submit", "Start a download", TaskSubmit{}},
+		{"get_tasks", "List the worker's tasks", NodeRequest{}},
+		{"get_task_detail", "Details of one task", NodeRequest{}},
+		{"get_task_log", "Tail of a task's log (protocol 2)", NodeRequest{}},
+		{"get_task_pieces", "Piece availability of a task (protocol 2)", NodeRequest{}},
+		{"task_pin", "Pin or unpin a task (protocol 2)", NodeRequest{}},
+		{"prune_task_data", "Delete leftovers of a failed task (protocol 2)", NodeRequest{}},
+		{"list_local_media", "List files in the worker's extra media directories (protocol 2)", NodeRequest{}},
+		{"transcode_local", "Transcode a local file (protocol 2)", NodeRequest{}},
+		{"task_retry", "Retry a failed task (protocol 4)", NodeRequest{}},
+		{"task_policy_verdict", "Answer to task_policy_check", TaskPolicyVerdict{}},
+		{"webrtc_offer", "A client's offer", WebRTCOffer{}},
+		{"ice_candidate", "Client ICE candidate", ICECandidate{}},
+		{"ice_resend", "Re-send the session's gathered candidates as ice_candidate messages (protocol 5)", ICEResend{}},
+		{"file_fetch", "Read a byte range of a task output file (protocol 6); names in rendition sub-directories and stream_token need protocol 21", FileFetch{}},
+		{"set_priority", "Change the priority of a task in the download queue (protocol 7)", SetPriority{}},
+		{"close_session", "Close a session whose client disconnected and did not reconnect (protocol 8)", CloseSession{}},
+		{"boost_task", "Move a task with a waiting viewer ahead of regular transcodes (protocol 9)", NodeRequest{}},
+		{"repair_segment", "Verify a segment and regenerate it from the source file when corrupted (protocol 10)", RepairSegment{}},
+		{"get_session_stats", "Transport statistics of a WebRTC session (protocol 11)", GetSessionStats{}},
+		{"task_pause", "Pause a pending or downloading task (protocol 12)", NodeRequest{}},
+		{"task_resume", "Resume a paused task (protocol 12)", NodeRequest{}},
+		{"task_remove", "Delete a task with its downloaded files and HLS output (protocol 12); purge_files false keeps the files (protocol 22)", NodeRequest{}},
+		{"get_queues", "Contents of the download and transcode queues (protocol 13)", NodeRequest{}},
+		{"pause_all", "Pause downloads and transcodes until resume_all; file serving continues (protocol 14)", NodeRequest{}},
+		{"resume_all", "End quiet mode, including the rest of a scheduled quiet window (protocol 14)", NodeRequest{}},
+		{"get_torrent_info", "Fetch a torrent's metadata and list its files without downloading, within 2 minutes (protocol 16)", GetTorrentInfo{}},
+		{"get_task_access", "Segment access statistics of a task since the worker started (protocol 18)", NodeRequest{}},
+		{"webrtc_probe", "A client's offer for a speed probe session, answered like webrtc_offer or refused with webrtc_offer_failed when the worker's probe limit is reached (protocol 19)", WebRTCOffer{}},
+		{"select_files", "Change the files a download fetches; unselected files stop downloading (protocol 20)", SelectFiles{}},
+		{"get_stream_token", "The stream token of a task, for its owner (protocol 21)", NodeRequest{}},
+		{"set_rate_limit", "Change the torrent download and upload limits of the node in kbps until it restarts (protocol 23)", SetRateLimit{}},
+	},
+}
+
+// clientProtocol is spoken on /ws/clients by players.
+var clientProtocol = &WebSocketProtocol{
+	Inbound: []MessageDoc{
+		{"webrtc_offer", "Start a session with worker_id", WebRTCOffer{}},
+		{"ice_candidate", "Client ICE candidate, forwarded to the session's worker", ICECandidate{}},
+		{"ice_resend", "Ask the session's worker to re-send its ICE candidates", ICEResend{}},
+	},
+	Outbound: []MessageDoc{
+		{"webrtc_answer", "The worker's answer", WebRTCAnswer{}},
+		{"webrtc_offer_failed", "The worker could not answer the offer or gathered no ICE candidates; the session is closed, reason says why", WebRTCOfferFailed{}},
+		{"ice_candidate", "Worker ICE candidate", ICECandidate{}},
+		{"probe_result", "Result of a speed probe started with POST /api/webrtc/probe", ProbeResultMessage{}},
+		{"ice_resend_response", "Answer to ice_resend", ICEResendResponse{}},
+		{"session_migrate", "The worker disconnected; renegotiate with new_worker_id", SessionMigrate{}},
+	},
+}
+
+func (p *WebSocketProtocol) document(comps *components) map[string]interface{} {
+	list := func(docs []MessageDoc) []map[string]interface{} {
+		out := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			out = append(out, map[string]interface{}{
+				"type":        doc.Type,
+				"description": doc.Description,
+				"payload":     comps.ref(doc.Payload),
+			})
+		}
+		return out
+	}
+	return map[string]interface{}{
+		"envelope": comps.ref(WebSocketMessage{}),
+		"inbound":  list(p.Inbound),
+		"outbound": list(p.Outbound),
+	}
+}
+
+// websocketDescription is the documentation section of the websocket tag.
+func websocketDescription() string {
+	return "The gateway speaks JSON over two WebSocket endpoints: /ws/nodes for workers and /ws/clients for players. " +
+		"Every frame is a WebSocketMessage envelope whose payload schema depends on the type. " +
+		"The x-websocket-messages extension of each endpoint lists the inbound and outbound types with references to their payload components " +
+		"(for example #/components/schemas/TaskSubmit and #/components/schemas/SessionMigrate). " +
+		"Requests sent to workers carry a request_id that the worker echoes in its answer."
+}
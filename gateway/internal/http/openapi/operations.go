@@ -0,0 +1,467 @@
+package openapi
+
+import (
+	"net/http"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/config"
+	"magnetm3u8-gateway/internal/http/handlers"
+	"magnetm3u8-gateway/internal/ice"
+	"magnetm3u8-gateway/internal/policy"
+	"magnetm3u8-gateway/internal/task"
+	"magnetm3u8-gateway/internal/timefmt"
+	"magnetm3u8-gateway/internal/user"
+)
+
+// Response payloads carried in the envelope's data field.
+
+// Account is a user as returned by the auth endpoints.
+type Account struct {
+	ID             int64        `json:"id"`
+	Username       string       `json:"username"`
+	Role           string       `json:"role"`
+	IsBanned       bool         `json:"is_banned"`
+	ExpiresAt      timefmt.Time `json:"expires_at"`
+	SubmitDisabled bool         `json:"submit_disabled"`
+	CreatedAt      timefmt.Time `json:"created_at"`
+}
+
+// AdminUser is a user in the admin listing.
+type AdminUser struct {
+	Account
+	Flagged          bool   `json:"flagged_for_review"`
+	RemainingSeconds *int64 `json:"remaining_seconds,omitempty" desc:"Guests only"`
+}
+
+// Task is one entry of the task list as reported by workers or the gateway.
+type Task struct {
+	ID            string        `json:"id"`
+	MagnetURL     string        `json:"magnet_url"`
+	Status        string        `json:"status" desc:"pending, downloading, transcoding, ready, error, permanently_failed, or pending_dispatch while queued at the gateway"`
+	ErrorCode     string        `json:"error_code,omitempty" desc:"Failure class of an error or permanently_failed task; the worker retries only metadata_timeout, transcode_failed and internal automatically"`
+	WorkerID      string        `json:"worker_id"`
+	TorrentName   string        `json:"torrent_name,omitempty"`
+	MediaType     string        `json:"media_type,omitempty" desc:"audio for audio-only tasks, absent for video"`
+	Outputs       []VideoOutput `json:"outputs,omitempty" desc:"Playable videos of a task with several video files, in file path order; absent for single-video tasks"`
+	Progress      float64       `json:"progress"`
+	Speed         int64         `json:"speed"`
+	Peers         int           `json:"peers" desc:"Peers currently sending data, 0 unless downloading"`
+	ETASeconds    int64         `json:"eta_seconds" desc:"Estimated seconds left at the current speed, -1 when the speed is zero, 0 once downloaded"`
+	Private       bool          `json:"private,omitempty"`
+	TraceID       string        `json:"trace_id,omitempty"`
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Cached        bool          `json:"cached,omitempty" desc:"Taken from the gateway registry because the worker was rate limited"`
+	CreatedAt     timefmt.Time  `json:"created_at"`
+	UpdatedAt     timefmt.Time  `json:"updated_at"`
+}
+
+// VideoOutput is one transcoded video of a task with several video files,
+// such as an episode of a season pack.
+type VideoOutput struct {
+	Name     string `json:"name" desc:"File name without extension"`
+	File     string `json:"file" desc:"Path of the source file inside the torrent"`
+	Playlist string `json:"playlist" desc:"/video/<task_id>/videoNN/index.m3u8"`
+}
+
+// TaskList is the merged task list of all online workers.
+type TaskList struct {
+	Tasks       []Task   `json:"tasks"`
+	CachedNodes []string `json:"cached_nodes,omitempty"`
+}
+
+// TorrentPreview lists a torrent's files; submitting to the same worker_id reuses the fetched metadata.
+type TorrentPreview struct {
+	WorkerID string        `json:"worker_id"`
+	InfoHash string        `json:"info_hash"`
+	Name     string        `json:"name"`
+	Size     int64         `json:"size"`
+	Private  bool          `json:"private"`
+	Files    []TorrentFile `json:"files"`
+}
+
+// SubmitTaskResult describes the task created, found or queued by a submission.
+type SubmitTaskResult struct {
+	TaskID        string `json:"task_id"`
+	WorkerID      string `json:"worker_id"`
+	Status        string `json:"status,omitempty"`
+	Duplicate     bool   `json:"duplicate"`
+	QueuePosition int    `json:"queue_position,omitempty" desc:"Set when the submission is queued (202)"`
+	TraceID       string `json:"trace_id"`
+}
+
+// TaskLocation is the worker holding a task.
+type TaskLocation struct {
+	TaskID   string       `json:"task_id"`
+	WorkerID string       `json:"worker_id"`
+	Online   bool         `json:"online"`
+	LastSeen timefmt.Time `json:"last_seen,omitempty"`
+}
+
+// TaskPieces is the run-length encoded piece availability of a task's video.
+type TaskPieces struct {
+	TaskID          string      `json:"task_id"`
+	Pieces          interface{} `json:"pieces"`
+	DurationSeconds float64     `json:"duration_seconds"`
+	SecondsPerPiece float64     `json:"seconds_per_piece"`
+}
+
+// TaskPinned is the pin state after a change.
+type TaskPinned struct {
+	TaskID string `json:"task_id"`
+	Pinned bool   `json:"pinned"`
+}
+
+// TaskState is a task's status after a pause, resume or removal.
+type TaskState struct {
+	TaskID string `json:"task_id"`
+	Status string `json:"status" desc:"paused, pending or downloading after a resume, removed after a removal"`
+}
+
+// TaskPriority is the priority after a change.
+type TaskPriority struct {
+	TaskID   string `json:"task_id"`
+	Priority int    `json:"priority"`
+}
+
+// StreamToken authorizes GET /api/tasks/:id/stream/*path.
+type StreamToken struct {
+	TaskID   string `json:"task_id"`
+	Token    string `json:"token" desc:"Send as Authorization: Bearer <token>"`
+	Playlist string `json:"playlist" desc:"Path of the task's playlist under the stream endpoint"`
+}
+
+// TaskFiles is a task's file selection after a change.
+type TaskFiles struct {
+	TaskID string        `json:"task_id"`
+	Size   int64         `json:"size" desc:"Total size of the selected files; progress counts only these"`
+	Files  []TorrentFile `json:"files" desc:"Empty until the torrent's metadata arrives; the selection is applied when it does"`
+}
+
+// TaskBoost is the answer to a boost.
+type TaskBoost struct {
+	TaskID        string `json:"task_id"`
+	QueuePosition int    `json:"queue_position,omitempty" desc:"Position in the worker's transcode queue after the boost; absent when the transcode is running or has not started"`
+}
+
+// SegmentCheck is the worker's verdict on a segment before any repair.
+type SegmentCheck struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// SegmentRepair is the outcome of a segment repair.
+type SegmentRepair struct {
+	TaskID string       `json:"task_id"`
+	Name   string       `json:"name"`
+	Status string       `json:"status" desc:"healthy (not regenerated), repaired, or needs_retranscode when the source file is gone"`
+	Check  SegmentCheck `json:"check"`
+}
+
+// TaskRef names a task.
+type TaskRef struct {
+	TaskID string `json:"task_id"`
+}
+
+// PruneResult lists the files removed, or that would be removed, for a failed task.
+type PruneResult struct {
+	TaskID         string   `json:"task_id"`
+	DryRun         bool     `json:"dry_run"`
+	Files          []string `json:"files"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// LocalMedia lists files in a worker's extra media directories.
+type LocalMedia struct {
+	NodeID    string                   `json:"node_id"`
+	Roots     []string                 `json:"roots"`
+	Files     []map[string]interface{} `json:"files"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// LocalTranscode is the task created for a local file.
+type LocalTranscode struct {
+	NodeID string `json:"node_id"`
+	TaskID string `json:"task_id"`
+}
+
+// SystemStatus summarises the cluster.
+type SystemStatus struct {
+	OnlineNodes       int                                  `json:"online_nodes"`
+	TotalNodes        int                                  `json:"total_nodes"`
+	ActiveSessions    int                                  `json:"active_sessions"`
+	SessionMigrations cluster.MigrationStats               `json:"session_migrations"`
+	NodeRequests      map[string]handlers.NodeRequestStats `json:"node_requests"`
+	DispatchQueue     handlers.DispatchStats               `json:"dispatch_queue"`
+	WebRTC            cluster.WebRTCStats                  `json:"webrtc" desc:"Aggregated from the workers' heartbeats"`
+	Forwarding        handlers.ForwardStats                `json:"forwarding" desc:"Retried and undeliverable messages to workers and clients"`
+	ClockSkew         cluster.ClockSkewStats               `json:"clock_skew" desc:"Worker clock skew in milliseconds and how many workers exceed CLOCK_SKEW_WARN_SECONDS"`
+}
+
+// DownloadQueueEntry is a task holding or waiting for a download slot.
+type DownloadQueueEntry struct {
+	TaskID   string `json:"task_id"`
+	Priority int    `json:"priority"`
+	Position int    `json:"position,omitempty" desc:"1-based position among the waiting tasks, absent for running tasks"`
+}
+
+// DownloadQueue is a worker's download slots and waiting tasks.
+type DownloadQueue struct {
+	MaxTasks int                  `json:"max_tasks"`
+	Running  []DownloadQueueEntry `json:"running"`
+	Pending  []DownloadQueueEntry `json:"pending" desc:"In the order the tasks will start"`
+}
+
+// TranscodeQueueEntry is a transcode holding or waiting for a transcode slot.
+type TranscodeQueueEntry struct {
+	TranscodeID string `json:"transcode_id"`
+	TaskID      string `json:"task_id,omitempty" desc:"Absent for local media transcodes"`
+	Interactive bool   `json:"interactive,omitempty" desc:"A viewer is waiting; runs ahead of regular transcodes"`
+	Position    int    `json:"position,omitempty" desc:"1-based position among the waiting transcodes, absent for running ones"`
+	Paused      bool   `json:"paused,omitempty" desc:"Paused for an interactive transcode"`
+	Progress    int    `json:"progress"`
+}
+
+// TranscodeQueue is a worker's transcode slots and waiting transcodes.
+type TranscodeQueue struct {
+	MaxTasks int                   `json:"max_tasks"`
+	Running  []TranscodeQueueEntry `json:"running" desc:"In the order they started"`
+	Pending  []TranscodeQueueEntry `json:"pending" desc:"In the order they will start, interactive transcodes first"`
+}
+
+// QueuedTask locates the task named by the task_id query parameter.
+type QueuedTask struct {
+	TaskID   string `json:"task_id"`
+	Queue    string `json:"queue" desc:"transcode or download"`
+	Running  bool   `json:"running"`
+	Position int    `json:"position" desc:"1-based position among the waiting entries, 0 when running"`
+	Depth    int    `json:"depth" desc:"Number of waiting entries in that queue"`
+}
+
+// NodeQueues are the download and transcode queues of a worker.
+type NodeQueues struct {
+	NodeID    string         `json:"node_id"`
+	Download  DownloadQueue  `json:"download"`
+	Transcode TranscodeQueue `json:"transcode"`
+	Task      *QueuedTask    `json:"task,omitempty" desc:"Only with the task_id query parameter"`
+}
+
+// NodeQuiet is a worker's quiet state after pause-all or resume-all.
+type NodeQuiet struct {
+	NodeID string `json:"node_id"`
+	Quiet  bool   `json:"quiet" desc:"Downloads and transcodes are paused; resume-all inside a scheduled window lifts it for the rest of that window"`
+}
+
+// NodeRateLimit is a worker's torrent rate limits after a change.
+type NodeRateLimit struct {
+	NodeID   string `json:"node_id"`
+	DownKbps int    `json:"down_kbps" desc:"0 means unlimited"`
+	UpKbps   int    `json:"up_kbps" desc:"0 means unlimited"`
+}
+
+// ICEServers is the top-level answer of the ICE server endpoint.
+type ICEServers struct {
+	Success    bool            `json:"success"`
+	IceServers []ice.IceServer `json:"iceServers"`
+	TTL        int             `json:"ttl" desc:"Seconds the credentials stay valid"`
+	ExpiresAt  string          `json:"expires_at,omitempty" desc:"When the credentials expire, on the clock of the worker named by node_id when its clock skew is known"`
+	Message    string          `json:"message,omitempty"`
+}
+
+// ICEResendResult reports the candidates a worker re-sent for a session.
+type ICEResendResult struct {
+	SessionID      string `json:"session_id"`
+	WorkerID       string `json:"worker_id"`
+	Candidates     int    `json:"candidates" desc:"Number of candidates forwarded again to the client as ice_candidate messages"`
+	GatheringState string `json:"gathering_state" desc:"Worker ICE gathering state: new, gathering or complete"`
+}
+
+// SessionStats are a WebRTC session's transport statistics as collected by its worker.
+type SessionStats struct {
+	BytesSent     int64        `json:"bytes_sent"`
+	BytesReceived int64        `json:"bytes_received"`
+	RTTMs         float64      `json:"rtt_ms" desc:"Round-trip time of the selected candidate pair"`
+	PacketLoss    float64      `json:"packet_loss" desc:"Fraction of packets lost, 0 to 1; only reported for media streams"`
+	LastUpdated   timefmt.Time `json:"last_updated"`
+}
+
+// SessionStatsResult wraps the statistics of one session.
+type SessionStatsResult struct {
+	SessionID string       `json:"session_id"`
+	WorkerID  string       `json:"worker_id"`
+	Stats     SessionStats `json:"stats"`
+}
+
+// SegmentAccess aggregates the segment requests a worker served for a task.
+type SegmentAccess struct {
+	TaskID       string       `json:"task_id"`
+	Sessions     int          `json:"sessions" desc:"Distinct sessions that requested segments, counting at most 1000"`
+	Segments     int64        `json:"segments" desc:"Segments served"`
+	Bytes        int64        `json:"bytes" desc:"Bytes of the segments served"`
+	LastSegment  string       `json:"last_segment"`
+	LastAccessAt timefmt.Time `json:"last_access_at"`
+}
+
+// TaskAccessResult wraps the segment access statistics of one task.
+type TaskAccessResult struct {
+	TaskID   string        `json:"task_id"`
+	WorkerID string        `json:"worker_id"`
+	Access   SegmentAccess `json:"access" desc:"Counted since the worker started"`
+}
+
+// WebRTCSession identifies the session created for an offer.
+type WebRTCSession struct {
+	Success   bool   `json:"success"`
+	SessionID string `json:"session_id"`
+}
+
+// ProbeResult is the measured speed between a user and a worker.
+type ProbeResult struct {
+	WorkerID       string       `json:"worker_id"`
+	Bytes          int64        `json:"bytes"`
+	DurationMs     int64        `json:"duration_ms" desc:"From the first chunk sent to the client's speedProbeAck"`
+	ThroughputKbps float64      `json:"throughput_kbps"`
+	RTTMs          float64      `json:"rtt_ms"`
+	MeasuredAt     timefmt.Time `json:"measured_at"`
+}
+
+// ProbeStarted answers a probe request with either a cached result or the new session.
+type ProbeStarted struct {
+	Success   bool        `json:"success"`
+	Cached    bool        `json:"cached"`
+	Result    ProbeResult `json:"result,omitempty" desc:"Set when cached"`
+	SessionID string      `json:"session_id,omitempty" desc:"Set when a new probe was started; its result arrives as probe_result"`
+}
+
+var taskNotFound = []int{http.StatusNotFound}
+
+// Operations lists every documented route. A test compares it with the
+// routes registered on the engine, so adding a route means adding it here.
+func Operations() []Operation {
+	return []Operation{
+		// Nodes
+		{Method: "GET", Path: "/api/nodes", Tag: "nodes", Summary: "List online worker nodes", Response: []cluster.WorkerNode{}},
+		{Method: "GET", Path: "/api/nodes/:id", Tag: "nodes", Summary: "Get a worker node", Response: cluster.WorkerNode{}, Errors: []int{http.StatusNotFound}},
+		{Method: "GET", Path: "/api/nodes/:id/queues", Tag: "nodes", Summary: "Download and transcode queues of a worker, and where a task waits in them",
+			Params:   []Param{{Name: "task_id", Description: "Also report this task's queue and position; 404 when it is in neither queue"}},
+			Response: NodeQueues{}, Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+
+		// WebRTC signalling
+		{Method: "GET", Path: "/api/webrtc/ice-servers", Tag: "webrtc", Summary: "Get ICE servers, including TURN credentials when configured",
+			Params: []Param{{Name: "node_id", Description: "Worker asking for the servers; expires_at is converted to its clock"}}, Body: ICEServers{}, Errors: []int{http.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/webrtc/offer", Tag: "webrtc", Summary: "Forward an SDP offer to a worker", Request: handlers.WebRTCOfferRequest{}, Body: WebRTCSession{}, Errors: []int{http.StatusNotFound, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/webrtc/answer", Tag: "webrtc", Summary: "Forward an SDP answer to the client", Request: handlers.WebRTCAnswerRequest{}, Errors: []int{http.StatusNotFound}},
+		{Method: "POST", Path: "/api/webrtc/ice", Tag: "webrtc", Summary: "Forward an ICE candidate", Request: handlers.ICECandidateRequest{}, Errors: []int{http.StatusNotFound}},
+		{Method: "POST", Path: "/api/webrtc/ice/resend", Tag: "webrtc", Summary: "Ask the worker to re-send its ICE candidates for a stuck session",
+			Request: handlers.ICEResendRequest{}, Response: ICEResendResult{},
+			Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/webrtc/probe", Tag: "webrtc", Access: User, Summary: "Measure throughput and RTT to a worker, cached per user and worker for 10 minutes",
+			Request: handlers.ProbeRequest{}, Body: ProbeStarted{}, Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented}},
+		{Method: "GET", Path: "/api/webrtc/probe", Tag: "webrtc", Access: User, Summary: "Cached speed probe results of the current user, fastest first", Response: []ProbeResult{}},
+		{Method: "GET", Path: "/api/webrtc/sessions/:id/stats", Tag: "webrtc", Summary: "Transport statistics of a session, refreshed by its worker", Response: SessionStatsResult{},
+			Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+
+		// Tasks
+		{Method: "POST", Path: "/api/tasks/submit", Tag: "tasks", Access: User, Summary: "Submit a magnet link; answers 202 when queued because every worker is at capacity",
+			Request: handlers.SubmitTaskRequest{}, Response: SubmitTaskResult{}, Statuses: []int{http.StatusOK, http.StatusAccepted},
+			Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/tasks/preview", Tag: "tasks", Access: User, Summary: "List a magnet's files without downloading it, to pick selected_files; may take up to about 2 minutes",
+			Request: handlers.PreviewTaskRequest{}, Response: TorrentPreview{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusNotImplemented, http.StatusServiceUnavailable, http.StatusGatewayTimeout}},
+		{Method: "GET", Path: "/api/tasks", Tag: "tasks", Summary: "List the tasks of all online workers and the gateway queue",
+			Params:   []Param{{Name: "status", Description: "Only list tasks in this status, e.g. paused"}},
+			Response: TaskList{}, Errors: []int{http.StatusRequestTimeout}},
+		{Method: "GET", Path: "/api/tasks/:id", Tag: "tasks", Summary: "Live details of a task from its registered worker with the stored summary (owner or admin only), or from every online worker when it is not registered", Response: task.Record{},
+			Errors: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGatewayTimeout}},
+		{Method: "GET", Path: "/api/tasks/:id/location", Tag: "tasks", Summary: "Find the worker holding a task", Response: TaskLocation{}, Errors: taskNotFound},
+		{Method: "GET", Path: "/api/tasks/:id/log", Tag: "tasks", Access: User, Summary: "Tail of a task's log",
+			Params:      []Param{{Name: "kb", Type: "integer", Description: "Kilobytes from the end, default 64, at most 1024"}},
+			ContentType: "text/plain", Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/tasks/:id/access", Tag: "tasks", Access: User, Summary: "Segment access statistics of a task: viewing sessions, segments and bytes served",
+			Response: TaskAccessResult{}, Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/tasks/:id/pieces", Tag: "tasks", Summary: "Piece availability of a task's video", Response: TaskPieces{}, Errors: []int{http.StatusNotFound, http.StatusServiceUnavailable}},
+		{Method: "PUT", Path: "/api/tasks/:id/pin", Tag: "tasks", Access: User, Summary: "Pin a task so retention never deletes it", Request: handlers.PinTaskRequest{}, Response: TaskPinned{},
+			Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+		{Method: "POST", Path: "/api/tasks/:id/retry", Tag: "tasks", Access: User, Summary: "Retry a failed task", Request: handlers.RetryTaskRequest{}, RequestOptional: true, Response: TaskRef{},
+			Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/tasks/:id/pause", Tag: "tasks", Access: User, Summary: "Pause a pending or downloading task", Response: TaskState{},
+			Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/tasks/:id/resume", Tag: "tasks", Access: User, Summary: "Resume a paused task", Response: TaskState{},
+			Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "DELETE", Path: "/api/tasks/:id", Tag: "tasks", Access: User, Summary: "Delete a task with its downloaded files and HLS output; transcoding tasks cannot be deleted", Response: TaskState{},
+			Params: []Param{{Name: "purge_files", Type: "boolean", Description: "Also delete the downloaded files and HLS output, default true; false keeps them on the worker's disk (protocol 22) and returns 501 for older workers, other values return 400"}},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/tasks/:id/boost", Tag: "tasks", Access: User, Summary: "Tell the task's worker a viewer is waiting so its transcode runs ahead of regular tasks", Response: TaskBoost{},
+			Errors: []int{http.StatusNotFound, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "PATCH", Path: "/api/tasks/:id/files", Tag: "tasks", Access: User, Summary: "Choose which files of a multi-file torrent to download; unselected files stop downloading", Request: handlers.SelectFilesRequest{}, Response: TaskFiles{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "PATCH", Path: "/api/tasks/:id/priority", Tag: "tasks", Access: Admin, Summary: "Change the download priority of a task queued on its worker", Request: handlers.SetPriorityRequest{}, Response: TaskPriority{},
+			Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/tasks/:id/segments/*name", Tag: "tasks", Summary: "Read a playlist, segment or subtitle file of a task over HTTP, streamed from its worker",
+			Params: []Param{
+				{Name: "Authorization", In: "header", Description: "Bearer followed by the token from GET /api/tasks/:id/stream-token", Required: true},
+				{Name: "Range", In: "header", Description: "Byte range, e.g. bytes=0-1023 or the suffix range bytes=-1024"},
+				{Name: "If-None-Match", In: "header", Description: "ETag of a cached copy; answered with 304 when unchanged"},
+			},
+			ContentType: "application/octet-stream", Statuses: []int{http.StatusOK, http.StatusPartialContent, http.StatusNotModified},
+			Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/tasks/:id/stream-token", Tag: "tasks", Access: User, Summary: "Bearer token for reading the task's HLS output over HTTP; task owner or admin only", Response: StreamToken{},
+			Errors: []int{http.StatusNotFound, http.StatusForbidden, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/tasks/:id/stream/*path", Tag: "tasks", Summary: "Read the task's HLS output over HTTP without WebRTC, e.g. stream/index.m3u8 or stream/720p/index0.ts",
+			Params: []Param{
+				{Name: "Authorization", In: "header", Description: "Bearer followed by the token from GET /api/tasks/:id/stream-token", Required: true},
+				{Name: "Range", In: "header", Description: "Byte ranges, answered with 206"},
+				{Name: "If-None-Match", In: "header", Description: "ETag of a cached copy; answered with 304 when unchanged"},
+			},
+			ContentType: "application/octet-stream", Statuses: []int{http.StatusOK, http.StatusPartialContent, http.StatusNotModified},
+			Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+
+		// System
+		{Method: "GET", Path: "/api/status", Tag: "system", Summary: "Cluster status, request limiting and dispatch queue metrics", Response: SystemStatus{}},
+		{Method: "GET", Path: "/api/events", Tag: "system", Access: User, ContentType: "text/event-stream",
+			Summary: "Server-sent task_ready and task_failed events of the user's tasks, when notifications.sse is set in the preferences; each data line is a JSON object with event, task_id, worker_id, status and at"},
+		{Method: "GET", Path: "/api/openapi.json", Tag: "system", Summary: "This document", Body: map[string]interface{}{}},
+		{Method: "GET", Path: "/api/docs", Tag: "system", Access: User, Summary: "Swagger UI for this document", ContentType: "text/html"},
+
+		// Auth
+		{Method: "POST", Path: "/api/auth/register", Tag: "auth", Summary: "Register an account", Request: handlers.Credentials{}, Response: Account{}, Statuses: []int{http.StatusCreated}},
+		{Method: "POST", Path: "/api/auth/login", Tag: "auth", Summary: "Log in and receive the session cookie", Request: handlers.Credentials{}, Response: Account{}, Errors: []int{http.StatusUnauthorized}},
+		{Method: "POST", Path: "/api/auth/logout", Tag: "auth", Summary: "Log out and clear the session cookie"},
+		{Method: "GET", Path: "/api/auth/me", Tag: "auth", Access: User, Summary: "The logged-in account", Response: Account{}},
+		{Method: "GET", Path: "/api/auth/preferences", Tag: "auth", Access: User, Summary: "The logged-in user's submission defaults", Response: user.Preferences{}},
+		{Method: "PUT", Path: "/api/auth/preferences", Tag: "auth", Access: User, Summary: "Replace the submission defaults; explicit submit fields always win", Request: user.Preferences{}, Response: user.Preferences{}, Errors: []int{http.StatusBadRequest}},
+
+		// Admin
+		{Method: "POST", Path: "/api/admin/tasks/:id/prune", Tag: "admin", Access: Admin, Summary: "Delete download leftovers of a failed task",
+			Params:   []Param{{Name: "dry_run", Type: "boolean", Description: "Only list what would be deleted"}},
+			Response: PruneResult{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/admin/tasks/:id/segments/:name/repair", Tag: "admin", Access: Admin, Summary: "Verify a segment and regenerate it from the source file when corrupted",
+			Params:   []Param{{Name: "force", Type: "boolean", Description: "Regenerate even when the segment verifies as healthy"}},
+			Response: SegmentRepair{}, Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/nodes/:id/transcode-local", Tag: "admin", Access: Admin, Summary: "List files in a worker's extra media directories", Response: LocalMedia{}, Errors: []int{http.StatusNotFound}},
+		{Method: "POST", Path: "/api/nodes/:id/transcode-local", Tag: "admin", Access: Admin, Summary: "Transcode a file from a worker's extra media directories", Request: handlers.TranscodeLocalRequest{}, Response: LocalTranscode{}, Errors: []int{http.StatusNotFound}},
+		{Method: "POST", Path: "/api/nodes/:id/pause-all", Tag: "admin", Access: Admin, Summary: "Pause a worker's downloads and transcodes until resume-all; playback continues",
+			Response: NodeQuiet{}, Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/api/nodes/:id/resume-all", Tag: "admin", Access: Admin, Summary: "End a worker's quiet mode, manual or scheduled",
+			Response: NodeQuiet{}, Errors: []int{http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "PUT", Path: "/api/nodes/:id/rate-limit", Tag: "admin", Access: Admin, Summary: "Change a worker's torrent download and upload rate limits until it restarts",
+			Request: handlers.SetRateLimitRequest{}, Response: NodeRateLimit{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestTimeout, http.StatusNotImplemented, http.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/admin/users", Tag: "admin", Access: Admin, Summary: "List users", Response: []AdminUser{}},
+		{Method: "POST", Path: "/api/admin/users/guest", Tag: "admin", Access: Admin, Summary: "Create a guest account", Request: handlers.CreateGuestRequest{}, Response: Account{}, Statuses: []int{http.StatusCreated}},
+		{Method: "PATCH", Path: "/api/admin/users/:id/expiry", Tag: "admin", Access: Admin, Summary: "Change or clear a guest's expiry", Request: handlers.ExpiryRequest{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+		{Method: "PATCH", Path: "/api/admin/users/:id/ban", Tag: "admin", Access: Admin, Summary: "Ban or unban a user", Request: handlers.BanRequest{}},
+		{Method: "PATCH", Path: "/api/admin/users/:id/flag", Tag: "admin", Access: Admin, Summary: "Set or clear the review flag", Request: handlers.FlagRequest{}},
+		{Method: "GET", Path: "/api/admin/users/:id/preferences", Tag: "admin", Access: Admin, Summary: "View a user's submission defaults (read-only)", Response: user.Preferences{}, Errors: []int{http.StatusNotFound}},
+		{Method: "GET", Path: "/api/admin/config-schema", Tag: "admin", Access: Admin, Summary: "Gateway configuration options", Response: []config.SchemaField{}},
+		{Method: "GET", Path: "/api/admin/blocklist", Tag: "admin", Access: Admin, Summary: "List blocklist rules", Response: []policy.Rule{}},
+		{Method: "POST", Path: "/api/admin/blocklist", Tag: "admin", Access: Admin, Summary: "Add a blocklist rule", Request: handlers.BlocklistRuleRequest{}, Response: policy.Rule{}, Statuses: []int{http.StatusCreated}},
+		{Method: "DELETE", Path: "/api/admin/blocklist/:id", Tag: "admin", Access: Admin, Summary: "Delete a blocklist rule", Errors: []int{http.StatusNotFound}},
+		{Method: "GET", Path: "/api/admin/policy-events", Tag: "admin", Access: Admin, Summary: "Audit trail of blocked submissions",
+			Params: []Param{{Name: "limit", Type: "integer", Description: "Number of events, newest first"}}, Response: []policy.Event{}},
+
+		// WebSocket
+		{Method: "GET", Path: "/ws/nodes", Tag: "websocket", Summary: "Worker connection", Messages: nodeProtocol},
+		{Method: "GET", Path: "/ws/clients", Tag: "websocket", Summary: "Player connection for signalling and session migration",
+			Params: []Param{{Name: "client_id", Required: true, Description: "Client identifier used to route answers and migrations"}}, Messages: clientProtocol},
+	}
+}
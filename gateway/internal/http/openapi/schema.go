@@ -0,0 +1,130 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+// Schema is a JSON Schema object as used by OpenAPI 3.0.
+type Schema map[string]interface{}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	timefmtType    = reflect.TypeOf(timefmt.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// components collects the named schemas referenced from the document.
+type components struct {
+	schemas map[string]Schema
+}
+
+func newComponents() *components {
+	return &components{schemas: make(map[string]Schema)}
+}
+
+// ref returns a reference to the component describing v's type, registering
+// the component on first use. Named struct types become components under
+// their Go type name; everything else is described inline.
+func (c *components) ref(v interface{}) Schema {
+	return c.schemaOf(reflect.TypeOf(v))
+}
+
+func (c *components) schemaOf(t reflect.Type) Schema {
+	switch t {
+	case timeType, timefmtType:
+		return Schema{"type": "string", "format": "date-time", "nullable": true}
+	case rawMessageType:
+		return Schema{"type": "object", "additionalProperties": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := c.schemaOf(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return Schema{"allOf": []Schema{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return Schema{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return Schema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"} // encoding/json writes []byte as base64
+		}
+		return Schema{"type": "array", "items": c.schemaOf(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": c.schemaOf(t.Elem())}
+	case reflect.Interface:
+		return Schema{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return c.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := c.schemas[name]; !ok {
+			c.schemas[name] = Schema{} // placeholder for recursive types
+			c.schemas[name] = c.structSchema(t)
+		}
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+	return Schema{}
+}
+
+// structSchema describes the JSON encoding of a struct: exported fields by
+// their json tag, embedded structs flattened, "-" fields skipped.
+func (c *components) structSchema(t reflect.Type) Schema {
+	properties := Schema{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := c.structSchema(field.Type)
+			for key, value := range embedded["properties"].(Schema) {
+				properties[key] = value
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := c.schemaOf(field.Type)
+		if desc := field.Tag.Get("desc"); desc != "" {
+			if _, isRef := schema["$ref"]; isRef {
+				schema = Schema{"allOf": []Schema{schema}}
+			}
+			schema["description"] = desc
+		}
+		properties[name] = schema
+		if strings.Contains(field.Tag.Get("binding"), "required") {
+			required = append(required, name)
+		}
+	}
+
+	schema := Schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,252 @@
+// Package openapi describes the gateway REST API as an OpenAPI 3 document.
+//
+// The document is built from a hand-maintained operation table (operations.go)
+// whose request and response bodies are Go types; their JSON encoding is
+// turned into schemas by reflection, so renaming a field in one of those
+// types changes the spec with it. Request bodies are the types the handlers
+// bind (handlers/requests.go), never copies. WebSocket message payloads are published
+// as components and listed on the two WebSocket endpoints.
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Version is the version of the described API.
+const Version = "1.0.0"
+
+// Access is the authentication an operation requires.
+type Access int
+
+const (
+	Public Access = iota
+	User
+	Admin
+)
+
+// Param is a path or query parameter.
+type Param struct {
+	Name        string
+	In          string // "path" or "query"
+	Type        string // JSON Schema type, "string" when empty
+	Description string
+	Required    bool
+}
+
+// Operation documents one registered route.
+type Operation struct {
+	Method  string
+	Path    string // Gin syntax, e.g. /api/tasks/:id
+	Tag     string
+	Summary string
+	Access  Access
+	Params  []Param
+	// Request is a zero value of the JSON request body type, nil when the
+	// endpoint takes no body.
+	Request         interface{}
+	RequestOptional bool
+	// Response is a zero value of the type carried in the envelope's data
+	// field, nil when the endpoint returns no data.
+	Response interface{}
+	// Body replaces the envelope for endpoints that answer with their own
+	// top-level object.
+	Body interface{}
+	// ContentType replaces JSON for endpoints answering with plain text or HTML.
+	ContentType string
+	// Statuses are the success status codes, 200 when empty.
+	Statuses []int
+	// Errors lists the status codes returned besides 200, each answered with
+	// the error envelope.
+	Errors []int
+	// Messages documents the WebSocket protocol of an upgrade endpoint.
+	Messages *WebSocketProtocol
+}
+
+// Key identifies the route of an operation as Gin reports it.
+func (op Operation) Key() string {
+	return op.Method + " " + op.Path
+}
+
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z_]+)`)
+
+// openAPIPath converts a Gin route path to OpenAPI path template syntax.
+func openAPIPath(path string) string {
+	return ginParam.ReplaceAllString(path, "{$1}")
+}
+
+// Build assembles the OpenAPI document for every operation.
+func Build() map[string]interface{} {
+	comps := newComponents()
+	comps.schemas["ErrorResponse"] = Schema{
+		"type": "object",
+		"properties": Schema{
+			"success": Schema{"type": "boolean", "enum": []bool{false}},
+			"error":   Schema{"type": "string"},
+			"code":    Schema{"type": "string", "description": "Machine-readable error code, e.g. policy_blocked, cluster_saturated"},
+		},
+		"required": []string{"success", "error"},
+	}
+
+	paths := map[string]map[string]interface{}{}
+	for _, op := range Operations() {
+		path := openAPIPath(op.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(op.Method)] = op.document(comps)
+	}
+
+	websocketDoc := websocketDescription()
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "magnetm3u8 gateway API",
+			"version":     Version,
+			"description": "REST API of the magnetm3u8 gateway. Every JSON response is an envelope with a boolean success field; successful responses carry data, failed ones error and sometimes code. Timestamps are RFC3339 strings in UTC.",
+		},
+		"tags": []map[string]interface{}{
+			{"name": "nodes", "description": "Worker nodes connected to the gateway"},
+			{"name": "tasks", "description": "Download and transcoding tasks"},
+			{"name": "webrtc", "description": "WebRTC signalling over HTTP"},
+			{"name": "auth", "description": "Accounts and sessions"},
+			{"name": "admin", "description": "Administration, admin role required"},
+			{"name": "system", "description": "Gateway status and documentation"},
+			{"name": "websocket", "description": websocketDoc},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": comps.schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "gateway_session",
+				},
+			},
+		},
+	}
+}
+
+func (op Operation) document(comps *components) map[string]interface{} {
+	doc := map[string]interface{}{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": operationID(op),
+	}
+	if op.Access != Public {
+		doc["security"] = []map[string][]string{{"session": {}}}
+		if op.Access == Admin {
+			doc["description"] = "Requires the admin role."
+		}
+	}
+
+	var params []map[string]interface{}
+	for _, match := range ginParam.FindAllStringSubmatch(op.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   Schema{"type": "string"},
+		})
+	}
+	for _, param := range op.Params {
+		typ := param.Type
+		if typ == "" {
+			typ = "string"
+		}
+		in := param.In
+		if in == "" {
+			in = "query"
+		}
+		params = append(params, map[string]interface{}{
+			"name":        param.Name,
+			"in":          in,
+			"required":    param.Required,
+			"description": param.Description,
+			"schema":      Schema{"type": typ},
+		})
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+
+	if op.Request != nil {
+		doc["requestBody"] = map[string]interface{}{
+			"required": !op.RequestOptional,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": comps.ref(op.Request)},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{}
+	if op.Messages != nil {
+		responses["101"] = map[string]interface{}{"description": "Switching to the WebSocket protocol"}
+		doc["x-websocket-messages"] = op.Messages.document(comps)
+	} else {
+		schema := Schema{"type": "object", "properties": Schema{"success": Schema{"type": "boolean"}}, "required": []string{"success"}}
+		if op.Response != nil {
+			schema["properties"].(Schema)["data"] = comps.ref(op.Response)
+		}
+		if op.Body != nil {
+			schema = comps.ref(op.Body)
+		}
+		contentType := "application/json"
+		if op.ContentType != "" {
+			contentType = op.ContentType
+			schema = Schema{"type": "string"}
+		}
+		statuses := op.Statuses
+		if len(statuses) == 0 {
+			statuses = []int{http.StatusOK}
+		}
+		for _, status := range statuses {
+			responses[fmt.Sprint(status)] = map[string]interface{}{
+				"description": http.StatusText(status),
+				"content": map[string]interface{}{
+					contentType: map[string]interface{}{"schema": schema},
+				},
+			}
+		}
+	}
+
+	errors := append([]int(nil), op.Errors...)
+	if op.Request != nil {
+		errors = append(errors, http.StatusBadRequest)
+	}
+	if op.Access != Public {
+		errors = append(errors, http.StatusUnauthorized)
+	}
+	if op.Access == Admin {
+		errors = append(errors, http.StatusForbidden)
+	}
+	sort.Ints(errors)
+	for _, status := range errors {
+		responses[fmt.Sprint(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": Schema{"$ref": "#/components/schemas/ErrorResponse"},
+				},
+			},
+		}
+	}
+	doc["responses"] = responses
+	return doc
+}
+
+// operationID derives a stable identifier such as getApiTasksId.
+func operationID(op Operation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '*' || r == '-' || r == '_' || r == '.'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
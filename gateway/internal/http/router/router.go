@@ -1,8 +1,11 @@
 package router
 
 import (
+	"context"
+	"log"
 	"net/http"
 	"path/filepath"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -11,33 +14,87 @@ import (
 	"magnetm3u8-gateway/internal/config"
 	"magnetm3u8-gateway/internal/http/handlers"
 	"magnetm3u8-gateway/internal/http/middleware"
+	"magnetm3u8-gateway/internal/http/openapi"
 	"magnetm3u8-gateway/internal/ice"
+	"magnetm3u8-gateway/internal/policy"
+	"magnetm3u8-gateway/internal/task"
 	"magnetm3u8-gateway/internal/user"
 )
 
 // Dependencies aggregates the components required to build the HTTP server.
+// Background work started by New, such as evicting idle rate limit counters,
+// stops when Context is done; a nil Context runs it for the life of the process.
 type Dependencies struct {
+	Context     context.Context
 	Config      config.Config
 	Manager     *cluster.Manager
 	Ice         *ice.IceServerProvider
 	AuthService *auth.Service
 	UserRepo    *user.Repository
+	TaskRepo    *task.Repository
+	Blocklist   *policy.Blocklist
+}
+
+// NewServer wraps handler in an http.Server listening on the configured port,
+// with read, write and idle timeouts taken from cfg.
+func NewServer(cfg config.Config, handler http.Handler) *http.Server {
+	seconds := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: seconds(cfg.HTTPReadHeaderTimeoutSeconds),
+		ReadTimeout:       seconds(cfg.HTTPReadTimeoutSeconds),
+		WriteTimeout:      seconds(cfg.HTTPWriteTimeoutSeconds),
+		IdleTimeout:       seconds(cfg.HTTPIdleTimeoutSeconds),
+	}
 }
 
 // New builds a fully configured Gin engine.
 func New(deps Dependencies) *gin.Engine {
 	engine := gin.Default()
+	// ClientIP keys the submission rate limit, so forwarding headers are only
+	// believed from configured proxies; gin trusts every proxy by default.
+	if err := engine.SetTrustedProxies(deps.Config.ProxyList()); err != nil {
+		log.Printf("Ignoring invalid TRUSTED_PROXIES %q: %v", deps.Config.TrustedProxies, err)
+		engine.SetTrustedProxies(nil)
+	}
 	engine.Use(corsMiddleware())
 	engine.Use(middleware.Session(deps.AuthService, deps.Config.SessionCookieName))
 
-	authHandler := handlers.NewAuthHandler(deps.AuthService, deps.Config.SessionCookieName, deps.Config.SessionTTL)
-	adminHandler := handlers.NewAdminHandler(deps.UserRepo)
+	authHandler := handlers.NewAuthHandler(deps.AuthService, deps.UserRepo, deps.Config.SessionCookieName, deps.Config.SessionTTL)
+	adminHandler := handlers.NewAdminHandler(deps.UserRepo, deps.AuthService)
+	policyHandler := handlers.NewPolicyHandler(deps.Blocklist)
 
-	handlers.RegisterGatewayRoutes(engine, deps.Manager, deps.Ice)
+	submitLimiter := middleware.NewRateLimiter(deps.Config.RateLimitRequests, time.Duration(deps.Config.RateLimitWindowSec)*time.Second)
+	ctx := deps.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go submitLimiter.Run(ctx, middleware.RateLimitEvictInterval)
+
+	handlers.RegisterGatewayRoutes(engine, deps.Manager, deps.Ice, deps.TaskRepo, deps.Blocklist, handlers.GatewayOptions{
+		NodeRequests: handlers.NodeRequestLimits{
+			PerSecond: deps.Config.NodeRequestRate,
+			Burst:     deps.Config.NodeRequestBurst,
+			MaxDelay:  time.Duration(deps.Config.NodeRequestMaxDelayMS) * time.Millisecond,
+		},
+		DuplicateSubmits: handlers.DuplicateSubmitMode(deps.Config.DuplicateSubmitMode),
+		Admission: handlers.AdmissionOptions{
+			Mode:       handlers.AdmissionMode(deps.Config.AdmissionMode),
+			RetryAfter: time.Duration(deps.Config.AdmissionRetryAfterSeconds) * time.Second,
+		},
+		Forwarding: handlers.ForwardOptions{
+			MaxRetries: deps.Config.ForwardMaxRetries,
+			Backoff:    time.Duration(deps.Config.ForwardRetryBackoffMS) * time.Millisecond,
+		},
+		SubmitLimiter: submitLimiter,
+		Users:         deps.UserRepo,
+	})
 	registerAuthRoutes(engine, authHandler)
-	registerAdminRoutes(engine, adminHandler)
+	registerAdminRoutes(engine, adminHandler, policyHandler)
 
 	staticDir := deps.Config.StaticDir
+	registerDocsRoutes(engine, staticDir)
 	engine.Static("/static", staticDir)
 	engine.StaticFile("/", filepath.Join(staticDir, "index.html"))
 	engine.StaticFile("/player", filepath.Join(staticDir, "player.html"))
@@ -52,18 +109,42 @@ func registerAuthRoutes(router *gin.Engine, handler *handlers.AuthHandler) {
 		authGroup.POST("/login", handler.Login)
 		authGroup.POST("/logout", handler.Logout)
 		authGroup.GET("/me", handler.Profile)
+		authGroup.GET("/preferences", handler.Preferences)
+		authGroup.PUT("/preferences", handler.UpdatePreferences)
 	}
 }
 
-func registerAdminRoutes(router *gin.Engine, handler *handlers.AdminHandler) {
+func registerAdminRoutes(router *gin.Engine, handler *handlers.AdminHandler, policyHandler *handlers.PolicyHandler) {
 	adminGroup := router.Group("/api/admin")
 	adminGroup.Use(middleware.RequireAdmin())
 	{
 		adminGroup.GET("/users", handler.ListUsers)
+		adminGroup.POST("/users/guest", handler.CreateGuest)
+		adminGroup.PATCH("/users/:id/expiry", handler.UpdateExpiry)
 		adminGroup.PATCH("/users/:id/ban", handler.UpdateBanState)
+		adminGroup.PATCH("/users/:id/flag", handler.UpdateFlagState)
+		adminGroup.GET("/users/:id/preferences", handler.UserPreferences)
+		adminGroup.GET("/config-schema", handler.ConfigSchema)
+
+		adminGroup.GET("/blocklist", policyHandler.ListRules)
+		adminGroup.POST("/blocklist", policyHandler.CreateRule)
+		adminGroup.DELETE("/blocklist/:id", policyHandler.DeleteRule)
+		adminGroup.GET("/policy-events", policyHandler.ListEvents)
 	}
 }
 
+// registerDocsRoutes serves the OpenAPI document and, to logged-in users, a
+// Swagger UI page rendering it.
+func registerDocsRoutes(router *gin.Engine, staticDir string) {
+	document := openapi.Build()
+	router.GET("/api/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, document)
+	})
+	router.GET("/api/docs", middleware.RequireAuth(), func(c *gin.Context) {
+		c.File(filepath.Join(staticDir, "docs.html"))
+	})
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		origin := c.GetHeader("Origin")
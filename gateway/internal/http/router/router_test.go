@@ -0,0 +1,140 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"magnetm3u8-gateway/internal/cluster"
+	"magnetm3u8-gateway/internal/config"
+	"magnetm3u8-gateway/internal/http/openapi"
+)
+
+func TestNewServerAppliesConfiguredTimeouts(t *testing.T) {
+	cfg := config.Config{
+		Port:                         "9090",
+		HTTPReadHeaderTimeoutSeconds: 5,
+		HTTPReadTimeoutSeconds:       20,
+		HTTPWriteTimeoutSeconds:      45,
+		HTTPIdleTimeoutSeconds:       90,
+	}
+	server := NewServer(cfg, http.NotFoundHandler())
+
+	if server.Addr != ":9090" {
+		t.Fatalf("expected address :9090, got %q", server.Addr)
+	}
+	if server.ReadHeaderTimeout != 5*time.Second || server.ReadTimeout != 20*time.Second ||
+		server.WriteTimeout != 45*time.Second || server.IdleTimeout != 90*time.Second {
+		t.Fatalf("unexpected timeouts: header=%s read=%s write=%s idle=%s",
+			server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	// Every timeout is set with the default configuration.
+	defaults := NewServer(config.Load(""), http.NotFoundHandler())
+	if defaults.ReadHeaderTimeout <= 0 || defaults.ReadTimeout <= 0 || defaults.WriteTimeout <= 0 || defaults.IdleTimeout <= 0 {
+		t.Fatalf("expected every timeout to be set by default, got %+v", defaults)
+	}
+}
+
+func TestClientIPIgnoresForwardedHeadersFromUntrustedPeers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clientIP := func(cfg config.Config) string {
+		cfg.StaticDir = t.TempDir()
+		engine := New(Dependencies{Config: cfg, Manager: cluster.NewManager()})
+		var ip string
+		engine.GET("/api/test-ip", func(c *gin.Context) { ip = c.ClientIP() })
+		req := httptest.NewRequest("GET", "/api/test-ip", nil)
+		req.RemoteAddr = "10.0.0.5:4321"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+		return ip
+	}
+
+	// A client cannot pick its own rate limit key with a forged header.
+	if ip := clientIP(config.Config{}); ip != "10.0.0.5" {
+		t.Fatalf("expected the remote address without trusted proxies, got %s", ip)
+	}
+	if ip := clientIP(config.Config{TrustedProxies: "10.0.0.0/8, 192.168.1.1"}); ip != "203.0.113.9" {
+		t.Fatalf("expected the forwarded address from a trusted proxy, got %s", ip)
+	}
+	if ip := clientIP(config.Config{TrustedProxies: "not-an-ip"}); ip != "10.0.0.5" {
+		t.Fatalf("expected an invalid proxy list to trust no proxy, got %s", ip)
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := New(Dependencies{
+		Config:  config.Config{StaticDir: t.TempDir()},
+		Manager: cluster.NewManager(),
+	})
+
+	documented := make(map[string]bool)
+	for _, op := range openapi.Operations() {
+		if documented[op.Key()] {
+			t.Errorf("%s is documented twice", op.Key())
+		}
+		documented[op.Key()] = true
+		// Request bodies are the handlers' own types, so the spec cannot drift from what they bind.
+		if op.Request != nil && reflect.TypeOf(op.Request).PkgPath() == reflect.TypeOf(openapi.Operation{}).PkgPath() {
+			t.Errorf("%s documents a request body declared in the openapi package", op.Key())
+		}
+	}
+
+	registered := make(map[string]bool)
+	for _, route := range engine.Routes() {
+		// Static files are not part of the API.
+		if !strings.HasPrefix(route.Path, "/api/") && !strings.HasPrefix(route.Path, "/ws/") {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if !documented[key] {
+			t.Errorf("route %s is missing from the OpenAPI spec", key)
+		}
+	}
+	for key := range documented {
+		if !registered[key] {
+			t.Errorf("OpenAPI spec documents %s, which is not registered", key)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var document struct {
+		OpenAPI    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("expected the spec at /api/openapi.json, got %d %v", recorder.Code, err)
+	}
+	if document.OpenAPI != "3.0.3" || document.Paths["/api/tasks/{id}/retry"]["post"] == nil {
+		t.Fatalf("expected OpenAPI 3 paths in template syntax, got %s %v", document.OpenAPI, document.Paths)
+	}
+	for _, name := range []string{"SubmitTaskRequest", "TaskSubmit", "SessionMigrate", "WebSocketMessage", "DispatchStats"} {
+		if document.Components.Schemas[name] == nil {
+			t.Errorf("expected component %s", name)
+		}
+	}
+	submit, _ := document.Components.Schemas["SubmitTaskRequest"].(map[string]interface{})
+	properties, _ := submit["properties"].(map[string]interface{})
+	if burn, _ := properties["burn_subtitles"].(map[string]interface{}); burn["nullable"] != true {
+		t.Errorf("expected burn_subtitles to be nullable like the handler's *bool, got %v", properties["burn_subtitles"])
+	}
+
+	// Swagger UI is only served to logged-in users.
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/docs", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected /api/docs to require login, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,240 @@
+package policy
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRule = errors.New("invalid blocklist rule")
+
+// Verdict is the outcome of checking content against the blocklist.
+type Verdict struct {
+	Allowed bool   `json:"allowed"`
+	RuleID  int64  `json:"rule_id,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Flagger marks accounts for manual review.
+type Flagger interface {
+	SetFlagged(ctx context.Context, userID int64, flagged bool) error
+}
+
+type nameRule struct {
+	id      int64
+	pattern *regexp.Regexp
+}
+
+// Blocklist keeps an in-memory copy of the admin-configured rules and records
+// an audit trail for every blocked request.
+type Blocklist struct {
+	store         *Store
+	flagger       Flagger
+	flagThreshold int
+	flagWindow    time.Duration
+
+	mutex  sync.RWMutex
+	hashes map[string]int64
+	names  []nameRule
+}
+
+// NewBlocklist loads the rules from the store. Users that trip the blocklist
+// flagThreshold times within flagWindow are flagged; a threshold of 0 disables flagging.
+func NewBlocklist(store *Store, flagger Flagger, flagThreshold int, flagWindow time.Duration) (*Blocklist, error) {
+	b := &Blocklist{
+		store:         store,
+		flagger:       flagger,
+		flagThreshold: flagThreshold,
+		flagWindow:    flagWindow,
+		hashes:        make(map[string]int64),
+	}
+	if err := b.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload rebuilds the in-memory rule set from the database.
+func (b *Blocklist) Reload(ctx context.Context) error {
+	rules, err := b.store.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]int64)
+	var names []nameRule
+	for _, rule := range rules {
+		switch rule.Kind {
+		case KindInfoHash:
+			hashes[rule.Pattern] = rule.ID
+		case KindNameRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				log.Printf("Skipping invalid blocklist regex %d: %v", rule.ID, err)
+				continue
+			}
+			names = append(names, nameRule{id: rule.ID, pattern: re})
+		}
+	}
+
+	b.mutex.Lock()
+	b.hashes = hashes
+	b.names = names
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *Blocklist) Rules(ctx context.Context) ([]Rule, error) {
+	return b.store.ListRules(ctx)
+}
+
+// AddRule validates and stores a new rule, then refreshes the in-memory set.
+func (b *Blocklist) AddRule(ctx context.Context, kind, pattern string, createdBy *int64) (*Rule, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch kind {
+	case KindInfoHash:
+		normalized, err := NormalizeInfoHash(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		pattern = normalized
+	case KindNameRegex:
+		if pattern == "" {
+			return nil, fmt.Errorf("%w: empty pattern", ErrInvalidRule)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidRule, kind)
+	}
+
+	rule, err := b.store.CreateRule(ctx, kind, pattern, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	return rule, b.Reload(ctx)
+}
+
+func (b *Blocklist) RemoveRule(ctx context.Context, id int64) error {
+	if err := b.store.DeleteRule(ctx, id); err != nil {
+		return err
+	}
+	return b.Reload(ctx)
+}
+
+func (b *Blocklist) Events(ctx context.Context, limit int) ([]Event, error) {
+	return b.store.ListEvents(ctx, limit)
+}
+
+// Check matches an info hash and display name against the loaded rules.
+// Either value may be empty when it is not known yet.
+func (b *Blocklist) Check(infoHash, name string) Verdict {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if infoHash != "" {
+		if normalized, err := NormalizeInfoHash(infoHash); err == nil {
+			if id, blocked := b.hashes[normalized]; blocked {
+				return Verdict{RuleID: id, Reason: "info hash is blocklisted"}
+			}
+		}
+	}
+
+	if name != "" {
+		for _, rule := range b.names {
+			if rule.pattern.MatchString(name) {
+				return Verdict{RuleID: rule.id, Reason: "name matches a blocklisted pattern"}
+			}
+		}
+	}
+
+	return Verdict{Allowed: true}
+}
+
+// RecordBlocked writes an audit event for a blocked request and flags the
+// user once they reach the repeat-offender threshold.
+func (b *Blocklist) RecordBlocked(ctx context.Context, userID *int64, taskID, infoHash, name string, verdict Verdict) {
+	event := Event{
+		UserID:   userID,
+		TaskID:   taskID,
+		InfoHash: infoHash,
+		Name:     name,
+		Reason:   verdict.Reason,
+	}
+	if verdict.RuleID != 0 {
+		ruleID := verdict.RuleID
+		event.RuleID = &ruleID
+	}
+
+	if err := b.store.RecordEvent(ctx, event); err != nil {
+		log.Printf("Failed to record policy event: %v", err)
+		return
+	}
+	log.Printf("Policy blocked task=%s hash=%s name=%q: %s", taskID, infoHash, name, verdict.Reason)
+
+	if userID == nil || b.flagger == nil || b.flagThreshold <= 0 {
+		return
+	}
+
+	count, err := b.store.CountEventsSince(ctx, *userID, time.Now().Add(-b.flagWindow))
+	if err != nil {
+		log.Printf("Failed to count policy events for user %d: %v", *userID, err)
+		return
+	}
+	if count >= b.flagThreshold {
+		if err := b.flagger.SetFlagged(ctx, *userID, true); err != nil {
+			log.Printf("Failed to flag user %d: %v", *userID, err)
+			return
+		}
+		log.Printf("User %d flagged for review after %d blocked requests", *userID, count)
+	}
+}
+
+// ParseMagnet extracts the info hash and display name from a magnet link.
+func ParseMagnet(magnetURL string) (infoHash, name string) {
+	parsed, err := url.Parse(strings.TrimSpace(magnetURL))
+	if err != nil || parsed.Scheme != "magnet" {
+		return "", ""
+	}
+
+	query := parsed.Query()
+	for _, xt := range query["xt"] {
+		if strings.HasPrefix(xt, "urn:btih:") {
+			if normalized, err := NormalizeInfoHash(strings.TrimPrefix(xt, "urn:btih:")); err == nil {
+				infoHash = normalized
+				break
+			}
+		}
+	}
+
+	return infoHash, query.Get("dn")
+}
+
+// NormalizeInfoHash converts a hex or base32 v1 info hash to lowercase hex.
+func NormalizeInfoHash(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch len(raw) {
+	case 40:
+		if _, err := hex.DecodeString(raw); err != nil {
+			return "", fmt.Errorf("invalid hex info hash")
+		}
+		return strings.ToLower(raw), nil
+	case 32:
+		decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(raw))
+		if err != nil {
+			return "", fmt.Errorf("invalid base32 info hash")
+		}
+		return hex.EncodeToString(decoded), nil
+	default:
+		return "", fmt.Errorf("info hash must be 40 hex or 32 base32 characters")
+	}
+}
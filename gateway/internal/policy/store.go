@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+// Rule kinds supported by the blocklist.
+const (
+	KindInfoHash  = "infohash"
+	KindNameRegex = "name_regex"
+)
+
+// Rule is a single admin-configured blocklist entry.
+type Rule struct {
+	ID        int64        `json:"id"`
+	Kind      string       `json:"kind"`
+	Pattern   string       `json:"pattern"`
+	CreatedBy *int64       `json:"created_by,omitempty"`
+	CreatedAt timefmt.Time `json:"created_at"`
+}
+
+// Event is an audit record of a blocked submission or download.
+type Event struct {
+	ID        int64        `json:"id"`
+	UserID    *int64       `json:"user_id,omitempty"`
+	TaskID    string       `json:"task_id,omitempty"`
+	InfoHash  string       `json:"info_hash,omitempty"`
+	Name      string       `json:"name,omitempty"`
+	RuleID    *int64       `json:"rule_id,omitempty"`
+	Reason    string       `json:"reason"`
+	CreatedAt timefmt.Time `json:"created_at"`
+}
+
+var ErrRuleNotFound = errors.New("blocklist rule not found")
+
+// Store persists blocklist rules and policy audit events.
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) ListRules(ctx context.Context) ([]Rule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, kind, pattern, created_by, created_at FROM blocklist_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var (
+			rule      Rule
+			createdBy sql.NullInt64
+		)
+		if err := rows.Scan(&rule.ID, &rule.Kind, &rule.Pattern, &createdBy, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		if createdBy.Valid {
+			id := createdBy.Int64
+			rule.CreatedBy = &id
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *Store) CreateRule(ctx context.Context, kind, pattern string, createdBy *int64) (*Rule, error) {
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO blocklist_rules (kind, pattern, created_by) VALUES (?, ?, ?)`,
+		kind, pattern, nullableInt(createdBy))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rule{ID: id, Kind: kind, Pattern: pattern, CreatedBy: createdBy, CreatedAt: timefmt.Now()}, nil
+}
+
+func (s *Store) DeleteRule(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM blocklist_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+func (s *Store) RecordEvent(ctx context.Context, event Event) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO policy_events (user_id, task_id, info_hash, name, rule_id, reason) VALUES (?, ?, ?, ?, ?, ?)`,
+		nullableInt(event.UserID), event.TaskID, event.InfoHash, event.Name, nullableInt(event.RuleID), event.Reason)
+	return err
+}
+
+// CountEventsSince returns how many blocked events were attributed to the user after since.
+func (s *Store) CountEventsSince(ctx context.Context, userID int64, since time.Time) (int, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM policy_events WHERE user_id = ? AND created_at >= ?`,
+		userID, since.UTC().Format("2006-01-02 15:04:05"))
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *Store) ListEvents(ctx context.Context, limit int) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, user_id, task_id, info_hash, name, rule_id, reason, created_at FROM policy_events ORDER BY id DESC LIMIT ?`,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var (
+			event  Event
+			userID sql.NullInt64
+			ruleID sql.NullInt64
+		)
+		if err := rows.Scan(&event.ID, &userID, &event.TaskID, &event.InfoHash, &event.Name, &ruleID, &event.Reason, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			id := userID.Int64
+			event.UserID = &id
+		}
+		if ruleID.Valid {
+			id := ruleID.Int64
+			event.RuleID = &id
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func nullableInt(v *int64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,188 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"magnetm3u8-gateway/internal/timefmt"
+)
+
+// Record tracks which worker holds a task and which user submitted it.
+type Record struct {
+	TaskID   string          `json:"task_id"`
+	WorkerID string          `json:"worker_id"`
+	OwnerID  *int64          `json:"owner_id,omitempty"`
+	Status   string          `json:"status"`
+	InfoHash string          `json:"info_hash,omitempty"`
+	Summary  json.RawMessage `json:"summary,omitempty"`
+	// BytesDownloaded and BytesServed are the cumulative traffic totals last
+	// reported by the worker.
+	BytesDownloaded int64        `json:"bytes_downloaded"`
+	BytesServed     int64        `json:"bytes_served"`
+	CreatedAt       timefmt.Time `json:"created_at"`
+	UpdatedAt       timefmt.Time `json:"updated_at"`
+}
+
+// IsOwnedBy reports whether the record belongs to the given user.
+func (r *Record) IsOwnedBy(userID int64) bool {
+	return r.OwnerID != nil && *r.OwnerID == userID
+}
+
+var ErrNotFound = errors.New("task not found")
+
+// Repository persists the gateway's task registry.
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// Upsert records the latest worker and status for a task. A nil ownerID keeps
+// any previously stored owner.
+func (r *Repository) Upsert(ctx context.Context, taskID, workerID, status string, ownerID *int64) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO tasks (task_id, worker_id, owner_id, status) VALUES (?, ?, ?, ?)
+		ON CONFLICT(task_id) DO UPDATE SET
+			worker_id = excluded.worker_id,
+			status = excluded.status,
+			owner_id = COALESCE(excluded.owner_id, tasks.owner_id),
+			updated_at = CURRENT_TIMESTAMP`,
+		taskID, workerID, nullableInt64(ownerID), status)
+	return err
+}
+
+const recordColumns = `task_id, worker_id, owner_id, status, info_hash, summary, bytes_downloaded, bytes_served, created_at, updated_at`
+
+func (r *Repository) Get(ctx context.Context, taskID string) (*Record, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+recordColumns+` FROM tasks WHERE task_id = ?`, taskID)
+
+	rec, err := scanRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return rec, err
+}
+
+// ListByWorker returns the registered tasks held by a worker, newest first.
+func (r *Repository) ListByWorker(ctx context.Context, workerID string) ([]Record, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM tasks WHERE worker_id = ? ORDER BY created_at DESC, task_id`, workerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
+}
+
+// SetInfoHash records the torrent info hash (lowercase hex) of a task. Tasks
+// that are not in the registry are ignored.
+func (r *Repository) SetInfoHash(ctx context.Context, taskID, infoHash string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE tasks SET info_hash = ? WHERE task_id = ?`, infoHash, taskID)
+	return err
+}
+
+// FindActiveByInfoHash returns the newest task with the given info hash that
+// has not failed, on any worker.
+func (r *Repository) FindActiveByInfoHash(ctx context.Context, infoHash string) (*Record, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+recordColumns+` FROM tasks
+		WHERE info_hash = ? AND status NOT IN ('error', 'permanently_failed')
+		ORDER BY created_at DESC, task_id LIMIT 1`, infoHash)
+
+	rec, err := scanRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return rec, err
+}
+
+// CountActiveByWorker returns how many registered tasks each worker is
+// downloading or about to download.
+func (r *Repository) CountActiveByWorker(ctx context.Context) (map[string]int, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT worker_id, COUNT(*) FROM tasks
+		WHERE status IN ('pending', 'downloading') GROUP BY worker_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var workerID string
+		var count int
+		if err := rows.Scan(&workerID, &count); err != nil {
+			return nil, err
+		}
+		counts[workerID] = count
+	}
+	return counts, rows.Err()
+}
+
+// ReplaceStatus moves every task in status from to status to and returns the
+// number of tasks changed.
+func (r *Repository) ReplaceStatus(ctx context.Context, from, to string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `UPDATE tasks SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE status = ?`, to, from)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanRecord(row interface{ Scan(...interface{}) error }) (*Record, error) {
+	var rec Record
+	var owner sql.NullInt64
+	var summary sql.NullString
+	if err := row.Scan(&rec.TaskID, &rec.WorkerID, &owner, &rec.Status, &rec.InfoHash, &summary, &rec.BytesDownloaded, &rec.BytesServed, &rec.CreatedAt, &rec.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if owner.Valid {
+		rec.OwnerID = &owner.Int64
+	}
+	if summary.Valid && summary.String != "" {
+		rec.Summary = json.RawMessage(summary.String)
+	}
+	return &rec, nil
+}
+
+// SaveSummary stores the completion summary reported by the worker and marks
+// the task with the given status.
+func (r *Repository) SaveSummary(ctx context.Context, taskID, workerID, status string, summary json.RawMessage) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO tasks (task_id, worker_id, status, summary) VALUES (?, ?, ?, ?)
+		ON CONFLICT(task_id) DO UPDATE SET
+			worker_id = excluded.worker_id,
+			status = excluded.status,
+			summary = excluded.summary,
+			updated_at = CURRENT_TIMESTAMP`,
+		taskID, workerID, status, string(summary))
+	return err
+}
+
+// UpdateTraffic stores the traffic totals reported by the worker. Tasks that
+// are not in the registry are ignored.
+func (r *Repository) UpdateTraffic(ctx context.Context, taskID string, downloaded, served int64) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE tasks SET bytes_downloaded = ?, bytes_served = ? WHERE task_id = ?`,
+		downloaded, served, taskID)
+	return err
+}
+
+func (r *Repository) Delete(ctx context.Context, taskID string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM tasks WHERE task_id = ?`, taskID)
+	return err
+}
+
+func nullableInt64(v *int64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,109 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"magnetm3u8-gateway/internal/database"
+)
+
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return NewRepository(db)
+}
+
+func TestRepositorySavesCompletionSummary(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	if err := repo.Upsert(ctx, "task-1", "worker-1", "downloading", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	summary := json.RawMessage(`{"duration_seconds":61.5,"width":1920,"height":1080,"segment_count":7}`)
+	if err := repo.SaveSummary(ctx, "task-1", "worker-1", "ready", summary); err != nil {
+		t.Fatalf("save summary: %v", err)
+	}
+
+	record, err := repo.Get(ctx, "task-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if record.Status != "ready" {
+		t.Fatalf("expected ready status, got %q", record.Status)
+	}
+
+	var stored map[string]interface{}
+	if err := json.Unmarshal(record.Summary, &stored); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if stored["width"] != float64(1920) || stored["segment_count"] != float64(7) {
+		t.Fatalf("unexpected stored summary: %s", record.Summary)
+	}
+}
+
+func TestRepositoryUpdatesTraffic(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	if err := repo.Upsert(ctx, "task-1", "worker-1", "ready", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := repo.UpdateTraffic(ctx, "task-1", 1024, 4096); err != nil {
+		t.Fatalf("update traffic: %v", err)
+	}
+	if err := repo.UpdateTraffic(ctx, "unknown", 1, 1); err != nil {
+		t.Fatalf("update traffic for unknown task: %v", err)
+	}
+
+	record, err := repo.Get(ctx, "task-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if record.BytesDownloaded != 1024 || record.BytesServed != 4096 {
+		t.Fatalf("unexpected traffic: downloaded=%d served=%d", record.BytesDownloaded, record.BytesServed)
+	}
+}
+
+func TestRecordTimestampsSerializeAsRFC3339UTC(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	if err := repo.Upsert(ctx, "task-1", "worker-1", "downloading", nil); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	record, err := repo.Get(ctx, "task-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	layout := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$`)
+	for _, field := range []string{"created_at", "updated_at"} {
+		value, _ := decoded[field].(string)
+		if !layout.MatchString(value) {
+			t.Fatalf("expected %s in RFC3339 UTC, got %v", field, decoded[field])
+		}
+	}
+}
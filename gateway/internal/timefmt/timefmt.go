@@ -0,0 +1,180 @@
+// Package timefmt defines the timestamp contract for everything the gateway
+// exposes over HTTP or WebSocket: RFC3339 strings in UTC with second
+// precision, e.g. "2024-05-01T12:30:00Z". Zero times are encoded as null.
+//
+// Inbound values are parsed leniently: RFC3339 with or without fractional
+// seconds or offsets, SQLite DATETIME text, and legacy Unix seconds.
+package timefmt
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout is the canonical timestamp layout.
+const Layout = time.RFC3339
+
+// Format renders t in the canonical layout, or "" for the zero time.
+func Format(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(Layout)
+}
+
+// Parse accepts any supported inbound representation of a timestamp.
+func Parse(v interface{}) (time.Time, bool) {
+	switch value := v.(type) {
+	case time.Time:
+		return value, !value.IsZero()
+	case Time:
+		return value.Time, !value.IsZero()
+	case float64:
+		return fromUnix(value)
+	case int64:
+		return fromUnix(float64(value))
+	case int:
+		return fromUnix(float64(value))
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return fromUnix(f)
+	case string:
+		return parseString(value)
+	case []byte:
+		return parseString(string(value))
+	}
+	return time.Time{}, false
+}
+
+// Normalize converts a decoded JSON value to the canonical string when it
+// parses as a timestamp and returns it unchanged otherwise.
+func Normalize(v interface{}) interface{} {
+	if t, ok := Parse(v); ok {
+		return Format(t)
+	}
+	return v
+}
+
+// NormalizeFields normalizes the named timestamp fields of a decoded payload in place.
+func NormalizeFields(payload map[string]interface{}, fields ...string) {
+	for _, field := range fields {
+		if value, ok := payload[field]; ok && value != nil {
+			payload[field] = Normalize(value)
+		}
+	}
+}
+
+var stringLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func parseString(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range stringLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return fromUnix(f)
+	}
+	return time.Time{}, false
+}
+
+func fromUnix(seconds float64) (time.Time, bool) {
+	if seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC(), true
+}
+
+// Time is a time.Time that marshals to the canonical layout and can be
+// scanned from SQLite DATETIME columns.
+type Time struct {
+	time.Time
+}
+
+// Now returns the current time.
+func Now() Time {
+	return Time{time.Now()}
+}
+
+// From wraps t.
+func From(t time.Time) Time {
+	return Time{t}
+}
+
+// String returns the canonical representation.
+func (t Time) String() string {
+	return Format(t.Time)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t Time) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(Format(t.Time))
+}
+
+// UnmarshalJSON implements json.Unmarshaler and accepts legacy formats.
+func (t *Time) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+
+	var raw interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	parsed, ok := Parse(raw)
+	if !ok {
+		if s, isString := raw.(string); isString && s == "" {
+			t.Time = time.Time{}
+			return nil
+		}
+		return fmt.Errorf("timefmt: unsupported timestamp %s", data)
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner.
+func (t *Time) Scan(src interface{}) error {
+	if src == nil {
+		t.Time = time.Time{}
+		return nil
+	}
+	parsed, ok := Parse(src)
+	if !ok {
+		return fmt.Errorf("timefmt: cannot scan %T %v", src, src)
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (t Time) Value() (driver.Value, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	return t.UTC(), nil
+}
@@ -0,0 +1,84 @@
+package timefmt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFormatIsRFC3339UTCSeconds(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	value := time.Date(2024, 5, 1, 20, 30, 15, 987654321, shanghai)
+
+	if got := Format(value); got != "2024-05-01T12:30:15Z" {
+		t.Fatalf("unexpected format: %s", got)
+	}
+	if got := Format(time.Time{}); got != "" {
+		t.Fatalf("expected empty string for zero time, got %q", got)
+	}
+
+	data, err := json.Marshal(struct {
+		At    Time `json:"at"`
+		Empty Time `json:"empty"`
+	}{At: From(value)})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(data) != `{"at":"2024-05-01T12:30:15Z","empty":null}` {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+}
+
+func TestParseAcceptsLegacyFormats(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+	inputs := []interface{}{
+		"2024-05-01T12:30:15Z",
+		"2024-05-01T20:30:15+08:00",
+		"2024-05-01T12:30:15.000000001Z",
+		"2024-05-01 12:30:15",
+		"1714566615",
+		float64(1714566615),
+		int64(1714566615),
+		json.Number("1714566615"),
+	}
+	for _, input := range inputs {
+		got, ok := Parse(input)
+		if !ok || !got.Truncate(time.Second).Equal(want) {
+			t.Fatalf("Parse(%#v) = %v, %v", input, got, ok)
+		}
+	}
+
+	for _, input := range []interface{}{"", "yesterday", float64(0), nil, true} {
+		if _, ok := Parse(input); ok {
+			t.Fatalf("expected Parse(%#v) to fail", input)
+		}
+	}
+}
+
+func TestUnmarshalAndNormalizeLegacyPayloads(t *testing.T) {
+	var decoded struct {
+		At Time `json:"at"`
+	}
+	if err := json.Unmarshal([]byte(`{"at":1714566615}`), &decoded); err != nil {
+		t.Fatalf("unmarshal unix seconds: %v", err)
+	}
+	if decoded.At.String() != "2024-05-01T12:30:15Z" {
+		t.Fatalf("unexpected decoded time: %s", decoded.At)
+	}
+
+	payload := map[string]interface{}{
+		"created_at":   float64(1714566615),
+		"updated_at":   "2024-05-01T20:30:15.5+08:00",
+		"completed_at": "not a time",
+	}
+	NormalizeFields(payload, "created_at", "updated_at", "completed_at", "missing")
+	if payload["created_at"] != "2024-05-01T12:30:15Z" || payload["updated_at"] != "2024-05-01T12:30:15Z" {
+		t.Fatalf("unexpected normalized payload: %v", payload)
+	}
+	if payload["completed_at"] != "not a time" {
+		t.Fatalf("expected unparseable values to be left alone, got %v", payload["completed_at"])
+	}
+	if _, ok := payload["missing"]; ok {
+		t.Fatalf("expected missing fields not to be added")
+	}
+}
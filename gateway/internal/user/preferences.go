@@ -0,0 +1,160 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+)
+
+// AutoWorker as the default worker lets the scheduler pick one, as when no
+// preference is set.
+const AutoWorker = "auto"
+
+// Preferences are a user's defaults for new submissions. They are stored as a
+// JSON object in users.preferences; the submit endpoint applies them to fields
+// the request omits.
+type Preferences struct {
+	DefaultWorker    string `json:"default_worker,omitempty" desc:"Worker new tasks go to when the request names none; empty or auto lets the scheduler pick. Scheduled as usual while that worker is offline"`
+	HLSQuality       string `json:"hls_quality,omitempty" desc:"Default transcode profile: single or multi"`
+	BurnSubtitles    bool   `json:"burn_subtitles,omitempty" desc:"Burn subtitles into the picture by default"`
+	SubtitleLanguage string `json:"subtitle_language,omitempty" desc:"Default language of the burned subtitles"`
+	RequireComplete  bool   `json:"require_complete,omitempty" desc:"Withhold ready until the whole output exists by default"`
+	// Sequential overrides the worker's transcode.streaming_mode for new tasks
+	// in either direction; nil keeps the worker's setting.
+	Sequential    *bool          `json:"sequential,omitempty" desc:"Sequential streaming for new tasks: true downloads the video in order and transcodes while it downloads, false waits for the download; absent keeps the worker's transcode.streaming_mode"`
+	Notifications *Notifications `json:"notifications,omitempty" desc:"Task events the user is told about; none when absent"`
+}
+
+// Task events users can be notified about.
+const (
+	EventTaskReady  = "task_ready"
+	EventTaskFailed = "task_failed"
+)
+
+// Notifications chooses which events of the user's own tasks are sent, and
+// where: a webhook, the GET /api/events stream, or both.
+type Notifications struct {
+	Events  []string `json:"events" desc:"task_ready when a task can be played, task_failed when it fails"`
+	Webhook string   `json:"webhook,omitempty" desc:"http or https URL that receives a JSON POST per event; private and loopback addresses are refused when sending"`
+	SSE     bool     `json:"sse,omitempty" desc:"Stream the events as server-sent events on GET /api/events"`
+}
+
+// maxWebhookLength bounds the stored webhook URL.
+const maxWebhookLength = 2048
+
+var (
+	workerIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	languagePattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+)
+
+// Validate checks the preferences against their schema.
+func (p Preferences) Validate() error {
+	if p.DefaultWorker != "" && !workerIDPattern.MatchString(p.DefaultWorker) {
+		return errors.New("default_worker must be a worker ID or auto")
+	}
+	if p.HLSQuality != "" && p.HLSQuality != "single" && p.HLSQuality != "multi" {
+		return errors.New("hls_quality must be single or multi")
+	}
+	if p.SubtitleLanguage != "" && !languagePattern.MatchString(p.SubtitleLanguage) {
+		return errors.New("subtitle_language must be a language tag such as chi or zh-CN")
+	}
+	if p.Notifications != nil {
+		return p.Notifications.validate()
+	}
+	return nil
+}
+
+func (n *Notifications) validate() error {
+	for _, event := range n.Events {
+		if event != EventTaskReady && event != EventTaskFailed {
+			return fmt.Errorf("notifications.events must list %s or %s, got %q", EventTaskReady, EventTaskFailed, event)
+		}
+	}
+	if n.Webhook == "" {
+		return nil
+	}
+	u, err := url.Parse(n.Webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(n.Webhook) > maxWebhookLength {
+		return errors.New("notifications.webhook must be an http or https URL")
+	}
+	return nil
+}
+
+// Notifies reports whether the user asked to be told about the event.
+func (p Preferences) Notifies(event string) bool {
+	if p.Notifications == nil {
+		return false
+	}
+	for _, wanted := range p.Notifications.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Worker returns the preferred worker, or "" when the scheduler should pick.
+func (p Preferences) Worker() string {
+	if p.DefaultWorker == AutoWorker {
+		return ""
+	}
+	return p.DefaultWorker
+}
+
+// ParsePreferences decodes a preferences document, rejecting unknown fields
+// and values that fail Validate.
+func ParsePreferences(r io.Reader) (Preferences, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var p Preferences
+	if err := decoder.Decode(&p); err != nil {
+		return Preferences{}, fmt.Errorf("invalid preferences: %w", err)
+	}
+	if decoder.More() {
+		return Preferences{}, errors.New("invalid preferences: trailing data")
+	}
+	return p, p.Validate()
+}
+
+// GetPreferences returns the user's preferences; users who never saved any get
+// the zero value.
+func (r *Repository) GetPreferences(ctx context.Context, userID int64) (Preferences, error) {
+	var raw sql.NullString
+	err := r.db.QueryRowContext(ctx, `SELECT preferences FROM users WHERE id = ?`, userID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Preferences{}, ErrNotFound
+	}
+	if err != nil || !raw.Valid || raw.String == "" {
+		return Preferences{}, err
+	}
+
+	var p Preferences
+	if err := json.Unmarshal([]byte(raw.String), &p); err != nil {
+		return Preferences{}, fmt.Errorf("decode preferences of user %d: %w", userID, err)
+	}
+	return p, nil
+}
+
+// SetPreferences validates and replaces the user's preferences.
+func (r *Repository) SetPreferences(ctx context.Context, userID int64, p Preferences) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, `UPDATE users SET preferences = ? WHERE id = ?`, string(data), userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"time"
+
+	"magnetm3u8-gateway/internal/timefmt"
 )
 
 // Role definitions.
@@ -15,16 +17,38 @@ const (
 
 // User represents an account interacting with the gateway.
 type User struct {
-	ID           int64     `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"`
-	Role         string    `json:"role"`
-	IsBanned     bool      `json:"is_banned"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	IsBanned     bool   `json:"is_banned"`
+	Flagged      bool   `json:"flagged_for_review"`
+	// ExpiresAt is set for guest accounts and null for permanent ones.
+	ExpiresAt      timefmt.Time `json:"expires_at"`
+	SubmitDisabled bool         `json:"submit_disabled"`
+	CreatedAt      timefmt.Time `json:"created_at"`
+}
+
+// IsGuest reports whether the account is a time-limited guest.
+func (u *User) IsGuest() bool {
+	return !u.ExpiresAt.IsZero()
+}
+
+// Expired reports whether a guest account is past its expiry.
+func (u *User) Expired(now time.Time) bool {
+	return u.IsGuest() && !now.Before(u.ExpiresAt.Time)
+}
+
+// CanSubmit reports whether the account may submit new tasks.
+func (u *User) CanSubmit() bool {
+	return !u.SubmitDisabled
 }
 
 var ErrNotFound = errors.New("user not found")
 
+// ErrNotGuest is returned when a guest-only change targets a regular account.
+var ErrNotGuest = errors.New("user is not a guest")
+
 // Repository provides persistence helpers.
 type Repository struct {
 	db *sql.DB
@@ -49,18 +73,36 @@ func (r *Repository) Create(ctx context.Context, username, passwordHash, role st
 	return r.GetByID(ctx, id)
 }
 
+// CreateGuest creates a time-limited account that expires at expiresAt.
+func (r *Repository) CreateGuest(ctx context.Context, username, passwordHash string, expiresAt time.Time, submitDisabled bool) (*User, error) {
+	query := `INSERT INTO users (username, password_hash, role, expires_at, submit_disabled) VALUES (?, ?, ?, ?, ?)`
+	result, err := r.db.ExecContext(ctx, query, username, passwordHash, RoleUser, expiresAt.UTC().Truncate(time.Second), boolToInt(submitDisabled))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetByID(ctx, id)
+}
+
+const userColumns = `id, username, password_hash, role, is_banned, flagged_for_review, expires_at, submit_disabled, created_at`
+
 func (r *Repository) GetByUsername(ctx context.Context, username string) (*User, error) {
-	return r.get(ctx, `SELECT id, username, password_hash, role, is_banned, created_at FROM users WHERE username = ?`, username)
+	return r.get(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username)
 }
 
 func (r *Repository) GetByID(ctx context.Context, id int64) (*User, error) {
-	return r.get(ctx, `SELECT id, username, password_hash, role, is_banned, created_at FROM users WHERE id = ?`, id)
+	return r.get(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id)
 }
 
 func (r *Repository) get(ctx context.Context, query string, args ...interface{}) (*User, error) {
 	row := r.db.QueryRowContext(ctx, query, args...)
 	var u User
-	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.IsBanned, &u.CreatedAt); err != nil {
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.IsBanned, &u.Flagged, &u.ExpiresAt, &u.SubmitDisabled, &u.CreatedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
 		}
@@ -70,7 +112,7 @@ func (r *Repository) get(ctx context.Context, query string, args ...interface{})
 }
 
 func (r *Repository) List(ctx context.Context) ([]User, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT id, username, role, is_banned, created_at FROM users ORDER BY created_at DESC`)
+	rows, err := r.db.QueryContext(ctx, `SELECT id, username, role, is_banned, flagged_for_review, expires_at, submit_disabled, created_at FROM users ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +121,7 @@ func (r *Repository) List(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.IsBanned, &u.CreatedAt); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.IsBanned, &u.Flagged, &u.ExpiresAt, &u.SubmitDisabled, &u.CreatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -93,6 +135,69 @@ func (r *Repository) SetBanState(ctx context.Context, userID int64, banned bool)
 	return err
 }
 
+// SetFlagged marks or clears an account for manual review.
+func (r *Repository) SetFlagged(ctx context.Context, userID int64, flagged bool) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET flagged_for_review = ? WHERE id = ?`, boolToInt(flagged), userID)
+	return err
+}
+
+// SetExpiry extends a guest account to expiresAt. A zero expiresAt converts the
+// account to a permanent user and re-enables task submission. Regular accounts
+// are left alone and return ErrNotGuest.
+func (r *Repository) SetExpiry(ctx context.Context, userID int64, expiresAt time.Time) error {
+	var result sql.Result
+	var err error
+	if expiresAt.IsZero() {
+		result, err = r.db.ExecContext(ctx, `UPDATE users SET expires_at = NULL, submit_disabled = 0 WHERE id = ? AND expires_at IS NOT NULL`, userID)
+	} else {
+		result, err = r.db.ExecContext(ctx, `UPDATE users SET expires_at = ? WHERE id = ? AND expires_at IS NOT NULL`, expiresAt.UTC().Truncate(time.Second), userID)
+	}
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := r.GetByID(ctx, userID); err != nil {
+			return err
+		}
+		return ErrNotGuest
+	}
+	return nil
+}
+
+// DeleteExpiredGuests removes guest accounts that expired before now together
+// with their sessions and policy events. Tasks they submitted are kept without
+// an owner, as for any deleted user. It returns the number of deleted accounts.
+func (r *Repository) DeleteExpiredGuests(ctx context.Context, now time.Time) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const expired = `SELECT id FROM users WHERE expires_at IS NOT NULL AND expires_at <= ?`
+	cascade := []string{
+		`DELETE FROM sessions WHERE user_id IN (` + expired + `)`,
+		`DELETE FROM policy_events WHERE user_id IN (` + expired + `)`,
+		`UPDATE tasks SET owner_id = NULL WHERE owner_id IN (` + expired + `)`,
+	}
+	cutoff := now.UTC()
+	for _, stmt := range cascade {
+		if _, err := tx.ExecContext(ctx, stmt, cutoff); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE expires_at IS NOT NULL AND expires_at <= ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
 func (r *Repository) CountAdmins(ctx context.Context) (int, error) {
 	row := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE role = ?`, RoleAdmin)
 	var count int
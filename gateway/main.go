@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -13,19 +19,33 @@ import (
 	"magnetm3u8-gateway/internal/database"
 	"magnetm3u8-gateway/internal/http/router"
 	"magnetm3u8-gateway/internal/ice"
+	"magnetm3u8-gateway/internal/policy"
 	"magnetm3u8-gateway/internal/session"
+	"magnetm3u8-gateway/internal/task"
 	"magnetm3u8-gateway/internal/user"
 )
 
 var port = flag.String("port", "8080", "Gateway server port")
 
+// guestCleanupInterval is how often expired guest accounts are deleted.
+const guestCleanupInterval = 10 * time.Minute
+
+// shutdownTimeout is how long in-flight requests may finish after SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Parse()
 	_ = godotenv.Load(".env")
 
 	cfg := config.Load(*port)
 
+	// 收到SIGINT/SIGTERM时停止后台协程并关闭HTTP服务
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	manager := cluster.NewManager()
+	manager.SetSchedulingAlgorithm(cfg.SchedulingAlgorithm)
+	manager.SetClockSkewThreshold(time.Duration(cfg.ClockSkewWarnSeconds) * time.Second)
 	iceProvider := ice.NewIceServerProviderFromEnv()
 
 	db, err := database.Open(cfg.DBPath)
@@ -40,22 +60,43 @@ func main() {
 
 	userRepo := user.NewRepository(db)
 	sessionStore := session.NewStore(db)
+	taskRepo := task.NewRepository(db)
 	authService := auth.NewService(userRepo, sessionStore, cfg.SessionTTL)
 
+	blocklist, err := policy.NewBlocklist(policy.NewStore(db), userRepo, cfg.PolicyFlagThreshold, cfg.PolicyFlagWindow)
+	if err != nil {
+		log.Fatalf("加载黑名单失败: %v", err)
+	}
+
 	if err := authService.EnsureDefaultAdmin(context.Background(), cfg.AdminUsername, cfg.AdminPassword); err != nil {
 		log.Fatalf("初始化管理员账户失败: %v", err)
 	}
+	go authService.RunGuestCleanup(ctx, guestCleanupInterval)
 
 	engine := router.New(router.Dependencies{
+		Context:     ctx,
 		Config:      cfg,
 		Manager:     manager,
 		Ice:         iceProvider,
 		AuthService: authService,
 		UserRepo:    userRepo,
+		TaskRepo:    taskRepo,
+		Blocklist:   blocklist,
 	})
 
+	server := router.NewServer(cfg, engine)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("关闭Gateway Server失败: %v", err)
+		}
+	}()
+
 	log.Printf("Gateway Server 启动在端口 %s...", cfg.Port)
-	if err := engine.Run(":" + cfg.Port); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("启动Gateway Server失败: %v", err)
 	}
+	log.Printf("Gateway Server 已停止")
 }
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"log"
+
+	"worker/domain"
+	"worker/tasklog"
+	"worker/transcoder"
+)
+
+// handleBoostTask 用户打开任务页面时网关发送boost_task：任务标记为交互任务，
+// 正在排队的转码移到普通任务之前，尚未开始转码的任务在下载完成后按交互任务排队
+func (w *Worker) handleBoostTask(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"found":   false,
+		"success": false,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if _, exists := w.downloader.GetTask(taskID); !exists {
+		response["error"] = "task not found"
+		w.sendBoostTaskResponse(response)
+		return
+	}
+	response["found"] = true
+
+	if w.markInteractive(taskID) {
+		w.taskLog.Info(taskID, tasklog.SourceTranscode, "boosted: a viewer is waiting")
+	}
+	// 由转码队列在持有队列锁时应用，此刻尚未排队的转码加入队列时同样按交互任务排队
+	if position := w.transcoder.BoostTask(taskID); position > 0 {
+		response["queue_position"] = position
+	}
+	response["success"] = true
+	w.sendBoostTaskResponse(response)
+}
+
+func (w *Worker) sendBoostTaskResponse(response map[string]interface{}) {
+	if err := w.gateway.SendMessage(domain.MessageTypeBoostTaskResponse, response); err != nil {
+		log.Printf("Failed to send boost task response: %v", err)
+	}
+}
+
+// markInteractive 在任务元数据中记录interactive，返回是否是新标记的
+func (w *Worker) markInteractive(taskID string) bool {
+	marked := false
+	err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		if interactive, _ := metadata["interactive"].(bool); !interactive {
+			metadata["interactive"] = true
+			marked = true
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to mark task %s interactive: %v", taskID, err)
+		return false
+	}
+	return marked
+}
+
+// activeTranscode 任务正在排队或进行的转码，没有时返回nil
+func (w *Worker) activeTranscode(taskID string) *transcoder.TranscodeTask {
+	for _, job := range w.transcoder.GetAllTasks() {
+		if job.Options.TaskID != taskID {
+			continue
+		}
+		if job.Status == domain.TranscodeStatusPending || job.Status == domain.TranscodeStatusProcessing {
+			return job
+		}
+	}
+	return nil
+}
+
+// transcodeQueuePositions 各任务在转码等待队列中的位置，只包含正在排队的任务
+func (w *Worker) transcodeQueuePositions() map[string]int {
+	positions := make(map[string]int)
+	for _, job := range w.transcoder.GetAllTasks() {
+		if job.Options.TaskID == "" || job.QueuePosition == 0 {
+			continue
+		}
+		// 多视频任务的多个文件同时排队时取最靠前的位置
+		if position, queued := positions[job.Options.TaskID]; !queued || job.QueuePosition < position {
+			positions[job.Options.TaskID] = job.QueuePosition
+		}
+	}
+	return positions
+}
+
+// handleTranscodeQueueEvent 将转码排队、插队、抢占和恢复写入任务日志
+func (w *Worker) handleTranscodeQueueEvent(job *transcoder.TranscodeTask, event string) {
+	if job.Options.TaskID == "" {
+		return
+	}
+	w.taskLog.Info(job.Options.TaskID, tasklog.SourceTranscode, "transcode %s", event)
+}
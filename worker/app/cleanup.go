@@ -0,0 +1,103 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"worker/domain"
+	"worker/downloader"
+)
+
+// failedTaskSweepInterval 清理失败/已取消任务的检查周期
+const failedTaskSweepInterval = time.Hour
+
+// startFailedTaskSweeper 周期性删除失败或已取消且超过保留期的任务（含下载残留、转码输出与数据库记录），
+// 与只清理下载数据的prune janitor相互独立，置顶的任务永不删除
+func (w *Worker) startFailedTaskSweeper() {
+	retention := time.Duration(w.config.Storage.FailedTaskRetentionHours) * time.Hour
+	if retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(failedTaskSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.sweepFailedTasks(retention)
+	}
+}
+
+// sweepFailedTasks 删除在终止状态停留超过retention的任务，返回被删除的任务ID
+func (w *Worker) sweepFailedTasks(retention time.Duration) []string {
+	cutoff := w.now().Add(-retention)
+	repo := w.taskRepository()
+
+	var removed []string
+	for _, status := range []domain.TaskStatus{domain.TaskStatusError, domain.TaskStatusPermanentlyFailed, domain.TaskStatusCancelled} {
+		tasks, err := repo.GetByStatus(status)
+		if err != nil {
+			log.Printf("Failed to list %s tasks for cleanup: %v", status, err)
+			continue
+		}
+
+		for _, task := range tasks {
+			// 按进入失败状态的时间而不是updated_at判断，失败后保存元数据等修改不会推迟清理
+			if task.Pinned || task.FailedAt == nil || task.FailedAt.After(cutoff) {
+				continue
+			}
+
+			if _, err := w.downloader.PruneTaskData(task.TaskID, false); err != nil {
+				if errors.Is(err, downloader.ErrTaskActive) {
+					continue
+				}
+				log.Printf("Failed to prune data for task %s before removal: %v", task.TaskID, err)
+			}
+
+			if err := w.removeTask(&task, true); err != nil {
+				log.Printf("Failed to remove %s task %s: %v", status, task.TaskID, err)
+				continue
+			}
+
+			log.Printf("Removed %s task %s after retention period", status, task.TaskID)
+			removed = append(removed, task.TaskID)
+
+			if !w.gatewaySupports(domain.MessageTypeTaskRemoved) {
+				continue
+			}
+			if err := w.gateway.SendMessage(domain.MessageTypeTaskRemoved, map[string]interface{}{
+				"task_id": task.TaskID,
+				"reason":  "retention_expired",
+			}); err != nil {
+				log.Printf("Failed to notify gateway about removed task %s: %v", task.TaskID, err)
+			}
+		}
+	}
+
+	return removed
+}
+
+// handleTaskPin 置顶或取消置顶任务，置顶的任务不会被自动清理
+func (w *Worker) handleTaskPin(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	pinned, _ := payload["pinned"].(bool)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"pinned":  pinned,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if err := w.taskRepository().SetPinned(taskID, pinned); err != nil {
+		response["success"] = false
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskPinResponse, response); err != nil {
+		log.Printf("Failed to send task pin response: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"worker/models"
+	"worker/tasklog"
+)
+
+// requireComplete 任务是否要求下载与转码输出全部完成后才标记为ready：
+// 提交时带require_complete，或节点配置了transcode.require_complete
+func (w *Worker) requireComplete(task *models.Task) bool {
+	if w.config.Transcode.RequireComplete {
+		return true
+	}
+	metadata, _ := task.GetMetadata()
+	return metadata["require_complete"] == true
+}
+
+// incompleteOutput 要求完整输出的任务在标记ready之前检查各播放列表，
+// 输出不完整时判转码失败并返回true
+func (w *Worker) incompleteOutput(taskID string, playlists ...string) bool {
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil || !w.requireComplete(task) {
+		return false
+	}
+	for _, playlist := range playlists {
+		if err := checkPlaylistComplete(playlist, 0); err != nil {
+			w.taskLog.Error(taskID, tasklog.SourceTranscode, "output incomplete, not marking ready: %v", err)
+			w.failTask(taskID, failedStageTranscode)
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlaylistComplete 检查播放列表已结束（#EXT-X-ENDLIST）且引用的切片都在磁盘上。
+// 主播放列表逐一检查各码流的播放列表
+func checkPlaylistComplete(path string, depth int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	master := strings.Contains(string(data), "#EXT-X-STREAM-INF")
+	ended := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "://"):
+		case strings.HasSuffix(strings.ToLower(line), ".m3u8"):
+			if depth > 0 {
+				return fmt.Errorf("%s: nested playlist %s", filepath.Base(path), line)
+			}
+			if err := checkPlaylistComplete(filepath.Join(dir, filepath.FromSlash(line)), depth+1); err != nil {
+				return err
+			}
+		default:
+			if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(line))); err != nil || info.Size() == 0 {
+				return fmt.Errorf("%s: segment %s is missing", filepath.Base(path), line)
+			}
+		}
+	}
+	if !master && !ended {
+		return fmt.Errorf("%s has no #EXT-X-ENDLIST", filepath.Base(path))
+	}
+	return nil
+}
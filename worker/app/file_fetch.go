@@ -0,0 +1,111 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"worker/domain"
+	"worker/webrtc"
+)
+
+// maxFileFetchChunk 单次file_fetch最多返回的字节数，网关按块拉取大文件，节点不需要整个读入内存
+const maxFileFetchChunk = 1 << 20
+
+// handleFileFetch 读取任务输出目录（播放列表、切片、字幕等）中文件的一段，供网关的HTTP直通使用。
+// 文件名可以带码流子目录（如720p/index0.ts），只在任务自己的目录中查找（webrtc.ResolveTaskFilePath），
+// 不像数据通道那样到其它目录中查找旧的输出，令牌只能读取所属任务的文件。
+// 请求带offset和length，length为0时只返回文件大小与修改时间；每次最多返回maxFileFetchChunk字节。
+func (w *Worker) handleFileFetch(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	name, _ := payload["name"].(string)
+	offset, _ := payload["offset"].(float64)
+	length, _ := payload["length"].(float64)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"name":    name,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	// 网关带上客户端的播放令牌（/api/tasks/:id/stream/与/segments/）。支持令牌的网关每次都带令牌，
+	// 没有令牌的请求只可能来自不认识令牌的旧版网关
+	token, hasToken := payload["stream_token"].(string)
+	if (hasToken || w.gatewaySupports(domain.MessageTypeGetStreamToken)) && !w.validStreamToken(taskID, token) {
+		response["success"] = false
+		response["error"] = "invalid stream token"
+		response["forbidden"] = true
+	} else if err := w.readFileChunk(taskID, name, int64(offset), int64(length), response); err != nil {
+		response["success"] = false
+		response["error"] = err.Error()
+		if errors.Is(err, os.ErrNotExist) {
+			response["error"] = "file not found"
+			response["not_found"] = true
+		}
+	} else {
+		response["success"] = true
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeFileFetchResponse, response); err != nil {
+		log.Printf("Failed to send file fetch response: %v", err)
+	}
+}
+
+// readFileChunk 把文件的大小、修改时间和[offset, offset+length)范围内的数据写入response
+func (w *Worker) readFileChunk(taskID, name string, offset, length int64, response map[string]interface{}) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid range")
+	}
+	path, err := webrtc.ResolveTaskFilePath(taskID, name, w.config.Storage.M3U8Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return fmt.Errorf("invalid file name")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.ErrNotExist
+	}
+	response["size"] = info.Size()
+	response["mod_time"] = domain.FormatTime(info.ModTime())
+	response["offset"] = offset
+
+	if offset > info.Size() {
+		return fmt.Errorf("offset %d beyond end of file (%d bytes)", offset, info.Size())
+	}
+	if length > maxFileFetchChunk {
+		length = maxFileFetchChunk
+	}
+	if remaining := info.Size() - offset; length > remaining {
+		length = remaining
+	}
+
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && !(errors.Is(err, io.EOF) && int64(n) == length) {
+		return err
+	}
+	response["data"] = data[:n] // JSON中编码为base64
+	return nil
+}
+
+// isPlainFileName 只接受单级文件名，拒绝路径分隔符和"."、".."，避免读取任务目录之外的文件
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"worker/domain"
+	"worker/models"
+	"worker/transcoder"
+
+	"github.com/google/uuid"
+)
+
+// maxLocalMediaListing 单次列出的本地媒体文件上限
+const maxLocalMediaListing = 500
+
+// handleListLocalMedia 列出额外媒体目录中可转码的视频文件
+func (w *Worker) handleListLocalMedia(payload map[string]interface{}) {
+	response := map[string]interface{}{}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	files := make([]map[string]interface{}, 0)
+	truncated := false
+	for _, root := range w.config.Storage.ExtraMediaPaths {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entry.IsDir() || !isVideoFile(entry.Name()) {
+				return nil
+			}
+			if len(files) >= maxLocalMediaListing {
+				truncated = true
+				return filepath.SkipAll
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			files = append(files, map[string]interface{}{
+				"path": path,
+				"root": root,
+				"size": info.Size(),
+			})
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to list local media under %s: %v", root, err)
+		}
+	}
+
+	response["roots"] = w.config.Storage.ExtraMediaPaths
+	response["files"] = files
+	response["truncated"] = truncated
+
+	if err := w.gateway.SendMessage(domain.MessageTypeLocalMediaList, response); err != nil {
+		log.Printf("Failed to send local media list: %v", err)
+	}
+}
+
+// handleTranscodeLocal 为额外媒体目录中的文件创建独立的转码任务（无磁力链接），
+// 之后与下载完成的任务走相同的转码→ready流程
+func (w *Worker) handleTranscodeLocal(payload map[string]interface{}) {
+	response := map[string]interface{}{"success": false}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	task, err := w.createLocalTranscodeTask(payload["path"])
+	if err != nil {
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+		response["task_id"] = task.TaskID
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTranscodeLocalResponse, response); err != nil {
+		log.Printf("Failed to send transcode_local response: %v", err)
+	}
+}
+
+func (w *Worker) createLocalTranscodeTask(rawPath interface{}) (*models.Task, error) {
+	path, _ := rawPath.(string)
+	if path == "" {
+		return nil, errors.New("path is required")
+	}
+
+	resolved, err := transcoder.ResolveInput(path, w.config.Storage.ExtraMediaPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() || !isVideoFile(resolved) {
+		return nil, errors.New("path is not a video file")
+	}
+
+	task := &models.Task{
+		TaskID:      uuid.New().String(),
+		TorrentName: filepath.Base(resolved),
+		Size:        info.Size(),
+		Downloaded:  info.Size(),
+		Progress:    100,
+		Status:      domain.TaskStatusTranscoding,
+		WorkerID:    w.config.Node.ID,
+	}
+	task.SetMetadata(map[string]interface{}{
+		"source":       "local",
+		"input_path":   resolved,
+		streamTokenKey: newStreamToken(),
+	})
+
+	if err := w.taskRepository().Create(task); err != nil {
+		return nil, err
+	}
+
+	if err := w.gateway.SendTaskStatus(task.TaskID, domain.TaskStatusTranscoding, 0, nil); err != nil {
+		log.Printf("Failed to notify gateway about local task %s: %v", task.TaskID, err)
+	}
+
+	go w.startTranscodingForTask(task, resolved)
+	return task, nil
+}
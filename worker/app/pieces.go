@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+
+	"worker/domain"
+	"worker/downloader"
+)
+
+// handleGetTaskPieces 返回任务视频文件的分片可用性，并按探测到的时长换算每个分片对应的播放时间
+func (w *Worker) handleGetTaskPieces(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"found":   false,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	pieces, err := w.downloader.PieceAvailability(taskID)
+	switch {
+	case err == nil:
+		response["found"] = true
+		response["pieces"] = pieces
+
+		duration := w.mediaDuration(taskID, pieces.FilePath)
+		response["duration_seconds"] = duration
+		if duration > 0 && pieces.FileSize > 0 && pieces.PieceLength > 0 {
+			response["seconds_per_piece"] = duration * float64(pieces.PieceLength) / float64(pieces.FileSize)
+		}
+	case errors.Is(err, downloader.ErrPiecesUnavailable):
+		response["found"] = true
+		response["error"] = err.Error()
+	default:
+		log.Printf("Failed to get piece availability for task %s: %v", taskID, err)
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskPiecesResponse, response); err != nil {
+		log.Printf("Failed to send task pieces response: %v", err)
+	}
+}
+
+// mediaDuration 探测并缓存任务视频文件的时长，部分下载的文件可能探测失败，此时返回0且不缓存
+func (w *Worker) mediaDuration(taskID, filePath string) float64 {
+	if filePath == "" {
+		return 0
+	}
+
+	w.durationMu.Lock()
+	duration, ok := w.mediaDurations[taskID]
+	w.durationMu.Unlock()
+	if ok {
+		return duration
+	}
+
+	info, err := w.transcoder.Probe(filepath.Join(w.config.Storage.DownloadPath, filePath))
+	if err != nil || info.DurationSeconds <= 0 {
+		return 0
+	}
+
+	w.durationMu.Lock()
+	w.mediaDurations[taskID] = info.DurationSeconds
+	w.durationMu.Unlock()
+	return info.DurationSeconds
+}
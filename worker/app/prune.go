@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"worker/domain"
+	"worker/downloader"
+	"worker/models"
+	"worker/tasklog"
+)
+
+// pruneJanitorInterval 自动清理失败任务残留数据的检查周期
+const pruneJanitorInterval = time.Hour
+
+// startPruneJanitor 周期性清理失败时间超过保留期的任务的下载数据
+func (w *Worker) startPruneJanitor() {
+	retention := time.Duration(w.config.Storage.PruneErrorAfterHours) * time.Hour
+	if retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(pruneJanitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.pruneStaleErrorTasks(retention)
+	}
+}
+
+func (w *Worker) pruneStaleErrorTasks(retention time.Duration) {
+	var tasks []models.Task
+	for _, status := range []domain.TaskStatus{domain.TaskStatusError, domain.TaskStatusPermanentlyFailed} {
+		failed, err := w.taskRepository().GetByStatus(status)
+		if err != nil {
+			log.Printf("Failed to list %s tasks for pruning: %v", status, err)
+			return
+		}
+		tasks = append(tasks, failed...)
+	}
+
+	cutoff := w.now().Add(-retention)
+	for _, task := range tasks {
+		if task.UpdatedAt.After(cutoff) {
+			continue
+		}
+		if metadata, _ := task.GetMetadata(); metadata["data_pruned"] == true {
+			continue
+		}
+
+		result, err := w.downloader.PruneTaskData(task.TaskID, false)
+		if err != nil {
+			log.Printf("Failed to prune data for task %s: %v", task.TaskID, err)
+			continue
+		}
+		atomic.AddInt64(&w.prunedBytes, result.ReclaimedBytes)
+		log.Printf("Pruned %d bytes of partial data for failed task %s", result.ReclaimedBytes, task.TaskID)
+	}
+}
+
+// handlePruneTaskData 处理网关的显式清理请求，dry_run只报告将被删除的文件
+func (w *Worker) handlePruneTaskData(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	dryRun, _ := payload["dry_run"].(bool)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"dry_run": dryRun,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	result, err := w.downloader.PruneTaskData(taskID, dryRun)
+	switch {
+	case err == nil:
+		response["success"] = true
+		response["files"] = result.Files
+		response["reclaimed_bytes"] = result.ReclaimedBytes
+		if !dryRun {
+			atomic.AddInt64(&w.prunedBytes, result.ReclaimedBytes)
+		}
+	case errors.Is(err, downloader.ErrTaskActive):
+		response["success"] = false
+		response["error"] = "task is still active"
+	default:
+		response["success"] = false
+		response["error"] = err.Error()
+		w.taskLog.Warn(taskID, tasklog.SourceTask, "prune request failed: %v", err)
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypePruneTaskDataResponse, response); err != nil {
+		log.Printf("Failed to send prune response: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"worker/domain"
+)
+
+// quietCheckInterval 检查是否进入或离开计划静默时段的间隔
+const quietCheckInterval = 30 * time.Second
+
+// 心跳中上报的节点状态
+const (
+	nodeStateActive = "active"
+	nodeStateQuiet  = "quiet"
+)
+
+// startQuietHours 定期按配置的静默时段进入或离开静默状态，没有配置时段时不运行
+func (w *Worker) startQuietHours() {
+	if len(w.config.QuietHours.ParsedWindows()) == 0 {
+		return
+	}
+	w.syncQuiet()
+
+	ticker := time.NewTicker(quietCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.syncQuiet()
+	}
+}
+
+// inQuietWindow 当前时间是否在某个配置的静默时段内
+func (w *Worker) inQuietWindow() bool {
+	now := w.now()
+	for _, window := range w.config.QuietHours.ParsedWindows() {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncQuiet 按手动暂停与计划时段计算是否静默，状态变化时暂停或恢复下载与转码，
+// 并立即发送心跳让网关停止或恢复向本节点分派任务。WebRTC文件服务始终不受影响
+func (w *Worker) syncQuiet() bool {
+	quiet, changed := w.applyQuiet()
+	if changed {
+		if err := w.gateway.SendHeartbeat(w.heartbeatMetrics()); err != nil {
+			log.Printf("Failed to send heartbeat after quiet mode change: %v", err)
+		}
+	}
+	return quiet
+}
+
+// applyQuiet 计算是否静默，状态变化时暂停或恢复下载与转码，返回当前状态与是否变化
+func (w *Worker) applyQuiet() (quiet, changed bool) {
+	scheduled := w.inQuietWindow()
+
+	w.quietMu.Lock()
+	if !scheduled {
+		// 时段结束后，下一个时段重新生效
+		w.quietResumed = false
+	}
+	quiet = w.quietManual || (scheduled && !w.quietResumed)
+	changed = quiet != w.quietActive
+	w.quietActive = quiet
+	manual := w.quietManual
+	w.quietMu.Unlock()
+	if !changed {
+		return quiet, false
+	}
+
+	w.downloader.SetQuiet(quiet)
+	w.transcoder.SetQuiet(quiet, w.config.QuietHours.SuspendTranscodes)
+	switch {
+	case quiet && manual:
+		log.Printf("Entering quiet mode on request: downloads, seeding and transcodes paused, playback continues")
+	case quiet:
+		log.Printf("Entering quiet hours: downloads, seeding and transcodes paused, playback continues")
+	default:
+		log.Printf("Leaving quiet mode: downloads and transcodes resumed")
+	}
+	return quiet, true
+}
+
+// isQuiet 节点当前是否处于静默状态
+func (w *Worker) isQuiet() bool {
+	w.quietMu.Lock()
+	defer w.quietMu.Unlock()
+	return w.quietActive
+}
+
+// handlePauseAll 网关管理员要求立即静默，直到resume_all。重启后仍然静默
+func (w *Worker) handlePauseAll(payload map[string]interface{}) {
+	w.quietMu.Lock()
+	w.quietManual = true
+	w.quietMu.Unlock()
+	w.saveQuietState(quietState{Manual: true})
+	w.respondQuiet(domain.MessageTypePauseAllResponse, payload, w.syncQuiet())
+}
+
+// handleResumeAll 结束手动静默；在计划时段内收到时本次时段也不再静默，期间重启也一样
+func (w *Worker) handleResumeAll(payload map[string]interface{}) {
+	scheduled := w.inQuietWindow()
+	w.quietMu.Lock()
+	w.quietManual = false
+	w.quietResumed = scheduled
+	w.quietMu.Unlock()
+	state := quietState{}
+	if scheduled {
+		state.ResumedAt = w.now()
+	}
+	w.saveQuietState(state)
+	w.respondQuiet(domain.MessageTypeResumeAllResponse, payload, w.syncQuiet())
+}
+
+// quietState 保存在Dependencies.QuietStatePath中的手动静默状态
+type quietState struct {
+	Manual    bool      `json:"manual"`               // pause_all之后、resume_all之前
+	ResumedAt time.Time `json:"resumed_at,omitempty"` // 计划时段内收到resume_all的时间
+}
+
+// saveQuietState 写入手动静默状态，先写临时文件再改名，重启时不会读到写了一半的文件
+func (w *Worker) saveQuietState(state quietState) {
+	if w.quietStatePath == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Failed to encode quiet state: %v", err)
+		return
+	}
+	tmp := w.quietStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Failed to save quiet state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, w.quietStatePath); err != nil {
+		os.Remove(tmp)
+		log.Printf("Failed to save quiet state: %v", err)
+	}
+}
+
+// restoreQuietState 启动时恢复上次运行的手动静默：pause_all之后重启仍然静默；计划时段内resume_all之后
+// 重启，只要这段时间一直在静默时段内，本次时段仍不静默。只暂停下载与转码，网关连接后由心跳得知状态
+func (w *Worker) restoreQuietState() {
+	if w.quietStatePath == "" {
+		return
+	}
+	data, err := os.ReadFile(w.quietStatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read quiet state: %v", err)
+		}
+		return
+	}
+	var state quietState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Ignoring unreadable quiet state %s: %v", w.quietStatePath, err)
+		return
+	}
+
+	w.quietMu.Lock()
+	w.quietManual = state.Manual
+	w.quietResumed = !state.ResumedAt.IsZero() && w.quietThroughout(state.ResumedAt, w.now())
+	w.quietMu.Unlock()
+	if state.Manual {
+		log.Printf("Restoring quiet mode requested before the restart")
+	}
+	w.applyQuiet()
+}
+
+// quietThroughout from到to之间是否一直处于计划静默时段内，按分钟检查，跨度超过一天时为false
+func (w *Worker) quietThroughout(from, to time.Time) bool {
+	if to.Before(from) || to.Sub(from) > 24*time.Hour {
+		return false
+	}
+	windows := w.config.QuietHours.ParsedWindows()
+	inWindow := func(t time.Time) bool {
+		for _, window := range windows {
+			if window.Contains(t) {
+				return true
+			}
+		}
+		return false
+	}
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		if !inWindow(t) {
+			return false
+		}
+	}
+	return inWindow(to)
+}
+
+// respondQuiet 回复pause_all/resume_all，附带节点当前是否静默
+func (w *Worker) respondQuiet(msgType domain.MessageType, payload map[string]interface{}, quiet bool) {
+	state := nodeStateActive
+	if quiet {
+		state = nodeStateQuiet
+	}
+	response := map[string]interface{}{
+		"success": true,
+		"quiet":   quiet,
+		"state":   state,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+	if err := w.gateway.SendMessage(msgType, response); err != nil {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+}
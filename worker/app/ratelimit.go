@@ -0,0 +1,40 @@
+package app
+
+import (
+	"log"
+
+	"worker/domain"
+)
+
+// handleSetRateLimit 网关管理员在运行中调整整个节点的种子下载与上传限速（kbps），0表示不限速。
+// 未给出的方向恢复为配置的network.max_bandwidth_kbps；调整不写回配置，重启后仍按配置限速
+func (w *Worker) handleSetRateLimit(payload map[string]interface{}) {
+	down := w.config.Network.MaxBandwidth
+	if value, ok := payload["down_kbps"].(float64); ok {
+		down = int(value)
+	}
+	up := w.config.Network.MaxBandwidth
+	if value, ok := payload["up_kbps"].(float64); ok {
+		up = int(value)
+	}
+
+	response := map[string]interface{}{
+		"down_kbps": down,
+		"up_kbps":   up,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if down < 0 || up < 0 {
+		response["success"] = false
+		response["error"] = "rate limits must not be negative"
+	} else {
+		w.downloader.SetRateLimit(down, up)
+		response["success"] = true
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeSetRateLimitResponse, response); err != nil {
+		log.Printf("Failed to send set rate limit response: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+	"worker/transcoder"
+)
+
+// 切片修复结果
+const (
+	RepairStatusHealthy          = "healthy"           // 检查未发现问题，未重新生成
+	RepairStatusRepaired         = "repaired"          // 已从源文件重新生成
+	RepairStatusNeedsRetranscode = "needs_retranscode" // 源文件已删除，需要重新下载并转码
+)
+
+// errSegmentNotFound 任务或播放列表中没有该切片
+var errSegmentNotFound = errors.New("segment not found")
+
+// repairSegment 检查任务的一个切片，损坏（或force）时用ffmpeg从仍在的源文件重新生成。
+// 源文件已被删除时在任务元数据中标记needs_retranscode。结果写入任务日志。
+// 纯音频任务的切片位于各曲目的子目录中，name为trackNN/<切片名>
+func (w *Worker) repairSegment(taskID, name string, force bool) (string, *transcoder.SegmentCheck, error) {
+	if !strings.EqualFold(filepath.Ext(name), ".ts") {
+		return "", nil, fmt.Errorf("invalid segment name %q", name)
+	}
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil || task.M3U8FilePath == "" {
+		return "", nil, errSegmentNotFound
+	}
+	source, err := w.segmentSource(task, name)
+	if err != nil {
+		return "", nil, err
+	}
+	segments, err := transcoder.ParsePlaylist(source.playlist)
+	if err != nil {
+		return "", nil, fmt.Errorf("read playlist: %w", err)
+	}
+	index := -1
+	for i, segment := range segments {
+		if segment.Name == source.name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return "", nil, errSegmentNotFound
+	}
+
+	// 串行化修复，同一切片被多个播放器同时报告时只重新生成一次
+	w.repairMu.Lock()
+	defer w.repairMu.Unlock()
+
+	dir := filepath.Dir(source.playlist)
+	check := transcoder.VerifySegment(dir, segments, index)
+	if check.Healthy && !force {
+		w.taskLog.Info(taskID, tasklog.SourceTranscode, "segment %s reported bad but verified healthy (%d bytes)", name, check.Size)
+		return RepairStatusHealthy, &check, nil
+	}
+	reason := check.Reason
+	if check.Healthy {
+		reason = "forced"
+	}
+
+	inputPath := source.input
+	if inputPath != "" {
+		if _, err := os.Stat(inputPath); err != nil {
+			inputPath = ""
+		}
+	}
+	if inputPath == "" {
+		w.markNeedsRetranscode(taskID)
+		w.taskLog.Warn(taskID, tasklog.SourceTranscode, "segment %s is bad (%s) and the source file is gone; task needs a re-transcode", name, reason)
+		return RepairStatusNeedsRetranscode, &check, nil
+	}
+
+	w.taskLog.Info(taskID, tasklog.SourceTranscode, "regenerating segment %s (%s)", name, reason)
+	if source.audio {
+		err = transcoder.RegenerateAudioSegment(inputPath, dir, segments[index])
+	} else {
+		err = transcoder.RegenerateSegment(inputPath, dir, segments[index], w.transcoder.RepairStrategy(outputStrategy(task)))
+	}
+	if err != nil {
+		w.taskLog.Error(taskID, tasklog.SourceTranscode, "failed to regenerate segment %s: %v", name, err)
+		return "", &check, err
+	}
+	w.webrtc.ForgetFile(taskID, name)
+	w.taskLog.Info(taskID, tasklog.SourceTranscode, "segment %s repaired", name)
+	return RepairStatusRepaired, &check, nil
+}
+
+// outputStrategy 生成任务输出的转码策略名称，取自任务元数据transcode_attempts中成功的一次，
+// 没有记录时返回空字符串
+func outputStrategy(task *models.Task) string {
+	metadata, _ := task.GetMetadata()
+	attempts, _ := metadata["transcode_attempts"].([]interface{})
+	for i := len(attempts) - 1; i >= 0; i-- {
+		attempt, _ := attempts[i].(map[string]interface{})
+		if success, _ := attempt["success"].(bool); success {
+			name, _ := attempt["strategy"].(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// segmentSource 一个切片所在的播放列表、在播放列表中的名字和生成它的源文件
+type segmentSource struct {
+	playlist string
+	name     string
+	input    string // 源文件，已找不到时为空
+	audio    bool
+}
+
+// segmentSource 按转码时选择输入的规则找到切片的源文件：纯音频任务为曲目子目录对应的曲目
+// （曲目按audioTracks的顺序编号），其它任务为transcodeInput选出的视频
+func (w *Worker) segmentSource(task *models.Task, name string) (segmentSource, error) {
+	metadata, _ := task.GetMetadata()
+	if metadata["media_type"] != transcoder.MediaTypeAudio {
+		if !isPlainFileName(name) {
+			return segmentSource{}, fmt.Errorf("invalid segment name %q", name)
+		}
+		input, _ := w.transcodeInput(task)
+		return segmentSource{playlist: task.M3U8FilePath, name: name, input: input}, nil
+	}
+
+	track, segment, ok := strings.Cut(name, "/")
+	var number int
+	if !ok || !isPlainFileName(segment) || len(track) != len("track00") {
+		return segmentSource{}, fmt.Errorf("invalid segment name %q", name)
+	}
+	if _, err := fmt.Sscanf(track, "track%02d", &number); err != nil || number < 1 {
+		return segmentSource{}, fmt.Errorf("invalid segment name %q", name)
+	}
+	source := segmentSource{
+		playlist: filepath.Join(filepath.Dir(task.M3U8FilePath), track, "index.m3u8"),
+		name:     segment,
+		audio:    true,
+	}
+	if tracks := w.audioTracks(task); number <= len(tracks) {
+		source.input = tracks[number-1]
+	}
+	return source, nil
+}
+
+// markNeedsRetranscode 在任务元数据中记录needs_retranscode
+func (w *Worker) markNeedsRetranscode(taskID string) {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		log.Printf("Failed to load task %s: %v", taskID, err)
+		return
+	}
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["needs_retranscode"] = true
+	if err := task.SetMetadata(metadata); err != nil {
+		log.Printf("Failed to set task metadata: %v", err)
+		return
+	}
+	if err := repo.Update(task); err != nil {
+		log.Printf("Failed to flag task %s for re-transcode: %v", taskID, err)
+	}
+}
+
+// handleDataChannelRepair 播放器通过数据通道报告的损坏切片
+func (w *Worker) handleDataChannelRepair(taskID, name string) (string, error) {
+	status, _, err := w.repairSegment(taskID, name, false)
+	return status, err
+}
+
+// handleRepairSegment 处理网关转发的切片修复请求，force为true时即使检查通过也重新生成
+func (w *Worker) handleRepairSegment(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	name, _ := payload["name"].(string)
+	force, _ := payload["force"].(bool)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"name":    name,
+		"success": false,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	status, check, err := w.repairSegment(taskID, name, force)
+	switch {
+	case err == nil:
+		response["success"] = true
+		response["status"] = status
+	case errors.Is(err, errSegmentNotFound):
+		response["not_found"] = true
+		response["error"] = err.Error()
+	default:
+		response["error"] = err.Error()
+	}
+	if check != nil {
+		response["check"] = check
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeRepairSegmentResponse, response); err != nil {
+		log.Printf("Failed to send repair segment response: %v", err)
+	}
+}
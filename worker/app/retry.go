@@ -0,0 +1,171 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"worker/domain"
+	"worker/tasklog"
+)
+
+// 失败的阶段，记录在任务元数据的failed_stage中，重试时从该阶段重新开始
+const (
+	failedStageDownload  = "download"
+	failedStageTranscode = "transcode"
+)
+
+// defaultRetryBackoff 第一次自动重试前的等待时间
+const defaultRetryBackoff = 30 * time.Second
+
+// failTask 记录任务在某个阶段失败。未达到重试上限时稍后自动重试该阶段，
+// 达到上限后标记为永久失败，不再自动重试。错误码不可重试（磁力链接无效、被策略拦截、元数据超限等）
+// 或元数据标记retryable为false的失败保持错误状态。每次失败都把错误码与原因通知网关
+func (w *Worker) failTask(taskID, stage string) {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		log.Printf("Failed to load failed task %s: %v", taskID, err)
+		return
+	}
+
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["failed_stage"] = stage
+	task.SetMetadata(metadata)
+	if stage == failedStageTranscode {
+		task.ErrorCode = domain.ErrorCodeTranscodeFailed
+	}
+
+	maxRetries := w.config.Limits.MaxRetries
+	retryable := metadata["retryable"] != false && (task.ErrorCode == "" || task.ErrorCode.Retryable())
+
+	switch {
+	case !retryable || maxRetries <= 0:
+		task.Status = domain.TaskStatusError
+	case task.RetryCount < maxRetries:
+		task.RetryCount++
+		task.Status = domain.TaskStatusError
+	default:
+		task.Status = domain.TaskStatusPermanentlyFailed
+	}
+	task.UpdatedAt = w.now()
+	if err := repo.Update(task); err != nil {
+		log.Printf("Failed to record failure of task %s: %v", taskID, err)
+		return
+	}
+
+	statusMeta := map[string]interface{}{
+		"retry_count":  task.RetryCount,
+		"failed_stage": stage,
+		"retryable":    retryable && task.Status != domain.TaskStatusPermanentlyFailed,
+	}
+	if reason, ok := metadata["error"]; ok {
+		statusMeta["error"] = reason
+	}
+	if task.ErrorCode != "" {
+		statusMeta["error_code"] = task.ErrorCode
+	}
+	if err := w.gateway.SendTaskStatus(taskID, task.Status, task.Progress, statusMeta); err != nil {
+		log.Printf("Failed to notify gateway about failed task %s: %v", taskID, err)
+	}
+
+	if task.Status == domain.TaskStatusPermanentlyFailed {
+		log.Printf("Task %s permanently failed after %d retries", taskID, task.RetryCount)
+		w.taskLog.Error(taskID, tasklog.SourceTask, "%s failed after %d retries, giving up", stage, task.RetryCount)
+		return
+	}
+	if !retryable || maxRetries <= 0 {
+		if task.ErrorCode != "" {
+			w.taskLog.Error(taskID, tasklog.SourceTask, "%s failed with %s, not retrying automatically", stage, task.ErrorCode)
+		}
+		return
+	}
+
+	delay := w.retryBackoff * time.Duration(task.RetryCount)
+	w.taskLog.Warn(taskID, tasklog.SourceTask, "%s failed, retry %d/%d in %s", stage, task.RetryCount, maxRetries, delay)
+	time.AfterFunc(delay, func() {
+		if err := w.retryStage(taskID, stage); err != nil {
+			log.Printf("Failed to retry task %s: %v", taskID, err)
+		}
+	})
+}
+
+// retryStage 从失败的阶段重新开始任务
+func (w *Worker) retryStage(taskID, stage string) error {
+	if stage != failedStageTranscode {
+		return w.downloader.RetryTask(taskID)
+	}
+
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	// 与下载完成时选择同样的输入，纯音频任务重新转码其曲目
+	start, err := w.transcodeStarter(task)
+	if err != nil {
+		return err
+	}
+	if start == nil {
+		return errors.New("no video or audio file to transcode")
+	}
+
+	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusTranscoding, task.Progress, nil); err != nil {
+		log.Printf("Failed to notify gateway about retried task %s: %v", taskID, err)
+	}
+	go start()
+	return nil
+}
+
+// handleTaskRetry 手动重试失败或永久失败的任务，重试计数清零
+func (w *Worker) handleTaskRetry(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	w.recordPrivateConsent(taskID, payload)
+	if err := w.retryTask(taskID); err != nil {
+		response["success"] = false
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskRetryResponse, response); err != nil {
+		log.Printf("Failed to send task retry response: %v", err)
+	}
+}
+
+func (w *Worker) retryTask(taskID string) error {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	if task.Status != domain.TaskStatusError && task.Status != domain.TaskStatusPermanentlyFailed {
+		return fmt.Errorf("task %s is %s, only failed tasks can be retried", taskID, task.Status)
+	}
+
+	metadata, _ := task.GetMetadata()
+	stage, _ := metadata["failed_stage"].(string)
+	if metadata != nil {
+		delete(metadata, "retryable")
+		task.SetMetadata(metadata)
+	}
+	task.ErrorCode = ""
+	task.RetryCount = 0
+	if err := repo.Update(task); err != nil {
+		return err
+	}
+
+	w.taskLog.Info(taskID, tasklog.SourceTask, "manual retry requested")
+	return w.retryStage(taskID, stage)
+}
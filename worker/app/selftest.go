@@ -0,0 +1,261 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"worker/client"
+	"worker/config"
+	"worker/database"
+	"worker/diskspace"
+	"worker/domain"
+	"worker/downloader"
+	"worker/transcoder"
+	"worker/webrtc"
+)
+
+const (
+	selfTestGatewayTimeout = 5 * time.Second
+	selfTestICETimeout     = 5 * time.Second
+)
+
+// SelfTestResult is the outcome of a single self-test check.
+type SelfTestResult struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// SelfTestReport aggregates the results of all self-test checks.
+type SelfTestReport struct {
+	NodeID  string           `json:"node_id"`
+	Passed  bool             `json:"passed"`
+	Results []SelfTestResult `json:"results"`
+}
+
+type selfTestCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// RunSelfTest exercises the worker's subsystems using the same code paths as a
+// normal start: config validation, storage, database, ffmpeg, STUN, gateway
+// registration and ICE server retrieval.
+func RunSelfTest(cfg *config.Config) SelfTestReport {
+	w := &Worker{config: cfg, now: time.Now}
+	return runSelfTestChecks(cfg.Node.ID, w.selfTestChecks())
+}
+
+func runSelfTestChecks(nodeID string, checks []selfTestCheck) SelfTestReport {
+	report := SelfTestReport{NodeID: nodeID, Passed: true}
+
+	for _, check := range checks {
+		start := time.Now()
+		detail, err := check.run()
+
+		result := SelfTestResult{
+			Name:       check.name,
+			Passed:     err == nil,
+			Detail:     detail,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	return report
+}
+
+func (w *Worker) selfTestChecks() []selfTestCheck {
+	return []selfTestCheck{
+		{name: "config", run: w.checkConfig},
+		{name: "storage", run: w.checkStorage},
+		{name: "database", run: checkDatabase},
+		{name: "listen_port", run: w.checkListenPort},
+		{name: "ffmpeg", run: checkFFmpegTools},
+		{name: "transcode", run: w.checkTranscode},
+		{name: "stun", run: w.checkSTUN},
+		{name: "gateway", run: w.checkGatewayRegistration},
+		{name: "ice_servers", run: w.checkICEServers},
+	}
+}
+
+func (w *Worker) checkListenPort() (string, error) {
+	port := w.config.Network.ListenPort
+	if port == 0 {
+		return "automatic port assignment", nil
+	}
+	if err := downloader.CheckListenPort(port); err != nil {
+		return "", fmt.Errorf("torrent listen port %d unavailable: %w", port, err)
+	}
+	return fmt.Sprintf("port %d can be bound for TCP and UDP", port), nil
+}
+
+func (w *Worker) checkConfig() (string, error) {
+	if err := w.config.Validate(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("node %s, gateway %s", w.config.Node.ID, strings.Join(w.config.Gateway.Endpoints(), ", ")), nil
+}
+
+func (w *Worker) checkStorage() (string, error) {
+	if err := w.config.GetStoragePaths(); err != nil {
+		return "", fmt.Errorf("create storage paths: %w", err)
+	}
+
+	var details []string
+	for _, dir := range []string{w.config.Storage.DownloadPath, w.config.Storage.M3U8Path, w.config.Storage.TaskLogPath} {
+		if dir == "" {
+			continue
+		}
+
+		probe, err := os.CreateTemp(dir, ".selftest-*")
+		if err != nil {
+			return "", fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+
+		free, err := diskspace.Available(dir)
+		if err != nil {
+			details = append(details, fmt.Sprintf("%s writable (free space unknown)", dir))
+			continue
+		}
+		details = append(details, fmt.Sprintf("%s writable, %.1f GB free", dir, float64(free)/(1<<30)))
+	}
+
+	return strings.Join(details, "; "), nil
+}
+
+func checkDatabase() (string, error) {
+	if err := database.Initialize("data/config"); err != nil {
+		return "", err
+	}
+	if err := database.Close(); err != nil {
+		return "", err
+	}
+	return "opened and migrated data/config/worker.db", nil
+}
+
+func checkFFmpegTools() (string, error) {
+	var versions []string
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		version, err := transcoder.ToolVersion(tool)
+		if err != nil {
+			return "", err
+		}
+		versions = append(versions, version)
+	}
+	return strings.Join(versions, "; "), nil
+}
+
+func (w *Worker) checkTranscode() (string, error) {
+	dir, err := os.MkdirTemp("", "worker-selftest-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "pattern.mp4")
+	if err := transcoder.GenerateTestPattern(input, 1); err != nil {
+		return "", fmt.Errorf("generate test pattern: %w", err)
+	}
+
+	playlist, err := transcoder.ConvertToHLS(input, filepath.Join(dir, "hls"), transcoder.DefaultHLSConfig())
+	if err != nil {
+		return "", fmt.Errorf("convert to HLS: %w", err)
+	}
+
+	segments, err := w.readSegmentsFromM3U8(playlist)
+	if err != nil {
+		return "", err
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("playlist %s has no segments", filepath.Base(playlist))
+	}
+	return fmt.Sprintf("%d segment(s) produced", len(segments)), nil
+}
+
+func (w *Worker) checkSTUN() (string, error) {
+	if len(w.config.Network.STUNServers) == 0 {
+		return "", fmt.Errorf("no STUN servers configured")
+	}
+
+	manager := webrtc.New()
+	manager.UpdateConfiguration(w.composeWebRTCConfiguration(nil))
+
+	types, err := manager.GatherCandidates(selfTestICETimeout)
+	if err != nil {
+		return "", err
+	}
+	for _, candidateType := range types {
+		if candidateType == "srflx" {
+			return fmt.Sprintf("%d candidate(s), server-reflexive address discovered", len(types)), nil
+		}
+	}
+	return "", fmt.Errorf("no server-reflexive candidate from %d candidate(s); STUN unreachable", len(types))
+}
+
+func (w *Worker) checkGatewayRegistration() (string, error) {
+	// 使用独立的节点ID，避免顶替同ID的在线节点
+	nodeID := w.config.Node.ID + "-selftest"
+	gateway := client.NewWithURLs(w.config.Gateway.Endpoints(), nodeID)
+
+	confirmed := make(chan struct{}, 1)
+	rejected := make(chan string, 1)
+	gateway.SetMessageHandler(func(msgType domain.MessageType, payload map[string]interface{}) {
+		switch msgType {
+		case domain.MessageTypeRegistrationConfirmed:
+			select {
+			case confirmed <- struct{}{}:
+			default:
+			}
+		case domain.MessageTypeRegistrationRejected:
+			reason, _ := payload["reason"].(string)
+			select {
+			case rejected <- reason:
+			default:
+			}
+		}
+	})
+
+	nodeInfo := domain.NodeInfo{
+		ID:       nodeID,
+		Name:     w.config.Node.Name + " (selftest)",
+		Address:  w.config.Node.Address,
+		Status:   domain.WorkerStatusOnline,
+		Metadata: map[string]string{"selftest": "true"},
+
+		ProtocolVersion:    domain.ProtocolVersion,
+		MinProtocolVersion: domain.MinProtocolVersion,
+	}
+	if err := gateway.Connect(nodeInfo); err != nil {
+		return "", fmt.Errorf("dial gateway: %w", err)
+	}
+	defer gateway.Disconnect()
+
+	select {
+	case <-confirmed:
+		return fmt.Sprintf("registered as %s at %s", nodeID, gateway.ActiveURL()), nil
+	case reason := <-rejected:
+		return "", fmt.Errorf("registration rejected: %s", reason)
+	case <-time.After(selfTestGatewayTimeout):
+		return "", fmt.Errorf("no registration confirmation within %s", selfTestGatewayTimeout)
+	}
+}
+
+func (w *Worker) checkICEServers() (string, error) {
+	servers, ttl, err := w.fetchTurnServersFromGateway()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d ICE server(s), ttl %s", len(servers), ttl), nil
+}
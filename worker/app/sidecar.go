@@ -0,0 +1,140 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"worker/domain"
+	"worker/transcoder"
+	"worker/webrtc"
+)
+
+// mediaInfoFileName 任务输出目录下汇总播放信息的文件，播放器取这一个文件即可开始播放
+const mediaInfoFileName = "info.json"
+
+// posterFileNames 输出目录下可作为封面的文件，按优先级排列
+var posterFileNames = []string{"poster.jpg", "poster.png", "poster.webp"}
+
+// writeMediaInfoSidecar 在任务输出目录写入info.json，每次转码完成时重新生成。
+// info为nil表示媒体探测失败，时长和分辨率留空；outputs为多视频任务的各视频，单视频任务为nil。
+func (w *Worker) writeMediaInfoSidecar(taskID, name string, transcodeTask *transcoder.TranscodeTask, info *transcoder.MediaInfo, outputs []domain.VideoOutput) error {
+	if transcodeTask.OutputPath == "" {
+		return fmt.Errorf("task %s has no output directory", taskID)
+	}
+
+	prefix := w.servePathPrefix()
+	sidecar := domain.MediaInfoSidecar{
+		TaskID:      taskID,
+		Name:        name,
+		Playlist:    mediaURI(prefix, taskID, transcodeTask.M3U8Path),
+		Subtitles:   []domain.SubtitleTrack{},
+		Outputs:     outputs,
+		GeneratedAt: domain.FormatTime(w.now()),
+	}
+	if len(outputs) > 0 {
+		// 多视频任务的播放列表在各视频的子目录中，默认播放第一个
+		sidecar.Playlist = outputs[0].Playlist
+	}
+
+	var languages []string
+	if info != nil {
+		sidecar.DurationSeconds = info.DurationSeconds
+		sidecar.Width = info.Width
+		sidecar.Height = info.Height
+		sidecar.VideoCodec = info.VideoCodec
+		sidecar.AudioCodec = info.AudioCodec
+		languages = info.SubtitleLanguages
+	}
+	sidecar.Subtitles = subtitleTracks(prefix, taskID, transcodeTask.Subtitles, languages)
+
+	if transcodeTask.Thumbnails != "" {
+		sidecar.Thumbnails = mediaURI(prefix, taskID, transcodeTask.Thumbnails)
+	}
+	for _, rendition := range transcodeTask.Renditions {
+		sidecar.Renditions = append(sidecar.Renditions, domain.Rendition{
+			Name:      rendition.Name,
+			Playlist:  prefix + taskID + "/" + rendition.Name + "/" + filepath.Base(rendition.M3U8Path),
+			Bandwidth: rendition.Bitrate,
+		})
+		sidecar.Qualities = append(sidecar.Qualities, rendition.Name)
+	}
+
+	if transcodeTask.MediaType == transcoder.MediaTypeAudio {
+		sidecar.MediaType = transcodeTask.MediaType
+		sidecar.DurationSeconds = tracksDuration(transcodeTask.Tracks)
+		for _, track := range transcodeTask.Tracks {
+			sidecar.Tracks = append(sidecar.Tracks, domain.AudioTrack{
+				Name:            track.Name,
+				Playlist:        prefix + taskID + "/" + track.Playlist,
+				DurationSeconds: track.DurationSeconds,
+			})
+		}
+	}
+
+	for _, poster := range posterFileNames {
+		if _, err := os.Stat(filepath.Join(transcodeTask.OutputPath, poster)); err == nil {
+			sidecar.Poster = mediaURI(prefix, taskID, poster)
+			break
+		}
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再改名，避免播放器读到写了一半的文件
+	path := filepath.Join(transcodeTask.OutputPath, mediaInfoFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// servePathPrefix 生成播放地址使用的路径前缀，与数据通道接受的network.serve_path_prefix一致
+func (w *Worker) servePathPrefix() string {
+	return webrtc.NormalizeServePathPrefix(w.config.Network.ServePathPrefix)
+}
+
+// mediaURI 输出目录中文件的播放地址，与播放列表、切片请求的格式一致
+func mediaURI(prefix, taskID, path string) string {
+	return prefix + taskID + "/" + filepath.Base(path)
+}
+
+// subtitleTracks 列出字幕文件及其语言。从视频中提取的字幕按流序号排在前面；旧版本提取的字幕
+// （subtitle_<流序号>）文件名中没有语言，按流的顺序对应探测到的语言。
+func subtitleTracks(prefix, taskID string, subtitles []transcoder.SubtitleInfo, probedLanguages []string) []domain.SubtitleTrack {
+	type extracted struct {
+		info  transcoder.SubtitleInfo
+		index int
+	}
+	var embedded []extracted
+	tracks := make([]domain.SubtitleTrack, 0, len(subtitles))
+
+	for _, sub := range subtitles {
+		if index, err := strconv.Atoi(sub.Index); err == nil {
+			embedded = append(embedded, extracted{info: sub, index: index})
+			continue
+		}
+		tracks = append(tracks, domain.SubtitleTrack{
+			URI:      mediaURI(prefix, taskID, sub.Path),
+			Language: sub.Language,
+		})
+	}
+
+	sort.Slice(embedded, func(i, j int) bool { return embedded[i].index < embedded[j].index })
+	embeddedTracks := make([]domain.SubtitleTrack, 0, len(embedded))
+	for i, sub := range embedded {
+		track := domain.SubtitleTrack{URI: mediaURI(prefix, taskID, sub.info.Path), Language: sub.info.Language}
+		if track.Language == "" && i < len(probedLanguages) {
+			track.Language = probedLanguages[i]
+		}
+		embeddedTracks = append(embeddedTracks, track)
+	}
+	return append(embeddedTracks, tracks...)
+}
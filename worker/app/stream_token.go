@@ -0,0 +1,82 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"worker/domain"
+)
+
+// streamTokenKey 任务元数据中HTTP播放令牌的键。网关的/api/tasks/:id/stream/路径以Bearer令牌读取
+// 任务输出，节点在file_fetch中核对令牌
+const streamTokenKey = "stream_token"
+
+// newStreamToken 生成32字节随机数的十六进制作为播放令牌
+func newStreamToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Failed to generate stream token: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// streamToken 返回任务的播放令牌。任务创建时已生成令牌（见submitMetadata），
+// 旧版本创建的任务没有令牌，首次请求时生成并只写回元数据列
+func (w *Worker) streamToken(taskID string) (string, error) {
+	var token string
+	err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		if existing, _ := metadata[streamTokenKey].(string); existing != "" {
+			token = existing
+			return
+		}
+		token = newStreamToken()
+		metadata[streamTokenKey] = token
+	})
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", errors.New("failed to generate stream token")
+	}
+	return token, nil
+}
+
+// validStreamToken 核对file_fetch带来的播放令牌，任务没有令牌时一律拒绝
+func (w *Worker) validStreamToken(taskID, token string) bool {
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil || token == "" {
+		return false
+	}
+	metadata, _ := task.GetMetadata()
+	expected, _ := metadata[streamTokenKey].(string)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// handleGetStreamToken 回复任务的播放令牌，网关只转发任务所有者和管理员的请求
+func (w *Worker) handleGetStreamToken(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if token, err := w.streamToken(taskID); err != nil {
+		response["success"] = false
+		response["not_found"] = true
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+		response["token"] = token
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeStreamTokenResponse, response); err != nil {
+		log.Printf("Failed to send stream token response: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+	"worker/transcoder"
+)
+
+// streamedTranscode 下载完成之前就开始的流式转码
+type streamedTranscode struct {
+	downloaded bool // 下载已完成
+	transcoded bool // 流式转码已成功
+	failed     bool // 流式转码失败，等下载完成后按完整文件重新转码
+	// held 要求完整输出的任务流式转码已成功，ready推迟到下载完成时
+	held *transcoder.TranscodeTask
+}
+
+// handleStreamReady 流式模式下视频文件的头尾下载完成后开始转码，ffmpeg通过下载器的读取器
+// 边下载边切片。只在开启streaming_mode（或任务提交时带sequential=true）时进行，
+// 否则转码总是等下载完成后读取完整文件。
+func (w *Worker) handleStreamReady(task *models.Task, filePath string) {
+	if !task.Sequential(w.config.Transcode.StreamingMode) {
+		return
+	}
+	// 烧录字幕与多码率输出需要反复读取完整文件，等下载完成后再转码
+	options := transcodeOptions(task)
+	if options.BurnSubtitles || options.HLSQuality == transcoder.HLSQualityMulti {
+		return
+	}
+	// 多视频任务等下载完成后逐个转码全部视频，流式转码只会处理其中一个
+	if len(videoFiles(task)) > 1 {
+		return
+	}
+
+	taskID := task.TaskID
+	w.streamMu.Lock()
+	if _, exists := w.streamed[taskID]; exists {
+		w.streamMu.Unlock()
+		return
+	}
+	w.streamed[taskID] = &streamedTranscode{}
+	w.streamMu.Unlock()
+
+	// 记录流式转码的输入，回退转码、重试和重启恢复都转码同一个文件
+	if err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		metadata[streamInputKey] = filePath
+	}); err != nil {
+		log.Printf("Failed to record the streamed input of task %s: %v", taskID, err)
+	}
+	w.taskLog.Info(taskID, tasklog.SourceTranscode, "transcoding %s while the rest of the torrent downloads", filePath)
+	openInput := func() (io.ReadCloser, error) {
+		return w.downloader.GetReader(taskID, filePath)
+	}
+	go w.startTranscode(task, filepath.Join(w.config.Storage.DownloadPath, filePath), openInput)
+}
+
+// streamedDownloadCompleted 记录流式转码任务的下载已完成。streaming为false表示不是流式转码
+// 或流式转码已失败，应按普通方式转码；transcoded表示流式转码已经成功结束；
+// held非空时流式转码的结果还没有标记ready，应在此时标记。
+func (w *Worker) streamedDownloadCompleted(taskID string) (streaming, transcoded bool, held *transcoder.TranscodeTask) {
+	w.streamMu.Lock()
+	defer w.streamMu.Unlock()
+
+	stream, exists := w.streamed[taskID]
+	if !exists {
+		return false, false, nil
+	}
+	if stream.failed || stream.transcoded {
+		delete(w.streamed, taskID)
+		return !stream.failed, stream.transcoded, stream.held
+	}
+	stream.downloaded = true
+	return true, false, nil
+}
+
+// readyHeldKey 推迟ready的任务在元数据中记录流式转码的输入文件，节点重启后据此恢复推迟的ready
+const readyHeldKey = "ready_held"
+
+// streamInputKey 流式转码的视频文件在种子中的路径
+const streamInputKey = "stream_input"
+
+// holdReadyUntilDownloaded 要求完整输出（require_complete）的任务流式转码成功时下载可能还没完成，
+// 此时保留转码结果，等下载完成再标记ready。推迟的状态同时写入数据库，推迟时返回true
+func (w *Worker) holdReadyUntilDownloaded(taskID string, result *transcoder.TranscodeTask) bool {
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil || !w.requireComplete(task) {
+		return false
+	}
+
+	w.streamMu.Lock()
+	defer w.streamMu.Unlock()
+	stream, exists := w.streamed[taskID]
+	if !exists || stream.downloaded || stream.failed {
+		return false
+	}
+	stream.transcoded = true
+	stream.held = result
+	if err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		metadata[readyHeldKey] = result.InputPath
+	}); err != nil {
+		log.Printf("Failed to record the held ready state of task %s: %v", taskID, err)
+	}
+	return true
+}
+
+// releaseHeldReady 下载完成后清除数据库中推迟ready的记录
+func (w *Worker) releaseHeldReady(taskID string) {
+	if err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		delete(metadata, readyHeldKey)
+	}); err != nil {
+		log.Printf("Failed to clear the held ready state of task %s: %v", taskID, err)
+	}
+}
+
+// streamRecovery 节点重启后需要继续处理的流式转码任务
+type streamRecovery struct {
+	ready     map[string]*transcoder.TranscodeTask // 下载已完成、推迟ready的任务，标记ready即可
+	transcode []*models.Task                       // 下载已完成、流式转码随进程中断的任务，需按完整文件重新转码
+}
+
+// restoreStreamedTranscodes 节点重启后恢复停在transcoding状态的流式转码任务，需在下载器启动之前调用。
+// 推迟ready的任务：下载还没完成的回到下载中，由下载器恢复下载，下载完成时再标记ready；
+// 下载已完成的返回其转码结果，连接网关后由调用方标记ready。
+// 流式转码中断的任务：下载还没完成的回到下载中，重新开始流式转码；下载已完成的返回给调用方重新转码
+func (w *Worker) restoreStreamedTranscodes() streamRecovery {
+	recovery := streamRecovery{ready: make(map[string]*transcoder.TranscodeTask)}
+	tasks, err := w.taskRepository().GetByStatus(domain.TaskStatusTranscoding)
+	if err != nil {
+		log.Printf("Failed to load transcoding tasks: %v", err)
+		return recovery
+	}
+
+	for i := range tasks {
+		task := &tasks[i]
+		metadata, _ := task.GetMetadata()
+		inputPath, held := metadata[readyHeldKey].(string)
+		if !held {
+			if streamInput, _ := metadata[streamInputKey].(string); streamInput == "" {
+				continue
+			}
+			if task.Progress >= 100 {
+				w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "streamed transcode was interrupted by a restart, transcoding the downloaded file")
+				recovery.transcode = append(recovery.transcode, task)
+				continue
+			}
+			w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusDownloading)
+			w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "streamed transcode was interrupted by a restart, resuming the download")
+			continue
+		}
+		outputPath, _ := metadata["output_path"].(string)
+		result := &transcoder.TranscodeTask{
+			Status:     domain.TranscodeStatusCompleted,
+			InputPath:  inputPath,
+			OutputPath: outputPath,
+			M3U8Path:   task.M3U8FilePath,
+		}
+		if task.Progress >= 100 {
+			w.releaseHeldReady(task.TaskID)
+			recovery.ready[task.TaskID] = result
+			continue
+		}
+
+		w.streamMu.Lock()
+		w.streamed[task.TaskID] = &streamedTranscode{transcoded: true, held: result}
+		w.streamMu.Unlock()
+		w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusDownloading)
+		w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "resuming the download after a restart, the streamed transcode is ready once it completes")
+	}
+	return recovery
+}
+
+// streamedTranscodeFinished 流式转码成功结束
+func (w *Worker) streamedTranscodeFinished(taskID string) {
+	w.streamMu.Lock()
+	defer w.streamMu.Unlock()
+
+	stream, exists := w.streamed[taskID]
+	if !exists {
+		return
+	}
+	if stream.downloaded {
+		delete(w.streamed, taskID)
+		return
+	}
+	stream.transcoded = true
+}
+
+// streamedTranscodeFailed 流式转码失败时不判任务失败，而是回退为读取完整文件转码：
+// 下载已完成时立即重新转码，否则回到下载中，等下载完成后按普通方式转码。
+// 不是流式转码时返回false。
+func (w *Worker) streamedTranscodeFailed(taskID string) bool {
+	w.streamMu.Lock()
+	stream, exists := w.streamed[taskID]
+	downloaded := exists && stream.downloaded
+	if downloaded {
+		delete(w.streamed, taskID)
+	} else if exists {
+		stream.failed = true
+	}
+	w.streamMu.Unlock()
+	if !exists {
+		return false
+	}
+
+	if !downloaded {
+		w.taskLog.Warn(taskID, tasklog.SourceTranscode, "streaming transcode failed, transcoding again once the download completes")
+		w.updateTaskStatusInDB(taskID, domain.TaskStatusDownloading)
+		return true
+	}
+
+	w.taskLog.Warn(taskID, tasklog.SourceTranscode, "streaming transcode failed, transcoding the downloaded file")
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil {
+		log.Printf("Failed to load task %s after streaming transcode failed: %v", taskID, err)
+		return true
+	}
+	videoFile, err := w.transcodeInput(task)
+	if err != nil || videoFile == "" {
+		log.Printf("No video file to transcode for task %s: %v", taskID, err)
+		w.failTask(taskID, failedStageTranscode)
+		return true
+	}
+	go w.startTranscodingForTask(task, videoFile)
+	return true
+}
+
+// forgetStreamedTranscode 删除任务时清理流式转码状态
+func (w *Worker) forgetStreamedTranscode(taskID string) {
+	w.streamMu.Lock()
+	delete(w.streamed, taskID)
+	w.streamMu.Unlock()
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"worker/domain"
+	"worker/downloader"
+	"worker/models"
+	"worker/transcoder"
+)
+
+// resubmitGraceWindow 启动后的宽限期。崩溃重启后restoreActiveTasks会恢复下载中的任务，
+// 而网关在节点重连时可能重新提交同一磁力链接，宽限期内的提交需与已有任务去重。
+const resubmitGraceWindow = 5 * time.Minute
+
+// findResubmittedTask 在启动宽限期内查找与提交的磁力链接相同的等待中或下载中任务。
+// 元数据尚未获取的任务没有info hash，因此同时按磁力链接原文精确匹配。
+// 混合种子的v1和v2 hash指向同一任务，任一相同即视为重复提交。
+func (w *Worker) findResubmittedTask(magnetURL string) (*models.Task, bool) {
+	if w.now().Sub(w.startedAt) > resubmitGraceWindow {
+		return nil, false
+	}
+
+	hashes, hashErr := downloader.ParseMagnetHashes(magnetURL)
+	repo := w.taskRepository()
+	for _, status := range []domain.TaskStatus{domain.TaskStatusPending, domain.TaskStatusDownloading} {
+		tasks, err := repo.GetByStatus(status)
+		if err != nil {
+			log.Printf("Failed to load %s tasks for duplicate check: %v", status, err)
+			continue
+		}
+		for i := range tasks {
+			task := &tasks[i]
+			if task.MagnetURL == magnetURL {
+				return task, true
+			}
+			if hashErr != nil {
+				continue
+			}
+			if hashes.V1 != "" && strings.EqualFold(task.InfoHash, hashes.V1) {
+				return task, true
+			}
+			if existing, err := downloader.ParseMagnetHashes(task.MagnetURL); err == nil && hashes.Matches(existing) {
+				return task, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// magnetInfoHash 解析磁力链接中的info hash（小写十六进制），混合种子取v1 hash，
+// 纯v2磁力链接取v2 hash，无法解析时返回空串
+func magnetInfoHash(magnetURL string) string {
+	hashes, err := downloader.ParseMagnetHashes(magnetURL)
+	if err != nil {
+		return ""
+	}
+	if hashes.V1 != "" {
+		return hashes.V1
+	}
+	return hashes.V2
+}
+
+// workerCapabilities 注册时上报的节点能力。torrent库支持纯v2磁力链接时附加torrent_v2
+func workerCapabilities() []string {
+	capabilities := []string{"torrent", "transcode", "webrtc"}
+	if downloader.SupportsTorrentV2() {
+		capabilities = append(capabilities, "torrent_v2")
+	}
+	return capabilities
+}
+
+// selectedFiles 读取提交时选择下载的文件路径，未选择时返回nil
+func selectedFiles(payload map[string]interface{}) []string {
+	items, _ := payload["selected_files"].([]interface{})
+	var paths []string
+	for _, item := range items {
+		if path, ok := item.(string); ok && strings.TrimSpace(path) != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// submitPriority 读取提交时指定的下载优先级，未指定时使用默认优先级
+func submitPriority(payload map[string]interface{}) int {
+	if priority, ok := payload["priority"].(float64); ok && priority != 0 {
+		return int(priority)
+	}
+	return domain.DefaultTaskPriority
+}
+
+// handleSetPriority 修改任务的下载优先级，排队中的任务按新优先级重新排序
+func (w *Worker) handleSetPriority(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	priority, _ := payload["priority"].(float64)
+
+	response := map[string]interface{}{
+		"task_id":  taskID,
+		"priority": int(priority),
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if err := w.downloader.SetPriority(taskID, int(priority)); err != nil {
+		response["success"] = false
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeSetPriorityResponse, response); err != nil {
+		log.Printf("Failed to send set priority response: %v", err)
+	}
+}
+
+// handleSelectFiles 修改任务选择下载的文件，成功时回复新的文件列表和任务大小，任务不存在时回复not_found
+func (w *Worker) handleSelectFiles(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if _, exists := w.downloader.GetTask(taskID); !exists {
+		response["success"] = false
+		response["not_found"] = true
+	} else if err := w.downloader.SelectFiles(taskID, selectedFiles(payload)); err != nil {
+		response["success"] = false
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+		if task, exists := w.downloader.GetTask(taskID); exists {
+			files, _ := task.GetTorrentFiles()
+			response["size"] = task.Size
+			response["files"] = files
+		}
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeSelectFilesResponse, response); err != nil {
+		log.Printf("Failed to send select files response: %v", err)
+	}
+}
+
+// submitMetadata 提交时写入任务元数据的选项，随任务记录一起创建：播放令牌、转码选项和私有种子确认
+func submitMetadata(payload map[string]interface{}) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if token := newStreamToken(); token != "" {
+		metadata[streamTokenKey] = token
+	}
+	addTranscodeOptions(metadata, payload)
+	if allow, _ := payload["allow_private"].(bool); allow {
+		metadata["allow_private"] = true
+	}
+	return metadata
+}
+
+// addTranscodeOptions 将提交时指定的转码选项写入元数据，下载完成后转码时读取
+func addTranscodeOptions(metadata map[string]interface{}, payload map[string]interface{}) {
+	if burn, _ := payload["burn_subtitles"].(bool); burn {
+		language, _ := payload["subtitle_language"].(string)
+		metadata["burn_subtitles"] = true
+		metadata["subtitle_language"] = strings.TrimSpace(language)
+	}
+	if quality, _ := payload["hls_quality"].(string); quality == transcoder.HLSQualityMulti {
+		metadata["hls_quality"] = transcoder.HLSQualityMulti
+	}
+	if interactive, _ := payload["interactive"].(bool); interactive {
+		metadata["interactive"] = true
+	}
+	if requireComplete, _ := payload["require_complete"].(bool); requireComplete {
+		metadata["require_complete"] = true
+	}
+	// sequential为false时同样记录，覆盖节点开启的streaming_mode
+	if sequential, ok := payload["sequential"].(bool); ok {
+		metadata["sequential"] = sequential
+	}
+}
+
+// recordPrivateConsent 手动重试时提交者确认下载私有种子（allow_private），写入任务元数据，
+// 节点要求确认私有种子时下载器据此放行。只写回元数据列
+func (w *Worker) recordPrivateConsent(taskID string, payload map[string]interface{}) {
+	allow, _ := payload["allow_private"].(bool)
+	if !allow {
+		return
+	}
+
+	err := w.taskRepository().UpdateMetadata(taskID, func(metadata map[string]interface{}) {
+		metadata["allow_private"] = true
+	})
+	if err != nil {
+		log.Printf("Failed to record private torrent consent for task %s: %v", taskID, err)
+	}
+}
+
+// isPrivateTask 任务是否为私有种子，获取元数据后由下载器标记
+func isPrivateTask(task *models.Task) bool {
+	metadata, _ := task.GetMetadata()
+	return metadata["private"] == true
+}
+
+// transcodeOptions 读取任务元数据中的转码选项，默认不烧录字幕、只输出一路码流
+func transcodeOptions(task *models.Task) transcoder.Options {
+	metadata, _ := task.GetMetadata()
+	burn, _ := metadata["burn_subtitles"].(bool)
+	language, _ := metadata["subtitle_language"].(string)
+	quality, _ := metadata["hls_quality"].(string)
+	interactive, _ := metadata["interactive"].(bool)
+	return transcoder.Options{BurnSubtitles: burn, SubtitleLanguage: language, HLSQuality: quality, Interactive: interactive}
+}
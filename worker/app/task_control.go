@@ -0,0 +1,194 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+)
+
+// taskStatusRemoved 删除成功后在task_remove_response中回报的状态
+const taskStatusRemoved = "removed"
+
+var errTaskNotFound = errors.New("task not found")
+
+// handleTaskPause 暂停排队或下载中的任务，回复暂停后的状态
+func (w *Worker) handleTaskPause(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	status, err := w.pauseTask(taskID)
+	w.sendTaskControlResponse(domain.MessageTypeTaskPauseResponse, payload, taskID, status, err)
+}
+
+func (w *Worker) pauseTask(taskID string) (domain.TaskStatus, error) {
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errTaskNotFound, taskID)
+	}
+	switch task.Status {
+	case domain.TaskStatusPaused:
+		return task.Status, nil
+	case domain.TaskStatusPending, domain.TaskStatusDownloading:
+	default:
+		return task.Status, fmt.Errorf("task %s is %s, only pending or downloading tasks can be paused", taskID, task.Status)
+	}
+
+	if err := w.downloader.PauseTask(taskID); err != nil {
+		return task.Status, err
+	}
+
+	w.taskLog.Info(taskID, tasklog.SourceTask, "download paused")
+	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusPaused, task.Progress, nil); err != nil {
+		log.Printf("Failed to notify gateway about paused task %s: %v", taskID, err)
+	}
+	return domain.TaskStatusPaused, nil
+}
+
+// handleTaskResume 恢复暂停的任务，名额用完时任务回到下载队列等待
+func (w *Worker) handleTaskResume(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	status, err := w.resumeTask(taskID)
+	w.sendTaskControlResponse(domain.MessageTypeTaskResumeResponse, payload, taskID, status, err)
+}
+
+func (w *Worker) resumeTask(taskID string) (domain.TaskStatus, error) {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errTaskNotFound, taskID)
+	}
+	if task.Status != domain.TaskStatusPaused {
+		return task.Status, fmt.Errorf("task %s is %s, only paused tasks can be resumed", taskID, task.Status)
+	}
+
+	if err := w.downloader.ResumeTask(taskID); err != nil {
+		return task.Status, err
+	}
+
+	// 拿到名额的任务此时可能已开始下载
+	status := domain.TaskStatusPending
+	if resumed, err := repo.GetByTaskID(taskID); err == nil {
+		status = resumed.Status
+	}
+
+	w.taskLog.Info(taskID, tasklog.SourceTask, "download resumed")
+	if err := w.gateway.SendTaskStatus(taskID, status, task.Progress, nil); err != nil {
+		log.Printf("Failed to notify gateway about resumed task %s: %v", taskID, err)
+	}
+	return status, nil
+}
+
+// handleTaskRemove 删除任务，默认连同下载的文件与转码输出目录，purge_files为false时保留文件。
+// 转码中的任务不能删除。
+func (w *Worker) handleTaskRemove(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	purgeFiles, ok := payload["purge_files"].(bool)
+	if !ok {
+		purgeFiles = true
+	}
+
+	var status domain.TaskStatus
+	task, err := w.taskRepository().GetByTaskID(taskID)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%w: %s", errTaskNotFound, taskID)
+	case task.Status == domain.TaskStatusTranscoding || w.activeTranscode(taskID) != nil:
+		status = task.Status
+		err = fmt.Errorf("task %s is transcoding and cannot be removed", taskID)
+	default:
+		status = taskStatusRemoved
+		err = w.removeTask(task, purgeFiles)
+		if err != nil {
+			status = task.Status
+		}
+	}
+	w.sendTaskControlResponse(domain.MessageTypeTaskRemoveResponse, payload, taskID, status, err)
+}
+
+// removeTask 删除任务的记录，purgeFiles为true时一并删除下载的文件与转码输出目录
+func (w *Worker) removeTask(task *models.Task, purgeFiles bool) error {
+	var outputDir string
+	if purgeFiles {
+		outputDir = w.taskOutputDir(task)
+	}
+	if err := w.downloader.RemoveTask(task.TaskID, purgeFiles); err != nil {
+		return err
+	}
+
+	if outputDir != "" {
+		if err := os.RemoveAll(outputDir); err != nil {
+			log.Printf("Failed to remove output directory %s of task %s: %v", outputDir, task.TaskID, err)
+		}
+	}
+	w.forgetTraceID(task.TaskID)
+	w.forgetStreamedTranscode(task.TaskID)
+	log.Printf("Removed task %s", task.TaskID)
+	return nil
+}
+
+// taskOutputDir 任务的转码输出目录，不在m3u8_path之内或尚未转码时返回空。
+// 输出按任务ID存放在<m3u8_path>/<任务ID>/下（多视频任务的videoNN/也在其中，转码中途就已存在）；
+// 该目录不存在时才按元数据中记录的输出路径查找，用于source_name布局或更早的任务
+func (w *Worker) taskOutputDir(task *models.Task) string {
+	dir := ""
+	if task.TaskID != "" {
+		candidate := filepath.Join(w.config.Storage.M3U8Path, task.TaskID)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			dir = candidate
+		}
+	}
+	if dir == "" {
+		metadata, _ := task.GetMetadata()
+		dir, _ = metadata["output_path"].(string)
+	}
+	if dir == "" && task.M3U8FilePath != "" {
+		dir = filepath.Dir(task.M3U8FilePath)
+	}
+	if dir == "" {
+		return ""
+	}
+
+	root, err := filepath.Abs(w.config.Storage.M3U8Path)
+	if err != nil {
+		return ""
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		log.Printf("Refusing to remove %q of task %s: outside %s", dir, task.TaskID, root)
+		return ""
+	}
+	return dir
+}
+
+// sendTaskControlResponse 回复暂停/恢复/删除请求，附带操作后的任务状态
+func (w *Worker) sendTaskControlResponse(msgType domain.MessageType, request map[string]interface{}, taskID string, status domain.TaskStatus, err error) {
+	response := map[string]interface{}{
+		"task_id": taskID,
+		"success": err == nil,
+	}
+	if status != "" {
+		response["status"] = status
+	}
+	if err != nil {
+		response["error"] = err.Error()
+		if errors.Is(err, errTaskNotFound) {
+			response["not_found"] = true
+		}
+	}
+	if requestID, ok := request["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if err := w.gateway.SendMessage(msgType, response); err != nil {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"worker/client"
+	"worker/domain"
+)
+
+// tracingGateway 在任务状态消息中附带任务的追踪ID，便于把网关请求、节点日志与状态上报对应起来
+type tracingGateway struct {
+	client.Gateway
+	traceID func(taskID string) string
+}
+
+func (g *tracingGateway) SendTaskStatus(taskID string, status domain.TaskStatus, progress int, metadata map[string]interface{}) error {
+	if traceID := g.traceID(taskID); traceID != "" {
+		withTrace := make(map[string]interface{}, len(metadata)+1)
+		for k, v := range metadata {
+			withTrace[k] = v
+		}
+		withTrace["trace_id"] = traceID
+		metadata = withTrace
+	}
+	return g.Gateway.SendTaskStatus(taskID, status, progress, metadata)
+}
+
+// traceID 返回任务的追踪ID，没有时返回空串
+func (w *Worker) traceID(taskID string) string {
+	w.traceMu.Lock()
+	traceID, cached := w.traceIDs[taskID]
+	w.traceMu.Unlock()
+	if cached {
+		return traceID
+	}
+
+	if task, err := w.taskRepository().GetByTaskID(taskID); err == nil {
+		traceID = task.TraceID
+	}
+	w.traceMu.Lock()
+	w.traceIDs[taskID] = traceID
+	w.traceMu.Unlock()
+	return traceID
+}
+
+// cacheTraceID 缓存新任务的追踪ID。追踪ID随任务创建时写入记录，这里不再回写任务，
+// 以免整行保存覆盖下载协程同时写入的进度
+func (w *Worker) cacheTraceID(taskID, traceID string) {
+	if traceID == "" {
+		return
+	}
+	w.traceMu.Lock()
+	w.traceIDs[taskID] = traceID
+	w.traceMu.Unlock()
+}
+
+// forgetTraceID 任务删除后丢弃缓存的追踪ID
+func (w *Worker) forgetTraceID(taskID string) {
+	w.traceMu.Lock()
+	delete(w.traceIDs, taskID)
+	w.traceMu.Unlock()
+}
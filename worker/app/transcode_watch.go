@@ -0,0 +1,97 @@
+package app
+
+import (
+	"sync"
+
+	"worker/domain"
+	"worker/transcoder"
+)
+
+// transcodeWatch 一个任务的转码状态订阅
+type transcodeWatch struct {
+	taskID   string
+	updates  chan *transcoder.TranscodeTask
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// watchTranscodes 订阅taskID的转码状态。转码器只有一个状态通道，多个监控协程直接读取会互相取走
+// 对方的状态，这里由一个协程读取后按任务ID分发。须在开始转码之前订阅，监控结束后调用stopWatch
+func (w *Worker) watchTranscodes(taskID string) *transcodeWatch {
+	w.transcodeWatchOnce.Do(func() {
+		go w.dispatchTranscodeStatus(w.transcoder.GetStatusChannel())
+	})
+
+	watch := &transcodeWatch{
+		taskID:  taskID,
+		updates: make(chan *transcoder.TranscodeTask, 64),
+		done:    make(chan struct{}),
+	}
+	w.transcodeWatchMu.Lock()
+	defer w.transcodeWatchMu.Unlock()
+	if w.transcodeWatchClosed {
+		close(watch.updates)
+		return watch
+	}
+	if w.transcodeWatches == nil {
+		w.transcodeWatches = make(map[string][]*transcodeWatch)
+	}
+	w.transcodeWatches[taskID] = append(w.transcodeWatches[taskID], watch)
+	return watch
+}
+
+// stopWatch 取消订阅，监控协程结束时调用
+func (w *Worker) stopWatch(watch *transcodeWatch) {
+	watch.stopOnce.Do(func() {
+		close(watch.done)
+		w.transcodeWatchMu.Lock()
+		defer w.transcodeWatchMu.Unlock()
+		watches := w.transcodeWatches[watch.taskID]
+		for i, other := range watches {
+			if other == watch {
+				watches = append(watches[:i], watches[i+1:]...)
+				break
+			}
+		}
+		if len(watches) == 0 {
+			delete(w.transcodeWatches, watch.taskID)
+		} else {
+			w.transcodeWatches[watch.taskID] = watches
+		}
+	})
+}
+
+// dispatchTranscodeStatus 把转码器的状态按任务ID分发给订阅者。进度更新在订阅者来不及读取时丢弃，
+// 不阻塞其它任务；结束等状态一定送达。转码器停止后关闭全部订阅
+func (w *Worker) dispatchTranscodeStatus(source <-chan *transcoder.TranscodeTask) {
+	for update := range source {
+		w.transcodeWatchMu.Lock()
+		watches := append([]*transcodeWatch(nil), w.transcodeWatches[update.Options.TaskID]...)
+		w.transcodeWatchMu.Unlock()
+
+		for _, watch := range watches {
+			if update.Status == domain.TranscodeStatusProcessing {
+				select {
+				case watch.updates <- update:
+				case <-watch.done:
+				default:
+				}
+				continue
+			}
+			select {
+			case watch.updates <- update:
+			case <-watch.done:
+			}
+		}
+	}
+
+	w.transcodeWatchMu.Lock()
+	defer w.transcodeWatchMu.Unlock()
+	w.transcodeWatchClosed = true
+	for _, watches := range w.transcodeWatches {
+		for _, watch := range watches {
+			close(watch.updates)
+		}
+	}
+	w.transcodeWatches = nil
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+	"worker/transcoder"
+)
+
+// videoDir 多视频任务中第index个视频文件（按路径排序，从0开始）在任务输出目录下的子目录名
+func videoDir(index int) string {
+	return fmt.Sprintf("video%02d", index+1)
+}
+
+// videoFiles 任务中选中下载的视频文件在种子内的路径，按路径排序。本地媒体任务没有种子文件，返回空
+func videoFiles(task *models.Task) []string {
+	files, err := task.GetTorrentFiles()
+	if err != nil {
+		return nil
+	}
+	var videos []string
+	for _, file := range files {
+		if file.IsSelected && isVideoFile(file.FileName) {
+			videos = append(videos, file.FilePath)
+		}
+	}
+	sort.Strings(videos)
+	return videos
+}
+
+// videoOutputs 多视频任务已转码完成的各视频，按源文件路径排序，播放地址以prefix开头；单视频任务返回nil
+func videoOutputs(task *models.Task, prefix string) []domain.VideoOutput {
+	outputs, _ := task.GetM3U8Outputs()
+	if len(outputs) == 0 {
+		return nil
+	}
+	files := make([]string, 0, len(outputs))
+	for file := range outputs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	list := make([]domain.VideoOutput, 0, len(files))
+	for _, file := range files {
+		// 播放列表位于<任务目录>/videoNN/下
+		playlist := outputs[file]
+		base := filepath.Base(filepath.FromSlash(file))
+		list = append(list, domain.VideoOutput{
+			Name:     strings.TrimSuffix(base, filepath.Ext(base)),
+			File:     file,
+			Playlist: prefix + task.TaskID + "/" + filepath.Base(filepath.Dir(playlist)) + "/" + filepath.Base(playlist),
+		})
+	}
+	return list
+}
+
+// startVideoTranscodes 为多视频任务（如整季打包的剧集）的每个视频文件各开始一个转码，输出到
+// <任务目录>/videoNN/。转码器名额用完时排队等待；重试时跳过已有输出的文件。全部完成后任务才标记为ready
+func (w *Worker) startVideoTranscodes(task *models.Task, files []string) {
+	w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusTranscoding)
+
+	done, _ := task.GetM3U8Outputs()
+	options := transcodeOptions(task)
+	// 各视频的输出按任务ID存放，不使用按源文件命名的旧布局
+	options.OutputName = task.TaskID
+	options.TaskID = task.TaskID
+	if options.BurnSubtitles {
+		w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "burning subtitles (language %q) into video", options.SubtitleLanguage)
+	}
+
+	watch := w.watchTranscodes(task.TaskID)
+	defer w.stopWatch(watch)
+
+	pending := make(map[string]string)
+	failed := false
+	for i, file := range files {
+		if path := done[file]; path != "" {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		options.OutputSubdir = videoDir(i)
+		input := filepath.Join(w.config.Storage.DownloadPath, file)
+		transcodeID, err := w.transcoder.StartTranscodeWithOptions(input, options)
+		if err != nil {
+			log.Printf("Failed to start transcoding %s for task %s: %v", file, task.TaskID, err)
+			w.taskLog.Error(task.TaskID, tasklog.SourceTranscode, "failed to start transcode of %s: %v", file, err)
+			failed = true
+			continue
+		}
+		pending[transcodeID] = file
+	}
+	w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "transcoding %d of %d video files", len(pending), len(files))
+
+	w.monitorVideoTranscodes(task.TaskID, files, pending, failed, watch.updates)
+}
+
+// monitorVideoTranscodes 跟踪多视频任务的各个转码，以完成的文件数和进行中文件的进度合计任务进度。
+// 每个文件完成时保存其输出；全部结束后有失败的文件则按转码阶段失败处理，否则任务变为ready
+func (w *Worker) monitorVideoTranscodes(taskID string, files []string, pending map[string]string, failed bool, updates <-chan *transcoder.TranscodeTask) {
+	finished := len(files) - len(pending)
+	running := make(map[string]transcoder.TranscodeTask)
+
+	for len(pending) > 0 {
+		transcodeTask, ok := <-updates
+		if !ok {
+			return
+		}
+		file, tracked := pending[transcodeTask.ID]
+		if !tracked {
+			continue
+		}
+
+		switch transcodeTask.Status {
+		case domain.TranscodeStatusProcessing:
+			running[transcodeTask.ID] = *transcodeTask
+			if transcodeTask.ProcessedSeconds > 0 {
+				w.sendTranscodeProgress(taskID, combinedProgress(len(files), finished, running))
+			}
+			continue
+		case domain.TranscodeStatusCompleted:
+			w.logFailedTranscodeAttempts(taskID, transcodeTask.Attempts)
+			if err := w.saveVideoOutput(taskID, file, transcodeTask); err != nil {
+				log.Printf("Failed to save transcoding results of %s for task %s: %v", file, taskID, err)
+				w.taskLog.Error(taskID, tasklog.SourceTranscode, "failed to save transcode results of %s: %v", file, err)
+				failed = true
+			} else {
+				w.taskLog.Info(taskID, tasklog.SourceTranscode, "transcode of %s completed: %s", file, transcodeTask.M3U8Path)
+			}
+		case domain.TranscodeStatusError:
+			w.logFailedTranscodeAttempts(taskID, transcodeTask.Attempts)
+			log.Printf("Transcoding %s failed for task %s: %s", file, taskID, transcodeTask.Metadata["error"])
+			w.taskLog.Error(taskID, tasklog.SourceTranscode, "transcode of %s failed: %s", file, transcodeTask.Metadata["error"])
+			if tail := transcodeTask.Metadata["ffmpeg_tail"]; tail != "" {
+				w.taskLog.Error(taskID, tasklog.SourceTranscode, "ffmpeg output tail:\n%s", tail)
+			}
+			w.recordTranscodeAttempts(taskID, transcodeTask.Attempts)
+			failed = true
+		default:
+			continue
+		}
+		delete(pending, transcodeTask.ID)
+		delete(running, transcodeTask.ID)
+		finished++
+	}
+
+	if failed {
+		w.failTask(taskID, failedStageTranscode)
+		return
+	}
+	if err := w.finishVideoTranscodes(taskID, files); err != nil {
+		log.Printf("Failed to save transcoding results for task %s: %v", taskID, err)
+		w.taskLog.Error(taskID, tasklog.SourceTranscode, "failed to save transcode results: %v", err)
+		w.failTask(taskID, failedStageTranscode)
+	}
+}
+
+// combinedProgress 多视频任务的整体进度：已结束的文件按100%计，任一进行中的文件进度不确定时整体也不确定
+func combinedProgress(total, finished int, running map[string]transcoder.TranscodeTask) *transcoder.TranscodeTask {
+	combined := &transcoder.TranscodeTask{}
+	percent := finished * 100
+	for _, job := range running {
+		percent += job.Progress
+		combined.ProcessedSeconds += job.ProcessedSeconds
+		combined.ProgressIndeterminate = combined.ProgressIndeterminate || job.ProgressIndeterminate
+	}
+	combined.Progress = percent / total
+	return combined
+}
+
+// saveVideoOutput 记录多视频任务中一个文件的转码输出，重试时据此跳过已完成的文件
+func (w *Worker) saveVideoOutput(taskID, file string, transcodeTask *transcoder.TranscodeTask) error {
+	return w.taskRepository().UpdateOutputs(taskID, func(task *models.Task) error {
+		outputs, _ := task.GetM3U8Outputs()
+		if outputs == nil {
+			outputs = make(map[string]string)
+		}
+		outputs[file] = transcodeTask.M3U8Path
+		if err := task.SetM3U8Outputs(outputs); err != nil {
+			return err
+		}
+
+		if len(transcodeTask.Subtitles) > 0 {
+			srts, _ := task.GetSrts()
+			if err := task.SetSrts(append(srts, transcodeTask.Subtitles...)); err != nil {
+				log.Printf("Failed to set subtitle files: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// finishVideoTranscodes 多视频任务的全部文件转码完成：m3u8_path指向第一个视频，
+// 分片列表合并全部视频，然后标记为ready并上报完成摘要
+func (w *Worker) finishVideoTranscodes(taskID string, files []string) error {
+	var (
+		outputs map[string]string
+		first   *transcoder.TranscodeTask
+	)
+	err := w.taskRepository().UpdateOutputs(taskID, func(task *models.Task) error {
+		outputs, _ = task.GetM3U8Outputs()
+		var segments []string
+		for _, file := range files {
+			fileSegments, err := w.readSegmentsFromM3U8(outputs[file])
+			if err != nil {
+				return fmt.Errorf("read playlist of %s: %v", file, err)
+			}
+			segments = append(segments, fileSegments...)
+		}
+
+		first = &transcoder.TranscodeTask{
+			InputPath: filepath.Join(w.config.Storage.DownloadPath, files[0]),
+			M3U8Path:  outputs[files[0]],
+			// 任务目录，各视频在其下的videoNN子目录中
+			OutputPath: filepath.Dir(filepath.Dir(outputs[files[0]])),
+		}
+		task.M3U8FilePath = first.M3U8Path
+		if err := task.SetSegments(segments); err != nil {
+			log.Printf("Failed to set segments: %v", err)
+		}
+		metadata, _ := task.GetMetadata()
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["output_path"] = first.OutputPath
+		metadata["segment_count"] = len(segments)
+		if err := task.SetMetadata(metadata); err != nil {
+			log.Printf("Failed to set task metadata: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Transcoding of %d video files completed for task %s", len(files), taskID)
+	w.taskLog.Info(taskID, tasklog.SourceTranscode, "all %d video files transcoded", len(files))
+	playlists := make([]string, 0, len(files))
+	for _, file := range files {
+		playlists = append(playlists, outputs[file])
+	}
+	if w.incompleteOutput(taskID, playlists...) {
+		return nil
+	}
+	w.updateTaskStatusInDB(taskID, domain.TaskStatusReady)
+	w.sendTaskSummary(taskID, first)
+	return nil
+}
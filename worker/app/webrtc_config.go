@@ -10,6 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"worker/domain"
+
 	webrtcLib "github.com/pion/webrtc/v3"
 )
 
@@ -19,6 +21,7 @@ type iceServersResponse struct {
 	Success    bool                  `json:"success"`
 	IceServers []webrtcLib.ICEServer `json:"iceServers"`
 	TTL        int                   `json:"ttl"`
+	ExpiresAt  string                `json:"expires_at"`
 	Error      string                `json:"error"`
 	Message    string                `json:"message"`
 }
@@ -60,7 +63,8 @@ func (w *Worker) fetchTurnServersFromGateway() ([]webrtcLib.ICEServer, time.Dura
 		return nil, 0, err
 	}
 
-	endpoint := fmt.Sprintf("%s/api/webrtc/ice-servers", baseURL)
+	// 带上节点ID，网关按本节点的时钟偏差换算expires_at
+	endpoint := fmt.Sprintf("%s/api/webrtc/ice-servers?node_id=%s", baseURL, url.QueryEscape(w.config.Node.ID))
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -96,6 +100,9 @@ func (w *Worker) fetchTurnServersFromGateway() ([]webrtcLib.ICEServer, time.Dura
 	}
 
 	ttl := time.Duration(payload.TTL) * time.Second
+	if expiresAt, ok := domain.ParseTime(payload.ExpiresAt); ok && expiresAt.After(w.now()) {
+		ttl = expiresAt.Sub(w.now())
+	}
 	return payload.IceServers, ttl, nil
 }
 
@@ -123,7 +130,15 @@ func (w *Worker) composeWebRTCConfiguration(turnServers []webrtcLib.ICEServer) w
 }
 
 func (w *Worker) gatewayAPIBase() (string, error) {
-	raw := strings.TrimSpace(w.config.Gateway.URL)
+	// 优先使用当前连接的网关，保证ICE配置来自同一个网关
+	raw := ""
+	if w.gateway != nil {
+		raw = w.gateway.ActiveURL()
+	}
+	if raw == "" {
+		raw = w.config.Gateway.Endpoints()[0]
+	}
+	raw = strings.TrimSpace(raw)
 	if raw == "" {
 		return "", fmt.Errorf("gateway URL is empty")
 	}
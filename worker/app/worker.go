@@ -1,22 +1,29 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"worker/client"
 	"worker/config"
 	"worker/database"
+	"worker/diskspace"
 	"worker/domain"
 	"worker/downloader"
 	"worker/models"
+	"worker/tasklog"
 	"worker/transcoder"
 	"worker/webrtc"
 
@@ -33,8 +40,11 @@ type Dependencies struct {
 	Transcoder        transcoder.Service
 	WebRTC            webrtc.Service
 	TaskRepoFactory   TaskRepositoryFactory
+	TaskLog           *tasklog.Logger
 	HeartbeatInterval time.Duration
 	Clock             func() time.Time
+	// QuietStatePath 保存pause_all/resume_all的手动静默状态，重启后恢复；为空时不保存
+	QuietStatePath string
 }
 
 // Worker orchestrates the worker node lifecycle via injected dependencies.
@@ -45,7 +55,9 @@ type Worker struct {
 	transcoder      transcoder.Service
 	webrtc          webrtc.Service
 	taskRepoFactory TaskRepositoryFactory
+	taskLog         *tasklog.Logger
 	heartbeatEvery  time.Duration
+	retryBackoff    time.Duration // 自动重试前的等待时间，随重试次数线性增加
 	now             func() time.Time
 
 	iceConfigMu     sync.RWMutex
@@ -55,6 +67,41 @@ type Worker struct {
 	sessionMu       sync.Mutex
 	sessionOffers   map[string]string
 	sessionFallback map[string]bool
+
+	prunedBytes int64 // 累计清理的下载残留数据，原子访问
+
+	protocolVersion int32 // 与当前网关协商的协议版本，原子访问，0表示尚未协商
+
+	startedAt time.Time  // 用于判断重复提交的启动宽限期
+	submitMu  sync.Mutex // 串行化任务提交，避免去重检查与创建之间交错
+
+	reportedTraffic map[string][2]int64 // 上次上报的各任务流量，仅在心跳协程中访问
+
+	durationMu     sync.Mutex
+	mediaDurations map[string]float64 // 各任务视频文件的探测时长
+
+	traceMu  sync.Mutex
+	traceIDs map[string]string // 各任务的追踪ID缓存，未命中时从数据库加载
+
+	repairMu sync.Mutex // 串行化切片修复
+
+	streamMu sync.Mutex
+	streamed map[string]*streamedTranscode // 下载完成前开始的流式转码，按任务ID索引
+
+	transcodeWatchOnce   sync.Once
+	transcodeWatchMu     sync.Mutex
+	transcodeWatches     map[string][]*transcodeWatch // 转码状态的订阅，按任务ID索引
+	transcodeWatchClosed bool                         // 转码器的状态通道已关闭
+
+	subStatusMu sync.Mutex
+	subStatuses map[string]string // 已上报给网关的下载子状态（如disk_full），按任务ID索引
+
+	quietMu      sync.Mutex
+	quietManual  bool // 网关下发pause_all后保持静默，直到resume_all
+	quietResumed bool // 计划静默时段内收到resume_all，本次时段不再静默
+	quietActive  bool // 下载与转码当前是否因静默暂停
+	// quietStatePath 手动静默状态文件，见Dependencies.QuietStatePath
+	quietStatePath string
 }
 
 // New constructs a Worker with the supplied configuration and dependencies.
@@ -100,22 +147,43 @@ func New(cfg *config.Config, deps Dependencies) (*Worker, error) {
 		transcoder:      deps.Transcoder,
 		webrtc:          deps.WebRTC,
 		taskRepoFactory: factory,
+		taskLog:         deps.TaskLog,
 		heartbeatEvery:  heartbeat,
+		retryBackoff:    defaultRetryBackoff,
 		now:             nowFn,
+		startedAt:       nowFn(),
 		sessionOffers:   make(map[string]string),
 		sessionFallback: make(map[string]bool),
+		mediaDurations:  make(map[string]float64),
+		traceIDs:        make(map[string]string),
+		streamed:        make(map[string]*streamedTranscode),
+		quietStatePath:  deps.QuietStatePath,
 	}
 
+	// 任务状态上报统一附带追踪ID
+	worker.gateway = &tracingGateway{Gateway: deps.Gateway, traceID: worker.traceID}
+	worker.taskLog.SetTraceLookup(worker.traceID)
+
 	worker.gateway.SetMessageHandler(worker.handleGatewayMessage)
 	worker.downloader.SetExternalStatusHandler(worker.handleDownloadStatusChange)
+	worker.downloader.SetMetadataHandler(worker.handleTaskMetadata)
+	worker.downloader.SetStreamReadyHandler(worker.handleStreamReady)
+	worker.transcoder.SetQueueEventHandler(worker.handleTranscodeQueueEvent)
 	worker.webrtc.SetICECandidateHandler(worker.handleWebRTCICECandidate)
 	worker.webrtc.SetConnectionStateHandler(worker.handleWebRTCStateChange)
+	worker.webrtc.SetServedBytesHandler(worker.recordServedBytes)
+	worker.webrtc.SetSegmentRepairHandler(worker.handleDataChannelRepair)
+	worker.webrtc.SetOfferFailedHandler(worker.handleWebRTCOfferFailed)
+	worker.webrtc.SetProbeResultHandler(worker.reportProbeResult)
 
 	return worker, nil
 }
 
 // Start boots up all subsystems and connects to the gateway.
 func (w *Worker) Start() error {
+	// 先恢复手动静默，重启前暂停的节点不会在恢复任务时开始下载
+	w.restoreQuietState()
+	recovery := w.restoreStreamedTranscodes()
 	if err := w.downloader.Start(); err != nil {
 		return err
 	}
@@ -133,7 +201,7 @@ func (w *Worker) Start() error {
 		Name:         w.config.Node.Name,
 		Address:      w.config.Node.Address,
 		Status:       domain.WorkerStatusOnline,
-		Capabilities: []string{"torrent", "transcode", "webrtc"},
+		Capabilities: workerCapabilities(),
 		Resources: map[string]int{
 			"max_downloads":  w.config.Limits.MaxDownloads,
 			"max_transcodes": w.config.Limits.MaxTranscodes,
@@ -142,14 +210,35 @@ func (w *Worker) Start() error {
 		Metadata: map[string]string{
 			"version": "1.0.0",
 			"arch":    "amd64",
+			// 播放器按该前缀拼出播放地址
+			"serve_path_prefix": w.servePathPrefix(),
 		},
+		ProtocolVersion:    domain.ProtocolVersion,
+		MinProtocolVersion: domain.MinProtocolVersion,
 	}
 
 	if err := w.gateway.Connect(nodeInfo); err != nil {
 		return err
 	}
 
+	for taskID, result := range recovery.ready {
+		w.taskLog.Info(taskID, tasklog.SourceTranscode, "download completed before the restart, marking the streamed transcode ready")
+		w.markTranscodeReady(taskID, result)
+	}
+	for _, task := range recovery.transcode {
+		videoFile, err := w.transcodeInput(task)
+		if err != nil || videoFile == "" {
+			log.Printf("No video file to transcode for task %s: %v", task.TaskID, err)
+			w.failTask(task.TaskID, failedStageTranscode)
+			continue
+		}
+		go w.startTranscodingForTask(task, videoFile)
+	}
+
 	go w.startHeartbeat()
+	go w.startPruneJanitor()
+	go w.startFailedTaskSweeper()
+	go w.startQuietHours()
 	return nil
 }
 
@@ -185,16 +274,166 @@ func (w *Worker) startHeartbeat() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		if err := w.gateway.SendHeartbeat(); err != nil {
+		if err := w.gateway.SendHeartbeat(w.heartbeatMetrics()); err != nil {
 			log.Printf("Failed to send heartbeat: %v", err)
 		}
+		w.reportTaskTraffic()
 	}
 }
 
+// recordServedBytes 持久化通过WebRTC发送给客户端的流量
+func (w *Worker) recordServedBytes(taskID string, n int64) {
+	if err := w.taskRepository().AddTraffic(taskID, 0, n); err != nil {
+		log.Printf("Failed to record served bytes for task %s: %v", taskID, err)
+	}
+}
+
+// reportTaskTraffic 将自上次上报以来有变化的任务流量发送给网关
+func (w *Worker) reportTaskTraffic() {
+	if !w.gatewaySupports(domain.MessageTypeTaskTraffic) {
+		return
+	}
+
+	tasks, err := w.taskRepository().GetAll()
+	if err != nil {
+		log.Printf("Failed to load tasks for traffic report: %v", err)
+		return
+	}
+
+	if w.reportedTraffic == nil {
+		w.reportedTraffic = make(map[string][2]int64)
+	}
+
+	var changed []map[string]interface{}
+	for _, task := range tasks {
+		current := [2]int64{task.BytesDownloaded, task.BytesServed}
+		if current == w.reportedTraffic[task.TaskID] {
+			continue
+		}
+		changed = append(changed, map[string]interface{}{
+			"task_id":          task.TaskID,
+			"bytes_downloaded": task.BytesDownloaded,
+			"bytes_served":     task.BytesServed,
+		})
+		w.reportedTraffic[task.TaskID] = current
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskTraffic, map[string]interface{}{"tasks": changed}); err != nil {
+		log.Printf("Failed to report task traffic: %v", err)
+	}
+}
+
+// handleRegistrationConfirmed 记录网关确认的协议版本。旧版网关不返回版本，按版本1处理。
+func (w *Worker) handleRegistrationConfirmed(payload map[string]interface{}) {
+	version := domain.LegacyProtocolVersion
+	if v, ok := payload["protocol_version"].(float64); ok && v > 0 {
+		version = int(v)
+	}
+	if version > domain.ProtocolVersion {
+		version = domain.ProtocolVersion
+	}
+	atomic.StoreInt32(&w.protocolVersion, int32(version))
+
+	if version < domain.MinProtocolVersion {
+		log.Printf("Gateway protocol version %d is older than supported minimum %d", version, domain.MinProtocolVersion)
+	}
+	log.Printf("Registration confirmed by gateway, protocol version %d", version)
+
+	// 立即回传网关时钟和本机时钟，网关据往返时间估计两边的时钟偏差
+	if gatewayClock, ok := payload["gateway_clock_ms"].(float64); ok && w.gatewaySupports(domain.MessageTypeClockSync) {
+		if err := w.gateway.SendMessage(domain.MessageTypeClockSync, map[string]interface{}{
+			"gateway_clock_ms": int64(gatewayClock),
+			"clock_ms":         w.now().UnixMilli(),
+		}); err != nil {
+			log.Printf("Failed to send clock_sync: %v", err)
+		}
+	}
+}
+
+// negotiatedProtocol 返回与网关协商的协议版本。尚未收到注册确认时按本地版本处理，
+// 旧版网关的确认不带版本号，收到后即降级为版本1。
+func (w *Worker) negotiatedProtocol() int {
+	if version := atomic.LoadInt32(&w.protocolVersion); version > 0 {
+		return int(version)
+	}
+	return domain.ProtocolVersion
+}
+
+// gatewaySupports 判断当前网关是否支持该消息类型
+func (w *Worker) gatewaySupports(msgType domain.MessageType) bool {
+	return domain.MessageSupported(w.negotiatedProtocol(), msgType)
+}
+
+// heartbeatMetrics 随心跳上报的节点指标
+func (w *Worker) heartbeatMetrics() map[string]interface{} {
+	listen := w.downloader.ListenStatus()
+	ready, issues := w.readiness()
+	downloads, transcodes := w.activeTaskCounts()
+	webrtcStats := w.webrtc.AggregateStats()
+	metrics := map[string]interface{}{
+		"active_downloads":    downloads,
+		"active_transcodes":   transcodes,
+		"torrent_listen_port": listen.Port,
+		"torrent_listen_ok":   listen.OK,
+		"ready":               ready,
+		"readiness_issues":    issues,
+		"pruned_bytes_total":  atomic.LoadInt64(&w.prunedBytes),
+		"gateway_url":         w.gateway.ActiveURL(),
+		"protocol_version":    w.negotiatedProtocol(),
+		"webrtc_sessions":     webrtcStats.ActiveSessionCount,
+		"webrtc_bytes_sent":   webrtcStats.TotalBytesSent,
+		"webrtc_avg_rtt_ms":   webrtcStats.AvgRTTMs,
+		"state":               nodeStateActive,
+	}
+	// 静默时段内网关不向本节点分派新任务
+	if w.isQuiet() {
+		metrics["state"] = nodeStateQuiet
+	}
+	// 网关按剩余空间与下载名额为未指定节点的提交选择节点
+	if free, err := diskspace.Available(w.config.Storage.DownloadPath); err == nil {
+		metrics["disk_free_gb"] = float64(free) / (1 << 30)
+		metrics["disk_available_bytes"] = free
+	}
+	// 最近一次因空间不足拒绝的下载需要的空间，网关在空间恢复之前把新任务分给其它节点
+	if shortfall := w.downloader.DiskShortfall(); shortfall.RequiredBytes > 0 {
+		metrics["disk_required_bytes"] = shortfall.RequiredBytes
+	}
+	return metrics
+}
+
+// activeTaskCounts 正在下载（含等待中）和正在转码的任务数，网关据此计算集群的剩余容量
+func (w *Worker) activeTaskCounts() (downloads, transcodes int) {
+	for _, task := range w.downloader.GetAllTasks() {
+		switch task.Status {
+		case domain.TaskStatusPending, domain.TaskStatusDownloading:
+			downloads++
+		case domain.TaskStatusTranscoding:
+			transcodes++
+		}
+	}
+	return downloads, transcodes
+}
+
+// readiness 汇总影响节点服务质量的问题，没有问题时节点就绪
+func (w *Worker) readiness() (bool, []string) {
+	issues := []string{}
+	if listen := w.downloader.ListenStatus(); !listen.OK {
+		issues = append(issues, listen.Warning)
+	}
+	return len(issues) == 0, issues
+}
+
 func (w *Worker) handleGatewayMessage(msgType domain.MessageType, payload map[string]interface{}) {
 	switch msgType {
 	case domain.MessageTypeRegistrationConfirmed:
-		log.Printf("Registration confirmed by gateway")
+		w.handleRegistrationConfirmed(payload)
+	case domain.MessageTypeRegistrationRejected:
+		log.Printf("Registration rejected by gateway %s: %v", w.gateway.ActiveURL(), payload["reason"])
+	case domain.MessageTypeConnectionRejected:
+		// 网关客户端已记录并推迟重连
 	case domain.MessageTypeTaskSubmit:
 		w.handleTaskSubmit(payload)
 	case domain.MessageTypeGetTasks:
@@ -203,8 +442,62 @@ func (w *Worker) handleGatewayMessage(msgType domain.MessageType, payload map[st
 		w.handleGetTaskDetail(payload)
 	case domain.MessageTypeWebRTCOffer:
 		w.handleWebRTCOffer(payload)
+	case domain.MessageTypeWebRTCProbe:
+		w.handleWebRTCProbe(payload)
 	case domain.MessageTypeICECandidate:
 		w.handleICECandidate(payload)
+	case domain.MessageTypeICEResend:
+		w.handleICEResend(payload)
+	case domain.MessageTypeGetSessionStats:
+		w.handleGetSessionStats(payload)
+	case domain.MessageTypeGetQueues:
+		w.handleGetQueues(payload)
+	case domain.MessageTypeGetTaskAccess:
+		w.handleGetTaskAccess(payload)
+	case domain.MessageTypeGetTorrentInfo:
+		w.handleGetTorrentInfo(payload)
+	case domain.MessageTypePauseAll:
+		w.handlePauseAll(payload)
+	case domain.MessageTypeResumeAll:
+		w.handleResumeAll(payload)
+	case domain.MessageTypeSetRateLimit:
+		w.handleSetRateLimit(payload)
+	case domain.MessageTypeFileFetch:
+		w.handleFileFetch(payload)
+	case domain.MessageTypeGetTaskLog:
+		w.handleGetTaskLog(payload)
+	case domain.MessageTypeGetTaskPieces:
+		w.handleGetTaskPieces(payload)
+	case domain.MessageTypeTaskPin:
+		w.handleTaskPin(payload)
+	case domain.MessageTypeTaskRetry:
+		w.handleTaskRetry(payload)
+	case domain.MessageTypeTaskPause:
+		w.handleTaskPause(payload)
+	case domain.MessageTypeTaskResume:
+		w.handleTaskResume(payload)
+	case domain.MessageTypeTaskRemove:
+		w.handleTaskRemove(payload)
+	case domain.MessageTypeSetPriority:
+		w.handleSetPriority(payload)
+	case domain.MessageTypeSelectFiles:
+		w.handleSelectFiles(payload)
+	case domain.MessageTypeGetStreamToken:
+		w.handleGetStreamToken(payload)
+	case domain.MessageTypeCloseSession:
+		w.handleCloseSession(payload)
+	case domain.MessageTypeBoostTask:
+		w.handleBoostTask(payload)
+	case domain.MessageTypeRepairSegment:
+		w.handleRepairSegment(payload)
+	case domain.MessageTypeListLocalMedia:
+		w.handleListLocalMedia(payload)
+	case domain.MessageTypeTranscodeLocal:
+		w.handleTranscodeLocal(payload)
+	case domain.MessageTypeTaskPolicyVerdict:
+		w.handleTaskPolicyVerdict(payload)
+	case domain.MessageTypePruneTaskData:
+		w.handlePruneTaskData(payload)
 	default:
 		log.Printf("Unknown message type: %s", msgType)
 	}
@@ -214,50 +507,165 @@ func (w *Worker) handleTaskSubmit(payload map[string]interface{}) {
 	magnetURL, ok := payload["magnet_url"].(string)
 	if !ok {
 		log.Printf("Invalid magnet URL in task submit")
+		w.sendTaskSubmitResponse(payload, "", false, "invalid magnet_url")
 		return
 	}
+	// web+magnet:链接与magnet:?链接视为同一提交
+	magnetURL = downloader.NormalizeMagnetURL(magnetURL)
 
 	log.Printf("Received task: %s", magnetURL)
 
-	taskID, err := w.downloader.StartDownload(magnetURL)
+	w.submitMu.Lock()
+	defer w.submitMu.Unlock()
+
+	if existing, found := w.findResubmittedTask(magnetURL); found {
+		log.Printf("Task for %s already exists as %s, ignoring resubmission", magnetURL, existing.TaskID)
+		w.taskLog.Info(existing.TaskID, tasklog.SourceTask, "duplicate submission ignored after restart")
+		w.sendTaskSubmitResponse(payload, existing.TaskID, true, "")
+		return
+	}
+
+	traceID, _ := payload["trace_id"].(string)
+	// selected_files为空时下载全部文件
+	taskID, err := w.downloader.StartDownloadWithOptions(magnetURL, downloader.TaskOptions{
+		Selected: selectedFiles(payload),
+		Priority: submitPriority(payload),
+		Metadata: submitMetadata(payload),
+		TraceID:  traceID,
+	})
+	if errors.Is(err, downloader.ErrDuplicateTask) {
+		log.Printf("Magnet already submitted as task %s (trace %s)", taskID, traceID)
+		w.sendTaskSubmitResponse(payload, taskID, true, err.Error())
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to start download: %v", err)
+		log.Printf("Failed to start download (trace %s): %v", traceID, err)
+		w.sendTaskSubmitResponse(payload, "", false, err.Error())
 		return
 	}
 
-	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusDownloading, 0, nil); err != nil {
+	w.cacheTraceID(taskID, traceID)
+	w.taskLog.Info(taskID, tasklog.SourceTask, "task submitted: %s", magnetURL)
+
+	// 回传提交者信息与info hash，供网关记录任务归属并在集群范围去重
+	statusMeta := map[string]interface{}{}
+	if ownerID, ok := payload["owner_id"]; ok {
+		statusMeta["owner_id"] = ownerID
+	}
+	if traceID != "" {
+		log.Printf("Task %s started for trace %s", taskID, traceID)
+	}
+	if infoHash := magnetInfoHash(magnetURL); infoHash != "" {
+		statusMeta["info_hash"] = infoHash
+	}
+
+	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusDownloading, 0, statusMeta); err != nil {
 		log.Printf("Failed to notify gateway about task status: %v", err)
 	}
+	w.sendTaskSubmitResponse(payload, taskID, false, "")
+}
+
+// sendTaskSubmitResponse 回复带request_id的任务提交。duplicate为true表示任务已存在：
+// 没有errMsg时（重启宽限期内的重复提交）网关应视为提交成功，带errMsg时表示以taskID拒绝了重复提交。
+func (w *Worker) sendTaskSubmitResponse(request map[string]interface{}, taskID string, duplicate bool, errMsg string) {
+	requestID, ok := request["request_id"]
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{
+		"request_id": requestID,
+		"success":    errMsg == "",
+		"task_id":    taskID,
+		"duplicate":  duplicate,
+	}
+	if errMsg != "" {
+		response["error"] = errMsg
+		if duplicate {
+			response["code"] = "duplicate_task"
+		}
+	}
+	if taskID != "" {
+		if traceID := w.traceID(taskID); traceID != "" {
+			response["trace_id"] = traceID
+		}
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskSubmitResponse, response); err != nil {
+		log.Printf("Failed to send task submit response: %v", err)
+	}
 }
 
+// listFileLimit 任务列表中每个任务最多列出的文件名数
+const listFileLimit = 20
+
 func (w *Worker) handleGetTasks(payload map[string]interface{}) {
 	tasks := w.downloader.GetAllTasks()
+	// 可选的status只列出该状态的任务，例如status=paused列出等待恢复的任务
+	if status, _ := payload["status"].(string); status != "" {
+		filtered, err := w.downloader.GetTasksByStatus(domain.TaskStatus(status))
+		if err != nil {
+			log.Printf("Failed to get %s tasks: %v", status, err)
+		}
+		tasks = filtered
+	}
+	queuePositions := w.transcodeQueuePositions()
 
 	taskList := make([]map[string]interface{}, 0, len(tasks))
 	for _, task := range tasks {
+		// 列表只带前listFileLimit个文件名，完整的文件列表与元数据在任务详情中
 		files, _ := task.GetTorrentFiles()
-		fileNames := make([]string, len(files))
+		fileNames := make([]string, 0, len(files))
 		for i, file := range files {
-			fileNames[i] = file.FileName
+			if i >= listFileLimit {
+				break
+			}
+			fileNames = append(fileNames, file.FileName)
 		}
 
 		srts, _ := task.GetSrts()
 
 		taskData := map[string]interface{}{
-			"id":           task.TaskID,
-			"magnet_url":   task.MagnetURL,
-			"status":       task.Status,
-			"progress":     task.Progress,
-			"speed":        task.Speed,
-			"size":         task.Size,
-			"downloaded":   task.Downloaded,
-			"files":        fileNames,
-			"torrent_name": task.TorrentName,
-			"m3u8_path":    task.M3U8FilePath,
-			"srts":         srts,
-			"created_at":   task.CreatedAt,
-			"updated_at":   task.UpdatedAt,
-			"worker_id":    w.config.Node.ID,
+			"id":               task.TaskID,
+			"magnet_url":       task.MagnetURL,
+			"status":           task.Status,
+			"progress":         task.Progress,
+			"speed":            task.Speed,
+			"peers":            task.Peers,
+			"eta_seconds":      task.ETASeconds,
+			"size":             task.Size,
+			"downloaded":       task.Downloaded,
+			"bytes_downloaded": task.BytesDownloaded,
+			"bytes_served":     task.BytesServed,
+			"pinned":           task.Pinned,
+			"retry_count":      task.RetryCount,
+			"priority":         task.Priority,
+			"trace_id":         task.TraceID,
+			"private":          isPrivateTask(task),
+			"files":            fileNames,
+			"file_count":       len(files),
+			"torrent_name":     task.TorrentName,
+			"m3u8_path":        task.M3U8FilePath,
+			"srts":             srts,
+			"created_at":       domain.FormatTime(task.CreatedAt),
+			"updated_at":       domain.FormatTime(task.UpdatedAt),
+			"worker_id":        w.config.Node.ID,
+		}
+		if position, queued := queuePositions[task.TaskID]; queued {
+			taskData["transcode_queue_position"] = position
+		}
+		// 失败的任务带错误码，客户端据此区分可自动重试的失败（如等待元数据超时）与需要处理的失败
+		if task.ErrorCode != "" {
+			taskData["error_code"] = task.ErrorCode
+		}
+		metadata, _ := task.GetMetadata()
+		if metadata["sub_status"] != nil {
+			taskData["sub_status"] = metadata["sub_status"]
+		}
+		if metadata["media_type"] != nil {
+			taskData["media_type"] = metadata["media_type"]
+		}
+		if outputs := videoOutputs(task, w.servePathPrefix()); len(outputs) > 0 {
+			taskData["outputs"] = outputs
 		}
 		taskList = append(taskList, taskData)
 	}
@@ -282,12 +690,17 @@ func (w *Worker) handleGetTaskDetail(payload map[string]interface{}) {
 		return
 	}
 
+	response := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
 	task, exists := w.downloader.GetTask(taskID)
 	if !exists {
-		_ = w.gateway.SendMessage(domain.MessageTypeTaskDetailResponse, map[string]interface{}{
-			"task_id": taskID,
-			"found":   false,
-		})
+		response["found"] = false
+		_ = w.gateway.SendMessage(domain.MessageTypeTaskDetailResponse, response)
 		return
 	}
 
@@ -304,30 +717,131 @@ func (w *Worker) handleGetTaskDetail(payload map[string]interface{}) {
 
 	srts, _ := task.GetSrts()
 	metadata, _ := task.GetMetadata()
+	// 播放令牌只通过get_stream_token交给任务所有者
+	delete(metadata, streamTokenKey)
+	// 旧版本保存的完成摘要以Unix秒记录完成时间
+	if summary, ok := metadata["summary"].(map[string]interface{}); ok {
+		if completedAt, exists := summary["completed_at"]; exists {
+			summary["completed_at"] = domain.NormalizeTime(completedAt)
+		}
+	}
 
 	taskData := map[string]interface{}{
-		"id":           task.TaskID,
-		"magnet_url":   task.MagnetURL,
-		"status":       task.Status,
-		"progress":     task.Progress,
-		"speed":        task.Speed,
-		"size":         task.Size,
-		"downloaded":   task.Downloaded,
-		"files":        fileDetails,
-		"torrent_name": task.TorrentName,
-		"m3u8_path":    task.M3U8FilePath,
-		"srts":         srts,
-		"created_at":   task.CreatedAt,
-		"updated_at":   task.UpdatedAt,
-		"worker_id":    w.config.Node.ID,
-		"metadata":     metadata,
-	}
-
-	_ = w.gateway.SendMessage(domain.MessageTypeTaskDetailResponse, map[string]interface{}{
+		"id":               task.TaskID,
+		"magnet_url":       task.MagnetURL,
+		"status":           task.Status,
+		"progress":         task.Progress,
+		"speed":            task.Speed,
+		"size":             task.Size,
+		"downloaded":       task.Downloaded,
+		"bytes_downloaded": task.BytesDownloaded,
+		"bytes_served":     task.BytesServed,
+		"retry_count":      task.RetryCount,
+		"priority":         task.Priority,
+		"trace_id":         task.TraceID,
+		"private":          isPrivateTask(task),
+		"pinned":           task.Pinned,
+		"files":            fileDetails,
+		"torrent_name":     task.TorrentName,
+		"m3u8_path":        task.M3U8FilePath,
+		"srts":             srts,
+		"created_at":       domain.FormatTime(task.CreatedAt),
+		"updated_at":       domain.FormatTime(task.UpdatedAt),
+		"worker_id":        w.config.Node.ID,
+		"metadata":         metadata,
+	}
+	if job := w.activeTranscode(taskID); job != nil && job.QueuePosition > 0 {
+		taskData["transcode_queue_position"] = job.QueuePosition
+	}
+	if task.ErrorCode != "" {
+		taskData["error_code"] = task.ErrorCode
+	}
+	if outputs := videoOutputs(task, w.servePathPrefix()); len(outputs) > 0 {
+		taskData["outputs"] = outputs
+	}
+
+	response["found"] = true
+	response["task"] = taskData
+	_ = w.gateway.SendMessage(domain.MessageTypeTaskDetailResponse, response)
+}
+
+// defaultTaskLogTailBytes 未指定时返回的任务日志长度
+const defaultTaskLogTailBytes = 64 * 1024
+
+func (w *Worker) handleGetTaskLog(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	response := map[string]interface{}{
 		"task_id": taskID,
-		"found":   true,
-		"task":    taskData,
-	})
+		"found":   false,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	maxBytes := int64(defaultTaskLogTailBytes)
+	if value, ok := payload["max_bytes"].(float64); ok && value > 0 {
+		maxBytes = int64(value)
+	}
+
+	if taskID != "" {
+		content, err := w.taskLog.Tail(taskID, maxBytes)
+		switch {
+		case err == nil:
+			response["found"] = true
+			response["content"] = string(content)
+		case os.IsNotExist(err):
+			// 任务存在但尚无日志时返回空内容
+			if _, exists := w.downloader.GetTask(taskID); exists {
+				response["found"] = true
+				response["content"] = ""
+			}
+		default:
+			log.Printf("Failed to read task log for %s: %v", taskID, err)
+			response["error"] = err.Error()
+		}
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskLogResponse, response); err != nil {
+		log.Printf("Failed to send task log response: %v", err)
+	}
+}
+
+// handleTaskMetadata 拿到种子元数据后请求网关按真实info hash与名称复查黑名单
+func (w *Worker) handleTaskMetadata(task *models.Task) {
+	if !w.gatewaySupports(domain.MessageTypeTaskPolicyCheck) {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"task_id":   task.TaskID,
+		"info_hash": task.InfoHash,
+		"name":      task.TorrentName,
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskPolicyCheck, payload); err != nil {
+		log.Printf("Failed to send policy check for task %s: %v", task.TaskID, err)
+	}
+}
+
+func (w *Worker) handleTaskPolicyVerdict(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+	allowed, _ := payload["allowed"].(bool)
+	if taskID == "" || allowed {
+		return
+	}
+
+	reason, _ := payload["reason"].(string)
+	log.Printf("Task %s blocked by gateway policy: %s", taskID, reason)
+
+	blocked := domain.NewDownloadError(domain.ErrorCodePolicyBlocked, fmt.Errorf("blocked by policy: %s", reason))
+	if err := w.downloader.AbortTask(taskID, blocked); err != nil {
+		log.Printf("Failed to abort blocked task %s: %v", taskID, err)
+		return
+	}
+
+	metadata := map[string]interface{}{"error_code": domain.ErrorCodePolicyBlocked}
+	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusError, 0, metadata); err != nil {
+		log.Printf("Failed to notify gateway about blocked task %s: %v", taskID, err)
+	}
 }
 
 func (w *Worker) handleWebRTCOffer(payload map[string]interface{}) {
@@ -344,6 +858,7 @@ func (w *Worker) handleWebRTCOffer(payload map[string]interface{}) {
 	answer, err := w.webrtc.HandleOffer(sessionID, sdp)
 	if err != nil {
 		log.Printf("Failed to handle WebRTC offer: %v", err)
+		w.handleWebRTCOfferFailed(sessionID, err.Error())
 		return
 	}
 
@@ -352,6 +867,46 @@ func (w *Worker) handleWebRTCOffer(payload map[string]interface{}) {
 	}
 }
 
+// handleWebRTCProbe 为测速创建会话，应答与ICE候选者照常发送；
+// 测速名额已满时以webrtc_offer_failed拒绝
+func (w *Worker) handleWebRTCProbe(payload map[string]interface{}) {
+	sessionID, _ := payload["session_id"].(string)
+	sdp, _ := payload["sdp"].(string)
+
+	log.Printf("Received speed probe offer for session %s", sessionID)
+
+	config := w.ensureWebRTCConfiguration(false)
+	w.webrtc.UpdateConfiguration(config)
+
+	answer, err := w.webrtc.HandleProbe(sessionID, sdp)
+	if err != nil {
+		log.Printf("Failed to handle speed probe offer: %v", err)
+		w.handleWebRTCOfferFailed(sessionID, err.Error())
+		return
+	}
+
+	if err := w.gateway.SendWebRTCAnswer(sessionID, answer); err != nil {
+		log.Printf("Failed to send WebRTC answer: %v", err)
+	}
+}
+
+// reportProbeResult 向网关上报测速结果，由网关缓存并转发给客户端
+func (w *Worker) reportProbeResult(result webrtc.ProbeResult) {
+	if !w.gatewaySupports(domain.MessageTypeProbeResult) {
+		return
+	}
+	payload := map[string]interface{}{
+		"session_id":      result.SessionID,
+		"bytes":           result.Bytes,
+		"duration_ms":     result.DurationMs,
+		"throughput_kbps": result.ThroughputKbps,
+		"rtt_ms":          result.RTTMs,
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeProbeResult, payload); err != nil {
+		log.Printf("Failed to report speed probe result for session %s: %v", result.SessionID, err)
+	}
+}
+
 func (w *Worker) handleICECandidate(payload map[string]interface{}) {
 	sessionID, _ := payload["session_id"].(string)
 	candidate, _ := payload["candidate"].(string)
@@ -363,6 +918,152 @@ func (w *Worker) handleICECandidate(payload map[string]interface{}) {
 	}
 }
 
+// handleICEResend 重新发送会话已收集的本地ICE候选者，帮助卡在协商阶段的会话恢复。
+// 候选者照常以ice_candidate消息发送，之后再回复ice_resend_response。
+func (w *Worker) handleICEResend(payload map[string]interface{}) {
+	sessionID, _ := payload["session_id"].(string)
+
+	response := map[string]interface{}{
+		"session_id": sessionID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	result, err := w.webrtc.ResendICECandidates(sessionID)
+	if err != nil {
+		log.Printf("Failed to re-send ICE candidates: %v", err)
+		response["success"] = false
+		response["error"] = err.Error()
+	} else {
+		response["success"] = true
+		response["candidates"] = result.Candidates
+		response["gathering_state"] = result.GatheringState
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeICEResendResponse, response); err != nil {
+		log.Printf("Failed to send ICE resend response: %v", err)
+	}
+}
+
+// handleGetSessionStats 返回会话的传输统计（收发字节数、RTT、丢包率）
+func (w *Worker) handleGetSessionStats(payload map[string]interface{}) {
+	sessionID, _ := payload["session_id"].(string)
+
+	response := map[string]interface{}{
+		"session_id": sessionID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if stats, ok := w.webrtc.SessionStats(sessionID); ok {
+		response["success"] = true
+		response["found"] = true
+		response["stats"] = stats
+	} else {
+		response["success"] = false
+		response["found"] = false
+		response["error"] = "session not found"
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeSessionStatsResponse, response); err != nil {
+		log.Printf("Failed to send session stats response: %v", err)
+	}
+}
+
+// handleGetTaskAccess 返回任务本次运行期间的切片访问统计（会话数、切片数、字节数）
+func (w *Worker) handleGetTaskAccess(payload map[string]interface{}) {
+	taskID, _ := payload["task_id"].(string)
+
+	response := map[string]interface{}{
+		"task_id": taskID,
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	access, ok := w.webrtc.SegmentAccess(taskID)
+	if !ok {
+		// 任务存在但还没有被播放过时返回零值
+		_, ok = w.downloader.GetTask(taskID)
+	}
+	if ok {
+		response["success"] = true
+		response["found"] = true
+		response["access"] = access
+	} else {
+		response["success"] = false
+		response["found"] = false
+		response["error"] = "task not found"
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskAccessResponse, response); err != nil {
+		log.Printf("Failed to send task access response: %v", err)
+	}
+}
+
+// handleGetQueues 返回下载队列与转码队列的内容：占用名额的任务和按先后排列的等待任务
+func (w *Worker) handleGetQueues(payload map[string]interface{}) {
+	response := map[string]interface{}{
+		"success":   true,
+		"download":  w.downloader.QueueSnapshot(),
+		"transcode": w.transcoder.QueueSnapshot(),
+	}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeQueuesResponse, response); err != nil {
+		log.Printf("Failed to send queues response: %v", err)
+	}
+}
+
+// handleGetTorrentInfo 只获取种子的元数据并返回文件列表，供用户提交前选择要下载的文件。
+// 等待元数据最多需要downloader.DefaultMetadataFetchTimeout
+func (w *Worker) handleGetTorrentInfo(payload map[string]interface{}) {
+	response := map[string]interface{}{}
+	if requestID, ok := payload["request_id"]; ok {
+		response["request_id"] = requestID
+	}
+
+	magnetURL, _ := payload["magnet_url"].(string)
+	if magnetURL == "" {
+		response["success"] = false
+		response["error"] = "invalid magnet_url"
+	} else if info, err := w.downloader.FetchMetadata(magnetURL); err != nil {
+		log.Printf("Failed to fetch metadata for %s: %v", magnetURL, err)
+		failure := domain.ClassifyDownloadError(err, domain.ErrorCodeInternal)
+		response["success"] = false
+		response["error"] = failure.Error()
+		response["error_code"] = failure.Code
+	} else {
+		response["success"] = true
+		response["info_hash"] = info.InfoHash
+		response["name"] = info.Name
+		response["size"] = info.Size
+		response["private"] = info.Private
+		response["files"] = info.Files
+	}
+
+	if err := w.gateway.SendMessage(domain.MessageTypeTorrentInfoResponse, response); err != nil {
+		log.Printf("Failed to send torrent info response: %v", err)
+	}
+}
+
+// handleCloseSession 网关通知会话的客户端已断开且未重连，关闭PeerConnection并释放会话资源
+func (w *Worker) handleCloseSession(payload map[string]interface{}) {
+	sessionID, _ := payload["session_id"].(string)
+	reason, _ := payload["reason"].(string)
+
+	if !w.webrtc.CloseSession(sessionID) {
+		log.Printf("Close requested for unknown session %s", sessionID)
+		return
+	}
+	w.clearSessionTracking(sessionID)
+	log.Printf("Closed session %s (%s)", sessionID, reason)
+}
+
 func (w *Worker) handleWebRTCStateChange(sessionID string, state webrtcLib.PeerConnectionState) {
 	switch state {
 	case webrtcLib.PeerConnectionStateConnected, webrtcLib.PeerConnectionStateClosed:
@@ -445,58 +1146,257 @@ func (w *Worker) hasTurnServers(config webrtcLib.Configuration) bool {
 }
 
 func (w *Worker) handleDownloadStatusChange(task *models.Task) {
+	if task.Status == domain.TaskStatusDownloading {
+		w.forwardSubStatus(task)
+		return
+	}
+	w.subStatusMu.Lock()
+	delete(w.subStatuses, task.TaskID)
+	w.subStatusMu.Unlock()
+
+	if task.Status == domain.TaskStatusError {
+		w.failTask(task.TaskID, failedStageDownload)
+		return
+	}
+
 	if task.Status == domain.TaskStatusCompleted {
+		if streaming, transcoded, held := w.streamedDownloadCompleted(task.TaskID); streaming {
+			log.Printf("Download completed for task %s, already transcoded while streaming", task.TaskID)
+			if !transcoded || held != nil {
+				if err := w.gateway.SendTaskStatus(task.TaskID, domain.TaskStatusCompleted, 100, downloadCompletePayload(task)); err != nil {
+					log.Printf("Failed to notify gateway about completed download %s: %v", task.TaskID, err)
+				}
+			}
+			if held != nil {
+				w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "download completed, marking the streamed transcode ready")
+				w.releaseHeldReady(task.TaskID)
+				w.markTranscodeReady(task.TaskID, held)
+			}
+			return
+		}
+
 		log.Printf("Download completed for task %s, starting transcoding", task.TaskID)
 
-		files, err := task.GetTorrentFiles()
+		if err := w.gateway.SendTaskStatus(task.TaskID, domain.TaskStatusCompleted, 100, downloadCompletePayload(task)); err != nil {
+			log.Printf("Failed to notify gateway about completed download %s: %v", task.TaskID, err)
+		}
+
+		// 下载协程发来的是它自己持有的任务对象，转码选项等元数据以数据库中的为准
+		if stored, err := w.taskRepository().GetByTaskID(task.TaskID); err == nil {
+			task = stored
+		}
+
+		start, err := w.transcodeStarter(task)
 		if err != nil {
 			log.Printf("Failed to get torrent files for task %s: %v", task.TaskID, err)
 			return
 		}
+		if start == nil {
+			log.Printf("No video file found in task %s", task.TaskID)
+			w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusReady)
+			w.sendTaskSummary(task.TaskID, nil)
+			return
+		}
+		go start()
+	}
+}
 
-		var videoFile string
-		videoExtensions := []string{".mp4", ".mkv", ".avi", ".mov", ".wmv", ".flv", ".webm", ".m4v"}
+// transcodeStarter 选出下载完成的任务要转码的文件，返回开始转码的函数：选中多个视频时逐个转码，
+// 一个视频时转码该视频，没有视频时转码音频曲目。没有可转码的文件时返回nil
+func (w *Worker) transcodeStarter(task *models.Task) (func(), error) {
+	if files := videoFiles(task); len(files) > 1 {
+		return func() { w.startVideoTranscodes(task, files) }, nil
+	}
+	videoFile, err := w.transcodeInput(task)
+	if err != nil {
+		return nil, err
+	}
+	if videoFile != "" {
+		return func() { w.startTranscodingForTask(task, videoFile) }, nil
+	}
+	if tracks := w.audioTracks(task); len(tracks) > 0 {
+		return func() { w.startAudioTranscode(task, tracks) }, nil
+	}
+	return nil, nil
+}
 
-		for _, file := range files {
-			for _, ext := range videoExtensions {
-				if strings.HasSuffix(strings.ToLower(file.FileName), ext) {
-					videoFile = filepath.Join(w.config.Storage.DownloadPath, file.FilePath)
-					break
-				}
-			}
-			if videoFile != "" {
-				break
-			}
+// forwardSubStatus 下载中任务的子状态（如剩余空间不足时的disk_full）变化时通知网关
+func (w *Worker) forwardSubStatus(task *models.Task) {
+	metadata, _ := task.GetMetadata()
+	subStatus, _ := metadata["sub_status"].(string)
+
+	w.subStatusMu.Lock()
+	if w.subStatuses == nil {
+		w.subStatuses = make(map[string]string)
+	}
+	previous := w.subStatuses[task.TaskID]
+	if subStatus == "" {
+		delete(w.subStatuses, task.TaskID)
+	} else {
+		w.subStatuses[task.TaskID] = subStatus
+	}
+	w.subStatusMu.Unlock()
+	if previous == subStatus {
+		return
+	}
+
+	if err := w.gateway.SendTaskStatus(task.TaskID, domain.TaskStatusDownloading, task.Progress, map[string]interface{}{
+		"sub_status": subStatus,
+	}); err != nil {
+		log.Printf("Failed to notify gateway about sub-status of task %s: %v", task.TaskID, err)
+	}
+}
+
+// videoExtensions 需要转码的视频文件扩展名
+var videoExtensions = []string{".mp4", ".mkv", ".avi", ".mov", ".wmv", ".flv", ".webm", ".m4v"}
+
+// transcodeInput 任务要转码的视频文件：本地媒体任务的输入路径，流式转码过的文件，或种子中的第一个视频文件。
+// 选中多个视频文件的任务由startVideoTranscodes逐个转码
+func (w *Worker) transcodeInput(task *models.Task) (string, error) {
+	metadata, _ := task.GetMetadata()
+	if inputPath, _ := metadata["input_path"].(string); inputPath != "" {
+		return inputPath, nil
+	}
+	if streamInput, _ := metadata[streamInputKey].(string); streamInput != "" {
+		return filepath.Join(w.config.Storage.DownloadPath, streamInput), nil
+	}
+
+	files, err := task.GetTorrentFiles()
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if isVideoFile(file.FileName) {
+			return filepath.Join(w.config.Storage.DownloadPath, file.FilePath), nil
 		}
+	}
+	return "", nil
+}
 
-		if videoFile != "" {
-			go w.startTranscodingForTask(task, videoFile)
-		} else {
-			log.Printf("No video file found in task %s", task.TaskID)
-			w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusReady)
+// audioTracks 没有视频文件时任务中选中下载的音频文件，按路径排序作为曲目顺序
+func (w *Worker) audioTracks(task *models.Task) []string {
+	files, err := task.GetTorrentFiles()
+	if err != nil {
+		return nil
+	}
+	var tracks []string
+	for _, file := range files {
+		if file.IsSelected && transcoder.IsAudioFile(file.FileName) {
+			tracks = append(tracks, filepath.Join(w.config.Storage.DownloadPath, file.FilePath))
 		}
 	}
+	sort.Strings(tracks)
+	return tracks
+}
+
+func isVideoFile(name string) bool {
+	for _, ext := range videoExtensions {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadCompletePayload 下载完成通知附带的最终大小与文件列表，供接收方校验完整性
+func downloadCompletePayload(task *models.Task) map[string]interface{} {
+	files, _ := task.GetTorrentFiles()
+
+	fileList := make([]map[string]interface{}, 0, len(files))
+	for _, file := range files {
+		if !file.IsSelected {
+			continue
+		}
+		fileList = append(fileList, map[string]interface{}{
+			"file_name": file.FileName,
+			"file_path": file.FilePath,
+			"file_size": file.FileSize,
+		})
+	}
+
+	payload := map[string]interface{}{
+		"total_bytes":    task.Downloaded,
+		"expected_bytes": task.Size,
+		"files":          fileList,
+	}
+	if task.InfoHash != "" {
+		payload["info_hash"] = task.InfoHash
+	}
+	return payload
 }
 
 func (w *Worker) startTranscodingForTask(task *models.Task, videoFile string) {
+	w.startTranscode(task, videoFile, nil)
+}
+
+// startTranscode 开始转码任务的视频文件。openInput非nil时为流式转码，ffmpeg从下载器读取尚未下载完的文件
+func (w *Worker) startTranscode(task *models.Task, videoFile string, openInput func() (io.ReadCloser, error)) {
 	w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusTranscoding)
 
-	transcodeID, err := w.transcoder.StartTranscode(videoFile)
+	w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "starting transcode of %s", videoFile)
+
+	options := transcodeOptions(task)
+	options.OpenInput = openInput
+	if options.BurnSubtitles {
+		w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "burning subtitles (language %q) into video", options.SubtitleLanguage)
+	}
+	if options.HLSQuality == transcoder.HLSQualityMulti {
+		w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "transcoding a multi-bitrate ladder")
+	}
+	w.launchTranscode(task, videoFile, options)
+}
+
+// startAudioTranscode 把只有音频文件的任务按曲目切片为纯音频HLS，任务标记为media_type=audio。
+// 音频任务不烧录字幕，也不输出多码率
+func (w *Worker) startAudioTranscode(task *models.Task, tracks []string) {
+	w.setTaskMetadata(task.TaskID, "media_type", transcoder.MediaTypeAudio)
+	w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusTranscoding)
+
+	w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "no video file, transcoding %d audio track(s)", len(tracks))
+
+	options := transcodeOptions(task)
+	options.BurnSubtitles = false
+	options.SubtitleLanguage = ""
+	options.HLSQuality = ""
+	options.AudioTracks = tracks
+	w.launchTranscode(task, tracks[0], options)
+}
+
+// launchTranscode 把转码交给转码器排队并跟踪进度
+func (w *Worker) launchTranscode(task *models.Task, input string, options transcoder.Options) {
+	if w.config.Storage.OutputLayout != config.OutputLayoutSourceName {
+		// 输出固定在<m3u8_path>/<任务ID>/下，文件服务按任务ID直接找到
+		options.OutputName = task.TaskID
+	}
+	options.TaskID = task.TaskID
+	if options.Interactive {
+		w.taskLog.Info(task.TaskID, tasklog.SourceTranscode, "interactive task, queued ahead of regular transcodes")
+	}
+
+	watch := w.watchTranscodes(task.TaskID)
+	transcodeID, err := w.transcoder.StartTranscodeWithOptions(input, options)
 	if err != nil {
+		w.stopWatch(watch)
 		log.Printf("Failed to start transcoding for task %s: %v", task.TaskID, err)
-		w.updateTaskStatusInDB(task.TaskID, domain.TaskStatusError)
+		w.taskLog.Error(task.TaskID, tasklog.SourceTranscode, "failed to start transcode: %v", err)
+		if w.streamedTranscodeFailed(task.TaskID) {
+			return
+		}
+		w.failTask(task.TaskID, failedStageTranscode)
 		return
 	}
 
 	log.Printf("Started transcoding for task %s with transcode ID %s", task.TaskID, transcodeID)
 
-	go w.monitorTranscodingProgress(task.TaskID, transcodeID)
+	go func() {
+		defer w.stopWatch(watch)
+		w.monitorTranscodingProgress(task.TaskID, transcodeID, watch.updates)
+	}()
 }
 
-func (w *Worker) monitorTranscodingProgress(taskID, transcodeID string) {
-	statusChan := w.transcoder.GetStatusChannel()
-
-	for transcodeTask := range statusChan {
+// monitorTranscodingProgress 跟踪一个转码，从updates读取本任务的转码状态，直到转码结束
+func (w *Worker) monitorTranscodingProgress(taskID, transcodeID string, updates <-chan *transcoder.TranscodeTask) {
+	for transcodeTask := range updates {
 		if transcodeTask.ID != transcodeID {
 			continue
 		}
@@ -505,44 +1405,186 @@ func (w *Worker) monitorTranscodingProgress(taskID, transcodeID string) {
 			taskID, transcodeTask.Status, transcodeTask.Progress)
 
 		switch transcodeTask.Status {
+		case domain.TranscodeStatusProcessing:
+			if transcodeTask.ProcessedSeconds > 0 {
+				w.sendTranscodeProgress(taskID, transcodeTask)
+			}
 		case domain.TranscodeStatusCompleted:
+			w.logFailedTranscodeAttempts(taskID, transcodeTask.Attempts)
 			if err := w.saveTranscodingResults(taskID, transcodeTask); err != nil {
 				log.Printf("Failed to save transcoding results for task %s: %v", taskID, err)
-				w.updateTaskStatusInDB(taskID, domain.TaskStatusError)
+				w.taskLog.Error(taskID, tasklog.SourceTranscode, "failed to save transcode results: %v", err)
+				w.streamedTranscodeFinished(taskID)
+				w.failTask(taskID, failedStageTranscode)
 			} else {
 				log.Printf("Transcoding completed and saved for task %s", taskID)
-				w.updateTaskStatusInDB(taskID, domain.TaskStatusReady)
+				w.taskLog.Info(taskID, tasklog.SourceTranscode, "transcode completed: %s", transcodeTask.M3U8Path)
+				if w.holdReadyUntilDownloaded(taskID, transcodeTask) {
+					w.taskLog.Info(taskID, tasklog.SourceTranscode, "task requires complete output, ready once the download completes")
+					return
+				}
+				w.markTranscodeReady(taskID, transcodeTask)
+				w.streamedTranscodeFinished(taskID)
 			}
 			return
 		case domain.TranscodeStatusError:
+			w.logFailedTranscodeAttempts(taskID, transcodeTask.Attempts)
 			log.Printf("Transcoding failed for task %s: %s", taskID, transcodeTask.Metadata["error"])
-			w.updateTaskStatusInDB(taskID, domain.TaskStatusError)
+			w.taskLog.Error(taskID, tasklog.SourceTranscode, "transcode failed: %s", transcodeTask.Metadata["error"])
+			if tail := transcodeTask.Metadata["ffmpeg_tail"]; tail != "" {
+				w.taskLog.Error(taskID, tasklog.SourceTranscode, "ffmpeg output tail:\n%s", tail)
+			}
+			w.recordTranscodeAttempts(taskID, transcodeTask.Attempts)
+			if w.streamedTranscodeFailed(taskID) {
+				return
+			}
+			w.failTask(taskID, failedStageTranscode)
 			return
 		}
 	}
 }
 
-func (w *Worker) saveTranscodingResults(taskID string, transcodeTask *transcoder.TranscodeTask) error {
+// markTranscodeReady 转码结果已保存，标记任务ready并发送完成摘要；
+// 要求完整输出的任务输出不完整时判转码失败
+func (w *Worker) markTranscodeReady(taskID string, transcodeTask *transcoder.TranscodeTask) {
+	if w.incompleteOutput(taskID, transcodeTask.M3U8Path) {
+		return
+	}
+	w.updateTaskStatusInDB(taskID, domain.TaskStatusReady)
+	w.sendTaskSummary(taskID, transcodeTask)
+}
+
+// sendTranscodeProgress 将转码进度作为transcoding状态转发给网关；片源时长未知时
+// 进度报-1并带progress_indeterminate，只有已转码的时长有意义
+func (w *Worker) sendTranscodeProgress(taskID string, transcodeTask *transcoder.TranscodeTask) {
+	metadata := map[string]interface{}{
+		"transcoded_seconds": math.Round(transcodeTask.ProcessedSeconds),
+	}
+	progress := transcodeTask.Progress
+	if transcodeTask.ProgressIndeterminate {
+		progress = -1
+		metadata["progress_indeterminate"] = true
+	}
+	if err := w.gateway.SendTaskStatus(taskID, domain.TaskStatusTranscoding, progress, metadata); err != nil {
+		log.Printf("Failed to send transcode progress for task %s: %v", taskID, err)
+	}
+}
+
+func (w *Worker) logFailedTranscodeAttempts(taskID string, attempts []transcoder.Attempt) {
+	for _, attempt := range attempts {
+		if !attempt.Success {
+			w.taskLog.Warn(taskID, tasklog.SourceTranscode, "transcode strategy %s failed: %s", attempt.Strategy, attempt.Error)
+		}
+	}
+}
+
+// recordTranscodeAttempts 将转码链各次尝试的结果写入任务元数据
+func (w *Worker) recordTranscodeAttempts(taskID string, attempts []transcoder.Attempt) {
 	repo := w.taskRepository()
 	task, err := repo.GetByTaskID(taskID)
 	if err != nil {
-		return fmt.Errorf("failed to get task: %v", err)
+		log.Printf("Failed to load task %s to record transcode attempts: %v", taskID, err)
+		return
 	}
 
-	task.M3U8FilePath = transcodeTask.M3U8Path
-
-	if len(transcodeTask.Subtitles) > 0 {
-		if err := task.SetSrts(transcodeTask.Subtitles); err != nil {
-			log.Printf("Failed to set subtitle files: %v", err)
-		}
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["transcode_attempts"] = attempts
+	if err := task.SetMetadata(metadata); err != nil {
+		log.Printf("Failed to set task metadata: %v", err)
+		return
+	}
+	if err := repo.Update(task); err != nil {
+		log.Printf("Failed to record transcode attempts for task %s: %v", taskID, err)
 	}
+}
 
+func (w *Worker) saveTranscodingResults(taskID string, transcodeTask *transcoder.TranscodeTask) error {
 	segments, err := w.readSegmentsFromM3U8(transcodeTask.M3U8Path)
 	if err != nil {
 		log.Printf("Failed to read segments from M3U8: %v", err)
-	} else {
-		if err := task.SetSegments(segments); err != nil {
-			log.Printf("Failed to set segments: %v", err)
+	}
+
+	// 流式转码结束时下载可能仍在写入进度，只写回转码产出的列
+	return w.taskRepository().UpdateOutputs(taskID, func(task *models.Task) error {
+		task.M3U8FilePath = transcodeTask.M3U8Path
+
+		if len(transcodeTask.Subtitles) > 0 {
+			if err := task.SetSrts(transcodeTask.Subtitles); err != nil {
+				log.Printf("Failed to set subtitle files: %v", err)
+			}
+		}
+		if segments != nil {
+			if err := task.SetSegments(segments); err != nil {
+				log.Printf("Failed to set segments: %v", err)
+			}
+		}
+
+		metadata, _ := task.GetMetadata()
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["output_path"] = transcodeTask.OutputPath
+		metadata["segment_count"] = len(segments)
+		metadata["transcode_attempts"] = transcodeTask.Attempts
+		if len(transcodeTask.Tracks) > 0 {
+			metadata["tracks"] = transcodeTask.Tracks
+		}
+		if err := task.SetMetadata(metadata); err != nil {
+			log.Printf("Failed to set task metadata: %v", err)
+		}
+		return nil
+	})
+}
+
+// sendTaskSummary 汇总任务产出信息，写入任务元数据并通过task_completed上报网关。
+// transcodeTask为nil表示任务没有可转码的视频。
+func (w *Worker) sendTaskSummary(taskID string, transcodeTask *transcoder.TranscodeTask) {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		log.Printf("Failed to load task %s for summary: %v", taskID, err)
+		return
+	}
+
+	summary := domain.TaskSummary{
+		Name:              task.TorrentName,
+		TotalBytes:        task.Size,
+		SubtitleLanguages: []string{},
+		CompletedAt:       domain.FormatTime(w.now()),
+	}
+
+	if transcodeTask != nil {
+		info, err := w.transcoder.Probe(transcodeTask.InputPath)
+		if err != nil {
+			log.Printf("Failed to probe media for task %s: %v", taskID, err)
+			w.taskLog.Warn(taskID, tasklog.SourceTranscode, "media probe failed: %v", err)
+			info = nil
+		} else {
+			summary.DurationSeconds = info.DurationSeconds
+			summary.Width = info.Width
+			summary.Height = info.Height
+			summary.VideoCodec = info.VideoCodec
+			summary.AudioCodec = info.AudioCodec
+			summary.SubtitleLanguages = info.SubtitleLanguages
+		}
+
+		if transcodeTask.MediaType == transcoder.MediaTypeAudio {
+			// 探测的是第一个曲目，音频任务的时长为全部曲目之和
+			summary.MediaType = transcodeTask.MediaType
+			summary.DurationSeconds = tracksDuration(transcodeTask.Tracks)
+		}
+
+		if segments, err := task.GetSegments(); err == nil {
+			summary.SegmentCount = len(segments)
+		}
+		summary.OutputBytes = directorySize(transcodeTask.OutputPath)
+
+		if err := w.writeMediaInfoSidecar(taskID, task.TorrentName, transcodeTask, info, videoOutputs(task, w.servePathPrefix())); err != nil {
+			log.Printf("Failed to write %s for task %s: %v", mediaInfoFileName, taskID, err)
+			w.taskLog.Warn(taskID, tasklog.SourceTranscode, "failed to write %s: %v", mediaInfoFileName, err)
 		}
 	}
 
@@ -550,13 +1592,49 @@ func (w *Worker) saveTranscodingResults(taskID string, transcodeTask *transcoder
 	if metadata == nil {
 		metadata = make(map[string]interface{})
 	}
-	metadata["output_path"] = transcodeTask.OutputPath
-	metadata["segment_count"] = len(segments)
-	if err := task.SetMetadata(metadata); err != nil {
-		log.Printf("Failed to set task metadata: %v", err)
+	metadata["summary"] = summary
+	if err := task.SetMetadata(metadata); err == nil {
+		if err := repo.Update(task); err != nil {
+			log.Printf("Failed to store summary for task %s: %v", taskID, err)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"task_id": taskID,
+		"status":  string(domain.TaskStatusReady),
+		"summary": summary,
+	}
+	if !w.gatewaySupports(domain.MessageTypeTaskCompleted) {
+		return
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeTaskCompleted, payload); err != nil {
+		log.Printf("Failed to send completion summary for task %s: %v", taskID, err)
+	}
+}
+
+// tracksDuration 音频任务各曲目时长之和
+func tracksDuration(tracks []transcoder.AudioTrack) float64 {
+	var total float64
+	for _, track := range tracks {
+		total += track.DurationSeconds
+	}
+	return total
+}
+
+// directorySize 统计目录下所有文件的大小
+func directorySize(dir string) int64 {
+	if dir == "" {
+		return 0
 	}
 
-	return repo.Update(task)
+	var total int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
 }
 
 func (w *Worker) readSegmentsFromM3U8(m3u8Path string) ([]string, error) {
@@ -590,6 +1668,43 @@ func (w *Worker) handleWebRTCICECandidate(sessionID string, candidate *webrtcLib
 	}
 }
 
+// handleWebRTCOfferFailed 通知客户端Offer无法建立连接（应答失败或没有收集到ICE候选者），
+// 客户端据此提示原因，而不是一直等到协商超时
+func (w *Worker) handleWebRTCOfferFailed(sessionID, reason string) {
+	if !w.gatewaySupports(domain.MessageTypeWebRTCOfferFailed) {
+		return
+	}
+	payload := map[string]interface{}{
+		"session_id": sessionID,
+		"reason":     reason,
+	}
+	if err := w.gateway.SendMessage(domain.MessageTypeWebRTCOfferFailed, payload); err != nil {
+		log.Printf("Failed to report failed WebRTC offer for session %s: %v", sessionID, err)
+	}
+}
+
+// setTaskMetadata 设置任务元数据中的一项
+func (w *Worker) setTaskMetadata(taskID, key string, value interface{}) {
+	repo := w.taskRepository()
+	task, err := repo.GetByTaskID(taskID)
+	if err != nil {
+		log.Printf("Failed to load task %s to set %s: %v", taskID, key, err)
+		return
+	}
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata[key] = value
+	if err := task.SetMetadata(metadata); err != nil {
+		log.Printf("Failed to set task metadata: %v", err)
+		return
+	}
+	if err := repo.Update(task); err != nil {
+		log.Printf("Failed to set %s of task %s: %v", key, taskID, err)
+	}
+}
+
 func (w *Worker) updateTaskStatusInDB(taskID string, status domain.TaskStatus) {
 	repo := w.taskRepository()
 	if err := repo.UpdateStatus(taskID, status); err != nil {
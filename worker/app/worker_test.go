@@ -1,7 +1,15 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -9,20 +17,26 @@ import (
 	"worker/config"
 	"worker/database"
 	"worker/domain"
+	"worker/downloader"
 	"worker/models"
+	"worker/tasklog"
 	"worker/transcoder"
 	"worker/webrtc"
 
+	"github.com/anacrolix/torrent"
 	webrtcLib "github.com/pion/webrtc/v3"
 )
 
 type fakeGateway struct {
 	messageHandler domain.GatewayMessageHandler
 	statuses       []struct {
-		taskID string
-		status domain.TaskStatus
+		taskID   string
+		status   domain.TaskStatus
+		progress int
+		metadata map[string]interface{}
 	}
 	messages []domain.MessageType
+	payloads []map[string]interface{}
 	mu       sync.Mutex
 }
 
@@ -33,23 +47,27 @@ func (f *fakeGateway) SetMessageHandler(handler domain.GatewayMessageHandler) {
 func (f *fakeGateway) Connect(domain.NodeInfo) error { return nil }
 func (f *fakeGateway) Disconnect()                   {}
 func (f *fakeGateway) IsConnected() bool             { return true }
+func (f *fakeGateway) ActiveURL() string             { return "ws://gateway.test/ws/nodes" }
 
-func (f *fakeGateway) SendMessage(msgType domain.MessageType, _ map[string]interface{}) error {
+func (f *fakeGateway) SendMessage(msgType domain.MessageType, payload map[string]interface{}) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.messages = append(f.messages, msgType)
+	f.payloads = append(f.payloads, payload)
 	return nil
 }
 
-func (f *fakeGateway) SendHeartbeat() error { return nil }
+func (f *fakeGateway) SendHeartbeat(map[string]interface{}) error { return nil }
 
-func (f *fakeGateway) SendTaskStatus(taskID string, status domain.TaskStatus, _ int, _ map[string]interface{}) error {
+func (f *fakeGateway) SendTaskStatus(taskID string, status domain.TaskStatus, progress int, metadata map[string]interface{}) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.statuses = append(f.statuses, struct {
-		taskID string
-		status domain.TaskStatus
-	}{taskID: taskID, status: status})
+		taskID   string
+		status   domain.TaskStatus
+		progress int
+		metadata map[string]interface{}
+	}{taskID: taskID, status: status, progress: progress, metadata: metadata})
 	return nil
 }
 
@@ -58,22 +76,97 @@ func (f *fakeGateway) SendICECandidate(string, string) error { return nil }
 
 type fakeDownloader struct {
 	startCalledWith []string
+	startSelections [][]string
+	startPriorities []int
+	startOptions    []downloader.TaskOptions
+	repo            *fakeTaskRepository // 非nil时提交的任务写入其中
 	tasks           []*models.Task
 	lookup          map[string]*models.Task
 	statusHandler   func(*models.Task)
+	metadataHandler func(*models.Task)
+	streamHandler   func(*models.Task, string)
+	aborted         []string
+	removed         []string
+	kept            []string
+	retried         []string
+	paused          []string
+	resumed         []string
+	listen          *downloader.ListenStatus
+	queue           downloader.QueueSnapshot
+	shortfall       downloader.DiskShortfall
+	quiet           bool
+	rateLimit       [2]int
+	torrentInfo     *downloader.TorrentInfo
+	fetchErr        error
 }
 
 func (f *fakeDownloader) Start() error { return nil }
 func (f *fakeDownloader) Stop()        {}
 
-func (f *fakeDownloader) StartDownload(magnetURL string) (string, error) {
+func (f *fakeDownloader) ListenStatus() downloader.ListenStatus {
+	if f.listen != nil {
+		return *f.listen
+	}
+	return downloader.ListenStatus{Port: 42069, OK: true}
+}
+
+func (f *fakeDownloader) StartDownload(magnetURL string, priority int) (string, error) {
+	return f.StartDownloadWithOptions(magnetURL, downloader.TaskOptions{Priority: priority})
+}
+
+func (f *fakeDownloader) StartDownloadWithSelection(magnetURL string, selected []string) (string, error) {
+	return f.StartDownloadWithOptions(magnetURL, downloader.TaskOptions{Selected: selected, Priority: domain.DefaultTaskPriority})
+}
+
+// StartDownloadWithOptions 记录提交选项；设置了repo时像下载器一样按选项创建任务记录，任务ID固定为task-1
+func (f *fakeDownloader) StartDownloadWithOptions(magnetURL string, options downloader.TaskOptions) (string, error) {
 	f.startCalledWith = append(f.startCalledWith, magnetURL)
+	f.startPriorities = append(f.startPriorities, options.Priority)
+	f.startOptions = append(f.startOptions, options)
+	if len(options.Selected) > 0 {
+		f.startSelections = append(f.startSelections, options.Selected)
+	}
+	if f.repo != nil {
+		task, err := downloader.NewTask(magnetURL, "worker-1", options)
+		if err != nil {
+			return "", err
+		}
+		task.TaskID = "task-1"
+		task.Status = domain.TaskStatusDownloading
+		f.repo.Create(task)
+	}
 	return "task-1", nil
 }
 
-func (f *fakeDownloader) PauseTask(string) error  { return nil }
-func (f *fakeDownloader) ResumeTask(string) error { return nil }
-func (f *fakeDownloader) RemoveTask(string) error { return nil }
+func (f *fakeDownloader) FetchMetadata(magnetURL string) (*downloader.TorrentInfo, error) {
+	if f.fetchErr != nil {
+		return nil, f.fetchErr
+	}
+	return f.torrentInfo, nil
+}
+
+func (f *fakeDownloader) SetPriority(string, int) error      { return nil }
+func (f *fakeDownloader) SelectFiles(string, []string) error { return nil }
+
+func (f *fakeDownloader) PauseTask(taskID string) error {
+	f.paused = append(f.paused, taskID)
+	return nil
+}
+func (f *fakeDownloader) ResumeTask(taskID string) error {
+	f.resumed = append(f.resumed, taskID)
+	return nil
+}
+func (f *fakeDownloader) RetryTask(taskID string) error {
+	f.retried = append(f.retried, taskID)
+	return nil
+}
+func (f *fakeDownloader) RemoveTask(taskID string, purgeFiles bool) error {
+	f.removed = append(f.removed, taskID)
+	if !purgeFiles {
+		f.kept = append(f.kept, taskID)
+	}
+	return nil
+}
 
 func (f *fakeDownloader) GetTask(taskID string) (*models.Task, bool) {
 	if f.lookup == nil {
@@ -87,6 +180,16 @@ func (f *fakeDownloader) GetAllTasks() []*models.Task {
 	return f.tasks
 }
 
+func (f *fakeDownloader) GetTasksByStatus(status domain.TaskStatus) ([]*models.Task, error) {
+	var tasks []*models.Task
+	for _, task := range f.tasks {
+		if task.Status == status {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
 func (f *fakeDownloader) GetStatusChannel() <-chan *models.Task {
 	ch := make(chan *models.Task)
 	close(ch)
@@ -97,42 +200,150 @@ func (f *fakeDownloader) SetExternalStatusHandler(handler func(*models.Task)) {
 	f.statusHandler = handler
 }
 
+func (f *fakeDownloader) SetMetadataHandler(handler func(*models.Task)) {
+	f.metadataHandler = handler
+}
+
+func (f *fakeDownloader) SetStreamReadyHandler(handler func(*models.Task, string)) {
+	f.streamHandler = handler
+}
+
+func (f *fakeDownloader) GetReader(taskID, filePath string) (torrent.Reader, error) {
+	return nil, errors.New("not downloading")
+}
+
+func (f *fakeDownloader) QueueSnapshot() downloader.QueueSnapshot {
+	return f.queue
+}
+
+func (f *fakeDownloader) DiskShortfall() downloader.DiskShortfall {
+	return f.shortfall
+}
+
+func (f *fakeDownloader) PruneTaskData(taskID string, dryRun bool) (*downloader.PruneResult, error) {
+	return &downloader.PruneResult{TaskID: taskID, DryRun: dryRun, Files: []string{}}, nil
+}
+
+func (f *fakeDownloader) PieceAvailability(taskID string) (*downloader.PieceMap, error) {
+	return nil, downloader.ErrPiecesUnavailable
+}
+
+func (f *fakeDownloader) AbortTask(taskID string, reason error) error {
+	f.aborted = append(f.aborted, taskID+": "+reason.Error())
+	return nil
+}
+
+func (f *fakeDownloader) SetQuiet(quiet bool) { f.quiet = quiet }
+
+func (f *fakeDownloader) SetRateLimit(downKbps, upKbps int) { f.rateLimit = [2]int{downKbps, upKbps} }
+
 type fakeTranscoder struct {
-	startCalls []string
-	statusCh   chan *transcoder.TranscodeTask
+	mu           sync.Mutex
+	startCalls   []string
+	startOptions []transcoder.Options
+	statusCh     chan *transcoder.TranscodeTask
+	mediaInfo    *transcoder.MediaInfo
+	queue        transcoder.QueueSnapshot
+	quiet        bool
+	quietSuspend bool
 }
 
 func (f *fakeTranscoder) Start() error { return nil }
 func (f *fakeTranscoder) Stop()        {}
 
 func (f *fakeTranscoder) StartTranscode(inputPath string) (string, error) {
+	return f.StartTranscodeWithOptions(inputPath, transcoder.Options{})
+}
+
+func (f *fakeTranscoder) StartTranscodeWithOptions(inputPath string, options transcoder.Options) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.startCalls = append(f.startCalls, inputPath)
-	return "transcode-1", nil
+	f.startOptions = append(f.startOptions, options)
+	return fmt.Sprintf("transcode-%d", len(f.startCalls)), nil
+}
+
+// waitStarts 等待转码被启动n次，返回各次的选项
+func (f *fakeTranscoder) waitStarts(t *testing.T, n int) []transcoder.Options {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		options := append([]transcoder.Options(nil), f.startOptions...)
+		f.mu.Unlock()
+		if len(options) >= n {
+			return options
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d transcode starts, got %d", n, len(options))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 func (f *fakeTranscoder) GetTask(string) (*transcoder.TranscodeTask, bool) { return nil, false }
 func (f *fakeTranscoder) GetAllTasks() []*transcoder.TranscodeTask         { return nil }
 
+func (f *fakeTranscoder) BoostTask(string) int { return 0 }
+
+func (f *fakeTranscoder) RepairStrategy(string) transcoder.Strategy {
+	return transcoder.DefaultStrategies()[1]
+}
+
+func (f *fakeTranscoder) SetQueueEventHandler(func(*transcoder.TranscodeTask, string)) {}
+
+func (f *fakeTranscoder) QueueSnapshot() transcoder.QueueSnapshot { return f.queue }
+
+func (f *fakeTranscoder) SetQuiet(quiet, suspend bool) {
+	f.quiet = quiet
+	f.quietSuspend = suspend
+}
+
 func (f *fakeTranscoder) GetStatusChannel() <-chan *transcoder.TranscodeTask {
 	return f.statusCh
 }
 
+func (f *fakeTranscoder) Probe(string) (*transcoder.MediaInfo, error) {
+	if f.mediaInfo == nil {
+		return nil, errors.New("no media info")
+	}
+	return f.mediaInfo, nil
+}
+
 type fakeWebRTC struct {
 	configUpdates int
+	offerErr      error
+	access        map[string]webrtc.SegmentAccess
 }
 
 func (f *fakeWebRTC) Start() error { return nil }
 func (f *fakeWebRTC) Stop()        {}
 
-func (f *fakeWebRTC) HandleOffer(string, string) (string, error) { return "answer", nil }
-func (f *fakeWebRTC) AddICECandidate(string, string) error       { return nil }
-func (f *fakeWebRTC) GetSession(string) (*webrtc.Session, bool)  { return nil, false }
-func (f *fakeWebRTC) GetAllSessions() []*webrtc.Session          { return nil }
+func (f *fakeWebRTC) HandleOffer(string, string) (string, error) {
+	if f.offerErr != nil {
+		return "", f.offerErr
+	}
+	return "answer", nil
+}
+
+func (f *fakeWebRTC) HandleProbe(sessionID, sdp string) (string, error) {
+	return f.HandleOffer(sessionID, sdp)
+}
+func (f *fakeWebRTC) AddICECandidate(string, string) error { return nil }
+func (f *fakeWebRTC) CloseSession(string) bool             { return false }
+
+func (f *fakeWebRTC) ResendICECandidates(string) (webrtc.ICEResend, error) {
+	return webrtc.ICEResend{}, nil
+}
+func (f *fakeWebRTC) GetSession(string) (*webrtc.Session, bool) { return nil, false }
+func (f *fakeWebRTC) GetAllSessions() []*webrtc.Session         { return nil }
 
 func (f *fakeWebRTC) SetICECandidateHandler(func(string, *webrtcLib.ICECandidate)) {}
 
 func (f *fakeWebRTC) SetConnectionStateHandler(func(string, webrtcLib.PeerConnectionState)) {}
 
+func (f *fakeWebRTC) SetServedBytesHandler(func(string, int64)) {}
+
 func (f *fakeWebRTC) UpdateConfiguration(webrtcLib.Configuration) {
 	f.configUpdates++
 }
@@ -140,6 +351,28 @@ func (f *fakeWebRTC) UpdateConfiguration(webrtcLib.Configuration) {
 func (f *fakeWebRTC) SendData(string, []byte) error { return nil }
 func (f *fakeWebRTC) BroadcastData([]byte)          {}
 
+func (f *fakeWebRTC) SetSegmentRepairHandler(func(string, string) (string, error)) {}
+
+func (f *fakeWebRTC) SetOfferFailedHandler(func(string, string)) {}
+
+func (f *fakeWebRTC) SetProbeResultHandler(func(webrtc.ProbeResult)) {}
+
+func (f *fakeWebRTC) ForgetFile(string, string) {}
+
+func (f *fakeWebRTC) SessionStats(string) (webrtc.SessionStats, bool) {
+	return webrtc.SessionStats{}, false
+}
+
+func (f *fakeWebRTC) AggregateStats() webrtc.AggregateStats { return webrtc.AggregateStats{} }
+
+func (f *fakeWebRTC) SegmentAccess(taskID string) (webrtc.SegmentAccess, bool) {
+	access, ok := f.access[taskID]
+	if !ok {
+		return webrtc.SegmentAccess{TaskID: taskID}, false
+	}
+	return access, true
+}
+
 type fakeTaskRepository struct {
 	store map[string]*models.Task
 }
@@ -159,13 +392,28 @@ func (f *fakeTaskRepository) GetByTaskID(taskID string) (*models.Task, error) {
 	return nil, errors.New("not found")
 }
 
+func (f *fakeTaskRepository) FindByMagnetURL(magnetURL string) (*models.Task, error) {
+	for _, task := range f.store {
+		if task.MagnetURL == magnetURL {
+			return task, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
 func (f *fakeTaskRepository) GetAll() ([]models.Task, error) { return nil, nil }
 func (f *fakeTaskRepository) GetByWorkerID(string) ([]models.Task, error) {
 	return nil, nil
 }
 
-func (f *fakeTaskRepository) GetByStatus(domain.TaskStatus) ([]models.Task, error) {
-	return nil, nil
+func (f *fakeTaskRepository) GetByStatus(status domain.TaskStatus) ([]models.Task, error) {
+	var tasks []models.Task
+	for _, task := range f.store {
+		if task.Status == status {
+			tasks = append(tasks, *task)
+		}
+	}
+	return tasks, nil
 }
 
 func (f *fakeTaskRepository) Update(task *models.Task) error {
@@ -181,9 +429,61 @@ func (f *fakeTaskRepository) UpdateStatus(taskID string, status domain.TaskStatu
 	return errors.New("not found")
 }
 
-func (f *fakeTaskRepository) UpdateProgress(string, int, int64, int64) error { return nil }
-func (f *fakeTaskRepository) Delete(string) error                            { return nil }
-func (f *fakeTaskRepository) GetActiveTasksCount(string) (int64, error)      { return 0, nil }
+func (f *fakeTaskRepository) UpdateMetadata(taskID string, update func(map[string]interface{})) error {
+	task, ok := f.store[taskID]
+	if !ok {
+		return errors.New("not found")
+	}
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	update(metadata)
+	return task.SetMetadata(metadata)
+}
+
+func (f *fakeTaskRepository) UpdateOutputs(taskID string, update func(*models.Task) error) error {
+	task, ok := f.store[taskID]
+	if !ok {
+		return errors.New("not found")
+	}
+	return update(task)
+}
+
+func (f *fakeTaskRepository) UpdateFiles(taskID string, update func(*models.Task) error) error {
+	return f.UpdateOutputs(taskID, update)
+}
+
+func (f *fakeTaskRepository) UpdateProgress(string, int, int64, int64) error      { return nil }
+func (f *fakeTaskRepository) UpdateProgressBatch([]database.ProgressUpdate) error { return nil }
+func (f *fakeTaskRepository) AddTraffic(taskID string, downloaded, served int64) error {
+	if task, ok := f.store[taskID]; ok {
+		task.BytesDownloaded += downloaded
+		task.BytesServed += served
+	}
+	return nil
+}
+func (f *fakeTaskRepository) SetPinned(taskID string, pinned bool) error {
+	task, ok := f.store[taskID]
+	if !ok {
+		return errors.New("not found")
+	}
+	task.Pinned = pinned
+	return nil
+}
+func (f *fakeTaskRepository) Delete(string) error                       { return nil }
+func (f *fakeTaskRepository) GetActiveTasksCount(string) (int64, error) { return 0, nil }
+func (f *fakeTaskRepository) GetNextPending(string) (*models.Task, error) {
+	return nil, errors.New("not found")
+}
+func (f *fakeTaskRepository) SetPriority(taskID string, priority int) error {
+	task, ok := f.store[taskID]
+	if !ok {
+		return errors.New("not found")
+	}
+	task.Priority = priority
+	return nil
+}
 
 func TestWorkerHandleTaskSubmitUsesDownloaderAndGateway(t *testing.T) {
 	cfg := config.Default()
@@ -217,6 +517,91 @@ func TestWorkerHandleTaskSubmitUsesDownloaderAndGateway(t *testing.T) {
 	if len(gw.statuses) != 1 || gw.statuses[0].status != domain.TaskStatusDownloading {
 		t.Fatalf("expected gateway to receive status update, got %+v", gw.statuses)
 	}
+	if len(dl.startSelections) != 0 {
+		t.Fatalf("expected a submission without selected_files to download every file")
+	}
+	// 播放令牌随任务记录一起创建
+	if token, _ := dl.startOptions[0].Metadata["stream_token"].(string); len(token) != 64 {
+		t.Fatalf("expected the task to be created with a stream token, got %v", dl.startOptions[0].Metadata)
+	}
+
+	worker.handleTaskSubmit(map[string]interface{}{
+		"magnet_url":     "magnet-2",
+		"selected_files": []interface{}{"Show/e01.mkv", "Show/e03.mkv"},
+		"priority":       float64(9),
+	})
+	if len(dl.startSelections) != 1 || strings.Join(dl.startSelections[0], ",") != "Show/e01.mkv,Show/e03.mkv" {
+		t.Fatalf("expected the selection to be passed to the downloader, got %v", dl.startSelections)
+	}
+	if len(dl.startPriorities) != 2 || dl.startPriorities[0] != domain.DefaultTaskPriority || dl.startPriorities[1] != 9 {
+		t.Fatalf("expected default then submitted priority, got %v", dl.startPriorities)
+	}
+}
+
+func TestWorkerCarriesTraceIDThroughTaskPipeline(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{}}
+	taskLog := tasklog.New(t.TempDir(), 0, 0)
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{repo: repo},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+		TaskLog:         taskLog,
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	worker.handleTaskSubmit(map[string]interface{}{
+		"magnet_url": "magnet",
+		"request_id": "req-1",
+		"trace_id":   traceID,
+	})
+
+	if repo.store["task-1"].TraceID != traceID {
+		t.Fatalf("expected trace to be persisted on the task, got %q", repo.store["task-1"].TraceID)
+	}
+	if len(gw.payloads) != 1 || gw.payloads[0]["trace_id"] != traceID {
+		t.Fatalf("expected submit response to carry the trace, got %v", gw.payloads)
+	}
+
+	// 之后的状态上报与任务日志都带上追踪ID，包括重启后从数据库加载
+	worker.forgetTraceID("task-1")
+	worker.gateway.SendTaskStatus("task-1", domain.TaskStatusTranscoding, 100, nil)
+	worker.taskLog.Info("task-1", tasklog.SourceTranscode, "ffmpeg started")
+
+	for _, status := range gw.statuses {
+		if status.metadata["trace_id"] != traceID {
+			t.Fatalf("expected %s status to carry the trace, got %v", status.status, status.metadata)
+		}
+	}
+	if len(gw.statuses) != 2 {
+		t.Fatalf("expected two status updates, got %d", len(gw.statuses))
+	}
+
+	content, err := taskLog.Tail("task-1", 64*1024)
+	if err != nil {
+		t.Fatalf("read task log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	for _, line := range lines {
+		var entry tasklog.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", line, err)
+		}
+		if entry.TraceID != traceID {
+			t.Fatalf("expected every log line to carry the trace, got %q", line)
+		}
+	}
+	if len(lines) < 2 {
+		t.Fatalf("expected submit and transcode log lines, got %q", content)
+	}
 }
 
 func TestWorkerHandleGetTasksResponds(t *testing.T) {
@@ -225,7 +610,7 @@ func TestWorkerHandleGetTasksResponds(t *testing.T) {
 
 	gw := &fakeGateway{}
 	dl := &fakeDownloader{}
-	dl.tasks = []*models.Task{{TaskID: "task-1"}}
+	dl.tasks = []*models.Task{{TaskID: "task-1", Status: domain.TaskStatusDownloading, Peers: 7, ETASeconds: -1}}
 	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
 	wr := &fakeWebRTC{}
 
@@ -247,4 +632,2081 @@ func TestWorkerHandleGetTasksResponds(t *testing.T) {
 	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTasksResponse {
 		t.Fatalf("expected tasks response to be sent, got %v", gw.messages)
 	}
+	tasks, _ := gw.payloads[0]["tasks"].([]map[string]interface{})
+	if len(tasks) != 1 || tasks[0]["peers"] != 7 || tasks[0]["eta_seconds"] != int64(-1) {
+		t.Fatalf("expected peers and ETA in the task list, got %v", tasks)
+	}
+}
+
+func TestWorkerBoundsTaskMetadataAndListPayload(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Big Pack", Status: domain.TaskStatusError}
+	files := make([]models.TorrentFileInfo, 500)
+	for i := range files {
+		files[i] = models.TorrentFileInfo{FileName: fmt.Sprintf("track-%03d.flac", i), FilePath: fmt.Sprintf("Big Pack/track-%03d.flac", i)}
+	}
+	if err := task.SetTorrentFiles(files); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+	metadata := map[string]interface{}{
+		"error":       "transcode failed",
+		"sub_status":  "failed",
+		"ffmpeg_tail": strings.Repeat("frame=1 fps=25\n", 2000) + "Conversion failed!",
+	}
+	for i := 0; i < 50; i++ {
+		metadata[fmt.Sprintf("note_%02d", i)] = strings.Repeat("x", 500)
+	}
+	if err := task.SetMetadata(metadata); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+
+	// 元数据不超过上限：ffmpeg输出保留末尾并注明截断，超出的附加字段被删除并记录
+	if len(task.Metadata) > models.MaxMetadataBytes {
+		t.Fatalf("expected metadata within %d bytes, got %d", models.MaxMetadataBytes, len(task.Metadata))
+	}
+	stored, _ := task.GetMetadata()
+	tail, _ := stored["ffmpeg_tail"].(string)
+	if !strings.HasPrefix(tail, "...[truncated ") || !strings.HasSuffix(tail, "Conversion failed!") {
+		t.Fatalf("expected the ffmpeg tail to keep its end behind a marker, got %.80q", tail)
+	}
+	dropped, _ := stored[models.MetadataDroppedKey].([]interface{})
+	if len(dropped) == 0 || stored["error"] != "transcode failed" || stored["sub_status"] != "failed" {
+		t.Fatalf("expected extra keys dropped and essential keys kept, got dropped=%v", dropped)
+	}
+
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{tasks: []*models.Task{task}},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 列表只带前几个文件名与文件总数，每个任务的数据保持在几KB以内
+	worker.handleGetTasks(map[string]interface{}{})
+	tasks, _ := gw.payloads[0]["tasks"].([]map[string]interface{})
+	if len(tasks) != 1 || tasks[0]["file_count"] != 500 || len(tasks[0]["files"].([]string)) != listFileLimit {
+		t.Fatalf("expected a capped file list with the total count, got %v", tasks)
+	}
+	encoded, _ := json.Marshal(tasks[0])
+	if len(encoded) > 4<<10 {
+		t.Fatalf("expected the task list entry under 4KB, got %d bytes", len(encoded))
+	}
+}
+
+func TestWorkerReportsFailedWebRTCOffer(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	gw := &fakeGateway{}
+	wr := &fakeWebRTC{offerErr: errors.New("failed to set remote description: malformed SDP")}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          wr,
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleWebRTCOffer(map[string]interface{}{"session_id": "session-1", "client_id": "client-1", "sdp": "v=0"})
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeWebRTCOfferFailed {
+		t.Fatalf("expected webrtc_offer_failed instead of an answer, got %v", gw.messages)
+	}
+	if gw.payloads[0]["session_id"] != "session-1" || gw.payloads[0]["reason"] != wr.offerErr.Error() {
+		t.Fatalf("expected the session and reason in the report, got %v", gw.payloads[0])
+	}
+
+	// 旧版网关不认识该消息
+	gw.messageHandler(domain.MessageTypeRegistrationConfirmed, map[string]interface{}{"node_id": "worker-1", "protocol_version": float64(14)})
+	worker.handleWebRTCOfferFailed("session-2", "no ICE candidates gathered")
+	if len(gw.messages) != 1 {
+		t.Fatalf("expected no report to a gateway without webrtc_offer_failed, got %v", gw.messages)
+	}
+}
+
+func TestWorkerHandleGetTaskLogResponds(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	taskLog := tasklog.New(t.TempDir(), 0, 0)
+	taskLog.Error("task-1", tasklog.SourceDownload, "tracker unreachable")
+
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: &fakeDownloader{},
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     &fakeWebRTC{},
+		TaskLog:    taskLog,
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleGetTaskLog(map[string]interface{}{"task_id": "task-1", "request_id": "req-1"})
+
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTaskLogResponse {
+		t.Fatalf("expected task log response to be sent, got %v", gw.messages)
+	}
+
+	payload := gw.payloads[0]
+	content, _ := payload["content"].(string)
+	if payload["found"] != true || payload["request_id"] != "req-1" || !strings.Contains(content, "tracker unreachable") {
+		t.Fatalf("unexpected task log payload: %v", payload)
+	}
+}
+
+func TestWorkerAbortsTaskOnPolicyBlock(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	dl.metadataHandler(&models.Task{TaskID: "task-1", InfoHash: "abc", TorrentName: "name"})
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTaskPolicyCheck {
+		t.Fatalf("expected policy check to be sent, got %v", gw.messages)
+	}
+
+	worker.handleGatewayMessage(domain.MessageTypeTaskPolicyVerdict, map[string]interface{}{"task_id": "task-1", "allowed": true})
+	if len(dl.aborted) != 0 {
+		t.Fatalf("allowed verdict must not abort: %v", dl.aborted)
+	}
+
+	worker.handleGatewayMessage(domain.MessageTypeTaskPolicyVerdict, map[string]interface{}{
+		"task_id": "task-1",
+		"allowed": false,
+		"reason":  "info hash is blocklisted",
+	})
+	if len(dl.aborted) != 1 || !strings.Contains(dl.aborted[0], "task-1") {
+		t.Fatalf("expected blocked task to be aborted, got %v", dl.aborted)
+	}
+}
+
+func TestWorkerSendsCompletionSummary(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	outputDir := t.TempDir()
+	playlist := filepath.Join(outputDir, "index.m3u8")
+	if err := os.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:10,\nindex0.ts\n#EXTINF:10,\nindex1.ts\n#EXT-X-ENDLIST\n"), 0644); err != nil {
+		t.Fatalf("write playlist: %v", err)
+	}
+	for _, name := range []string{"index0.ts", "index1.ts"} {
+		if err := os.WriteFile(filepath.Join(outputDir, name), make([]byte, 100), 0644); err != nil {
+			t.Fatalf("write segment: %v", err)
+		}
+	}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"task-1": {TaskID: "task-1", TorrentName: "Movie", Size: 4096},
+	}}
+	gw := &fakeGateway{}
+	tr := &fakeTranscoder{
+		statusCh: make(chan *transcoder.TranscodeTask),
+		mediaInfo: &transcoder.MediaInfo{
+			DurationSeconds:   20,
+			Width:             1280,
+			Height:            720,
+			VideoCodec:        "h264",
+			SubtitleLanguages: []string{"eng", "chi"},
+		},
+	}
+
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+		Clock:           func() time.Time { return time.Unix(1700000000, 0) },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	transcodeTask := &transcoder.TranscodeTask{
+		ID:         "transcode-1",
+		InputPath:  "/downloads/movie.mkv",
+		OutputPath: outputDir,
+		M3U8Path:   playlist,
+	}
+	if err := worker.saveTranscodingResults("task-1", transcodeTask); err != nil {
+		t.Fatalf("save results: %v", err)
+	}
+	worker.sendTaskSummary("task-1", transcodeTask)
+
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTaskCompleted {
+		t.Fatalf("expected task_completed message, got %v", gw.messages)
+	}
+
+	summary, ok := gw.payloads[0]["summary"].(domain.TaskSummary)
+	if !ok {
+		t.Fatalf("summary missing from payload: %v", gw.payloads[0])
+	}
+	if summary.Name != "Movie" || summary.Width != 1280 || summary.Height != 720 || summary.DurationSeconds != 20 {
+		t.Fatalf("unexpected media fields: %+v", summary)
+	}
+	if summary.SegmentCount != 2 || summary.OutputBytes <= 200 || len(summary.SubtitleLanguages) != 2 {
+		t.Fatalf("unexpected output fields: %+v", summary)
+	}
+	if summary.CompletedAt != "2023-11-14T22:13:20Z" {
+		t.Fatalf("expected RFC3339 completion time from clock, got %s", summary.CompletedAt)
+	}
+
+	metadata, _ := repo.store["task-1"].GetMetadata()
+	if _, stored := metadata["summary"]; !stored {
+		t.Fatalf("expected summary to be stored in task metadata: %v", metadata)
+	}
+}
+
+func TestWorkerWritesMediaInfoSidecar(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	outputDir := t.TempDir()
+	playlist := filepath.Join(outputDir, "index.m3u8")
+	files := []string{"index.m3u8", "index0.ts", "subtitle_3.srt", "subtitle_2.srt", "movie.zh-CN.srt", "poster.jpg"}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte("#EXTM3U\n"), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"task-1": {TaskID: "task-1", TorrentName: "Movie", Size: 4096},
+	}}
+	tr := &fakeTranscoder{
+		statusCh: make(chan *transcoder.TranscodeTask),
+		mediaInfo: &transcoder.MediaInfo{
+			DurationSeconds:   5400.5,
+			Width:             1920,
+			Height:            1080,
+			VideoCodec:        "h264",
+			AudioCodec:        "aac",
+			SubtitleLanguages: []string{"eng", "chi"},
+		},
+	}
+	clock := time.Unix(1700000000, 0)
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+		Clock:           func() time.Time { return clock },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	transcodeTask := &transcoder.TranscodeTask{
+		ID:         "transcode-1",
+		InputPath:  "/downloads/movie.mkv",
+		OutputPath: outputDir,
+		M3U8Path:   playlist,
+		Subtitles: []transcoder.SubtitleInfo{
+			transcoder.SubtitleInfoFromPath(filepath.Join(outputDir, "movie.zh-CN.srt")),
+			transcoder.SubtitleInfoFromPath(filepath.Join(outputDir, "subtitle_3.srt")),
+			transcoder.SubtitleInfoFromPath(filepath.Join(outputDir, "subtitle_2.srt")),
+			transcoder.SubtitleInfoFromPath(filepath.Join(outputDir, "subtitle_jpn_5.srt")),
+		},
+	}
+	worker.sendTaskSummary("task-1", transcodeTask)
+
+	readSidecar := func() domain.MediaInfoSidecar {
+		data, err := os.ReadFile(filepath.Join(outputDir, mediaInfoFileName))
+		if err != nil {
+			t.Fatalf("read sidecar: %v", err)
+		}
+		var sidecar domain.MediaInfoSidecar
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			t.Fatalf("decode sidecar: %v", err)
+		}
+		return sidecar
+	}
+
+	sidecar := readSidecar()
+	if sidecar.TaskID != "task-1" || sidecar.Name != "Movie" || sidecar.Playlist != "/video/task-1/index.m3u8" {
+		t.Fatalf("unexpected playlist fields: %+v", sidecar)
+	}
+	if sidecar.DurationSeconds != 5400.5 || sidecar.Width != 1920 || sidecar.Height != 1080 || sidecar.AudioCodec != "aac" {
+		t.Fatalf("unexpected media fields: %+v", sidecar)
+	}
+	if sidecar.Poster != "/video/task-1/poster.jpg" {
+		t.Fatalf("expected poster uri, got %q", sidecar.Poster)
+	}
+	wantSubtitles := []domain.SubtitleTrack{
+		{URI: "/video/task-1/subtitle_2.srt", Language: "eng"},
+		{URI: "/video/task-1/subtitle_3.srt", Language: "chi"},
+		{URI: "/video/task-1/subtitle_jpn_5.srt", Language: "jpn"},
+		{URI: "/video/task-1/movie.zh-CN.srt", Language: "zh-CN"},
+	}
+	if !reflect.DeepEqual(sidecar.Subtitles, wantSubtitles) {
+		t.Fatalf("unexpected subtitle tracks: %+v", sidecar.Subtitles)
+	}
+
+	// 重新转码后按新的探测结果重新生成
+	tr.mediaInfo = &transcoder.MediaInfo{DurationSeconds: 60, Width: 1280, Height: 720}
+	clock = clock.Add(time.Hour)
+	transcodeTask.Subtitles = nil
+	worker.sendTaskSummary("task-1", transcodeTask)
+
+	sidecar = readSidecar()
+	if sidecar.Width != 1280 || sidecar.DurationSeconds != 60 || len(sidecar.Subtitles) != 0 {
+		t.Fatalf("expected sidecar to be regenerated, got %+v", sidecar)
+	}
+	if sidecar.GeneratedAt != "2023-11-14T23:13:20Z" {
+		t.Fatalf("expected regeneration time from clock, got %s", sidecar.GeneratedAt)
+	}
+
+	// 播放地址按network.serve_path_prefix生成，与数据通道接受的路径一致
+	worker.config.Network.ServePathPrefix = "media"
+	worker.sendTaskSummary("task-1", transcodeTask)
+	if sidecar = readSidecar(); sidecar.Playlist != "/media/task-1/index.m3u8" || sidecar.Poster != "/media/task-1/poster.jpg" {
+		t.Fatalf("expected URIs under the configured prefix, got %q %q", sidecar.Playlist, sidecar.Poster)
+	}
+}
+
+func TestRunSelfTestChecksReportsFailures(t *testing.T) {
+	checks := []selfTestCheck{
+		{name: "ok", run: func() (string, error) { return "fine", nil }},
+		{name: "broken", run: func() (string, error) { return "", errors.New("boom") }},
+	}
+
+	report := runSelfTestChecks("worker-1", checks)
+	if report.Passed {
+		t.Fatalf("report must fail when a check fails")
+	}
+	if len(report.Results) != 2 || !report.Results[0].Passed || report.Results[1].Error != "boom" {
+		t.Fatalf("unexpected results: %+v", report.Results)
+	}
+}
+
+func TestWorkerSelfTestConfigCheck(t *testing.T) {
+	cfg := config.Default()
+	cfg.Gateway.URL = "http://example.com"
+	cfg.Limits.MaxDownloads = 0
+
+	w := &Worker{config: cfg, now: time.Now}
+	if _, err := w.checkConfig(); err == nil || !strings.Contains(err.Error(), "gateway.url") || !strings.Contains(err.Error(), "max_downloads") {
+		t.Fatalf("expected config problems to be reported, got %v", err)
+	}
+
+	cfg.Gateway.URL = "ws://localhost:8080/ws/nodes"
+	cfg.Limits.MaxDownloads = 5
+	if _, err := w.checkConfig(); err != nil {
+		t.Fatalf("default config should validate: %v", err)
+	}
+}
+
+func TestWorkerTranscodeFallsBackAfterRemuxFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg scripts require a POSIX shell")
+	}
+
+	// 伪造的ffmpeg在直接复制流时失败（并留下不完整的播放列表），重新编码时成功
+	binDir := t.TempDir()
+	ffprobe := "#!/bin/sh\necho h264\n"
+	ffmpeg := `#!/bin/sh
+for last; do :; done
+dir=$(dirname "$last")
+for arg; do
+  if [ "$arg" = "copy" ]; then
+    printf '#EXTM3U\n' > "$last"
+    echo "codec not supported in container" >&2
+    exit 1
+  fi
+done
+printf '#EXTM3U\n#EXTINF:10.0,\nindex0.ts\n#EXT-X-ENDLIST\n' > "$last"
+: > "$dir/index0.ts"
+`
+	if err := os.WriteFile(filepath.Join(binDir, "ffprobe"), []byte(ffprobe), 0755); err != nil {
+		t.Fatalf("write fake ffprobe: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "ffmpeg"), []byte(ffmpeg), 0755); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	downloadDir := t.TempDir()
+	input := filepath.Join(downloadDir, "movie.mp4")
+	if err := os.WriteFile(input, []byte("not really a video"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"task-1": {TaskID: "task-1", TorrentName: "Movie", Status: domain.TaskStatusTranscoding},
+	}}
+	tr := transcoder.New(downloadDir, t.TempDir())
+
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	transcodeID, err := tr.StartTranscode(input)
+	if err != nil {
+		t.Fatalf("start transcode: %v", err)
+	}
+	worker.monitorTranscodingProgress("task-1", transcodeID, tr.GetStatusChannel())
+
+	task := repo.store["task-1"]
+	if task.Status != domain.TaskStatusReady {
+		t.Fatalf("expected task to be ready, got %s", task.Status)
+	}
+
+	metadata, _ := task.GetMetadata()
+	attempts, ok := metadata["transcode_attempts"].([]interface{})
+	if !ok || len(attempts) != 2 {
+		t.Fatalf("expected two recorded attempts, got %v", metadata["transcode_attempts"])
+	}
+	first, _ := attempts[0].(map[string]interface{})
+	second, _ := attempts[1].(map[string]interface{})
+	if first["strategy"] != "remux" || first["success"] != false || first["error"] == "" {
+		t.Fatalf("unexpected remux attempt: %v", first)
+	}
+	if second["strategy"] != "transcode" || second["success"] != true {
+		t.Fatalf("unexpected transcode attempt: %v", second)
+	}
+}
+
+func TestWorkerForwardsTranscodeProgress(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	gateway := &fakeGateway{}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask, 4)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gateway,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{store: map[string]*models.Task{}} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Status: domain.TranscodeStatusProcessing}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Status: domain.TranscodeStatusProcessing, Progress: 42, ProcessedSeconds: 1260.4}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-2", Status: domain.TranscodeStatusProcessing, Progress: 10, ProcessedSeconds: 60}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Status: domain.TranscodeStatusProcessing, ProgressIndeterminate: true, ProcessedSeconds: 1320}
+	close(tr.statusCh)
+	worker.monitorTranscodingProgress("task-1", "transcode-1", tr.statusCh)
+
+	if len(gateway.statuses) != 2 {
+		t.Fatalf("expected two progress updates for task-1, got %+v", gateway.statuses)
+	}
+	first, second := gateway.statuses[0], gateway.statuses[1]
+	if first.taskID != "task-1" || first.status != domain.TaskStatusTranscoding || first.progress != 42 ||
+		first.metadata["transcoded_seconds"] != float64(1260) || first.metadata["progress_indeterminate"] != nil {
+		t.Fatalf("unexpected progress update: %+v", first)
+	}
+	if second.progress != -1 || second.metadata["progress_indeterminate"] != true || second.metadata["transcoded_seconds"] != float64(1320) {
+		t.Fatalf("expected an indeterminate update, got %+v", second)
+	}
+}
+
+func TestWorkerDownloadCompletionIncludesTotalSize(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Album", Size: 3000, Downloaded: 3000, Status: domain.TaskStatusCompleted}
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "a.flac", FilePath: "Album/a.flac", FileSize: 1000, IsSelected: true},
+		{FileName: "b.flac", FilePath: "Album/b.flac", FileSize: 2000, IsSelected: true},
+		{FileName: "skipped.txt", FilePath: "Album/skipped.txt", FileSize: 10, IsSelected: false},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleDownloadStatusChange(task)
+
+	if len(gw.statuses) == 0 || gw.statuses[0].status != domain.TaskStatusCompleted {
+		t.Fatalf("expected completed status notification, got %+v", gw.statuses)
+	}
+	payload := gw.statuses[0].metadata
+	if payload["total_bytes"] != int64(3000) || payload["expected_bytes"] != int64(3000) {
+		t.Fatalf("unexpected sizes in completion payload: %v", payload)
+	}
+	files, _ := payload["files"].([]map[string]interface{})
+	if len(files) != 2 || files[1]["file_size"] != int64(2000) {
+		t.Fatalf("expected the two selected files with final sizes, got %v", payload["files"])
+	}
+}
+
+func TestWorkerAppliesTranscodeOptionsFromSubmit(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = "/downloads"
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{}}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{repo: repo},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleTaskSubmit(map[string]interface{}{
+		"magnet_url":        "magnet",
+		"burn_subtitles":    true,
+		"subtitle_language": " chi ",
+		"hls_quality":       "multi",
+		"interactive":       true,
+		"sequential":        false,
+	})
+	stored := repo.store["task-1"]
+	if stored == nil {
+		t.Fatalf("expected the task to be created")
+	}
+	if stored.Sequential(true) {
+		t.Fatal("expected sequential=false to be kept and override streaming_mode")
+	}
+	files := []models.TorrentFileInfo{{FileName: "movie.mkv", FilePath: "movie.mkv", IsSelected: true}}
+	stored.SetTorrentFiles(files)
+
+	// 下载协程持有的任务对象不含提交选项，转码仍按数据库中的选项进行
+	stale := &models.Task{TaskID: "task-1", Status: domain.TaskStatusCompleted}
+	stale.SetTorrentFiles(files)
+	worker.handleDownloadStatusChange(stale)
+
+	options := tr.waitStarts(t, 1)[0]
+	if !options.BurnSubtitles || options.SubtitleLanguage != "chi" || options.HLSQuality != transcoder.HLSQualityMulti || !options.Interactive {
+		t.Fatalf("expected the submitted transcode options, got %+v", options)
+	}
+}
+
+func TestWorkerTranscodesAudioOnlyTasks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = "/downloads"
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Album", Status: domain.TaskStatusCompleted}
+	task.SetMetadata(map[string]interface{}{"burn_subtitles": true, "hls_quality": "multi"})
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "02 - Second.flac", FilePath: "Album/02 - Second.flac", IsSelected: true},
+		{FileName: "cover.jpg", FilePath: "Album/cover.jpg", IsSelected: true},
+		{FileName: "01 - First.mp3", FilePath: "Album/01 - First.mp3", IsSelected: true},
+		{FileName: "bonus.flac", FilePath: "Album/Bonus/bonus.flac", IsSelected: false},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	dl := &fakeDownloader{tasks: []*models.Task{task}}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleDownloadStatusChange(task)
+
+	// 没有视频时按路径顺序切片选中的音频文件，不烧录字幕、不输出多码率
+	options := tr.waitStarts(t, 1)[0]
+	want := []string{"/downloads/Album/01 - First.mp3", "/downloads/Album/02 - Second.flac"}
+	if strings.Join(options.AudioTracks, "|") != strings.Join(want, "|") || tr.startCalls[0] != want[0] {
+		t.Fatalf("expected the two selected tracks in order, got %v (input %s)", options.AudioTracks, tr.startCalls[0])
+	}
+	if options.BurnSubtitles || options.HLSQuality != "" {
+		t.Fatalf("expected subtitle and bitrate options to be dropped for audio, got %+v", options)
+	}
+
+	worker.handleGetTasks(map[string]interface{}{})
+	tasks, _ := gw.payloads[len(gw.payloads)-1]["tasks"].([]map[string]interface{})
+	if len(tasks) != 1 || tasks[0]["media_type"] != transcoder.MediaTypeAudio {
+		t.Fatalf("expected media_type audio in the task list, got %v", tasks)
+	}
+}
+
+func TestWorkerTranscodesEveryVideoFile(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = "/downloads"
+	outputRoot := t.TempDir()
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Show S01", Status: domain.TaskStatusCompleted}
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "E02.mkv", FilePath: "Show S01/E02.mkv", IsSelected: true},
+		{FileName: "E01.mkv", FilePath: "Show S01/E01.mkv", IsSelected: true},
+		{FileName: "E03.mkv", FilePath: "Show S01/E03.mkv", IsSelected: false},
+		{FileName: "E01.srt", FilePath: "Show S01/E01.srt", IsSelected: true},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+	files := videoFiles(task)
+	if strings.Join(files, "|") != "Show S01/E01.mkv|Show S01/E02.mkv" {
+		t.Fatalf("expected the selected videos in path order, got %v", files)
+	}
+
+	// 转码器按完成顺序回报：第二集先完成
+	playlists := make([]string, len(files))
+	for i := range files {
+		dir := filepath.Join(outputRoot, "task-1", videoDir(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		playlists[i] = filepath.Join(dir, "index.m3u8")
+		if err := os.WriteFile(playlists[i], []byte("#EXTM3U\n#EXTINF:10.0,\nindex0.ts\n#EXTINF:10.0,\nindex1.ts\n#EXT-X-ENDLIST\n"), 0644); err != nil {
+			t.Fatalf("write playlist: %v", err)
+		}
+	}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask, 8)}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusProcessing, Progress: 50, ProcessedSeconds: 600}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-2", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusCompleted, M3U8Path: playlists[1], OutputPath: filepath.Dir(playlists[1])}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusProcessing, Progress: 80, ProcessedSeconds: 960}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusCompleted, M3U8Path: playlists[0], OutputPath: filepath.Dir(playlists[0])}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{tasks: []*models.Task{task}},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+	worker.startVideoTranscodes(task, files)
+
+	options := tr.waitStarts(t, 2)
+	if tr.startCalls[0] != "/downloads/Show S01/E01.mkv" || tr.startCalls[1] != "/downloads/Show S01/E02.mkv" {
+		t.Fatalf("expected one transcode per episode in order, got %v", tr.startCalls)
+	}
+	if options[0].OutputName != "task-1" || options[0].OutputSubdir != "video01" || options[1].OutputSubdir != "video02" {
+		t.Fatalf("expected each episode in its own subdirectory of the task, got %+v", options)
+	}
+
+	// 进度按两个文件合计：第一集50%时25%，第二集完成后第一集80%时90%
+	var progress []int
+	for _, status := range gw.statuses {
+		if status.status == domain.TaskStatusTranscoding {
+			progress = append(progress, status.progress)
+		}
+	}
+	if fmt.Sprint(progress) != "[25 90]" {
+		t.Fatalf("expected combined progress [25 90], got %v", progress)
+	}
+
+	stored := repo.store["task-1"]
+	outputs, _ := stored.GetM3U8Outputs()
+	if stored.Status != domain.TaskStatusReady || outputs["Show S01/E01.mkv"] != playlists[0] || outputs["Show S01/E02.mkv"] != playlists[1] {
+		t.Fatalf("expected a ready task with both outputs, got %s %v", stored.Status, outputs)
+	}
+	if segments, _ := stored.GetSegments(); len(segments) != 4 || stored.M3U8FilePath != playlists[0] {
+		t.Fatalf("expected the first episode as m3u8_path and all four segments, got %s %v", stored.M3U8FilePath, segments)
+	}
+
+	worker.handleGetTasks(map[string]interface{}{})
+	tasks, _ := gw.payloads[len(gw.payloads)-1]["tasks"].([]map[string]interface{})
+	listed, _ := tasks[0]["outputs"].([]domain.VideoOutput)
+	if len(listed) != 2 || listed[0].Name != "E01" || listed[1].Playlist != "/video/task-1/video02/index.m3u8" {
+		t.Fatalf("expected both episodes in the task list, got %v", tasks[0]["outputs"])
+	}
+
+	var sidecar domain.MediaInfoSidecar
+	data, err := os.ReadFile(filepath.Join(outputRoot, "task-1", mediaInfoFileName))
+	if err != nil || json.Unmarshal(data, &sidecar) != nil {
+		t.Fatalf("read %s: %v", mediaInfoFileName, err)
+	}
+	if sidecar.Playlist != "/video/task-1/video01/index.m3u8" || len(sidecar.Outputs) != 2 {
+		t.Fatalf("expected the sidecar to play the first episode and list both, got %+v", sidecar)
+	}
+}
+
+func TestWorkerTranscodesWhileDownloadingOnlyInStreamingMode(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = t.TempDir()
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Movie", Status: domain.TaskStatusDownloading}
+	// 回退转码要转码流式转码过的文件，而不是种子中的第一个视频
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "sample.mp4", FilePath: "Movie/sample.mp4", FileSize: 10},
+		{FileName: "movie.mp4", FilePath: "Movie/movie.mp4", FileSize: 1000, IsSelected: true},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	gw := &fakeGateway{}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 未开启流式模式时不对部分下载的文件转码
+	worker.handleStreamReady(task, "Movie/movie.mp4")
+	if len(worker.streamed) != 0 {
+		t.Fatal("expected no streaming transcode without streaming_mode")
+	}
+
+	// 提交时的sequential=false覆盖节点开启的streaming_mode
+	cfg.Transcode.StreamingMode = true
+	if err := task.SetMetadata(map[string]interface{}{"sequential": false}); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+	worker.handleStreamReady(task, "Movie/movie.mp4")
+	if len(worker.streamed) != 0 {
+		t.Fatal("expected no streaming transcode for a task submitted with sequential=false")
+	}
+
+	// sequential=true在未开启streaming_mode的节点上也边下载边转码
+	cfg.Transcode.StreamingMode = false
+	if err := task.SetMetadata(map[string]interface{}{"sequential": true}); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+	worker.handleStreamReady(task, "Movie/movie.mp4")
+	if options := tr.waitStarts(t, 1); options[0].OpenInput == nil {
+		t.Fatal("expected the streaming transcode to read through the downloader")
+	}
+
+	// 下载完成时流式转码仍在进行，不再重复转码
+	completed := *task
+	completed.Status = domain.TaskStatusCompleted
+	worker.handleDownloadStatusChange(&completed)
+	if len(gw.statuses) == 0 || gw.statuses[len(gw.statuses)-1].status != domain.TaskStatusCompleted {
+		t.Fatalf("expected completed status notification, got %+v", gw.statuses)
+	}
+	if stream := worker.streamed["task-1"]; stream == nil || !stream.downloaded {
+		t.Fatal("expected the completed download to be recorded against the streaming transcode")
+	}
+
+	// 流式转码失败后按完整文件重新转码
+	if !worker.streamedTranscodeFailed("task-1") {
+		t.Fatal("expected the streaming failure to be handled")
+	}
+	options := tr.waitStarts(t, 2)
+	if options[1].OpenInput != nil {
+		t.Fatal("expected the fallback transcode to read the downloaded file")
+	}
+	tr.mu.Lock()
+	input := tr.startCalls[1]
+	tr.mu.Unlock()
+	if want := filepath.Join(cfg.Storage.DownloadPath, "Movie/movie.mp4"); input != want {
+		t.Fatalf("expected fallback transcode of %s, got %s", want, input)
+	}
+}
+
+func TestWorkerWaitsForDownloadToTranscodeMultiVideoTasks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Transcode.StreamingMode = true
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Show", Status: domain.TaskStatusDownloading}
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "E01.mkv", FilePath: "Show/E01.mkv", IsSelected: true},
+		{FileName: "E02.mkv", FilePath: "Show/E02.mkv", IsSelected: true},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    &fakeGateway{},
+		Downloader: &fakeDownloader{},
+		Transcoder: tr,
+		WebRTC:     &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository {
+			return &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+		},
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 流式转码只处理一个文件，多视频任务等下载完成后转码全部视频
+	worker.handleStreamReady(task, "Show/E01.mkv")
+	if len(worker.streamed) != 0 || len(tr.startCalls) != 0 {
+		t.Fatalf("expected no streaming transcode for a multi-video task, got %v", tr.startCalls)
+	}
+}
+
+func TestTranscodeStatusReachesEveryWatchingTask(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask, 4)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{store: map[string]*models.Task{}} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 两个任务同时转码，各自只收到自己的状态，谁也不会取走对方的完成状态
+	first := worker.watchTranscodes("task-1")
+	second := worker.watchTranscodes("task-2")
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-2", Options: transcoder.Options{TaskID: "task-2"}, Status: domain.TranscodeStatusCompleted}
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusCompleted}
+
+	for _, watch := range []struct {
+		watch *transcodeWatch
+		want  string
+	}{{first, "transcode-1"}, {second, "transcode-2"}} {
+		select {
+		case update := <-watch.watch.updates:
+			if update.ID != watch.want {
+				t.Fatalf("expected %s, got %s", watch.want, update.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s to be delivered", watch.want)
+		}
+	}
+
+	// 取消订阅后不再阻塞分发
+	worker.stopWatch(first)
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusError}
+	close(tr.statusCh)
+	if _, ok := <-second.updates; ok {
+		t.Fatal("expected the watch to be closed with the transcoder")
+	}
+}
+
+func TestWorkerSweepsFailedTasksAfterRetention(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := base.Add(6 * 24 * time.Hour)
+	now := base
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"failed":    {TaskID: "failed", Status: domain.TaskStatusError, FailedAt: &base},
+		"cancelled": {TaskID: "cancelled", Status: domain.TaskStatusCancelled, FailedAt: &base},
+		"pinned":    {TaskID: "pinned", Status: domain.TaskStatusError, FailedAt: &base, Pinned: true},
+		// 失败后又保存过元数据，updated_at较新不影响清理
+		"resaved": {TaskID: "resaved", Status: domain.TaskStatusError, FailedAt: &base, UpdatedAt: recent},
+		"recent":  {TaskID: "recent", Status: domain.TaskStatusError, FailedAt: &recent},
+		"unknown": {TaskID: "unknown", Status: domain.TaskStatusError},
+		"ready":   {TaskID: "ready", Status: domain.TaskStatusReady, UpdatedAt: base},
+	}}
+	dl := &fakeDownloader{}
+	gw := &fakeGateway{}
+
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+		Clock:           func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	retention := 7 * 24 * time.Hour
+	now = base.Add(24 * time.Hour)
+	if removed := worker.sweepFailedTasks(retention); len(removed) != 0 {
+		t.Fatalf("expected nothing removed inside retention window, got %v", removed)
+	}
+
+	now = base.Add(retention + time.Hour)
+	removed := worker.sweepFailedTasks(retention)
+	sort.Strings(removed)
+	if len(removed) != 3 || removed[0] != "cancelled" || removed[1] != "failed" || removed[2] != "resaved" {
+		t.Fatalf("expected failed and cancelled tasks removed, got %v", removed)
+	}
+	if len(dl.removed) != 3 {
+		t.Fatalf("expected downloader to remove three tasks, got %v", dl.removed)
+	}
+	for _, msgType := range gw.messages {
+		if msgType != domain.MessageTypeTaskRemoved {
+			t.Fatalf("unexpected message %s", msgType)
+		}
+	}
+	if len(gw.messages) != 3 {
+		t.Fatalf("expected gateway to be told about every removal, got %v", gw.messages)
+	}
+}
+
+func TestWorkerSetRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Network.MaxBandwidth = 4000
+
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: dl,
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     &fakeWebRTC{},
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleGatewayMessage(domain.MessageTypeSetRateLimit, map[string]interface{}{"request_id": "req-1", "down_kbps": float64(800)})
+	if dl.rateLimit != [2]int{800, 4000} {
+		t.Fatalf("expected 800 kbps down and the configured 4000 kbps up, got %v", dl.rateLimit)
+	}
+	last := len(gw.messages) - 1
+	if gw.messages[last] != domain.MessageTypeSetRateLimitResponse || gw.payloads[last]["request_id"] != "req-1" ||
+		gw.payloads[last]["success"] != true || gw.payloads[last]["down_kbps"] != 800 {
+		t.Fatalf("unexpected set_rate_limit response %s %v", gw.messages[last], gw.payloads[last])
+	}
+
+	worker.handleSetRateLimit(map[string]interface{}{"down_kbps": float64(-1), "up_kbps": float64(0)})
+	last = len(gw.messages) - 1
+	if gw.payloads[last]["success"] != false || dl.rateLimit != [2]int{800, 4000} {
+		t.Fatalf("expected a negative limit to be rejected, got %v with limits %v", gw.payloads[last], dl.rateLimit)
+	}
+
+	worker.handleSetRateLimit(map[string]interface{}{"down_kbps": float64(0), "up_kbps": float64(0)})
+	if dl.rateLimit != [2]int{0, 0} {
+		t.Fatalf("expected both directions unlimited, got %v", dl.rateLimit)
+	}
+}
+
+func TestWorkerAnswersTaskAccess(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{lookup: map[string]*models.Task{
+		"task-played": {TaskID: "task-played"},
+		"task-idle":   {TaskID: "task-idle"},
+	}}
+	rtc := &fakeWebRTC{access: map[string]webrtc.SegmentAccess{
+		"task-played": {TaskID: "task-played", Sessions: 2, Segments: 5, Bytes: 5000},
+	}}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: dl,
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     rtc,
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	for _, tc := range []struct {
+		taskID   string
+		found    bool
+		sessions int
+	}{
+		{"task-played", true, 2},
+		// 还没有被播放过的任务返回零值
+		{"task-idle", true, 0},
+		{"task-missing", false, 0},
+	} {
+		worker.handleGatewayMessage(domain.MessageTypeGetTaskAccess, map[string]interface{}{"request_id": "req-" + tc.taskID, "task_id": tc.taskID})
+		last := len(gw.messages) - 1
+		payload := gw.payloads[last]
+		if gw.messages[last] != domain.MessageTypeTaskAccessResponse || payload["request_id"] != "req-"+tc.taskID || payload["found"] != tc.found {
+			t.Fatalf("%s: unexpected task_access response %s %v", tc.taskID, gw.messages[last], payload)
+		}
+		if !tc.found {
+			continue
+		}
+		if access, _ := payload["access"].(webrtc.SegmentAccess); access.TaskID != tc.taskID || access.Sessions != tc.sessions {
+			t.Fatalf("%s: unexpected access %v", tc.taskID, payload["access"])
+		}
+	}
+}
+
+func TestWorkerQuietHoursPauseDownloadsAndTranscodes(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.QuietHours.Windows = []string{"23:00-07:00"}
+	cfg.QuietHours.SuspendTranscodes = true
+
+	now := time.Date(2024, 1, 1, 22, 30, 0, 0, time.Local)
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: dl,
+		Transcoder: tr,
+		WebRTC:     &fakeWebRTC{},
+		Clock:      func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	if worker.syncQuiet() || worker.heartbeatMetrics()["state"] != "active" {
+		t.Fatalf("expected node to be active before the quiet window")
+	}
+
+	// 跨午夜的时段
+	now = now.Add(2 * time.Hour)
+	if !worker.syncQuiet() || !dl.quiet || !tr.quiet || !tr.quietSuspend {
+		t.Fatalf("expected downloads and transcodes paused inside the quiet window")
+	}
+	if worker.heartbeatMetrics()["state"] != "quiet" {
+		t.Fatalf("expected heartbeat to report the quiet state")
+	}
+
+	// 时段内手动恢复，本次时段不再静默
+	worker.handleResumeAll(map[string]interface{}{"request_id": "req-1"})
+	if dl.quiet || tr.quiet {
+		t.Fatalf("expected resume_all to lift the scheduled quiet hours")
+	}
+	last := len(gw.messages) - 1
+	if gw.messages[last] != domain.MessageTypeResumeAllResponse || gw.payloads[last]["request_id"] != "req-1" || gw.payloads[last]["quiet"] != false {
+		t.Fatalf("unexpected resume_all response %s %v", gw.messages[last], gw.payloads[last])
+	}
+	if worker.syncQuiet() {
+		t.Fatalf("expected node to stay active for the rest of the resumed window")
+	}
+
+	// 时段结束后手动pause_all，直到resume_all
+	now = now.Add(7 * time.Hour)
+	worker.handlePauseAll(map[string]interface{}{"request_id": "req-2"})
+	last = len(gw.messages) - 1
+	if gw.messages[last] != domain.MessageTypePauseAllResponse || gw.payloads[last]["quiet"] != true {
+		t.Fatalf("unexpected pause_all response %s %v", gw.messages[last], gw.payloads[last])
+	}
+	if !worker.syncQuiet() || !dl.quiet {
+		t.Fatalf("expected pause_all to keep the node quiet outside the window")
+	}
+	worker.handleResumeAll(map[string]interface{}{})
+	if dl.quiet || tr.quiet {
+		t.Fatalf("expected resume_all to end manual quiet mode")
+	}
+
+	// 下一个时段重新生效
+	now = now.Add(16 * time.Hour)
+	if !worker.syncQuiet() {
+		t.Fatalf("expected the next quiet window to apply again")
+	}
+}
+
+func TestWorkerRestoresManualQuietAfterRestart(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.QuietHours.Windows = []string{"23:00-07:00"}
+
+	statePath := filepath.Join(t.TempDir(), "quiet.json")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	start := func() (*Worker, *fakeDownloader) {
+		dl := &fakeDownloader{}
+		worker, err := New(cfg, Dependencies{
+			Gateway:        &fakeGateway{},
+			Downloader:     dl,
+			Transcoder:     &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+			WebRTC:         &fakeWebRTC{},
+			Clock:          func() time.Time { return now },
+			QuietStatePath: statePath,
+		})
+		if err != nil {
+			t.Fatalf("create worker: %v", err)
+		}
+		worker.restoreQuietState()
+		return worker, dl
+	}
+
+	// pause_all之后重启仍然静默
+	worker, _ := start()
+	worker.handlePauseAll(map[string]interface{}{})
+	worker, dl := start()
+	if !dl.quiet || !worker.isQuiet() {
+		t.Fatalf("expected pause_all to survive a restart")
+	}
+
+	// 时段内resume_all之后重启，本次时段仍不静默
+	now = time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local)
+	worker.handleResumeAll(map[string]interface{}{})
+	now = now.Add(2 * time.Hour)
+	worker, dl = start()
+	if dl.quiet || worker.syncQuiet() {
+		t.Fatalf("expected resume_all inside the window to survive a restart")
+	}
+
+	// 下一个时段重启时重新静默
+	now = now.Add(22 * time.Hour)
+	worker, dl = start()
+	if !dl.quiet || !worker.isQuiet() {
+		t.Fatalf("expected the next quiet window to apply after a restart")
+	}
+}
+
+func TestWorkerGatesMessagesOnNegotiatedProtocol(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: dl,
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     &fakeWebRTC{},
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 旧版网关的注册确认不带协议版本
+	gw.messageHandler(domain.MessageTypeRegistrationConfirmed, map[string]interface{}{"node_id": "worker-1"})
+	dl.metadataHandler(&models.Task{TaskID: "task-1", InfoHash: "abc", TorrentName: "name"})
+	if len(gw.messages) != 0 {
+		t.Fatalf("expected no policy check for a legacy gateway, got %v", gw.messages)
+	}
+	if got := worker.heartbeatMetrics()["protocol_version"]; got != domain.LegacyProtocolVersion {
+		t.Fatalf("expected legacy protocol in metrics, got %v", got)
+	}
+
+	gw.messageHandler(domain.MessageTypeRegistrationConfirmed, map[string]interface{}{
+		"node_id":          "worker-1",
+		"protocol_version": float64(domain.ProtocolVersion),
+	})
+	dl.metadataHandler(&models.Task{TaskID: "task-1", InfoHash: "abc", TorrentName: "name"})
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTaskPolicyCheck {
+		t.Fatalf("expected policy check after negotiating v%d, got %v", domain.ProtocolVersion, gw.messages)
+	}
+}
+
+func TestWorkerAnswersGatewayClockWithClockSync(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	gw := &fakeGateway{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    gw,
+		Downloader: &fakeDownloader{},
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     &fakeWebRTC{},
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 45, 0, time.UTC)
+	worker.now = func() time.Time { return now }
+
+	// 版本16的网关不认识clock_sync
+	gw.messageHandler(domain.MessageTypeRegistrationConfirmed, map[string]interface{}{
+		"protocol_version": float64(16),
+		"gateway_clock_ms": float64(now.Add(-45 * time.Second).UnixMilli()),
+	})
+	if len(gw.messages) != 0 {
+		t.Fatalf("expected no clock_sync for protocol 16, got %v", gw.messages)
+	}
+
+	gw.messageHandler(domain.MessageTypeRegistrationConfirmed, map[string]interface{}{
+		"protocol_version": float64(domain.ProtocolVersion),
+		"gateway_clock_ms": float64(now.Add(-45 * time.Second).UnixMilli()),
+	})
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeClockSync {
+		t.Fatalf("expected clock_sync, got %v", gw.messages)
+	}
+	payload := gw.payloads[0]
+	if payload["gateway_clock_ms"] != now.Add(-45*time.Second).UnixMilli() || payload["clock_ms"] != now.UnixMilli() {
+		t.Fatalf("expected both clocks echoed, got %v", payload)
+	}
+}
+
+func TestWorkerReadinessReflectsListenPort(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:    &fakeGateway{},
+		Downloader: dl,
+		Transcoder: &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:     &fakeWebRTC{},
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	if metrics := worker.heartbeatMetrics(); metrics["ready"] != true {
+		t.Fatalf("expected worker to be ready, got %v", metrics)
+	}
+
+	dl.listen = &downloader.ListenStatus{RequestedPort: 6881, Port: 40000, Warning: "listen port 6881 unavailable"}
+	metrics := worker.heartbeatMetrics()
+	issues, _ := metrics["readiness_issues"].([]string)
+	if metrics["ready"] != false || metrics["torrent_listen_ok"] != false || len(issues) != 1 {
+		t.Fatalf("expected listen failure in readiness, got %v", metrics)
+	}
+}
+
+func TestWorkerIgnoresResubmissionAfterRestart(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	magnet := "magnet:?xt=urn:btih:" + hash + "&dn=movie"
+
+	// 重启前正在下载的任务，尚未获取元数据，由restoreActiveTasks恢复
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"restored": {TaskID: "restored", MagnetURL: magnet, Status: domain.TaskStatusDownloading},
+	}}
+	dl := &fakeDownloader{}
+	gw := &fakeGateway{}
+	_, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+		Clock:           func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 网关在节点重连后重新提交同一磁力链接，以及带不同tracker的同一info hash
+	gw.messageHandler(domain.MessageTypeTaskSubmit, map[string]interface{}{"magnet_url": magnet, "request_id": "req-1"})
+	gw.messageHandler(domain.MessageTypeTaskSubmit, map[string]interface{}{
+		"magnet_url": "magnet:?xt=urn:btih:" + strings.ToUpper(hash) + "&tr=udp://tracker.example:80",
+		"request_id": "req-2",
+	})
+
+	if len(dl.startCalledWith) != 0 {
+		t.Fatalf("expected resubmissions not to start downloads, got %v", dl.startCalledWith)
+	}
+	if len(gw.payloads) != 2 {
+		t.Fatalf("expected two submit acknowledgements, got %v", gw.messages)
+	}
+	for i, payload := range gw.payloads {
+		if gw.messages[i] != domain.MessageTypeTaskSubmitResponse || payload["duplicate"] != true ||
+			payload["success"] != true || payload["task_id"] != "restored" {
+			t.Fatalf("unexpected acknowledgement %d: %s %v", i, gw.messages[i], payload)
+		}
+	}
+
+	// 宽限期过后不再按磁力链接去重
+	now = base.Add(resubmitGraceWindow + time.Minute)
+	gw.messageHandler(domain.MessageTypeTaskSubmit, map[string]interface{}{"magnet_url": magnet, "request_id": "req-3"})
+	if len(dl.startCalledWith) != 1 {
+		t.Fatalf("expected submission after grace window to start a download, got %v", dl.startCalledWith)
+	}
+	last := gw.payloads[len(gw.payloads)-1]
+	if last["duplicate"] != false || last["task_id"] != "task-1" {
+		t.Fatalf("unexpected acknowledgement after grace window: %v", last)
+	}
+}
+
+func TestWorkerTreatsHybridHashesAsSameTask(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	const (
+		v1Hash = "0123456789abcdef0123456789abcdef01234567"
+		v2Hash = "89abcdef0123456789abcdef0123456789abcdef0123456789abcdef01234567"
+	)
+	hybrid := "magnet:?xt=urn:btih:" + v1Hash + "&xt=urn:btmh:1220" + v2Hash
+
+	// 重启前由混合种子磁力链接提交的任务
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"restored": {TaskID: "restored", MagnetURL: hybrid, Status: domain.TaskStatusDownloading},
+	}}
+	dl := &fakeDownloader{}
+	gw := &fakeGateway{}
+	_, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 只带v1 hash和只带v2 hash的磁力链接都指向同一任务
+	for _, magnet := range []string{
+		"magnet:?xt=urn:btih:" + v1Hash,
+		"magnet:?xt=urn:btmh:1220" + strings.ToUpper(v2Hash) + "&dn=movie",
+	} {
+		gw.messageHandler(domain.MessageTypeTaskSubmit, map[string]interface{}{"magnet_url": magnet, "request_id": "req"})
+	}
+	if len(dl.startCalledWith) != 0 {
+		t.Fatalf("expected v1 and v2 forms of the hybrid not to start downloads, got %v", dl.startCalledWith)
+	}
+	for i, payload := range gw.payloads {
+		if payload["duplicate"] != true || payload["task_id"] != "restored" {
+			t.Fatalf("unexpected acknowledgement %d: %v", i, payload)
+		}
+	}
+}
+
+func TestWorkerPermanentlyFailsTaskAfterMaxRetries(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Limits.MaxRetries = 2
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"task-1": {TaskID: "task-1", Status: domain.TaskStatusDownloading},
+		"task-2": {TaskID: "task-2", Status: domain.TaskStatusDownloading},
+	}}
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+	// 只验证重试决策，不等待定时器触发
+	worker.retryBackoff = time.Hour
+
+	fail := func(taskID string) *models.Task {
+		task := repo.store[taskID]
+		task.Status = domain.TaskStatusError
+		worker.handleDownloadStatusChange(task)
+		return repo.store[taskID]
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		task := fail("task-1")
+		if task.Status != domain.TaskStatusError || task.RetryCount != attempt {
+			t.Fatalf("expected retry %d to be scheduled, got %s with retry_count %d", attempt, task.Status, task.RetryCount)
+		}
+	}
+
+	task := fail("task-1")
+	if task.Status != domain.TaskStatusPermanentlyFailed || task.RetryCount != 2 {
+		t.Fatalf("expected permanent failure after max retries, got %s with retry_count %d", task.Status, task.RetryCount)
+	}
+	last := gw.statuses[len(gw.statuses)-1]
+	if last.taskID != "task-1" || last.status != domain.TaskStatusPermanentlyFailed || last.metadata["retry_count"] != 2 {
+		t.Fatalf("expected gateway to be told about the permanent failure, got %+v", last)
+	}
+
+	// 永久失败后不再自动重试
+	if task := fail("task-1"); task.Status != domain.TaskStatusPermanentlyFailed {
+		t.Fatalf("expected permanently failed task to stay terminal, got %s", task.Status)
+	}
+
+	// 不可重试的失败（如被策略拦截）不计入重试次数
+	repo.store["task-2"].SetMetadata(map[string]interface{}{"retryable": false})
+	if task := fail("task-2"); task.Status != domain.TaskStatusError || task.RetryCount != 0 {
+		t.Fatalf("expected non-retryable failure to stay in error, got %s with retry_count %d", task.Status, task.RetryCount)
+	}
+
+	// 错误码决定是否自动重试：等待元数据超时会重试，无效的磁力链接不会；错误码随状态通知网关
+	repo.store["task-3"] = &models.Task{TaskID: "task-3", ErrorCode: domain.ErrorCodeMetadataTimeout}
+	if task := fail("task-3"); task.RetryCount != 1 {
+		t.Fatalf("expected a metadata timeout to be retried, got retry_count %d", task.RetryCount)
+	}
+	last = gw.statuses[len(gw.statuses)-1]
+	if last.status != domain.TaskStatusError || last.metadata["error_code"] != domain.ErrorCodeMetadataTimeout || last.metadata["retryable"] != true {
+		t.Fatalf("expected a retryable metadata_timeout status, got %+v", last)
+	}
+	repo.store["task-4"] = &models.Task{TaskID: "task-4", ErrorCode: domain.ErrorCodeMagnetInvalid}
+	if task := fail("task-4"); task.Status != domain.TaskStatusError || task.RetryCount != 0 {
+		t.Fatalf("expected an invalid magnet not to be retried, got %s with retry_count %d", task.Status, task.RetryCount)
+	}
+	last = gw.statuses[len(gw.statuses)-1]
+	if last.metadata["error_code"] != domain.ErrorCodeMagnetInvalid || last.metadata["retryable"] != false {
+		t.Fatalf("expected a non-retryable magnet_invalid status, got %+v", last)
+	}
+
+	// 手动重试清零计数并重新下载
+	worker.handleGatewayMessage(domain.MessageTypeTaskRetry, map[string]interface{}{"task_id": "task-1", "request_id": "req-1"})
+	if repo.store["task-1"].RetryCount != 0 {
+		t.Fatalf("expected manual retry to reset retry_count, got %d", repo.store["task-1"].RetryCount)
+	}
+	if len(dl.retried) != 1 || dl.retried[0] != "task-1" {
+		t.Fatalf("expected download to be retried, got %v", dl.retried)
+	}
+	response := gw.payloads[len(gw.payloads)-1]
+	if gw.messages[len(gw.messages)-1] != domain.MessageTypeTaskRetryResponse || response["success"] != true || response["request_id"] != "req-1" {
+		t.Fatalf("unexpected retry response: %v", response)
+	}
+}
+
+func TestWorkerFileFetchReturnsRequestedRange(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.M3U8Path = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cfg.Storage.M3U8Path, "task-1"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	content := []byte("0123456789abcdef")
+	if err := os.WriteFile(filepath.Join(cfg.Storage.M3U8Path, "task-1", "index0.ts"), content, 0644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	task := &models.Task{TaskID: "task-1", Status: domain.TaskStatusReady}
+	task.SetMetadata(map[string]interface{}{"stream_token": "token-1"})
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	gw := &fakeGateway{}
+	if _, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	}); err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+	fetch := func(name string, offset, length float64) map[string]interface{} {
+		t.Helper()
+		gw.messageHandler(domain.MessageTypeFileFetch, map[string]interface{}{
+			"request_id":   "req-1",
+			"task_id":      "task-1",
+			"name":         name,
+			"offset":       offset,
+			"length":       length,
+			"stream_token": "token-1",
+		})
+		last := len(gw.messages) - 1
+		if last < 0 || gw.messages[last] != domain.MessageTypeFileFetchResponse {
+			t.Fatalf("expected file_fetch_response, got %v", gw.messages)
+		}
+		return gw.payloads[last]
+	}
+
+	response := fetch("index0.ts", 10, 100)
+	if response["success"] != true || response["size"] != int64(len(content)) || response["request_id"] != "req-1" {
+		t.Fatalf("unexpected response %v", response)
+	}
+	if data, _ := response["data"].([]byte); string(data) != "abcdef" {
+		t.Fatalf("expected the tail of the file from offset 10, got %q", data)
+	}
+
+	// length为0时只返回文件信息
+	if response := fetch("index0.ts", 0, 0); response["success"] != true || len(response["data"].([]byte)) != 0 || response["mod_time"] == "" {
+		t.Fatalf("expected a stat-only response, got %v", response)
+	}
+	if response := fetch("index0.ts", 17, 1); response["success"] != false {
+		t.Fatalf("expected an offset past the end to fail, got %v", response)
+	}
+	if response := fetch("missing.ts", 0, 1); response["not_found"] != true {
+		t.Fatalf("expected a missing file to be reported, got %v", response)
+	}
+	if response := fetch("../task-1/index0.ts", 0, 1); response["success"] != false || response["not_found"] == true {
+		t.Fatalf("expected a path outside the task directory to be rejected, got %v", response)
+	}
+}
+
+func TestWorkerFileFetchChecksStreamToken(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.M3U8Path = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cfg.Storage.M3U8Path, "task-1", "720p"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.M3U8Path, "task-1", "720p", "index0.ts"), []byte("segment"), 0644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": {TaskID: "task-1", Status: domain.TaskStatusReady}}}
+	gw := &fakeGateway{}
+	if _, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      &fakeDownloader{},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	}); err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+	request := func(msgType domain.MessageType, payload map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		gw.messageHandler(msgType, payload)
+		return gw.payloads[len(gw.payloads)-1]
+	}
+
+	// 旧版本创建的任务没有令牌，首次请求时生成
+	response := request(domain.MessageTypeGetStreamToken, map[string]interface{}{"task_id": "task-1"})
+	token, _ := response["token"].(string)
+	if response["success"] != true || len(token) != 64 {
+		t.Fatalf("expected a generated stream token, got %v", response)
+	}
+	if again := request(domain.MessageTypeGetStreamToken, map[string]interface{}{"task_id": "task-1"}); again["token"] != token {
+		t.Fatalf("expected the stored token to be reused, got %v", again)
+	}
+	if missing := request(domain.MessageTypeGetStreamToken, map[string]interface{}{"task_id": "task-2"}); missing["not_found"] != true {
+		t.Fatalf("expected an unknown task to be reported, got %v", missing)
+	}
+
+	fetch := func(token string) map[string]interface{} {
+		return request(domain.MessageTypeFileFetch, map[string]interface{}{
+			"task_id":      "task-1",
+			"name":         "720p/index0.ts",
+			"length":       float64(100),
+			"stream_token": token,
+		})
+	}
+	if response := fetch(token); response["success"] != true || string(response["data"].([]byte)) != "segment" {
+		t.Fatalf("expected the rendition segment to be served with the token, got %v", response)
+	}
+	if response := fetch("wrong"); response["forbidden"] != true || response["data"] != nil {
+		t.Fatalf("expected a wrong token to be refused, got %v", response)
+	}
+	// 支持令牌的网关总是带令牌，没有令牌的请求同样拒绝
+	response = request(domain.MessageTypeFileFetch, map[string]interface{}{
+		"task_id": "task-1",
+		"name":    "720p/index0.ts",
+		"length":  float64(100),
+	})
+	if response["forbidden"] != true || response["data"] != nil {
+		t.Fatalf("expected a request without a token to be refused, got %v", response)
+	}
+
+	// 任务自己的目录中没有的文件不能从其它任务的目录中读取
+	if err := os.MkdirAll(filepath.Join(cfg.Storage.M3U8Path, "task-2"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.M3U8Path, "task-2", "index.m3u8"), []byte("#EXTM3U"), 0644); err != nil {
+		t.Fatalf("write playlist: %v", err)
+	}
+	response = request(domain.MessageTypeFileFetch, map[string]interface{}{
+		"task_id":      "task-1",
+		"name":         "index.m3u8",
+		"length":       float64(100),
+		"stream_token": token,
+	})
+	if response["not_found"] != true || response["data"] != nil {
+		t.Fatalf("expected another task's playlist not to be served, got %v", response)
+	}
+}
+
+func TestWorkerStoresTranscodeOutputWhereItIsServed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg scripts require a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	ffprobe := "#!/bin/sh\necho h264\n"
+	ffmpeg := `#!/bin/sh
+for last; do :; done
+dir=$(dirname "$last")
+printf '#EXTM3U\n#EXTINF:10.0,\nindex0.ts\n#EXT-X-ENDLIST\n' > "$last"
+: > "$dir/index0.ts"
+`
+	if err := os.WriteFile(filepath.Join(binDir, "ffprobe"), []byte(ffprobe), 0755); err != nil {
+		t.Fatalf("write fake ffprobe: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "ffmpeg"), []byte(ffmpeg), 0755); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// 输出目录不再取自视频文件名
+	downloadDir := t.TempDir()
+	input := filepath.Join(downloadDir, "Some.Movie.2020.1080p.mkv")
+	if err := os.WriteFile(input, []byte("not really a video"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = downloadDir
+	cfg.Storage.M3U8Path = t.TempDir()
+
+	task := &models.Task{TaskID: "task-1", TorrentName: "Movie", Status: domain.TaskStatusCompleted}
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	tr := &probeNotifyingTranscoder{Manager: transcoder.New(downloadDir, cfg.Storage.M3U8Path), probed: make(chan struct{}, 1)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.startTranscodingForTask(task, input)
+	select {
+	case <-tr.probed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transcode did not complete")
+	}
+	if task.Status != domain.TaskStatusReady {
+		t.Fatalf("expected task to be ready, got %s", task.Status)
+	}
+
+	stored := filepath.Join(cfg.Storage.M3U8Path, "task-1", "index.m3u8")
+	if task.M3U8FilePath != stored {
+		t.Fatalf("expected playlist stored at %s, got %s", stored, task.M3U8FilePath)
+	}
+
+	server := webrtc.New()
+	server.SetMediaRoot(cfg.Storage.M3U8Path)
+	served, found := server.ResolveFile("task-1", "index.m3u8")
+	if !found || served != task.M3U8FilePath {
+		t.Fatalf("expected the file server to serve the stored playlist %s, got %q (found=%v)", task.M3U8FilePath, served, found)
+	}
+}
+
+// probeNotifyingTranscoder 在转码完成后的媒体探测时发出通知，此时转码结果已经保存
+type probeNotifyingTranscoder struct {
+	*transcoder.Manager
+	probed chan struct{}
+}
+
+func (p *probeNotifyingTranscoder) Probe(inputPath string) (*transcoder.MediaInfo, error) {
+	info, err := p.Manager.Probe(inputPath)
+	p.probed <- struct{}{}
+	return info, err
+}
+
+func TestWorkerPausesResumesAndRemovesTasks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.M3U8Path = t.TempDir()
+
+	outputDir := filepath.Join(cfg.Storage.M3U8Path, "task-2")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "index.m3u8"), []byte("#EXTM3U\n"), 0644); err != nil {
+		t.Fatalf("write playlist: %v", err)
+	}
+
+	ready := &models.Task{TaskID: "task-2", Status: domain.TaskStatusReady, M3U8FilePath: filepath.Join(outputDir, "index.m3u8")}
+	ready.SetMetadata(map[string]interface{}{"output_path": outputDir})
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"task-1": {TaskID: "task-1", Status: domain.TaskStatusDownloading},
+		"task-2": ready,
+		"task-3": {TaskID: "task-3", Status: domain.TaskStatusTranscoding},
+	}}
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	send := func(msgType domain.MessageType, taskID string) map[string]interface{} {
+		worker.handleGatewayMessage(msgType, map[string]interface{}{"task_id": taskID, "request_id": "req-" + taskID})
+		if response := gw.payloads[len(gw.payloads)-1]; response["request_id"] == "req-"+taskID {
+			return response
+		}
+		t.Fatalf("expected an acknowledgement for %s %s", msgType, taskID)
+		return nil
+	}
+
+	response := send(domain.MessageTypeTaskPause, "task-1")
+	if gw.messages[len(gw.messages)-1] != domain.MessageTypeTaskPauseResponse || response["success"] != true || response["status"] != domain.TaskStatusPaused {
+		t.Fatalf("unexpected pause response: %v", response)
+	}
+	if len(dl.paused) != 1 || gw.statuses[len(gw.statuses)-1].status != domain.TaskStatusPaused {
+		t.Fatalf("expected the download to be paused and reported, got %v", dl.paused)
+	}
+
+	// 只能恢复暂停的任务
+	if response := send(domain.MessageTypeTaskResume, "task-1"); response["success"] != false || response["status"] != domain.TaskStatusDownloading {
+		t.Fatalf("expected resuming a running task to fail, got %v", response)
+	}
+	repo.store["task-1"].Status = domain.TaskStatusPaused
+	if response := send(domain.MessageTypeTaskResume, "task-1"); response["success"] != true || len(dl.resumed) != 1 {
+		t.Fatalf("expected the paused task to resume, got %v", response)
+	}
+
+	// 转码中的任务不能删除
+	if response := send(domain.MessageTypeTaskRemove, "task-3"); response["success"] != false || len(dl.removed) != 0 {
+		t.Fatalf("expected removing a transcoding task to fail, got %v", response)
+	}
+
+	response = send(domain.MessageTypeTaskRemove, "task-2")
+	if gw.messages[len(gw.messages)-1] != domain.MessageTypeTaskRemoveResponse || response["success"] != true || response["status"] != domain.TaskStatus(taskStatusRemoved) {
+		t.Fatalf("unexpected remove response: %v", response)
+	}
+	if len(dl.removed) != 1 || dl.removed[0] != "task-2" {
+		t.Fatalf("expected the task to be removed from the downloader, got %v", dl.removed)
+	}
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the output directory to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(cfg.Storage.M3U8Path); err != nil {
+		t.Fatalf("the output root must be kept: %v", err)
+	}
+
+	// purge_files为false时只删除记录，保留下载的文件与转码输出
+	keptDir := filepath.Join(cfg.Storage.M3U8Path, "task-4")
+	if err := os.MkdirAll(keptDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	keep := &models.Task{TaskID: "task-4", Status: domain.TaskStatusReady, M3U8FilePath: filepath.Join(keptDir, "index.m3u8")}
+	keep.SetMetadata(map[string]interface{}{"output_path": keptDir})
+	repo.store["task-4"] = keep
+	worker.handleGatewayMessage(domain.MessageTypeTaskRemove, map[string]interface{}{"task_id": "task-4", "purge_files": false})
+	if response := gw.payloads[len(gw.payloads)-1]; response["success"] != true || len(dl.kept) != 1 || dl.kept[0] != "task-4" {
+		t.Fatalf("expected the task to be removed keeping its files, got %v (kept %v)", response, dl.kept)
+	}
+	if _, err := os.Stat(keptDir); err != nil {
+		t.Fatalf("expected the output directory to be kept: %v", err)
+	}
+
+	// 多视频任务在全部转码完成前没有记录输出路径，删除时同样清理<m3u8_path>/<任务ID>/
+	partialDir := filepath.Join(cfg.Storage.M3U8Path, "task-5", "video01")
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	repo.store["task-5"] = &models.Task{TaskID: "task-5", Status: domain.TaskStatusError}
+	if response := send(domain.MessageTypeTaskRemove, "task-5"); response["success"] != true {
+		t.Fatalf("unexpected remove response: %v", response)
+	}
+	if _, err := os.Stat(filepath.Dir(partialDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial output directory to be deleted, got %v", err)
+	}
+
+	if response := send(domain.MessageTypeTaskPause, "missing"); response["success"] != false || response["not_found"] != true {
+		t.Fatalf("expected unknown task to be reported as not found, got %v", response)
+	}
+}
+
+func TestWorkerReturnsTorrentInfoWithoutDownloading(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	gw := &fakeGateway{}
+	dl := &fakeDownloader{torrentInfo: &downloader.TorrentInfo{
+		InfoHash: strings.Repeat("a", 40),
+		Name:     "Movie",
+		Size:     300,
+		Files: []models.TorrentFileInfo{
+			{FileName: "Movie/movie.mkv", FilePath: "movie.mkv", FileSize: 200, IsSelected: true},
+			{FileName: "Movie/extras.mkv", FilePath: "extras.mkv", FileSize: 100, IsSelected: true},
+		},
+	}}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         gw,
+		Downloader:      dl,
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return &fakeTaskRepository{} },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleGatewayMessage(domain.MessageTypeGetTorrentInfo, map[string]interface{}{
+		"magnet_url": "magnet:?xt=urn:btih:" + strings.Repeat("a", 40),
+		"request_id": "req-1",
+	})
+	if len(gw.messages) != 1 || gw.messages[0] != domain.MessageTypeTorrentInfoResponse {
+		t.Fatalf("expected a torrent_info_response, got %v", gw.messages)
+	}
+	response := gw.payloads[0]
+	files, _ := response["files"].([]models.TorrentFileInfo)
+	if response["request_id"] != "req-1" || response["success"] != true || response["name"] != "Movie" || len(files) != 2 {
+		t.Fatalf("unexpected torrent info response: %v", response)
+	}
+	if len(dl.startCalledWith) != 0 {
+		t.Fatalf("expected no download to start, got %v", dl.startCalledWith)
+	}
+
+	// 失败时带错误码
+	dl.fetchErr = domain.ErrMetadataTimeout
+	worker.handleGatewayMessage(domain.MessageTypeGetTorrentInfo, map[string]interface{}{
+		"magnet_url": "magnet:?xt=urn:btih:" + strings.Repeat("b", 40),
+		"request_id": "req-2",
+	})
+	response = gw.payloads[1]
+	if response["success"] != false || response["error_code"] != domain.ErrorCodeMetadataTimeout || response["error"] == "" {
+		t.Fatalf("expected a metadata_timeout failure, got %v", response)
+	}
+}
+
+func TestWorkerHoldsReadyUntilOutputIsComplete(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = t.TempDir()
+	cfg.Transcode.StreamingMode = true
+
+	repo := &fakeTaskRepository{store: map[string]*models.Task{}}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{repo: repo},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	worker.handleTaskSubmit(map[string]interface{}{"magnet_url": "magnet", "require_complete": true})
+	task := repo.store["task-1"]
+	if task == nil {
+		t.Fatalf("expected the task to be created")
+	}
+	task.TorrentName = "Movie"
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "movie.mp4", FilePath: "Movie/movie.mp4", FileSize: 1000, IsSelected: true},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+
+	outputDir := t.TempDir()
+	playlist := filepath.Join(outputDir, "index.m3u8")
+	if err := os.WriteFile(filepath.Join(outputDir, "index0.ts"), []byte("segment"), 0o644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	if err := os.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:6.0,\nindex0.ts\n#EXT-X-ENDLIST\n"), 0o644); err != nil {
+		t.Fatalf("write playlist: %v", err)
+	}
+
+	worker.handleStreamReady(task, "Movie/movie.mp4")
+	tr.waitStarts(t, 1)
+
+	// 流式转码先于下载完成，要求完整输出的任务不标记ready
+	tr.statusCh <- &transcoder.TranscodeTask{ID: "transcode-1", Options: transcoder.Options{TaskID: "task-1"}, Status: domain.TranscodeStatusCompleted, M3U8Path: playlist}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		worker.streamMu.Lock()
+		held := worker.streamed["task-1"] != nil && worker.streamed["task-1"].held != nil
+		worker.streamMu.Unlock()
+		if held {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the streamed transcode to be held until the download completes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored, _ := repo.GetByTaskID("task-1"); stored.Status == domain.TaskStatusReady {
+		t.Fatal("expected the task not to be ready before the download completes")
+	}
+	if metadata, _ := repo.store["task-1"].GetMetadata(); metadata[readyHeldKey] == nil {
+		t.Fatalf("expected the held ready state to be stored, got %v", metadata)
+	}
+
+	completed := *repo.store["task-1"]
+	completed.Status = domain.TaskStatusCompleted
+	worker.handleDownloadStatusChange(&completed)
+	if stored, _ := repo.GetByTaskID("task-1"); stored.Status != domain.TaskStatusReady {
+		t.Fatalf("expected the task to be ready once downloaded, got %s", stored.Status)
+	}
+	if metadata, _ := repo.store["task-1"].GetMetadata(); metadata[readyHeldKey] != nil {
+		t.Fatalf("expected the held ready state to be cleared, got %v", metadata)
+	}
+}
+
+func TestWorkerRestoresHeldReadyAfterRestart(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+
+	held := func(taskID string, progress int) *models.Task {
+		task := &models.Task{TaskID: taskID, Status: domain.TaskStatusTranscoding, Progress: progress, M3U8FilePath: "/m3u8/" + taskID + "/index.m3u8"}
+		if err := task.SetMetadata(map[string]interface{}{
+			"require_complete": true,
+			readyHeldKey:       "/downloads/" + taskID + ".mp4",
+			"output_path":      "/m3u8/" + taskID,
+		}); err != nil {
+			t.Fatalf("set metadata: %v", err)
+		}
+		return task
+	}
+	repo := &fakeTaskRepository{store: map[string]*models.Task{
+		"partial":    held("partial", 40),
+		"downloaded": held("downloaded", 100),
+		"other":      {TaskID: "other", Status: domain.TaskStatusTranscoding},
+	}}
+	// 流式转码随进程中断的任务
+	for taskID, progress := range map[string]int{"streaming-partial": 40, "streaming-done": 100} {
+		task := &models.Task{TaskID: taskID, Status: domain.TaskStatusTranscoding, Progress: progress}
+		if err := task.SetMetadata(map[string]interface{}{streamInputKey: "Movie/movie.mp4"}); err != nil {
+			t.Fatalf("set metadata: %v", err)
+		}
+		repo.store[taskID] = task
+	}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)},
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	recovery := worker.restoreStreamedTranscodes()
+	ready := recovery.ready
+
+	// 下载未完成的任务回到下载中由下载器恢复，流式转码的结果仍等下载完成后标记ready
+	if status := repo.store["partial"].Status; status != domain.TaskStatusDownloading {
+		t.Fatalf("expected the unfinished download to be resumed, got %s", status)
+	}
+	if stream := worker.streamed["partial"]; stream == nil || stream.held == nil || stream.held.M3U8Path != "/m3u8/partial/index.m3u8" {
+		t.Fatalf("expected the held transcode to be restored, got %+v", stream)
+	}
+	if len(ready) != 1 || ready["downloaded"] == nil || ready["downloaded"].InputPath != "/downloads/downloaded.mp4" {
+		t.Fatalf("expected only the finished download to be marked ready, got %v", ready)
+	}
+	if metadata, _ := repo.store["downloaded"].GetMetadata(); metadata[readyHeldKey] != nil {
+		t.Fatalf("expected the held state of the finished download to be cleared, got %v", metadata)
+	}
+	if status := repo.store["other"].Status; status != domain.TaskStatusTranscoding {
+		t.Fatalf("expected transcodes that were not held to be left alone, got %s", status)
+	}
+
+	// 中断的流式转码：下载未完成的恢复下载，已完成的按完整文件重新转码
+	if status := repo.store["streaming-partial"].Status; status != domain.TaskStatusDownloading {
+		t.Fatalf("expected the interrupted streaming download to be resumed, got %s", status)
+	}
+	if len(recovery.transcode) != 1 || recovery.transcode[0].TaskID != "streaming-done" {
+		t.Fatalf("expected the finished download to be transcoded again, got %+v", recovery.transcode)
+	}
+	if input, err := worker.transcodeInput(recovery.transcode[0]); err != nil || input != filepath.Join(cfg.Storage.DownloadPath, "Movie/movie.mp4") {
+		t.Fatalf("expected the streamed input to be transcoded again, got %q (%v)", input, err)
+	}
+}
+
+func TestRetryAndRepairUseTheTracksOfAudioTasks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Node.ID = "worker-1"
+	cfg.Storage.DownloadPath = t.TempDir()
+	outputDir := filepath.Join(t.TempDir(), "task-1")
+	if err := os.MkdirAll(filepath.Join(outputDir, "track01"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "track01", "index.m3u8"), []byte("#EXTM3U\n#EXTINF:6.0,\nindex0.ts\n#EXT-X-ENDLIST\n"), 0o644); err != nil {
+		t.Fatalf("write playlist: %v", err)
+	}
+
+	task := &models.Task{TaskID: "task-1", Status: domain.TaskStatusError, M3U8FilePath: filepath.Join(outputDir, "index.m3u8")}
+	if err := task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FileName: "b.mp3", FilePath: "Album/b.mp3", FileSize: 10, IsSelected: true},
+		{FileName: "a.flac", FilePath: "Album/a.flac", FileSize: 10, IsSelected: true},
+	}); err != nil {
+		t.Fatalf("set files: %v", err)
+	}
+	if err := task.SetMetadata(map[string]interface{}{"media_type": transcoder.MediaTypeAudio}); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+	repo := &fakeTaskRepository{store: map[string]*models.Task{"task-1": task}}
+	tr := &fakeTranscoder{statusCh: make(chan *transcoder.TranscodeTask)}
+	worker, err := New(cfg, Dependencies{
+		Gateway:         &fakeGateway{},
+		Downloader:      &fakeDownloader{},
+		Transcoder:      tr,
+		WebRTC:          &fakeWebRTC{},
+		TaskRepoFactory: func() database.TaskRepository { return repo },
+	})
+	if err != nil {
+		t.Fatalf("create worker: %v", err)
+	}
+
+	// 重试转码与下载完成时一样转码全部曲目
+	if err := worker.retryStage("task-1", failedStageTranscode); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	options := tr.waitStarts(t, 1)
+	want := []string{filepath.Join(cfg.Storage.DownloadPath, "Album/a.flac"), filepath.Join(cfg.Storage.DownloadPath, "Album/b.mp3")}
+	if !reflect.DeepEqual(options[0].AudioTracks, want) {
+		t.Fatalf("expected the retry to transcode the audio tracks %v, got %v", want, options[0].AudioTracks)
+	}
+
+	// 曲目子目录中的切片对应同序号的曲目，曲目已删除时需要重新转码
+	status, _, err := worker.repairSegment("task-1", "track01/index0.ts", false)
+	if err != nil || status != RepairStatusNeedsRetranscode {
+		t.Fatalf("expected a bad segment without its track to need a re-transcode, got %q (%v)", status, err)
+	}
+	source, err := worker.segmentSource(task, "track02/index0.ts")
+	if err != nil || !source.audio || source.input != want[1] || source.name != "index0.ts" {
+		t.Fatalf("expected the second track to be the source of track02, got %+v (%v)", source, err)
+	}
+	if _, _, err := worker.repairSegment("task-1", "index0.ts", false); err == nil {
+		t.Fatal("expected a segment outside the track directories to be rejected")
+	}
+}
+
+func TestCheckPlaylistComplete(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "720p"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write("master.m3u8", "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2800000\n720p/index.m3u8\n")
+	write("720p/index0.ts", "segment")
+	write("720p/index.m3u8", "#EXTM3U\n#EXTINF:6.0,\nindex0.ts\n#EXTINF:6.0,\nindex1.ts\n")
+
+	// 没有ENDLIST且index1.ts尚未生成
+	if err := checkPlaylistComplete(filepath.Join(dir, "master.m3u8"), 0); err == nil {
+		t.Fatal("expected an unfinished rendition to be incomplete")
+	}
+	write("720p/index1.ts", "segment")
+	if err := checkPlaylistComplete(filepath.Join(dir, "master.m3u8"), 0); err == nil {
+		t.Fatal("expected a playlist without #EXT-X-ENDLIST to be incomplete")
+	}
+	write("720p/index.m3u8", "#EXTM3U\n#EXTINF:6.0,\nindex0.ts\n#EXTINF:6.0,\nindex1.ts\n#EXT-X-ENDLIST\n")
+	if err := checkPlaylistComplete(filepath.Join(dir, "master.m3u8"), 0); err != nil {
+		t.Fatalf("expected the finished output to be complete: %v", err)
+	}
 }
@@ -3,8 +3,10 @@ package client
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"worker/domain"
@@ -19,10 +21,11 @@ type Gateway interface {
 	Disconnect()
 	IsConnected() bool
 	SendMessage(msgType domain.MessageType, payload map[string]interface{}) error
-	SendHeartbeat() error
+	SendHeartbeat(metrics map[string]interface{}) error
 	SendTaskStatus(taskID string, status domain.TaskStatus, progress int, metadata map[string]interface{}) error
 	SendWebRTCAnswer(sessionID, sdp string) error
 	SendICECandidate(sessionID, candidate string) error
+	ActiveURL() string
 }
 
 // Message 消息结构
@@ -31,71 +34,200 @@ type Message struct {
 	Payload map[string]interface{} `json:"payload"`
 }
 
-// GatewayClient 网关客户端
+// failbackProbeInterval 连接到备用网关时探测更高优先级网关的间隔
+const failbackProbeInterval = time.Minute
+
+// initialReconnectDelay 断线后第一次重连前等待的时长，之后每次失败翻倍，直到reconnectDelay
+const initialReconnectDelay = time.Second
+
+// rejectedBackoff 网关以connection_rejected拒绝连接（如同一节点ID已有连接）后，重连前等待的时间
+const rejectedBackoff = 30 * time.Second
+
+// maxRegistrationRejections 网关连续以registration_rejected拒绝注册（协议版本不兼容）的次数上限，
+// 达到后不再重连：升级网关或Worker之前重连不会成功。每次拒绝后的等待从rejectBackoff起翻倍，
+// 不超过maxRejectedBackoff
+const (
+	maxRegistrationRejections = 5
+	maxRejectedBackoff        = 10 * time.Minute
+)
+
+// GatewayClient 网关客户端。支持按优先级排列的多个网关地址：
+// 连接第一个可达的网关，断开后依次尝试后续地址，并定期探测更高优先级的网关以便切回。
+//
+// 连接成功后由唯一的连接管理协程（run）负责整个生命周期：为当前连接启动读循环并等它退出，
+// 断线后按指数退避重连并重新注册，切回高优先级网关时先关闭旧连接、等旧读循环退出后再读新连接，
+// 因此任何时候最多只有一个读循环。未连接时发送消息直接返回ErrNotConnected，不排队。
+// 连续重连失败达到SetMaxReconnects的上限，或网关多次因协议版本不兼容拒绝注册时放弃重连，
+// 原因通过Failed报告。
 type GatewayClient struct {
-	gatewayURL     string
+	gatewayURLs    []string
 	nodeID         string
 	conn           *websocket.Conn
+	activeIndex    int // 当前连接的网关在gatewayURLs中的下标，未连接时为-1
+	nodeInfo       domain.NodeInfo
 	messageHandler domain.GatewayMessageHandler
-	reconnectDelay time.Duration
+	reconnectDelay time.Duration // 重连退避的上限
+	failbackEvery  time.Duration
+	rejectBackoff  time.Duration
+	rejectedUntil  time.Time // 被网关拒绝后在此之前不重连
+	rejections     int       // 连续被拒绝注册的次数，注册成功后清零
+	maxReconnects  int       // 连续重连失败的次数上限，0表示不限
+	registered     bool      // 当前连接已收到registration_confirmed
+	failed         chan error
 	connected      bool
 	mutex          sync.RWMutex
+	writeMu        sync.Mutex // websocket连接不支持并发写
 	stopChan       chan struct{}
+	stopOnce       sync.Once // Disconnect可能被并发调用，stopChan只关闭一次
+	runOnce        sync.Once
+	readers        atomic.Int32 // 正在运行的读循环数
 }
 
 // New 创建新的网关客户端
 func New(gatewayURL, nodeID string) *GatewayClient {
+	return NewWithURLs([]string{gatewayURL}, nodeID)
+}
+
+// NewWithURLs 创建支持多个网关的客户端，gatewayURLs按优先级从高到低排列
+func NewWithURLs(gatewayURLs []string, nodeID string) *GatewayClient {
 	return &GatewayClient{
-		gatewayURL:     gatewayURL,
+		gatewayURLs:    append([]string(nil), gatewayURLs...),
 		nodeID:         nodeID,
+		activeIndex:    -1,
 		reconnectDelay: 5 * time.Second,
+		failbackEvery:  failbackProbeInterval,
+		rejectBackoff:  rejectedBackoff,
+		failed:         make(chan error, 1),
 		stopChan:       make(chan struct{}),
 	}
 }
 
+// SetReconnectDelay 设置断线重连退避的上限，不大于0时保持默认的5秒
+func (gc *GatewayClient) SetReconnectDelay(max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	gc.mutex.Lock()
+	gc.reconnectDelay = max
+	gc.mutex.Unlock()
+}
+
+// SetMaxReconnects 设置连续重连失败（连不上网关或连上后没有注册成功）的次数上限，
+// 达到后放弃重连并通过Failed报告，不大于0时一直重连
+func (gc *GatewayClient) SetMaxReconnects(max int) {
+	gc.mutex.Lock()
+	gc.maxReconnects = max
+	gc.mutex.Unlock()
+}
+
+// Failed 放弃重连时收到原因：连续重连失败达到上限，或网关多次因协议版本不兼容拒绝注册
+func (gc *GatewayClient) Failed() <-chan error {
+	return gc.failed
+}
+
 // SetMessageHandler 设置消息处理器
 func (gc *GatewayClient) SetMessageHandler(handler domain.GatewayMessageHandler) {
 	gc.messageHandler = handler
 }
 
-// Connect 连接到网关
+// Connect 按优先级连接第一个可达的网关并注册节点
 func (gc *GatewayClient) Connect(nodeInfo domain.NodeInfo) error {
-	u, err := url.Parse(gc.gatewayURL)
-	if err != nil {
+	gc.mutex.Lock()
+	gc.nodeInfo = nodeInfo
+	gc.mutex.Unlock()
+
+	if err := gc.connectFrom(0, len(gc.gatewayURLs)); err != nil {
 		return err
 	}
 
-	log.Printf("Connecting to gateway: %s", gc.gatewayURL)
+	// 启动连接管理协程，重复调用Connect不会再启动
+	gc.runOnce.Do(func() { go gc.run() })
+	return nil
+}
+
+// connectFrom 依次尝试gatewayURLs[from:to]，成功后切换到该网关
+func (gc *GatewayClient) connectFrom(from, to int) error {
+	var lastErr error = ErrNoGateway
+	for i := from; i < to; i++ {
+		conn, err := gc.dial(gc.gatewayURLs[i])
+		if err != nil {
+			log.Printf("Failed to connect to gateway %s: %v", gc.gatewayURLs[i], err)
+			lastErr = err
+			continue
+		}
+		gc.switchTo(i, conn)
+		return nil
+	}
+	return lastErr
+}
+
+// dial 连接网关并发送节点注册信息
+func (gc *GatewayClient) dial(gatewayURL string) (*websocket.Conn, error) {
+	u, err := url.Parse(gatewayURL)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connecting to gateway: %s", gatewayURL)
 
 	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	gc.mutex.RLock()
+	nodeInfo := gc.nodeInfo
+	gc.mutex.RUnlock()
+
+	// 发送节点注册信息，附带本机时钟供网关估计时钟偏差
+	nodeInfo.ClockMs = time.Now().UnixMilli()
+	if err := conn.WriteJSON(nodeInfo); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// switchTo 将新连接设为当前连接，关闭旧连接并记录切换
+func (gc *GatewayClient) switchTo(index int, conn *websocket.Conn) {
+	gc.writeMu.Lock()
 	gc.mutex.Lock()
+	previous := gc.conn
+	previousIndex := gc.activeIndex
 	gc.conn = conn
+	gc.activeIndex = index
 	gc.connected = true
+	gc.registered = false
 	gc.mutex.Unlock()
+	gc.writeMu.Unlock()
 
-	// 发送节点注册信息
-	if err := gc.conn.WriteJSON(nodeInfo); err != nil {
-		gc.conn.Close()
-		return err
+	if previous != nil {
+		previous.Close()
 	}
 
-	// 启动消息接收循环
-	go gc.readLoop()
-
-	// 启动重连监控
-	go gc.reconnectLoop(nodeInfo)
+	switch {
+	case previousIndex < 0:
+		log.Printf("Connected to gateway %s successfully", gc.gatewayURLs[index])
+	case previousIndex != index:
+		log.Printf("Switched gateway from %s to %s", gc.gatewayURLs[previousIndex], gc.gatewayURLs[index])
+	default:
+		log.Printf("Reconnected to gateway %s", gc.gatewayURLs[index])
+	}
+}
 
-	log.Printf("Connected to gateway successfully")
-	return nil
+// ActiveURL 返回当前连接的网关地址，未连接时为空
+func (gc *GatewayClient) ActiveURL() string {
+	gc.mutex.RLock()
+	defer gc.mutex.RUnlock()
+	if !gc.connected || gc.activeIndex < 0 {
+		return ""
+	}
+	return gc.gatewayURLs[gc.activeIndex]
 }
 
 // Disconnect 断开连接
 func (gc *GatewayClient) Disconnect() {
-	close(gc.stopChan)
+	gc.stopOnce.Do(func() { close(gc.stopChan) })
 
 	gc.mutex.Lock()
 	if gc.conn != nil {
@@ -103,6 +235,7 @@ func (gc *GatewayClient) Disconnect() {
 		gc.conn = nil
 	}
 	gc.connected = false
+	gc.activeIndex = -1
 	gc.mutex.Unlock()
 
 	log.Printf("Disconnected from gateway")
@@ -115,8 +248,12 @@ func (gc *GatewayClient) IsConnected() bool {
 	return gc.connected
 }
 
-// SendMessage 发送消息到网关
+// SendMessage 发送消息到当前连接的网关。未连接（包括重连期间）时立即返回ErrNotConnected，
+// 消息不会排队；调用方自行决定是否稍后重发，心跳和状态更新会在下一周期再次发送
 func (gc *GatewayClient) SendMessage(msgType domain.MessageType, payload map[string]interface{}) error {
+	gc.writeMu.Lock()
+	defer gc.writeMu.Unlock()
+
 	gc.mutex.RLock()
 	conn := gc.conn
 	connected := gc.connected
@@ -134,12 +271,17 @@ func (gc *GatewayClient) SendMessage(msgType domain.MessageType, payload map[str
 	return conn.WriteJSON(message)
 }
 
-// SendHeartbeat 发送心跳
-func (gc *GatewayClient) SendHeartbeat() error {
-	return gc.SendMessage(domain.MessageTypeHeartbeat, map[string]interface{}{
-		"timestamp": time.Now().Unix(),
+// SendHeartbeat 发送心跳，metrics为附带的节点指标
+func (gc *GatewayClient) SendHeartbeat(metrics map[string]interface{}) error {
+	payload := map[string]interface{}{
+		"timestamp": domain.FormatTime(time.Now()),
+		"clock_ms":  time.Now().UnixMilli(),
 		"node_id":   gc.nodeID,
-	})
+	}
+	if metrics != nil {
+		payload["metrics"] = metrics
+	}
+	return gc.SendMessage(domain.MessageTypeHeartbeat, payload)
 }
 
 // SendTaskStatus 发送任务状态更新
@@ -148,7 +290,7 @@ func (gc *GatewayClient) SendTaskStatus(taskID string, status domain.TaskStatus,
 		"task_id":   taskID,
 		"status":    status,
 		"progress":  progress,
-		"timestamp": time.Now().Unix(),
+		"timestamp": domain.FormatTime(time.Now()),
 	}
 
 	if metadata != nil {
@@ -176,16 +318,19 @@ func (gc *GatewayClient) SendICECandidate(sessionID, candidate string) error {
 	})
 }
 
-// readLoop 消息接收循环
-func (gc *GatewayClient) readLoop() {
+// readLoop 消息接收循环，conn被替换或关闭后退出。只由run调用
+func (gc *GatewayClient) readLoop(conn *websocket.Conn) {
+	gc.readers.Add(1)
+	defer gc.readers.Add(-1)
 	defer func() {
 		gc.mutex.Lock()
-		gc.connected = false
-		if gc.conn != nil {
-			gc.conn.Close()
+		// 回切后旧连接的读循环退出时不能影响新连接
+		if gc.conn == conn {
+			gc.connected = false
 			gc.conn = nil
 		}
 		gc.mutex.Unlock()
+		conn.Close()
 	}()
 
 	for {
@@ -195,21 +340,27 @@ func (gc *GatewayClient) readLoop() {
 		default:
 		}
 
-		gc.mutex.RLock()
-		conn := gc.conn
-		gc.mutex.RUnlock()
-
-		if conn == nil {
-			return
-		}
-
 		var message Message
 		err := conn.ReadJSON(&message)
 		if err != nil {
-			log.Printf("Failed to read message from gateway: %v", err)
+			if websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				log.Printf("Gateway closed the connection, retrying later: %v", err)
+			} else {
+				log.Printf("Failed to read message from gateway: %v", err)
+			}
 			return
 		}
 
+		switch message.Type {
+		case domain.MessageTypeRegistrationConfirmed:
+			gc.confirmRegistration(conn)
+		case domain.MessageTypeRegistrationRejected:
+			gc.rejectRegistration(message.Payload)
+		case domain.MessageTypeConnectionRejected:
+			// 拒绝连接是正常的繁忙信号而非错误，等待一段时间后再重连
+			gc.backOff(message.Payload)
+		}
+
 		// 处理接收到的消息
 		if gc.messageHandler != nil {
 			go gc.messageHandler(message.Type, message.Payload)
@@ -217,31 +368,174 @@ func (gc *GatewayClient) readLoop() {
 	}
 }
 
-// reconnectLoop 重连循环
-func (gc *GatewayClient) reconnectLoop(nodeInfo domain.NodeInfo) {
-	ticker := time.NewTicker(gc.reconnectDelay)
-	defer ticker.Stop()
+// backOff 记录网关拒绝连接，rejectBackoff内不再重连
+func (gc *GatewayClient) backOff(payload map[string]interface{}) {
+	gc.mutex.Lock()
+	gc.rejectedUntil = time.Now().Add(gc.rejectBackoff)
+	gc.mutex.Unlock()
+	log.Printf("Gateway rejected the connection (%v), reconnecting in %v", payload["reason"], gc.rejectBackoff)
+}
+
+// confirmRegistration 记录conn注册成功，之后断线时重连从头退避
+func (gc *GatewayClient) confirmRegistration(conn *websocket.Conn) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	if gc.conn == conn {
+		gc.registered = true
+		gc.rejections = 0
+	}
+}
+
+// rejectRegistration 记录网关因协议版本不兼容拒绝注册：重连前的等待从rejectBackoff起每次翻倍，
+// 不超过maxRejectedBackoff
+func (gc *GatewayClient) rejectRegistration(payload map[string]interface{}) {
+	gc.mutex.Lock()
+	gc.rejections++
+	wait := gc.rejectBackoff
+	for i := 1; i < gc.rejections && wait < maxRejectedBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRejectedBackoff {
+		wait = maxRejectedBackoff
+	}
+	gc.rejectedUntil = time.Now().Add(wait)
+	rejections := gc.rejections
+	gc.mutex.Unlock()
+
+	if rejections < maxRegistrationRejections {
+		log.Printf("Gateway rejected the registration (%v), reconnecting in %v", payload["reason"], wait)
+	}
+}
+
+// giveUp 判断是否放弃重连，attempt为连续失败的次数
+func (gc *GatewayClient) giveUp(attempt int) error {
+	gc.mutex.RLock()
+	defer gc.mutex.RUnlock()
+	if gc.rejections >= maxRegistrationRejections {
+		return fmt.Errorf("%w: gateway rejected the registration %d times", ErrGaveUp, gc.rejections)
+	}
+	if gc.maxReconnects > 0 && attempt >= gc.maxReconnects {
+		return fmt.Errorf("%w: %d reconnect attempts failed", ErrGaveUp, attempt)
+	}
+	return nil
+}
+
+// run 连接管理协程：为当前连接运行读循环直到断开，然后退避重连；连接到备用网关时定期探测更高优先级的网关
+func (gc *GatewayClient) run() {
+	failback := time.NewTicker(gc.failbackEvery)
+	defer failback.Stop()
+
+	// 连续失败的重连次数：连接在收到registration_confirmed之前断开也算失败，
+	// 避免被拒绝注册的节点不加退避地反复重连
+	attempt := 0
+	for {
+		gc.mutex.RLock()
+		conn := gc.conn
+		gc.mutex.RUnlock()
+
+		if conn != nil {
+			if !gc.serve(conn, failback.C) {
+				return
+			}
+			gc.mutex.RLock()
+			registered := gc.registered
+			gc.mutex.RUnlock()
+			if registered {
+				attempt = 0
+			}
+			continue
+		}
+
+		if err := gc.giveUp(attempt); err != nil {
+			log.Printf("Giving up reconnecting to gateway: %v", err)
+			gc.failed <- err
+			return
+		}
+		if !gc.sleep(gc.reconnectBackoff(attempt)) {
+			return
+		}
+		attempt++
+		log.Printf("Attempting to reconnect to gateway (attempt %d)...", attempt)
+		if err := gc.connectFrom(0, len(gc.gatewayURLs)); err != nil {
+			log.Printf("Reconnection failed: %v", err)
+		}
+	}
+}
+
+// serve 运行conn的读循环并等待它退出；期间按failback探测更高优先级的网关，切换后旧连接被关闭，
+// 读循环随之退出。客户端停止时返回false
+func (gc *GatewayClient) serve(conn *websocket.Conn, failback <-chan time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gc.readLoop(conn)
+	}()
 
 	for {
 		select {
+		case <-done:
+			return true
 		case <-gc.stopChan:
-			return
-		case <-ticker.C:
-			if !gc.IsConnected() {
-				log.Printf("Attempting to reconnect to gateway...")
-				if err := gc.Connect(nodeInfo); err != nil {
-					log.Printf("Reconnection failed: %v", err)
-				} else {
-					log.Printf("Reconnected to gateway successfully")
-				}
+			conn.Close()
+			<-done
+			return false
+		case <-failback:
+			gc.mutex.RLock()
+			active := gc.activeIndex
+			current := gc.conn
+			gc.mutex.RUnlock()
+			if active <= 0 || current != conn {
+				continue
+			}
+			if err := gc.connectFrom(0, active); err != nil {
+				log.Printf("Higher-priority gateways still unreachable: %v", err)
 			}
 		}
 	}
 }
 
+// reconnectBackoff 第attempt次（从0开始）重连前等待的时长：从initialReconnectDelay起每次翻倍，
+// 不超过reconnectDelay，再取其一半到全部之间的随机值，避免多个节点同时重连。
+// 被网关拒绝后至少等到rejectBackoff结束
+func (gc *GatewayClient) reconnectBackoff(attempt int) time.Duration {
+	gc.mutex.RLock()
+	max := gc.reconnectDelay
+	rejectedWait := time.Until(gc.rejectedUntil)
+	gc.mutex.RUnlock()
+
+	delay := initialReconnectDelay
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if half := delay / 2; half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+	if rejectedWait > delay {
+		delay = rejectedWait
+	}
+	return delay
+}
+
+// sleep 等待d，客户端停止时提前返回false
+func (gc *GatewayClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-gc.stopChan:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 // 错误定义
 var (
 	ErrNotConnected = fmt.Errorf("not connected to gateway")
+	ErrNoGateway    = fmt.Errorf("no gateway URL configured")
+	ErrGaveUp       = fmt.Errorf("gave up reconnecting to gateway")
 )
 
 var _ Gateway = (*GatewayClient)(nil)
@@ -1,9 +1,18 @@
 package client
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"worker/domain"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestGatewayClientImplementsGateway(t *testing.T) {
@@ -17,6 +26,31 @@ func TestGatewayClientSendMessageWithoutConnection(t *testing.T) {
 	}
 }
 
+func TestGatewayClientDisconnectIsSafeToCallConcurrently(t *testing.T) {
+	// 并发的Disconnect只关闭一次stopChan，重复关闭会panic
+	for round := 0; round < 200; round++ {
+		gc := New("ws://localhost:1234", "worker-1")
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				gc.Disconnect()
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		select {
+		case <-gc.stopChan:
+		default:
+			t.Fatal("expected stopChan to be closed")
+		}
+	}
+}
+
 func TestGatewayClientSetMessageHandler(t *testing.T) {
 	captured := make([]domain.MessageType, 0, 1)
 	handler := func(msgType domain.MessageType, _ map[string]interface{}) {
@@ -35,3 +69,283 @@ func TestGatewayClientSetMessageHandler(t *testing.T) {
 		t.Fatalf("handler not invoked as expected; captured=%v", captured)
 	}
 }
+
+// newTestGateway 启动一个接受节点注册的WebSocket服务，up为false时拒绝连接
+func newTestGateway(t *testing.T, up *atomic.Bool, registrations *atomic.Int32) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var info domain.NodeInfo
+		if err := conn.ReadJSON(&info); err != nil {
+			return
+		}
+		registrations.Add(1)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestGatewayClientFailsOverAndBack(t *testing.T) {
+	var primaryUp, backupUp atomic.Bool
+	var primaryRegs, backupRegs atomic.Int32
+	backupUp.Store(true)
+
+	primary := newTestGateway(t, &primaryUp, &primaryRegs)
+	backup := newTestGateway(t, &backupUp, &backupRegs)
+
+	gc := NewWithURLs([]string{primary, backup}, "worker-1")
+	gc.reconnectDelay = 10 * time.Millisecond
+	gc.failbackEvery = 10 * time.Millisecond
+	defer gc.Disconnect()
+
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if got := gc.ActiveURL(); got != backup {
+		t.Fatalf("expected backup gateway while primary is down, got %q", got)
+	}
+	if err := gc.SendHeartbeat(nil); err != nil {
+		t.Fatalf("heartbeat via backup: %v", err)
+	}
+
+	primaryUp.Store(true)
+	waitFor(t, func() bool { return gc.ActiveURL() == primary })
+
+	if primaryRegs.Load() != 1 || backupRegs.Load() != 1 {
+		t.Fatalf("expected one registration per gateway, got primary=%d backup=%d", primaryRegs.Load(), backupRegs.Load())
+	}
+	if err := gc.SendHeartbeat(nil); err != nil {
+		t.Fatalf("heartbeat via primary: %v", err)
+	}
+}
+
+func TestGatewayClientBacksOffWhenRejected(t *testing.T) {
+	var registrations atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var info domain.NodeInfo
+		if err := conn.ReadJSON(&info); err != nil {
+			return
+		}
+		registrations.Add(1)
+		conn.WriteJSON(Message{Type: domain.MessageTypeConnectionRejected, Payload: map[string]interface{}{"node_id": info.ID, "reason": "already_connected"}})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "already_connected"), time.Now().Add(time.Second))
+		conn.ReadMessage()
+	}))
+	t.Cleanup(server.Close)
+
+	gc := New("ws"+strings.TrimPrefix(server.URL, "http"), "worker-1")
+	gc.reconnectDelay = 10 * time.Millisecond
+	gc.rejectBackoff = 300 * time.Millisecond
+	defer gc.Disconnect()
+
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	waitFor(t, func() bool { return !gc.IsConnected() })
+
+	// 退避期间不重连，之后再试
+	time.Sleep(100 * time.Millisecond)
+	if got := registrations.Load(); got != 1 {
+		t.Fatalf("expected no reconnect while backing off, got %d registrations", got)
+	}
+	waitFor(t, func() bool { return registrations.Load() >= 2 })
+}
+
+func TestGatewayClientGivesUpAfterRepeatedRegistrationRejections(t *testing.T) {
+	var registrations atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var info domain.NodeInfo
+		if err := conn.ReadJSON(&info); err != nil {
+			return
+		}
+		registrations.Add(1)
+		conn.WriteJSON(Message{Type: domain.MessageTypeRegistrationRejected, Payload: map[string]interface{}{
+			"node_id": info.ID,
+			"reason":  "incompatible protocol version: worker supports 24-25, gateway supports 1-23",
+		}})
+	}))
+	t.Cleanup(server.Close)
+
+	gc := New("ws"+strings.TrimPrefix(server.URL, "http"), "worker-1")
+	gc.reconnectDelay = time.Millisecond
+	gc.rejectBackoff = 20 * time.Millisecond
+	defer gc.Disconnect()
+
+	start := time.Now()
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	select {
+	case err := <-gc.Failed():
+		if !errors.Is(err, ErrGaveUp) {
+			t.Fatalf("expected ErrGaveUp, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to give up after repeated rejections")
+	}
+
+	// 每次拒绝后的等待翻倍：20+40+80+160毫秒
+	if got := registrations.Load(); got != maxRegistrationRejections {
+		t.Fatalf("expected %d registrations before giving up, got %d", maxRegistrationRejections, got)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("expected the rejection backoff to double, gave up after %v", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := registrations.Load(); got != maxRegistrationRejections {
+		t.Fatalf("expected no reconnects after giving up, got %d registrations", got)
+	}
+}
+
+func TestGatewayClientGivesUpAfterMaxReconnects(t *testing.T) {
+	var up atomic.Bool
+	var regs atomic.Int32
+	up.Store(true)
+	gc := New(newTestGateway(t, &up, &regs), "worker-1")
+	gc.SetReconnectDelay(time.Millisecond)
+	gc.SetMaxReconnects(3)
+	defer gc.Disconnect()
+
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	up.Store(false)
+	gc.mutex.RLock()
+	conn := gc.conn
+	gc.mutex.RUnlock()
+	conn.Close()
+
+	select {
+	case err := <-gc.Failed():
+		if !errors.Is(err, ErrGaveUp) {
+			t.Fatalf("expected ErrGaveUp, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to give up after 3 failed reconnects")
+	}
+}
+
+func TestGatewayClientConnectFailsWhenAllGatewaysDown(t *testing.T) {
+	var up atomic.Bool
+	var regs atomic.Int32
+	gc := NewWithURLs([]string{newTestGateway(t, &up, &regs)}, "worker-1")
+
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err == nil {
+		t.Fatalf("expected error when no gateway is reachable")
+	}
+	if gc.ActiveURL() != "" {
+		t.Fatalf("expected no active gateway, got %q", gc.ActiveURL())
+	}
+}
+
+func TestGatewayClientKeepsOneReaderAcrossReconnects(t *testing.T) {
+	var registrations atomic.Int32
+	drops := make(chan *websocket.Conn, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		var info domain.NodeInfo
+		if err := conn.ReadJSON(&info); err != nil {
+			conn.Close()
+			return
+		}
+		registrations.Add(1)
+		drops <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	gc := New("ws"+strings.TrimPrefix(server.URL, "http"), "worker-1")
+	gc.SetReconnectDelay(10 * time.Millisecond)
+
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	// 再次调用Connect不会启动第二个管理协程
+	if err := gc.Connect(domain.NodeInfo{ID: "worker-1"}); err != nil {
+		t.Fatalf("second connect: %v", err)
+	}
+	(<-drops).Close()
+
+	const reconnects = 5
+	for i := 0; i < reconnects; i++ {
+		// 网关断开连接，客户端退避后重新注册
+		(<-drops).Close()
+	}
+	conn := <-drops
+	defer conn.Close()
+	waitFor(t, gc.IsConnected)
+
+	if got := registrations.Load(); got != reconnects+2 {
+		t.Fatalf("expected %d registrations, got %d", reconnects+2, got)
+	}
+	if got := gc.readers.Load(); got != 1 {
+		t.Fatalf("expected exactly one reader after %d reconnects, got %d", reconnects, got)
+	}
+
+	gc.Disconnect()
+	gc.Disconnect()
+	waitFor(t, func() bool { return gc.readers.Load() == 0 })
+	if err := gc.SendHeartbeat(nil); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected after disconnect, got %v", err)
+	}
+}
+
+func TestGatewayClientReconnectBackoffGrowsToMax(t *testing.T) {
+	gc := New("ws://localhost:1234", "worker-1")
+	gc.SetReconnectDelay(8 * time.Second)
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := gc.reconnectBackoff(attempt); got < want/2 || got > want {
+				t.Fatalf("attempt %d: expected a delay between %v and %v, got %v", attempt, want/2, want, got)
+			}
+		}
+	}
+
+	gc.backOff(map[string]interface{}{"reason": "already_connected"})
+	if got := gc.reconnectBackoff(0); got < rejectedBackoff-time.Second {
+		t.Fatalf("expected the rejection backoff to apply, got %v", got)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("condition not met before deadline")
+}
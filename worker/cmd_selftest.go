@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"worker/app"
+	"worker/config"
+)
+
+// runSelfTestCommand 实现 `worker selftest`：依次检查配置、存储、数据库、ffmpeg、
+// STUN、网关注册与ICE服务器获取，退出码反映是否全部通过。
+func runSelfTestCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "config/worker.json", "Configuration file path")
+	gateway := fs.String("gateway", "", "Override gateway WebSocket URL")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: worker selftest [flags]")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load config %s: %v\n", *configPath, err)
+		return 1
+	}
+	if *gateway != "" {
+		cfg.Gateway.URL = *gateway
+		cfg.Gateway.URLs = nil
+	}
+
+	report := app.RunSelfTest(cfg)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(stderr, "failed to encode report: %v\n", err)
+			return 1
+		}
+	} else {
+		printSelfTestReport(stdout, report)
+	}
+
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+func printSelfTestReport(out io.Writer, report app.SelfTestReport) {
+	fmt.Fprintf(out, "Worker self-test (node %s)\n", report.NodeID)
+	for _, result := range report.Results {
+		status := "PASS"
+		message := result.Detail
+		if !result.Passed {
+			status = "FAIL"
+			message = result.Error
+		}
+		fmt.Fprintf(out, "  [%s] %-12s %s (%dms)\n", status, result.Name, message, result.DurationMS)
+	}
+
+	if report.Passed {
+		fmt.Fprintln(out, "All checks passed")
+	} else {
+		fmt.Fprintln(out, "Some checks failed")
+	}
+}
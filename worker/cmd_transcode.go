@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"worker/transcoder"
+)
+
+// runTranscodeCommand 实现 `worker transcode <input> <outputDir>`：
+// 直接调用 ConvertToHLS 完成一次性切片，不连接网关也不启动下载子系统。
+func runTranscodeCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("transcode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	segment := fs.Int("segment", transcoder.DefaultHLSConfig().SegmentDuration, "HLS segment duration in seconds")
+	subtitles := fs.Bool("subtitles", false, "extract embedded subtitles (enabled automatically for .mkv)")
+	keyframeGap := fs.Float64("max-keyframe-gap", 15, "re-encode with forced keyframes when copying video whose keyframes are further apart, in seconds; 0 disables")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: worker transcode [flags] <input> <outputDir>")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	inputPath := fs.Arg(0)
+	outputDir := fs.Arg(1)
+
+	hlsConfig := transcoder.DefaultHLSConfig()
+	hlsConfig.SegmentDuration = *segment
+	hlsConfig.MaxKeyframeGap = *keyframeGap
+	hlsConfig.ExtractSubtitles = *subtitles || strings.ToLower(filepath.Ext(inputPath)) == ".mkv"
+
+	playlist, err := transcoder.ConvertToHLS(inputPath, outputDir, hlsConfig)
+	if err != nil {
+		fmt.Fprintf(stderr, "transcode failed: %v\n", err)
+		var ffmpegErr *transcoder.FFmpegError
+		if errors.As(err, &ffmpegErr) && ffmpegErr.Tail != "" {
+			fmt.Fprintf(stderr, "ffmpeg output:\n%s\n", ffmpegErr.Tail)
+		}
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "playlist: %s\n", playlist)
+
+	subs, err := transcoder.FindSubtitleFiles(outputDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to list subtitles: %v\n", err)
+		return 1
+	}
+	for _, sub := range subs {
+		if sub.Language == "" {
+			fmt.Fprintf(stdout, "subtitle: %s\n", sub.Path)
+			continue
+		}
+		fmt.Fprintf(stdout, "subtitle: %s (%s)\n", sub.Path, sub.Language)
+	}
+
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// installFakeFFmpeg 在PATH前部放置伪造的 ffmpeg/ffprobe 脚本
+func installFakeFFmpeg(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg scripts require a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	ffprobe := "#!/bin/sh\necho h264\n"
+	// 最后一个参数是输出的 m3u8 路径
+	ffmpeg := `#!/bin/sh
+for last; do :; done
+dir=$(dirname "$last")
+printf '#EXTM3U\n#EXTINF:10.0,\nindex0.ts\n#EXT-X-ENDLIST\n' > "$last"
+: > "$dir/index0.ts"
+`
+	if err := os.WriteFile(filepath.Join(binDir, "ffprobe"), []byte(ffprobe), 0755); err != nil {
+		t.Fatalf("write fake ffprobe: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "ffmpeg"), []byte(ffmpeg), 0755); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunTranscodeCommand(t *testing.T) {
+	installFakeFFmpeg(t)
+
+	input := filepath.Join(t.TempDir(), "sample.mp4")
+	if err := os.WriteFile(input, []byte("not really a video"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	outputDir := filepath.Join(t.TempDir(), "out")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "sample.srt"), []byte("1\n"), 0644); err != nil {
+		t.Fatalf("write subtitle: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := runTranscodeCommand([]string{input, outputDir}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	playlist := filepath.Join(outputDir, "index.m3u8")
+	if !strings.Contains(stdout.String(), "playlist: "+playlist) {
+		t.Fatalf("playlist path not printed: %s", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "subtitle: "+filepath.Join(outputDir, "sample.srt")) {
+		t.Fatalf("subtitle not printed: %s", stdout.String())
+	}
+	if _, err := os.Stat(playlist); err != nil {
+		t.Fatalf("playlist not written: %v", err)
+	}
+}
+
+func TestRunTranscodeCommandUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runTranscodeCommand([]string{"only-input"}, &stdout, &stderr); code != 2 {
+		t.Fatalf("expected usage exit code 2, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "Usage: worker transcode") {
+		t.Fatalf("usage not printed: %s", stderr.String())
+	}
+}
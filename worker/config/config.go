@@ -2,58 +2,217 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
-// Config 工作节点配置
+// Config 工作节点配置。每个字段的desc标签是面向运维的说明，由Schema导出；
+// flag标签表示可由同名命令行参数覆盖，default标签覆盖Default()中与主机相关的默认值。
 type Config struct {
-	Node    NodeConfig    `json:"node"`
-	Gateway GatewayConfig `json:"gateway"`
-	Storage StorageConfig `json:"storage"`
-	Limits  LimitsConfig  `json:"limits"`
-	Network NetworkConfig `json:"network"`
+	Node      NodeConfig      `json:"node" desc:"Identity this worker registers with"`
+	Gateway   GatewayConfig   `json:"gateway" desc:"Gateway connection settings"`
+	Storage   StorageConfig   `json:"storage" desc:"Download, output and log locations"`
+	Limits    LimitsConfig    `json:"limits" desc:"Concurrency and size limits"`
+	Network   NetworkConfig   `json:"network" desc:"BitTorrent and WebRTC networking"`
+	Transcode TranscodeConfig `json:"transcode" desc:"HLS transcode chain and preset rules"`
+	// QuietHours 静默时段，时段内暂停下载、做种与新的转码，已转码内容的播放不受影响
+	QuietHours QuietHoursConfig `json:"quiet_hours" desc:"Daily windows during which the worker stops downloading, seeding and transcoding"`
 }
 
 // NodeConfig 节点配置
 type NodeConfig struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	ID      string `json:"id" flag:"id" default:"<hostname>-<random>" desc:"Unique worker node ID"`
+	Name    string `json:"name" flag:"name" default:"<hostname>-worker" desc:"Display name shown in the gateway"`
+	Address string `json:"address" desc:"Address reported to the gateway"`
 }
 
 // GatewayConfig 网关配置
 type GatewayConfig struct {
-	URL             string        `json:"url"`
-	ReconnectDelay  time.Duration `json:"reconnect_delay"`
-	HeartbeatPeriod time.Duration `json:"heartbeat_period"`
+	URL             string        `json:"url" flag:"gateway" desc:"Gateway WebSocket URL (ws:// or wss://)"`
+	URLs            []string      `json:"urls,omitempty" desc:"Gateway URLs in priority order; overrides url when set"` // 按优先级排列的多个网关地址，设置后优先于URL
+	ReconnectDelay  time.Duration `json:"reconnect_delay" desc:"Longest delay between reconnect attempts to the gateway, in nanoseconds; the delay starts at 1s and doubles after each failure"`
+	MaxReconnects   int           `json:"max_reconnects" desc:"Consecutive failed reconnect attempts after which the worker exits; 0 (the default) retries forever"`
+	HeartbeatPeriod time.Duration `json:"heartbeat_period" desc:"Interval between heartbeats, in nanoseconds"`
 }
 
 // StorageConfig 存储配置
 type StorageConfig struct {
-	DownloadPath string `json:"download_path"`
-	M3U8Path     string `json:"m3u8_path"`
-	MaxSizeGB    int    `json:"max_size_gb"`
+	DownloadPath             string   `json:"download_path" desc:"Directory torrents are downloaded into"`
+	M3U8Path                 string   `json:"m3u8_path" desc:"Directory HLS output is written to"`
+	OutputLayout             string   `json:"output_layout" desc:"Name of each task's HLS directory under m3u8_path: task_id (default) or source_name (legacy, named after the video file)"` // 转码输出目录的命名方式
+	MaxSizeGB                int      `json:"max_size_gb" desc:"Maximum storage to use, in GB"`
+	TaskLogPath              string   `json:"task_log_path" desc:"Directory for per-task logs"`
+	TaskLogMaxKB             int      `json:"task_log_max_kb" desc:"Size cap of a single task log, in KB"`                                       // 单个任务日志上限
+	TaskLogTotalMaxMB        int      `json:"task_log_total_max_mb" desc:"Size cap of the whole task log directory, in MB"`                      // 任务日志目录总上限
+	PruneErrorAfterHours     int      `json:"prune_error_after_hours" desc:"Hours before partial data of failed tasks is pruned; 0 disables"`    // 失败任务的下载残留保留时长，0表示不自动清理
+	ExtraMediaPaths          []string `json:"extra_media_paths" desc:"Directories outside download_path whose files may be transcoded directly"` // 下载目录之外允许直接转码的媒体目录
+	FailedTaskRetentionHours int      `json:"failed_task_retention_hours" desc:"Hours before failed or cancelled tasks are deleted; 0 disables"` // 失败/已取消任务的保留时长，超过后连同记录一并删除，0表示不删除
+	// MetadataCache 按info hash缓存的种子元数据，再次提交同一磁力链接时不必等待peer
+	MetadataCache MetadataCacheConfig `json:"metadata_cache" desc:"Cache of torrent info dictionaries keyed by info hash"`
 }
 
+// MetadataCacheConfig 种子元数据缓存配置
+type MetadataCacheConfig struct {
+	Path       string `json:"path" desc:"Directory of the cache; empty disables caching"`
+	TTLHours   int    `json:"ttl_hours" desc:"Hours a cached info dictionary stays valid; expired entries are ignored and swept"`
+	MaxEntries int    `json:"max_entries" desc:"Number of cached info dictionaries; the least recently used are evicted beyond it"`
+}
+
+// 转码输出目录的命名方式。task_id时输出固定在<m3u8_path>/<任务ID>/index.m3u8，
+// 与文件服务按任务ID查找的路径一致；source_name是旧的按视频文件名命名的方式。
+const (
+	OutputLayoutTaskID     = "task_id"
+	OutputLayoutSourceName = "source_name"
+)
+
 // LimitsConfig 限制配置
 type LimitsConfig struct {
-	MaxDownloads   int `json:"max_downloads"`
-	MaxTranscodes  int `json:"max_transcodes"`
-	DiskSpaceGB    int `json:"disk_space_gb"`
-	MaxConnections int `json:"max_connections"`
+	MaxDownloads    int `json:"max_downloads" desc:"Maximum concurrent downloads"`
+	MaxTranscodes   int `json:"max_transcodes" desc:"Maximum concurrent transcodes"`
+	DiskSpaceGB     int `json:"disk_space_gb" desc:"Disk space reserved for the worker, in GB"`
+	MaxConnections  int `json:"max_connections" desc:"Maximum concurrent WebRTC connections"`
+	MaxTorrentFiles int `json:"max_torrent_files" desc:"Maximum number of files in a single torrent"`                                                     // 单个种子允许的最大文件数
+	MaxMetadataKB   int `json:"max_metadata_kb" desc:"Maximum size of torrent metadata and file list, in KB"`                                             // 种子元数据（info字典与文件列表）大小上限
+	MaxRetries      int `json:"max_retries" desc:"Automatic retries of a failed download or transcode before the task is permanently failed; 0 disables"` // 自动重试上限，超过后任务永久失败
+	// 等待种子元数据超过MetadataTimeoutMinutes时任务以metadata_timeout失败，按max_retries自动重试；静默时段不计时
+	MetadataTimeoutMinutes int `json:"metadata_timeout_minutes" desc:"Minutes to wait for torrent metadata before the task fails with metadata_timeout, not counting quiet hours; 0 (the default) waits forever"`
+	// ConfirmPrivateTorrents 多人共用的节点上，私有种子需提交者确认（allow_private）才下载
+	ConfirmPrivateTorrents bool `json:"confirm_private_torrents" desc:"Refuse private torrents unless the submitter confirms with allow_private; for shared workers"`
+	// 下载目录剩余空间低于MinFreeDiskMB时按DiskFullAction处理下载中的任务
+	MinFreeDiskMB  int    `json:"min_free_disk_mb" desc:"Free space of download_path below which downloads stop writing, in MB; 0 disables"`
+	DiskFullAction string `json:"disk_full_action" desc:"What downloads do when free space drops below min_free_disk_mb: pause (resume when space is freed) or fail"`
+	// 开始下载前要求剩余空间放下选中的文件，再额外预留种子大小的DiskReservePercent%
+	DiskReservePercent int `json:"disk_reserve_percent" desc:"Free space a new download needs beyond its selected files, as a percentage of the torrent size"`
 }
 
+// 剩余空间不足时下载任务的处理方式
+const (
+	DiskFullActionPause = "pause"
+	DiskFullActionFail  = "fail"
+)
+
 // NetworkConfig 网络配置
 type NetworkConfig struct {
-	ListenPort   int      `json:"listen_port"`
-	STUNServers  []string `json:"stun_servers"`
-	TURNServers  []string `json:"turn_servers"`
-	MaxBandwidth int      `json:"max_bandwidth_kbps"`
+	ListenPort   int      `json:"listen_port" desc:"BitTorrent listen port; 0 picks one automatically"`
+	STUNServers  []string `json:"stun_servers" desc:"STUN servers used for WebRTC"`
+	TURNServers  []string `json:"turn_servers" desc:"TURN servers used for WebRTC"`
+	MaxBandwidth int      `json:"max_bandwidth_kbps" desc:"Download and upload rate cap of the torrent client, each in kbps; 0 disables"`
+	// 应答Offer后这段时间内没有收集到任何本地ICE候选者时，向客户端报告webrtc_offer_failed
+	ICEGatherTimeoutSeconds int `json:"ice_gather_timeout_seconds" desc:"Seconds to wait for local ICE candidates after answering an offer before reporting webrtc_offer_failed; 0 disables"`
+	// 通过WebRTC发送切片的限速，0表示不限速
+	ServeBandwidth   int `json:"serve_bandwidth_kbps" desc:"Total WebRTC serving rate cap across all sessions, in kbps; 0 disables"`
+	SessionBandwidth int `json:"session_bandwidth_kbps" desc:"WebRTC serving rate cap per session, in kbps; 0 disables"`
+	// 数据通道待发送的数据超过该值时暂停发送，回落到一半以下再继续
+	DataChannelHighWaterKB int `json:"datachannel_high_water_kb" desc:"Pause sending a file once this many KB are buffered on a data channel; resumes below half of it"`
+	// ServePathPrefix 数据通道文件请求路径中<task_id>之前的前缀，Worker生成的播放地址也使用该前缀
+	ServePathPrefix string `json:"serve_path_prefix" desc:"Path prefix in front of <task_id>/<file> in data channel file requests and in the playback URLs the worker generates; full URLs are matched on their path"`
+	// SegmentAccessLog 为true时把每次切片请求写入任务日志，默认只保留汇总计数
+	SegmentAccessLog bool `json:"segment_access_log" desc:"Write every WebRTC segment request to the task log; per-task counts are kept either way"`
+	// 测速会话的限制，防止测速被滥用来消耗带宽
+	MaxProbes      int `json:"max_probes" desc:"Concurrent speed probe sessions; extra probes are refused. 0 uses the default of 2"`
+	ProbeBandwidth int `json:"probe_bandwidth_kbps" desc:"Total speed probe sending rate across all probe sessions, in kbps; 0 for unlimited"`
+	// TrackerPolicy 限制提交的磁力链接可以引用的tracker，默认不限制
+	TrackerPolicy TrackerPolicyConfig `json:"tracker_policy" desc:"Restrict which trackers submitted magnets may reference"`
+	// TrackersFile 每行一个地址的公开tracker列表，文件不存在时使用内置列表
+	TrackersFile string `json:"trackers_file" desc:"Newline-delimited list of public trackers added to public torrents; built-in list when the file is missing"`
+}
+
+// TrackerPolicyConfig tracker主机名白名单/黑名单
+type TrackerPolicyConfig struct {
+	Mode  string   `json:"mode" desc:"allow_all (default), allowlist or denylist"`
+	Hosts []string `json:"hosts" desc:"Tracker hostnames the mode applies to; each also matches its subdomains"`
+}
+
+// TranscodeConfig 转码配置
+type TranscodeConfig struct {
+	// Strategies 转码链，按顺序尝试直到成功；为空时使用默认的先封装后转码
+	Strategies []TranscodeStrategy `json:"strategies" desc:"Transcode chain tried in order until one succeeds"`
+	// Rules 按扩展名/视频编码直接指定预设，在按探测结果自动判断之前按顺序匹配
+	Rules []TranscodeRule `json:"rules,omitempty" desc:"Extension/codec rules that pick a preset before probing"`
+	// MaxKeyframeGapSeconds 直接复制视频流时允许的最大关键帧间隔，超过时重新编码并强制关键帧，0表示不检查
+	MaxKeyframeGapSeconds float64 `json:"max_keyframe_gap_seconds" desc:"Re-encode with forced keyframes when a copied video stream has keyframes further apart than this, in seconds; 0 disables"`
+	// Thumbnails 拖动进度条预览用的缩略图雪碧图，默认关闭
+	Thumbnails ThumbnailConfig `json:"thumbnails" desc:"Scrubbing preview sprites generated after each transcode"`
+	// Renditions 提交时hls_quality为multi的任务使用的码率阶梯，为空时使用内置的1080p/720p/480p/360p
+	Renditions []TranscodeRendition `json:"renditions,omitempty" desc:"Bitrate ladder for tasks submitted with hls_quality multi; built-in 1080p to 360p ladder when empty"`
+	// PreemptForInteractive 有观众等待的任务排队时，暂停（SIGSTOP）最近开始的普通转码为其让出名额，Windows上无效
+	PreemptForInteractive bool `json:"preempt_for_interactive" desc:"Pause the most recently started regular transcode with SIGSTOP when an interactive task is queued; ignored on Windows"`
+	// SegmentChecksums 转码完成后在输出目录写入segments.sha256，修复切片时据此判断是否损坏
+	SegmentChecksums bool `json:"segment_checksums" desc:"Record a SHA-256 of every segment after transcoding so segment repair can detect corruption"`
+	// StreamingMode 视频文件从开头按顺序先下载，开头就绪后边下载边转码，不必等整个种子下载完成
+	StreamingMode bool `json:"streaming_mode" desc:"Download the video sequentially and start transcoding before the download completes; a task submitted with sequential overrides it"`
+	// StreamingReadaheadMB 流式模式下开头下载多少MB后开始转码，以及转码读取位置之后优先下载的数据量
+	StreamingReadaheadMB int `json:"streaming_readahead_mb" desc:"Leading MB downloaded before a streaming transcode starts, and MB prioritized ahead of its read position"`
+	// SubtitleCharset 字幕没有BOM且不是UTF-8时假定的编码（WHATWG编码名，如gb18030、big5、shift_jis），
+	// 复制字幕时据此转换为UTF-8，数据通道原样发送的文本也据此给出charset
+	SubtitleCharset string `json:"subtitle_charset" desc:"Charset assumed for subtitles without a BOM that are not valid UTF-8, e.g. gb18030, big5 or shift_jis; they are converted to UTF-8"`
+	// RequireComplete 所有任务都等下载完成、播放列表引用的切片全部生成后才标记为ready，与提交时的require_complete相同
+	RequireComplete bool `json:"require_complete" desc:"Mark tasks ready only once the download has finished and every segment of the output exists, as if every task were submitted with require_complete"`
+}
+
+// TranscodeRendition 多码率输出中的一路码流
+type TranscodeRendition struct {
+	Name         string `json:"name" desc:"Rendition name, also its sub-directory, e.g. 720p"`
+	Width        int    `json:"width" desc:"Width advertised in the master playlist when the source resolution is unknown; the picture is scaled to the height keeping its aspect ratio"`
+	Height       int    `json:"height" desc:"Output height in pixels; renditions taller than the source are skipped"`
+	VideoBitrate string `json:"video_bitrate" desc:"Video bitrate in ffmpeg notation, e.g. 2800k"`
+	AudioBitrate string `json:"audio_bitrate" desc:"Audio bitrate in ffmpeg notation, e.g. 128k"`
+}
+
+// ThumbnailConfig 缩略图雪碧图配置
+type ThumbnailConfig struct {
+	Enabled         bool `json:"enabled" desc:"Generate thumbnail sprites and a WebVTT index after transcoding"`
+	IntervalSeconds int  `json:"interval_seconds" desc:"Seconds between two thumbnails"`
+	Columns         int  `json:"columns" desc:"Thumbnails per row of a sprite sheet"`
+	Rows            int  `json:"rows" desc:"Rows of thumbnails per sprite sheet"`
+	Width           int  `json:"width" desc:"Thumbnail width in pixels; height follows the video aspect ratio"`
+}
+
+// TranscodeRule 扩展名/编码到预设的映射。Preset为转码链中的策略名，
+// 或内置预设copy、remux、transcode之一。
+type TranscodeRule struct {
+	Extensions []string `json:"extensions,omitempty" desc:"File extensions the rule matches, e.g. .mp4"`
+	Codecs     []string `json:"codecs,omitempty" desc:"Video codecs the rule matches, as reported by ffprobe"`
+	Preset     string   `json:"preset" desc:"Strategy name from the chain, or copy, remux or transcode"`
+}
+
+// builtinTranscodePresets 转码器内置、无需在转码链中声明即可被规则引用的预设
+var builtinTranscodePresets = []string{"copy", "remux", "transcode"}
+
+// TranscodeStrategy 转码链中的一步
+type TranscodeStrategy struct {
+	Name       string `json:"name" desc:"Strategy name, referenced by rules"`
+	VideoCodec string `json:"video_codec" desc:"copy, auto or an ffmpeg video encoder"` // "copy"、"auto"或ffmpeg编码器名称
+	AudioCodec string `json:"audio_codec" desc:"copy or an ffmpeg audio encoder"`
+	Preset     string `json:"preset,omitempty" desc:"Encoder preset, e.g. veryfast"`
+	CRF        int    `json:"crf,omitempty" desc:"Constant rate factor for the video encoder"`
+}
+
+// hasPreset 判断预设名是否为转码链中的策略或内置预设
+func (t TranscodeConfig) hasPreset(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, strategy := range t.Strategies {
+		if strategy.Name == name {
+			return true
+		}
+	}
+	for _, preset := range builtinTranscodePresets {
+		if preset == name {
+			return true
+		}
+	}
+	return false
 }
 
 // Load 加载配置文件
@@ -115,15 +274,33 @@ func Default() *Config {
 			HeartbeatPeriod: 30 * time.Second,
 		},
 		Storage: StorageConfig{
-			DownloadPath: "data/downloads",
-			M3U8Path:     "data/m3u8",
-			MaxSizeGB:    100,
+			DownloadPath:             "data/downloads",
+			M3U8Path:                 "data/m3u8",
+			OutputLayout:             OutputLayoutTaskID,
+			MaxSizeGB:                100,
+			TaskLogPath:              "data/logs/tasks",
+			TaskLogMaxKB:             256,
+			TaskLogTotalMaxMB:        100,
+			PruneErrorAfterHours:     72,
+			FailedTaskRetentionHours: 168,
+			MetadataCache: MetadataCacheConfig{
+				Path:       "data/metadata",
+				TTLHours:   168,
+				MaxEntries: 1000,
+			},
 		},
 		Limits: LimitsConfig{
-			MaxDownloads:   5,
-			MaxTranscodes:  3,
-			DiskSpaceGB:    50,
-			MaxConnections: 10,
+			MaxDownloads:    5,
+			MaxTranscodes:   3,
+			DiskSpaceGB:     50,
+			MaxConnections:  10,
+			MaxTorrentFiles: 10000,
+			MaxMetadataKB:   4096,
+			MaxRetries:      3,
+			MinFreeDiskMB:   1024,
+			DiskFullAction:  DiskFullActionPause,
+			// 与downloader.DefaultDiskReservePercent一致
+			DiskReservePercent: 20,
 		},
 		Network: NetworkConfig{
 			ListenPort: 0, // 自动分配
@@ -133,7 +310,34 @@ func Default() *Config {
 				"stun:stun1.l.google.com:19302",
 			},
 			TURNServers:  []string{},
-			MaxBandwidth: 5000, // 5 Mbps
+			MaxBandwidth: 0, // 不限速
+			TrackersFile: "data/config/trackers.txt",
+			// 与webrtc.DefaultICEGatherTimeout一致
+			ICEGatherTimeoutSeconds: 10,
+			// 与webrtc.DefaultServePathPrefix一致
+			ServePathPrefix: "/video/",
+			// 与webrtc.DefaultBufferedHighWater一致
+			DataChannelHighWaterKB: 1024,
+			// 与webrtc.DefaultMaxProbes、webrtc.DefaultProbeBandwidth一致
+			MaxProbes:      2,
+			ProbeBandwidth: 100000,
+		},
+		Transcode: TranscodeConfig{
+			Strategies: []TranscodeStrategy{
+				{Name: "remux", VideoCodec: "auto", AudioCodec: "copy"},
+				{Name: "transcode", VideoCodec: "libx264", AudioCodec: "aac", Preset: "veryfast", CRF: 23},
+			},
+			MaxKeyframeGapSeconds: 15,
+			// 与downloader.DefaultStreamingReadahead一致
+			StreamingReadaheadMB: 64,
+			// 与transcoder.DefaultTextCharset一致
+			SubtitleCharset: "gb18030",
+			Thumbnails: ThumbnailConfig{
+				IntervalSeconds: 10,
+				Columns:         5,
+				Rows:            5,
+				Width:           160,
+			},
 		},
 	}
 }
@@ -148,6 +352,148 @@ func generateNodeID() string {
 	return hostname + "-" + uuid.New().String()[:8]
 }
 
+// Endpoints 返回按优先级排列的网关地址；未配置URLs时只有URL
+func (g GatewayConfig) Endpoints() []string {
+	if len(g.URLs) > 0 {
+		return g.URLs
+	}
+	return []string{g.URL}
+}
+
+// Validate 检查配置是否可用，返回所有发现的问题
+func (c *Config) Validate() error {
+	var problems []error
+
+	if c.Node.ID == "" {
+		problems = append(problems, errors.New("node.id is empty"))
+	}
+
+	for _, endpoint := range c.Gateway.Endpoints() {
+		if parsed, err := url.Parse(endpoint); err != nil || (parsed.Scheme != "ws" && parsed.Scheme != "wss") || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("gateway.url must be a ws:// or wss:// URL, got %q", endpoint))
+		}
+	}
+	if c.Gateway.HeartbeatPeriod < 0 {
+		problems = append(problems, errors.New("gateway.heartbeat_period must not be negative"))
+	}
+
+	if c.Storage.DownloadPath == "" {
+		problems = append(problems, errors.New("storage.download_path is empty"))
+	}
+	if c.Storage.M3U8Path == "" {
+		problems = append(problems, errors.New("storage.m3u8_path is empty"))
+	}
+	switch c.Storage.OutputLayout {
+	case "", OutputLayoutTaskID, OutputLayoutSourceName:
+	default:
+		problems = append(problems, fmt.Errorf("storage.output_layout must be %q or %q, got %q", OutputLayoutTaskID, OutputLayoutSourceName, c.Storage.OutputLayout))
+	}
+
+	if c.Limits.MaxDownloads <= 0 {
+		problems = append(problems, errors.New("limits.max_downloads must be positive"))
+	}
+	if c.Limits.MaxTranscodes <= 0 {
+		problems = append(problems, errors.New("limits.max_transcodes must be positive"))
+	}
+	if c.Limits.MaxRetries < 0 {
+		problems = append(problems, errors.New("limits.max_retries must not be negative"))
+	}
+	if c.Network.ICEGatherTimeoutSeconds < 0 {
+		problems = append(problems, errors.New("network.ice_gather_timeout_seconds must not be negative"))
+	}
+	if strings.ContainsAny(c.Network.ServePathPrefix, "?#\\") || strings.Contains(c.Network.ServePathPrefix, "..") {
+		problems = append(problems, errors.New("network.serve_path_prefix must be a plain path"))
+	}
+	if c.Network.DataChannelHighWaterKB < 0 {
+		problems = append(problems, errors.New("network.datachannel_high_water_kb must not be negative"))
+	}
+	if c.Network.MaxProbes < 0 || c.Network.ProbeBandwidth < 0 {
+		problems = append(problems, errors.New("network speed probe limits must not be negative"))
+	}
+	if c.Limits.MetadataTimeoutMinutes < 0 {
+		problems = append(problems, errors.New("limits.metadata_timeout_minutes must not be negative"))
+	}
+	if c.Limits.MinFreeDiskMB < 0 {
+		problems = append(problems, errors.New("limits.min_free_disk_mb must not be negative"))
+	}
+	if c.Limits.DiskReservePercent < 0 {
+		problems = append(problems, errors.New("limits.disk_reserve_percent must not be negative"))
+	}
+	switch c.Limits.DiskFullAction {
+	case "", DiskFullActionPause, DiskFullActionFail:
+	default:
+		problems = append(problems, fmt.Errorf("limits.disk_full_action must be %q or %q, got %q", DiskFullActionPause, DiskFullActionFail, c.Limits.DiskFullAction))
+	}
+
+	for i, strategy := range c.Transcode.Strategies {
+		if strategy.Name == "" || strategy.VideoCodec == "" {
+			problems = append(problems, fmt.Errorf("transcode.strategies[%d] needs a name and video_codec", i))
+		}
+	}
+	for i, rule := range c.Transcode.Rules {
+		if len(rule.Extensions) == 0 && len(rule.Codecs) == 0 {
+			problems = append(problems, fmt.Errorf("transcode.rules[%d] needs extensions or codecs", i))
+		}
+		if !c.Transcode.hasPreset(rule.Preset) {
+			problems = append(problems, fmt.Errorf("transcode.rules[%d] references unknown preset %q", i, rule.Preset))
+		}
+	}
+
+	if c.Transcode.MaxKeyframeGapSeconds < 0 {
+		problems = append(problems, errors.New("transcode.max_keyframe_gap_seconds must not be negative"))
+	}
+	if c.Transcode.StreamingReadaheadMB < 0 {
+		problems = append(problems, errors.New("transcode.streaming_readahead_mb must not be negative"))
+	}
+	if c.Transcode.SubtitleCharset != "" {
+		if _, err := htmlindex.Get(c.Transcode.SubtitleCharset); err != nil {
+			problems = append(problems, fmt.Errorf("transcode.subtitle_charset %q is not a known charset", c.Transcode.SubtitleCharset))
+		}
+	}
+	names := make(map[string]bool, len(c.Transcode.Renditions))
+	for i, rendition := range c.Transcode.Renditions {
+		if rendition.Name == "" || strings.ContainsAny(rendition.Name, `/\`) || rendition.Name == "." || rendition.Name == ".." || names[rendition.Name] {
+			problems = append(problems, fmt.Errorf("transcode.renditions[%d] needs a unique name usable as a directory", i))
+		}
+		names[rendition.Name] = true
+		if rendition.Width <= 0 || rendition.Height <= 0 || rendition.VideoBitrate == "" || rendition.AudioBitrate == "" {
+			problems = append(problems, fmt.Errorf("transcode.renditions[%d] needs a positive width and height and both bitrates", i))
+		}
+	}
+	if thumbs := c.Transcode.Thumbnails; thumbs.Enabled &&
+		(thumbs.IntervalSeconds <= 0 || thumbs.Columns <= 0 || thumbs.Rows <= 0 || thumbs.Width <= 0) {
+		problems = append(problems, errors.New("transcode.thumbnails needs positive interval_seconds, columns, rows and width when enabled"))
+	}
+
+	switch c.Network.TrackerPolicy.Mode {
+	case "", "allow_all", "denylist":
+	case "allowlist":
+		if len(c.Network.TrackerPolicy.Hosts) == 0 {
+			problems = append(problems, errors.New("network.tracker_policy.hosts must list at least one tracker host in allowlist mode"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("network.tracker_policy.mode must be allow_all, allowlist or denylist, got %q", c.Network.TrackerPolicy.Mode))
+	}
+
+	if c.Network.MaxBandwidth < 0 {
+		problems = append(problems, errors.New("network.max_bandwidth_kbps must not be negative"))
+	}
+	if c.Network.ServeBandwidth < 0 || c.Network.SessionBandwidth < 0 {
+		problems = append(problems, errors.New("network serving bandwidth limits must not be negative"))
+	}
+	if c.Network.ListenPort < 0 || c.Network.ListenPort > 65535 {
+		problems = append(problems, fmt.Errorf("network.listen_port out of range: %d", c.Network.ListenPort))
+	}
+
+	for i, raw := range c.QuietHours.Windows {
+		if _, err := ParseQuietWindow(raw); err != nil {
+			problems = append(problems, fmt.Errorf("quiet_hours.windows[%d]: %w", i, err))
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
 // GetStoragePaths 获取存储路径（确保目录存在）
 func (c *Config) GetStoragePaths() error {
 	paths := []string{
@@ -156,6 +502,9 @@ func (c *Config) GetStoragePaths() error {
 		"data/config",
 		"data/logs",
 	}
+	if c.Storage.TaskLogPath != "" {
+		paths = append(paths, c.Storage.TaskLogPath)
+	}
 
 	for _, path := range paths {
 		if err := os.MkdirAll(path, 0755); err != nil {
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QuietHoursConfig 静默时段配置
+type QuietHoursConfig struct {
+	// Windows 每天重复的本地时间段，如"23:00-07:00"，结束早于开始时跨越午夜
+	Windows []string `json:"windows,omitempty" desc:"Daily local time windows such as 23:00-07:00; a window ending before it starts spans midnight"`
+	// SuspendTranscodes 静默时段内同时用SIGSTOP暂停正在运行的ffmpeg，否则只推迟排队的转码；Windows上无效
+	SuspendTranscodes bool `json:"suspend_transcodes" desc:"Also pause running ffmpeg processes with SIGSTOP during quiet hours instead of only deferring queued transcodes; ignored on Windows"`
+}
+
+// QuietWindow 解析后的静默时段，Start与End为零点起的分钟数
+type QuietWindow struct {
+	Start int
+	End   int
+}
+
+// ParseQuietWindow 解析"HH:MM-HH:MM"形式的时段，开始与结束相同的时段无效
+func ParseQuietWindow(raw string) (QuietWindow, error) {
+	from, to, found := strings.Cut(strings.TrimSpace(raw), "-")
+	if !found {
+		return QuietWindow{}, fmt.Errorf("window %q must look like 23:00-07:00", raw)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return QuietWindow{}, fmt.Errorf("window %q: %w", raw, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return QuietWindow{}, fmt.Errorf("window %q: %w", raw, err)
+	}
+	if start == end {
+		return QuietWindow{}, fmt.Errorf("window %q is empty", raw)
+	}
+	return QuietWindow{Start: start, End: end}, nil
+}
+
+// parseClock 将"HH:MM"解析为零点起的分钟数
+func parseClock(raw string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", raw)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains 本地时间t是否落在时段内，包含开始、不包含结束
+func (w QuietWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+// ParsedWindows 解析后的静默时段，忽略无法解析的时段（由Validate报告）
+func (q QuietHoursConfig) ParsedWindows() []QuietWindow {
+	var windows []QuietWindow
+	for _, raw := range q.Windows {
+		if window, err := ParseQuietWindow(raw); err == nil {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaField 一个配置项的说明，供界面与部署工具渲染表单、校验配置文件
+type SchemaField struct {
+	Field       string      `json:"field"` // 以点分隔的JSON路径，数组元素的字段写作"strategies[].name"
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default"`
+	Flag        string      `json:"flag,omitempty"` // 可覆盖该项的命令行参数
+	Description string      `json:"description"`
+}
+
+// Schema 根据结构体标签生成配置说明，默认值取自Default()
+func Schema() []SchemaField {
+	return schemaFields("", reflect.TypeOf(Config{}), reflect.ValueOf(*Default()))
+}
+
+// schemaFields 递归展开结构体字段；value无效时（数组元素）不输出默认值
+func schemaFields(prefix string, t reflect.Type, value reflect.Value) []SchemaField {
+	var fields []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+		path := prefix + name
+
+		var fieldValue reflect.Value
+		if value.IsValid() {
+			fieldValue = value.Field(i)
+		}
+
+		switch {
+		case field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)):
+			fields = append(fields, schemaFields(path+".", field.Type, fieldValue)...)
+			continue
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			fields = append(fields, SchemaField{
+				Field:       path,
+				Type:        "array<object>",
+				Default:     defaultValue(field, fieldValue),
+				Description: field.Tag.Get("desc"),
+			})
+			fields = append(fields, schemaFields(path+"[].", field.Type.Elem(), reflect.Value{})...)
+			continue
+		}
+
+		fields = append(fields, SchemaField{
+			Field:       path,
+			Type:        schemaType(field.Type),
+			Default:     defaultValue(field, fieldValue),
+			Flag:        field.Tag.Get("flag"),
+			Description: field.Tag.Get("desc"),
+		})
+	}
+	return fields
+}
+
+func jsonName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func defaultValue(field reflect.StructField, value reflect.Value) interface{} {
+	if fixed, ok := field.Tag.Lookup("default"); ok {
+		return fixed
+	}
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array<" + schemaType(t.Elem()) + ">"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEveryConfigFieldHasDescription(t *testing.T) {
+	var check func(reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("desc") == "" {
+				t.Errorf("%s.%s has no desc tag", typ.Name(), field.Name)
+			}
+			elem := field.Type
+			if elem.Kind() == reflect.Slice {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Struct && elem != reflect.TypeOf(time.Duration(0)) {
+				check(elem)
+			}
+		}
+	}
+	check(reflect.TypeOf(Config{}))
+}
+
+func TestSchemaListsFieldsWithDefaults(t *testing.T) {
+	fields := make(map[string]SchemaField)
+	for _, field := range Schema() {
+		if field.Description == "" {
+			t.Errorf("schema field %s has no description", field.Field)
+		}
+		fields[field.Field] = field
+	}
+
+	port, ok := fields["network.listen_port"]
+	if !ok || port.Type != "integer" || port.Default != 0 {
+		t.Fatalf("unexpected listen_port entry: %+v", port)
+	}
+	if url := fields["gateway.url"]; url.Flag != "gateway" || url.Default != Default().Gateway.URL {
+		t.Fatalf("unexpected gateway.url entry: %+v", url)
+	}
+	if id := fields["node.id"]; id.Default != "<hostname>-<random>" {
+		t.Fatalf("expected generated node ID to be described, got %+v", id)
+	}
+	if delay := fields["gateway.reconnect_delay"]; delay.Type != "duration" {
+		t.Fatalf("expected duration type, got %+v", delay)
+	}
+	if codec, ok := fields["transcode.strategies[].video_codec"]; !ok || codec.Default != nil {
+		t.Fatalf("expected strategy item fields without defaults, got %+v", codec)
+	}
+}
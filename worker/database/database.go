@@ -1,9 +1,13 @@
 package database
 
 import (
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"worker/domain"
@@ -11,6 +15,7 @@ import (
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	_ "modernc.org/sqlite" // 使用纯Go SQLite实现
 )
@@ -24,14 +29,23 @@ var (
 type TaskRepository interface {
 	Create(task *models.Task) error
 	GetByTaskID(taskID string) (*models.Task, error)
+	FindByMagnetURL(magnetURL string) (*models.Task, error)
 	GetAll() ([]models.Task, error)
 	GetByWorkerID(workerID string) ([]models.Task, error)
 	GetByStatus(status domain.TaskStatus) ([]models.Task, error)
 	Update(task *models.Task) error
 	UpdateStatus(taskID string, status domain.TaskStatus) error
+	UpdateMetadata(taskID string, update func(metadata map[string]interface{})) error
+	UpdateOutputs(taskID string, update func(task *models.Task) error) error
+	UpdateFiles(taskID string, update func(task *models.Task) error) error
 	UpdateProgress(taskID string, progress int, speed int64, downloaded int64) error
+	UpdateProgressBatch(updates []ProgressUpdate) error
+	AddTraffic(taskID string, downloaded, served int64) error
+	SetPinned(taskID string, pinned bool) error
+	SetPriority(taskID string, priority int) error
 	Delete(taskID string) error
 	GetActiveTasksCount(workerID string) (int64, error)
+	GetNextPending(workerID string) (*models.Task, error)
 }
 
 // Initialize 初始化数据库
@@ -65,10 +79,16 @@ func Initialize(dataPath string) error {
 	}
 
 	// 自动迁移数据库表
-	err = DB.AutoMigrate(&models.Task{}, &models.WebRTCSession{})
+	err = DB.AutoMigrate(&models.Task{}, &models.WebRTCSession{}, &models.TaskMagnetHash{})
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %v", err)
 	}
+	if err := backfillMagnetIndex(DB); err != nil {
+		return fmt.Errorf("failed to index magnet URLs: %v", err)
+	}
+	if err := backfillFailedAt(DB); err != nil {
+		return fmt.Errorf("failed to backfill failure times: %v", err)
+	}
 
 	// 配置数据库连接池
 	sqlDBConn, err := DB.DB()
@@ -114,9 +134,80 @@ func NewTaskRepository() TaskRepository {
 
 var _ TaskRepository = (*gormTaskRepository)(nil)
 
-// Create 创建任务
+// Create 创建任务，并在同一事务中把磁力链接索引指向该任务
 func (r *gormTaskRepository) Create(task *models.Task) error {
-	return r.db.Create(task).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(task).Error; err != nil {
+			return err
+		}
+		return indexMagnet(tx, task.MagnetURL, task.TaskID)
+	})
+}
+
+// FindByMagnetURL 查找最近一次以该磁力链接（原文完全相同）创建的任务，
+// 没有时返回gorm.ErrRecordNotFound
+func (r *gormTaskRepository) FindByMagnetURL(magnetURL string) (*models.Task, error) {
+	var entry models.TaskMagnetHash
+	if err := r.db.Where("magnet_hash = ?", MagnetHash(magnetURL)).First(&entry).Error; err != nil {
+		return nil, err
+	}
+	return r.GetByTaskID(entry.TaskID)
+}
+
+// MagnetHash 磁力链接索引的键：磁力链接原文sha1的十六进制
+func MagnetHash(magnetURL string) string {
+	sum := sha1.Sum([]byte(magnetURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexMagnet 把磁力链接索引指向taskID
+func indexMagnet(tx *gorm.DB, magnetURL, taskID string) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "magnet_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"task_id"}),
+	}).Create(&models.TaskMagnetHash{MagnetHash: MagnetHash(magnetURL), TaskID: taskID}).Error
+}
+
+// backfillMagnetIndex 为索引建立之前创建的任务补充磁力链接索引，同一磁力链接指向最新的任务
+func backfillMagnetIndex(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.TaskMagnetHash{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	var tasks []models.Task
+	if err := db.Select("task_id", "magnet_url").Order("created_at ASC").Order("id ASC").Find(&tasks).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, task := range tasks {
+			if err := indexMagnet(tx, task.MagnetURL, task.TaskID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// failedStatuses 失败或已取消的状态，任务进入这些状态的时间记录在failed_at中
+var failedStatuses = []domain.TaskStatus{domain.TaskStatusError, domain.TaskStatusPermanentlyFailed, domain.TaskStatusCancelled}
+
+// backfillFailedAt 为failed_at列加入之前就已失败的任务补上时间，取其updated_at
+func backfillFailedAt(db *gorm.DB) error {
+	return db.Model(&models.Task{}).Where("failed_at IS NULL AND status IN (?)", failedStatuses).
+		UpdateColumn("failed_at", gorm.Expr("updated_at")).Error
+}
+
+// markFailedAt 任务进入失败或已取消状态时记下时间，离开这些状态时清空。已经记下的时间不变，
+// 之后保存元数据等其它修改不会推迟失败任务的清理
+func (r *gormTaskRepository) markFailedAt(taskID string, status domain.TaskStatus) error {
+	for _, failed := range failedStatuses {
+		if status == failed {
+			return r.db.Model(&models.Task{}).Where("task_id = ? AND failed_at IS NULL", taskID).
+				UpdateColumn("failed_at", time.Now()).Error
+		}
+	}
+	return r.db.Model(&models.Task{}).Where("task_id = ? AND failed_at IS NOT NULL", taskID).
+		UpdateColumn("failed_at", nil).Error
 }
 
 // GetByTaskID 根据TaskID获取任务
@@ -150,14 +241,92 @@ func (r *gormTaskRepository) GetByStatus(status domain.TaskStatus) ([]models.Tas
 	return tasks, err
 }
 
-// Update 更新任务
+// ownColumns 由专门的方法原子写入的列。Update整行保存时跳过这些列，
+// 调用方持有的旧任务对象不会覆盖期间累加的流量、置顶、优先级与失败时间
+var ownColumns = []string{"bytes_downloaded", "bytes_served", "pinned", "priority", "trace_id", "failed_at"}
+
+// Update 更新任务，不写入ownColumns中的列；按保存的状态记下或清空失败时间
 func (r *gormTaskRepository) Update(task *models.Task) error {
-	return r.db.Save(task).Error
+	if err := r.db.Omit(ownColumns...).Save(task).Error; err != nil {
+		return err
+	}
+	return r.markFailedAt(task.TaskID, task.Status)
 }
 
-// UpdateStatus 更新任务状态
+// UpdateStatus 更新任务状态，并按新状态记下或清空失败时间
 func (r *gormTaskRepository) UpdateStatus(taskID string, status domain.TaskStatus) error {
-	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).Update("status", status).Error
+	if err := r.db.Model(&models.Task{}).Where("task_id = ?", taskID).Update("status", status).Error; err != nil {
+		return err
+	}
+	return r.markFailedAt(taskID, status)
+}
+
+// metadataMu 串行化UpdateMetadata、UpdateOutputs与UpdateFiles的读改写，同一进程中对同一任务的修改不会互相覆盖
+var metadataMu sync.Mutex
+
+// UpdateMetadata 只读取并写回任务的metadata列，由update修改元数据。与Update保存整行不同，
+// 不会用调用方手中过期的任务对象覆盖其它列
+func (r *gormTaskRepository) UpdateMetadata(taskID string, update func(metadata map[string]interface{})) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	var task models.Task
+	if err := r.db.Select("id", "metadata").Where("task_id = ?", taskID).First(&task).Error; err != nil {
+		return err
+	}
+	metadata, err := task.GetMetadata()
+	if err != nil || metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	update(metadata)
+	if err := task.SetMetadata(metadata); err != nil {
+		return err
+	}
+	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumn("metadata", task.Metadata).Error
+}
+
+// UpdateOutputs 只读取并写回任务的转码产出（m3u8路径、多视频输出、字幕、分片与元数据），由update修改。
+// 下载仍在进行时（流式转码）也不会覆盖下载进度等其它列
+func (r *gormTaskRepository) UpdateOutputs(taskID string, update func(task *models.Task) error) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	var task models.Task
+	if err := r.db.Select("ID", "TaskID", "M3U8FilePath", "M3U8Outputs", "Srts", "Segments", "Metadata").Where("task_id = ?", taskID).First(&task).Error; err != nil {
+		return err
+	}
+	if err := update(&task); err != nil {
+		return err
+	}
+	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumns(map[string]interface{}{
+		"M3U8FilePath": task.M3U8FilePath,
+		"M3U8Outputs":  task.M3U8Outputs,
+		"Srts":         task.Srts,
+		"Segments":     task.Segments,
+		"Metadata":     task.Metadata,
+	}).Error
+}
+
+// UpdateFiles 只读取并写回任务的文件选择（文件列表、大小、进度与元数据），由update修改，
+// update可以读取任务状态但不能修改。下载协程同时写入的状态、速度与流量不会被覆盖
+func (r *gormTaskRepository) UpdateFiles(taskID string, update func(task *models.Task) error) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	var task models.Task
+	if err := r.db.Select("ID", "TaskID", "Status", "TorrentFiles", "Size", "Downloaded", "Progress", "Metadata").Where("task_id = ?", taskID).First(&task).Error; err != nil {
+		return err
+	}
+	if err := update(&task); err != nil {
+		return err
+	}
+	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumns(map[string]interface{}{
+		"TorrentFiles": task.TorrentFiles,
+		"Size":         task.Size,
+		"Downloaded":   task.Downloaded,
+		"Progress":     task.Progress,
+		"Metadata":     task.Metadata,
+	}).Error
 }
 
 // UpdateProgress 更新任务进度
@@ -171,9 +340,86 @@ func (r *gormTaskRepository) UpdateProgress(taskID string, progress int, speed i
 	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).Updates(updates).Error
 }
 
-// Delete 删除任务
+// UpdateProgressBatch 在一个事务中写入多个任务的进度
+func (r *gormTaskRepository) UpdateProgressBatch(updates []ProgressUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, update := range updates {
+			values := map[string]interface{}{
+				"progress":         update.Progress,
+				"speed":            update.Speed,
+				"downloaded":       update.Downloaded,
+				"last_update_time": update.UpdatedAt,
+			}
+			if err := tx.Model(&models.Task{}).Where("task_id = ?", update.TaskID).Updates(values).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddTraffic 累加任务的下载/服务流量
+func (r *gormTaskRepository) AddTraffic(taskID string, downloaded, served int64) error {
+	updates := map[string]interface{}{
+		"bytes_downloaded": gorm.Expr("bytes_downloaded + ?", downloaded),
+		"bytes_served":     gorm.Expr("bytes_served + ?", served),
+	}
+	return r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumns(updates).Error
+}
+
+// SetPinned 设置任务是否置顶
+func (r *gormTaskRepository) SetPinned(taskID string, pinned bool) error {
+	result := r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumn("pinned", pinned)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	return nil
+}
+
+// SetPriority 设置任务的下载优先级
+func (r *gormTaskRepository) SetPriority(taskID string, priority int) error {
+	result := r.db.Model(&models.Task{}).Where("task_id = ?", taskID).UpdateColumn("priority", priority)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	return nil
+}
+
+// Delete 删除任务，并在同一事务中删除指向它的磁力链接索引。
+// 同一磁力链接还有其它任务时，索引改为指向其中最新的一个
 func (r *gormTaskRepository) Delete(taskID string) error {
-	return r.db.Where("task_id = ?", taskID).Delete(&models.Task{}).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var task models.Task
+		found := tx.Where("task_id = ?", taskID).First(&task).Error == nil
+		if err := tx.Where("task_id = ?", taskID).Delete(&models.Task{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ?", taskID).Delete(&models.TaskMagnetHash{}).Error; err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+
+		var latest models.Task
+		err := tx.Where("magnet_url = ?", task.MagnetURL).Order("created_at DESC").Order("id DESC").First(&latest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return indexMagnet(tx, latest.MagnetURL, latest.TaskID)
+	})
 }
 
 // GetActiveTasksCount 获取活跃任务数量
@@ -191,6 +437,19 @@ func (r *gormTaskRepository) GetActiveTasksCount(workerID string) (int64, error)
 	return count, err
 }
 
+// GetNextPending 获取节点下一个应开始的等待中任务：优先级高的在前，同优先级先提交的在前。
+// 没有等待中的任务时返回gorm.ErrRecordNotFound
+func (r *gormTaskRepository) GetNextPending(workerID string) (*models.Task, error) {
+	var task models.Task
+	err := r.db.Where("worker_id = ? AND status = ?", workerID, domain.TaskStatusPending).
+		Order("priority DESC").Order("created_at ASC").Order("id ASC").
+		First(&task).Error
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
 // WebRTCSessionRepository WebRTC会话数据仓库
 type WebRTCSessionRepository struct {
 	db *gorm.DB
@@ -1,11 +1,16 @@
 package database
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"worker/domain"
 	"worker/models"
+
+	"gorm.io/gorm"
 )
 
 func TestTaskRepositoryCRUD(t *testing.T) {
@@ -65,3 +70,349 @@ func TestTaskRepositoryCRUD(t *testing.T) {
 		t.Fatalf("expected error fetching deleted task")
 	}
 }
+
+func TestUpdateMetadataWritesOnlyMetadata(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		Close()
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	task := &models.Task{TaskID: "task_1", MagnetURL: "magnet:?xt=urn:btih:dummy", WorkerID: "worker-1"}
+	task.SetMetadata(map[string]interface{}{"interactive": true})
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	if err := repo.UpdateProgress(task.TaskID, 50, 1024, 2048); err != nil {
+		t.Fatalf("update progress: %v", err)
+	}
+
+	if err := repo.UpdateMetadata(task.TaskID, func(metadata map[string]interface{}) {
+		metadata["stream_token"] = "token"
+	}); err != nil {
+		t.Fatalf("update metadata: %v", err)
+	}
+	stored, err := repo.GetByTaskID(task.TaskID)
+	if err != nil {
+		t.Fatalf("get task: %v", err)
+	}
+	metadata, _ := stored.GetMetadata()
+	if metadata["stream_token"] != "token" || metadata["interactive"] != true || stored.Progress != 50 {
+		t.Fatalf("expected the metadata to be merged and progress kept, got %v, progress %d", metadata, stored.Progress)
+	}
+
+	if err := repo.UpdateMetadata("missing", func(map[string]interface{}) {}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected a missing task to be reported, got %v", err)
+	}
+}
+
+func TestUpdateOutputsKeepsDownloadColumns(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		Close()
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	task := &models.Task{TaskID: "task_1", MagnetURL: "magnet:?xt=urn:btih:dummy", WorkerID: "worker-1"}
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	// 流式转码期间下载仍在写入进度
+	if err := repo.UpdateProgress(task.TaskID, 60, 1024, 4096); err != nil {
+		t.Fatalf("update progress: %v", err)
+	}
+
+	if err := repo.UpdateOutputs(task.TaskID, func(task *models.Task) error {
+		task.M3U8FilePath = "/m3u8/task_1/index.m3u8"
+		if err := task.SetSegments([]string{"index0.ts"}); err != nil {
+			return err
+		}
+		return task.SetMetadata(map[string]interface{}{"segment_count": 1})
+	}); err != nil {
+		t.Fatalf("update outputs: %v", err)
+	}
+	stored, err := repo.GetByTaskID(task.TaskID)
+	if err != nil {
+		t.Fatalf("get task: %v", err)
+	}
+	segments, _ := stored.GetSegments()
+	if stored.M3U8FilePath != "/m3u8/task_1/index.m3u8" || len(segments) != 1 || stored.Progress != 60 || stored.Downloaded != 4096 {
+		t.Fatalf("expected the outputs to be written and the progress kept, got %+v", stored)
+	}
+}
+
+func TestUpdateKeepsAtomicallyWrittenColumns(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		Close()
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	task := &models.Task{TaskID: "task_1", MagnetURL: "magnet:?xt=urn:btih:dummy", WorkerID: "worker-1", Priority: 5, TraceID: "trace-1"}
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	stale, err := repo.GetByTaskID(task.TaskID)
+	if err != nil {
+		t.Fatalf("get task: %v", err)
+	}
+
+	// 持有旧对象期间流量累加、任务被置顶并调整优先级
+	if err := repo.AddTraffic(task.TaskID, 100, 200); err != nil {
+		t.Fatalf("add traffic: %v", err)
+	}
+	if err := repo.SetPinned(task.TaskID, true); err != nil {
+		t.Fatalf("pin task: %v", err)
+	}
+	if err := repo.SetPriority(task.TaskID, 9); err != nil {
+		t.Fatalf("set priority: %v", err)
+	}
+
+	stale.Progress = 50
+	stale.TraceID = ""
+	if err := repo.Update(stale); err != nil {
+		t.Fatalf("update task: %v", err)
+	}
+	stored, err := repo.GetByTaskID(task.TaskID)
+	if err != nil {
+		t.Fatalf("get task: %v", err)
+	}
+	if stored.Progress != 50 {
+		t.Fatalf("expected the update to be written, got progress %d", stored.Progress)
+	}
+	if stored.BytesDownloaded != 100 || stored.BytesServed != 200 || !stored.Pinned || stored.Priority != 9 || stored.TraceID != "trace-1" {
+		t.Fatalf("expected a stale save to keep counters, pin, priority and trace, got %+v", stored)
+	}
+}
+
+func TestFailedAtRecordsWhenTaskFailed(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		Close()
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	task := &models.Task{TaskID: "task_1", MagnetURL: "magnet:?xt=urn:btih:dummy", WorkerID: "worker-1"}
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	failedAt := func() *time.Time {
+		stored, err := repo.GetByTaskID(task.TaskID)
+		if err != nil {
+			t.Fatalf("get task: %v", err)
+		}
+		return stored.FailedAt
+	}
+
+	task.Status = domain.TaskStatusError
+	if err := repo.Update(task); err != nil {
+		t.Fatalf("update task: %v", err)
+	}
+	first := failedAt()
+	if first == nil {
+		t.Fatalf("expected failed_at to be set when the task failed")
+	}
+
+	// 失败后再保存其它列、改为永久失败都不改变失败时间，旧对象也不会清空它
+	time.Sleep(10 * time.Millisecond)
+	task.Progress = 10
+	task.FailedAt = nil
+	if err := repo.Update(task); err != nil {
+		t.Fatalf("update task: %v", err)
+	}
+	if err := repo.UpdateStatus(task.TaskID, domain.TaskStatusPermanentlyFailed); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+	if again := failedAt(); again == nil || !again.Equal(*first) {
+		t.Fatalf("expected later saves to keep failed_at %v, got %v", first, again)
+	}
+
+	// 重试后清空
+	if err := repo.UpdateStatus(task.TaskID, domain.TaskStatusPending); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+	if cleared := failedAt(); cleared != nil {
+		t.Fatalf("expected failed_at to be cleared on retry, got %v", cleared)
+	}
+}
+
+func TestGetNextPendingOrdersByPriorityThenAge(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Fatalf("close database: %v", err)
+		}
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	base := time.Now()
+	for _, task := range []*models.Task{
+		{TaskID: "old-low", Priority: 2, CreatedAt: base},
+		{TaskID: "old-high", Priority: 8, CreatedAt: base.Add(time.Second)},
+		{TaskID: "new-high", Priority: 8, CreatedAt: base.Add(2 * time.Second)},
+		{TaskID: "running", Priority: 10, CreatedAt: base, Status: domain.TaskStatusDownloading},
+		{TaskID: "other-worker", Priority: 10, CreatedAt: base, WorkerID: "worker-2"},
+	} {
+		task.MagnetURL = "magnet:?xt=urn:btih:" + task.TaskID
+		if task.WorkerID == "" {
+			task.WorkerID = "worker-1"
+		}
+		if task.Status == "" {
+			task.Status = domain.TaskStatusPending
+		}
+		if err := repo.Create(task); err != nil {
+			t.Fatalf("create task %s: %v", task.TaskID, err)
+		}
+	}
+
+	for _, want := range []string{"old-high", "new-high", "old-low"} {
+		next, err := repo.GetNextPending("worker-1")
+		if err != nil {
+			t.Fatalf("get next pending: %v", err)
+		}
+		if next.TaskID != want {
+			t.Fatalf("expected %s next, got %s", want, next.TaskID)
+		}
+		if err := repo.UpdateStatus(next.TaskID, domain.TaskStatusDownloading); err != nil {
+			t.Fatalf("update status: %v", err)
+		}
+	}
+	if _, err := repo.GetNextPending("worker-1"); err == nil {
+		t.Fatalf("expected no pending task to be left")
+	}
+}
+
+func TestSetPriorityWritesOnlyPriority(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Fatalf("close database: %v", err)
+		}
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	task := &models.Task{TaskID: "task_1", MagnetURL: "magnet:?xt=urn:btih:dummy", WorkerID: "worker-1", Priority: 5, Status: domain.TaskStatusPending}
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	if err := repo.UpdateStatus(task.TaskID, domain.TaskStatusDownloading); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+
+	if err := repo.SetPriority(task.TaskID, 3); err != nil {
+		t.Fatalf("set priority: %v", err)
+	}
+	stored, _ := repo.GetByTaskID(task.TaskID)
+	if stored.Priority != 3 || stored.Status != domain.TaskStatusDownloading {
+		t.Fatalf("expected only the priority to change, got priority %d status %s", stored.Priority, stored.Status)
+	}
+	if err := repo.SetPriority("missing", 3); err == nil {
+		t.Fatalf("expected setting the priority of a missing task to fail")
+	}
+}
+
+func TestMagnetIndexUnderConcurrentWrites(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Fatalf("close database: %v", err)
+		}
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	const writers, perWriter = 8, 10
+	const shared = "magnet:?xt=urn:btih:shared"
+	base := time.Now()
+
+	// 每个写入者创建各自的任务，另外都提交一次同一磁力链接，再删除其中一个自己的任务
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				task := &models.Task{
+					TaskID:    fmt.Sprintf("task-%d-%d", w, i),
+					MagnetURL: fmt.Sprintf("magnet:?xt=urn:btih:%d-%d", w, i),
+					CreatedAt: base,
+				}
+				if err := repo.Create(task); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := repo.Create(&models.Task{TaskID: fmt.Sprintf("shared-%d", w), MagnetURL: shared, CreatedAt: base.Add(time.Duration(w) * time.Second)}); err != nil {
+				errs <- err
+				return
+			}
+			if err := repo.Delete(fmt.Sprintf("task-%d-0", w)); err != nil {
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent write: %v", err)
+	}
+
+	for w := 0; w < writers; w++ {
+		if _, err := repo.FindByMagnetURL(fmt.Sprintf("magnet:?xt=urn:btih:%d-0", w)); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("expected the deleted task's magnet to be unindexed, got %v", err)
+		}
+		for i := 1; i < perWriter; i++ {
+			task, err := repo.FindByMagnetURL(fmt.Sprintf("magnet:?xt=urn:btih:%d-%d", w, i))
+			if err != nil || task.TaskID != fmt.Sprintf("task-%d-%d", w, i) {
+				t.Fatalf("expected task-%d-%d, got %v (%v)", w, i, task, err)
+			}
+		}
+	}
+	var entries int64
+	DB.Model(&models.TaskMagnetHash{}).Count(&entries)
+	if entries != writers*(perWriter-1)+1 {
+		t.Fatalf("expected one index entry per live magnet, got %d", entries)
+	}
+
+	// 同一磁力链接的索引指向一个存在的任务；删除后改为指向剩余任务中最新的一个
+	current, err := repo.FindByMagnetURL(shared)
+	if err != nil || current.MagnetURL != shared {
+		t.Fatalf("expected a task for the shared magnet, got %v (%v)", current, err)
+	}
+	for w := writers - 1; w >= 0; w-- {
+		if err := repo.Delete(fmt.Sprintf("shared-%d", w)); err != nil {
+			t.Fatalf("delete shared task: %v", err)
+		}
+		next, err := repo.FindByMagnetURL(shared)
+		if w == 0 {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				t.Fatalf("expected no task once every shared task is deleted, got %v (%v)", next, err)
+			}
+			break
+		}
+		if err != nil || next.TaskID != fmt.Sprintf("shared-%d", w-1) {
+			t.Fatalf("expected shared-%d after deleting shared-%d, got %v (%v)", w-1, w, next, err)
+		}
+	}
+}
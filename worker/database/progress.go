@@ -0,0 +1,134 @@
+package database
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProgressUpdate 一个任务待写入的进度
+type ProgressUpdate struct {
+	TaskID     string
+	Progress   int
+	Speed      int64
+	Downloaded int64
+	UpdatedAt  time.Time
+}
+
+// ProgressBatcher 在内存中合并各任务的进度更新，定期在一个事务中批量写入。
+// SQLite同一时间只允许一个写事务，每个任务每次采样单独写库时，多个下载会互相排队，
+// 进度写入越积越慢。状态变更仍由调用方直接写库，不经过这里。
+type ProgressBatcher struct {
+	repo TaskRepository
+	now  func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]ProgressUpdate
+	running bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewProgressBatcher 创建进度批量写入器，调用Start后开始定期写入
+func NewProgressBatcher(repo TaskRepository) *ProgressBatcher {
+	return &ProgressBatcher{
+		repo:    repo,
+		now:     time.Now,
+		pending: make(map[string]ProgressUpdate),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Record 记录任务的最新进度，同一任务在两次写入之间只保留最后一次
+func (b *ProgressBatcher) Record(taskID string, progress int, speed int64, downloaded int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[taskID] = ProgressUpdate{
+		TaskID:     taskID,
+		Progress:   progress,
+		Speed:      speed,
+		Downloaded: downloaded,
+		UpdatedAt:  b.now(),
+	}
+}
+
+// Forget 丢弃任务尚未写入的进度，用于任务已整体保存或被删除时
+func (b *ProgressBatcher) Forget(taskID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, taskID)
+}
+
+// FlushNow 立即把所有待写入的进度写入数据库。写入失败时保留未写入的进度，下次重试
+func (b *ProgressBatcher) FlushNow() error {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	updates := make([]ProgressUpdate, 0, len(b.pending))
+	for _, update := range b.pending {
+		updates = append(updates, update)
+	}
+	b.pending = make(map[string]ProgressUpdate)
+	b.mu.Unlock()
+
+	sort.Slice(updates, func(i, j int) bool { return updates[i].TaskID < updates[j].TaskID })
+	if err := b.repo.UpdateProgressBatch(updates); err != nil {
+		b.mu.Lock()
+		for _, update := range updates {
+			// 写入期间又有新的进度时以新的为准
+			if _, newer := b.pending[update.TaskID]; !newer {
+				b.pending[update.TaskID] = update
+			}
+		}
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Start 每隔interval写入一次待写入的进度，直到Stop
+func (b *ProgressBatcher) Start(interval time.Duration) {
+	b.mu.Lock()
+	if b.running {
+		b.mu.Unlock()
+		return
+	}
+	b.running = true
+	b.mu.Unlock()
+
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.FlushNow(); err != nil {
+					log.Printf("Failed to flush task progress: %v", err)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止定期写入并写入剩余的进度，用于优雅退出
+func (b *ProgressBatcher) Stop() error {
+	b.mu.Lock()
+	running := b.running
+	b.running = false
+	b.mu.Unlock()
+
+	if running {
+		close(b.stop)
+		<-b.done
+	}
+	return b.FlushNow()
+}
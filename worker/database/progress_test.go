@@ -0,0 +1,111 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"worker/models"
+)
+
+// countingRepository 统计写库次数，每次调用对应一个写事务
+type countingRepository struct {
+	TaskRepository
+	writes  int
+	batches [][]ProgressUpdate
+}
+
+func (r *countingRepository) UpdateProgress(string, int, int64, int64) error {
+	r.writes++
+	return nil
+}
+
+func (r *countingRepository) UpdateProgressBatch(updates []ProgressUpdate) error {
+	r.writes++
+	r.batches = append(r.batches, updates)
+	return nil
+}
+
+func TestProgressBatcherCoalescesWrites(t *testing.T) {
+	const tasks, ticks = 5, 3
+	taskIDs := []string{"task-1", "task-2", "task-3", "task-4", "task-5"}
+
+	// 逐次写库：每个任务每次采样一个写事务
+	direct := &countingRepository{}
+	for tick := 1; tick <= ticks; tick++ {
+		for _, taskID := range taskIDs {
+			direct.UpdateProgress(taskID, tick*10, 100, int64(tick*1000))
+		}
+	}
+	if direct.writes != tasks*ticks {
+		t.Fatalf("expected %d direct writes, got %d", tasks*ticks, direct.writes)
+	}
+
+	// 批量写库：同一周期内的采样合并为一个写事务
+	batched := &countingRepository{}
+	batcher := NewProgressBatcher(batched)
+	for tick := 1; tick <= ticks; tick++ {
+		for _, taskID := range taskIDs {
+			batcher.Record(taskID, tick*10, 100, int64(tick*1000))
+		}
+	}
+	batcher.Forget("task-5")
+	if err := batcher.FlushNow(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if batched.writes != 1 {
+		t.Fatalf("expected a single batched write, got %d", batched.writes)
+	}
+	updates := batched.batches[0]
+	if len(updates) != tasks-1 {
+		t.Fatalf("expected %d updates without the forgotten task, got %d", tasks-1, len(updates))
+	}
+	for i, update := range updates {
+		if update.TaskID != taskIDs[i] || update.Progress != ticks*10 || update.Downloaded != int64(ticks*1000) {
+			t.Fatalf("expected latest progress for %s, got %+v", taskIDs[i], update)
+		}
+	}
+
+	// 没有新的采样时不写库
+	if err := batcher.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if batched.writes != 1 {
+		t.Fatalf("expected no write without pending progress, got %d writes", batched.writes)
+	}
+}
+
+func TestUpdateProgressBatchWritesAllTasks(t *testing.T) {
+	if err := Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		Close()
+		DB = nil
+	})
+
+	repo := NewTaskRepository()
+	for _, taskID := range []string{"task-1", "task-2"} {
+		if err := repo.Create(&models.Task{TaskID: taskID, WorkerID: "worker-1"}); err != nil {
+			t.Fatalf("create %s: %v", taskID, err)
+		}
+	}
+
+	now := time.Now()
+	err := repo.UpdateProgressBatch([]ProgressUpdate{
+		{TaskID: "task-1", Progress: 40, Speed: 10, Downloaded: 400, UpdatedAt: now},
+		{TaskID: "task-2", Progress: 70, Speed: 20, Downloaded: 700, UpdatedAt: now},
+	})
+	if err != nil {
+		t.Fatalf("update progress batch: %v", err)
+	}
+
+	for taskID, want := range map[string]int64{"task-1": 400, "task-2": 700} {
+		task, err := repo.GetByTaskID(taskID)
+		if err != nil {
+			t.Fatalf("get %s: %v", taskID, err)
+		}
+		if task.Downloaded != want {
+			t.Fatalf("expected %s to have %d bytes, got %d", taskID, want, task.Downloaded)
+		}
+	}
+}
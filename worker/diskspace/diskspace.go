@@ -0,0 +1,12 @@
+// Package diskspace 查询文件系统可用空间
+package diskspace
+
+import "errors"
+
+// ErrUnsupported 当前平台无法查询可用空间
+var ErrUnsupported = errors.New("disk space query not supported on this platform")
+
+// Available 返回path所在文件系统对当前用户可用的字节数
+func Available(path string) (uint64, error) {
+	return available(path)
+}
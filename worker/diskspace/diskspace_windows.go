@@ -0,0 +1,7 @@
+//go:build windows
+
+package diskspace
+
+func available(string) (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,94 @@
+package domain
+
+import "errors"
+
+// ErrorCode classifies why a task failed. It is stored with the task and sent
+// to the gateway as error_code so clients can tell a transient failure from
+// one that retrying cannot fix.
+type ErrorCode string
+
+const (
+	// ErrorCodeMagnetInvalid: the magnet link cannot be parsed or uses a
+	// disallowed tracker.
+	ErrorCodeMagnetInvalid ErrorCode = "magnet_invalid"
+	// ErrorCodeMetadataTimeout: no peer delivered the torrent metadata in time.
+	ErrorCodeMetadataTimeout ErrorCode = "metadata_timeout"
+	// ErrorCodeInsufficientDisk: the download directory cannot hold the
+	// selected files.
+	ErrorCodeInsufficientDisk ErrorCode = "insufficient_disk"
+	// ErrorCodeTorrentRejected: the metadata exceeds the configured limits,
+	// the file selection is invalid or a private torrent was not confirmed.
+	ErrorCodeTorrentRejected ErrorCode = "torrent_rejected"
+	// ErrorCodePolicyBlocked: the gateway's content policy blocked the task.
+	ErrorCodePolicyBlocked ErrorCode = "policy_blocked"
+	// ErrorCodeTranscodeFailed: every transcode strategy failed.
+	ErrorCodeTranscodeFailed ErrorCode = "transcode_failed"
+	// ErrorCodeInternal: an unexpected failure such as a panic in the
+	// download loop.
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// Retryable reports whether an automatic retry may succeed. Invalid magnets,
+// rejected torrents, policy blocks and a full disk need a change by the user
+// or operator first; such tasks are only retried manually.
+func (c ErrorCode) Retryable() bool {
+	switch c {
+	case ErrorCodeMetadataTimeout, ErrorCodeTranscodeFailed, ErrorCodeInternal:
+		return true
+	default:
+		return false
+	}
+}
+
+// DownloadError is a task failure with its classification. Err carries the
+// human readable reason that is stored in the task metadata as error.
+type DownloadError struct {
+	Code ErrorCode
+	Err  error
+}
+
+// Sentinel errors for errors.Is; any DownloadError with the same code matches.
+var (
+	ErrMagnetInvalid    = &DownloadError{Code: ErrorCodeMagnetInvalid, Err: errors.New("invalid magnet link")}
+	ErrMetadataTimeout  = &DownloadError{Code: ErrorCodeMetadataTimeout, Err: errors.New("timed out waiting for torrent metadata")}
+	ErrInsufficientDisk = &DownloadError{Code: ErrorCodeInsufficientDisk, Err: errors.New("insufficient disk space")}
+	ErrTorrentRejected  = &DownloadError{Code: ErrorCodeTorrentRejected, Err: errors.New("torrent rejected")}
+	ErrPolicyBlocked    = &DownloadError{Code: ErrorCodePolicyBlocked, Err: errors.New("blocked by policy")}
+)
+
+// NewDownloadError wraps err with code.
+func NewDownloadError(code ErrorCode, err error) *DownloadError {
+	return &DownloadError{Code: code, Err: err}
+}
+
+func (e *DownloadError) Error() string {
+	if e.Err == nil {
+		return string(e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *DownloadError) Unwrap() error { return e.Err }
+
+// Is matches any DownloadError with the same code.
+func (e *DownloadError) Is(target error) bool {
+	t, ok := target.(*DownloadError)
+	return ok && t.Code == e.Code
+}
+
+// Retryable reports whether the failure may go away on an automatic retry.
+func (e *DownloadError) Retryable() bool { return e.Code.Retryable() }
+
+// ClassifyDownloadError returns err as a DownloadError. Errors wrapping a
+// DownloadError keep its code and their full message; errors that carry no
+// code are classified as fallback.
+func ClassifyDownloadError(err error, fallback ErrorCode) *DownloadError {
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		if downloadErr == err {
+			return downloadErr
+		}
+		return NewDownloadError(downloadErr.Code, err)
+	}
+	return NewDownloadError(fallback, err)
+}
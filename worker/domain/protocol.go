@@ -0,0 +1,123 @@
+package domain
+
+// ProtocolVersion is the gateway protocol version implemented by this worker.
+// MinProtocolVersion is the oldest version it can still talk to.
+//
+// Version history:
+//
+//	1: registration, tasks, WebRTC signalling and heartbeats.
+//	2: task logs, policy checks, completion summaries, pruning, traffic
+//	   reports, piece maps, pinning, retention sweeps and local media.
+//	3: task submissions carrying a request_id are acknowledged with
+//	   task_submit_response, including resubmissions of existing tasks.
+//	4: manual retries of failed tasks via task_retry.
+//	5: re-sending the local ICE candidates of a session via ice_resend.
+//	6: ranged reads of task output files via file_fetch, for the gateway's
+//	   HTTP passthrough.
+//	7: changing the priority of a queued download via set_priority.
+//	8: closing the sessions of disconnected clients via close_session.
+//	9: moving a task with waiting viewers to the front of the transcode
+//	   queue via boost_task.
+//	10: verifying and regenerating a single segment via repair_segment.
+//	11: transport statistics of a WebRTC session via get_session_stats.
+//	12: pausing, resuming and removing tasks via task_pause, task_resume
+//	    and task_remove.
+//	13: download and transcode queue contents via get_queues.
+//	14: entering and leaving quiet mode on request via pause_all and
+//	    resume_all.
+//	15: reporting WebRTC offers that cannot connect via webrtc_offer_failed.
+//	16: fetching a torrent's file list without downloading via
+//	    get_torrent_info.
+//	17: answering the gateway clock in registration_confirmed with
+//	    clock_sync, for measuring clock skew.
+//	18: per-task segment access statistics via get_task_access.
+//	19: speed probe sessions via webrtc_probe, reported with probe_result.
+//	20: changing the files a download fetches via select_files.
+//	21: per-task stream tokens via get_stream_token; file_fetch checks the
+//	    stream_token it carries and reads files in rendition directories.
+//	22: task_remove honours purge_files=false and keeps the task's files.
+//	23: changing the torrent download and upload rate limits via
+//	    set_rate_limit; srts in tasks_response and task_detail_response
+//	    lists {path, language, index, format} objects instead of paths.
+//	24: task_submit carries sequential, overriding transcode.streaming_mode
+//	    for the task.
+const (
+	ProtocolVersion    = 24
+	MinProtocolVersion = 1
+)
+
+// LegacyProtocolVersion is assumed for peers that do not announce a version.
+const LegacyProtocolVersion = 1
+
+// messageVersions lists message types introduced after protocol version 1.
+var messageVersions = map[MessageType]int{
+	MessageTypeGetTaskLog:             2,
+	MessageTypeTaskLogResponse:        2,
+	MessageTypeTaskPolicyCheck:        2,
+	MessageTypeTaskPolicyVerdict:      2,
+	MessageTypeTaskCompleted:          2,
+	MessageTypePruneTaskData:          2,
+	MessageTypePruneTaskDataResponse:  2,
+	MessageTypeTaskTraffic:            2,
+	MessageTypeGetTaskPieces:          2,
+	MessageTypeTaskPiecesResponse:     2,
+	MessageTypeTaskRemoved:            2,
+	MessageTypeTaskPin:                2,
+	MessageTypeTaskPinResponse:        2,
+	MessageTypeListLocalMedia:         2,
+	MessageTypeLocalMediaList:         2,
+	MessageTypeTranscodeLocal:         2,
+	MessageTypeTranscodeLocalResponse: 2,
+	MessageTypeTaskSubmitResponse:     3,
+	MessageTypeTaskRetry:              4,
+	MessageTypeTaskRetryResponse:      4,
+	MessageTypeICEResend:              5,
+	MessageTypeICEResendResponse:      5,
+	MessageTypeFileFetch:              6,
+	MessageTypeFileFetchResponse:      6,
+	MessageTypeSetPriority:            7,
+	MessageTypeSetPriorityResponse:    7,
+	MessageTypeCloseSession:           8,
+	MessageTypeBoostTask:              9,
+	MessageTypeBoostTaskResponse:      9,
+	MessageTypeRepairSegment:          10,
+	MessageTypeRepairSegmentResponse:  10,
+	MessageTypeGetSessionStats:        11,
+	MessageTypeSessionStatsResponse:   11,
+	MessageTypeTaskPause:              12,
+	MessageTypeTaskPauseResponse:      12,
+	MessageTypeTaskResume:             12,
+	MessageTypeTaskResumeResponse:     12,
+	MessageTypeTaskRemove:             12,
+	MessageTypeTaskRemoveResponse:     12,
+	MessageTypeGetQueues:              13,
+	MessageTypeQueuesResponse:         13,
+	MessageTypePauseAll:               14,
+	MessageTypePauseAllResponse:       14,
+	MessageTypeResumeAll:              14,
+	MessageTypeResumeAllResponse:      14,
+	MessageTypeWebRTCOfferFailed:      15,
+	MessageTypeGetTorrentInfo:         16,
+	MessageTypeTorrentInfoResponse:    16,
+	MessageTypeClockSync:              17,
+	MessageTypeGetTaskAccess:          18,
+	MessageTypeTaskAccessResponse:     18,
+	MessageTypeWebRTCProbe:            19,
+	MessageTypeProbeResult:            19,
+	MessageTypeSelectFiles:            20,
+	MessageTypeSelectFilesResponse:    20,
+	MessageTypeGetStreamToken:         21,
+	MessageTypeStreamTokenResponse:    21,
+	MessageTypeSetRateLimit:           23,
+	MessageTypeSetRateLimitResponse:   23,
+}
+
+// MessageSupported reports whether msgType may be exchanged under the
+// negotiated protocol version.
+func MessageSupported(negotiated int, msgType MessageType) bool {
+	required, ok := messageVersions[msgType]
+	if !ok {
+		required = LegacyProtocolVersion
+	}
+	return negotiated >= required
+}
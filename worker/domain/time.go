@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the format of every timestamp the worker sends to the
+// gateway: RFC3339 in UTC with second precision, e.g. "2024-05-01T12:30:00Z".
+const TimeLayout = time.RFC3339
+
+// FormatTime renders t in TimeLayout, or "" for the zero time.
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(TimeLayout)
+}
+
+// ParseTime accepts RFC3339 strings (with or without fractional seconds or
+// offsets) and legacy Unix seconds, as numbers or numeric strings.
+func ParseTime(v interface{}) (time.Time, bool) {
+	switch value := v.(type) {
+	case time.Time:
+		return value, !value.IsZero()
+	case float64:
+		return unixTime(value)
+	case int64:
+		return unixTime(float64(value))
+	case int:
+		return unixTime(float64(value))
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return unixTime(f)
+	case string:
+		s := strings.TrimSpace(value)
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return unixTime(f)
+		}
+	}
+	return time.Time{}, false
+}
+
+// NormalizeTime rewrites a decoded timestamp value in TimeLayout and returns
+// values that are not timestamps unchanged.
+func NormalizeTime(v interface{}) interface{} {
+	if t, ok := ParseTime(v); ok {
+		return FormatTime(t)
+	}
+	return v
+}
+
+func unixTime(seconds float64) (time.Time, bool) {
+	if seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC(), true
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFormatTimeIsRFC3339UTCSeconds(t *testing.T) {
+	local := time.Date(2024, 5, 1, 20, 30, 15, 500000000, time.FixedZone("CST", 8*3600))
+	if got := FormatTime(local); got != "2024-05-01T12:30:15Z" {
+		t.Fatalf("unexpected format: %s", got)
+	}
+	if got := FormatTime(time.Time{}); got != "" {
+		t.Fatalf("expected empty string for zero time, got %q", got)
+	}
+
+	data, err := json.Marshal(TaskSummary{CompletedAt: FormatTime(local)})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if decoded["completed_at"] != "2024-05-01T12:30:15Z" {
+		t.Fatalf("unexpected completed_at: %v", decoded["completed_at"])
+	}
+}
+
+func TestNormalizeTimeAcceptsLegacyUnixSeconds(t *testing.T) {
+	for _, input := range []interface{}{float64(1714566615), int64(1714566615), "1714566615", "2024-05-01T20:30:15.25+08:00"} {
+		if got := NormalizeTime(input); got != "2024-05-01T12:30:15Z" {
+			t.Fatalf("NormalizeTime(%#v) = %v", input, got)
+		}
+	}
+	if got := NormalizeTime("soon"); got != "soon" {
+		t.Fatalf("expected non-timestamps to pass through, got %v", got)
+	}
+}
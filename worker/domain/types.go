@@ -4,17 +4,78 @@ package domain
 type MessageType string
 
 const (
-	MessageTypeRegistrationConfirmed MessageType = "registration_confirmed"
-	MessageTypeTaskSubmit            MessageType = "task_submit"
-	MessageTypeGetTasks              MessageType = "get_tasks"
-	MessageTypeGetTaskDetail         MessageType = "get_task_detail"
-	MessageTypeWebRTCOffer           MessageType = "webrtc_offer"
-	MessageTypeICECandidate          MessageType = "ice_candidate"
-	MessageTypeTasksResponse         MessageType = "tasks_response"
-	MessageTypeTaskDetailResponse    MessageType = "task_detail_response"
-	MessageTypeTaskStatus            MessageType = "task_status"
-	MessageTypeHeartbeat             MessageType = "heartbeat"
-	MessageTypeWebRTCAnswer          MessageType = "webrtc_answer"
+	MessageTypeRegistrationConfirmed  MessageType = "registration_confirmed"
+	MessageTypeRegistrationRejected   MessageType = "registration_rejected"
+	MessageTypeConnectionRejected     MessageType = "connection_rejected"
+	MessageTypeTaskSubmit             MessageType = "task_submit"
+	MessageTypeTaskSubmitResponse     MessageType = "task_submit_response"
+	MessageTypeGetTasks               MessageType = "get_tasks"
+	MessageTypeGetTaskDetail          MessageType = "get_task_detail"
+	MessageTypeWebRTCOffer            MessageType = "webrtc_offer"
+	MessageTypeICECandidate           MessageType = "ice_candidate"
+	MessageTypeTasksResponse          MessageType = "tasks_response"
+	MessageTypeTaskDetailResponse     MessageType = "task_detail_response"
+	MessageTypeTaskStatus             MessageType = "task_status"
+	MessageTypeHeartbeat              MessageType = "heartbeat"
+	MessageTypeWebRTCAnswer           MessageType = "webrtc_answer"
+	MessageTypeGetTaskLog             MessageType = "get_task_log"
+	MessageTypeTaskLogResponse        MessageType = "task_log_response"
+	MessageTypeTaskPolicyCheck        MessageType = "task_policy_check"
+	MessageTypeTaskPolicyVerdict      MessageType = "task_policy_verdict"
+	MessageTypeTaskCompleted          MessageType = "task_completed"
+	MessageTypePruneTaskData          MessageType = "prune_task_data"
+	MessageTypePruneTaskDataResponse  MessageType = "prune_task_data_response"
+	MessageTypeTaskTraffic            MessageType = "task_traffic"
+	MessageTypeGetTaskPieces          MessageType = "get_task_pieces"
+	MessageTypeTaskPiecesResponse     MessageType = "task_pieces_response"
+	MessageTypeTaskRemoved            MessageType = "task_removed"
+	MessageTypeTaskPin                MessageType = "task_pin"
+	MessageTypeTaskPinResponse        MessageType = "task_pin_response"
+	MessageTypeListLocalMedia         MessageType = "list_local_media"
+	MessageTypeLocalMediaList         MessageType = "local_media_list"
+	MessageTypeTranscodeLocal         MessageType = "transcode_local"
+	MessageTypeTranscodeLocalResponse MessageType = "transcode_local_response"
+	MessageTypeTaskRetry              MessageType = "task_retry"
+	MessageTypeTaskRetryResponse      MessageType = "task_retry_response"
+	MessageTypeICEResend              MessageType = "ice_resend"
+	MessageTypeICEResendResponse      MessageType = "ice_resend_response"
+	MessageTypeFileFetch              MessageType = "file_fetch"
+	MessageTypeFileFetchResponse      MessageType = "file_fetch_response"
+	MessageTypeSetPriority            MessageType = "set_priority"
+	MessageTypeCloseSession           MessageType = "close_session"
+	MessageTypeSetPriorityResponse    MessageType = "set_priority_response"
+	MessageTypeBoostTask              MessageType = "boost_task"
+	MessageTypeBoostTaskResponse      MessageType = "boost_task_response"
+	MessageTypeRepairSegment          MessageType = "repair_segment"
+	MessageTypeRepairSegmentResponse  MessageType = "repair_segment_response"
+	MessageTypeGetSessionStats        MessageType = "get_session_stats"
+	MessageTypeSessionStatsResponse   MessageType = "session_stats_response"
+	MessageTypeTaskPause              MessageType = "task_pause"
+	MessageTypeTaskPauseResponse      MessageType = "task_pause_response"
+	MessageTypeTaskResume             MessageType = "task_resume"
+	MessageTypeTaskResumeResponse     MessageType = "task_resume_response"
+	MessageTypeTaskRemove             MessageType = "task_remove"
+	MessageTypeTaskRemoveResponse     MessageType = "task_remove_response"
+	MessageTypeGetQueues              MessageType = "get_queues"
+	MessageTypeQueuesResponse         MessageType = "queues_response"
+	MessageTypePauseAll               MessageType = "pause_all"
+	MessageTypePauseAllResponse       MessageType = "pause_all_response"
+	MessageTypeResumeAll              MessageType = "resume_all"
+	MessageTypeResumeAllResponse      MessageType = "resume_all_response"
+	MessageTypeWebRTCOfferFailed      MessageType = "webrtc_offer_failed"
+	MessageTypeGetTorrentInfo         MessageType = "get_torrent_info"
+	MessageTypeTorrentInfoResponse    MessageType = "torrent_info_response"
+	MessageTypeClockSync              MessageType = "clock_sync"
+	MessageTypeGetTaskAccess          MessageType = "get_task_access"
+	MessageTypeTaskAccessResponse     MessageType = "task_access_response"
+	MessageTypeWebRTCProbe            MessageType = "webrtc_probe"
+	MessageTypeProbeResult            MessageType = "probe_result"
+	MessageTypeSelectFiles            MessageType = "select_files"
+	MessageTypeSelectFilesResponse    MessageType = "select_files_response"
+	MessageTypeGetStreamToken         MessageType = "get_stream_token"
+	MessageTypeStreamTokenResponse    MessageType = "stream_token_response"
+	MessageTypeSetRateLimit           MessageType = "set_rate_limit"
+	MessageTypeSetRateLimitResponse   MessageType = "set_rate_limit_response"
 )
 
 // TaskStatus captures the lifecycle state of a download/transcode task.
@@ -28,6 +89,18 @@ const (
 	TaskStatusPaused      TaskStatus = "paused"
 	TaskStatusTranscoding TaskStatus = "transcoding"
 	TaskStatusReady       TaskStatus = "ready"
+	TaskStatusCancelled   TaskStatus = "cancelled"
+	// TaskStatusPermanentlyFailed is reached once automatic retries are
+	// exhausted; only a manual retry restarts the task.
+	TaskStatusPermanentlyFailed TaskStatus = "permanently_failed"
+)
+
+// Task priorities range from MinTaskPriority to MaxTaskPriority. When every
+// download slot is taken, queued tasks with a higher priority start first.
+const (
+	MinTaskPriority     = 1
+	MaxTaskPriority     = 10
+	DefaultTaskPriority = 5
 )
 
 // TranscodeStatus captures the lifecycle of a transcoding job.
@@ -60,4 +133,83 @@ type NodeInfo struct {
 	Capabilities []string          `json:"capabilities"`
 	Resources    map[string]int    `json:"resources"`
 	Metadata     map[string]string `json:"metadata"`
+	// ProtocolVersion and MinProtocolVersion announce the supported protocol range.
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version"`
+	// ClockMs is the worker's wall clock in Unix milliseconds when the
+	// registration was sent, for the gateway's clock skew estimate.
+	ClockMs int64 `json:"clock_ms,omitempty"`
+}
+
+// TaskSummary describes the output of a finished task for display in the UI.
+type TaskSummary struct {
+	Name              string   `json:"name"`
+	TotalBytes        int64    `json:"total_bytes"`
+	DurationSeconds   float64  `json:"duration_seconds"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	VideoCodec        string   `json:"video_codec,omitempty"`
+	AudioCodec        string   `json:"audio_codec,omitempty"`
+	SubtitleLanguages []string `json:"subtitle_languages"`
+	MediaType         string   `json:"media_type,omitempty"` // "audio" for audio-only tasks, empty for video
+	SegmentCount      int      `json:"segment_count"`
+	OutputBytes       int64    `json:"output_bytes"`
+	CompletedAt       string   `json:"completed_at"` // RFC3339 UTC
+}
+
+// MediaInfoSidecar is the content of the info.json file written next to a
+// task's playlist. Players fetch it over the data channel to bootstrap
+// playback with a single request. URIs use the same <prefix><task_id>/ form
+// as playlist and segment requests, where the prefix is
+// network.serve_path_prefix (/video/ by default).
+type MediaInfoSidecar struct {
+	TaskID          string          `json:"task_id"`
+	Name            string          `json:"name"`
+	Playlist        string          `json:"playlist"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	Width           int             `json:"width"`
+	Height          int             `json:"height"`
+	VideoCodec      string          `json:"video_codec,omitempty"`
+	AudioCodec      string          `json:"audio_codec,omitempty"`
+	Subtitles       []SubtitleTrack `json:"subtitles"`
+	Poster          string          `json:"poster,omitempty"`
+	Thumbnails      string          `json:"thumbnails,omitempty"` // WebVTT index of scrubbing preview sprites
+	Renditions      []Rendition     `json:"renditions,omitempty"` // set when Playlist is a multi-bitrate master playlist
+	Qualities       []string        `json:"qualities,omitempty"`  // rendition names accepted as the quality of a hijackReq, in ladder order
+	MediaType       string          `json:"media_type,omitempty"` // "audio" for audio-only tasks, empty for video
+	Tracks          []AudioTrack    `json:"tracks,omitempty"`     // set for audio-only tasks, in play order
+	Outputs         []VideoOutput   `json:"outputs,omitempty"`    // set for tasks with several video files; Playlist is the first
+	GeneratedAt     string          `json:"generated_at"`         // RFC3339 UTC
+}
+
+// AudioTrack is one track of an audio-only task, listed in the media info
+// sidecar. Playlist plays the track alone; the sidecar's Playlist plays all
+// tracks in order.
+type AudioTrack struct {
+	Name            string  `json:"name"`
+	Playlist        string  `json:"playlist"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// VideoOutput is one playable video of a task with several video files, such
+// as an episode of a season pack. Outputs are listed in file path order so
+// players can offer an episode picker.
+type VideoOutput struct {
+	Name     string `json:"name"`     // file name without extension
+	File     string `json:"file"`     // path of the source file inside the torrent
+	Playlist string `json:"playlist"` // <prefix><task_id>/<dir>/index.m3u8
+}
+
+// Rendition is one bitrate of a multi-bitrate task, listed in the media
+// info sidecar. Bandwidth matches the master playlist, in bits per second.
+type Rendition struct {
+	Name      string `json:"name"`
+	Playlist  string `json:"playlist"`
+	Bandwidth int    `json:"bandwidth"`
+}
+
+// SubtitleTrack is one subtitle file listed in the media info sidecar.
+type SubtitleTrack struct {
+	URI      string `json:"uri"`
+	Language string `json:"language,omitempty"`
 }
@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"worker/diskspace"
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 下载目录剩余空间不足时的处理方式
+const (
+	// DiskFullPause 停止写入新的分片，任务保持下载中并带disk_full子状态，空间恢复后继续
+	DiskFullPause = "pause"
+	// DiskFullFail 中止下载中的任务并标记为错误
+	DiskFullFail = "fail"
+)
+
+// SubStatusDiskFull 因剩余空间不足暂停写入的下载任务，在任务元数据sub_status中标记
+const SubStatusDiskFull = "disk_full"
+
+// ErrInsufficientDiskSpace 下载目录的剩余空间放不下种子选中的文件和预留空间
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// ErrorInsufficientDisk 因剩余空间不足未开始下载的任务，在任务元数据error中的标记
+const ErrorInsufficientDisk = "insufficient_disk"
+
+// DefaultDiskReservePercent 开始下载前在种子大小之外默认预留的空间，占种子大小的百分比
+const DefaultDiskReservePercent = 20
+
+// DiskShortfall 最近一次因剩余空间不足被拒绝的下载：当时的可用字节数与需要的字节数。
+// 之后有下载通过检查时清零
+type DiskShortfall struct {
+	AvailableBytes uint64 `json:"available_bytes"`
+	RequiredBytes  uint64 `json:"required_bytes"`
+}
+
+// diskCheckInterval 下载期间检查剩余空间的间隔
+const diskCheckInterval = 5 * time.Second
+
+// dataGate 控制是否继续下载分片数据，由*torrent.Torrent实现
+type dataGate interface {
+	DisallowDataDownload()
+	AllowDataDownload()
+}
+
+// SetDiskGuard 下载目录剩余空间低于minFreeBytes时按action处理下载中的任务，minFreeBytes为0时不检查
+func (m *Manager) SetDiskGuard(minFreeBytes uint64, action string) {
+	if action != DiskFullFail {
+		action = DiskFullPause
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.minFreeBytes = minFreeBytes
+	m.diskFullAction = action
+}
+
+// SetDiskReserve 开始下载前除了选中文件的剩余大小，还要求预留种子大小percent%的空间
+func (m *Manager) SetDiskReserve(percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.diskReservePercent = percent
+}
+
+// DiskShortfall 最近一次因剩余空间不足被拒绝的下载，没有时为零值
+func (m *Manager) DiskShortfall() DiskShortfall {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.diskShortfall
+}
+
+// requiredSpace 下载size字节的种子还需要的空间：尚未下载的部分加上预留空间
+func (m *Manager) requiredSpace(size, downloaded int64) uint64 {
+	m.mutex.RLock()
+	percent := m.diskReservePercent
+	m.mutex.RUnlock()
+
+	remaining := size - downloaded
+	if remaining < 0 {
+		remaining = 0
+	}
+	return uint64(remaining) + uint64(size)*uint64(percent)/100
+}
+
+// checkFreeSpace 可用空间少于需要的空间时返回包含两者字节数的ErrInsufficientDiskSpace
+func checkFreeSpace(available, required uint64) error {
+	if required > available {
+		return fmt.Errorf("%w: %d bytes available, %d bytes required", ErrInsufficientDiskSpace, available, required)
+	}
+	return nil
+}
+
+// rejectForDiskSpace 因剩余空间不足不开始下载，任务标记为错误，元数据中记录可用与需要的字节数。
+// 不自动重试，空间释放后可以手动重试
+func (m *Manager) rejectForDiskSpace(task *models.Task, t *torrent.Torrent, available, required uint64, reason error) {
+	log.Printf("Not downloading task %s: %v", task.TaskID, reason)
+	m.taskLog.Error(task.TaskID, tasklog.SourceDownload, "not enough disk space: %v", reason)
+
+	t.Drop()
+	m.mutex.Lock()
+	delete(m.activeTasks, task.TaskID)
+	m.diskShortfall = DiskShortfall{AvailableBytes: available, RequiredBytes: required}
+	m.mutex.Unlock()
+
+	metadata := recordFailure(task, domain.NewDownloadError(domain.ErrorCodeInsufficientDisk, reason))
+	metadata["error"] = ErrorInsufficientDisk
+	metadata["error_detail"] = reason.Error()
+	metadata["available_bytes"] = available
+	metadata["required_bytes"] = required
+	task.SetMetadata(metadata)
+	m.taskRepo.Update(task)
+	m.statusChan <- task
+}
+
+// clearDiskShortfall 有下载通过空间检查后清除之前的不足记录
+func (m *Manager) clearDiskShortfall() {
+	m.mutex.Lock()
+	m.diskShortfall = DiskShortfall{}
+	m.mutex.Unlock()
+}
+
+// DiskFull 剩余空间是否低于阈值
+func (m *Manager) DiskFull() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.diskFull
+}
+
+// watchDiskSpace 定期检查下载目录的剩余空间，直到stop关闭
+func (m *Manager) watchDiskSpace(stop <-chan struct{}) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.checkDiskSpace()
+		}
+	}
+}
+
+// checkDiskSpace 剩余空间低于阈值时标记磁盘已满：pause方式由下载协程暂停写入，
+// fail方式中止占用下载名额的任务；空间恢复（例如保留期清理删除了文件）后清除标记
+func (m *Manager) checkDiskSpace() {
+	m.mutex.RLock()
+	minFree, action, wasFull := m.minFreeBytes, m.diskFullAction, m.diskFull
+	m.mutex.RUnlock()
+	if minFree == 0 {
+		return
+	}
+
+	free, err := m.diskFree(m.downloadPath)
+	if err != nil {
+		if err != diskspace.ErrUnsupported {
+			log.Printf("Failed to check free space of %s: %v", m.downloadPath, err)
+		}
+		return
+	}
+	full := free < minFree
+	if full == wasFull {
+		return
+	}
+
+	m.mutex.Lock()
+	m.diskFull = full
+	var running []string
+	for task := range m.running {
+		running = append(running, task.TaskID)
+	}
+	m.mutex.Unlock()
+
+	if !full {
+		log.Printf("Free space of %s is back to %d MB, resuming downloads", m.downloadPath, free>>20)
+		return
+	}
+	log.Printf("Free space of %s dropped to %d MB, below %d MB", m.downloadPath, free>>20, minFree>>20)
+	if action == DiskFullFail {
+		for _, taskID := range running {
+			reason := domain.NewDownloadError(domain.ErrorCodeInsufficientDisk, fmt.Errorf("%s: %d MB free", SubStatusDiskFull, free>>20))
+			if err := m.AbortTask(taskID, reason); err != nil {
+				log.Printf("Failed to abort task %s on full disk: %v", taskID, err)
+			}
+		}
+	}
+}
+
+// syncDiskState 让下载协程的torrent跟随磁盘已满标记暂停或恢复写入，并更新任务的sub_status。
+// paused为任务当前是否因磁盘已满暂停，状态变化时返回true
+func (m *Manager) syncDiskState(task *models.Task, gate dataGate, paused *bool) bool {
+	m.mutex.RLock()
+	full := m.diskFull && m.diskFullAction == DiskFullPause
+	quiet := m.quiet
+	m.mutex.RUnlock()
+	if full == *paused {
+		return false
+	}
+	*paused = full
+
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	if full {
+		gate.DisallowDataDownload()
+		metadata["sub_status"] = SubStatusDiskFull
+		m.taskLog.Warn(task.TaskID, tasklog.SourceDownload, "disk almost full, pausing piece writes")
+	} else {
+		// 静默时段内由SetQuiet在时段结束时恢复写入
+		if !quiet {
+			gate.AllowDataDownload()
+		}
+		delete(metadata, "sub_status")
+		m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "free space recovered, resuming piece writes")
+	}
+	task.SetMetadata(metadata)
+
+	// 只更新元数据，进度由批量写入负责
+	if stored, err := m.taskRepo.GetByTaskID(task.TaskID); err == nil && stored.Status == domain.TaskStatusDownloading {
+		stored.SetMetadata(metadata)
+		m.taskRepo.Update(stored)
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"worker/domain"
+	"worker/models"
+
+	"github.com/anacrolix/torrent"
+)
+
+// DefaultMetadataFetchTimeout 只获取元数据（预览文件列表）时等待的时长上限
+const DefaultMetadataFetchTimeout = 2 * time.Minute
+
+// TorrentInfo 只获取元数据时得到的种子信息，用户据此选择要下载的文件
+type TorrentInfo struct {
+	InfoHash string                   `json:"info_hash"`
+	Name     string                   `json:"name"`
+	Size     int64                    `json:"size"`
+	Private  bool                     `json:"private"`
+	Files    []models.TorrentFileInfo `json:"files"`
+}
+
+// FetchMetadata 添加磁力链接并等待元数据，返回文件列表后移除种子，不下载任何数据。
+// 不创建任务；拿到的元数据写入缓存，之后提交同一磁力链接时不必再等待。
+// 同一种子正在下载时直接读取其元数据，不移除该种子
+func (m *Manager) FetchMetadata(magnetURL string) (*TorrentInfo, error) {
+	magnetURL = NormalizeMagnetURL(magnetURL)
+	m.mutex.RLock()
+	policy := m.trackerPolicy
+	client := m.client
+	timeout := m.metadataFetchTimeout
+	m.mutex.RUnlock()
+	if err := ValidateMagnetURL(magnetURL, policy); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("download manager not started")
+	}
+
+	spec, err := torrent.TorrentSpecFromMagnetUri(v1MagnetURL(magnetURL))
+	if err != nil {
+		return nil, domain.ClassifyDownloadError(err, domain.ErrorCodeMagnetInvalid)
+	}
+	t, added, err := client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, domain.ClassifyDownloadError(err, domain.ErrorCodeMagnetInvalid)
+	}
+	m.loadCachedMetadata(t)
+	if added {
+		defer m.dropFetchedTorrent(t)
+		if !magnetHasTrackers(magnetURL) {
+			t.AddTrackers(m.publicTrackerTiers())
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.GotInfo():
+	case <-timer.C:
+		stats := t.Stats()
+		return nil, domain.NewDownloadError(domain.ErrorCodeMetadataTimeout,
+			fmt.Errorf("no metadata after %s: %d known peers, %d active", timeout, stats.TotalPeers, stats.ActivePeers))
+	case <-t.Closed():
+		return nil, errors.New("torrent closed while waiting for metadata")
+	case <-m.stop:
+		return nil, errors.New("download manager stopped")
+	}
+
+	if err := m.metadataLimits.checkFileCount(len(t.Files())); err != nil {
+		return nil, domain.NewDownloadError(domain.ErrorCodeTorrentRejected, err)
+	}
+	info := &TorrentInfo{
+		InfoHash: t.InfoHash().HexString(),
+		Name:     t.Name(),
+		Size:     t.Length(),
+		Private:  isPrivateTorrent(t.Info()),
+		Files:    make([]models.TorrentFileInfo, len(t.Files())),
+	}
+	for i, file := range t.Files() {
+		info.Files[i] = models.TorrentFileInfo{
+			FileName:   file.DisplayPath(),
+			FileSize:   file.Length(),
+			FilePath:   file.Path(),
+			IsSelected: true,
+		}
+	}
+	if _, err := m.metadataLimits.checkMetadata(len(t.Metainfo().InfoBytes), info.Files); err != nil {
+		return nil, domain.NewDownloadError(domain.ErrorCodeTorrentRejected, err)
+	}
+	m.storeMetadata(t)
+	return info, nil
+}
+
+// dropFetchedTorrent 移除只为获取元数据而添加的种子。获取期间开始下载的任务
+// 拿到的是同一个种子实例，这时保留给任务使用
+func (m *Manager) dropFetchedTorrent(t *torrent.Torrent) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, active := range m.activeTasks {
+		if active == t {
+			return
+		}
+	}
+	t.Drop()
+	log.Printf("Dropped metadata-only torrent %s", t.InfoHash().HexString())
+}
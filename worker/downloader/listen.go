@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/anacrolix/torrent"
+)
+
+// ListenStatus 种子客户端监听端口的状态。OK为false时客户端无法接受入站连接
+// 或未能使用配置的端口，下载速度可能明显下降，通常是端口被占用或被防火墙拦截。
+type ListenStatus struct {
+	RequestedPort int      `json:"requested_port"` // 配置的端口，0表示自动分配
+	Port          int      `json:"port"`           // 实际监听的端口，0表示没有监听
+	Addrs         []string `json:"addrs"`
+	OK            bool     `json:"ok"`
+	Warning       string   `json:"warning,omitempty"`
+}
+
+// SetListenPort 设置种子客户端的监听端口，0表示自动分配，需在Start之前调用
+func (m *Manager) SetListenPort(port int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listenPort = port
+}
+
+// ListenStatus 返回Start时检查的监听端口状态
+func (m *Manager) ListenStatus() ListenStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.listenStatus
+}
+
+// newTorrentClient 按配置端口创建种子客户端；端口无法绑定时改用自动分配的端口，
+// 保证下载可用，并在返回的状态中记录告警。
+func newTorrentClient(config *torrent.ClientConfig, port int) (*torrent.Client, ListenStatus, error) {
+	status := ListenStatus{RequestedPort: port}
+
+	config.ListenPort = port
+	client, err := torrent.NewClient(config)
+	if err != nil && port != 0 {
+		bindErr := err
+		config.ListenPort = 0
+		client, err = torrent.NewClient(config)
+		if err != nil {
+			return nil, status, err
+		}
+		status.Warning = fmt.Sprintf("listen port %d unavailable (%v), fell back to an automatically assigned port", port, bindErr)
+	}
+	if err != nil {
+		return nil, status, err
+	}
+
+	status.Port = client.LocalPort()
+	for _, addr := range client.ListenAddrs() {
+		status.Addrs = append(status.Addrs, addr.String())
+	}
+	status.OK = checkListenStatus(&status)
+	return client, status, nil
+}
+
+// checkListenStatus 根据实际监听的端口判断状态并补全告警
+func checkListenStatus(status *ListenStatus) bool {
+	switch {
+	case status.Port == 0:
+		if status.Warning == "" {
+			status.Warning = "torrent client is not listening on any port; incoming peer connections are impossible"
+		}
+		return false
+	case status.RequestedPort != 0 && status.Port != status.RequestedPort:
+		if status.Warning == "" {
+			status.Warning = fmt.Sprintf("torrent client listens on port %d instead of configured port %d", status.Port, status.RequestedPort)
+		}
+		return false
+	}
+	return status.Warning == ""
+}
+
+// CheckListenPort 尝试绑定TCP和UDP端口，用于启动前自检
+func CheckListenPort(port int) error {
+	address := net.JoinHostPort("", fmt.Sprint(port))
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	tcp.Close()
+
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	udp.Close()
+	return nil
+}
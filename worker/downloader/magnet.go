@@ -0,0 +1,212 @@
+package downloader
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"worker/domain"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// 磁力链接的info hash形式
+const (
+	MagnetFormV1     = "v1"     // 只有btih（BitTorrent v1）
+	MagnetFormV2     = "v2"     // 只有btmh（BitTorrent v2）
+	MagnetFormHybrid = "hybrid" // 同时带有btih和btmh的混合种子
+)
+
+// ErrInvalidMagnet 磁力链接格式错误：不是magnet:?开头、缺少可用的xt参数、info hash格式不对或tracker地址无效。
+// 错误码为magnet_invalid，errors.Is(err, domain.ErrMagnetInvalid)同样成立
+var ErrInvalidMagnet error = domain.NewDownloadError(domain.ErrorCodeMagnetInvalid, errors.New("invalid magnet URL"))
+
+// magnetPrefix 规范化后的磁力链接前缀，其后是查询参数
+const magnetPrefix = "magnet:?"
+
+// ErrUnsupportedHashType 磁力链接只有当前torrent库不支持的hash类型（如纯v2的btmh）
+var ErrUnsupportedHashType = errors.New("unsupported info hash type")
+
+// sha256Multihash btmh中SHA-256 multihash的前缀：函数码0x12，摘要长度0x20
+const sha256Multihash = "1220"
+
+// v2ProbeMagnet 检测torrent库是否支持v2时使用的纯btmh磁力链接
+const v2ProbeMagnet = "magnet:?xt=urn:btmh:" + sha256Multihash + "0000000000000000000000000000000000000000000000000000000000000000"
+
+// MagnetHashes 磁力链接中的info hash（小写十六进制）。V1来自btih，V2来自btmh，
+// 为去掉multihash前缀的SHA-256摘要。混合种子两者都有。
+type MagnetHashes struct {
+	V1 string
+	V2 string
+}
+
+// Form 返回info hash形式：v1、v2或hybrid
+func (h MagnetHashes) Form() string {
+	switch {
+	case h.V1 != "" && h.V2 != "":
+		return MagnetFormHybrid
+	case h.V2 != "":
+		return MagnetFormV2
+	}
+	return MagnetFormV1
+}
+
+// Matches 判断两组hash是否指向同一种子：v1或v2任一相同即视为相同，
+// 因此混合种子与只带其v1或v2 hash的磁力链接是同一任务
+func (h MagnetHashes) Matches(other MagnetHashes) bool {
+	return (h.V1 != "" && h.V1 == other.V1) || (h.V2 != "" && h.V2 == other.V2)
+}
+
+// NormalizeMagnetURL 把浏览器协议处理器传来的web+magnet:链接和magnet://?写法统一为magnet:?，
+// 其它链接去掉首尾空白后原样返回
+func NormalizeMagnetURL(magnetURL string) string {
+	normalized := strings.TrimSpace(magnetURL)
+	if len(normalized) >= len("web+magnet:") && strings.EqualFold(normalized[:len("web+magnet:")], "web+magnet:") {
+		normalized = "magnet:" + normalized[len("web+magnet:"):]
+	}
+	if len(normalized) >= len("magnet://") && strings.EqualFold(normalized[:len("magnet://")], "magnet://") {
+		normalized = "magnet:" + normalized[len("magnet://"):]
+	}
+	return normalized
+}
+
+// magnetQuery 解析规范化后磁力链接magnet:?之后的查询参数
+func magnetQuery(magnetURL string) (url.Values, error) {
+	normalized := NormalizeMagnetURL(magnetURL)
+	if len(normalized) < len(magnetPrefix) || !strings.EqualFold(normalized[:len(magnetPrefix)], magnetPrefix) {
+		return nil, errors.New("must start with magnet:?")
+	}
+	query, err := url.ParseQuery(normalized[len(magnetPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("malformed query: %w", err)
+	}
+	return query, nil
+}
+
+// ParseMagnetHashes 解析磁力链接中全部xt参数的info hash，btih支持十六进制和base32，
+// btmh只支持SHA-256 multihash。不认识的xt被忽略，没有任何可用hash时返回错误
+func ParseMagnetHashes(magnetURL string) (MagnetHashes, error) {
+	var hashes MagnetHashes
+	query, err := magnetQuery(magnetURL)
+	if err != nil {
+		return hashes, err
+	}
+	xts := query["xt"]
+	if len(xts) == 0 {
+		return hashes, errors.New("xt parameter missing")
+	}
+	for _, xt := range xts {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			v1, err := parseBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return hashes, err
+			}
+			hashes.V1 = v1
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			v2, err := parseBTMH(strings.TrimPrefix(xt, "urn:btmh:"))
+			if err != nil {
+				return hashes, err
+			}
+			hashes.V2 = v2
+		}
+	}
+	if hashes.V1 == "" && hashes.V2 == "" {
+		return hashes, errors.New("xt parameter must be urn:btih:<infohash> or urn:btmh:<multihash>")
+	}
+	return hashes, nil
+}
+
+// parseBTIH 将40位十六进制或32位base32的v1 info hash转换为小写十六进制
+func parseBTIH(raw string) (string, error) {
+	switch len(raw) {
+	case 40:
+		if _, err := hex.DecodeString(raw); err != nil {
+			return "", errors.New("infohash must be 40 hex chars")
+		}
+		return strings.ToLower(raw), nil
+	case 32:
+		decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(raw))
+		if err != nil {
+			return "", errors.New("base32 infohash must be 32 chars of A-Z and 2-7")
+		}
+		return hex.EncodeToString(decoded), nil
+	}
+	return "", fmt.Errorf("infohash must be 40 hex or 32 base32 chars, got %d", len(raw))
+}
+
+// parseBTMH 解析十六进制的SHA-256 multihash，返回摘要部分
+func parseBTMH(raw string) (string, error) {
+	raw = strings.ToLower(raw)
+	if len(raw) != len(sha256Multihash)+64 || !strings.HasPrefix(raw, sha256Multihash) {
+		return "", errors.New("btmh must be 68 hex chars: a SHA-256 multihash, 1220 followed by 64 hex chars")
+	}
+	if _, err := hex.DecodeString(raw); err != nil {
+		return "", errors.New("btmh must be 68 hex chars")
+	}
+	return raw[len(sha256Multihash):], nil
+}
+
+var (
+	torrentV2Once      sync.Once
+	torrentV2Supported bool
+)
+
+// SupportsTorrentV2 检测当前使用的torrent库能否添加纯v2（btmh）磁力链接，结果在进程内缓存。
+// 不支持时混合种子仍按其v1 hash下载
+func SupportsTorrentV2() bool {
+	torrentV2Once.Do(func() {
+		_, err := metainfo.ParseMagnetUri(v2ProbeMagnet)
+		torrentV2Supported = err == nil
+	})
+	return torrentV2Supported
+}
+
+// checkHashSupport 磁力链接只有v2 hash而torrent库不支持v2时返回ErrUnsupportedHashType，
+// 在提交时直接拒绝，而不是让任务一直等不到元数据
+func checkHashSupport(hashes MagnetHashes) error {
+	if hashes.Form() == MagnetFormV2 && !SupportsTorrentV2() {
+		return fmt.Errorf("%w: magnet has only a BitTorrent v2 (btmh) info hash, which this worker cannot download; submit a v1 or hybrid magnet instead", ErrUnsupportedHashType)
+	}
+	return nil
+}
+
+// v1MagnetURL 把btih参数移到最前面。torrent库只读取第一个xt，
+// 混合种子的btmh排在前面时会解析失败
+func v1MagnetURL(magnetURL string) string {
+	u, err := url.Parse(NormalizeMagnetURL(magnetURL))
+	if err != nil || u.Scheme != "magnet" {
+		return magnetURL
+	}
+	query := u.Query()
+	xts := query["xt"]
+	if len(xts) < 2 || strings.HasPrefix(xts[0], "urn:btih:") {
+		return magnetURL
+	}
+	ordered := make([]string, 0, len(xts))
+	for _, xt := range xts {
+		if strings.HasPrefix(xt, "urn:btih:") {
+			ordered = append(ordered, xt)
+		}
+	}
+	if len(ordered) == 0 {
+		return magnetURL
+	}
+	for _, xt := range xts {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			ordered = append(ordered, xt)
+		}
+	}
+	query["xt"] = ordered
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// parseMagnet 按v1解析磁力链接，兼容btmh排在前面的混合种子
+func parseMagnet(magnetURL string) (metainfo.Magnet, error) {
+	return metainfo.ParseMagnetUri(v1MagnetURL(magnetURL))
+}
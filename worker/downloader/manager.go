@@ -1,56 +1,136 @@
 package downloader
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"worker/database"
+	"worker/diskspace"
 	"worker/domain"
 	"worker/models"
+	"worker/tasklog"
+	"worker/trackers"
 
 	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
 )
 
 // Service 抽象下载管理行为，方便依赖注入。
 type Service interface {
 	Start() error
 	Stop()
-	StartDownload(magnetURL string) (string, error)
+	StartDownload(magnetURL string, priority int) (string, error)
+	StartDownloadWithSelection(magnetURL string, selected []string) (string, error)
+	StartDownloadWithOptions(magnetURL string, options TaskOptions) (string, error)
+	FetchMetadata(magnetURL string) (*TorrentInfo, error)
+	SetPriority(taskID string, priority int) error
+	SelectFiles(taskID string, selectedPaths []string) error
 	PauseTask(taskID string) error
 	ResumeTask(taskID string) error
-	RemoveTask(taskID string) error
+	RetryTask(taskID string) error
+	RemoveTask(taskID string, purgeFiles bool) error
 	GetTask(taskID string) (*models.Task, bool)
 	GetAllTasks() []*models.Task
+	GetTasksByStatus(status domain.TaskStatus) ([]*models.Task, error)
 	GetStatusChannel() <-chan *models.Task
 	SetExternalStatusHandler(handler func(*models.Task))
+	SetMetadataHandler(handler func(*models.Task))
+	AbortTask(taskID string, reason error) error
+	PruneTaskData(taskID string, dryRun bool) (*PruneResult, error)
+	PieceAvailability(taskID string) (*PieceMap, error)
+	ListenStatus() ListenStatus
+	GetReader(taskID, filePath string) (torrent.Reader, error)
+	SetStreamReadyHandler(handler func(task *models.Task, filePath string))
+	QueueSnapshot() QueueSnapshot
+	DiskShortfall() DiskShortfall
+	SetQuiet(quiet bool)
+	SetRateLimit(downKbps, upKbps int)
 }
 
 // Manager 下载管理器
 type Manager struct {
 	client                *torrent.Client
 	activeTasks           map[string]*torrent.Torrent // 内存中的活跃任务（torrent实例）
+	pending               taskQueue                   // 等待下载名额的任务，按优先级排列
+	queued                map[string]*queuedTask      // 等待队列中的任务，按任务ID索引
+	queueSeq              uint64
+	running               map[*models.Task]bool // 占用下载名额的任务实例，暂停后立即恢复时新旧实例分别计数
 	downloadPath          string
 	workerID              string
 	mutex                 sync.RWMutex
+	cancelFuncs           map[string]context.CancelFunc // 各下载协程的取消函数，暂停、删除时让协程立即退出
 	statusChan            chan *models.Task
 	maxTasks              int
 	taskRepo              database.TaskRepository
-	externalStatusHandler func(*models.Task) // 外部状态处理器
+	progress              *database.ProgressBatcher // Start后进度先合并再批量写库
+	externalStatusHandler func(*models.Task)        // 外部状态处理器
+	metadataHandler       func(*models.Task)        // 获取到种子元数据后的回调
+	metadataLimits        MetadataLimits
+	taskLog               *tasklog.Logger
+	listenPort            int             // 配置的监听端口，0表示自动分配
+	listenStatus          ListenStatus    // Start时检查的监听端口状态
+	privateClient         *torrent.Client // 关闭DHT/PEX的私有种子客户端，按需创建
+	// 私有种子需要提交者确认才下载
+	requirePrivateConfirmation bool
+	trackerPolicy              TrackerPolicy // 磁力链接与公开tracker的主机名限制
+	publicTrackers             []string      // 为公开种子追加的tracker，提高发现速度
+	metadataCache              *MetadataCache
+	// 所有torrent客户端共享的下载/上传限速，SetRateLimit在运行中调整
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
+	// 流式模式下视频文件从开头按顺序先下载，开头streamingReadahead字节就绪后回调streamReadyHandler
+	streamingMode      bool
+	streamingReadahead int64
+	streamReadyHandler func(task *models.Task, filePath string)
+	// 剩余空间低于minFreeBytes时按diskFullAction暂停写入或中止任务
+	minFreeBytes   uint64
+	diskFullAction string
+	diskFull       bool
+	diskFree       func(path string) (uint64, error)
+	// 开始下载前在种子大小之外预留的空间（占种子大小的百分比），以及最近一次因空间不足拒绝的下载
+	diskReservePercent int
+	diskShortfall      DiskShortfall
+	metadataTimeout    time.Duration // 等待种子元数据的时长上限，0表示一直等待
+	stop               chan struct{} // Stop时关闭，结束后台检查
+	// 静默时段内暂停所有torrent的传输，等待的任务不开始
+	quiet bool
+	// quietSince 本次静默开始的时间，quietTotal 此前各次静默的累计时长，用于让元数据超时不计静默时段
+	quietSince time.Time
+	quietTotal time.Duration
+	// FetchMetadata只获取元数据时等待的时长上限
+	metadataFetchTimeout time.Duration
 }
 
 // New 创建新的下载管理器
 func New(downloadPath, workerID string) *Manager {
 	return &Manager{
 		activeTasks:           make(map[string]*torrent.Torrent),
+		cancelFuncs:           make(map[string]context.CancelFunc),
+		queued:                make(map[string]*queuedTask),
+		running:               make(map[*models.Task]bool),
 		downloadPath:          downloadPath,
 		workerID:              workerID,
 		statusChan:            make(chan *models.Task, 100),
 		maxTasks:              5,
 		taskRepo:              database.NewTaskRepository(),
 		externalStatusHandler: nil,
+		downloadLimiter:       rate.NewLimiter(rate.Inf, minRateBurst),
+		uploadLimiter:         rate.NewLimiter(rate.Inf, minRateBurst),
+		publicTrackers:        trackers.Defaults(),
+		diskFullAction:        DiskFullPause,
+		diskReservePercent:    DefaultDiskReservePercent,
+		metadataTimeout:       DefaultMetadataTimeout,
+		metadataFetchTimeout:  DefaultMetadataFetchTimeout,
+		streamingReadahead:    DefaultStreamingReadahead,
+		diskFree:              diskspace.Available,
+		stop:                  make(chan struct{}),
 	}
 }
 
@@ -66,16 +146,39 @@ func (m *Manager) Start() error {
 	config.DataDir = m.downloadPath
 	config.NoUpload = false
 	config.Seed = true
+	m.applyRateLimiters(config)
 
-	client, err := torrent.NewClient(config)
+	m.mutex.RLock()
+	listenPort := m.listenPort
+	metadataCache := m.metadataCache
+	m.mutex.RUnlock()
+
+	client, status, err := newTorrentClient(config, listenPort)
 	if err != nil {
 		return fmt.Errorf("failed to create torrent client: %v", err)
 	}
+	if !status.OK {
+		log.Printf("WARNING: %s", status.Warning)
+	} else {
+		log.Printf("Torrent client listening on port %d", status.Port)
+	}
+	if !SupportsTorrentV2() {
+		log.Printf("Torrent library does not support BitTorrent v2 magnets; v2-only magnets will be rejected, hybrid magnets download by their v1 hash")
+	}
 
+	m.mutex.Lock()
 	m.client = client
+	m.listenStatus = status
+	m.progress = database.NewProgressBatcher(m.taskRepo)
+	m.progress.Start(progressFlushInterval)
+	m.mutex.Unlock()
 
 	// 启动状态监控
 	go m.statusMonitor()
+	go m.watchDiskSpace(m.stop)
+	if metadataCache != nil {
+		go m.sweepMetadataCache(metadataCache)
+	}
 
 	// 恢复之前未完成的任务
 	if err := m.restoreActiveTasks(); err != nil {
@@ -88,54 +191,121 @@ func (m *Manager) Start() error {
 
 // Stop 停止下载管理器
 func (m *Manager) Stop() {
+	if batcher := m.progressBatcher(); batcher != nil {
+		if err := batcher.Stop(); err != nil {
+			log.Printf("Failed to flush task progress: %v", err)
+		}
+	}
 	if m.client != nil {
 		m.client.Close()
 	}
+	m.mutex.RLock()
+	privateClient := m.privateClient
+	m.mutex.RUnlock()
+	if privateClient != nil {
+		privateClient.Close()
+	}
+	close(m.stop)
 	close(m.statusChan)
 	log.Printf("Download manager stopped")
 }
 
-// StartDownload 开始下载任务
-func (m *Manager) StartDownload(magnetURL string) (string, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// ErrDuplicateTask 同一磁力链接已有任务，StartDownload同时返回该任务的ID
+var ErrDuplicateTask = errors.New("a task for this magnet URL already exists")
+
+// resubmittable 该状态的任务不阻止以同一磁力链接重新提交
+func resubmittable(status domain.TaskStatus) bool {
+	switch status {
+	case domain.TaskStatusError, domain.TaskStatusPermanentlyFailed, domain.TaskStatusCancelled:
+		return true
+	}
+	return false
+}
 
-	// 检查任务数量限制
-	activeCount, err := m.taskRepo.GetActiveTasksCount(m.workerID)
+// TaskOptions 提交任务时的选项。它们与任务记录一起创建，而不是创建后再读改写任务：
+// 下载协程持有任务对象并会保存整行，创建之后写入的字段可能被它覆盖
+type TaskOptions struct {
+	Selected []string               // 只下载这些文件（按种子内的相对路径匹配），为空时下载全部文件
+	Priority int                    // 下载优先级1-10
+	Metadata map[string]interface{} // 写入任务元数据的提交选项，如播放令牌
+	TraceID  string                 // 网关提交时生成的追踪ID
+}
+
+// StartDownload 开始下载任务，下载种子中的全部文件。同一磁力链接已有未失败的任务时
+// 返回该任务的ID和ErrDuplicateTask
+func (m *Manager) StartDownload(magnetURL string, priority int) (string, error) {
+	return m.StartDownloadWithOptions(magnetURL, TaskOptions{Priority: priority})
+}
+
+// StartDownloadWithSelection 开始下载任务，只下载路径在selected中的文件（按种子内的相对路径匹配），
+// 其余文件在任务的文件列表中标记为未选中，进度按选中文件的大小计算。使用默认优先级
+func (m *Manager) StartDownloadWithSelection(magnetURL string, selected []string) (string, error) {
+	return m.StartDownloadWithOptions(magnetURL, TaskOptions{Selected: selected, Priority: domain.DefaultTaskPriority})
+}
+
+// StartDownloadWithOptions 按提交选项创建并开始下载任务。只下载路径在options.Selected中的文件，
+// 其余文件在任务的文件列表中标记为未选中；Selected为空时下载全部文件，进度按选中文件的大小计算。
+// 下载名额用完时任务保持pending并按优先级（1-10）排队，有名额空出时优先级最高的任务先开始。
+func (m *Manager) StartDownloadWithOptions(magnetURL string, options TaskOptions) (string, error) {
+	if err := checkPriority(options.Priority); err != nil {
+		return "", err
+	}
+	magnetURL = NormalizeMagnetURL(magnetURL)
+	m.mutex.RLock()
+	policy := m.trackerPolicy
+	m.mutex.RUnlock()
+	if err := ValidateMagnetURL(magnetURL, policy); err != nil {
+		return "", err
+	}
+
+	// 同一磁力链接已有未失败的任务时返回该任务
+	if existing, err := m.taskRepo.FindByMagnetURL(magnetURL); err == nil && !resubmittable(existing.Status) {
+		return existing.TaskID, ErrDuplicateTask
+	}
+
+	task, err := NewTask(magnetURL, m.workerID, options)
 	if err != nil {
-		return "", fmt.Errorf("failed to check active tasks: %v", err)
+		return "", err
 	}
 
-	if activeCount >= int64(m.maxTasks) {
-		return "", fmt.Errorf("maximum active downloads reached (%d)", m.maxTasks)
+	// 保存到数据库
+	if err := m.taskRepo.Create(task); err != nil {
+		return "", fmt.Errorf("failed to create task in database: %v", err)
 	}
 
-	// 创建数据库任务记录
+	// 排队，有空闲名额时立即开始
+	m.schedule(task)
+
+	log.Printf("Submitted download task %s with priority %d", task.TaskID, options.Priority)
+	return task.TaskID, nil
+}
+
+// NewTask 按提交选项构造等待下载的任务记录，尚未写入数据库
+func NewTask(magnetURL, workerID string, options TaskOptions) (*models.Task, error) {
 	task := &models.Task{
 		TaskID:    generateTaskID(),
 		MagnetURL: magnetURL,
 		Status:    domain.TaskStatusPending,
 		Progress:  0,
-		WorkerID:  m.workerID,
+		Priority:  options.Priority,
+		TraceID:   options.TraceID,
+		WorkerID:  workerID,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
-	// 设置空的元数据
-	if err := task.SetMetadata(make(map[string]interface{})); err != nil {
-		return "", fmt.Errorf("failed to set metadata: %v", err)
+	// 文件选择在拿到元数据后才能应用，先随任务保存
+	metadata := make(map[string]interface{}, len(options.Metadata)+1)
+	for key, value := range options.Metadata {
+		metadata[key] = value
 	}
-
-	// 保存到数据库
-	if err := m.taskRepo.Create(task); err != nil {
-		return "", fmt.Errorf("failed to create task in database: %v", err)
+	if len(options.Selected) > 0 {
+		metadata[selectedFilesKey] = options.Selected
 	}
-
-	// 开始下载
-	go m.downloadTask(task)
-
-	log.Printf("Started download task: %s", task.TaskID)
-	return task.TaskID, nil
+	if err := task.SetMetadata(metadata); err != nil {
+		return nil, fmt.Errorf("failed to set metadata: %v", err)
+	}
+	return task, nil
 }
 
 // GetTask 获取任务信息
@@ -160,15 +330,52 @@ func (m *Manager) GetAllTasks() []*models.Task {
 	for i := range tasks {
 		taskPtrs[i] = &tasks[i]
 	}
+	m.addLiveStats(taskPtrs)
 	return taskPtrs
 }
 
-// PauseTask 暂停任务
+// addLiveStats 为正在下载的任务填入实时的peer数，并按入库的速度估计剩余时间。
+// 没有下载协程的任务peer数为0，未下载完时剩余时间为-1
+func (m *Manager) addLiveStats(tasks []*models.Task) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, task := range tasks {
+		t, active := m.activeTasks[task.TaskID]
+		if !active {
+			task.Peers = 0
+			task.ETASeconds = estimateETA(task.Size, task.Downloaded, 0)
+			continue
+		}
+		task.Peers = t.Stats().ActivePeers
+		task.ETASeconds = estimateETA(task.Size, task.Downloaded, task.Speed)
+	}
+}
+
+// GetTasksByStatus 获取本节点指定状态的任务，例如列出等待恢复的暂停任务
+func (m *Manager) GetTasksByStatus(status domain.TaskStatus) ([]*models.Task, error) {
+	tasks, err := m.taskRepo.GetByStatus(status)
+	if err != nil {
+		return nil, err
+	}
+
+	taskPtrs := make([]*models.Task, 0, len(tasks))
+	for i := range tasks {
+		if tasks[i].WorkerID == m.workerID {
+			taskPtrs = append(taskPtrs, &tasks[i])
+		}
+	}
+	m.addLiveStats(taskPtrs)
+	return taskPtrs, nil
+}
+
+// PauseTask 暂停任务，排队中的任务移出等待队列
 func (m *Manager) PauseTask(taskID string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	// 从内存中移除torrent实例
+	m.unqueueLocked(taskID)
+	// 结束下载协程并从内存中移除torrent实例，协程退出时释放名额
+	m.cancelTaskLocked(taskID)
 	if torrentInstance, exists := m.activeTasks[taskID]; exists {
 		torrentInstance.Drop()
 		delete(m.activeTasks, taskID)
@@ -178,7 +385,7 @@ func (m *Manager) PauseTask(taskID string) error {
 	return m.taskRepo.UpdateStatus(taskID, domain.TaskStatusPaused)
 }
 
-// ResumeTask 恢复任务
+// ResumeTask 恢复暂停的任务，重启后暂停的任务只能由此恢复
 func (m *Manager) ResumeTask(taskID string) error {
 	task, err := m.taskRepo.GetByTaskID(taskID)
 	if err != nil {
@@ -186,36 +393,193 @@ func (m *Manager) ResumeTask(taskID string) error {
 	}
 
 	if task.Status == domain.TaskStatusPaused {
-		go m.downloadTask(task)
+		// 重新排队，名额用完时等待
+		task.Status = domain.TaskStatusPending
+		task.UpdatedAt = time.Now()
+		if err := m.taskRepo.Update(task); err != nil {
+			return err
+		}
+		m.schedule(task)
 	}
 
 	return nil
 }
 
-// RemoveTask 删除任务
-func (m *Manager) RemoveTask(taskID string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// RetryTask 重新下载失败的任务，已下载并校验通过的数据会被torrent客户端复用
+func (m *Manager) RetryTask(taskID string) error {
+	task, err := m.taskRepo.GetByTaskID(taskID)
+	if err != nil {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	if task.Status != domain.TaskStatusError && task.Status != domain.TaskStatusPermanentlyFailed {
+		return fmt.Errorf("task %s is %s, only failed tasks can be retried", taskID, task.Status)
+	}
 
-	// 从内存中移除torrent实例
+	m.mutex.Lock()
+	m.cancelTaskLocked(taskID)
 	if torrentInstance, exists := m.activeTasks[taskID]; exists {
 		torrentInstance.Drop()
 		delete(m.activeTasks, taskID)
 	}
+	m.mutex.Unlock()
+
+	task.Status = domain.TaskStatusPending
+	task.ErrorCode = ""
+	task.UpdatedAt = time.Now()
+	if err := m.taskRepo.Update(task); err != nil {
+		return err
+	}
+
+	m.taskLog.Info(taskID, tasklog.SourceTask, "retrying download")
+	m.schedule(task)
+	return nil
+}
+
+// RemoveTask 删除任务，purgeFiles为true时一并删除其在下载目录中的文件
+func (m *Manager) RemoveTask(taskID string, purgeFiles bool) error {
+	// 持锁时只把任务移出队列和内存，丢弃torrent与删除文件可能很慢，在锁外进行
+	m.mutex.Lock()
+	m.unqueueLocked(taskID)
+	m.cancelTaskLocked(taskID)
+	torrentInstance, exists := m.activeTasks[taskID]
+	delete(m.activeTasks, taskID)
+	m.mutex.Unlock()
+
+	// 结束下载协程并丢弃torrent实例，释放文件句柄后再删除文件
+	if exists {
+		torrentInstance.Drop()
+	}
+
+	if !purgeFiles {
+		log.Printf("Removing task %s, keeping its downloaded files", taskID)
+	} else if task, err := m.taskRepo.GetByTaskID(taskID); err == nil {
+		m.removeDownloadedFiles(task)
+	}
+
+	if err := m.taskLog.Remove(taskID); err != nil {
+		log.Printf("Failed to remove task log for %s: %v", taskID, err)
+	}
+
+	if m.progress != nil {
+		m.progress.Forget(taskID)
+	}
 
 	// 从数据库删除
 	return m.taskRepo.Delete(taskID)
 }
 
-// downloadTask 执行下载任务
+// removeDownloadedFiles 删除任务已下载的文件，只会删除下载根目录之内的文件
+func (m *Manager) removeDownloadedFiles(task *models.Task) {
+	files, err := task.GetTorrentFiles()
+	if err != nil {
+		log.Printf("Failed to parse torrent files of task %s: %v", task.TaskID, err)
+		return
+	}
+	root, err := filepath.Abs(m.downloadPath)
+	if err != nil {
+		log.Printf("Failed to resolve download path for task %s: %v", task.TaskID, err)
+		return
+	}
+
+	removed, bytes := removeTaskFiles(task.TaskID, root, files, false)
+	if len(removed) > 0 {
+		log.Printf("Removed %d downloaded files (%d bytes) of task %s", len(removed), bytes, task.TaskID)
+	}
+}
+
+// rejectTorrent 丢弃元数据超限的种子并将任务标记为错误，不保存文件列表
+func (m *Manager) rejectTorrent(task *models.Task, t *torrent.Torrent, reason error) {
+	log.Printf("Rejecting torrent for task %s: %v", task.TaskID, reason)
+	m.taskLog.Error(task.TaskID, tasklog.SourceDownload, "torrent rejected: %v", reason)
+	m.failDownload(task, t, domain.ClassifyDownloadError(reason, domain.ErrorCodeTorrentRejected))
+}
+
+// failDownload 丢弃torrent并将任务标记为错误
+func (m *Manager) failDownload(task *models.Task, t *torrent.Torrent, failure *domain.DownloadError) {
+	t.Drop()
+	m.mutex.Lock()
+	delete(m.activeTasks, task.TaskID)
+	m.mutex.Unlock()
+
+	task.SetMetadata(recordFailure(task, failure))
+	m.taskRepo.Update(task)
+	m.statusChan <- task
+}
+
+// recordFailure 将任务标记为错误并记录错误码，返回写入了原因（error）与能否自动重试（retryable）的元数据，
+// 由调用方补充其他字段后保存
+func recordFailure(task *models.Task, failure *domain.DownloadError) map[string]interface{} {
+	task.Status = domain.TaskStatusError
+	task.ErrorCode = failure.Code
+	metadata, _ := task.GetMetadata()
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["error"] = failure.Error()
+	metadata["retryable"] = failure.Retryable()
+	return metadata
+}
+
+// AbortTask 停止任务并标记为错误，已下载的数据保留在磁盘上。错误码取自reason，
+// 没有错误码时为internal；中止的任务不自动重试
+func (m *Manager) AbortTask(taskID string, reason error) error {
+	m.mutex.Lock()
+	m.unqueueLocked(taskID)
+	m.cancelTaskLocked(taskID)
+	if torrentInstance, exists := m.activeTasks[taskID]; exists {
+		torrentInstance.Drop()
+		delete(m.activeTasks, taskID)
+	}
+	m.mutex.Unlock()
+
+	task, err := m.taskRepo.GetByTaskID(taskID)
+	if err != nil {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+
+	metadata := recordFailure(task, domain.ClassifyDownloadError(reason, domain.ErrorCodeInternal))
+	metadata["retryable"] = false
+	task.SetMetadata(metadata)
+	if err := m.taskRepo.Update(task); err != nil {
+		return err
+	}
+
+	m.taskLog.Error(taskID, tasklog.SourceTask, "task aborted: %v", reason)
+	m.statusChan <- task
+	return nil
+}
+
+// cancelTaskLocked 取消任务的下载协程，协程在下一次检查时退出。调用方持有m.mutex
+func (m *Manager) cancelTaskLocked(taskID string) {
+	if cancel, exists := m.cancelFuncs[taskID]; exists {
+		cancel()
+		delete(m.cancelFuncs, taskID)
+	}
+}
+
+// downloadTask 执行下载任务，调用前任务已占用下载名额，返回时释放
 func (m *Manager) downloadTask(task *models.Task) {
+	defer m.releaseSlot(task)
+
+	// 暂停、删除等操作通过取消ctx让协程立即退出，不必等下一次轮询数据库
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mutex.Lock()
+	m.cancelFuncs[task.TaskID] = cancel
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		// 被取消时取消方已删除记录，之后可能已有同一任务的新协程登记
+		if ctx.Err() == nil {
+			delete(m.cancelFuncs, task.TaskID)
+		}
+		m.mutex.Unlock()
+		cancel()
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Download task %s panicked: %v", task.TaskID, r)
-			task.Status = domain.TaskStatusError
-			metadata, _ := task.GetMetadata()
-			metadata["error"] = fmt.Sprintf("panic: %v", r)
-			task.SetMetadata(metadata)
+			m.taskLog.Error(task.TaskID, tasklog.SourceDownload, "download panicked: %v", r)
+			task.SetMetadata(recordFailure(task, domain.NewDownloadError(domain.ErrorCodeInternal, fmt.Errorf("panic: %v", r))))
 			m.taskRepo.Update(task)
 			m.statusChan <- task
 		}
@@ -223,41 +587,36 @@ func (m *Manager) downloadTask(task *models.Task) {
 
 	log.Printf("Starting download for task %s: %s", task.TaskID, task.MagnetURL)
 
+	// 开始前查询下载目录的剩余空间，拿到元数据后判断能否放下种子；无法查询时不检查
+	available, freeErr := m.diskFree(m.downloadPath)
+	if freeErr != nil && freeErr != diskspace.ErrUnsupported {
+		log.Printf("Failed to check free space of %s: %v", m.downloadPath, freeErr)
+	}
+
 	// 添加torrent
-	t, err := m.client.AddMagnet(task.MagnetURL)
+	t, err := m.client.AddMagnet(v1MagnetURL(task.MagnetURL))
 	if err != nil {
 		log.Printf("Failed to add magnet for task %s: %v", task.TaskID, err)
-		task.Status = domain.TaskStatusError
-		metadata, _ := task.GetMetadata()
-		metadata["error"] = err.Error()
-		task.SetMetadata(metadata)
+		m.taskLog.Error(task.TaskID, tasklog.SourceDownload, "failed to add magnet: %v", err)
+		task.SetMetadata(recordFailure(task, domain.ClassifyDownloadError(err, domain.ErrorCodeMagnetInvalid)))
 		m.taskRepo.Update(task)
 		m.statusChan <- task
 		return
 	}
 
-	// 为种子添加更多的 trackers 以提高发现速度
-	publicTrackers := []string{
-		"udp://tracker.opentrackr.org:1337/announce",
-		"udp://tracker.openbittorrent.com:6969/announce",
-		"udp://open.stealth.si:80/announce",
-		"udp://exodus.desync.com:6969/announce",
-		"udp://explodie.org:6969/announce",
-		"http://tracker.opentrackr.org:1337/announce",
-		"http://tracker.openbittorrent.com:80/announce",
-		"udp://tracker.torrent.eu.org:451/announce",
-		"udp://tracker.moeking.me:6969/announce",
-		"udp://bt.oiyo.tk:6969/announce",
-		"https://tracker.nanoha.org:443/announce",
-		"https://tracker.lilithraws.org:443/announce",
-	}
-	for _, tracker := range publicTrackers {
-		t.AddTrackers([][]string{{tracker}})
+	m.applyCachedMetadata(task.TaskID, t)
+
+	// 为种子添加更多的 trackers 以提高发现速度。磁力链接自带tracker时可能是私有种子，
+	// 等拿到元数据确认不是私有种子后再追加
+	deferPublicTrackers := magnetHasTrackers(task.MagnetURL)
+	if !deferPublicTrackers {
+		m.addPublicTrackers(task.TaskID, t)
 	}
 
 	// 保存torrent实例到内存
 	m.mutex.Lock()
 	m.activeTasks[task.TaskID] = t
+	m.holdIfQuietLocked(t)
 	m.mutex.Unlock()
 
 	// 更新任务状态为下载中
@@ -266,16 +625,92 @@ func (m *Manager) downloadTask(task *models.Task) {
 	m.taskRepo.Update(task)
 	m.statusChan <- task
 
-	// 等待torrent信息
-	<-t.GotInfo()
+	// 等待torrent信息，长时间拿不到元数据时记录tracker/peer状况，超过metadataTimeout仍拿不到时任务失败。
+	// 静默时段内传输暂停，这段时间不计入等待时长
+	metadataWait := time.NewTicker(30 * time.Second)
+	m.mutex.RLock()
+	metadataTimeout := m.metadataTimeout
+	m.mutex.RUnlock()
+	waitStart, quietAtStart := time.Now(), m.quietElapsed()
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if metadataTimeout > 0 {
+		timer = time.NewTimer(metadataTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+waitInfo:
+	for {
+		select {
+		case <-t.GotInfo():
+			break waitInfo
+		case <-timeout:
+			waited := time.Since(waitStart) - (m.quietElapsed() - quietAtStart)
+			if waited < metadataTimeout {
+				timer.Reset(metadataTimeout - waited)
+				continue
+			}
+			metadataWait.Stop()
+			stats := t.Stats()
+			failure := domain.NewDownloadError(domain.ErrorCodeMetadataTimeout,
+				fmt.Errorf("no metadata after %s: %d known peers, %d active", metadataTimeout, stats.TotalPeers, stats.ActivePeers))
+			log.Printf("Task %s: %v", task.TaskID, failure)
+			m.taskLog.Error(task.TaskID, tasklog.SourceTracker, "%v", failure)
+			m.failDownload(task, t, failure)
+			return
+		case <-t.Closed():
+			// 等待元数据期间被暂停、删除或中止
+			metadataWait.Stop()
+			return
+		case <-ctx.Done():
+			metadataWait.Stop()
+			return
+		case <-metadataWait.C:
+			stats := t.Stats()
+			m.taskLog.Warn(task.TaskID, tasklog.SourceTracker, "still waiting for metadata: %d known peers, %d active",
+				stats.TotalPeers, stats.ActivePeers)
+		}
+	}
+	metadataWait.Stop()
 
-	// 更新任务信息
-	task.Size = t.Length()
-	task.TorrentName = t.Name()
+	// 在序列化和入库之前检查元数据大小
+	if err := m.metadataLimits.checkFileCount(len(t.Files())); err != nil {
+		m.rejectTorrent(task, t, err)
+		return
+	}
+
+	// 私有种子不追加公开tracker、不走DHT/PEX，并在元数据中标记供界面显示。
+	// 手动重试时的私有种子确认只写入数据库，这里重新读取
+	metadata, _ := task.GetMetadata()
+	if stored, err := m.taskRepo.GetByTaskID(task.TaskID); err == nil {
+		if storedMetadata, err := stored.GetMetadata(); err == nil && storedMetadata != nil {
+			metadata = storedMetadata
+		}
+	}
+	m.mutex.RLock()
+	requireConfirmation := m.requirePrivateConfirmation
+	m.mutex.RUnlock()
+	private, err := checkPrivateTorrent(t.Info(), requireConfirmation, metadata)
+	if private {
+		metadata["private"] = true
+	}
+	task.SetMetadata(metadata)
+	if err != nil {
+		m.rejectTorrent(task, t, err)
+		return
+	}
+	if private {
+		isolated, err := m.isolatePrivateTorrent(task, t)
+		if err != nil {
+			m.rejectTorrent(task, t, err)
+			return
+		}
+		t = isolated
+	} else if deferPublicTrackers {
+		m.addPublicTrackers(task.TaskID, t)
+	}
 
-	// 保存文件信息
 	files := make([]models.TorrentFileInfo, len(t.Files()))
-	fileNames := make([]string, len(t.Files()))
 	for i, file := range t.Files() {
 		files[i] = models.TorrentFileInfo{
 			FileName:   file.DisplayPath(),
@@ -283,69 +718,144 @@ func (m *Manager) downloadTask(task *models.Task) {
 			FilePath:   file.Path(),
 			IsSelected: true,
 		}
-		fileNames[i] = file.Path()
 	}
-	task.SetTorrentFiles(files)
+
+	// 恢复的任务沿用之前的文件选择，选择变化时重新计算大小；新任务应用提交时的选择
+	previousFiles, _ := task.GetTorrentFiles()
+	var size int64
+	if selection := requestedSelection(metadata); len(previousFiles) == 0 && len(selection) > 0 {
+		if size, err = selectFiles(files, selection); err != nil {
+			m.rejectTorrent(task, t, err)
+			return
+		}
+	} else {
+		size = applyFileSelection(previousFiles, files)
+	}
+
+	serializedFiles, err := m.metadataLimits.checkMetadata(len(t.Metainfo().InfoBytes), files)
+	if err != nil {
+		m.rejectTorrent(task, t, err)
+		return
+	}
+	m.storeMetadata(t)
+
+	// 剩余空间放不下选中的文件和预留空间时不开始下载，避免写到一半空间耗尽
+	if freeErr == nil {
+		required := m.requiredSpace(size, task.Downloaded)
+		if err := checkFreeSpace(available, required); err != nil {
+			task.Size = size
+			task.TorrentName = t.Name()
+			task.InfoHash = t.InfoHash().HexString()
+			task.TorrentFiles = serializedFiles
+			m.rejectForDiskSpace(task, t, available, required, err)
+			return
+		}
+		m.clearDiskShortfall()
+	}
+
+	// 只下载选中的文件，进度只统计选中的文件
+	source := applyFilePriorities(t, files)
+	stream := m.prioritizeStreamFile(task, t, files)
+
+	// 更新任务信息。已下载字节数从torrent校验后的实际完成量开始，而不是数据库中的旧值
+	if task.Size > 0 && task.Size != size {
+		log.Printf("Task %s size changed from %d to %d bytes", task.TaskID, task.Size, size)
+	}
+	task.Size = size
+	task.TorrentName = t.Name()
+	task.InfoHash = t.InfoHash().HexString()
+	task.TorrentFiles = serializedFiles
+	tracker := newProgressTracker(task.Size, source, time.Now())
+	task.Downloaded = tracker.lastDownloaded
+	task.Progress = progressPercent(task.Downloaded, task.Size)
 	m.taskRepo.Update(task)
 
 	log.Printf("Got torrent info for task %s: %s, size: %d bytes", task.TaskID, t.Name(), task.Size)
+	m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "got torrent info: %s, %d files, %d bytes", t.Name(), len(files), task.Size)
 
-	// 开始下载所有文件
-	t.DownloadAll()
+	if m.metadataHandler != nil {
+		m.metadataHandler(task)
+	}
 
 	// 监控下载进度
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
-	var lastDownloaded int64
-	lastTime := time.Now()
+	lastRead := usefulBytesRead(t)
+	diskPaused := false
 
 	for {
 		select {
+		case <-ctx.Done():
+			// 任务被暂停、删除或中止
+			return
+
 		case <-ticker.C:
 			// 从数据库重新获取任务状态，以防被外部暂停
 			currentTask, err := m.taskRepo.GetByTaskID(task.TaskID)
 			if err != nil {
 				log.Printf("Failed to get task status: %v", err)
+				m.taskLog.Error(task.TaskID, tasklog.SourceDownload, "stopped monitoring, failed to load task: %v", err)
 				return
 			}
 
-			if currentTask.Status != domain.TaskStatusDownloading {
+			// 流式转码开始后任务状态变为transcoding或ready，下载继续
+			if currentTask.Status != domain.TaskStatusDownloading && !stream.transcoding(currentTask.Status) {
 				return
 			}
 
-			// 更新进度
-			downloaded := t.BytesCompleted()
-			progress := 0
-			if task.Size > 0 {
-				progress = int((downloaded * 100) / task.Size)
+			// 剩余空间不足时暂停写入分片，空间恢复后继续
+			m.syncDiskState(task, t, &diskPaused)
+
+			// SelectFiles修改了文件选择时按新的选择统计进度
+			if currentTask.TorrentFiles != task.TorrentFiles {
+				if selected, err := currentTask.GetTorrentFiles(); err == nil && len(selected) == len(t.Files()) {
+					task.TorrentFiles = currentTask.TorrentFiles
+					task.Size = currentTask.Size
+					source = applyFilePriorities(t, selected)
+					tracker = newProgressTracker(task.Size, source, time.Now())
+				}
 			}
 
-			// 计算速度
-			currentTime := time.Now()
-			elapsedTime := currentTime.Sub(lastTime).Seconds()
-			var speed int64
-			if elapsedTime > 0 {
-				speed = (downloaded - lastDownloaded) / int64(elapsedTime)
-			}
-			lastDownloaded = downloaded
-			lastTime = currentTime
+			// 更新进度，已下载字节数与进度在入库前已限制在合法范围内
+			downloaded, progress, speed := tracker.sample(source, time.Now())
 
 			// 更新数据库
-			m.taskRepo.UpdateProgress(task.TaskID, progress, speed, downloaded)
+			m.recordProgress(task.TaskID, progress, speed, downloaded)
+
+			// 累计从BT网络接收的有效数据量
+			if read := usefulBytesRead(t); read > lastRead {
+				m.recordDownloadedBytes(task, read-lastRead)
+				lastRead = read
+			}
 
 			// 更新任务对象用于发送状态
 			task.Progress = progress
 			task.Speed = speed
 			task.Downloaded = downloaded
+			task.Peers = t.Stats().ActivePeers
+			task.ETASeconds = estimateETA(task.Size, downloaded, speed)
 			task.UpdatedAt = time.Now()
 
 			// 检查是否完成
 			if progress >= 100 {
 				task.Status = domain.TaskStatusCompleted
 				task.UpdatedAt = time.Now()
-				m.taskRepo.Update(task)
+				if batcher := m.progressBatcher(); batcher != nil {
+					batcher.Forget(task.TaskID)
+				}
+				if stream.transcoding(currentTask.Status) {
+					// 保留流式转码写入的状态与转码结果，只更新下载进度
+					currentTask.Progress = progress
+					currentTask.Speed = speed
+					currentTask.Downloaded = downloaded
+					currentTask.UpdatedAt = task.UpdatedAt
+					m.taskRepo.Update(currentTask)
+				} else {
+					m.taskRepo.Update(task)
+				}
 				log.Printf("Download completed for task %s", task.TaskID)
+				m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "download completed, %d bytes", downloaded)
 
 				// 从活跃任务中移除
 				m.mutex.Lock()
@@ -356,6 +866,8 @@ func (m *Manager) downloadTask(task *models.Task) {
 				return
 			}
 
+			m.notifyStreamReady(task, t, stream)
+
 			// 发送状态更新
 			m.statusChan <- task
 
@@ -365,21 +877,106 @@ func (m *Manager) downloadTask(task *models.Task) {
 	}
 }
 
-// restoreActiveTasks 恢复之前未完成的任务
+// restoreActiveTasks 恢复之前未完成的任务：下载中的任务直接恢复并占用名额，已有下载协程的跳过；
+// 排队中的任务重新放入等待队列；暂停的任务保持暂停，由ResumeTask显式恢复
 func (m *Manager) restoreActiveTasks() error {
 	tasks, err := m.taskRepo.GetByStatus(domain.TaskStatusDownloading)
 	if err != nil {
 		return err
 	}
 
-	for _, task := range tasks {
+	for i := range tasks {
+		task := &tasks[i]
+		m.mutex.Lock()
+		if m.isRunningLocked(task.TaskID) {
+			m.mutex.Unlock()
+			log.Printf("Task %s is already downloading, not restoring it again", task.TaskID)
+			continue
+		}
+		m.running[task] = true
+		m.mutex.Unlock()
 		log.Printf("Restoring active task: %s", task.TaskID)
-		go m.downloadTask(&task)
+		go m.downloadTask(task)
+	}
+
+	paused, err := m.GetTasksByStatus(domain.TaskStatusPaused)
+	if err != nil {
+		return err
+	}
+	if len(paused) > 0 {
+		log.Printf("%d paused tasks stay paused until resumed", len(paused))
 	}
 
+	if err := m.startNextPending(); err != nil {
+		return err
+	}
+
+	// 名额占满后剩下的等待中任务放回内存中的优先级队列
+	pending, err := m.taskRepo.GetByStatus(domain.TaskStatusPending)
+	if err != nil {
+		return err
+	}
+	queued := 0
+	m.mutex.Lock()
+	for i := range pending {
+		if pending[i].WorkerID == m.workerID && !m.isRunningLocked(pending[i].TaskID) {
+			m.enqueueLocked(&pending[i])
+			queued++
+		}
+	}
+	ready := m.takeRunnableLocked()
+	m.mutex.Unlock()
+	if queued > 0 {
+		log.Printf("Restored %d queued tasks", queued)
+	}
+	m.launch(ready)
+
 	return nil
 }
 
+// startNextPending 重启后按数据库中的顺序（GetNextPending）开始等待中的任务，直到名额占满。
+// 开始前先把任务标记为下载中，下一次查询不会再取到它
+func (m *Manager) startNextPending() error {
+	for {
+		m.mutex.RLock()
+		full := m.quiet || len(m.running) >= m.maxTasks
+		m.mutex.RUnlock()
+		if full {
+			return nil
+		}
+
+		next, err := m.taskRepo.GetNextPending(m.workerID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.taskRepo.UpdateStatus(next.TaskID, domain.TaskStatusDownloading); err != nil {
+			return err
+		}
+		next.Status = domain.TaskStatusDownloading
+
+		m.mutex.Lock()
+		m.running[next] = true
+		m.mutex.Unlock()
+		m.launch([]*models.Task{next})
+	}
+}
+
+// isRunningLocked 任务是否已有下载协程或torrent实例，调用方需持有m.mutex
+func (m *Manager) isRunningLocked(taskID string) bool {
+	if _, exists := m.activeTasks[taskID]; exists {
+		return true
+	}
+	for task := range m.running {
+		if task.TaskID == taskID {
+			return true
+		}
+	}
+	return false
+}
+
 // statusMonitor 状态监控
 func (m *Manager) statusMonitor() {
 	for task := range m.statusChan {
@@ -409,9 +1006,38 @@ func (m *Manager) SetExternalStatusHandler(handler func(*models.Task)) {
 	m.externalStatusHandler = handler
 }
 
+// SetMetadataHandler 设置获取到种子元数据后的回调
+func (m *Manager) SetMetadataHandler(handler func(*models.Task)) {
+	m.metadataHandler = handler
+}
+
+// recordDownloadedBytes 累加任务的下载流量，同时更新内存中的任务对象以免后续整体保存时覆盖
+func (m *Manager) recordDownloadedBytes(task *models.Task, delta int64) {
+	task.BytesDownloaded += delta
+	if err := m.taskRepo.AddTraffic(task.TaskID, delta, 0); err != nil {
+		log.Printf("Failed to record traffic for task %s: %v", task.TaskID, err)
+	}
+}
+
+// SetMetadataLimits 设置种子元数据的文件数与大小上限
+func (m *Manager) SetMetadataLimits(limits MetadataLimits) {
+	m.metadataLimits = limits
+}
+
+// SetTaskLogger 设置按任务划分的日志记录器
+func (m *Manager) SetTaskLogger(logger *tasklog.Logger) {
+	m.taskLog = logger
+}
+
 // generateTaskID 生成任务ID
 func generateTaskID() string {
 	return fmt.Sprintf("task_%d", time.Now().UnixNano())
 }
 
 var _ Service = (*Manager)(nil)
+
+// usefulBytesRead 返回种子已从对等节点接收的有效数据字节数
+func usefulBytesRead(t *torrent.Torrent) int64 {
+	stats := t.Stats()
+	return stats.BytesReadUsefulData.Int64()
+}
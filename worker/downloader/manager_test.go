@@ -1,9 +1,29 @@
 package downloader
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"worker/database"
+	"worker/domain"
 	"worker/models"
+	"worker/trackers"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"golang.org/x/time/rate"
 )
 
 func TestManagerImplementsService(t *testing.T) {
@@ -26,3 +46,1774 @@ func TestManagerExternalStatusHandler(t *testing.T) {
 		t.Fatalf("external status handler was not invoked")
 	}
 }
+
+func TestMetadataLimitsRejectOversizedTorrent(t *testing.T) {
+	files := make([]models.TorrentFileInfo, 5000)
+	for i := range files {
+		files[i] = models.TorrentFileInfo{
+			FileName: fmt.Sprintf("dir/file_%05d.bin", i),
+			FileSize: 1024,
+			FilePath: fmt.Sprintf("dir/file_%05d.bin", i),
+		}
+	}
+
+	limits := MetadataLimits{MaxFiles: 1000}
+	if _, err := limits.checkMetadata(1024, files); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected too many files to be rejected, got %v", err)
+	}
+
+	limits = MetadataLimits{MaxFiles: 10000, MaxBytes: 64 * 1024}
+	if _, err := limits.checkMetadata(1024, files); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected oversized file list to be rejected, got %v", err)
+	}
+
+	if _, err := limits.checkMetadata(128*1024, files[:1]); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected oversized info dictionary to be rejected, got %v", err)
+	}
+
+	serialized, err := limits.checkMetadata(1024, files[:10])
+	if err != nil || serialized == "" {
+		t.Fatalf("small torrent should be accepted: %v", err)
+	}
+}
+
+func TestPruneTaskDataStaysInsideDownloadRoot(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	base := t.TempDir()
+	root := filepath.Join(base, "downloads")
+	outside := filepath.Join(base, "outside.txt")
+	for path, size := range map[string]int{
+		filepath.Join(root, "Movie", "movie.mkv"):     300,
+		filepath.Join(root, "Movie", "subs", "a.srt"): 20,
+		outside: 10,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	mgr := New(root, "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+
+	task := &models.Task{TaskID: "task-1", MagnetURL: "magnet:?xt=urn:btih:dummy", Status: domain.TaskStatusError}
+	task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FilePath: "Movie/movie.mkv"},
+		{FilePath: "Movie/subs/a.srt"},
+		{FilePath: "../outside.txt"},
+	})
+	if err := mgr.taskRepo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+
+	preview, err := mgr.PruneTaskData("task-1", true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(preview.Files) != 2 || preview.ReclaimedBytes != 320 {
+		t.Fatalf("unexpected dry run result: %+v", preview)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Movie", "movie.mkv")); err != nil {
+		t.Fatalf("dry run must not delete files: %v", err)
+	}
+
+	result, err := mgr.PruneTaskData("task-1", false)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if result.ReclaimedBytes != 320 {
+		t.Fatalf("unexpected reclaimed bytes: %d", result.ReclaimedBytes)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Movie")); !os.IsNotExist(err) {
+		t.Fatalf("expected empty task directory to be removed")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside download root must be kept: %v", err)
+	}
+
+	stored, _ := mgr.taskRepo.GetByTaskID("task-1")
+	metadata, _ := stored.GetMetadata()
+	if metadata["data_pruned"] != true {
+		t.Fatalf("expected prune to be recorded in metadata: %v", metadata)
+	}
+}
+
+func TestRemoveTaskDeletesDownloadedFiles(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	base := t.TempDir()
+	root := filepath.Join(base, "downloads")
+	movie := filepath.Join(root, "Movie", "movie.mkv")
+	other := filepath.Join(root, "Other", "keep.mkv")
+	outside := filepath.Join(base, "outside.txt")
+	for _, path := range []string{movie, other, outside} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	mgr := New(root, "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+
+	task := &models.Task{TaskID: "task-1", MagnetURL: "magnet:?xt=urn:btih:dummy", Status: domain.TaskStatusPaused}
+	task.SetTorrentFiles([]models.TorrentFileInfo{
+		{FilePath: "Movie/movie.mkv"},
+		{FilePath: "../outside.txt"},
+	})
+	if err := mgr.taskRepo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+
+	kept := &models.Task{TaskID: "task-2", MagnetURL: "magnet:?xt=urn:btih:other", Status: domain.TaskStatusPaused}
+	kept.SetTorrentFiles([]models.TorrentFileInfo{{FilePath: "Other/keep.mkv"}})
+	if err := mgr.taskRepo.Create(kept); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	if err := mgr.RemoveTask("task-2", false); err != nil {
+		t.Fatalf("remove keeping files: %v", err)
+	}
+	if _, err := mgr.taskRepo.GetByTaskID("task-2"); err == nil {
+		t.Fatalf("expected the record of the task keeping its files to be deleted")
+	}
+
+	if err := mgr.RemoveTask("task-1", true); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Movie")); !os.IsNotExist(err) {
+		t.Fatalf("expected the task's files and empty directory to be deleted")
+	}
+	for _, path := range []string{other, outside} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("file %s must be kept: %v", path, err)
+		}
+	}
+	if _, err := mgr.taskRepo.GetByTaskID("task-1"); err == nil {
+		t.Fatalf("expected the task record to be deleted")
+	}
+}
+
+func TestEncodePieceRunsClipsToFileRange(t *testing.T) {
+	runs := []pieceRun{
+		{complete: true, length: 10},  // 0-9
+		{complete: false, length: 5},  // 10-14
+		{complete: false, length: 5},  // 15-19，与前一段状态相同应合并
+		{complete: true, length: 30},  // 20-49
+		{complete: false, length: 10}, // 50-59
+	}
+
+	encoded, completed := encodePieceRuns(runs, 5, 55)
+	want := []int{5, 10, 30, 5}
+	if len(encoded) != len(want) {
+		t.Fatalf("expected runs %v, got %v", want, encoded)
+	}
+	for i := range want {
+		if encoded[i] != want[i] {
+			t.Fatalf("expected runs %v, got %v", want, encoded)
+		}
+	}
+	if completed != 35 {
+		t.Fatalf("expected 35 completed pieces, got %d", completed)
+	}
+
+	// 文件从未完成的分片开始时第一个游程为0
+	encoded, _ = encodePieceRuns(runs, 12, 20)
+	if len(encoded) != 2 || encoded[0] != 0 || encoded[1] != 8 {
+		t.Fatalf("expected [0 8], got %v", encoded)
+	}
+}
+
+func TestEdgePiecesCoverHeadAndTail(t *testing.T) {
+	// 文件从第2个分片中间开始，长1000字节，分片长100字节：占用分片2-12
+	got := edgePieces(250, 1000, 100, 150, 120)
+	want := []int{2, 3, 11, 12}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected pieces %v, got %v", want, got)
+	}
+
+	// 头尾相接时覆盖整个文件且不重复
+	if got := edgePieces(0, 300, 100, 200, 200); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Fatalf("expected all pieces of a small file, got %v", got)
+	}
+	if got := edgePieces(0, 0, 100, 200, 200); len(got) != 0 {
+		t.Fatalf("expected no pieces for an empty file, got %v", got)
+	}
+}
+
+func TestSequentialWindowsSplitFileIntoPriorityBands(t *testing.T) {
+	// 文件从第2个分片中间开始，长1000字节，分片长100字节，窗口300字节
+	got := sequentialWindows(250, 1000, 100, 300, 4)
+	want := [][]int{{2, 3, 4, 5}, {6, 7, 8}, {9, 10, 11}, {12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected windows %v, got %v", want, got)
+	}
+
+	// 只取前两个窗口
+	if got := sequentialWindows(0, 1000, 100, 300, 2); !reflect.DeepEqual(got, [][]int{{0, 1, 2}, {3, 4, 5}}) {
+		t.Fatalf("expected two windows, got %v", got)
+	}
+	if got := sequentialWindows(0, 0, 100, 300, 4); len(got) != 0 {
+		t.Fatalf("expected no windows for an empty file, got %v", got)
+	}
+}
+
+// mp4Box 生成指定类型和总长度的MP4 box
+func mp4Box(kind string, size int) []byte {
+	box := make([]byte, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], kind)
+	return box
+}
+
+func TestMoovFirstDetectsFaststartMP4(t *testing.T) {
+	faststart := bytes.Join([][]byte{mp4Box("ftyp", 24), mp4Box("moov", 100), mp4Box("mdat", 200)}, nil)
+	if first, err := moovFirst(bytes.NewReader(faststart), 1<<20); !first {
+		t.Fatalf("expected moov before mdat, got %v", err)
+	}
+
+	// 相机直接录制的文件moov在末尾
+	tailMoov := bytes.Join([][]byte{mp4Box("ftyp", 24), mp4Box("mdat", 200), mp4Box("moov", 100)}, nil)
+	if first, _ := moovFirst(bytes.NewReader(tailMoov), 1<<20); first {
+		t.Fatal("expected moov after mdat to be rejected")
+	}
+
+	// moov在检查范围之外时按不可流式处理
+	padded := bytes.Join([][]byte{mp4Box("ftyp", 24), mp4Box("free", 1000), mp4Box("moov", 100)}, nil)
+	if first, _ := moovFirst(bytes.NewReader(padded), 512); first {
+		t.Fatal("expected moov beyond the limit to be rejected")
+	}
+	if first, _ := moovFirst(bytes.NewReader(padded), 1<<20); !first {
+		t.Fatal("expected moov after a free box within the limit to be found")
+	}
+}
+
+func TestEncodePieceRunsStaysCompact(t *testing.T) {
+	// 10万个分片中零散完成的区段
+	runs := make([]pieceRun, 0, 200)
+	for i := 0; i < 100; i++ {
+		runs = append(runs, pieceRun{complete: true, length: 50}, pieceRun{complete: false, length: 950})
+	}
+
+	encoded, completed := encodePieceRuns(runs, 0, 100000)
+	if completed != 5000 {
+		t.Fatalf("expected 5000 completed pieces, got %d", completed)
+	}
+	data, err := json.Marshal(PieceMap{Runs: encoded, PieceCount: 100000})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if len(data) > 4096 {
+		t.Fatalf("expected payload under 4KB, got %d bytes", len(data))
+	}
+}
+
+func TestRestoreKeepsPausedTasksAndDoesNotRelaunchDownloads(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	// 离线的torrent客户端，任务停在等待元数据
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.client = client
+	mgr.publicTrackers = nil
+	mgr.taskRepo = database.NewTaskRepository()
+
+	// 重启前一个任务暂停、一个任务下载中
+	for _, task := range []*models.Task{
+		{TaskID: "paused", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("a", 40), Status: domain.TaskStatusPaused, WorkerID: "worker-1"},
+		{TaskID: "downloading", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("b", 40), Status: domain.TaskStatusDownloading, WorkerID: "worker-1"},
+	} {
+		if err := mgr.taskRepo.Create(task); err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+	}
+
+	if err := mgr.restoreActiveTasks(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	waitActive := func(taskID string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mgr.mutex.RLock()
+			_, active := mgr.activeTasks[taskID]
+			mgr.mutex.RUnlock()
+			if active {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("task %s was not started", taskID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitActive("downloading")
+
+	// 再次恢复不会为同一任务启动第二个下载协程
+	if err := mgr.restoreActiveTasks(); err != nil {
+		t.Fatalf("restore again: %v", err)
+	}
+	mgr.mutex.RLock()
+	running := len(mgr.running)
+	_, pausedActive := mgr.activeTasks["paused"]
+	mgr.mutex.RUnlock()
+	if running != 1 || pausedActive {
+		t.Fatalf("expected only the downloading task to run, got %d running (paused active: %v)", running, pausedActive)
+	}
+
+	paused, err := mgr.GetTasksByStatus(domain.TaskStatusPaused)
+	if err != nil || len(paused) != 1 || paused[0].TaskID != "paused" {
+		t.Fatalf("expected the paused task to be listed, got %v (%v)", paused, err)
+	}
+
+	// 暂停的任务由ResumeTask显式恢复
+	if err := mgr.ResumeTask("paused"); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	waitActive("paused")
+	if paused, _ := mgr.GetTasksByStatus(domain.TaskStatusPaused); len(paused) != 0 {
+		t.Fatalf("expected no paused tasks after resume, got %d", len(paused))
+	}
+}
+
+func TestRestoreStartsPendingTasksByPriority(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	// 离线的torrent客户端，任务停在等待元数据
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.client = client
+	mgr.publicTrackers = nil
+	mgr.taskRepo = database.NewTaskRepository()
+	mgr.SetMaxTasks(1)
+
+	// 重启前三个任务在排队，只有一个名额
+	base := time.Now()
+	for i, task := range []*models.Task{
+		{TaskID: "low", Priority: 2},
+		{TaskID: "high", Priority: 8},
+		{TaskID: "normal", Priority: 5},
+	} {
+		task.MagnetURL = "magnet:?xt=urn:btih:" + strings.Repeat(string(rune('a'+i)), 40)
+		task.Status = domain.TaskStatusPending
+		task.WorkerID = "worker-1"
+		task.CreatedAt = base.Add(time.Duration(i) * time.Second)
+		if err := mgr.taskRepo.Create(task); err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+	}
+
+	if err := mgr.restoreActiveTasks(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	snapshot := mgr.QueueSnapshot()
+	if len(snapshot.Running) != 1 || snapshot.Running[0].TaskID != "high" {
+		t.Fatalf("expected the high priority task to start, got %+v", snapshot.Running)
+	}
+	if len(snapshot.Pending) != 2 || snapshot.Pending[0].TaskID != "normal" || snapshot.Pending[1].TaskID != "low" {
+		t.Fatalf("expected normal then low to wait, got %+v", snapshot.Pending)
+	}
+	if stored, _ := mgr.taskRepo.GetByTaskID("high"); stored.Status != domain.TaskStatusDownloading {
+		t.Fatalf("expected the started task to be marked downloading, got %s", stored.Status)
+	}
+}
+
+func TestCancellingTaskStopsDownloadGoroutinePromptly(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	// 离线的torrent客户端，任务停在等待元数据
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.client = client
+	mgr.publicTrackers = nil
+	mgr.taskRepo = database.NewTaskRepository()
+	go func() {
+		for range mgr.statusChan {
+		}
+	}()
+
+	start := func(taskID, hash string) (*models.Task, chan struct{}) {
+		task := &models.Task{TaskID: taskID, MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat(hash, 40), Status: domain.TaskStatusPending, WorkerID: "worker-1"}
+		if err := mgr.taskRepo.Create(task); err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+		mgr.running[task] = true
+		done := make(chan struct{})
+		go func() {
+			mgr.downloadTask(task)
+			close(done)
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mgr.mutex.RLock()
+			_, active := mgr.activeTasks[taskID]
+			mgr.mutex.RUnlock()
+			if active {
+				return task, done
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("task %s was not started", taskID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitExit := func(done chan struct{}, what string) {
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("download goroutine still running 100ms after %s", what)
+		}
+	}
+
+	// 只取消ctx、不丢弃torrent，协程也立即退出
+	_, done := start("cancelled", "a")
+	mgr.mutex.Lock()
+	mgr.cancelTaskLocked("cancelled")
+	mgr.mutex.Unlock()
+	waitExit(done, "cancellation")
+
+	// 暂停结束协程但保留数据库记录
+	_, done = start("paused", "b")
+	if err := mgr.PauseTask("paused"); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	waitExit(done, "pause")
+	if stored, err := mgr.taskRepo.GetByTaskID("paused"); err != nil || stored.Status != domain.TaskStatusPaused {
+		t.Fatalf("expected the paused task to stay in the database, got %v (%v)", stored, err)
+	}
+
+	mgr.mutex.RLock()
+	remaining := len(mgr.cancelFuncs)
+	mgr.mutex.RUnlock()
+	if remaining != 0 {
+		t.Fatalf("expected no cancel funcs after the goroutines exited, got %d", remaining)
+	}
+}
+
+func TestDownloadFailuresCarryErrorCodes(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	// 离线的torrent客户端，拿不到元数据
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.client = client
+	mgr.publicTrackers = nil
+	mgr.taskRepo = database.NewTaskRepository()
+	mgr.SetMetadataTimeout(50 * time.Millisecond)
+	go func() {
+		for range mgr.statusChan {
+		}
+	}()
+
+	download := func(taskID, magnet string) *models.Task {
+		task := &models.Task{TaskID: taskID, MagnetURL: magnet, Status: domain.TaskStatusPending, WorkerID: "worker-1"}
+		if err := mgr.taskRepo.Create(task); err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+		mgr.running[task] = true
+		done := make(chan struct{})
+		go func() {
+			mgr.downloadTask(task)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("download of %s did not fail", taskID)
+		}
+		stored, err := mgr.taskRepo.GetByTaskID(taskID)
+		if err != nil {
+			t.Fatalf("load task: %v", err)
+		}
+		return stored
+	}
+
+	// 等待元数据超时可以自动重试
+	stored := download("timeout", "magnet:?xt=urn:btih:"+strings.Repeat("e", 40))
+	metadata, _ := stored.GetMetadata()
+	if stored.Status != domain.TaskStatusError || stored.ErrorCode != domain.ErrorCodeMetadataTimeout || metadata["retryable"] != true {
+		t.Fatalf("expected a retryable metadata_timeout, got %s %q %v", stored.Status, stored.ErrorCode, metadata)
+	}
+	if _, active := mgr.activeTasks["timeout"]; active {
+		t.Fatal("expected the timed out torrent to be dropped")
+	}
+
+	// 无法添加的磁力链接不可重试
+	stored = download("invalid", "magnet:?xt=urn:btih:zz")
+	metadata, _ = stored.GetMetadata()
+	if stored.ErrorCode != domain.ErrorCodeMagnetInvalid || metadata["retryable"] != false || metadata["error"] == "" {
+		t.Fatalf("expected a non-retryable magnet_invalid with the reason, got %q %v", stored.ErrorCode, metadata)
+	}
+
+	// 静默时段不计入等待时长，结束后才超时
+	mgr.SetQuiet(true)
+	quietTask := &models.Task{TaskID: "quiet", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("f", 40), Status: domain.TaskStatusPending, WorkerID: "worker-1"}
+	if err := mgr.taskRepo.Create(quietTask); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	mgr.running[quietTask] = true
+	quietDone := make(chan struct{})
+	go func() {
+		mgr.downloadTask(quietTask)
+		close(quietDone)
+	}()
+	select {
+	case <-quietDone:
+		t.Fatal("expected the metadata timeout to wait out quiet hours")
+	case <-time.After(300 * time.Millisecond):
+	}
+	mgr.SetQuiet(false)
+	select {
+	case <-quietDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the metadata timeout after quiet hours")
+	}
+	if stored, _ := mgr.taskRepo.GetByTaskID("quiet"); stored.ErrorCode != domain.ErrorCodeMetadataTimeout {
+		t.Fatalf("expected metadata_timeout after quiet hours, got %q", stored.ErrorCode)
+	}
+
+	// 重试清除错误码
+	if err := mgr.RetryTask("timeout"); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if stored, _ := mgr.taskRepo.GetByTaskID("timeout"); stored.ErrorCode != "" {
+		t.Fatalf("expected retry to clear the error code, got %q", stored.ErrorCode)
+	}
+
+	// 带错误码的错误保留完整原因，errors.Is按错误码匹配
+	failure := domain.ClassifyDownloadError(fmt.Errorf("%w: tracker not allowed", ErrInvalidMagnet), domain.ErrorCodeInternal)
+	if failure.Code != domain.ErrorCodeMagnetInvalid || !strings.Contains(failure.Error(), "tracker not allowed") || !errors.Is(failure, domain.ErrMagnetInvalid) {
+		t.Fatalf("expected magnet_invalid with the full reason, got %q %v", failure.Code, failure)
+	}
+	if failure := domain.ClassifyDownloadError(errors.New("boom"), domain.ErrorCodeInternal); failure.Code != domain.ErrorCodeInternal || !failure.Retryable() {
+		t.Fatalf("expected unclassified errors to fall back, got %q", failure.Code)
+	}
+}
+
+// fakeGate 记录下载是否被暂停写入
+type fakeGate struct{ disallowed bool }
+
+func (g *fakeGate) DisallowDataDownload() { g.disallowed = true }
+func (g *fakeGate) AllowDataDownload()    { g.disallowed = false }
+
+func TestDiskGuardPausesWritesUntilSpaceIsFreed(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+	free := uint64(500 << 20)
+	mgr.diskFree = func(string) (uint64, error) { return free, nil }
+	mgr.SetDiskGuard(100<<20, DiskFullPause)
+
+	task := &models.Task{TaskID: "task-1", MagnetURL: "magnet:?xt=urn:btih:dummy", Status: domain.TaskStatusDownloading, WorkerID: "worker-1"}
+	if err := mgr.taskRepo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	gate := &fakeGate{}
+	paused := false
+	subStatus := func() interface{} {
+		stored, err := mgr.taskRepo.GetByTaskID("task-1")
+		if err != nil {
+			t.Fatalf("load task: %v", err)
+		}
+		metadata, _ := stored.GetMetadata()
+		return metadata["sub_status"]
+	}
+
+	mgr.checkDiskSpace()
+	if mgr.DiskFull() || mgr.syncDiskState(task, gate, &paused) {
+		t.Fatal("enough free space must not pause the download")
+	}
+
+	// 下载途中剩余空间跌破阈值
+	free = 50 << 20
+	mgr.checkDiskSpace()
+	if !mgr.DiskFull() || !mgr.syncDiskState(task, gate, &paused) {
+		t.Fatal("expected low free space to pause the download")
+	}
+	if !gate.disallowed || subStatus() != SubStatusDiskFull {
+		t.Fatalf("expected piece writes paused with sub_status disk_full, got %v %v", gate.disallowed, subStatus())
+	}
+	if stored, _ := mgr.taskRepo.GetByTaskID("task-1"); stored.Status != domain.TaskStatusDownloading {
+		t.Fatalf("a paused write must not fail the task, got %s", stored.Status)
+	}
+	if mgr.syncDiskState(task, gate, &paused) {
+		t.Fatal("an unchanged disk state must not report a change")
+	}
+
+	// 保留期清理释放空间后自动恢复
+	free = 200 << 20
+	mgr.checkDiskSpace()
+	if mgr.DiskFull() || !mgr.syncDiskState(task, gate, &paused) {
+		t.Fatal("expected freed space to resume the download")
+	}
+	if gate.disallowed || subStatus() != nil {
+		t.Fatalf("expected piece writes resumed without sub_status, got %v %v", gate.disallowed, subStatus())
+	}
+
+	// fail方式中止占用下载名额的任务
+	mgr.SetDiskGuard(100<<20, DiskFullFail)
+	mgr.mutex.Lock()
+	mgr.running[task] = true
+	mgr.mutex.Unlock()
+	free = 10 << 20
+	mgr.checkDiskSpace()
+	stored, _ := mgr.taskRepo.GetByTaskID("task-1")
+	metadata, _ := stored.GetMetadata()
+	if stored.Status != domain.TaskStatusError || !strings.HasPrefix(fmt.Sprint(metadata["error"]), SubStatusDiskFull) {
+		t.Fatalf("expected the task to fail with disk_full, got %s %v", stored.Status, metadata["error"])
+	}
+	if mgr.syncDiskState(task, gate, &paused) || gate.disallowed {
+		t.Fatal("the fail action must not pause writes")
+	}
+}
+
+func TestDiskPreCheckRejectsDownloadsThatDoNotFit(t *testing.T) {
+	mgr := New(t.TempDir(), "worker-1")
+	// 10 GB种子已下载2 GB：还需8 GB，另外预留种子大小的20%
+	required := mgr.requiredSpace(10<<30, 2<<30)
+	if required != 8<<30+2<<30 {
+		t.Fatalf("expected 10 GB required with the default reserve, got %d", required)
+	}
+	mgr.SetDiskReserve(0)
+	if got := mgr.requiredSpace(10<<30, 2<<30); got != 8<<30 {
+		t.Fatalf("expected only the remaining bytes without reserve, got %d", got)
+	}
+	if err := checkFreeSpace(12<<30, required); err != nil {
+		t.Fatalf("enough space must pass, got %v", err)
+	}
+	shortErr := checkFreeSpace(4<<30, required)
+	if !errors.Is(shortErr, ErrInsufficientDiskSpace) || !strings.Contains(shortErr.Error(), fmt.Sprint(uint64(4<<30))) || !strings.Contains(shortErr.Error(), fmt.Sprint(required)) {
+		t.Fatalf("expected ErrInsufficientDiskSpace with both byte counts, got %v", shortErr)
+	}
+
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr.taskRepo = database.NewTaskRepository()
+	magnet := "magnet:?xt=urn:btih:" + strings.Repeat("d", 40)
+	task := &models.Task{TaskID: "task-1", MagnetURL: magnet, Status: domain.TaskStatusDownloading, WorkerID: "worker-1"}
+	if err := mgr.taskRepo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	tor, err := client.AddMagnet(magnet)
+	if err != nil {
+		t.Fatalf("add magnet: %v", err)
+	}
+	mgr.activeTasks[task.TaskID] = tor
+
+	mgr.rejectForDiskSpace(task, tor, 4<<30, required, shortErr)
+	stored, _ := mgr.taskRepo.GetByTaskID("task-1")
+	metadata, _ := stored.GetMetadata()
+	if stored.Status != domain.TaskStatusError || stored.ErrorCode != domain.ErrorCodeInsufficientDisk || metadata["error"] != ErrorInsufficientDisk || metadata["retryable"] != false {
+		t.Fatalf("expected a non-retryable insufficient_disk error, got %s %v", stored.Status, metadata)
+	}
+	if metadata["available_bytes"] != float64(4<<30) || metadata["required_bytes"] != float64(required) {
+		t.Fatalf("expected the byte counts in the metadata, got %v", metadata)
+	}
+	if shortfall := mgr.DiskShortfall(); shortfall.AvailableBytes != 4<<30 || shortfall.RequiredBytes != required {
+		t.Fatalf("expected the shortfall to be recorded, got %+v", shortfall)
+	}
+	if _, active := mgr.activeTasks[task.TaskID]; active {
+		t.Fatal("the rejected torrent must be dropped")
+	}
+	if update := <-mgr.statusChan; update.TaskID != "task-1" {
+		t.Fatalf("expected a status update for task-1, got %s", update.TaskID)
+	}
+
+	mgr.clearDiskShortfall()
+	if mgr.DiskShortfall().RequiredBytes != 0 {
+		t.Fatal("a download that fits must clear the shortfall")
+	}
+}
+
+func TestTorrentClientSurfacesListenPortBindFailure(t *testing.T) {
+	occupied, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("occupy port: %v", err)
+	}
+	defer occupied.Close()
+	port := occupied.Addr().(*net.TCPAddr).Port
+
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+
+	client, status, err := newTorrentClient(config, port)
+	if err != nil {
+		t.Fatalf("expected fallback to an automatic port, got %v", err)
+	}
+	defer client.Close()
+
+	if status.OK {
+		t.Fatalf("expected bind failure to be reported, got %+v", status)
+	}
+	if status.RequestedPort != port || status.Port == 0 || status.Port == port {
+		t.Fatalf("unexpected listen status: %+v", status)
+	}
+	if !strings.Contains(status.Warning, fmt.Sprint(port)) {
+		t.Fatalf("expected warning to name the configured port, got %q", status.Warning)
+	}
+	if err := CheckListenPort(port); err == nil {
+		t.Fatalf("expected self-test check to detect the occupied port")
+	}
+}
+
+func TestCheckListenStatusWithoutListener(t *testing.T) {
+	status := ListenStatus{RequestedPort: 0, Port: 0}
+	if checkListenStatus(&status) || status.Warning == "" {
+		t.Fatalf("expected missing listener to be reported, got %+v", status)
+	}
+
+	status = ListenStatus{RequestedPort: 0, Port: 51413}
+	if !checkListenStatus(&status) || status.Warning != "" {
+		t.Fatalf("expected automatic port to be healthy, got %+v", status)
+	}
+}
+
+// fakeTorrent 报告固定的已完成字节数，模拟重启后已校验的种子
+type fakeTorrent struct {
+	completed int64
+}
+
+func (f *fakeTorrent) BytesCompleted() int64 { return f.completed }
+
+func TestProgressTrackerStartsFromRestoredBytes(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	restored := &fakeTorrent{completed: 900}
+
+	tracker := newProgressTracker(1000, restored, start)
+	if tracker.lastDownloaded != 900 {
+		t.Fatalf("expected counter to start from completed bytes, got %d", tracker.lastDownloaded)
+	}
+
+	restored.completed = 950
+	downloaded, progress, speed := tracker.sample(restored, start.Add(2*time.Second))
+	if downloaded != 950 || progress != 95 || speed != 25 {
+		t.Fatalf("expected 950 bytes at 95%% and 25 B/s, got %d bytes, %d%%, %d B/s", downloaded, progress, speed)
+	}
+
+	// 重新校验分片后报告的完成量超过任务大小
+	restored.completed = 1040
+	downloaded, progress, _ = tracker.sample(restored, start.Add(4*time.Second))
+	if downloaded != 1000 || progress != 100 {
+		t.Fatalf("expected counters clamped to size, got %d bytes, %d%%", downloaded, progress)
+	}
+
+	restored.completed = 600
+	downloaded, progress, speed = tracker.sample(restored, start.Add(6*time.Second))
+	if downloaded != 600 || progress != 60 || speed != 0 {
+		t.Fatalf("expected regression to report no speed, got %d bytes, %d%%, %d B/s", downloaded, progress, speed)
+	}
+}
+
+func TestLiveStatsReportPeersAndETA(t *testing.T) {
+	for _, c := range []struct {
+		size, downloaded, speed, want int64
+	}{
+		{1000, 400, 200, 3},
+		{1000, 400, 250, 3},
+		{1000, 401, 200, 3},
+		{1000, 399, 200, 4},
+		{1000, 400, 0, -1},
+		{1000, 1000, 0, 0},
+	} {
+		if got := estimateETA(c.size, c.downloaded, c.speed); got != c.want {
+			t.Fatalf("estimateETA(%d, %d, %d) = %d, want %d", c.size, c.downloaded, c.speed, got, c.want)
+		}
+	}
+
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+	for _, task := range []*models.Task{
+		{TaskID: "active", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("a", 40), Status: domain.TaskStatusDownloading, Size: 1000, Downloaded: 400, Speed: 200, WorkerID: "worker-1"},
+		{TaskID: "stalled", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("b", 40), Status: domain.TaskStatusPaused, Size: 1000, Downloaded: 400, Speed: 200, WorkerID: "worker-1"},
+		{TaskID: "done", MagnetURL: "magnet:?xt=urn:btih:" + strings.Repeat("c", 40), Status: domain.TaskStatusReady, Size: 1000, Downloaded: 1000, WorkerID: "worker-1"},
+	} {
+		if err := mgr.taskRepo.Create(task); err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+	}
+	active, err := client.AddMagnet("magnet:?xt=urn:btih:" + strings.Repeat("a", 40))
+	if err != nil {
+		t.Fatalf("add magnet: %v", err)
+	}
+	mgr.activeTasks["active"] = active
+
+	// 只有下载协程中的任务按速度估计；暂停任务入库的速度已过时，剩余时间未知
+	want := map[string]int64{"active": 3, "stalled": -1, "done": 0}
+	for _, task := range mgr.GetAllTasks() {
+		if task.ETASeconds != want[task.TaskID] || task.Peers != 0 {
+			t.Fatalf("task %s: expected ETA %d and no peers offline, got %d and %d", task.TaskID, want[task.TaskID], task.ETASeconds, task.Peers)
+		}
+	}
+	paused, err := mgr.GetTasksByStatus(domain.TaskStatusPaused)
+	if err != nil || len(paused) != 1 || paused[0].ETASeconds != -1 {
+		t.Fatalf("expected the paused task with an unknown ETA, got %+v (%v)", paused, err)
+	}
+}
+
+func TestApplyFileSelectionRecomputesSize(t *testing.T) {
+	previous := []models.TorrentFileInfo{
+		{FilePath: "movie.mkv", FileSize: 800, IsSelected: true},
+		{FilePath: "extras.mkv", FileSize: 300, IsSelected: false},
+	}
+	files := []models.TorrentFileInfo{
+		{FilePath: "movie.mkv", FileSize: 800, IsSelected: true},
+		{FilePath: "extras.mkv", FileSize: 300, IsSelected: true},
+		{FilePath: "movie.srt", FileSize: 20, IsSelected: true},
+	}
+
+	if size := applyFileSelection(previous, files); size != 820 {
+		t.Fatalf("expected selected size 820, got %d", size)
+	}
+	if files[1].IsSelected {
+		t.Fatalf("expected previous deselection to be kept")
+	}
+
+	fresh := []models.TorrentFileInfo{{FilePath: "a", FileSize: 5, IsSelected: true}, {FilePath: "b", FileSize: 7, IsSelected: true}}
+	if size := applyFileSelection(nil, fresh); size != 12 {
+		t.Fatalf("expected new task to select every file, got %d", size)
+	}
+}
+
+func TestSelectFilesAppliesSubmittedSelection(t *testing.T) {
+	// 选择随任务元数据以JSON保存，读回后是[]interface{}
+	task := &models.Task{}
+	if err := task.SetMetadata(map[string]interface{}{selectedFilesKey: []string{"Show/e01.mkv", "e03.mkv"}}); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+	metadata, _ := task.GetMetadata()
+	selection := requestedSelection(metadata)
+
+	files := []models.TorrentFileInfo{
+		{FileName: "e01.mkv", FilePath: "Show/e01.mkv", FileSize: 700, IsSelected: true},
+		{FileName: "e02.mkv", FilePath: "Show/e02.mkv", FileSize: 800, IsSelected: true},
+		{FileName: "e03.mkv", FilePath: "Show/e03.mkv", FileSize: 900, IsSelected: true},
+	}
+	size, err := selectFiles(files, selection)
+	if err != nil {
+		t.Fatalf("select files: %v", err)
+	}
+	if size != 1600 {
+		t.Fatalf("expected selected size 1600, got %d", size)
+	}
+	if !files[0].IsSelected || files[1].IsSelected || !files[2].IsSelected {
+		t.Fatalf("unexpected selection: %+v", files)
+	}
+
+	// 进度按选中文件的大小计算
+	source := &fakeTorrent{}
+	tracker := newProgressTracker(size, source, time.Now())
+	source.completed = 800
+	if _, progress, _ := tracker.sample(source, time.Now()); progress != 50 {
+		t.Fatalf("expected progress against selected bytes to be 50%%, got %d", progress)
+	}
+
+	if _, err := selectFiles(files, []string{"Show/missing.mkv"}); err == nil {
+		t.Fatalf("expected a selection matching no file to be rejected")
+	}
+}
+
+func TestSubmittedSelectionSurvivesMetadataBounds(t *testing.T) {
+	// 拿到种子元数据前选择只保存在任务元数据中，被当作附加字段删除就会变成下载整个种子
+	selection := make([]string, 150)
+	for i := range selection {
+		selection[i] = fmt.Sprintf("%s/episode-%03d.mkv", strings.Repeat("Long Season Directory Name ", 8), i)
+	}
+	task := &models.Task{}
+	if err := task.SetMetadata(map[string]interface{}{
+		selectedFilesKey: selection,
+		"notes":          strings.Repeat("x", 3000),
+	}); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+
+	metadata, _ := task.GetMetadata()
+	if got := requestedSelection(metadata); len(got) != len(selection) || got[149] != selection[149] {
+		t.Fatalf("expected all %d selected paths to be kept, got %d", len(selection), len(got))
+	}
+}
+
+func TestSelectFilesSkipsUnselectedFilesOnDisk(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	// 两个按分片对齐的文件，选中一个时另一个的分片完全不会被请求
+	const pieceLength, fileSize = 16 << 10, 64 << 10
+	seedDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(seedDir, "pack"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i, name := range []string{"a.bin", "b.bin"} {
+		if err := os.WriteFile(filepath.Join(seedDir, "pack", name), bytes.Repeat([]byte{byte(i + 1)}, fileSize), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	info := metainfo.Info{PieceLength: pieceLength}
+	if err := info.BuildFromFilePath(filepath.Join(seedDir, "pack")); err != nil {
+		t.Fatalf("build info: %v", err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("marshal info: %v", err)
+	}
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+
+	newClient := func(dir string, seed bool) *torrent.Client {
+		config := torrent.NewDefaultClientConfig()
+		config.DataDir = dir
+		config.Seed = seed
+		config.NoDHT = true
+		config.DisableTrackers = true
+		config.DisableIPv6 = true
+		config.NoDefaultPortForwarding = true
+		client, _, err := newTorrentClient(config, 0)
+		if err != nil {
+			t.Fatalf("create torrent client: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	seeder := newClient(seedDir, true)
+	if _, err := seeder.AddTorrent(mi); err != nil {
+		t.Fatalf("seed torrent: %v", err)
+	}
+	leechDir := t.TempDir()
+	leecher := newClient(leechDir, false)
+	live, err := leecher.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent: %v", err)
+	}
+	<-live.GotInfo()
+
+	files := make([]models.TorrentFileInfo, len(live.Files()))
+	for i, file := range live.Files() {
+		files[i] = models.TorrentFileInfo{FileName: file.DisplayPath(), FilePath: file.Path(), FileSize: file.Length(), IsSelected: true}
+	}
+	if _, err := selectFiles(files, []string{"a.bin"}); err != nil {
+		t.Fatalf("select files: %v", err)
+	}
+	source := applyFilePriorities(live, files)
+	live.AddClientPeer(seeder)
+
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(15 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor("the selected file", func() bool { return source.BytesCompleted() == fileSize })
+	time.Sleep(200 * time.Millisecond)
+	if got := live.Files()[1].BytesCompleted(); got != 0 {
+		t.Fatalf("expected no pieces of the unselected file, got %d bytes", got)
+	}
+	if _, err := os.Stat(filepath.Join(leechDir, "pack", "b.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected the unselected file not to be written to disk, got %v", err)
+	}
+
+	// 下载途中选中另一个文件，立即开始下载并按新的大小计算进度
+	mgr := New(leechDir, "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+	task := &models.Task{TaskID: "task-1", MagnetURL: "magnet:?xt=urn:btih:" + mi.HashInfoBytes().HexString(), Status: domain.TaskStatusDownloading, WorkerID: "worker-1", Size: fileSize}
+	task.SetTorrentFiles(files)
+	if err := mgr.taskRepo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	mgr.activeTasks["task-1"] = live
+	if err := mgr.SelectFiles("task-1", []string{"pack/a.bin", "pack/b.bin"}); err != nil {
+		t.Fatalf("select files on a live task: %v", err)
+	}
+	stored, _ := mgr.taskRepo.GetByTaskID("task-1")
+	if stored.Size != 2*fileSize {
+		t.Fatalf("expected the task size to include both files, got %d", stored.Size)
+	}
+	waitFor("the newly selected file", func() bool { return live.BytesCompleted() == 2*fileSize })
+
+	if err := mgr.SelectFiles("task-1", nil); err == nil {
+		t.Fatal("expected an empty selection to be rejected")
+	}
+	mgr.taskRepo.UpdateStatus("task-1", domain.TaskStatusReady)
+	if err := mgr.SelectFiles("task-1", []string{"pack/a.bin"}); err == nil {
+		t.Fatal("expected the selection of a finished task to be refused")
+	}
+}
+
+// racingTaskRepository 在SelectFiles读取任务之后模拟下载协程写入进度与状态
+type racingTaskRepository struct {
+	database.TaskRepository
+	race func(taskID string)
+}
+
+func (r *racingTaskRepository) GetByTaskID(taskID string) (*models.Task, error) {
+	task, err := r.TaskRepository.GetByTaskID(taskID)
+	if r.race != nil {
+		r.race(taskID)
+	}
+	return task, err
+}
+
+func TestSelectFilesKeepsConcurrentDownloaderWrites(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	repo := database.NewTaskRepository()
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.taskRepo = &racingTaskRepository{TaskRepository: repo, race: func(taskID string) {
+		repo.UpdateProgress(taskID, 30, 4096, 300)
+		repo.UpdateStatus(taskID, domain.TaskStatusPaused)
+	}}
+	files := []models.TorrentFileInfo{
+		{FileName: "a.bin", FilePath: "pack/a.bin", FileSize: 1000, IsSelected: true},
+		{FileName: "b.bin", FilePath: "pack/b.bin", FileSize: 1000, IsSelected: true},
+	}
+	task := &models.Task{TaskID: "task-1", MagnetURL: "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567", Status: domain.TaskStatusDownloading, WorkerID: "worker-1", Size: 2000}
+	task.SetTorrentFiles(files)
+	if err := repo.Create(task); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+
+	if err := mgr.SelectFiles("task-1", []string{"pack/a.bin"}); err != nil {
+		t.Fatalf("select files: %v", err)
+	}
+	stored, _ := repo.GetByTaskID("task-1")
+	if stored.Status != domain.TaskStatusPaused || stored.Speed != 4096 {
+		t.Fatalf("expected the downloader's status and speed to survive the selection, got %s %d", stored.Status, stored.Speed)
+	}
+	if stored.Size != 1000 || stored.Downloaded != 300 || stored.Progress != 30 {
+		t.Fatalf("expected the selection to be applied to the latest progress, got size %d downloaded %d progress %d", stored.Size, stored.Downloaded, stored.Progress)
+	}
+	selected, _ := stored.GetTorrentFiles()
+	if !selected[0].IsSelected || selected[1].IsSelected {
+		t.Fatalf("expected only a.bin to be selected, got %+v", selected)
+	}
+}
+
+func TestPrivateTorrentFlagFromMetainfo(t *testing.T) {
+	load := func(name string) *metainfo.MetaInfo {
+		mi, err := metainfo.LoadFromFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("load %s: %v", name, err)
+		}
+		return mi
+	}
+
+	public, err := load("public.torrent").UnmarshalInfo()
+	if err != nil {
+		t.Fatalf("unmarshal public info: %v", err)
+	}
+	if private, err := checkPrivateTorrent(&public, true, map[string]interface{}{}); private || err != nil {
+		t.Fatalf("expected public torrent to pass even when confirmation is required, got private=%v err=%v", private, err)
+	}
+
+	privateMeta := load("private.torrent")
+	privateInfo, err := privateMeta.UnmarshalInfo()
+	if err != nil {
+		t.Fatalf("unmarshal private info: %v", err)
+	}
+	if private, err := checkPrivateTorrent(&privateInfo, false, map[string]interface{}{}); !private || err != nil {
+		t.Fatalf("expected private torrent to be detected and allowed without confirmation, got private=%v err=%v", private, err)
+	}
+	if private, err := checkPrivateTorrent(&privateInfo, true, map[string]interface{}{}); !private || !errors.Is(err, ErrPrivateNotConfirmed) {
+		t.Fatalf("expected unconfirmed private torrent to be refused, got private=%v err=%v", private, err)
+	}
+	if _, err := checkPrivateTorrent(&privateInfo, true, map[string]interface{}{"allow_private": true}); err != nil {
+		t.Fatalf("expected confirmed private torrent to be allowed, got %v", err)
+	}
+
+	// 私有种子只保留自带的tracker
+	added := trackers.Defaults()
+	tiers := [][]string{{privateMeta.Announce}, {added[0], added[1]}}
+	kept := withoutTrackers(tiers, added)
+	if len(kept) != 1 || len(kept[0]) != 1 || kept[0][0] != privateMeta.Announce {
+		t.Fatalf("expected only the private tracker to remain, got %v", kept)
+	}
+
+	hash := privateMeta.HashInfoBytes().HexString()
+	if magnetHasTrackers("magnet:?xt=urn:btih:" + hash) {
+		t.Fatalf("expected magnet without tr= to have no trackers")
+	}
+	if !magnetHasTrackers("magnet:?xt=urn:btih:" + hash + "&tr=" + privateMeta.Announce) {
+		t.Fatalf("expected magnet with tr= to carry trackers")
+	}
+}
+
+func TestTaskQueueDispatchOrder(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	type submission struct {
+		id       string
+		priority int
+		created  time.Duration // 相对base的创建时间
+	}
+	tests := []struct {
+		name     string
+		maxTasks int
+		running  int // 已占用的名额
+		submit   []submission
+		release  int // 提交后释放的名额数
+		want     []string
+	}{
+		{
+			name:     "priority inversion",
+			maxTasks: 1,
+			running:  1,
+			submit: []submission{
+				{id: "low", priority: 2},
+				{id: "default", priority: 5, created: time.Second},
+				{id: "high", priority: 9, created: 2 * time.Second},
+			},
+			release: 3,
+			want:    []string{"high", "default", "low"},
+		},
+		{
+			name:     "equal priority is first in first out",
+			maxTasks: 1,
+			running:  1,
+			submit: []submission{
+				{id: "first", priority: 5},
+				{id: "second", priority: 5},
+				{id: "third", priority: 5, created: -time.Second},
+			},
+			release: 3,
+			want:    []string{"third", "first", "second"},
+		},
+		{
+			name:     "saturated slots start nothing",
+			maxTasks: 2,
+			running:  2,
+			submit: []submission{
+				{id: "a", priority: 10},
+				{id: "b", priority: 1},
+			},
+			want: nil,
+		},
+		{
+			name:     "free slots start immediately",
+			maxTasks: 3,
+			running:  1,
+			submit: []submission{
+				{id: "a", priority: 1},
+				{id: "b", priority: 7},
+				{id: "c", priority: 4},
+			},
+			want: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := New(t.TempDir(), "worker-1")
+			mgr.maxTasks = tt.maxTasks
+			var holders []*models.Task
+			for i := 0; i < tt.running; i++ {
+				holder := &models.Task{TaskID: fmt.Sprintf("running-%d", i)}
+				mgr.running[holder] = true
+				holders = append(holders, holder)
+			}
+
+			var started []string
+			for _, sub := range tt.submit {
+				mgr.enqueueLocked(&models.Task{TaskID: sub.id, Priority: sub.priority, CreatedAt: base.Add(sub.created)})
+				for _, task := range mgr.takeRunnableLocked() {
+					started = append(started, task.TaskID)
+				}
+			}
+			for i := 0; i < tt.release; i++ {
+				// 每次释放一个名额，刚开始的任务继续占用它
+				delete(mgr.running, holders[0])
+				holders = holders[1:]
+				for _, task := range mgr.takeRunnableLocked() {
+					started = append(started, task.TaskID)
+					holders = append(holders, task)
+				}
+			}
+
+			if strings.Join(started, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected start order %v, got %v", tt.want, started)
+			}
+			if len(mgr.running) > tt.maxTasks {
+				t.Fatalf("expected at most %d running tasks, got %d", tt.maxTasks, len(mgr.running))
+			}
+			if mgr.pending.Len() != len(mgr.queued) {
+				t.Fatalf("queue index out of sync: %d queued, %d indexed", mgr.pending.Len(), len(mgr.queued))
+			}
+		})
+	}
+}
+
+func TestTaskQueueHoldsTasksDuringQuietHours(t *testing.T) {
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.maxTasks = 2
+	mgr.quiet = true
+	mgr.enqueueLocked(&models.Task{TaskID: "a", Priority: 5})
+	if ready := mgr.takeRunnableLocked(); len(ready) != 0 {
+		t.Fatalf("expected no task to start during quiet hours, got %v", ready)
+	}
+
+	mgr.quiet = false
+	if ready := mgr.takeRunnableLocked(); len(ready) != 1 || ready[0].TaskID != "a" {
+		t.Fatalf("expected a to start after quiet hours, got %v", ready)
+	}
+}
+
+func TestTaskQueueReordersOnPriorityChange(t *testing.T) {
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.maxTasks = 0
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		mgr.enqueueLocked(&models.Task{TaskID: id, Priority: 5, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	// 提高最后一个任务的优先级，并把第一个移出队列
+	item := mgr.queued["c"]
+	item.task.Priority = 8
+	heap.Fix(&mgr.pending, item.index)
+	if !mgr.unqueueLocked("a") || mgr.unqueueLocked("a") {
+		t.Fatalf("expected a to be removed from the queue exactly once")
+	}
+
+	mgr.maxTasks = 2
+	var started []string
+	for _, task := range mgr.takeRunnableLocked() {
+		started = append(started, task.TaskID)
+	}
+	if strings.Join(started, ",") != "c,b" {
+		t.Fatalf("expected c then b, got %v", started)
+	}
+	if err := checkPriority(11); err == nil {
+		t.Fatalf("expected priority 11 to be rejected")
+	}
+}
+
+func TestSetPriorityUpdatesRunningTask(t *testing.T) {
+	if err := database.Initialize(t.TempDir()); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		database.DB = nil
+	})
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.taskRepo = database.NewTaskRepository()
+	running := &models.Task{TaskID: "running", MagnetURL: "magnet:?xt=urn:btih:running", WorkerID: "worker-1", Priority: 5, Status: domain.TaskStatusDownloading}
+	if err := mgr.taskRepo.Create(running); err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	mgr.running[running] = true
+
+	if err := mgr.SetPriority("running", 9); err != nil {
+		t.Fatalf("set priority: %v", err)
+	}
+	if running.Priority != 9 {
+		t.Fatalf("expected the running task to carry the new priority, got %d", running.Priority)
+	}
+
+	// 下载协程之后整行保存旧对象也不会改回优先级
+	stale := *running
+	stale.Priority = 5
+	if err := mgr.taskRepo.Update(&stale); err != nil {
+		t.Fatalf("update task: %v", err)
+	}
+	if stored, _ := mgr.taskRepo.GetByTaskID("running"); stored.Priority != 9 {
+		t.Fatalf("expected the stored priority to stay 9, got %d", stored.Priority)
+	}
+}
+
+func TestQueueSnapshotReportsRunningAndPendingOrder(t *testing.T) {
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.maxTasks = 1
+	now := time.Now()
+	mgr.running[&models.Task{TaskID: "active", Priority: 5}] = true
+	for i, sub := range []struct {
+		id       string
+		priority int
+	}{{"low", 2}, {"default", 5}, {"high", 9}, {"default-2", 5}} {
+		mgr.enqueueLocked(&models.Task{TaskID: sub.id, Priority: sub.priority, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	snapshot := mgr.QueueSnapshot()
+	want := QueueSnapshot{
+		MaxTasks: 1,
+		Running:  []QueueEntry{{TaskID: "active", Priority: 5}},
+		Pending: []QueueEntry{
+			{TaskID: "high", Priority: 9, Position: 1},
+			{TaskID: "default", Priority: 5, Position: 2},
+			{TaskID: "default-2", Priority: 5, Position: 3},
+			{TaskID: "low", Priority: 2, Position: 4},
+		},
+	}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("expected %+v, got %+v", want, snapshot)
+	}
+	if mgr.pending.Len() != 4 {
+		t.Fatalf("expected the snapshot to leave the queue intact, got %d pending", mgr.pending.Len())
+	}
+}
+
+func TestValidateMagnetURLEnforcesTrackerPolicy(t *testing.T) {
+	const hash = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"
+	allowed := hash + "&tr=udp%3A%2F%2Ftracker.example.org%3A6969%2Fannounce"
+	subdomain := hash + "&tr=https%3A%2F%2Fannounce.internal.example.com%2Fannounce"
+	denied := hash + "&tr=udp%3A%2F%2Ftracker.example.org%3A6969&tr=http%3A%2F%2Fevil.example.net%2Fannounce"
+
+	cases := []struct {
+		name    string
+		policy  TrackerPolicy
+		magnet  string
+		allowed bool
+	}{
+		{"default allows everything", TrackerPolicy{}, denied, true},
+		{"allowlisted host", TrackerPolicy{Mode: TrackerPolicyAllowlist, Hosts: []string{"tracker.example.org", "internal.example.com"}}, allowed, true},
+		{"allowlisted parent domain", TrackerPolicy{Mode: TrackerPolicyAllowlist, Hosts: []string{"Internal.Example.com"}}, subdomain, true},
+		{"host missing from allowlist", TrackerPolicy{Mode: TrackerPolicyAllowlist, Hosts: []string{"tracker.example.org"}}, denied, false},
+		{"trackerless magnet under allowlist", TrackerPolicy{Mode: TrackerPolicyAllowlist, Hosts: []string{"tracker.example.org"}}, hash, true},
+		{"denylisted host", TrackerPolicy{Mode: TrackerPolicyDenylist, Hosts: []string{"evil.example.net"}}, denied, false},
+		{"host not on denylist", TrackerPolicy{Mode: TrackerPolicyDenylist, Hosts: []string{"evil.example.net"}}, allowed, true},
+	}
+	for _, tc := range cases {
+		err := ValidateMagnetURL(tc.magnet, tc.policy)
+		if tc.allowed && err != nil {
+			t.Fatalf("%s: expected magnet to be allowed, got %v", tc.name, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrTrackerNotAllowed) {
+			t.Fatalf("%s: expected ErrTrackerNotAllowed, got %v", tc.name, err)
+		}
+	}
+
+	if err := ValidateMagnetURL("not a magnet", TrackerPolicy{}); err == nil {
+		t.Fatalf("expected an unparsable magnet to be rejected")
+	}
+
+	// 公开tracker同样按策略过滤
+	m := &Manager{publicTrackers: trackers.Defaults()}
+	m.SetTrackerPolicy(TrackerPolicy{Mode: TrackerPolicyAllowlist, Hosts: []string{"opentrackr.org"}})
+	for _, tracker := range m.allowedPublicTrackers() {
+		if !strings.Contains(tracker, "opentrackr.org") {
+			t.Fatalf("unexpected public tracker %s under the allowlist", tracker)
+		}
+	}
+	if got := len(m.allowedPublicTrackers()); got != 2 {
+		t.Fatalf("expected the 2 opentrackr public trackers, got %d", got)
+	}
+}
+
+func TestValidateMagnetURLChecksFormat(t *testing.T) {
+	const (
+		v1Hex    = "0123456789abcdef0123456789abcdef01234567"
+		v1Base32 = "AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH"
+		v2Hash   = "122089abcdef0123456789abcdef0123456789abcdef0123456789abcdef01234567"
+	)
+	valid := []struct {
+		name   string
+		magnet string
+	}{
+		{"BTv1 hex", "magnet:?xt=urn:btih:" + v1Hex + "&dn=movie"},
+		{"BTv1 upper-case hex", "magnet:?xt=urn:btih:" + strings.ToUpper(v1Hex)},
+		{"BTv1 base32", "magnet:?xt=urn:btih:" + v1Base32},
+		{"BTv2 hybrid", "magnet:?xt=urn:btmh:" + v2Hash + "&xt=urn:btih:" + v1Hex},
+		{"trackers", "magnet:?xt=urn:btih:" + v1Hex + "&tr=udp%3A%2F%2Ftracker.example.org%3A6969&tr=https%3A%2F%2Ftracker.example.org%2Fannounce"},
+		{"web+magnet", "web+magnet:?xt=urn:btih:" + v1Hex},
+		{"web+magnet with slashes", "web+magnet://?xt=urn:btih:" + v1Hex},
+	}
+	for _, tc := range valid {
+		if err := ValidateMagnetURL(tc.magnet, TrackerPolicy{}); err != nil {
+			t.Fatalf("%s: expected %s to be valid, got %v", tc.name, tc.magnet, err)
+		}
+	}
+	if got := NormalizeMagnetURL(" web+magnet://?xt=urn:btih:" + v1Hex); got != "magnet:?xt=urn:btih:"+v1Hex {
+		t.Fatalf("expected web+magnet to normalize to magnet:?, got %s", got)
+	}
+	if err := ValidateMagnetURL("magnet:?xt=urn:btmh:"+v2Hash, TrackerPolicy{}); err != nil && !errors.Is(err, ErrUnsupportedHashType) {
+		t.Fatalf("expected a BTv2 magnet to be well formed, got %v", err)
+	}
+
+	malformed := []struct {
+		name   string
+		magnet string
+		reason string
+	}{
+		{"not a magnet", "https://example.org/?xt=urn:btih:" + v1Hex, "must start with magnet:?"},
+		{"no query", "magnet:", "must start with magnet:?"},
+		{"xt missing", "magnet:?foo=bar", "xt parameter missing"},
+		{"empty xt", "magnet:?xt=", "xt parameter must be"},
+		{"unknown urn", "magnet:?xt=urn:sha1:" + v1Hex, "xt parameter must be"},
+		{"short hex", "magnet:?xt=urn:btih:" + v1Hex[:39], "infohash must be 40 hex or 32 base32 chars"},
+		{"non-hex", "magnet:?xt=urn:btih:" + strings.Repeat("g", 40), "infohash must be 40 hex chars"},
+		{"bad base32", "magnet:?xt=urn:btih:" + strings.Repeat("1", 32), "base32 infohash must be 32 chars"},
+		{"short btmh", "magnet:?xt=urn:btmh:" + v2Hash[:66], "btmh must be 68 hex chars"},
+		{"malformed query", "magnet:?xt=urn:btih:" + v1Hex + "&dn=%zz", "malformed query"},
+		{"tracker scheme", "magnet:?xt=urn:btih:" + v1Hex + "&tr=ftp%3A%2F%2Ftracker.example.org", "must be a udp, http or https URL"},
+		{"tracker without host", "magnet:?xt=urn:btih:" + v1Hex + "&tr=udp%3A%2F%2F", "must be a udp, http or https URL"},
+	}
+	for _, tc := range malformed {
+		err := ValidateMagnetURL(tc.magnet, TrackerPolicy{})
+		if !errors.Is(err, ErrInvalidMagnet) || !strings.Contains(err.Error(), tc.reason) {
+			t.Fatalf("%s: expected ErrInvalidMagnet mentioning %q, got %v", tc.name, tc.reason, err)
+		}
+	}
+}
+
+func TestMagnetHashForms(t *testing.T) {
+	const (
+		v1Hash = "0123456789abcdef0123456789abcdef01234567"
+		v2Hash = "89abcdef0123456789abcdef0123456789abcdef0123456789abcdef01234567"
+	)
+	v1 := "magnet:?xt=urn:btih:" + v1Hash + "&dn=movie"
+	v2 := "magnet:?xt=urn:btmh:1220" + v2Hash + "&dn=movie"
+	// 混合种子的btmh排在前面，torrent库只读第一个xt
+	hybrid := "magnet:?xt=urn:btmh:1220" + v2Hash + "&xt=urn:btih:" + v1Hash + "&dn=movie&tr=udp%3A%2F%2Ftracker.example.org%3A6969"
+
+	cases := []struct {
+		magnet string
+		form   string
+		hashes MagnetHashes
+	}{
+		{v1, MagnetFormV1, MagnetHashes{V1: v1Hash}},
+		{v2, MagnetFormV2, MagnetHashes{V2: v2Hash}},
+		{hybrid, MagnetFormHybrid, MagnetHashes{V1: v1Hash, V2: v2Hash}},
+	}
+	for _, tc := range cases {
+		hashes, err := ParseMagnetHashes(tc.magnet)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tc.magnet, err)
+		}
+		if hashes != tc.hashes || hashes.Form() != tc.form {
+			t.Fatalf("%s: got %+v (%s), want %+v (%s)", tc.magnet, hashes, hashes.Form(), tc.hashes, tc.form)
+		}
+	}
+
+	// 混合种子与只带其v1或v2 hash的磁力链接是同一种子
+	hybridHashes, _ := ParseMagnetHashes(hybrid)
+	if !hybridHashes.Matches(MagnetHashes{V1: v1Hash}) || !hybridHashes.Matches(MagnetHashes{V2: v2Hash}) {
+		t.Fatalf("expected the hybrid to match its v1 and v2 hashes")
+	}
+	if (MagnetHashes{V1: v1Hash}).Matches(MagnetHashes{V2: v2Hash}) {
+		t.Fatalf("unrelated v1 and v2 hashes must not match")
+	}
+
+	if err := ValidateMagnetURL(v1, TrackerPolicy{}); err != nil {
+		t.Fatalf("v1 magnet rejected: %v", err)
+	}
+	if err := ValidateMagnetURL(hybrid, TrackerPolicy{Mode: TrackerPolicyDenylist, Hosts: []string{"tracker.example.org"}}); !errors.Is(err, ErrTrackerNotAllowed) {
+		t.Fatalf("expected the hybrid magnet's tracker to be checked, got %v", err)
+	}
+	if err := ValidateMagnetURL(hybrid, TrackerPolicy{}); err != nil {
+		t.Fatalf("hybrid magnet rejected: %v", err)
+	}
+	err := ValidateMagnetURL(v2, TrackerPolicy{})
+	if SupportsTorrentV2() {
+		if err != nil {
+			t.Fatalf("v2 magnet rejected although the torrent library supports v2: %v", err)
+		}
+	} else if !errors.Is(err, ErrUnsupportedHashType) {
+		t.Fatalf("expected ErrUnsupportedHashType for a v2-only magnet, got %v", err)
+	}
+
+	// 添加到torrent库前btih被移到最前面
+	magnet, err := parseMagnet(hybrid)
+	if err != nil {
+		t.Fatalf("parse hybrid as v1: %v", err)
+	}
+	if magnet.InfoHash.HexString() != v1Hash || magnet.DisplayName != "movie" || len(magnet.Trackers) != 1 {
+		t.Fatalf("unexpected v1 view of the hybrid magnet: %+v", magnet)
+	}
+	if got := v1MagnetURL(v1); got != v1 {
+		t.Fatalf("v1 magnet should be added unchanged, got %s", got)
+	}
+
+	if _, err := ParseMagnetHashes("magnet:?xt=urn:btmh:1114" + v2Hash[:40]); err == nil {
+		t.Fatalf("expected a non-SHA-256 multihash to be rejected")
+	}
+}
+
+func TestSetRateLimitAppliesToRunningClients(t *testing.T) {
+	m := New(t.TempDir(), "worker-1")
+	config := torrent.NewDefaultClientConfig()
+	m.applyRateLimiters(config)
+
+	if config.DownloadRateLimiter.Limit() != rate.Inf || config.UploadRateLimiter.Limit() != rate.Inf {
+		t.Fatalf("expected no limit by default")
+	}
+
+	// 客户端持有同一个限速器，调整后无需重建客户端
+	m.SetRateLimit(8000, 800)
+	if got := config.DownloadRateLimiter.Limit(); got != 1000000 {
+		t.Fatalf("expected 8000 kbps to be 1000000 bytes/s, got %v", got)
+	}
+	if got := config.UploadRateLimiter.Limit(); got != 100000 {
+		t.Fatalf("expected 800 kbps to be 100000 bytes/s, got %v", got)
+	}
+	if config.UploadRateLimiter.Burst() < minRateBurst || config.DownloadRateLimiter.Burst() != 1000000 {
+		t.Fatalf("unexpected bursts %d/%d", config.DownloadRateLimiter.Burst(), config.UploadRateLimiter.Burst())
+	}
+
+	m.SetRateLimit(0, 0)
+	if config.DownloadRateLimiter.Limit() != rate.Inf || config.UploadRateLimiter.Limit() != rate.Inf {
+		t.Fatalf("expected 0 to remove the limit")
+	}
+}
+
+func TestMetadataCacheExpiresAndEvicts(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewMetadataCache(dir, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("new metadata cache: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	hash := func(b byte) string { return strings.Repeat(fmt.Sprintf("%02x", b), 20) }
+	if err := cache.Put(hash(1), []byte("info-1")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	if err := cache.Put(hash(2), []byte("info-2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if data, ok := cache.Get(hash(1)); !ok || string(data) != "info-1" {
+		t.Fatalf("expected a fresh entry to be returned, got %q %v", data, ok)
+	}
+
+	// 超过TTL的条目不再使用，清理时连同文件删除
+	now = now.Add(45 * time.Minute)
+	if _, ok := cache.Get(hash(1)); ok {
+		t.Fatalf("expected the expired entry to be ignored")
+	}
+	if removed := cache.Sweep(); removed != 1 || cache.Len() != 1 {
+		t.Fatalf("expected the sweep to remove 1 entry leaving 1, removed %d left %d", removed, cache.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, hash(1)+metadataCacheExt)); !os.IsNotExist(err) {
+		t.Fatalf("expected the expired entry's file to be deleted, got %v", err)
+	}
+
+	// 超过条目上限时淘汰最久未使用的条目
+	if err := cache.Put(hash(3), []byte("info-3")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, ok := cache.Get(hash(2)); !ok {
+		t.Fatalf("expected entry 2 to be cached")
+	}
+	if err := cache.Put(hash(4), []byte("info-4")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected the cache to stay at 2 entries, got %d", cache.Len())
+	}
+	if _, ok := cache.Get(hash(3)); ok {
+		t.Fatalf("expected the least recently used entry to be evicted")
+	}
+	if _, ok := cache.Get(hash(2)); !ok {
+		t.Fatalf("expected the recently used entry to survive eviction")
+	}
+
+	// 重新打开时载入已有条目，无效的文件名被忽略
+	if err := cache.Put("../escape", []byte("x")); err != nil {
+		t.Fatalf("put invalid hash: %v", err)
+	}
+	reopened, err := NewMetadataCache(dir, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if reopened.Len() != 2 {
+		t.Fatalf("expected 2 entries after reopening, got %d", reopened.Len())
+	}
+}
+
+func TestFetchMetadataListsFilesWithoutKeepingTorrent(t *testing.T) {
+	// 离线的torrent客户端，只能从缓存拿到元数据
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		t.Fatalf("create torrent client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	cache, err := NewMetadataCache(t.TempDir(), time.Hour, 10)
+	if err != nil {
+		t.Fatalf("new metadata cache: %v", err)
+	}
+	mi, err := metainfo.LoadFromFile(filepath.Join("testdata", "public.torrent"))
+	if err != nil {
+		t.Fatalf("load torrent: %v", err)
+	}
+	hash := mi.HashInfoBytes().HexString()
+	if err := cache.Put(hash, mi.InfoBytes); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	mgr := New(t.TempDir(), "worker-1")
+	mgr.client = client
+	mgr.publicTrackers = nil
+	mgr.SetMetadataCache(cache)
+	mgr.metadataFetchTimeout = 50 * time.Millisecond
+
+	info, err := mgr.FetchMetadata("magnet:?xt=urn:btih:" + hash)
+	if err != nil {
+		t.Fatalf("fetch metadata: %v", err)
+	}
+	if info.InfoHash != hash || info.Name == "" || len(info.Files) == 0 || info.Private {
+		t.Fatalf("expected the public torrent's files, got %+v", info)
+	}
+	var total int64
+	for _, file := range info.Files {
+		total += file.FileSize
+	}
+	if total != info.Size {
+		t.Fatalf("expected file sizes to add up to %d, got %d", info.Size, total)
+	}
+	if len(client.Torrents()) != 0 {
+		t.Fatalf("expected the torrent to be dropped after fetching metadata")
+	}
+
+	// 正在下载的种子保留给任务
+	active, _ := client.AddMagnet("magnet:?xt=urn:btih:" + hash)
+	mgr.activeTasks["task-1"] = active
+	if _, err := mgr.FetchMetadata("magnet:?xt=urn:btih:" + hash); err != nil {
+		t.Fatalf("fetch metadata of an active torrent: %v", err)
+	}
+	if len(client.Torrents()) != 1 {
+		t.Fatalf("expected the active torrent to be kept")
+	}
+
+	// 拿不到元数据时以metadata_timeout失败，无效链接以magnet_invalid失败
+	if _, err := mgr.FetchMetadata("magnet:?xt=urn:btih:" + strings.Repeat("e", 40)); !errors.Is(err, domain.ErrMetadataTimeout) {
+		t.Fatalf("expected metadata_timeout, got %v", err)
+	}
+	if len(client.Torrents()) != 1 {
+		t.Fatalf("expected the timed out torrent to be dropped")
+	}
+	if _, err := mgr.FetchMetadata("magnet:?xt=urn:btih:zz"); !errors.Is(err, domain.ErrMagnetInvalid) {
+		t.Fatalf("expected magnet_invalid, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package downloader
+
+import (
+	"container/list"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"worker/tasklog"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 默认的元数据缓存上限
+const (
+	DefaultMetadataCacheTTL        = 7 * 24 * time.Hour
+	DefaultMetadataCacheMaxEntries = 1000
+	metadataCacheExt               = ".info"
+)
+
+// MetadataCache 按info hash缓存种子的info字典，再次提交同一磁力链接时不必等待从peer获取元数据。
+// 每个条目是目录中的一个<infohash>.info文件；超过TTL的条目查找时忽略并由Sweep删除，
+// 条目数超过上限时淘汰最久未使用的条目
+type MetadataCache struct {
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // 最近使用的在前
+	entries map[string]*list.Element
+}
+
+type metadataCacheEntry struct {
+	infoHash string
+	storedAt time.Time
+}
+
+// NewMetadataCache 打开目录中的元数据缓存，ttl或maxEntries不大于0时使用默认值。
+// 已有条目按写入时间排列，越新的越晚淘汰
+func NewMetadataCache(dir string, ttl time.Duration, maxEntries int) (*MetadataCache, error) {
+	if ttl <= 0 {
+		ttl = DefaultMetadataCacheTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultMetadataCacheMaxEntries
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &MetadataCache{
+		dir:        dir,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var existing []metadataCacheEntry
+	for _, file := range files {
+		infoHash := strings.TrimSuffix(file.Name(), metadataCacheExt)
+		if file.IsDir() || infoHash == file.Name() || !validInfoHash(infoHash) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, metadataCacheEntry{infoHash: infoHash, storedAt: info.ModTime()})
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].storedAt.Before(existing[j].storedAt) })
+	c.mu.Lock()
+	for i := range existing {
+		c.entries[existing[i].infoHash] = c.order.PushFront(&existing[i])
+	}
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// validInfoHash 只接受40位十六进制的v1 info hash，避免用作文件名时越出缓存目录
+func validInfoHash(infoHash string) bool {
+	if len(infoHash) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(infoHash)
+	return err == nil
+}
+
+func (c *MetadataCache) path(infoHash string) string {
+	return filepath.Join(c.dir, infoHash+metadataCacheExt)
+}
+
+// Get 返回缓存的info字典并将条目标记为最近使用，不存在或已过期时返回false
+func (c *MetadataCache) Get(infoHash string) ([]byte, bool) {
+	infoHash = strings.ToLower(infoHash)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[infoHash]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*metadataCacheEntry)
+	if c.now().Sub(entry.storedAt) > c.ttl {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(infoHash))
+	if err != nil {
+		c.removeLocked(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return data, true
+}
+
+// Put 缓存info字典，已有条目时覆盖并重新计算过期时间
+func (c *MetadataCache) Put(infoHash string, infoBytes []byte) error {
+	infoHash = strings.ToLower(infoHash)
+	if !validInfoHash(infoHash) || len(infoBytes) == 0 {
+		return nil
+	}
+	tmp := c.path(infoHash) + ".tmp"
+	if err := os.WriteFile(tmp, infoBytes, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path(infoHash)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[infoHash]; ok {
+		element.Value.(*metadataCacheEntry).storedAt = c.now()
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[infoHash] = c.order.PushFront(&metadataCacheEntry{infoHash: infoHash, storedAt: c.now()})
+	}
+	c.evictLocked()
+	return nil
+}
+
+// Remove 删除条目，缓存的info字典与info hash不符时调用
+func (c *MetadataCache) Remove(infoHash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[strings.ToLower(infoHash)]; ok {
+		c.removeLocked(element)
+	}
+}
+
+// Sweep 删除过期的条目，返回删除的条目数
+func (c *MetadataCache) Sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	now := c.now()
+	for element := c.order.Back(); element != nil; {
+		prev := element.Prev()
+		if now.Sub(element.Value.(*metadataCacheEntry).storedAt) > c.ttl {
+			c.removeLocked(element)
+			removed++
+		}
+		element = prev
+	}
+	return removed
+}
+
+// Len 缓存的条目数，包括尚未清理的过期条目
+func (c *MetadataCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// evictLocked 条目数超过上限时淘汰最久未使用的条目。调用方持有c.mu
+func (c *MetadataCache) evictLocked() {
+	for len(c.entries) > c.maxEntries {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// removeLocked 删除条目及其文件。调用方持有c.mu
+func (c *MetadataCache) removeLocked(element *list.Element) {
+	entry := element.Value.(*metadataCacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.infoHash)
+	if err := os.Remove(c.path(entry.infoHash)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cached metadata %s: %v", entry.infoHash, err)
+	}
+}
+
+// SetMetadataCache 设置种子元数据缓存，nil表示不缓存。应在Start之前调用
+func (m *Manager) SetMetadataCache(cache *MetadataCache) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.metadataCache = cache
+}
+
+// sweepMetadataCache 定期删除过期的元数据缓存条目
+func (m *Manager) sweepMetadataCache(cache *MetadataCache) {
+	interval := cache.ttl / 24
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if removed := cache.Sweep(); removed > 0 {
+			log.Printf("Removed %d expired metadata cache entries", removed)
+		}
+	}
+}
+
+// applyCachedMetadata 有缓存的info字典时直接交给种子，省去从peer获取元数据的等待。
+// 与info hash不符的缓存条目被删除
+func (m *Manager) applyCachedMetadata(taskID string, t *torrent.Torrent) {
+	if m.loadCachedMetadata(t) {
+		m.taskLog.Info(taskID, tasklog.SourceDownload, "metadata loaded from cache")
+	}
+}
+
+// loadCachedMetadata 把缓存的info字典交给种子，返回是否使用了缓存
+func (m *Manager) loadCachedMetadata(t *torrent.Torrent) bool {
+	m.mutex.RLock()
+	cache := m.metadataCache
+	m.mutex.RUnlock()
+	if cache == nil || t.Info() != nil {
+		return false
+	}
+	infoHash := t.InfoHash().HexString()
+	infoBytes, ok := cache.Get(infoHash)
+	if !ok {
+		return false
+	}
+	if err := t.SetInfoBytes(infoBytes); err != nil {
+		log.Printf("Discarding cached metadata for %s: %v", infoHash, err)
+		cache.Remove(infoHash)
+		return false
+	}
+	return true
+}
+
+// storeMetadata 缓存通过大小检查的info字典
+func (m *Manager) storeMetadata(t *torrent.Torrent) {
+	m.mutex.RLock()
+	cache := m.metadataCache
+	m.mutex.RUnlock()
+	if cache == nil {
+		return
+	}
+	if err := cache.Put(t.InfoHash().HexString(), t.Metainfo().InfoBytes); err != nil {
+		log.Printf("Failed to cache metadata for %s: %v", t.InfoHash().HexString(), err)
+	}
+}
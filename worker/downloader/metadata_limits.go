@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"worker/models"
+)
+
+// 默认的种子元数据上限
+const (
+	DefaultMaxTorrentFiles  = 10000
+	DefaultMaxMetadataBytes = 4 * 1024 * 1024
+)
+
+// DefaultMetadataTimeout 默认等待种子元数据的时长，0表示一直等待。设置后超过该时长任务以metadata_timeout失败并自动重试
+const DefaultMetadataTimeout = 0
+
+// ErrMetadataTooLarge 种子元数据超过配置上限
+var ErrMetadataTooLarge = errors.New("torrent metadata exceeds configured limits")
+
+// MetadataLimits 限制GotInfo后接受的文件数量与元数据大小，防止恶意种子撑爆数据库和网关消息
+type MetadataLimits struct {
+	MaxFiles int // 最大文件数，0表示使用默认值
+	MaxBytes int // info字典与序列化文件列表的最大字节数，0表示使用默认值
+}
+
+func (l MetadataLimits) withDefaults() MetadataLimits {
+	if l.MaxFiles <= 0 {
+		l.MaxFiles = DefaultMaxTorrentFiles
+	}
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = DefaultMaxMetadataBytes
+	}
+	return l
+}
+
+// checkFileCount 在构建文件列表之前检查文件数量
+func (l MetadataLimits) checkFileCount(count int) error {
+	limits := l.withDefaults()
+	if count > limits.MaxFiles {
+		return fmt.Errorf("%w: %d files (max %d)", ErrMetadataTooLarge, count, limits.MaxFiles)
+	}
+	return nil
+}
+
+// checkMetadata 检查文件数量、info字典大小以及序列化后的文件列表大小
+func (l MetadataLimits) checkMetadata(infoBytes int, files []models.TorrentFileInfo) (string, error) {
+	if err := l.checkFileCount(len(files)); err != nil {
+		return "", err
+	}
+
+	limits := l.withDefaults()
+	if infoBytes > limits.MaxBytes {
+		return "", fmt.Errorf("%w: info dictionary is %d bytes (max %d)", ErrMetadataTooLarge, infoBytes, limits.MaxBytes)
+	}
+
+	var task models.Task
+	if err := task.SetTorrentFiles(files); err != nil {
+		return "", err
+	}
+	if len(task.TorrentFiles) > limits.MaxBytes {
+		return "", fmt.Errorf("%w: file list is %d bytes (max %d)", ErrMetadataTooLarge, len(task.TorrentFiles), limits.MaxBytes)
+	}
+
+	return task.TorrentFiles, nil
+}
+
+// SetMetadataTimeout 设置等待种子元数据的时长上限，0表示一直等待
+func (m *Manager) SetMetadataTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.metadataTimeout = timeout
+}
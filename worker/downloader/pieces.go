@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"worker/domain"
+)
+
+// ErrPiecesUnavailable 任务不在下载中，无法获取分片状态
+var ErrPiecesUnavailable = errors.New("piece state is only available for active downloads")
+
+// videoExtensions 用于选择播放文件的视频扩展名
+var videoExtensions = []string{".mp4", ".mkv", ".avi", ".mov", ".wmv", ".flv", ".webm", ".m4v"}
+
+// PieceMap 任务视频文件的分片可用性。Runs为交替的游程长度，
+// 第一个游程表示已完成的分片（可能为0），随后依次为未完成、已完成……
+type PieceMap struct {
+	TaskID          string `json:"task_id"`
+	FilePath        string `json:"file_path"`
+	FileSize        int64  `json:"file_size"`
+	FileOffset      int64  `json:"file_offset"` // 文件在种子数据中的起始偏移
+	PieceLength     int64  `json:"piece_length"`
+	FirstPiece      int    `json:"first_piece"`
+	PieceCount      int    `json:"piece_count"`
+	CompletedPieces int    `json:"completed_pieces"`
+	Complete        bool   `json:"complete"`
+	Runs            []int  `json:"runs"`
+}
+
+// pieceRun 连续的同状态分片
+type pieceRun struct {
+	complete bool
+	length   int
+}
+
+// PieceAvailability 返回任务视频文件的分片可用性。已下载完成的任务直接报告为完整。
+func (m *Manager) PieceAvailability(taskID string) (*PieceMap, error) {
+	m.mutex.RLock()
+	t, active := m.activeTasks[taskID]
+	m.mutex.RUnlock()
+
+	if !active || t.Info() == nil {
+		task, err := m.taskRepo.GetByTaskID(taskID)
+		if err != nil {
+			return nil, fmt.Errorf("task not found: %s", taskID)
+		}
+		switch task.Status {
+		case domain.TaskStatusCompleted, domain.TaskStatusTranscoding, domain.TaskStatusReady:
+		default:
+			return nil, ErrPiecesUnavailable
+		}
+
+		pieces := &PieceMap{TaskID: taskID, Complete: true}
+		if files, err := task.GetTorrentFiles(); err == nil {
+			candidates := make([]fileCandidate, len(files))
+			for i, file := range files {
+				candidates[i] = fileCandidate{name: file.FileName, size: file.FileSize}
+			}
+			if index := pickVideoFile(candidates); index >= 0 {
+				pieces.FilePath = files[index].FilePath
+				pieces.FileSize = files[index].FileSize
+			}
+		}
+		return pieces, nil
+	}
+
+	files := t.Files()
+	candidates := make([]fileCandidate, len(files))
+	for i, file := range files {
+		candidates[i] = fileCandidate{name: file.DisplayPath(), size: file.Length()}
+	}
+	index := pickVideoFile(candidates)
+	if index < 0 {
+		return nil, fmt.Errorf("task %s has no files", taskID)
+	}
+	file := files[index]
+
+	begin, end := file.BeginPieceIndex(), file.EndPieceIndex()
+	runs := make([]pieceRun, 0)
+	for _, run := range t.PieceStateRuns() {
+		runs = append(runs, pieceRun{complete: run.Complete, length: run.Length})
+	}
+
+	encoded, completed := encodePieceRuns(runs, begin, end)
+	return &PieceMap{
+		TaskID:          taskID,
+		FilePath:        file.Path(),
+		FileSize:        file.Length(),
+		FileOffset:      file.Offset(),
+		PieceLength:     t.Info().PieceLength,
+		FirstPiece:      begin,
+		PieceCount:      end - begin,
+		CompletedPieces: completed,
+		Complete:        completed == end-begin,
+		Runs:            encoded,
+	}, nil
+}
+
+type fileCandidate struct {
+	name string
+	size int64
+}
+
+// pickVideoFile 选择最大的视频文件；没有视频文件时选择最大的文件
+func pickVideoFile(files []fileCandidate) int {
+	best, bestVideo := -1, -1
+	var bestSize, bestVideoSize int64
+	for i, file := range files {
+		name, size := file.name, file.size
+		if best < 0 || size > bestSize {
+			best, bestSize = i, size
+		}
+		if isVideoFile(name) && (bestVideo < 0 || size > bestVideoSize) {
+			bestVideo, bestVideoSize = i, size
+		}
+	}
+	if bestVideo >= 0 {
+		return bestVideo
+	}
+	return best
+}
+
+func isVideoFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, videoExt := range videoExtensions {
+		if ext == videoExt {
+			return true
+		}
+	}
+	return false
+}
+
+// encodePieceRuns 截取[begin, end)范围内的分片状态并编码为交替游程，返回游程与已完成分片数
+func encodePieceRuns(runs []pieceRun, begin, end int) ([]int, int) {
+	encoded := []int{0}
+	completed := 0
+	current := true // 当前游程表示的状态，从已完成开始
+
+	position := 0
+	for _, run := range runs {
+		start, stop := position, position+run.length
+		position = stop
+		if stop <= begin || start >= end {
+			continue
+		}
+		if start < begin {
+			start = begin
+		}
+		if stop > end {
+			stop = end
+		}
+
+		length := stop - start
+		if run.complete {
+			completed += length
+		}
+		if run.complete != current {
+			encoded = append(encoded, 0)
+			current = run.complete
+		}
+		encoded[len(encoded)-1] += length
+	}
+
+	return encoded, completed
+}
@@ -0,0 +1,150 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+
+	"worker/models"
+	"worker/tasklog"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// ErrPrivateNotConfirmed 节点要求确认私有种子，而提交者没有确认
+var ErrPrivateNotConfirmed = errors.New("private torrent requires confirmation: resubmit or retry with allow_private")
+
+// SetRequirePrivateConfirmation 设置私有种子是否需要提交者确认（任务元数据allow_private）才下载，
+// 适用于多人共用的节点
+func (m *Manager) SetRequirePrivateConfirmation(require bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requirePrivateConfirmation = require
+}
+
+// isPrivateTorrent 判断info字典是否带有private标记（BEP27）
+func isPrivateTorrent(info *metainfo.Info) bool {
+	return info != nil && info.Private != nil && *info.Private
+}
+
+// checkPrivateTorrent 返回种子是否为私有种子；需要确认而任务元数据中没有allow_private时返回错误
+func checkPrivateTorrent(info *metainfo.Info, requireConfirmation bool, metadata map[string]interface{}) (bool, error) {
+	if !isPrivateTorrent(info) {
+		return false, nil
+	}
+	if requireConfirmation && metadata["allow_private"] != true {
+		return true, ErrPrivateNotConfirmed
+	}
+	return true, nil
+}
+
+// magnetHasTrackers 磁力链接是否自带tracker。自带tracker时公开tracker推迟到确认不是私有种子后再追加；
+// 没有tracker时只能靠公开tracker和DHT获取元数据。
+func magnetHasTrackers(magnetURL string) bool {
+	magnet, err := parseMagnet(magnetURL)
+	return err == nil && len(magnet.Trackers) > 0
+}
+
+// addPublicTrackers 为种子追加tracker策略允许的公开tracker
+func (m *Manager) addPublicTrackers(taskID string, t *torrent.Torrent) {
+	tiers := m.publicTrackerTiers()
+	t.AddTrackers(tiers)
+	m.taskLog.Info(taskID, tasklog.SourceTracker, "added %d public trackers", len(tiers))
+}
+
+// publicTrackerTiers 策略允许的公开tracker，每个tracker单独一层
+func (m *Manager) publicTrackerTiers() [][]string {
+	trackers := m.allowedPublicTrackers()
+	tiers := make([][]string, 0, len(trackers))
+	for _, tracker := range trackers {
+		tiers = append(tiers, []string{tracker})
+	}
+	return tiers
+}
+
+// privateTorrentClient 私有种子专用的客户端，关闭DHT和PEX，首次遇到私有种子时创建。
+// anacrolix/torrent只能按客户端关闭DHT/PEX，因此私有种子拿到元数据后移到这个客户端。
+func (m *Manager) privateTorrentClient() (*torrent.Client, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.privateClient != nil {
+		return m.privateClient, nil
+	}
+
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = m.downloadPath
+	config.Seed = true
+	config.NoDHT = true
+	config.DisablePEX = true
+	m.applyRateLimiters(config)
+	// 分片完成状态放在内存中，避免与主客户端争用同一个数据库文件；重新加入时校验已有数据
+	config.DefaultStorage = storage.NewFileWithCompletion(m.downloadPath, storage.NewMapPieceCompletion())
+
+	client, _, err := newTorrentClient(config, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private torrent client: %w", err)
+	}
+	m.privateClient = client
+	return client, nil
+}
+
+// isolatePrivateTorrent 把已获取元数据的私有种子从主客户端移到关闭DHT/PEX的客户端，
+// 只保留种子自带的tracker
+func (m *Manager) isolatePrivateTorrent(task *models.Task, t *torrent.Torrent) (*torrent.Torrent, error) {
+	client, err := m.privateTorrentClient()
+	if err != nil {
+		return nil, err
+	}
+
+	mi := t.Metainfo()
+	m.mutex.RLock()
+	public := m.publicTrackers
+	m.mutex.RUnlock()
+	mi.AnnounceList = withoutTrackers(mi.AnnounceList, public)
+	if mi.Announce != "" && len(withoutTrackers([][]string{{mi.Announce}}, public)) == 0 {
+		mi.Announce = ""
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(&mi)
+	if err != nil {
+		return nil, err
+	}
+	spec.DisplayName = t.Name()
+
+	t.Drop()
+	isolated, _, err := client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	<-isolated.GotInfo()
+
+	m.mutex.Lock()
+	m.activeTasks[task.TaskID] = isolated
+	m.holdIfQuietLocked(isolated)
+	m.mutex.Unlock()
+
+	m.taskLog.Info(task.TaskID, tasklog.SourceTracker, "private torrent: DHT and PEX disabled, %d own trackers kept", len(spec.Trackers))
+	return isolated, nil
+}
+
+// withoutTrackers 去掉追加的公开tracker，空的层级一并去掉
+func withoutTrackers(tiers [][]string, trackers []string) [][]string {
+	public := make(map[string]bool, len(trackers))
+	for _, tracker := range trackers {
+		public[tracker] = true
+	}
+
+	var kept [][]string
+	for _, tier := range tiers {
+		var urls []string
+		for _, url := range tier {
+			if !public[url] {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			kept = append(kept, urls)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,275 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"worker/database"
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+
+	"github.com/anacrolix/torrent"
+)
+
+// progressFlushInterval 合并后的进度写库间隔，与进度采样间隔一致
+const progressFlushInterval = 2 * time.Second
+
+// progressSource 已完成字节数的来源，通常是torrent或其中被选中的文件
+type progressSource interface {
+	BytesCompleted() int64
+}
+
+// selectedFiles 只统计被选中文件的已完成字节数
+type selectedFiles []*torrent.File
+
+func (files selectedFiles) BytesCompleted() int64 {
+	var total int64
+	for _, file := range files {
+		total += file.BytesCompleted()
+	}
+	return total
+}
+
+// progressTracker 根据已完成字节数计算进度与速度。计数器从创建时的已完成字节数开始，
+// 恢复的任务第一次采样不会把之前下载的数据算作速度。
+type progressTracker struct {
+	size           int64
+	lastDownloaded int64
+	lastTime       time.Time
+}
+
+func newProgressTracker(size int64, source progressSource, now time.Time) *progressTracker {
+	return &progressTracker{
+		size:           size,
+		lastDownloaded: clampDownloaded(source.BytesCompleted(), size),
+		lastTime:       now,
+	}
+}
+
+// sample 采样一次，返回限制在[0,size]内的已下载字节数、[0,100]内的进度以及速度（字节/秒）。
+// 重新校验分片时已完成字节数可能回退，此时速度记为0。
+func (p *progressTracker) sample(source progressSource, now time.Time) (int64, int, int64) {
+	downloaded := clampDownloaded(source.BytesCompleted(), p.size)
+
+	var speed int64
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 && downloaded > p.lastDownloaded {
+		speed = int64(float64(downloaded-p.lastDownloaded) / elapsed)
+	}
+	p.lastDownloaded = downloaded
+	p.lastTime = now
+
+	return downloaded, progressPercent(downloaded, p.size), speed
+}
+
+// estimateETA 按当前速度估计剩余下载秒数（向上取整），已下载完时为0，速度为0时为-1
+func estimateETA(size, downloaded, speed int64) int64 {
+	remaining := size - downloaded
+	if remaining <= 0 {
+		return 0
+	}
+	if speed <= 0 {
+		return -1
+	}
+	return (remaining + speed - 1) / speed
+}
+
+func clampDownloaded(downloaded, size int64) int64 {
+	if downloaded < 0 {
+		return 0
+	}
+	if size > 0 && downloaded > size {
+		return size
+	}
+	return downloaded
+}
+
+func progressPercent(downloaded, size int64) int {
+	if size <= 0 {
+		return 0
+	}
+	return int(clampDownloaded(downloaded, size) * 100 / size)
+}
+
+// applyFileSelection 沿用之前保存的文件选择（按路径匹配），新出现的文件默认选中，
+// 返回被选中文件的总大小。之前的选择一个文件都不匹配时全部选中。
+func applyFileSelection(previous, files []models.TorrentFileInfo) int64 {
+	selected := make(map[string]bool, len(previous))
+	for _, file := range previous {
+		selected[file.FilePath] = file.IsSelected
+	}
+
+	var size int64
+	for i := range files {
+		if isSelected, known := selected[files[i].FilePath]; known {
+			files[i].IsSelected = isSelected
+		}
+		if files[i].IsSelected {
+			size += files[i].FileSize
+		}
+	}
+	if size > 0 || len(previous) == 0 {
+		return size
+	}
+
+	for i := range files {
+		files[i].IsSelected = true
+		size += files[i].FileSize
+	}
+	return size
+}
+
+// selectedFilesKey 任务元数据中保存提交时文件选择的键
+const selectedFilesKey = "selected_files"
+
+// requestedSelection 读取提交时保存在元数据中的文件选择
+func requestedSelection(metadata map[string]interface{}) []string {
+	switch value := metadata[selectedFilesKey].(type) {
+	case []string:
+		return value
+	case []interface{}:
+		selection := make([]string, 0, len(value))
+		for _, item := range value {
+			if path, ok := item.(string); ok && path != "" {
+				selection = append(selection, path)
+			}
+		}
+		return selection
+	}
+	return nil
+}
+
+// selectFiles 只选中路径在selection中的文件，路径可以是包含种子名的完整路径或界面显示的路径，
+// 返回被选中文件的总大小。一个文件都不匹配时返回错误，避免静默下载整个种子。
+func selectFiles(files []models.TorrentFileInfo, selection []string) (int64, error) {
+	wanted := make(map[string]bool, len(selection))
+	for _, path := range selection {
+		wanted[path] = true
+	}
+
+	var size int64
+	matched := 0
+	for i := range files {
+		files[i].IsSelected = wanted[files[i].FilePath] || wanted[files[i].FileName]
+		if files[i].IsSelected {
+			size += files[i].FileSize
+			matched++
+		}
+	}
+	if matched == 0 {
+		return 0, fmt.Errorf("none of the %d selected files are in the torrent", len(selection))
+	}
+	return size, nil
+}
+
+// applyFilePriorities 按files中的选择设置live torrent各文件的优先级：选中的文件正常下载，
+// 未选中的文件不再请求分片。返回统计进度的来源，全部选中时为整个torrent
+func applyFilePriorities(t *torrent.Torrent, files []models.TorrentFileInfo) progressSource {
+	all := true
+	selected := make(selectedFiles, 0, len(files))
+	for i, file := range t.Files() {
+		if i < len(files) && !files[i].IsSelected {
+			file.SetPriority(torrent.PiecePriorityNone)
+			all = false
+			continue
+		}
+		file.SetPriority(torrent.PiecePriorityNormal)
+		selected = append(selected, file)
+	}
+	if all {
+		return t
+	}
+	return selected
+}
+
+// SelectFiles 修改任务选择下载的文件，路径可以是种子内的完整路径或界面显示的路径。
+// 还没拿到元数据的任务保存选择，拿到元数据后应用；已知文件列表的任务更新各文件的IsSelected
+// 和任务大小，正在下载的任务立即调整文件优先级，取消选择的文件已下载的数据保留；
+// 与选中文件共享的边界分片仍会写入未选中的文件。下载已完成的任务不能再修改
+func (m *Manager) SelectFiles(taskID string, selectedPaths []string) error {
+	if len(selectedPaths) == 0 {
+		return errors.New("at least one file must be selected")
+	}
+	if _, err := m.taskRepo.GetByTaskID(taskID); err != nil {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+
+	// 只写回文件选择相关的列，不用整行保存覆盖下载协程同时写入的状态与进度
+	var files []models.TorrentFileInfo
+	var size int64
+	err := m.taskRepo.UpdateFiles(taskID, func(task *models.Task) error {
+		switch task.Status {
+		case domain.TaskStatusPending, domain.TaskStatusDownloading, domain.TaskStatusPaused:
+		default:
+			return fmt.Errorf("cannot change the file selection of a %s task", task.Status)
+		}
+
+		var err error
+		files, err = task.GetTorrentFiles()
+		if err != nil {
+			return fmt.Errorf("failed to parse torrent files: %w", err)
+		}
+		if len(files) == 0 {
+			metadata, _ := task.GetMetadata()
+			if metadata == nil {
+				metadata = make(map[string]interface{})
+			}
+			metadata[selectedFilesKey] = selectedPaths
+			return task.SetMetadata(metadata)
+		}
+
+		if size, err = selectFiles(files, selectedPaths); err != nil {
+			return err
+		}
+		if err := task.SetTorrentFiles(files); err != nil {
+			return err
+		}
+		task.Size = size
+		task.Downloaded = clampDownloaded(task.Downloaded, size)
+		task.Progress = progressPercent(task.Downloaded, size)
+		return nil
+	})
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	m.mutex.RLock()
+	t, active := m.activeTasks[taskID]
+	m.mutex.RUnlock()
+	if active && t.Info() != nil && len(t.Files()) == len(files) {
+		applyFilePriorities(t, files)
+	}
+
+	m.taskLog.Info(taskID, tasklog.SourceTask, "file selection changed: %d of %d files, %d bytes", countSelected(files), len(files), size)
+	return nil
+}
+
+// countSelected 返回被选中的文件数
+func countSelected(files []models.TorrentFileInfo) int {
+	count := 0
+	for _, file := range files {
+		if file.IsSelected {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *Manager) progressBatcher() *database.ProgressBatcher {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.progress
+}
+
+// recordProgress 保存一次进度采样。管理器启动后交给批量写入器合并写库，否则直接写库
+func (m *Manager) recordProgress(taskID string, progress int, speed int64, downloaded int64) {
+	if batcher := m.progressBatcher(); batcher != nil {
+		batcher.Record(taskID, progress, speed, downloaded)
+		return
+	}
+	if err := m.taskRepo.UpdateProgress(taskID, progress, speed, downloaded); err != nil {
+		log.Printf("Failed to update progress for task %s: %v", taskID, err)
+	}
+}
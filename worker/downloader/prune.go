@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+)
+
+// ErrTaskActive 任务仍在下载或转码，不能清理数据
+var ErrTaskActive = errors.New("task is still active")
+
+// PruneResult 清理任务下载数据的结果
+type PruneResult struct {
+	TaskID         string   `json:"task_id"`
+	DryRun         bool     `json:"dry_run"`
+	Files          []string `json:"files"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// PruneTaskData 删除任务在下载目录中的残留数据。文件路径从TorrentFiles解析，
+// 只会删除下载根目录之内的文件；dryRun为true时只报告将被删除的文件。
+func (m *Manager) PruneTaskData(taskID string, dryRun bool) (*PruneResult, error) {
+	task, err := m.taskRepo.GetByTaskID(taskID)
+	if err != nil {
+		return nil, fmt.Errorf("task not found: %s", taskID)
+	}
+
+	m.mutex.RLock()
+	_, active := m.activeTasks[taskID]
+	m.mutex.RUnlock()
+	if active || task.Status == domain.TaskStatusDownloading || task.Status == domain.TaskStatusTranscoding {
+		return nil, ErrTaskActive
+	}
+
+	files, err := task.GetTorrentFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent files: %w", err)
+	}
+
+	root, err := filepath.Abs(m.downloadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{TaskID: taskID, DryRun: dryRun}
+	result.Files, result.ReclaimedBytes = removeTaskFiles(taskID, root, files, dryRun)
+
+	if dryRun {
+		return result, nil
+	}
+
+	metadata, _ := task.GetMetadata()
+	metadata["data_pruned"] = true
+	metadata["pruned_bytes"] = result.ReclaimedBytes
+	task.SetMetadata(metadata)
+	if err := m.taskRepo.Update(task); err != nil {
+		log.Printf("Failed to record prune result for task %s: %v", taskID, err)
+	}
+
+	m.taskLog.Info(taskID, tasklog.SourceTask, "pruned %d files, reclaimed %d bytes", len(result.Files), result.ReclaimedBytes)
+	return result, nil
+}
+
+// removeTaskFiles 删除任务在下载根目录root下的文件及随之变空的目录，返回删除的文件与字节数；
+// dryRun为true时只统计不删除
+func removeTaskFiles(taskID, root string, files []models.TorrentFileInfo, dryRun bool) ([]string, int64) {
+	removed := []string{}
+	var bytes int64
+	for _, path := range resolveTaskFiles(root, files) {
+		info, err := os.Lstat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove %s for task %s: %v", path, taskID, err)
+				continue
+			}
+			removeEmptyParents(root, filepath.Dir(path))
+		}
+
+		removed = append(removed, path)
+		bytes += info.Size()
+	}
+	return removed, bytes
+}
+
+// resolveTaskFiles 将种子文件路径解析为下载根目录下的绝对路径，丢弃任何逃逸出根目录的路径
+func resolveTaskFiles(root string, files []models.TorrentFileInfo) []string {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		realRoot = root
+	}
+
+	var paths []string
+	for _, file := range files {
+		if file.FilePath == "" {
+			continue
+		}
+
+		path := filepath.Join(root, file.FilePath)
+		if !isWithin(root, path) {
+			log.Printf("Refusing to touch %q outside download root", file.FilePath)
+			continue
+		}
+
+		// 父目录可能是指向根目录之外的符号链接
+		if realDir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil && !isWithin(realRoot, filepath.Join(realDir, filepath.Base(path))) {
+			log.Printf("Refusing to touch %q: resolves outside download root", file.FilePath)
+			continue
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeEmptyParents 自下而上删除空目录，直到下载根目录
+func removeEmptyParents(root, dir string) {
+	for isWithin(root, dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,209 @@
+package downloader
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"sort"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+)
+
+// queuedTask 等待下载名额的任务
+type queuedTask struct {
+	task  *models.Task
+	seq   uint64 // 入队顺序，创建时间相同时保证先进先出
+	index int    // 在堆中的位置，供heap.Fix/heap.Remove使用
+}
+
+// taskQueue 按优先级排列的等待队列（container/heap），优先级高的在前，同优先级先提交的在前
+type taskQueue []*queuedTask
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool {
+	a, b := q[i].task, q[j].task
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	item := x.(*queuedTask)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
+
+// checkPriority 校验优先级是否在1-10之间
+func checkPriority(priority int) error {
+	if priority < domain.MinTaskPriority || priority > domain.MaxTaskPriority {
+		return fmt.Errorf("priority must be between %d and %d, got %d", domain.MinTaskPriority, domain.MaxTaskPriority, priority)
+	}
+	return nil
+}
+
+// schedule 将任务放入等待队列，有空闲名额时立即开始
+func (m *Manager) schedule(task *models.Task) {
+	m.mutex.Lock()
+	m.enqueueLocked(task)
+	ready := m.takeRunnableLocked()
+	m.mutex.Unlock()
+	m.launch(ready)
+}
+
+// enqueueLocked 将任务加入等待队列，已在队列中的任务只更新内容。调用方持有m.mutex
+func (m *Manager) enqueueLocked(task *models.Task) {
+	if item, exists := m.queued[task.TaskID]; exists {
+		item.task = task
+		heap.Fix(&m.pending, item.index)
+		return
+	}
+	m.queueSeq++
+	item := &queuedTask{task: task, seq: m.queueSeq}
+	heap.Push(&m.pending, item)
+	m.queued[task.TaskID] = item
+}
+
+// unqueueLocked 将任务移出等待队列，返回任务是否在队列中。调用方持有m.mutex
+func (m *Manager) unqueueLocked(taskID string) bool {
+	item, exists := m.queued[taskID]
+	if !exists {
+		return false
+	}
+	heap.Remove(&m.pending, item.index)
+	delete(m.queued, taskID)
+	return true
+}
+
+// takeRunnableLocked 在名额允许的范围内按优先级取出等待的任务并占用名额。调用方持有m.mutex
+func (m *Manager) takeRunnableLocked() []*models.Task {
+	if m.quiet {
+		// 静默时段结束后由SetQuiet开始
+		return nil
+	}
+	var ready []*models.Task
+	for len(m.running) < m.maxTasks && m.pending.Len() > 0 {
+		item := heap.Pop(&m.pending).(*queuedTask)
+		delete(m.queued, item.task.TaskID)
+		m.running[item.task] = true
+		ready = append(ready, item.task)
+	}
+	return ready
+}
+
+// releaseSlot 下载结束（完成、失败、暂停或删除）后释放名额，并开始下一个等待的任务
+func (m *Manager) releaseSlot(task *models.Task) {
+	m.mutex.Lock()
+	delete(m.running, task)
+	ready := m.takeRunnableLocked()
+	m.mutex.Unlock()
+	m.launch(ready)
+}
+
+// launch 开始下载已占用名额的任务
+func (m *Manager) launch(tasks []*models.Task) {
+	for _, task := range tasks {
+		log.Printf("Starting queued task %s (priority %d)", task.TaskID, task.Priority)
+		go m.downloadTask(task)
+	}
+}
+
+// SetPriority 修改任务的下载优先级，只写priority一列。还在排队的任务按新优先级重新排序；
+// 已开始的任务更新内存中的对象，暂停后重新排队时按新值排序
+func (m *Manager) SetPriority(taskID string, priority int) error {
+	if err := checkPriority(priority); err != nil {
+		return err
+	}
+	if err := m.taskRepo.SetPriority(taskID, priority); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	if item, exists := m.queued[taskID]; exists {
+		item.task.Priority = priority
+		heap.Fix(&m.pending, item.index)
+	}
+	for task := range m.running {
+		if task.TaskID == taskID {
+			task.Priority = priority
+		}
+	}
+	m.mutex.Unlock()
+
+	m.taskLog.Info(taskID, tasklog.SourceTask, "priority set to %d", priority)
+	return nil
+}
+
+// SetMaxTasks 设置同时下载的任务数，超出的任务排队等待。应在Start之前调用
+func (m *Manager) SetMaxTasks(maxTasks int) {
+	if maxTasks <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	m.maxTasks = maxTasks
+	m.mutex.Unlock()
+}
+
+// QueueEntry 下载队列中的一个任务
+type QueueEntry struct {
+	TaskID   string `json:"task_id"`
+	Priority int    `json:"priority"`
+	Position int    `json:"position,omitempty"` // 在等待队列中的位置，从1开始；已开始的任务为0
+}
+
+// QueueSnapshot 下载名额与等待队列的快照
+type QueueSnapshot struct {
+	MaxTasks int          `json:"max_tasks"`
+	Running  []QueueEntry `json:"running"`
+	Pending  []QueueEntry `json:"pending"` // 按开始的先后顺序
+}
+
+// QueueSnapshot 返回占用下载名额的任务和等待队列，等待的任务按开始的先后排列
+func (m *Manager) QueueSnapshot() QueueSnapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	snapshot := QueueSnapshot{
+		MaxTasks: m.maxTasks,
+		Running:  make([]QueueEntry, 0, len(m.running)),
+		Pending:  make([]QueueEntry, 0, m.pending.Len()),
+	}
+	// 暂停后立即恢复的任务新旧实例同时占用名额，只列出一次
+	seen := make(map[string]bool, len(m.running))
+	for task := range m.running {
+		if !seen[task.TaskID] {
+			seen[task.TaskID] = true
+			snapshot.Running = append(snapshot.Running, QueueEntry{TaskID: task.TaskID, Priority: task.Priority})
+		}
+	}
+	sort.Slice(snapshot.Running, func(i, j int) bool { return snapshot.Running[i].TaskID < snapshot.Running[j].TaskID })
+
+	ordered := append(taskQueue(nil), m.pending...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered.Less(i, j) })
+	for i, item := range ordered {
+		snapshot.Pending = append(snapshot.Pending, QueueEntry{TaskID: item.task.TaskID, Priority: item.task.Priority, Position: i + 1})
+	}
+	return snapshot
+}
@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"log"
+	"time"
+
+	"worker/models"
+
+	"github.com/anacrolix/torrent"
+)
+
+// SetQuiet 进入静默时段时暂停所有活跃torrent的下载与上传，等待的任务不再开始；
+// 离开时恢复传输（磁盘已满暂停写入的除外）并开始等待的任务。任务状态不变
+func (m *Manager) SetQuiet(quiet bool) {
+	m.mutex.Lock()
+	if m.quiet == quiet {
+		m.mutex.Unlock()
+		return
+	}
+	m.quiet = quiet
+	if quiet {
+		m.quietSince = time.Now()
+	} else {
+		m.quietTotal += time.Since(m.quietSince)
+	}
+	diskPaused := m.diskFull && m.diskFullAction == DiskFullPause
+	torrents := make([]*torrent.Torrent, 0, len(m.activeTasks))
+	for _, t := range m.activeTasks {
+		torrents = append(torrents, t)
+	}
+	var ready []*models.Task
+	if !quiet {
+		ready = m.takeRunnableLocked()
+	}
+	m.mutex.Unlock()
+
+	for _, t := range torrents {
+		if quiet {
+			t.DisallowDataDownload()
+			t.DisallowDataUpload()
+			continue
+		}
+		if !diskPaused {
+			t.AllowDataDownload()
+		}
+		t.AllowDataUpload()
+	}
+	if quiet {
+		log.Printf("Quiet hours: paused transfers of %d torrents", len(torrents))
+	} else {
+		log.Printf("Quiet hours over: resumed transfers of %d torrents, starting %d queued tasks", len(torrents), len(ready))
+	}
+	m.launch(ready)
+}
+
+// holdIfQuietLocked 静默时段内新加入的torrent同样不下载、不上传。调用方持有m.mutex
+func (m *Manager) holdIfQuietLocked(t *torrent.Torrent) {
+	if m.quiet {
+		t.DisallowDataDownload()
+		t.DisallowDataUpload()
+	}
+}
+
+// quietElapsed 启动以来静默时段的累计时长，包括正在进行的这一次
+func (m *Manager) quietElapsed() time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	elapsed := m.quietTotal
+	if m.quiet {
+		elapsed += time.Since(m.quietSince)
+	}
+	return elapsed
+}
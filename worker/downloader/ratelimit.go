@@ -0,0 +1,44 @@
+package downloader
+
+import (
+	"log"
+
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+// minRateBurst 限速器的最小突发量，需容纳一次上传的分块请求（16KB）和一次读取
+const minRateBurst = 256 * 1024
+
+// rateLimit 将kbps换算为限速器参数（字节/秒），0表示不限速；突发量为一秒的额度且不小于minRateBurst
+func rateLimit(kbps int) (rate.Limit, int) {
+	if kbps <= 0 {
+		return rate.Inf, minRateBurst
+	}
+	bytesPerSec := kbps * 1000 / 8
+	burst := bytesPerSec
+	if burst < minRateBurst {
+		burst = minRateBurst
+	}
+	return rate.Limit(bytesPerSec), burst
+}
+
+// applyRateLimiters 让torrent客户端使用管理器的共享限速器
+func (m *Manager) applyRateLimiters(config *torrent.ClientConfig) {
+	config.DownloadRateLimiter = m.downloadLimiter
+	config.UploadRateLimiter = m.uploadLimiter
+}
+
+// SetRateLimit 设置整个节点的下载与上传限速（kbps），0表示不限速。
+// 限速器由所有torrent客户端共享，可在运行中随时调整，对进行中的任务立即生效，无需重启客户端。
+func (m *Manager) SetRateLimit(downKbps, upKbps int) {
+	limit, burst := rateLimit(downKbps)
+	m.downloadLimiter.SetLimit(limit)
+	m.downloadLimiter.SetBurst(burst)
+
+	limit, burst = rateLimit(upKbps)
+	m.uploadLimiter.SetLimit(limit)
+	m.uploadLimiter.SetBurst(burst)
+
+	log.Printf("Torrent rate limit set to %d kbps down, %d kbps up (0 = unlimited)", downKbps, upKbps)
+}
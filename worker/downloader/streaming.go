@@ -0,0 +1,291 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"worker/domain"
+	"worker/models"
+	"worker/tasklog"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+)
+
+// streamingTailBytes 流式模式下视频文件末尾优先下载的数据量，供编码探测读取MKV的Cues等索引
+const streamingTailBytes = 4 << 20
+
+// DefaultStreamingReadahead 流式模式默认的预读量：开头这么多数据下载完成后开始转码，
+// 之后读取位置之后这么多数据优先下载
+const DefaultStreamingReadahead = 64 << 20
+
+// streamingPriorities 流式模式下从文件开头起各个预读窗口的分片优先级，之后的分片按普通优先级下载，
+// 转码读到时由读取器的预读提升
+var streamingPriorities = []types.PiecePriority{
+	torrent.PiecePriorityNow,
+	torrent.PiecePriorityNext,
+	torrent.PiecePriorityReadahead,
+	torrent.PiecePriorityHigh,
+}
+
+// streamTarget 流式模式下优先下载的视频文件
+type streamTarget struct {
+	path     string // 文件在种子中的路径
+	pieces   []int  // 头尾数据所在的分片
+	notified bool   // 已回调streamReadyHandler
+}
+
+// SetStreamingMode 开启后视频文件从开头按顺序优先下载，开头的预读量就绪时回调SetStreamReadyHandler
+// 设置的处理器，转码可以通过GetReader在下载完成前开始
+func (m *Manager) SetStreamingMode(enabled bool) {
+	m.mutex.Lock()
+	m.streamingMode = enabled
+	m.mutex.Unlock()
+}
+
+// SetStreamingReadahead 设置流式模式的预读量（字节），不大于0时使用DefaultStreamingReadahead
+func (m *Manager) SetStreamingReadahead(bytes int64) {
+	if bytes <= 0 {
+		bytes = DefaultStreamingReadahead
+	}
+	m.mutex.Lock()
+	m.streamingReadahead = bytes
+	m.mutex.Unlock()
+}
+
+// SetStreamReadyHandler 设置流式模式下视频文件头尾分片下载完成后的回调，filePath为文件在种子中的路径
+func (m *Manager) SetStreamReadyHandler(handler func(task *models.Task, filePath string)) {
+	m.mutex.Lock()
+	m.streamReadyHandler = handler
+	m.mutex.Unlock()
+}
+
+// GetReader 返回下载中任务里某个文件的读取器，读到尚未下载的数据时阻塞等待，
+// 读取位置之后的数据优先下载。filePath为文件在种子中的路径
+func (m *Manager) GetReader(taskID, filePath string) (torrent.Reader, error) {
+	m.mutex.RLock()
+	t, active := m.activeTasks[taskID]
+	readahead := m.streamingReadahead
+	m.mutex.RUnlock()
+	if !active || t.Info() == nil {
+		return nil, fmt.Errorf("task %s is not downloading", taskID)
+	}
+
+	for _, file := range t.Files() {
+		if file.Path() == filePath {
+			reader := file.NewReader()
+			reader.SetReadahead(readahead)
+			return reader, nil
+		}
+	}
+	return nil, fmt.Errorf("file %s not found in task %s", filePath, taskID)
+}
+
+// prioritizeStreamFile 流式模式开启（或任务提交时带sequential=true）时，为选中文件中最大的视频文件从开头起按预读窗口设置递减的优先级，
+// 开头一个窗口与末尾的索引最先下载
+func (m *Manager) prioritizeStreamFile(task *models.Task, t *torrent.Torrent, files []models.TorrentFileInfo) *streamTarget {
+	m.mutex.RLock()
+	enabled := m.streamingMode
+	readahead := m.streamingReadahead
+	m.mutex.RUnlock()
+	if !task.Sequential(enabled) {
+		return nil
+	}
+
+	torrentFiles := t.Files()
+	candidates := make([]fileCandidate, 0, len(files))
+	indexes := make([]int, 0, len(files))
+	for i, file := range files {
+		if file.IsSelected && isVideoFile(file.FileName) {
+			candidates = append(candidates, fileCandidate{name: file.FileName, size: file.FileSize})
+			indexes = append(indexes, i)
+		}
+	}
+	best := pickVideoFile(candidates)
+	if best < 0 {
+		return nil
+	}
+
+	file := torrentFiles[indexes[best]]
+	pieceLength := t.Info().PieceLength
+	for i, window := range sequentialWindows(file.Offset(), file.Length(), pieceLength, readahead, len(streamingPriorities)) {
+		for _, piece := range window {
+			t.Piece(piece).SetPriority(streamingPriorities[i])
+		}
+	}
+	pieces := edgePieces(file.Offset(), file.Length(), pieceLength, readahead, streamingTailBytes)
+	for _, piece := range pieces {
+		t.Piece(piece).SetPriority(torrent.PiecePriorityNow)
+	}
+	m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "streaming mode: downloading %s sequentially, first %d MB and tail first (%d pieces)",
+		file.DisplayPath(), readahead>>20, len(pieces))
+	return &streamTarget{path: file.Path(), pieces: pieces}
+}
+
+// ready 头尾分片是否都已下载并校验
+func (s *streamTarget) ready(t *torrent.Torrent) bool {
+	for _, piece := range s.pieces {
+		if !t.PieceState(piece).Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// transcoding 流式转码已开始，任务状态被转码流程改为transcoding或ready时下载继续
+func (s *streamTarget) transcoding(status domain.TaskStatus) bool {
+	return s != nil && s.notified && (status == domain.TaskStatusTranscoding || status == domain.TaskStatusReady)
+}
+
+// notifyStreamReady 头尾分片就绪后回调一次streamReadyHandler
+func (m *Manager) notifyStreamReady(task *models.Task, t *torrent.Torrent, stream *streamTarget) {
+	if stream == nil || stream.notified || !stream.ready(t) {
+		return
+	}
+	stream.notified = true
+
+	m.mutex.RLock()
+	handler := m.streamReadyHandler
+	readahead := m.streamingReadahead
+	m.mutex.RUnlock()
+
+	// ffmpeg从管道读取，无法跳到文件末尾读取moov，这类文件等下载完成后再转码
+	if needsMoovUpFront(stream.path) {
+		if file := torrentFile(t, stream.path); file != nil {
+			reader := file.NewReader()
+			first, err := moovFirst(reader, readahead)
+			reader.Close()
+			if !first {
+				m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "moov atom of %s is not at the start of the file (%v), transcoding after the download completes", stream.path, err)
+				return
+			}
+		}
+	}
+
+	m.taskLog.Info(task.TaskID, tasklog.SourceDownload, "first %d MB of %s downloaded, ready for streaming", readahead>>20, stream.path)
+	if handler != nil {
+		handler(task, stream.path)
+	}
+}
+
+// torrentFile 种子中路径为filePath的文件
+func torrentFile(t *torrent.Torrent, filePath string) *torrent.File {
+	for _, file := range t.Files() {
+		if file.Path() == filePath {
+			return file
+		}
+	}
+	return nil
+}
+
+// needsMoovUpFront MP4类容器的索引（moov）在媒体数据之后时无法从管道顺序读取
+func needsMoovUpFront(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov":
+		return true
+	}
+	return false
+}
+
+// moovFirst 依次读取MP4顶层box的头部，moov出现在mdat之前时返回true。
+// 只读取开头limit字节之内（已下载、不会阻塞）的box头部，超出范围仍未找到moov时返回false
+func moovFirst(r io.ReadSeeker, limit int64) (bool, error) {
+	var offset int64
+	header := make([]byte, 16)
+	for offset+int64(len(header)) <= limit {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return false, err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:8]) {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, fmt.Errorf("mdat at offset %d before moov", offset)
+		}
+		switch size {
+		case 0:
+			// box延续到文件末尾
+			return false, fmt.Errorf("%s box at offset %d extends to the end of the file", header[4:8], offset)
+		case 1:
+			// 64位长度
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return false, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return false, fmt.Errorf("invalid box size %d at offset %d", size, offset)
+		}
+		offset += size
+	}
+	return false, fmt.Errorf("no moov within the first %d bytes", limit)
+}
+
+// sequentialWindows 文件[offset, offset+length)从开头起连续count个window字节窗口所在的分片，
+// 跨越窗口边界的分片只属于前一个窗口
+func sequentialWindows(offset, length, pieceLength, window int64, count int) [][]int {
+	if length <= 0 || pieceLength <= 0 || window <= 0 {
+		return nil
+	}
+	var windows [][]int
+	next := -1 // 下一个窗口的分片须大于它
+	for i := 0; i < count; i++ {
+		begin := offset + int64(i)*window
+		if begin >= offset+length {
+			break
+		}
+		end := begin + window
+		if end > offset+length {
+			end = offset + length
+		}
+		var pieces []int
+		for _, piece := range pieceSpan(begin, end, pieceLength) {
+			if piece > next {
+				pieces = append(pieces, piece)
+			}
+		}
+		if len(pieces) > 0 {
+			next = pieces[len(pieces)-1]
+		}
+		windows = append(windows, pieces)
+	}
+	return windows
+}
+
+// edgePieces 文件[offset, offset+length)中开头head字节与末尾tail字节所在的分片，升序且不重复
+func edgePieces(offset, length, pieceLength, head, tail int64) []int {
+	if length <= 0 || pieceLength <= 0 {
+		return nil
+	}
+	if head+tail >= length {
+		return pieceSpan(offset, offset+length, pieceLength)
+	}
+
+	pieces := pieceSpan(offset, offset+head, pieceLength)
+	for _, piece := range pieceSpan(offset+length-tail, offset+length, pieceLength) {
+		if len(pieces) == 0 || piece > pieces[len(pieces)-1] {
+			pieces = append(pieces, piece)
+		}
+	}
+	return pieces
+}
+
+// pieceSpan 字节范围[begin, end)覆盖的分片
+func pieceSpan(begin, end, pieceLength int64) []int {
+	if end <= begin {
+		return nil
+	}
+	first, last := int(begin/pieceLength), int((end-1)/pieceLength)
+	pieces := make([]int, 0, last-first+1)
+	for piece := first; piece <= last; piece++ {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
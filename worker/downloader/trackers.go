@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// tracker策略模式
+const (
+	TrackerPolicyAllowAll  = "allow_all" // 默认，不限制tracker
+	TrackerPolicyAllowlist = "allowlist" // 只允许Hosts中的tracker
+	TrackerPolicyDenylist  = "denylist"  // 拒绝Hosts中的tracker
+)
+
+// ErrTrackerNotAllowed 磁力链接引用了策略不允许的tracker
+var ErrTrackerNotAllowed = errors.New("tracker not allowed by policy")
+
+// TrackerPolicy 按主机名限制磁力链接可以引用的tracker。Hosts中的主机名同时匹配其子域名，
+// 如"example.org"匹配"tracker.example.org"。
+type TrackerPolicy struct {
+	Mode  string
+	Hosts []string
+}
+
+// Allows 判断tracker主机名是否被策略允许
+func (p TrackerPolicy) Allows(host string) bool {
+	switch p.Mode {
+	case TrackerPolicyAllowlist:
+		return p.matches(host)
+	case TrackerPolicyDenylist:
+		return !p.matches(host)
+	}
+	return true
+}
+
+func (p TrackerPolicy) matches(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, entry := range p.Hosts {
+		entry = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+		if entry == "" {
+			continue
+		}
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTracker 判断tracker地址是否被允许，无法解析出主机名的地址按不允许处理
+func (p TrackerPolicy) allowsTracker(tracker string) bool {
+	if p.Mode == "" || p.Mode == TrackerPolicyAllowAll {
+		return true
+	}
+	u, err := url.Parse(tracker)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	return p.Allows(u.Hostname())
+}
+
+// ValidateMagnetURL 检查磁力链接格式（见ParseMagnetHashes，web+magnet:链接先规范化）、info hash类型被支持、
+// tr参数都是udp、http或https地址，并且其中的tracker都被策略允许。格式错误时返回ErrInvalidMagnet。
+// 不带tracker的磁力链接只通过DHT获取元数据，总是允许。
+func ValidateMagnetURL(magnetURL string, policy TrackerPolicy) error {
+	hashes, err := ParseMagnetHashes(magnetURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMagnet, err)
+	}
+	if err := checkHashSupport(hashes); err != nil {
+		return err
+	}
+	return policy.checkMagnetTrackers(magnetURL)
+}
+
+// trackerSchemes 磁力链接tr参数允许的协议
+var trackerSchemes = map[string]bool{"udp": true, "http": true, "https": true}
+
+// checkMagnetTrackers 检查磁力链接tr参数中的tracker地址有效并被策略允许
+func (p TrackerPolicy) checkMagnetTrackers(magnetURL string) error {
+	query, err := magnetQuery(magnetURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMagnet, err)
+	}
+	for _, tracker := range query["tr"] {
+		u, err := url.Parse(tracker)
+		if err != nil || !trackerSchemes[strings.ToLower(u.Scheme)] || u.Hostname() == "" {
+			return fmt.Errorf("%w: tracker %q must be a udp, http or https URL", ErrInvalidMagnet, tracker)
+		}
+		if !p.allowsTracker(tracker) {
+			return fmt.Errorf("%w: %s", ErrTrackerNotAllowed, tracker)
+		}
+	}
+	return nil
+}
+
+// SetTrackerPolicy 设置提交的磁力链接可以引用的tracker，同时限制为公开种子追加的tracker
+func (m *Manager) SetTrackerPolicy(policy TrackerPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.trackerPolicy = policy
+}
+
+// SetPublicTrackers 设置为公开种子追加的tracker，之后添加的种子生效。私有种子不追加，否则会被私有tracker封禁
+func (m *Manager) SetPublicTrackers(list []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.publicTrackers = append([]string(nil), list...)
+}
+
+// allowedPublicTrackers 公开tracker中被策略允许的部分
+func (m *Manager) allowedPublicTrackers() []string {
+	m.mutex.RLock()
+	policy := m.trackerPolicy
+	public := m.publicTrackers
+	m.mutex.RUnlock()
+
+	trackers := make([]string, 0, len(public))
+	for _, tracker := range public {
+		if policy.allowsTracker(tracker) {
+			trackers = append(trackers, tracker)
+		}
+	}
+	return trackers
+}
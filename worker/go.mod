@@ -7,6 +7,8 @@ require (
 	github.com/google/uuid v1.3.1
 	github.com/gorilla/websocket v1.5.0
 	github.com/pion/webrtc/v3 v3.2.18
+	golang.org/x/text v0.20.0
+	golang.org/x/time v0.0.0-20220609170525-579cf78fd858
 	gorm.io/driver/sqlite v1.6.0
 	gorm.io/gorm v1.30.0
 	modernc.org/sqlite v1.28.0
@@ -81,8 +83,6 @@ require (
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.9.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
-	golang.org/x/text v0.20.0 // indirect
-	golang.org/x/time v0.0.0-20220609170525-579cf78fd858 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	lukechampine.com/uint128 v1.2.0 // indirect
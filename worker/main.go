@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"worker/app"
 	"worker/client"
 	"worker/config"
 	"worker/database"
 	"worker/downloader"
+	"worker/tasklog"
+	"worker/trackers"
 	"worker/transcoder"
 	"worker/webrtc"
 )
@@ -21,11 +26,31 @@ var (
 	nodeID     = flag.String("id", "", "Worker node ID (auto-generated if empty)")
 	nodeName   = flag.String("name", "", "Worker node name")
 	configFile = flag.String("config", "config/worker.json", "Configuration file path")
+	showSchema = flag.Bool("config-schema", false, "Print the configuration schema as JSON and exit")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "transcode":
+			os.Exit(runTranscodeCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "selftest":
+			os.Exit(runSelfTestCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	flag.Parse()
 
+	if *showSchema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(config.Schema()); err != nil {
+			log.Fatalf("Failed to print config schema: %v", err)
+		}
+		return
+	}
+
 	cfg, err := config.Load(*configFile)
 	if err != nil {
 		log.Printf("Failed to load config, using defaults: %v", err)
@@ -34,6 +59,7 @@ func main() {
 
 	if *gatewayURL != "ws://localhost:8080/ws/nodes" {
 		cfg.Gateway.URL = *gatewayURL
+		cfg.Gateway.URLs = nil
 	}
 	if *nodeID != "" {
 		cfg.Node.ID = *nodeID
@@ -50,11 +76,90 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	taskLogPath := cfg.Storage.TaskLogPath
+	if taskLogPath == "" {
+		taskLogPath = config.Default().Storage.TaskLogPath
+	}
+	taskLog := tasklog.New(taskLogPath,
+		int64(cfg.Storage.TaskLogMaxKB)*1024,
+		int64(cfg.Storage.TaskLogTotalMaxMB)*1024*1024)
+
+	downloadMgr := downloader.New(cfg.Storage.DownloadPath, cfg.Node.ID)
+	downloadMgr.SetTaskLogger(taskLog)
+	downloadMgr.SetListenPort(cfg.Network.ListenPort)
+	downloadMgr.SetMaxTasks(cfg.Limits.MaxDownloads)
+	downloadMgr.SetRateLimit(cfg.Network.MaxBandwidth, cfg.Network.MaxBandwidth)
+	downloadMgr.SetRequirePrivateConfirmation(cfg.Limits.ConfirmPrivateTorrents)
+	downloadMgr.SetDiskGuard(uint64(cfg.Limits.MinFreeDiskMB)<<20, cfg.Limits.DiskFullAction)
+	downloadMgr.SetDiskReserve(cfg.Limits.DiskReservePercent)
+	downloadMgr.SetMetadataTimeout(time.Duration(cfg.Limits.MetadataTimeoutMinutes) * time.Minute)
+	downloadMgr.SetTrackerPolicy(downloader.TrackerPolicy{
+		Mode:  cfg.Network.TrackerPolicy.Mode,
+		Hosts: cfg.Network.TrackerPolicy.Hosts,
+	})
+	publicTrackers, err := trackers.Load(cfg.Network.TrackersFile)
+	if err != nil {
+		log.Printf("Failed to load trackers from %s, using built-in list: %v", cfg.Network.TrackersFile, err)
+		publicTrackers = trackers.Defaults()
+	}
+	downloadMgr.SetPublicTrackers(publicTrackers)
+	if path := cfg.Storage.MetadataCache.Path; path != "" {
+		cache, err := downloader.NewMetadataCache(path,
+			time.Duration(cfg.Storage.MetadataCache.TTLHours)*time.Hour, cfg.Storage.MetadataCache.MaxEntries)
+		if err != nil {
+			log.Printf("Failed to open metadata cache %s, caching disabled: %v", path, err)
+		} else {
+			downloadMgr.SetMetadataCache(cache)
+		}
+	}
+	downloadMgr.SetMetadataLimits(downloader.MetadataLimits{
+		MaxFiles: cfg.Limits.MaxTorrentFiles,
+		MaxBytes: cfg.Limits.MaxMetadataKB * 1024,
+	})
+	downloadMgr.SetStreamingMode(cfg.Transcode.StreamingMode)
+	downloadMgr.SetStreamingReadahead(int64(cfg.Transcode.StreamingReadaheadMB) << 20)
+
+	transcodeMgr := transcoder.New(cfg.Storage.DownloadPath, cfg.Storage.M3U8Path)
+	transcodeMgr.SetStrategies(transcodeStrategies(cfg.Transcode.Strategies))
+	transcodeMgr.SetRules(transcodeRules(cfg.Transcode.Rules))
+	transcodeMgr.SetExtraMediaRoots(cfg.Storage.ExtraMediaPaths)
+	transcodeMgr.SetMaxKeyframeGap(cfg.Transcode.MaxKeyframeGapSeconds)
+	transcodeMgr.SetTextCharset(cfg.Transcode.SubtitleCharset)
+	transcodeMgr.SetRenditions(transcodeRenditions(cfg.Transcode.Renditions))
+	transcodeMgr.SetMaxTasks(cfg.Limits.MaxTranscodes)
+	transcodeMgr.SetPreemptForInteractive(cfg.Transcode.PreemptForInteractive)
+	transcodeMgr.SetSegmentChecksums(cfg.Transcode.SegmentChecksums)
+	transcodeMgr.SetThumbnails(transcoder.ThumbnailOptions{
+		Enabled:  cfg.Transcode.Thumbnails.Enabled,
+		Interval: time.Duration(cfg.Transcode.Thumbnails.IntervalSeconds) * time.Second,
+		Columns:  cfg.Transcode.Thumbnails.Columns,
+		Rows:     cfg.Transcode.Thumbnails.Rows,
+		Width:    cfg.Transcode.Thumbnails.Width,
+	})
+
+	webrtcMgr := webrtc.New()
+	webrtcMgr.SetTaskLogger(taskLog)
+	webrtcMgr.SetMediaRoot(cfg.Storage.M3U8Path)
+	webrtcMgr.SetTextCharset(cfg.Transcode.SubtitleCharset)
+	webrtcMgr.SetServePathPrefix(cfg.Network.ServePathPrefix)
+	webrtcMgr.SetICEGatherTimeout(time.Duration(cfg.Network.ICEGatherTimeoutSeconds) * time.Second)
+	webrtcMgr.SetEgressLimits(cfg.Network.ServeBandwidth*1000/8, cfg.Network.SessionBandwidth*1000/8)
+	webrtcMgr.SetBufferedHighWater(cfg.Network.DataChannelHighWaterKB * 1024)
+	webrtcMgr.SetSegmentAccessLog(cfg.Network.SegmentAccessLog)
+	webrtcMgr.SetProbeLimits(cfg.Network.MaxProbes, cfg.Network.ProbeBandwidth*1000/8)
+
+	gatewayClient := client.NewWithURLs(cfg.Gateway.Endpoints(), cfg.Node.ID)
+	gatewayClient.SetReconnectDelay(cfg.Gateway.ReconnectDelay)
+	gatewayClient.SetMaxReconnects(cfg.Gateway.MaxReconnects)
+
 	deps := app.Dependencies{
-		Gateway:    client.New(cfg.Gateway.URL, cfg.Node.ID),
-		Downloader: downloader.New(cfg.Storage.DownloadPath, cfg.Node.ID),
-		Transcoder: transcoder.New(cfg.Storage.DownloadPath, cfg.Storage.M3U8Path),
-		WebRTC:     webrtc.New(),
+		Gateway:    gatewayClient,
+		Downloader: downloadMgr,
+		Transcoder: transcodeMgr,
+		WebRTC:     webrtcMgr,
+		TaskLog:    taskLog,
+		// 与数据库放在同一目录
+		QuietStatePath: "data/config/quiet.json",
 	}
 
 	worker, err := app.New(cfg, deps)
@@ -63,7 +168,7 @@ func main() {
 	}
 
 	log.Printf("Worker Node starting: ID=%s, Name=%s", cfg.Node.ID, cfg.Node.Name)
-	log.Printf("Gateway URL: %s", cfg.Gateway.URL)
+	log.Printf("Gateway URLs: %s", strings.Join(cfg.Gateway.Endpoints(), ", "))
 
 	if err := worker.Start(); err != nil {
 		log.Fatalf("Failed to start worker node: %v", err)
@@ -71,8 +176,59 @@ func main() {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	exitCode := 0
+	select {
+	case <-sigChan:
+	case err := <-gatewayClient.Failed():
+		// 放弃重连后退出，由进程管理器决定是否重启
+		log.Printf("Lost the gateway: %v", err)
+		exitCode = 1
+	}
 
 	log.Println("Shutting down worker node...")
 	worker.Stop()
+	os.Exit(exitCode)
+}
+
+// transcodeStrategies 将配置中的转码链转换为转码器的策略
+func transcodeStrategies(configured []config.TranscodeStrategy) []transcoder.Strategy {
+	strategies := make([]transcoder.Strategy, 0, len(configured))
+	for _, s := range configured {
+		strategies = append(strategies, transcoder.Strategy{
+			Name:       s.Name,
+			VideoCodec: s.VideoCodec,
+			AudioCodec: s.AudioCodec,
+			Preset:     s.Preset,
+			CRF:        s.CRF,
+		})
+	}
+	return strategies
+}
+
+// transcodeRenditions 将配置中的码率阶梯转换为转码器的码流
+func transcodeRenditions(configured []config.TranscodeRendition) []transcoder.VariantSpec {
+	renditions := make([]transcoder.VariantSpec, 0, len(configured))
+	for _, r := range configured {
+		renditions = append(renditions, transcoder.VariantSpec{
+			Name:         r.Name,
+			Width:        r.Width,
+			Height:       r.Height,
+			VideoBitrate: r.VideoBitrate,
+			AudioBitrate: r.AudioBitrate,
+		})
+	}
+	return renditions
+}
+
+// transcodeRules 将配置中的预设规则转换为转码器的规则
+func transcodeRules(configured []config.TranscodeRule) []transcoder.Rule {
+	rules := make([]transcoder.Rule, 0, len(configured))
+	for _, r := range configured {
+		rules = append(rules, transcoder.Rule{
+			Extensions: r.Extensions,
+			Codecs:     r.Codecs,
+			Preset:     r.Preset,
+		})
+	}
+	return rules
 }
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// 任务元数据的大小限制。元数据每次读取任务都会反序列化，任务详情也会原样发给网关，
+// 各功能不断写入的错误信息、ffmpeg输出等不能让它无限增长
+const (
+	// MaxMetadataBytes 元数据序列化后的总上限
+	MaxMetadataBytes = 16 << 10
+	// maxMetadataText 单个字符串值的上限，超出部分替换为截断标记
+	maxMetadataText = 2 << 10
+	// maxMetadataExtra 未登记字段序列化后合计的上限
+	maxMetadataExtra = 4 << 10
+)
+
+// MetadataDroppedKey 因超出上限而被删除的字段名列表
+const MetadataDroppedKey = "metadata_dropped"
+
+// metadataField 已登记的元数据字段。keepTail的字段（ffmpeg输出）截断时保留末尾，
+// 其余保留开头；essential的字段决定任务状态与播放，超出总上限时也不删除
+type metadataField struct {
+	keepTail  bool
+	essential bool
+}
+
+// metadataFields 已登记的元数据字段，其余字段为附加字段，合计不超过maxMetadataExtra
+var metadataFields = map[string]metadataField{
+	"error":                  {essential: true},
+	"error_detail":           {},
+	"ffmpeg_tail":            {keepTail: true},
+	"failed_stage":           {essential: true},
+	"retryable":              {essential: true},
+	"sub_status":             {essential: true},
+	"media_type":             {essential: true},
+	"output_path":            {essential: true},
+	"input_path":             {essential: true},
+	"segment_count":          {essential: true},
+	"summary":                {essential: true},
+	"interactive":            {essential: true},
+	"private":                {essential: true},
+	"allow_private":          {essential: true},
+	"stream_token":           {essential: true},
+	"selected_files":         {essential: true},
+	"hls_quality":            {essential: true},
+	"burn_subtitles":         {essential: true},
+	"subtitle_language":      {essential: true},
+	"require_complete":       {essential: true},
+	"sequential":             {essential: true},
+	"ready_held":             {essential: true},
+	"stream_input":           {essential: true},
+	"data_pruned":            {essential: true},
+	"needs_retranscode":      {essential: true},
+	"progress_indeterminate": {essential: true},
+	"available_bytes":        {essential: true},
+	"required_bytes":         {essential: true},
+	"pruned_bytes":           {},
+	"transcode_attempts":     {},
+	"tracks":                 {},
+	MetadataDroppedKey:       {essential: true},
+}
+
+// boundMetadata 把元数据限制在上限内：过长的字符串截断并加标记，附加字段超出maxMetadataExtra时
+// 从最大的开始删除，总大小仍超出MaxMetadataBytes时再删除最大的非必要字段。
+// 被删除的字段名记录在metadata_dropped中。返回序列化结果
+func boundMetadata(metadata map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	// 转为通用的JSON值后逐个检查，结构体字段中的长字符串（如转码尝试的错误）同样截断
+	var bounded map[string]interface{}
+	if err := json.Unmarshal(data, &bounded); err != nil || bounded == nil {
+		return data, err
+	}
+
+	for key, value := range bounded {
+		bounded[key] = truncateStrings(value, metadataFields[key].keepTail)
+	}
+
+	dropped, _ := bounded[MetadataDroppedKey].([]interface{})
+	drop := func(key string) {
+		delete(bounded, key)
+		dropped = append(dropped, key)
+	}
+
+	sizes := make(map[string]int, len(bounded))
+	extra := 0
+	for key, value := range bounded {
+		encoded, _ := json.Marshal(value)
+		sizes[key] = len(key) + len(encoded)
+		if _, known := metadataFields[key]; !known {
+			extra += sizes[key]
+		}
+	}
+	for _, key := range largestFirst(sizes, func(key string) bool {
+		_, known := metadataFields[key]
+		return !known
+	}) {
+		if extra <= maxMetadataExtra {
+			break
+		}
+		extra -= sizes[key]
+		drop(key)
+	}
+
+	total := 0
+	for key := range bounded {
+		total += sizes[key]
+	}
+	for _, key := range largestFirst(sizes, func(key string) bool {
+		_, present := bounded[key]
+		return present && !metadataFields[key].essential
+	}) {
+		if total <= MaxMetadataBytes {
+			break
+		}
+		total -= sizes[key]
+		drop(key)
+	}
+
+	if len(dropped) > 0 {
+		bounded[MetadataDroppedKey] = dropped
+	}
+	return json.Marshal(bounded)
+}
+
+// truncateStrings 截断value中（含嵌套的数组与对象）超过maxMetadataText的字符串
+func truncateStrings(value interface{}, keepTail bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		return truncateText(v, keepTail)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = truncateStrings(item, keepTail)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = truncateStrings(item, keepTail)
+		}
+	}
+	return value
+}
+
+// truncateText 把过长的文本截到maxMetadataText以内，并注明截掉的字节数
+func truncateText(text string, keepTail bool) string {
+	if len(text) <= maxMetadataText {
+		return text
+	}
+	marker := fmt.Sprintf("...[truncated %d bytes]...", len(text)-maxMetadataText)
+	if keepTail {
+		return marker + validUTF8Suffix(text[len(text)-maxMetadataText:])
+	}
+	return validUTF8Prefix(text[:maxMetadataText]) + marker
+}
+
+// validUTF8Prefix 去掉截断后末尾不完整的UTF-8字符
+func validUTF8Prefix(s string) string {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return s[:i]
+			}
+			break
+		}
+	}
+	return s
+}
+
+// validUTF8Suffix 去掉截断后开头不完整的UTF-8字符
+func validUTF8Suffix(s string) string {
+	for i := 0; i < len(s) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(s[i]) {
+			return s[i:]
+		}
+	}
+	return s
+}
+
+// largestFirst 按大小从大到小列出满足include的字段，大小相同时按名称排列
+func largestFirst(sizes map[string]int, include func(string) bool) []string {
+	var keys []string
+	for key := range sizes {
+		if include(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if sizes[keys[i]] != sizes[keys[j]] {
+			return sizes[keys[i]] > sizes[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"encoding/json"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"worker/domain"
@@ -17,27 +19,54 @@ type TorrentFileInfo struct {
 	IsSelected bool   `json:"is_selected"`
 }
 
+// SubtitleInfo 表示任务的一个字幕文件
+type SubtitleInfo struct {
+	Path     string `json:"path"`
+	Language string `json:"language"` // 语言标记，如jpn、zh-CN；提取时语言未知为und，无法识别时为空
+	Index    string `json:"index"`    // 从视频中提取的字幕为其流序号，种子自带的字幕为空
+	Format   string `json:"format"`   // 文件格式，如srt、vtt
+}
+
 // Task 表示一个磁力链接下载任务
 type Task struct {
-	ID             uint              `json:"id" gorm:"primaryKey"`
-	TaskID         string            `json:"task_id" gorm:"uniqueIndex;not null"` // UUID for task identification
-	MagnetURL      string            `json:"magnet_url" gorm:"not null"`
-	Status         domain.TaskStatus `json:"status" gorm:"default:pending"`  // pending, downloading, completed, error, transcoding, ready
-	Progress       int               `json:"progress" gorm:"default:0"`      // 0-100
-	Speed          int64             `json:"speed" gorm:"default:0"`         // bytes per second
-	Size           int64             `json:"size" gorm:"default:0"`          // total size in bytes
-	Downloaded     int64             `json:"downloaded" gorm:"default:0"`    // downloaded bytes
-	TorrentFiles   string            `json:"torrent_files" gorm:"type:text"` // JSON序列化的文件信息
-	TorrentName    string            `json:"torrent_name"`                   // 种子名称
-	M3U8FilePath   string            `json:"m3u8_file_path"`                 // M3U8文件路径
-	Srts           string            `json:"srts" gorm:"type:text"`          // JSON序列化的字幕文件列表
-	Segments       string            `json:"segments" gorm:"type:text"`      // JSON序列化的视频分片信息
-	WorkerID       string            `json:"worker_id"`                      // 执行任务的worker节点ID
-	Metadata       string            `json:"metadata" gorm:"type:text"`      // JSON序列化的额外元数据
-	LastUpdateTime time.Time         `json:"last_update_time"`
-	CreatedAt      time.Time         `json:"created_at"`
-	UpdatedAt      time.Time         `json:"updated_at"`
-	DeletedAt      gorm.DeletedAt    `json:"deleted_at" gorm:"index"`
+	ID              uint              `json:"id" gorm:"primaryKey"`
+	TaskID          string            `json:"task_id" gorm:"uniqueIndex;not null"` // UUID for task identification
+	MagnetURL       string            `json:"magnet_url" gorm:"not null"`
+	Status          domain.TaskStatus `json:"status" gorm:"default:pending"`     // pending, downloading, completed, error, transcoding, ready
+	Progress        int               `json:"progress" gorm:"default:0"`         // 0-100
+	Speed           int64             `json:"speed" gorm:"default:0"`            // bytes per second
+	Peers           int               `json:"peers" gorm:"-"`                    // 正在传输数据的peer数，只反映下载协程的实时状态，不入库
+	ETASeconds      int64             `json:"eta_seconds" gorm:"-"`              // 按当前速度估计的剩余秒数，速度为0时为-1，不入库
+	Size            int64             `json:"size" gorm:"default:0"`             // total size in bytes
+	Downloaded      int64             `json:"downloaded" gorm:"default:0"`       // downloaded bytes
+	BytesDownloaded int64             `json:"bytes_downloaded" gorm:"default:0"` // 从BT网络实际接收的有效数据量（累计）
+	BytesServed     int64             `json:"bytes_served" gorm:"default:0"`     // 通过WebRTC发送给客户端的数据量（累计）
+	Pinned          bool              `json:"pinned" gorm:"default:false"`       // 置顶的任务不会被自动清理
+	FailedAt        *time.Time        `json:"failed_at,omitempty" gorm:"index"`  // 进入error、permanently_failed或cancelled的时间，离开时清空；失败任务按它过保留期
+	RetryCount      int               `json:"retry_count" gorm:"default:0"`      // 失败后自动重试的次数，手动重试时清零
+	ErrorCode       domain.ErrorCode  `json:"error_code,omitempty"`              // 失败的分类，见domain.ErrorCode；重试时清空
+	Priority        int               `json:"priority" gorm:"default:5;index"`   // 下载优先级1-10，下载名额用完时优先级高的排队任务先开始
+	TorrentFiles    string            `json:"torrent_files" gorm:"type:text"`    // JSON序列化的文件信息
+	TorrentName     string            `json:"torrent_name"`                      // 种子名称
+	InfoHash        string            `json:"info_hash" gorm:"index"`            // 种子info hash（十六进制）
+	TraceID         string            `json:"trace_id" gorm:"index"`             // 网关提交时生成的追踪ID，贯穿下载、转码与状态上报
+	M3U8FilePath    string            `json:"m3u8_file_path"`                    // M3U8文件路径
+	M3U8Outputs     string            `json:"m3u8_outputs" gorm:"type:text"`     // 多视频任务JSON序列化的源文件路径（种子内）到M3U8文件路径的映射
+	Srts            string            `json:"srts" gorm:"type:text"`             // JSON序列化的字幕文件及语言列表
+	Segments        string            `json:"segments" gorm:"type:text"`         // JSON序列化的视频分片信息
+	WorkerID        string            `json:"worker_id"`                         // 执行任务的worker节点ID
+	Metadata        string            `json:"metadata" gorm:"type:text"`         // JSON序列化的额外元数据
+	LastUpdateTime  time.Time         `json:"last_update_time"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt    `json:"deleted_at" gorm:"index"`
+}
+
+// TaskMagnetHash 磁力链接到任务的索引，用于发现同一磁力链接的重复提交。
+// 同一磁力链接再次创建任务时指向最新的任务
+type TaskMagnetHash struct {
+	MagnetHash string `json:"magnet_hash" gorm:"primaryKey"` // 磁力链接原文sha1的十六进制
+	TaskID     string `json:"task_id" gorm:"index;not null"`
 }
 
 // GetTorrentFiles 获取反序列化的文件信息
@@ -61,19 +90,29 @@ func (t *Task) SetTorrentFiles(files []TorrentFileInfo) error {
 	return nil
 }
 
-// GetSrts 获取反序列化的字幕文件列表
-func (t *Task) GetSrts() ([]string, error) {
+// GetSrts 获取反序列化的字幕文件列表。旧版本只保存了文件路径，读出时只有Path和Format
+func (t *Task) GetSrts() ([]SubtitleInfo, error) {
 	if t.Srts == "" {
-		return []string{}, nil
+		return []SubtitleInfo{}, nil
 	}
 
-	var srts []string
-	err := json.Unmarshal([]byte(t.Srts), &srts)
-	return srts, err
+	var srts []SubtitleInfo
+	if err := json.Unmarshal([]byte(t.Srts), &srts); err == nil {
+		return srts, nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(t.Srts), &paths); err != nil {
+		return nil, err
+	}
+	srts = make([]SubtitleInfo, len(paths))
+	for i, path := range paths {
+		srts[i] = SubtitleInfo{Path: path, Format: strings.TrimPrefix(filepath.Ext(path), ".")}
+	}
+	return srts, nil
 }
 
 // SetSrts 设置序列化的字幕文件列表
-func (t *Task) SetSrts(srts []string) error {
+func (t *Task) SetSrts(srts []SubtitleInfo) error {
 	data, err := json.Marshal(srts)
 	if err != nil {
 		return err
@@ -82,6 +121,27 @@ func (t *Task) SetSrts(srts []string) error {
 	return nil
 }
 
+// GetM3U8Outputs 获取反序列化的各视频文件的M3U8文件路径
+func (t *Task) GetM3U8Outputs() (map[string]string, error) {
+	if t.M3U8Outputs == "" {
+		return map[string]string{}, nil
+	}
+
+	var outputs map[string]string
+	err := json.Unmarshal([]byte(t.M3U8Outputs), &outputs)
+	return outputs, err
+}
+
+// SetM3U8Outputs 设置序列化的各视频文件的M3U8文件路径
+func (t *Task) SetM3U8Outputs(outputs map[string]string) error {
+	data, err := json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	t.M3U8Outputs = string(data)
+	return nil
+}
+
 // GetMetadata 获取反序列化的元数据
 func (t *Task) GetMetadata() (map[string]interface{}, error) {
 	if t.Metadata == "" {
@@ -93,9 +153,19 @@ func (t *Task) GetMetadata() (map[string]interface{}, error) {
 	return metadata, err
 }
 
-// SetMetadata 设置序列化的元数据
+// Sequential 任务是否按顺序流式下载与转码：提交时给出的sequential优先，否则使用节点的配置fallback
+func (t *Task) Sequential(fallback bool) bool {
+	metadata, _ := t.GetMetadata()
+	if sequential, ok := metadata["sequential"].(bool); ok {
+		return sequential
+	}
+	return fallback
+}
+
+// SetMetadata 设置序列化的元数据，超出大小限制的部分被截断或删除（见boundMetadata）。
+// 之前版本写入的超大元数据在下一次写入时一并截断
 func (t *Task) SetMetadata(metadata map[string]interface{}) error {
-	data, err := json.Marshal(metadata)
+	data, err := boundMetadata(metadata)
 	if err != nil {
 		return err
 	}
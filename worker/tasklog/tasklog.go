@@ -0,0 +1,304 @@
+package tasklog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志来源
+const (
+	SourceDownload  = "download"
+	SourceTracker   = "tracker"
+	SourceTranscode = "transcode"
+	SourceWebRTC    = "webrtc"
+	SourceTask      = "task"
+)
+
+// 日志级别
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+const truncatedMarker = "... earlier entries truncated ...\n"
+
+var validTaskID = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Entry 单条结构化任务日志
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Source  string    `json:"source"`
+	TraceID string    `json:"trace_id,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Logger 将任务相关的日志写入 <dir>/<task_id>.log，单文件与目录总大小都有上限
+type Logger struct {
+	dir           string
+	maxFileBytes  int64
+	maxTotalBytes int64
+	mutex         sync.Mutex
+	now           func() time.Time
+	traceLookup   func(taskID string) string
+}
+
+// New 创建任务日志记录器，maxFileBytes/maxTotalBytes 为0时表示不限制
+func New(dir string, maxFileBytes, maxTotalBytes int64) *Logger {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to create task log directory: %v", err)
+	}
+
+	return &Logger{
+		dir:           dir,
+		maxFileBytes:  maxFileBytes,
+		maxTotalBytes: maxTotalBytes,
+		now:           time.Now,
+	}
+}
+
+// SetTraceLookup 设置查找任务追踪ID的函数，之后每条日志都带上所属任务的trace_id
+func (l *Logger) SetTraceLookup(lookup func(taskID string) string) {
+	if l == nil {
+		return
+	}
+	l.traceLookup = lookup
+}
+
+// Path 返回任务日志文件路径
+func (l *Logger) Path(taskID string) (string, error) {
+	if !validTaskID.MatchString(taskID) || strings.Trim(taskID, ".") == "" {
+		return "", fmt.Errorf("invalid task id: %q", taskID)
+	}
+	return filepath.Join(l.dir, taskID+".log"), nil
+}
+
+// Log 追加一条任务日志；Logger为nil时忽略
+func (l *Logger) Log(taskID, source, level, format string, args ...interface{}) {
+	if l == nil || taskID == "" {
+		return
+	}
+
+	entry := Entry{
+		Time:    l.now().UTC(),
+		Level:   level,
+		Source:  source,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if l.traceLookup != nil {
+		entry.TraceID = l.traceLookup(taskID)
+	}
+
+	if err := l.append(taskID, entry); err != nil {
+		log.Printf("Failed to write task log for %s: %v", taskID, err)
+	}
+}
+
+// Info 记录info级别日志
+func (l *Logger) Info(taskID, source, format string, args ...interface{}) {
+	l.Log(taskID, source, LevelInfo, format, args...)
+}
+
+// Warn 记录warn级别日志
+func (l *Logger) Warn(taskID, source, format string, args ...interface{}) {
+	l.Log(taskID, source, LevelWarn, format, args...)
+}
+
+// Error 记录error级别日志
+func (l *Logger) Error(taskID, source, format string, args ...interface{}) {
+	l.Log(taskID, source, LevelError, format, args...)
+}
+
+// Tail 读取任务日志末尾的maxBytes字节（按行对齐）
+func (l *Logger) Tail(taskID string, maxBytes int64) ([]byte, error) {
+	if l == nil {
+		return nil, os.ErrNotExist
+	}
+
+	path, err := l.Path(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return readTail(path, maxBytes)
+}
+
+// Remove 删除任务日志文件
+func (l *Logger) Remove(taskID string) error {
+	if l == nil {
+		return nil
+	}
+
+	path, err := l.Path(taskID)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *Logger) append(taskID string, entry Entry) error {
+	path, err := l.Path(taskID)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxFileBytes > 0 {
+		if info, statErr := os.Stat(path); statErr == nil && info.Size()+int64(len(line)) > l.maxFileBytes {
+			if err := l.shrink(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	l.enforceTotal(path)
+	return nil
+}
+
+// shrink 保留日志文件后半部分，为新日志腾出空间
+func (l *Logger) shrink(path string) error {
+	kept, err := readTail(path, l.maxFileBytes/2)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	content := append([]byte(truncatedMarker), kept...)
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// enforceTotal 目录总大小超限时按修改时间删除最旧的日志文件
+func (l *Logger) enforceTotal(current string) {
+	if l.maxTotalBytes <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return
+	}
+
+	type logFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []logFile
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".log" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{
+			path:    filepath.Join(l.dir, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		total += info.Size()
+	}
+
+	if total <= l.maxTotalBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, file := range files {
+		if total <= l.maxTotalBytes {
+			break
+		}
+		if file.path == current {
+			continue
+		}
+		if err := os.Remove(file.path); err == nil {
+			total -= file.size
+			log.Printf("Rotated task log %s to cap log directory size", filepath.Base(file.path))
+		}
+	}
+}
+
+func readTail(path string, maxBytes int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(0)
+	if maxBytes > 0 && info.Size() > maxBytes {
+		offset = info.Size() - maxBytes
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// 截断时丢弃首个不完整的行
+	if offset > 0 {
+		if idx := strings.IndexByte(string(data), '\n'); idx >= 0 {
+			data = data[idx+1:]
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,92 @@
+package tasklog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerAppendAndTail(t *testing.T) {
+	logger := New(t.TempDir(), 0, 0)
+	logger.Error("task_1", SourceDownload, "failed to add magnet: %s", "boom")
+	logger.Info("task_1", SourceTask, "status changed")
+
+	data, err := logger.Tail("task_1", 0)
+	if err != nil {
+		t.Fatalf("tail: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %s", len(lines), data)
+	}
+	if !strings.Contains(lines[0], `"source":"download"`) || !strings.Contains(lines[0], "boom") {
+		t.Fatalf("unexpected first entry: %s", lines[0])
+	}
+}
+
+func TestLoggerCapsFileSize(t *testing.T) {
+	logger := New(t.TempDir(), 1024, 0)
+	for i := 0; i < 100; i++ {
+		logger.Info("task_1", SourceTask, "entry %03d %s", i, strings.Repeat("x", 40))
+	}
+
+	path, _ := logger.Path("task_1")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Size() > 1024 {
+		t.Fatalf("log file exceeds cap: %d bytes", info.Size())
+	}
+
+	data, _ := logger.Tail("task_1", 0)
+	if !strings.HasPrefix(string(data), truncatedMarker) {
+		t.Fatalf("expected truncation marker at head of log")
+	}
+	if !strings.Contains(string(data), "entry 099") {
+		t.Fatalf("latest entry missing after truncation")
+	}
+}
+
+func TestLoggerCapsDirectorySize(t *testing.T) {
+	dir := t.TempDir()
+	logger := New(dir, 0, 600)
+
+	base := time.Now().Add(-time.Hour)
+	for i, id := range []string{"task_a", "task_b", "task_c"} {
+		logger.Info(id, SourceTask, "%s", strings.Repeat("y", 200))
+		path, _ := logger.Path(id)
+		stamp := base.Add(time.Duration(i) * time.Minute)
+		_ = os.Chtimes(path, stamp, stamp)
+	}
+	logger.Info("task_d", SourceTask, "%s", strings.Repeat("z", 200))
+
+	if _, err := os.Stat(filepath.Join(dir, "task_a.log")); !os.IsNotExist(err) {
+		t.Fatalf("expected oldest log to be rotated away")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "task_d.log")); err != nil {
+		t.Fatalf("current log must be kept: %v", err)
+	}
+}
+
+func TestLoggerRemoveAndValidation(t *testing.T) {
+	logger := New(t.TempDir(), 0, 0)
+	logger.Info("task_1", SourceTask, "hello")
+
+	if err := logger.Remove("task_1"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := logger.Tail("task_1", 0); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist after remove, got %v", err)
+	}
+
+	if _, err := logger.Path("../etc/passwd"); err == nil {
+		t.Fatalf("expected traversal task id to be rejected")
+	}
+
+	var nilLogger *Logger
+	nilLogger.Info("task_1", SourceTask, "ignored")
+}
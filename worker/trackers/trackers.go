@@ -0,0 +1,75 @@
+// Package trackers 为公开种子追加的tracker列表
+package trackers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaults 内置的公开tracker，tracker列表文件不存在时使用
+var defaults = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"udp://tracker.openbittorrent.com:6969/announce",
+	"udp://open.stealth.si:80/announce",
+	"udp://exodus.desync.com:6969/announce",
+	"udp://explodie.org:6969/announce",
+	"http://tracker.opentrackr.org:1337/announce",
+	"http://tracker.openbittorrent.com:80/announce",
+	"udp://tracker.torrent.eu.org:451/announce",
+	"udp://tracker.moeking.me:6969/announce",
+	"udp://bt.oiyo.tk:6969/announce",
+	"https://tracker.nanoha.org:443/announce",
+	"https://tracker.lilithraws.org:443/announce",
+}
+
+// Defaults 返回内置公开tracker列表的副本
+func Defaults() []string {
+	return append([]string(nil), defaults...)
+}
+
+// Load 从每行一个地址的文件读取tracker列表，空行和以#开头的注释行忽略，重复的地址只保留一个。
+// path为空或文件不存在时返回内置列表；文件存在但没有地址时返回空列表，即不追加公开tracker
+func Load(path string) ([]string, error) {
+	if path == "" {
+		return Defaults(), nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Defaults(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := []string{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid tracker URL %q", path, lineNo, line)
+		}
+		switch u.Scheme {
+		case "udp", "http", "https", "ws", "wss":
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported tracker scheme %q", path, lineNo, u.Scheme)
+		}
+		if !seen[line] {
+			seen[line] = true
+			list = append(list, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
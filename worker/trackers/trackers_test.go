@@ -0,0 +1,43 @@
+package trackers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	list, err := Load(filepath.Join(dir, "missing.txt"))
+	if err != nil || len(list) != len(defaults) {
+		t.Fatalf("missing file: expected the built-in list, got %d trackers, err %v", len(list), err)
+	}
+
+	path := filepath.Join(dir, "trackers.txt")
+	content := "# my trackers\nudp://tracker.example.org:1337/announce\n\n  https://t.example.net/announce  \nudp://tracker.example.org:1337/announce\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(list) != 2 || list[0] != "udp://tracker.example.org:1337/announce" || list[1] != "https://t.example.net/announce" {
+		t.Fatalf("unexpected trackers: %v", list)
+	}
+
+	if err := os.WriteFile(path, []byte("# none\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := Load(path); err != nil || list == nil || len(list) != 0 {
+		t.Fatalf("empty file: expected an empty list, got %v, err %v", list, err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a tracker\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected an error for an invalid line")
+	}
+}
@@ -0,0 +1,249 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// MediaTypeVideo 含视频的任务（默认）
+	MediaTypeVideo = "video"
+	// MediaTypeAudio 只有音频文件的任务（播客、音乐专辑），前端使用音频播放器
+	MediaTypeAudio = "audio"
+)
+
+// TrackManifestName 音频任务输出目录中列出各曲目名称、时长和播放列表的索引文件
+const TrackManifestName = "tracks.json"
+
+// audioExtensions 可以切片为纯音频HLS的文件扩展名
+var audioExtensions = []string{".mp3", ".flac", ".m4a", ".aac", ".ogg", ".oga", ".opus", ".wav", ".wma", ".ape", ".alac"}
+
+// audioBitrate 无法直接复制音频流时重新编码为AAC的码率
+const audioBitrate = "192k"
+
+// AudioTrack 音频任务中的一个曲目
+type AudioTrack struct {
+	Name            string  `json:"name"`             // 曲目名，取源文件名去掉扩展名
+	Source          string  `json:"source"`           // 源文件名
+	Playlist        string  `json:"playlist"`         // 曲目播放列表相对输出目录的路径，如"track01/index.m3u8"
+	DurationSeconds float64 `json:"duration_seconds"` // 各切片时长之和
+}
+
+// trackManifest 索引文件的内容
+type trackManifest struct {
+	MediaType string       `json:"media_type"`
+	Playlist  string       `json:"playlist"` // 依次播放全部曲目的播放列表
+	Tracks    []AudioTrack `json:"tracks"`
+}
+
+// IsAudioFile 文件扩展名是否为支持的音频格式
+func IsAudioFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, audio := range audioExtensions {
+		if ext == audio {
+			return true
+		}
+	}
+	return false
+}
+
+// audioCodecArgs MPEG-TS可以直接承载AAC和MP3，其它编码（FLAC、Vorbis、Opus等）重新编码为AAC
+func audioCodecArgs(codec string) []string {
+	switch codec {
+	case "aac", "mp3":
+		return []string{"-c:a", "copy"}
+	}
+	return []string{"-c:a", "aac", "-b:a", audioBitrate}
+}
+
+// audioArgs 构建纯音频HLS切片的ffmpeg参数，只保留第一路音频，丢弃封面图等视频流
+func audioArgs(inputPath, outputPath string, config HLSConfig, codec string) []string {
+	args := append(progressArgs(config), "-i", inputPath, "-map", "0:a:0", "-vn", "-sn")
+	args = append(args, audioCodecArgs(codec)...)
+	return append(args,
+		"-start_number", "0",
+		"-hls_time", fmt.Sprintf("%d", config.SegmentDuration),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", config.PlaylistType,
+		"-f", "hls",
+		outputPath,
+	)
+}
+
+// trackDir 第index个曲目（从0开始）的输出子目录名
+func trackDir(index int) string {
+	return fmt.Sprintf("track%02d", index+1)
+}
+
+// albumPlaylist 生成依次播放全部曲目的播放列表，引用各曲目子目录中的切片，曲目之间以DISCONTINUITY分隔
+func albumPlaylist(outputDir string, tracks []AudioTrack) (string, error) {
+	var body strings.Builder
+	target := 1.0
+	for i, track := range tracks {
+		segments, err := ParsePlaylist(filepath.Join(outputDir, track.Playlist))
+		if err != nil {
+			return "", fmt.Errorf("读取曲目播放列表失败: %w", err)
+		}
+		if i > 0 {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		dir := filepath.ToSlash(filepath.Dir(track.Playlist))
+		for _, segment := range segments {
+			target = math.Max(target, segment.Duration)
+			fmt.Fprintf(&body, "#EXTINF:%.6f,\n%s/%s\n", segment.Duration, dir, segment.Name)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	b.WriteString(body.String())
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+// writeTrackManifest 在outputDir写入曲目索引文件
+func writeTrackManifest(outputDir, playlist string, tracks []AudioTrack) error {
+	data, err := json.MarshalIndent(trackManifest{MediaType: MediaTypeAudio, Playlist: playlist, Tracks: tracks}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, TrackManifestName), data, 0644)
+}
+
+// trackDuration 曲目播放列表中各切片时长之和
+func trackDuration(playlist string) float64 {
+	segments, err := ParsePlaylist(playlist)
+	if err != nil {
+		return 0
+	}
+	var total float64
+	for _, segment := range segments {
+		total += segment.Duration
+	}
+	return total
+}
+
+// convertAudioTracks 把inputs中的音频文件按顺序各切片到<outputDir>/trackNN/index.m3u8，
+// 然后写入依次播放全部曲目的index.m3u8和曲目索引tracks.json，返回index.m3u8的路径。
+// 失败时删除已输出的曲目目录。
+func convertAudioTracks(inputs []string, outputDir string, config HLSConfig) (m3u8Path string, tracks []AudioTrack, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := range inputs {
+			os.RemoveAll(filepath.Join(outputDir, trackDir(i)))
+		}
+	}()
+
+	onProgress := config.OnProgress
+	for i, input := range inputs {
+		// 各曲目依次切片，总进度按已完成的曲目数加上当前曲目的进度计算
+		codec := ""
+		config.Duration = 0
+		if info, err := ProbeMedia(input); err != nil {
+			log.Printf("警告: 无法获取音频编码，重新编码为AAC: %v", err)
+		} else {
+			codec = info.AudioCodec
+			config.Duration = time.Duration(info.DurationSeconds * float64(time.Second))
+		}
+		if onProgress != nil {
+			done := i
+			config.OnProgress = func(percent int, processed time.Duration) {
+				if percent >= 0 {
+					percent = (done*100 + percent) / len(inputs)
+				}
+				onProgress(percent, processed)
+			}
+		}
+
+		dir := filepath.Join(outputDir, trackDir(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", nil, fmt.Errorf("创建曲目目录失败: %w", err)
+		}
+		playlist := filepath.Join(dir, "index.m3u8")
+		args := audioArgs(input, playlist, config, codec)
+
+		stderrTail := newTailBuffer(ffmpegTailBytes)
+		cmd := exec.Command("ffmpeg", args...)
+		cmd.Stdout = progressOutput(config)
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderrTail)
+
+		log.Printf("开始切片曲目 %d/%d: %s -> %s", i+1, len(inputs), input, playlist)
+		log.Printf("处理参数: %v", args)
+		if err := runCommand(cmd, config.OnStart); err != nil {
+			return "", nil, &FFmpegError{Err: fmt.Errorf("track %d: %w", i+1, err), Tail: stderrTail.String()}
+		}
+
+		base := filepath.Base(input)
+		tracks = append(tracks, AudioTrack{
+			Name:            strings.TrimSuffix(base, filepath.Ext(base)),
+			Source:          base,
+			Playlist:        trackDir(i) + "/index.m3u8",
+			DurationSeconds: trackDuration(playlist),
+		})
+	}
+
+	album, err := albumPlaylist(outputDir, tracks)
+	if err != nil {
+		return "", nil, err
+	}
+	m3u8Path = filepath.Join(outputDir, "index.m3u8")
+	if err := os.WriteFile(m3u8Path, []byte(album), 0644); err != nil {
+		return "", nil, fmt.Errorf("写入播放列表失败: %w", err)
+	}
+	if err := writeTrackManifest(outputDir, "index.m3u8", tracks); err != nil {
+		return "", nil, fmt.Errorf("写入曲目索引失败: %w", err)
+	}
+	return m3u8Path, tracks, nil
+}
+
+// TranscodeAudio 把音频任务的曲目切片为纯音频HLS，不处理字幕。输出目录的命名与Transcode相同，
+// 以第一个曲目为准
+func (lm *LegacyManager) TranscodeAudio(taskID uint, inputs []string, options Options, onStart func(*os.Process)) (string, string, []AudioTrack, error) {
+	if len(inputs) == 0 {
+		return "", "", nil, fmt.Errorf("没有音频文件")
+	}
+	for _, input := range inputs {
+		if _, err := os.Stat(input); os.IsNotExist(err) {
+			return "", "", nil, fmt.Errorf("输入文件不存在: %s", input)
+		}
+	}
+
+	taskDir, err := lm.taskDir(inputs[0], options.OutputName, options.OutputSubdir)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	lm.mu.Lock()
+	lm.activeJobs[taskID] = true
+	lm.mu.Unlock()
+	defer func() {
+		lm.mu.Lock()
+		delete(lm.activeJobs, taskID)
+		lm.mu.Unlock()
+	}()
+
+	log.Printf("开始处理音频任务 %d: %d 个曲目 -> %s", taskID, len(inputs), taskDir)
+
+	config := DefaultHLSConfig()
+	config.OnStart = onStart
+	config.OnProgress = options.OnProgress
+	m3u8Path, tracks, err := convertAudioTracks(inputs, taskDir, config)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("HLS转码失败: %w", err)
+	}
+
+	log.Printf("处理完成: %s", m3u8Path)
+	return m3u8Path, taskDir, tracks, nil
+}
@@ -0,0 +1,129 @@
+package transcoder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Options 单个转码任务的选项
+type Options struct {
+	BurnSubtitles    bool   `json:"burn_subtitles,omitempty"`    // 将字幕硬编码进画面，需要重新编码视频
+	SubtitleLanguage string `json:"subtitle_language,omitempty"` // 要烧录的字幕语言，如"chi"；为空时使用第一条字幕
+	OutputName       string `json:"output_name,omitempty"`       // 输出目录名（通常是任务ID）；为空时按输入文件名命名
+	OutputSubdir     string `json:"output_subdir,omitempty"`     // 输出目录下的子目录名，多视频任务的每个文件各占一个；为空时直接输出到输出目录
+	HLSQuality       string `json:"hls_quality,omitempty"`       // single（默认）或multi，multi时按码率阶梯输出多路码流
+	Interactive      bool   `json:"interactive,omitempty"`       // 有观众在等待，排在普通任务之前，允许时可抢占普通任务
+	TaskID           string `json:"task_id,omitempty"`           // 对应的节点任务ID，排队事件据此写入任务日志
+	// AudioTracks 纯音频任务按播放顺序排列的曲目，非空时输入为第一个曲目，输出纯音频HLS且不处理字幕
+	AudioTracks []string `json:"audio_tracks,omitempty"`
+	// OpenInput 流式转码时打开输入的读取器，下载完成前读到缺失的数据会阻塞等待；为nil时读取磁盘上的完整文件
+	OpenInput func() (io.ReadCloser, error) `json:"-"`
+	// OnProgress 转码进行中定期回调进度，为nil时不解析ffmpeg进度
+	OnProgress ProgressFunc `json:"-"`
+}
+
+// pickSubtitleTrack 按语言选择要烧录的字幕，返回其在字幕流中的序号（即subtitles滤镜的si），
+// 找不到时返回-1。language为空时选择第一条字幕。
+func pickSubtitleTrack(streams []subtitleStream, language string) int {
+	if len(streams) == 0 {
+		return -1
+	}
+	if language == "" {
+		return 0
+	}
+	for i, stream := range streams {
+		if strings.EqualFold(strings.TrimSpace(stream.lang), language) {
+			return i
+		}
+	}
+	return -1
+}
+
+// burnFilter 生成烧录内嵌字幕的视频滤镜
+func burnFilter(inputPath string, track int) string {
+	return fmt.Sprintf("subtitles=filename=%s:si=%d", escapeFilterValue(inputPath), track)
+}
+
+// filterValueEscaper 依次按滤镜参数与滤镜图两层规则转义特殊字符
+var filterValueEscaper = strings.NewReplacer(
+	`\`, `\\\\`,
+	`'`, `\\\'`,
+	`:`, `\\:`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`,`, `\,`,
+	`;`, `\;`,
+)
+
+// escapeFilterValue 转义滤镜参数值。参数通过exec直接传给ffmpeg，无需再做shell转义
+func escapeFilterValue(value string) string {
+	return filterValueEscaper.Replace(value)
+}
+
+// reencodeStrategy 烧录字幕、强制关键帧都必须重新编码视频：复制或自动判断的视频编码改为H.264
+func reencodeStrategy(strategy Strategy) Strategy {
+	if strategy.VideoCodec == "" || strategy.VideoCodec == VideoCodecAuto || strategy.VideoCodec == "copy" {
+		strategy.VideoCodec = "libx264"
+		if strategy.Preset == "" {
+			strategy.Preset = "veryfast"
+		}
+		if strategy.CRF == 0 {
+			strategy.CRF = 23
+		}
+	}
+	return strategy
+}
+
+// hlsArgs 构建HLS切片的ffmpeg参数。subtitleTrack>=0时烧录对应的内嵌字幕。
+func hlsArgs(inputPath, outputPath string, config HLSConfig, codec string, subtitleTrack int) []string {
+	input := inputPath
+	if config.OpenInput != nil {
+		input = streamInput
+	}
+	args := append(progressArgs(config), "-i", input)
+
+	strategy := config.Strategy
+	if subtitleTrack >= 0 {
+		burned := reencodeStrategy(Strategy{Name: "burn"})
+		if strategy != nil {
+			burned = reencodeStrategy(*strategy)
+		}
+		strategy = &burned
+		args = append(args, "-map", "0:v:0", "-map", "0:a:0?", "-vf", burnFilter(inputPath, subtitleTrack))
+	}
+
+	// 关键帧稀疏的片源不能直接复制视频流，重新编码并在每个切片边界强制关键帧
+	if config.ForceKeyframes {
+		forced := reencodeStrategy(Strategy{Name: "keyframes", AudioCodec: "copy"})
+		if strategy != nil {
+			forced = reencodeStrategy(*strategy)
+		}
+		strategy = &forced
+		args = append(args, "-force_key_frames", forceKeyframesExpr(config.SegmentDuration))
+	}
+
+	// 根据切片策略和视频编码决定是否需要转码
+	if strategy != nil {
+		args = append(args, strategy.codecArgs(codec)...)
+	} else if codec == "h264" {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-c:a", "copy")
+	}
+
+	// 如果提取或烧录了字幕，HLS切片时需禁用内置字幕流
+	if config.ExtractSubtitles || subtitleTrack >= 0 {
+		args = append(args, "-sn")
+	}
+
+	// 添加HLS相关的参数
+	return append(args,
+		"-start_number", "0",
+		"-hls_time", fmt.Sprintf("%d", config.SegmentDuration),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", config.PlaylistType,
+		"-f", "hls",
+		outputPath,
+	)
+}
@@ -0,0 +1,113 @@
+package transcoder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// DefaultTextCharset 字幕等文本文件既没有BOM、又不是合法UTF-8时假定的编码。
+// GB18030兼容GBK和GB2312，覆盖最常见的中文字幕
+const DefaultTextCharset = "gb18030"
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// LookupCharset 按WHATWG编码名（如gbk、gb18030、big5、shift_jis）查找编码
+func LookupCharset(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", name)
+	}
+	return enc, nil
+}
+
+// DetectTextEncoding 判断文本的编码：先看BOM，再看是否像不带BOM的UTF-16、是否为合法UTF-8，
+// 都不是时返回fallback（为空时为DefaultTextCharset）。返回小写的编码名，如utf-8、utf-16le、gb18030
+func DetectTextEncoding(data []byte, fallback string) string {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return "utf-8"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	// UTF-16中的ASCII字符带有NUL字节，本身也是合法的UTF-8，要先判断
+	if charset := guessUTF16(data); charset != "" {
+		return charset
+	}
+	if utf8.Valid(data) {
+		return "utf-8"
+	}
+	if fallback == "" {
+		fallback = DefaultTextCharset
+	}
+	return strings.ToLower(fallback)
+}
+
+// guessUTF16 没有BOM时按NUL字节的位置判断UTF-16：字幕中的数字和时间轴是ASCII，
+// 在UTF-16LE中高字节（奇数位置）为0，UTF-16BE中低字节为0
+func guessUTF16(data []byte) string {
+	pairs := len(data) / 2
+	if pairs < 2 {
+		return ""
+	}
+	var even, odd int
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i+1] == 0 {
+			odd++
+		}
+	}
+	switch {
+	case odd*2 > pairs && even*10 < pairs:
+		return "utf-16le"
+	case even*2 > pairs && odd*10 < pairs:
+		return "utf-16be"
+	}
+	return ""
+}
+
+// DecodeText 把文本转换为不带BOM的UTF-8，返回转换后的内容和检测到的原编码
+func DecodeText(data []byte, fallback string) ([]byte, string, error) {
+	charset := DetectTextEncoding(data, fallback)
+	if charset == "utf-8" {
+		return bytes.TrimPrefix(data, utf8BOM), charset, nil
+	}
+	enc, err := LookupCharset(charset)
+	if err != nil {
+		return nil, charset, err
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return nil, charset, fmt.Errorf("decode %s text: %w", charset, err)
+	}
+	return bytes.TrimPrefix(decoded, utf8BOM), charset, nil
+}
+
+// SetTextCharset 设置字幕没有BOM且不是UTF-8时假定的编码，为空时使用DefaultTextCharset
+func (m *Manager) SetTextCharset(charset string) {
+	m.legacyManager.mu.Lock()
+	defer m.legacyManager.mu.Unlock()
+	m.legacyManager.textCharset = charset
+}
+
+// copySubtitleAsUTF8 复制种子自带的文本字幕，转换为不带BOM的UTF-8
+func copySubtitleAsUTF8(src, dst, fallback string) (string, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	text, charset, err := DecodeText(data, fallback)
+	if err != nil {
+		return charset, err
+	}
+	return charset, os.WriteFile(dst, text, 0644)
+}
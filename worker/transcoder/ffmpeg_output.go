@@ -0,0 +1,51 @@
+package transcoder
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ffmpegTailBytes 失败时保留的ffmpeg stderr末尾字节数
+const ffmpegTailBytes = 4 * 1024
+
+// FFmpegError 描述ffmpeg执行失败，附带stderr末尾输出
+type FFmpegError struct {
+	Err  error
+	Tail string
+}
+
+func (e *FFmpegError) Error() string {
+	return fmt.Sprintf("FFmpeg处理失败: %s", e.Err)
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer 只保留最近写入的limit字节
+type tailBuffer struct {
+	mu    sync.Mutex
+	limit int
+	data  []byte
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = append(b.data, p...)
+	if overflow := len(b.data) - b.limit; overflow > 0 {
+		b.data = append(b.data[:0], b.data[overflow:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.data)
+}
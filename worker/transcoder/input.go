@@ -0,0 +1,49 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInputNotAllowed 输入文件不在允许的目录之内
+var ErrInputNotAllowed = errors.New("input path is outside the allowed media roots")
+
+// ResolveInput 将输入路径解析为绝对路径（跟随符号链接），并确认其位于roots中某个目录之内
+func ResolveInput(inputPath string, roots []string) (string, error) {
+	abs, err := filepath.Abs(inputPath)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("resolve input %s: %w", inputPath, err)
+	}
+
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		rootAbs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if realRoot, err := filepath.EvalSymlinks(rootAbs); err == nil {
+			rootAbs = realRoot
+		}
+		if withinRoot(rootAbs, resolved) {
+			return resolved, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrInputNotAllowed, inputPath)
+}
+
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
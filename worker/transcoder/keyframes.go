@@ -0,0 +1,107 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// keyframeProbeSeconds 关键帧分析只读取开头这段时长，稀疏关键帧的片源在开头就能看出来
+const keyframeProbeSeconds = 300
+
+// SetMaxKeyframeGap 设置直接复制视频流时允许的最大关键帧间隔（秒），
+// 超过时改为重新编码并强制关键帧；0表示不检查
+func (m *Manager) SetMaxKeyframeGap(seconds float64) {
+	m.legacyManager.mu.Lock()
+	defer m.legacyManager.mu.Unlock()
+	m.legacyManager.maxKeyframeGap = seconds
+}
+
+// probeKeyframes 用ffprobe列出视频流开头的关键帧时间（秒）。-skip_frame nokey只解码关键帧，开销很小
+func probeKeyframes(inputPath string) ([]float64, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-read_intervals", fmt.Sprintf("%%+%d", keyframeProbeSeconds),
+		"-show_entries", "frame=best_effort_timestamp_time",
+		"-of", "csv=p=0",
+		inputPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe关键帧分析失败: %w", err)
+	}
+	return parseKeyframeTimes(output), nil
+}
+
+// parseKeyframeTimes 解析ffprobe输出的关键帧时间，忽略无法解析的行（如N/A）
+func parseKeyframeTimes(output []byte) []float64 {
+	var times []float64
+	for _, line := range strings.Split(string(output), "\n") {
+		value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), ","))
+		if t, err := strconv.ParseFloat(value, 64); err == nil {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// maxKeyframeGap 相邻关键帧之间的最大间隔；只有一个或没有关键帧时返回-1，表示无法判断是否稀疏
+func maxKeyframeGap(times []float64) float64 {
+	if len(times) < 2 {
+		return -1
+	}
+	gap := 0.0
+	for i := 1; i < len(times); i++ {
+		if d := times[i] - times[i-1]; d > gap {
+			gap = d
+		}
+	}
+	return gap
+}
+
+// copiesVideo 判断按该切片方式是否直接复制视频流
+func copiesVideo(strategy *Strategy, codec string) bool {
+	if strategy == nil {
+		return codec == "h264"
+	}
+	switch strategy.VideoCodec {
+	case "copy":
+		return true
+	case "", VideoCodecAuto:
+		return codec == "h264"
+	}
+	return false
+}
+
+// applyKeyframePolicy 直接复制视频流时，切片只能在关键帧处切开，关键帧稀疏的片源会切出长短悬殊的切片、
+// 播放卡顿。关键帧间隔超过config.MaxKeyframeGap时改为重新编码，并按切片时长强制关键帧。
+func applyKeyframePolicy(config *HLSConfig, inputPath, codec string, subtitleTrack int, probe func(string) ([]float64, error)) {
+	if config.MaxKeyframeGap <= 0 || subtitleTrack >= 0 || !copiesVideo(config.Strategy, codec) {
+		return
+	}
+
+	times, err := probe(inputPath)
+	if err != nil {
+		log.Printf("警告: %v，按原方式切片", err)
+		return
+	}
+	// 分析范围内只有一个关键帧，说明间隔至少与分析时长相当
+	gap := maxKeyframeGap(times)
+	if len(times) == 1 {
+		gap = keyframeProbeSeconds
+	}
+	if gap > config.MaxKeyframeGap {
+		log.Printf("关键帧间隔最长 %.1f 秒，超过 %.1f 秒，改为重新编码并强制关键帧", gap, config.MaxKeyframeGap)
+		config.ForceKeyframes = true
+	}
+}
+
+// forceKeyframesExpr 每个切片时长强制一个关键帧
+func forceKeyframesExpr(segmentDuration int) string {
+	return fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentDuration)
+}
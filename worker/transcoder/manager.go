@@ -1,7 +1,9 @@
 package transcoder
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -20,9 +22,16 @@ type Service interface {
 	Start() error
 	Stop()
 	StartTranscode(inputPath string) (string, error)
+	StartTranscodeWithOptions(inputPath string, options Options) (string, error)
 	GetTask(taskID string) (*TranscodeTask, bool)
 	GetAllTasks() []*TranscodeTask
 	GetStatusChannel() <-chan *TranscodeTask
+	Probe(inputPath string) (*MediaInfo, error)
+	BoostTask(taskID string) int
+	RepairStrategy(name string) Strategy
+	SetQueueEventHandler(handler func(task *TranscodeTask, event string))
+	QueueSnapshot() QueueSnapshot
+	SetQuiet(quiet, suspend bool)
 }
 
 // TranscodeTask 转码任务
@@ -32,11 +41,22 @@ type TranscodeTask struct {
 	OutputPath string                 `json:"output_path"`
 	Status     domain.TranscodeStatus `json:"status"`
 	Progress   int                    `json:"progress"`
-	M3U8Path   string                 `json:"m3u8_path"`
-	Subtitles  []string               `json:"subtitles"`
-	CreatedAt  time.Time              `json:"created_at"`
-	UpdatedAt  time.Time              `json:"updated_at"`
-	Metadata   map[string]string      `json:"metadata"`
+	// ProgressIndeterminate 片源时长未知，Progress不反映实际进度；ProcessedSeconds为已输出的媒体时长
+	ProgressIndeterminate bool    `json:"progress_indeterminate,omitempty"`
+	ProcessedSeconds      float64 `json:"processed_seconds,omitempty"`
+	// QueuePosition 在等待队列中的位置，从1开始；已开始或已结束时为0
+	QueuePosition int               `json:"queue_position,omitempty"`
+	M3U8Path      string            `json:"m3u8_path"`
+	Subtitles     []SubtitleInfo    `json:"subtitles"`
+	Thumbnails    string            `json:"thumbnails,omitempty"` // 缩略图WebVTT索引，未生成时为空
+	Renditions    []RenditionInfo   `json:"renditions,omitempty"` // 多码率输出的各路码流，M3U8Path为主播放列表
+	MediaType     string            `json:"media_type,omitempty"` // 纯音频任务为audio，视频任务为空
+	Tracks        []AudioTrack      `json:"tracks,omitempty"`     // 音频任务的各曲目，M3U8Path依次播放全部曲目
+	Attempts      []Attempt         `json:"attempts"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	Metadata      map[string]string `json:"metadata"`
+	Options       Options           `json:"options"`
 }
 
 // Manager 转码管理器 - 重构后的版本
@@ -47,6 +67,21 @@ type Manager struct {
 	mutex      sync.RWMutex
 	statusChan chan *TranscodeTask
 	maxTasks   int
+	pending    []*TranscodeTask       // 等待名额的任务，交互任务在前
+	running    map[string]*runningJob // 已开始的任务，含被抢占暂停的任务
+	preempt    bool                   // 交互任务排队时暂停一个普通任务
+	boosted    map[string]bool        // 有观众在等待的任务ID，其转码按交互任务排队
+	strategies []Strategy
+	rules      []Rule   // 按扩展名/编码选择预设的规则
+	extraRoots []string // 下载目录之外允许转码的媒体目录
+	thumbnails ThumbnailOptions
+	// 转码完成后记录切片校验和
+	segmentChecksums bool
+	// 排队、插队、抢占和恢复的回调
+	queueHandler func(task *TranscodeTask, event string)
+	// 静默时段内等待的任务不开始，quietSuspend时正在运行的ffmpeg也被SIGSTOP
+	quiet        bool
+	quietSuspend bool
 	// 引用原有的转码器
 	legacyManager *LegacyManager
 }
@@ -57,6 +92,12 @@ type LegacyManager struct {
 	outputDir  string
 	activeJobs map[uint]bool
 	mu         sync.RWMutex
+	// 直接复制视频流时允许的最大关键帧间隔（秒），0表示不检查
+	maxKeyframeGap float64
+	// hls_quality为multi时的码率阶梯
+	renditions []VariantSpec
+	// 字幕没有BOM且不是UTF-8时假定的编码，为空时为DefaultTextCharset
+	textCharset string
 }
 
 // New 创建新的转码管理器
@@ -70,6 +111,7 @@ func New(inputDir, outputDir string) *Manager {
 		inputDir:   inputDir,
 		outputDir:  outputDir,
 		activeJobs: make(map[uint]bool),
+		renditions: DefaultRenditions(),
 	}
 
 	return &Manager{
@@ -78,10 +120,38 @@ func New(inputDir, outputDir string) *Manager {
 		tasks:         make(map[string]*TranscodeTask),
 		statusChan:    make(chan *TranscodeTask, 100),
 		maxTasks:      3,
+		running:       make(map[string]*runningJob),
+		boosted:       make(map[string]bool),
+		strategies:    DefaultStrategies(),
 		legacyManager: legacyMgr,
 	}
 }
 
+// SetExtraMediaRoots 设置下载目录之外允许作为转码输入的目录
+func (m *Manager) SetExtraMediaRoots(roots []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.extraRoots = append([]string(nil), roots...)
+}
+
+// SetStrategies 设置转码链，为空时使用默认转码链
+func (m *Manager) SetStrategies(strategies []Strategy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(strategies) == 0 {
+		strategies = DefaultStrategies()
+	}
+	m.strategies = append([]Strategy(nil), strategies...)
+}
+
+// SetRules 设置按扩展名/编码选择预设的规则，按顺序匹配，第一条命中的规则生效
+func (m *Manager) SetRules(rules []Rule) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rules = append([]Rule(nil), rules...)
+}
+
 // Start 启动转码管理器
 func (m *Manager) Start() error {
 	log.Printf("Transcoder manager started, input: %s, output: %s", m.inputDir, m.outputDir)
@@ -94,21 +164,34 @@ func (m *Manager) Stop() {
 	log.Printf("Transcoder manager stopped")
 }
 
-// StartTranscode 开始转码任务
+// StartTranscode 开始转码任务，输入文件必须位于下载目录或额外媒体目录之内
 func (m *Manager) StartTranscode(inputPath string) (string, error) {
+	return m.StartTranscodeWithOptions(inputPath, Options{})
+}
+
+// StartTranscodeWithOptions 按任务选项开始转码，例如烧录字幕。
+// 名额已满时任务保持pending并排队，options.Interactive的任务排在普通任务之前
+func (m *Manager) StartTranscodeWithOptions(inputPath string, options Options) (string, error) {
+	var events []queueEvent
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	defer func() {
+		m.mutex.Unlock()
+		m.notify(events)
+	}()
 
-	// 检查任务数量限制
-	activeCount := 0
-	for _, task := range m.tasks {
-		if task.Status == domain.TranscodeStatusProcessing || task.Status == domain.TranscodeStatusPending {
-			activeCount++
+	resolved, err := ResolveInput(inputPath, append([]string{m.inputDir}, m.extraRoots...))
+	if err != nil {
+		return "", err
+	}
+	inputPath = resolved
+	if len(options.AudioTracks) > 0 {
+		tracks := make([]string, len(options.AudioTracks))
+		for i, track := range options.AudioTracks {
+			if tracks[i], err = ResolveInput(track, append([]string{m.inputDir}, m.extraRoots...)); err != nil {
+				return "", err
+			}
 		}
-	}
-
-	if activeCount >= m.maxTasks {
-		return "", fmt.Errorf("maximum active transcodes reached (%d)", m.maxTasks)
+		options.AudioTracks = tracks
 	}
 
 	// 创建任务
@@ -120,12 +203,19 @@ func (m *Manager) StartTranscode(inputPath string) (string, error) {
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		Metadata:  make(map[string]string),
+		Options:   options,
 	}
 
 	m.tasks[taskID] = task
 
-	// 开始转码
-	go m.transcodeTask(task)
+	// 排队，有空闲名额时立即开始
+	m.enqueueLocked(task)
+	m.preemptLocked(&events)
+	ready := m.takeRunnableLocked(&events)
+	if task.QueuePosition > 0 {
+		events = append(events, queueEvent{task, fmt.Sprintf("queued at position %d", task.QueuePosition)})
+	}
+	m.launch(ready)
 
 	log.Printf("Started transcode task: %s for file: %s", taskID, inputPath)
 	return taskID, nil
@@ -154,6 +244,7 @@ func (m *Manager) GetAllTasks() []*TranscodeTask {
 
 // transcodeTask 执行转码任务
 func (m *Manager) transcodeTask(task *TranscodeTask) {
+	defer m.releaseSlot(task)
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Transcode task %s panicked: %v", task.ID, r)
@@ -174,11 +265,33 @@ func (m *Manager) transcodeTask(task *TranscodeTask) {
 	// 生成一个临时的uint ID给legacy系统使用
 	legacyID := uint(time.Now().Unix() % 1000000)
 
-	m3u8Path, outputDir, err := m.legacyManager.Transcode(legacyID, task.InputPath)
+	m.mutex.RLock()
+	strategies := m.strategies
+	rules := m.rules
+	options := task.Options
+	m.mutex.RUnlock()
+	options.OnProgress = func(percent int, processed time.Duration) { m.reportProgress(task, percent, processed) }
+
+	onStart := func(process *os.Process) { m.processStarted(task.ID, process) }
+	var m3u8Path, outputDir string
+	var attempts []Attempt
+	var tracks []AudioTrack
+	var err error
+	if len(options.AudioTracks) > 0 {
+		m3u8Path, outputDir, tracks, err = m.legacyManager.TranscodeAudio(legacyID, options.AudioTracks, options, onStart)
+	} else {
+		strategies = selectStrategies(task.InputPath, rules, strategies, getVideoCodec)
+		m3u8Path, outputDir, attempts, err = m.legacyManager.Transcode(legacyID, task.InputPath, strategies, options, onStart)
+	}
+	task.Attempts = attempts
 	if err != nil {
 		log.Printf("Transcode failed for task %s: %v", task.ID, err)
 		task.Status = domain.TranscodeStatusError
 		task.Metadata["error"] = err.Error()
+		var ffmpegErr *FFmpegError
+		if errors.As(err, &ffmpegErr) && ffmpegErr.Tail != "" {
+			task.Metadata["ffmpeg_tail"] = ffmpegErr.Tail
+		}
 		task.UpdatedAt = time.Now()
 		m.statusChan <- task
 		return
@@ -187,7 +300,39 @@ func (m *Manager) transcodeTask(task *TranscodeTask) {
 	// 更新任务信息
 	task.M3U8Path = m3u8Path
 	task.OutputPath = outputDir
+	if options.HLSQuality == HLSQualityMulti {
+		m.legacyManager.mu.RLock()
+		renditions := m.legacyManager.renditions
+		m.legacyManager.mu.RUnlock()
+		task.Renditions = collectRenditions(outputDir, renditions)
+	}
+	if len(options.AudioTracks) > 0 {
+		task.MediaType = MediaTypeAudio
+		task.Tracks = tracks
+	} else {
+		m.addThumbnails(task)
+	}
+	m.mutex.RLock()
+	checksums := m.segmentChecksums
+	m.mutex.RUnlock()
+	if checksums && len(task.Renditions) == 0 {
+		dirs := []string{filepath.Dir(m3u8Path)}
+		if len(tracks) > 0 {
+			dirs = dirs[:0]
+			for _, track := range tracks {
+				dirs = append(dirs, filepath.Join(outputDir, filepath.Dir(track.Playlist)))
+			}
+		}
+		for _, dir := range dirs {
+			if err := writeSegmentChecksums(dir, nil); err != nil {
+				log.Printf("Failed to record segment checksums for task %s: %v", task.ID, err)
+			}
+		}
+	}
+	m.mutex.Lock()
 	task.Progress = 100
+	task.ProgressIndeterminate = false
+	m.mutex.Unlock()
 	task.Status = domain.TranscodeStatusCompleted
 	task.UpdatedAt = time.Now()
 
@@ -204,8 +349,13 @@ func (m *Manager) transcodeTask(task *TranscodeTask) {
 }
 
 // findSubtitleFiles 查找字幕文件
-func (m *Manager) findSubtitleFiles(dir string) ([]string, error) {
-	var subtitles []string
+func (m *Manager) findSubtitleFiles(dir string) ([]SubtitleInfo, error) {
+	return FindSubtitleFiles(dir)
+}
+
+// FindSubtitleFiles 查找目录下的 .srt/.vtt 字幕文件及其语言，缩略图索引不算字幕
+func FindSubtitleFiles(dir string) ([]SubtitleInfo, error) {
+	var subtitles []SubtitleInfo
 
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -214,8 +364,8 @@ func (m *Manager) findSubtitleFiles(dir string) ([]string, error) {
 
 		if !info.IsDir() {
 			ext := filepath.Ext(path)
-			if ext == ".srt" || ext == ".vtt" {
-				subtitles = append(subtitles, path)
+			if (ext == ".srt" || ext == ".vtt") && info.Name() != ThumbnailsVTTName {
+				subtitles = append(subtitles, SubtitleInfoFromPath(path))
 			}
 		}
 		return nil
@@ -224,6 +374,11 @@ func (m *Manager) findSubtitleFiles(dir string) ([]string, error) {
 	return subtitles, err
 }
 
+// Probe 获取媒体文件信息
+func (m *Manager) Probe(inputPath string) (*MediaInfo, error) {
+	return ProbeMedia(inputPath)
+}
+
 // GetStatusChannel 获取状态通道
 func (m *Manager) GetStatusChannel() <-chan *TranscodeTask {
 	return m.statusChan
@@ -231,23 +386,17 @@ func (m *Manager) GetStatusChannel() <-chan *TranscodeTask {
 
 // === Legacy Manager 方法 ===
 
-// Transcode 原有的转码方法
-func (lm *LegacyManager) Transcode(taskID uint, inputPath string) (string, string, error) {
+// Transcode 原有的转码方法，按转码链依次尝试，返回每次尝试的结果。
+// onStart在每个ffmpeg进程启动后调用，可以为nil
+func (lm *LegacyManager) Transcode(taskID uint, inputPath string, strategies []Strategy, options Options, onStart func(*os.Process)) (string, string, []Attempt, error) {
 	// 检查文件是否存在
 	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
-		return "", "", fmt.Errorf("输入文件不存在: %s", inputPath)
-	}
-
-	// 获取转码的这个文件的纯名字
-	filenameOnly := filepath.Base(inputPath)
-	if ext := filepath.Ext(filenameOnly); ext != "" {
-		filenameOnly = filenameOnly[:len(filenameOnly)-len(ext)]
+		return "", "", nil, fmt.Errorf("输入文件不存在: %s", inputPath)
 	}
 
-	// 创建任务特定的输出目录
-	taskDir := filepath.Join(lm.outputDir, filenameOnly)
-	if err := os.MkdirAll(taskDir, 0755); err != nil {
-		return "", "", fmt.Errorf("创建任务输出目录失败: %w", err)
+	taskDir, err := lm.taskDir(inputPath, options.OutputName, options.OutputSubdir)
+	if err != nil {
+		return "", "", nil, err
 	}
 
 	// 标记任务为活跃
@@ -266,18 +415,43 @@ func (lm *LegacyManager) Transcode(taskID uint, inputPath string) (string, strin
 
 	// 使用默认HLS配置
 	config := DefaultHLSConfig()
+	config.BurnSubtitles = options.BurnSubtitles
+	config.SubtitleLanguage = options.SubtitleLanguage
+	config.OnStart = onStart
+	config.OpenInput = options.OpenInput
+	if options.OnProgress != nil {
+		config.OnProgress = options.OnProgress
+		// 时长未知时（如直播录制的片源）进度不确定，只上报已输出的时长
+		if info, err := ProbeMedia(inputPath); err != nil || info.DurationSeconds <= 0 {
+			log.Printf("无法获取片源时长，转码进度不确定: %v", err)
+		} else {
+			config.Duration = time.Duration(info.DurationSeconds * float64(time.Second))
+		}
+	}
+	lm.mu.RLock()
+	config.MaxKeyframeGap = lm.maxKeyframeGap
+	if options.HLSQuality == HLSQualityMulti {
+		config.Variants = lm.renditions
+	}
+	lm.mu.RUnlock()
 
-	// 对MKV文件启用字幕提取
+	// 对MKV文件启用字幕提取；流式转码时文件尚未下载完，不提取
 	ext := strings.ToLower(filepath.Ext(inputPath))
-	if ext == ".mkv" {
+	if ext == ".mkv" && config.OpenInput == nil {
 		config.ExtractSubtitles = true
 		log.Printf("检测到MKV文件，启用字幕提取功能")
 	}
 
-	// 进行HLS切片处理(不做转码)
-	m3u8Path, err := ConvertToHLS(inputPath, taskDir, config)
+	// 进行HLS切片处理，失败时按转码链回退；多码率输出总是重新编码，不走转码链
+	var m3u8Path string
+	var attempts []Attempt
+	if len(config.Variants) > 0 {
+		m3u8Path, attempts, err = convertMultiQuality(inputPath, taskDir, config)
+	} else {
+		m3u8Path, attempts, err = convertWithFallback(inputPath, taskDir, config, strategies)
+	}
 	if err != nil {
-		return "", "", fmt.Errorf("HLS转码失败: %w", err)
+		return "", "", attempts, fmt.Errorf("HLS转码失败: %w", err)
 	}
 
 	// 处理字幕文件
@@ -289,7 +463,35 @@ func (lm *LegacyManager) Transcode(taskID uint, inputPath string) (string, strin
 	}
 
 	log.Printf("处理完成: %s", m3u8Path)
-	return m3u8Path, taskDir, nil
+	return m3u8Path, taskDir, attempts, nil
+}
+
+// taskDir 创建并返回任务的输出目录。目录名优先使用调用方指定的名字（任务ID），否则使用转码的这个文件的纯名字；
+// subdir非空时输出到该目录下的子目录
+func (lm *LegacyManager) taskDir(inputPath, name, subdir string) (string, error) {
+	dirName := name
+	if dirName == "" {
+		dirName = filepath.Base(inputPath)
+		if ext := filepath.Ext(dirName); ext != "" {
+			dirName = dirName[:len(dirName)-len(ext)]
+		}
+	} else if !validDirName(dirName) {
+		return "", fmt.Errorf("无效的输出目录名: %s", dirName)
+	}
+	if subdir != "" && !validDirName(subdir) {
+		return "", fmt.Errorf("无效的输出子目录名: %s", subdir)
+	}
+
+	taskDir := filepath.Join(lm.outputDir, dirName, subdir)
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		return "", fmt.Errorf("创建任务输出目录失败: %w", err)
+	}
+	return taskDir, nil
+}
+
+// validDirName 目录名只能是输出目录下的一级名字
+func validDirName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
 }
 
 // ConvertSubtitle 原有的字幕转换方法（简化版）
@@ -305,6 +507,9 @@ func (lm *LegacyManager) ConvertSubtitle(taskDir string, downloadPath string) ([
 	}
 
 	targetSrts := make([]string, 0)
+	lm.mu.RLock()
+	fallback := lm.textCharset
+	lm.mu.RUnlock()
 
 	// 遍历downloadPath下所有文件
 	err := filepath.Walk(downloadPath, func(path string, info os.FileInfo, err error) error {
@@ -324,8 +529,16 @@ func (lm *LegacyManager) ConvertSubtitle(taskDir string, downloadPath string) ([
 		baseName := info.Name()[:len(info.Name())-len(ext)]
 		targetSrt := filepath.Join(taskDir, baseName+".srt")
 
-		// 复制字幕文件
-		if err := copyFile(path, targetSrt); err != nil {
+		// 复制字幕文件，srt/vtt文本字幕转换为UTF-8，浏览器按UTF-8解码
+		if ext == ".srt" || ext == ".vtt" {
+			charset, err := copySubtitleAsUTF8(path, targetSrt, fallback)
+			if err != nil {
+				log.Printf("转换字幕文件失败: %s -> %s, err: %v", path, targetSrt, err)
+				return nil
+			}
+			log.Printf("已复制字幕文件: %s -> %s（原编码%s）", path, targetSrt, charset)
+			targetSrts = append(targetSrts, targetSrt)
+		} else if err := copyFile(path, targetSrt); err != nil {
 			log.Printf("复制字幕文件失败: %s -> %s, err: %v", path, targetSrt, err)
 		} else {
 			log.Printf("已复制字幕文件: %s -> %s", path, targetSrt)
@@ -358,11 +571,31 @@ func copyFile(src, dst string) error {
 
 // HLSConfig 配置HLS转换参数
 type HLSConfig struct {
-	SegmentDuration  int    // 片段时长（秒）
-	PlaylistType     string // 播放列表类型（event或vod）
-	ExtractSubtitles bool   // 是否提取字幕文件
+	SegmentDuration  int       // 片段时长（秒）
+	PlaylistType     string    // 播放列表类型（event或vod）
+	ExtractSubtitles bool      // 是否提取字幕文件
+	Strategy         *Strategy // 切片方式，为nil时按视频编码自动判断
+	BurnSubtitles    bool      // 是否将字幕烧录进画面（强制重新编码视频）
+	SubtitleLanguage string    // 烧录的字幕语言，为空时使用第一条字幕
+	MaxKeyframeGap   float64   // 直接复制视频流时允许的最大关键帧间隔（秒），0表示不检查
+	ForceKeyframes   bool      // 重新编码并按切片时长强制关键帧
+	// Variants 多码率输出的各路码流，非空时一次ffmpeg调用把每路码流输出到<outputDir>/<name>/，
+	// outputDir下的master.m3u8（及其副本index.m3u8）为引用各路码流的主播放列表；
+	// 为空时只输出一路码流，按转码链尽量直接复制视频流
+	Variants []VariantSpec
+	// OnStart 每个ffmpeg进程启动后调用，用于抢占时暂停和恢复进程，可以为nil
+	OnStart func(*os.Process)
+	// OpenInput 流式转码时打开输入的读取器，ffmpeg从stdin读取；为nil时读取inputPath。
+	// 输入文件可能尚未下载完，探测只能依赖已下载的文件头尾
+	OpenInput func() (io.ReadCloser, error)
+	// OnProgress 每个ffmpeg进度块结束时回调，为nil时不解析进度；Duration为片源时长，0表示未知
+	OnProgress ProgressFunc
+	Duration   time.Duration
 }
 
+// streamInput 流式转码时ffmpeg的输入，从stdin读取
+const streamInput = "pipe:0"
+
 // DefaultHLSConfig 返回默认的HLS配置
 func DefaultHLSConfig() HLSConfig {
 	return HLSConfig{
@@ -402,59 +635,80 @@ func ConvertToHLS(inputPath string, outputDir string, config HLSConfig) (string,
 		}
 	}
 
-	// 检查视频编码
-	codec, err := getVideoCodec(inputPath)
-	if err != nil {
-		log.Printf("警告: 无法检测视频编码: %v。将默认使用-c copy。", err)
-		codec = "h264" // 出现错误时，默认其兼容，避免不必要的转码
+	// 选择要烧录的字幕；没有匹配的字幕时按普通方式切片
+	subtitleTrack := -1
+	if config.BurnSubtitles {
+		streams, err := getSubtitleStreams(inputPath)
+		if err != nil {
+			log.Printf("警告: 无法获取字幕流，跳过字幕烧录: %s", err)
+		} else if subtitleTrack = pickSubtitleTrack(streams, config.SubtitleLanguage); subtitleTrack < 0 {
+			log.Printf("警告: 没有找到语言为 %q 的字幕，跳过字幕烧录", config.SubtitleLanguage)
+		} else {
+			log.Printf("烧录字幕流 %s (%s)", streams[subtitleTrack].index, streams[subtitleTrack].lang)
+		}
 	}
-	log.Printf("检测到视频编码: %s", codec)
 
-	// 构建FFmpeg命令
-	args := []string{
-		"-i", inputPath,
+	// 多码率输出总是重新编码，不需要探测视频编码
+	if len(config.Variants) > 0 {
+		return convertRenditions(inputPath, outputDir, config, subtitleTrack)
 	}
 
-	// 根据视频编码决定是否需要转码
-	if codec == "h264" {
-		log.Println("视频为H.264编码，直接复制流")
-		args = append(args, "-c", "copy")
-	} else {
-		log.Printf("视频为 %s 编码，转码为H.264", codec)
-		args = append(args, "-c:v", "libx264", "-c:a", "copy")
+	// 检查视频编码；策略已指定视频编码器或需要烧录字幕时无需探测
+	codec := ""
+	if subtitleTrack < 0 && (config.Strategy == nil || config.Strategy.VideoCodec == "" || config.Strategy.VideoCodec == VideoCodecAuto) {
+		detected, err := getVideoCodec(inputPath)
+		if err != nil {
+			log.Printf("警告: 无法检测视频编码: %v。将默认使用-c copy。", err)
+			detected = "h264" // 出现错误时，默认其兼容，避免不必要的转码
+		}
+		codec = detected
+		log.Printf("检测到视频编码: %s", codec)
 	}
-
-	// 如果提取了字幕，HLS切片时需禁用内置字幕流
-	if config.ExtractSubtitles {
-		args = append(args, "-sn")
+	if config.Strategy != nil {
+		log.Printf("使用转码策略 %s", config.Strategy.Name)
 	}
+	applyKeyframePolicy(&config, inputPath, codec, subtitleTrack, probeKeyframes)
 
-	// 添加HLS相关的参数
-	args = append(args,
-		"-start_number", "0",
-		"-hls_time", fmt.Sprintf("%d", config.SegmentDuration),
-		"-hls_list_size", "0",
-		"-hls_playlist_type", config.PlaylistType,
-		"-f", "hls",
-		outputPath,
-	)
+	// 构建FFmpeg命令
+	args := hlsArgs(inputPath, outputPath, config, codec, subtitleTrack)
 
-	// 执行FFmpeg命令
+	// 执行FFmpeg命令，同时保留stderr末尾用于排查
+	stderrTail := newTailBuffer(ffmpegTailBytes)
 	cmd := exec.Command("ffmpeg", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = progressOutput(config)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderrTail)
+	if config.OpenInput != nil {
+		input, err := config.OpenInput()
+		if err != nil {
+			return "", fmt.Errorf("打开流式输入失败: %w", err)
+		}
+		defer input.Close()
+		cmd.Stdin = input
+		log.Printf("流式转码，边下载边切片")
+	}
 
 	log.Printf("开始处理: %s -> %s", inputPath, outputPath)
 	log.Printf("处理参数: %v", args)
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("FFmpeg处理失败: %s", err)
+	if err := runCommand(cmd, config.OnStart); err != nil {
+		return "", &FFmpegError{Err: err, Tail: stderrTail.String()}
 	}
 
 	log.Printf("处理完成: %s", outputPath)
 	return outputPath, nil
 }
 
+// runCommand 运行ffmpeg并等待结束，进程启动后调用onStart
+func runCommand(cmd *exec.Cmd, onStart func(*os.Process)) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if onStart != nil {
+		onStart(cmd.Process)
+	}
+	return cmd.Wait()
+}
+
 // getVideoCodec 使用ffprobe获取视频文件的视频编码格式
 func getVideoCodec(inputPath string) (string, error) {
 	cmd := exec.Command("ffprobe",
@@ -495,7 +749,7 @@ func extractSubtitles(inputPath string, outputDir string) error {
 
 	// 为每个字幕流执行提取
 	for _, stream := range subtitleStreams {
-		outputFile := filepath.Join(outputDir, fmt.Sprintf("subtitle_%s.%s", stream.index, stream.format))
+		outputFile := filepath.Join(outputDir, subtitleFileName(stream))
 
 		// 构建提取字幕的ffmpeg命令
 		args := []string{
@@ -521,7 +775,7 @@ func extractSubtitles(inputPath string, outputDir string) error {
 type subtitleStream struct {
 	index  string // 流索引
 	format string // 字幕格式
-	lang   string // 语言（如果有）
+	lang   string // 语言标记，ffprobe没有给出或不像语言标记时为空
 }
 
 // 获取视频中的字幕流信息
@@ -555,12 +809,14 @@ func getSubtitleStreams(inputPath string) ([]subtitleStream, error) {
 		}
 
 		stream := subtitleStream{
-			index:  parts[0],
-			format: parts[1],
+			index:  strings.TrimSpace(parts[0]),
+			format: strings.TrimSpace(parts[1]),
 		}
 
 		if len(parts) > 2 {
-			stream.lang = parts[2]
+			if lang := strings.TrimSpace(parts[2]); isLanguageTag(lang) {
+				stream.lang = lang
+			}
 		}
 
 		streams = append(streams, stream)
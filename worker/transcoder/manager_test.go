@@ -1,6 +1,20 @@
 package transcoder
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"worker/domain"
+)
 
 func TestManagerImplementsService(t *testing.T) {
 	var _ Service = (*Manager)(nil)
@@ -12,3 +26,873 @@ func TestManagerStatusChannelExposure(t *testing.T) {
 		t.Fatalf("GetStatusChannel should expose underlying status channel")
 	}
 }
+
+func TestTailBufferKeepsLastBytes(t *testing.T) {
+	buf := newTailBuffer(8)
+	_, _ = buf.Write([]byte("0123456789"))
+	_, _ = buf.Write([]byte("ab"))
+	if got := buf.String(); got != "456789ab" {
+		t.Fatalf("unexpected tail: %q", got)
+	}
+}
+
+func TestParseProbeOutput(t *testing.T) {
+	output := []byte(`{"streams":[
+		{"codec_type":"video","codec_name":"h264","width":1920,"height":1080},
+		{"codec_type":"audio","codec_name":"aac"},
+		{"codec_type":"subtitle","codec_name":"subrip","tags":{"language":"chi"}},
+		{"codec_type":"subtitle","codec_name":"ass"}
+	],"format":{"duration":"125.400000"}}`)
+
+	info, err := parseProbeOutput(output)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if info.Width != 1920 || info.Height != 1080 || info.VideoCodec != "h264" || info.DurationSeconds != 125.4 {
+		t.Fatalf("unexpected media info: %+v", info)
+	}
+	if len(info.SubtitleLanguages) != 2 || info.SubtitleLanguages[0] != "chi" || info.SubtitleLanguages[1] != "und" {
+		t.Fatalf("unexpected subtitle languages: %v", info.SubtitleLanguages)
+	}
+}
+
+func TestResolveInputEnforcesRoots(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	inside := filepath.Join(root, "shows", "episode.mkv")
+	if err := os.MkdirAll(filepath.Dir(inside), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, path := range []string{inside, filepath.Join(outside, "secret.mkv")} {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	if _, err := ResolveInput(inside, []string{root}); err != nil {
+		t.Fatalf("expected file inside root to be allowed: %v", err)
+	}
+
+	traversal := filepath.Join(root, "shows", "..", "..", filepath.Base(outside), "secret.mkv")
+	if _, err := ResolveInput(traversal, []string{root}); !errors.Is(err, ErrInputNotAllowed) {
+		t.Fatalf("expected traversal to be rejected, got %v", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(root, "escape.mkv")
+		if err := os.Symlink(filepath.Join(outside, "secret.mkv"), link); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		if _, err := ResolveInput(link, []string{root}); !errors.Is(err, ErrInputNotAllowed) {
+			t.Fatalf("expected symlink escape to be rejected, got %v", err)
+		}
+	}
+
+	mgr := New(t.TempDir(), t.TempDir())
+	if _, err := mgr.StartTranscode(inside); !errors.Is(err, ErrInputNotAllowed) {
+		t.Fatalf("expected input outside download dir to be rejected, got %v", err)
+	}
+	mgr.SetExtraMediaRoots([]string{root})
+	if _, err := ResolveInput(inside, append([]string{mgr.inputDir}, mgr.extraRoots...)); err != nil {
+		t.Fatalf("expected extra media root to be allowed: %v", err)
+	}
+}
+
+func TestTaskDirPlacesVideosInSubdirectories(t *testing.T) {
+	output := t.TempDir()
+	lm := New(t.TempDir(), output).legacyManager
+
+	dir, err := lm.taskDir("/downloads/Show/E02.mkv", "task-1", "video02")
+	if err != nil || dir != filepath.Join(output, "task-1", "video02") {
+		t.Fatalf("expected the video02 subdirectory of the task, got %s (%v)", dir, err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected the subdirectory to be created: %v", err)
+	}
+	if dir, err := lm.taskDir("/downloads/Show/E02.mkv", "", ""); err != nil || dir != filepath.Join(output, "E02") {
+		t.Fatalf("expected the legacy directory named after the file, got %s (%v)", dir, err)
+	}
+	for _, subdir := range []string{"..", "a/b", `a\b`} {
+		if _, err := lm.taskDir("/downloads/Show/E02.mkv", "task-1", subdir); err == nil {
+			t.Fatalf("expected subdirectory %q to be rejected", subdir)
+		}
+	}
+}
+
+func TestRulesOverrideProbeBasedChoice(t *testing.T) {
+	chain := DefaultStrategies()
+	probes := 0
+	probe := func(string) (string, error) {
+		probes++
+		return "h264", nil
+	}
+
+	// 没有规则时按默认链，remux会按探测到的编码决定是否复制
+	if got := selectStrategies("/media/movie.mp4", nil, chain, probe); got[0].Name != "remux" {
+		t.Fatalf("expected default chain to start with remux, got %s", got[0].Name)
+	}
+
+	rules := []Rule{
+		{Extensions: []string{"avi"}, Preset: "transcode"},
+		{Extensions: []string{".MP4"}, Preset: "copy"},
+		{Codecs: []string{"hevc"}, Preset: "transcode"},
+	}
+
+	got := selectStrategies("/media/movie.mp4", rules, chain, probe)
+	if got[0].Name != "copy" || len(got) != 1+len(chain) {
+		t.Fatalf("expected copy preset followed by the default chain, got %+v", got)
+	}
+	if args := got[0].codecArgs(""); len(args) != 2 || args[1] != "copy" {
+		t.Fatalf("expected copy preset to copy streams without probing, got %v", args)
+	}
+	if probes != 0 {
+		t.Fatalf("expected extension rules to skip ffprobe, probed %d times", probes)
+	}
+
+	got = selectStrategies("/media/clip.avi", rules, chain, probe)
+	if got[0].Name != "transcode" || len(got) != 1 {
+		t.Fatalf("expected chain to start at transcode, got %+v", got)
+	}
+
+	probe = func(string) (string, error) {
+		probes++
+		return "hevc", nil
+	}
+	got = selectStrategies("/media/show.mkv", rules, chain, probe)
+	if got[0].Name != "transcode" || probes != 1 {
+		t.Fatalf("expected codec rule to select transcode after one probe, got %+v (%d probes)", got, probes)
+	}
+}
+
+func TestRepairStrategyFollowsConfiguredEncoder(t *testing.T) {
+	mgr := New("", t.TempDir())
+	mgr.SetStrategies([]Strategy{
+		{Name: "remux", VideoCodec: VideoCodecAuto, AudioCodec: "copy"},
+		{Name: "nvenc", VideoCodec: "h264_nvenc", AudioCodec: "aac", Preset: "p4"},
+		{Name: "cpu", VideoCodec: "libx264", AudioCodec: "aac", Preset: "slow", CRF: 20},
+	})
+
+	if got := mgr.RepairStrategy("cpu"); got.VideoCodec != "libx264" || got.Preset != "slow" || got.CRF != 20 {
+		t.Fatalf("expected the strategy that produced the output, got %+v", got)
+	}
+	// 没有记录或策略已不在转码链中时使用第一个重新编码视频的策略
+	for _, name := range []string{"", "removed"} {
+		if got := mgr.RepairStrategy(name); got.Name != "nvenc" {
+			t.Fatalf("%q: expected the first re-encoding strategy, got %+v", name, got)
+		}
+	}
+	// 直接复制视频的策略重新编码，音频编码保持不变
+	args := reencodeStrategy(mgr.RepairStrategy("remux")).codecArgs("")
+	if strings.Join(args, " ") != "-c:v libx264 -preset veryfast -crf 23 -c:a copy" {
+		t.Fatalf("unexpected codec args for a remuxed task: %v", args)
+	}
+}
+
+func TestHLSArgsReadStreamingInputFromStdin(t *testing.T) {
+	config := DefaultHLSConfig()
+	config.OpenInput = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("")), nil }
+
+	args := hlsArgs("/downloads/movie.mp4", "/out/index.m3u8", config, "h264", -1)
+	if len(args) < 2 || args[0] != "-i" || args[1] != "pipe:0" {
+		t.Fatalf("expected streaming input from stdin, got %v", args)
+	}
+}
+
+func TestHLSArgsBurnSubtitlesForcesTranscode(t *testing.T) {
+	config := DefaultHLSConfig()
+	remux := DefaultStrategies()[0]
+	config.Strategy = &remux
+
+	args := strings.Join(hlsArgs("/media/movie: part 1.mkv", "/out/index.m3u8", config, "h264", -1), " ")
+	if strings.Contains(args, "-vf") || !strings.Contains(args, "-c copy") {
+		t.Fatalf("expected plain remux without burning, got %s", args)
+	}
+
+	got := hlsArgs("/media/movie: part 1.mkv", "/out/index.m3u8", config, "h264", 1)
+	joined := strings.Join(got, " ")
+	filter := ""
+	for i, arg := range got {
+		if arg == "-vf" && i+1 < len(got) {
+			filter = got[i+1]
+		}
+	}
+	if filter != `subtitles=filename=/media/movie\\: part 1.mkv:si=1` {
+		t.Fatalf("unexpected subtitle filter %q", filter)
+	}
+	if !strings.Contains(joined, "-c:v libx264") || strings.Contains(joined, "-c copy") {
+		t.Fatalf("expected burning to re-encode video, got %s", joined)
+	}
+	if !strings.Contains(joined, "-sn") {
+		t.Fatalf("expected subtitle streams to be dropped from the output, got %s", joined)
+	}
+}
+
+func TestPickSubtitleTrackByLanguage(t *testing.T) {
+	streams := []subtitleStream{{index: "2", lang: "eng"}, {index: "3", lang: "chi"}}
+	for language, want := range map[string]int{"": 0, "CHI": 1, "eng": 0, "jpn": -1} {
+		if got := pickSubtitleTrack(streams, language); got != want {
+			t.Fatalf("pickSubtitleTrack(%q) = %d, want %d", language, got, want)
+		}
+	}
+	if got := pickSubtitleTrack(nil, ""); got != -1 {
+		t.Fatalf("expected no track without subtitle streams, got %d", got)
+	}
+}
+
+func TestGenerateThumbnailsWritesSpriteMappings(t *testing.T) {
+	dir := t.TempDir()
+	options := ThumbnailOptions{Enabled: true, Interval: 10 * time.Second, Columns: 2, Rows: 2, Width: 160}
+	info := &MediaInfo{DurationSeconds: 65, Width: 1920, Height: 1080}
+
+	var gotArgs []string
+	run := func(args []string) error {
+		gotArgs = args
+		// 65秒、每10秒一张共7张，2x2网格需要两张雪碧图
+		for _, name := range []string{"thumbnails_001.jpg", "thumbnails_002.jpg"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte("jpg"), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path, err := generateThumbnails("/media/movie.mkv", dir, options, info, run)
+	if err != nil {
+		t.Fatalf("generate thumbnails: %v", err)
+	}
+	if path != filepath.Join(dir, ThumbnailsVTTName) {
+		t.Fatalf("unexpected index path %s", path)
+	}
+	if joined := strings.Join(gotArgs, " "); !strings.Contains(joined, "-vf fps=1/10,scale=160:90,tile=2x2") ||
+		!strings.HasSuffix(joined, filepath.Join(dir, "thumbnails_%03d.jpg")) {
+		t.Fatalf("unexpected ffmpeg args %s", joined)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	want := `WEBVTT
+
+00:00:00.000 --> 00:00:10.000
+thumbnails_001.jpg#xywh=0,0,160,90
+
+00:00:10.000 --> 00:00:20.000
+thumbnails_001.jpg#xywh=160,0,160,90
+
+00:00:20.000 --> 00:00:30.000
+thumbnails_001.jpg#xywh=0,90,160,90
+
+00:00:30.000 --> 00:00:40.000
+thumbnails_001.jpg#xywh=160,90,160,90
+
+00:00:40.000 --> 00:00:50.000
+thumbnails_002.jpg#xywh=0,0,160,90
+
+00:00:50.000 --> 00:01:00.000
+thumbnails_002.jpg#xywh=160,0,160,90
+
+00:01:00.000 --> 00:01:05.000
+thumbnails_002.jpg#xywh=0,90,160,90
+`
+	if string(data) != want {
+		t.Fatalf("unexpected thumbnail index:\n%s", data)
+	}
+
+	subtitles, err := FindSubtitleFiles(dir)
+	if err != nil {
+		t.Fatalf("find subtitles: %v", err)
+	}
+	if len(subtitles) != 0 {
+		t.Fatalf("expected the thumbnail index not to be listed as a subtitle, got %v", subtitles)
+	}
+
+	// 缺少雪碧图时不生成索引
+	os.Remove(filepath.Join(dir, "thumbnails_002.jpg"))
+	if _, err := generateThumbnails("/media/movie.mkv", dir, options, info, func([]string) error { return nil }); err == nil {
+		t.Fatalf("expected missing sprite sheets to fail")
+	}
+}
+
+func TestSparseKeyframesForceReencodeWithKeyframes(t *testing.T) {
+	remux := DefaultStrategies()[0]
+	newConfig := func() HLSConfig {
+		config := DefaultHLSConfig()
+		config.MaxKeyframeGap = 15
+		config.Strategy = &remux
+		return config
+	}
+
+	dense := newConfig()
+	applyKeyframePolicy(&dense, "/media/dense.mp4", "h264", -1, func(string) ([]float64, error) {
+		return parseKeyframeTimes([]byte("0.000000\n2.002000,\nN/A\n4.004000\n6.006000\n")), nil
+	})
+	if dense.ForceKeyframes {
+		t.Fatalf("expected dense keyframes to keep the remux path")
+	}
+	if args := strings.Join(hlsArgs("/media/dense.mp4", "/out/index.m3u8", dense, "h264", -1), " "); !strings.Contains(args, "-c copy") || strings.Contains(args, "-force_key_frames") {
+		t.Fatalf("expected plain remux, got %s", args)
+	}
+
+	sparse := newConfig()
+	applyKeyframePolicy(&sparse, "/media/sparse.mp4", "h264", -1, func(string) ([]float64, error) {
+		return []float64{0, 40, 45}, nil
+	})
+	if !sparse.ForceKeyframes {
+		t.Fatalf("expected a 40 second keyframe gap to force keyframes")
+	}
+	args := strings.Join(hlsArgs("/media/sparse.mp4", "/out/index.m3u8", sparse, "h264", -1), " ")
+	if !strings.Contains(args, "-force_key_frames expr:gte(t,n_forced*10)") || !strings.Contains(args, "-c:v libx264") || strings.Contains(args, "-c copy") {
+		t.Fatalf("expected re-encode with forced keyframes, got %s", args)
+	}
+
+	// 视频本来就要重新编码时不做关键帧分析
+	transcode := DefaultStrategies()[1]
+	encoded := newConfig()
+	encoded.Strategy = &transcode
+	applyKeyframePolicy(&encoded, "/media/sparse.mp4", "hevc", -1, func(string) ([]float64, error) {
+		t.Fatalf("unexpected keyframe probe for a re-encoded stream")
+		return nil, nil
+	})
+	if encoded.ForceKeyframes {
+		t.Fatalf("expected no keyframe forcing when the video is re-encoded anyway")
+	}
+}
+
+func TestMasterPlaylistListsFittedRenditions(t *testing.T) {
+	ladder := DefaultRenditions()
+	if err := validateRenditions(ladder); err != nil {
+		t.Fatalf("default ladder should be valid: %v", err)
+	}
+	if err := validateRenditions([]VariantSpec{{Name: "../720p", Width: 1280, Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k"}}); err == nil {
+		t.Fatalf("expected a rendition name with a path separator to be rejected")
+	}
+	if err := validateRenditions([]VariantSpec{{Name: "720p", Width: 1280, Height: 720, VideoBitrate: "fast", AudioBitrate: "128k"}}); err == nil {
+		t.Fatalf("expected an unparsable bitrate to be rejected")
+	}
+
+	// 720p片源不放大到1080p；比最低一路还小的片源保留最低一路
+	fitted := fitRenditions(ladder, 720)
+	if len(fitted) != 3 || fitted[0].Name != "720p" {
+		t.Fatalf("expected 720p and below for a 720p source, got %+v", fitted)
+	}
+	if low := fitRenditions(ladder, 240); len(low) != 1 || low[0].Name != "360p" {
+		t.Fatalf("expected only the lowest rendition for a 240p source, got %+v", low)
+	}
+
+	playlist, err := masterPlaylist(fitted[:2])
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2928000,RESOLUTION=1280x720\n720p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1528000,RESOLUTION=854x480\n480p/index.m3u8\n"
+	if playlist != want {
+		t.Fatalf("unexpected master playlist:\n%s", playlist)
+	}
+
+	config := DefaultHLSConfig()
+	args := strings.Join(ladderArgs("/media/movie.mkv", "/out", config, fitted[:2], audioPresent, -1), " ")
+	for _, want := range []string{
+		"-map 0:v:0 -map 0:a:0 -map 0:v:0 -map 0:a:0",
+		"-filter:v:0 scale=-2:720 -b:v:0 2800k -b:a:0 128k", "-filter:v:1 scale=-2:480 -b:v:1 1400k -b:a:1 128k",
+		"-force_key_frames expr:gte(t,n_forced*10)", "-hls_time 10",
+		"-hls_segment_filename /out/%v/index%d.ts", "-var_stream_map v:0,a:0,name:720p v:1,a:1,name:480p",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected %q in ladder args, got %s", want, args)
+		}
+	}
+	if !strings.HasSuffix(args, "/out/%v/index.m3u8") {
+		t.Fatalf("expected the variant playlists as output, got %s", args)
+	}
+
+	// 没有音频的片源只映射视频
+	args = strings.Join(ladderArgs("/media/silent.mp4", "/out", config, fitted[:1], audioAbsent, -1), " ")
+	if strings.Contains(args, "0:a:0") || strings.Contains(args, "-b:a:0") || !strings.Contains(args, "-var_stream_map v:0,name:720p") {
+		t.Fatalf("expected video-only mapping for a silent source, got %s", args)
+	}
+	// 探测失败时音频按可选映射
+	args = strings.Join(ladderArgs("/media/unknown.mp4", "/out", config, fitted[:1], audioUnknown, -1), " ")
+	if !strings.Contains(args, "-map 0:v:0 -map 0:a:0? ") || !strings.Contains(args, "-var_stream_map v:0,a:0,name:720p") {
+		t.Fatalf("expected an optional audio mapping for an unprobed source, got %s", args)
+	}
+	// 宽银幕片源按宽高比缩放，不拉伸到预设的宽度
+	if width := scaledWidth(720, 1920, 800); width != 1728 {
+		t.Fatalf("expected a 2.4:1 source to scale to 1728x720, got width %d", width)
+	}
+}
+
+// TestConvertToHLSMultiQuality 用ffmpeg生成1分钟的测试视频并输出两路码流，没有ffmpeg时跳过
+func TestConvertToHLSMultiQuality(t *testing.T) {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "synthetic.mp4")
+	generate := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "testsrc=duration=60:size=640x360:rate=25",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=60",
+		"-c:v", "libx264", "-preset", "ultrafast", "-c:a", "aac", "-shortest", input)
+	if output, err := generate.CombinedOutput(); err != nil {
+		t.Fatalf("generate synthetic video: %v\n%s", err, output)
+	}
+
+	output := filepath.Join(dir, "out")
+	config := DefaultHLSConfig()
+	config.Variants = []VariantSpec{
+		{Name: "360p", Width: 640, Height: 360, VideoBitrate: "800k", AudioBitrate: "96k"},
+		{Name: "240p", Width: 426, Height: 240, VideoBitrate: "400k", AudioBitrate: "64k"},
+	}
+	master, err := ConvertToHLS(input, output, config)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+
+	if filepath.Base(master) != MasterPlaylistName {
+		t.Fatalf("expected the master playlist to be returned, got %s", master)
+	}
+	data, err := os.ReadFile(master)
+	if err != nil {
+		t.Fatalf("read master playlist: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "#EXTM3U\n") || strings.Count(string(data), "#EXT-X-STREAM-INF:") != 2 {
+		t.Fatalf("unexpected master playlist:\n%s", data)
+	}
+
+	infos := collectRenditions(output, config.Variants)
+	if len(infos) != 2 || infos[0].Bitrate != 896000 {
+		t.Fatalf("unexpected renditions %+v", infos)
+	}
+	for _, info := range infos {
+		playlist, err := os.ReadFile(info.M3U8Path)
+		if err != nil {
+			t.Fatalf("read %s playlist: %v", info.Name, err)
+		}
+		// 60秒按10秒切片，每路码流6个切片
+		if segments := strings.Count(string(playlist), "#EXTINF:"); segments != 6 {
+			t.Fatalf("expected 6 segments in %s, got %d:\n%s", info.Name, segments, playlist)
+		}
+		if !strings.Contains(string(playlist), "#EXT-X-ENDLIST") {
+			t.Fatalf("expected a complete VOD playlist for %s:\n%s", info.Name, playlist)
+		}
+	}
+}
+
+func TestAudioTracksPlaylistAndManifest(t *testing.T) {
+	for name, want := range map[string]bool{"01.FLAC": true, "talk.mp3": true, "book.m4a": true, "cover.jpg": false, "movie.mkv": false} {
+		if IsAudioFile(name) != want {
+			t.Fatalf("IsAudioFile(%q) should be %v", name, want)
+		}
+	}
+
+	// AAC和MP3直接复制进TS切片，FLAC等重新编码为AAC；封面图不进入输出
+	config := DefaultHLSConfig()
+	copied := strings.Join(audioArgs("/music/01.mp3", "/out/track01/index.m3u8", config, "mp3"), " ")
+	encoded := strings.Join(audioArgs("/music/02.flac", "/out/track02/index.m3u8", config, "flac"), " ")
+	for args, want := range map[string]string{copied: "-c:a copy", encoded: "-c:a aac -b:a 192k"} {
+		if !strings.Contains(args, want) || !strings.Contains(args, "-map 0:a:0 -vn -sn") || !strings.Contains(args, "-hls_time 10") {
+			t.Fatalf("expected %q in audio args, got %s", want, args)
+		}
+	}
+
+	dir := t.TempDir()
+	tracks := []AudioTrack{
+		{Name: "01 - First", Playlist: "track01/index.m3u8"},
+		{Name: "02 - Second", Playlist: "track02/index.m3u8"},
+	}
+	playlists := []string{
+		"#EXTM3U\n#EXTINF:10.000000,\nindex0.ts\n#EXTINF:4.500000,\nindex1.ts\n#EXT-X-ENDLIST\n",
+		"#EXTM3U\n#EXTINF:7.250000,\nindex0.ts\n#EXT-X-ENDLIST\n",
+	}
+	for i, track := range tracks {
+		path := filepath.Join(dir, track.Playlist)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(playlists[i]), 0644); err != nil {
+			t.Fatalf("write track playlist: %v", err)
+		}
+		tracks[i].DurationSeconds = trackDuration(path)
+	}
+	if tracks[0].DurationSeconds != 14.5 || tracks[1].DurationSeconds != 7.25 {
+		t.Fatalf("unexpected track durations %+v", tracks)
+	}
+
+	album, err := albumPlaylist(dir, tracks)
+	if err != nil {
+		t.Fatalf("album playlist: %v", err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXTINF:10.000000,\ntrack01/index0.ts\n#EXTINF:4.500000,\ntrack01/index1.ts\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:7.250000,\ntrack02/index0.ts\n#EXT-X-ENDLIST\n"
+	if album != want {
+		t.Fatalf("unexpected album playlist:\n%s", album)
+	}
+
+	if err := writeTrackManifest(dir, "index.m3u8", tracks); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	var manifest trackManifest
+	data, _ := os.ReadFile(filepath.Join(dir, TrackManifestName))
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("parse manifest: %v", err)
+	}
+	if manifest.MediaType != MediaTypeAudio || len(manifest.Tracks) != 2 || manifest.Tracks[1].Name != "02 - Second" || manifest.Tracks[1].DurationSeconds != 7.25 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+}
+
+func TestTranscodeQueuePrioritizesInteractiveTasks(t *testing.T) {
+	mgr := New(t.TempDir(), t.TempDir())
+	mgr.maxTasks = 1
+	var events []string
+	mgr.SetQueueEventHandler(func(task *TranscodeTask, event string) {
+		events = append(events, task.ID+": "+event)
+	})
+
+	queue := func(id string, interactive bool) *TranscodeTask {
+		task := &TranscodeTask{ID: id, Status: domain.TranscodeStatusPending, Metadata: map[string]string{}, Options: Options{TaskID: "task-" + id, Interactive: interactive}}
+		mgr.mutex.Lock()
+		mgr.tasks[id] = task
+		mgr.enqueueLocked(task)
+		mgr.mutex.Unlock()
+		return task
+	}
+	take := func() []*TranscodeTask {
+		var queueEvents []queueEvent
+		mgr.mutex.Lock()
+		ready := mgr.takeRunnableLocked(&queueEvents)
+		mgr.mutex.Unlock()
+		mgr.notify(queueEvents)
+		return ready
+	}
+
+	a := queue("a", false)
+	if ready := take(); len(ready) != 1 || ready[0] != a {
+		t.Fatalf("expected a to take the only slot, got %v", ready)
+	}
+	a.Status = domain.TranscodeStatusProcessing
+	b := queue("b", false)
+	c := queue("c", false)
+	i := queue("i", true)
+	if i.QueuePosition != 1 || b.QueuePosition != 2 || c.QueuePosition != 3 {
+		t.Fatalf("expected the interactive task first, got i=%d b=%d c=%d", i.QueuePosition, b.QueuePosition, c.QueuePosition)
+	}
+
+	// 没有开启抢占时插队只调整顺序
+	if position := mgr.BoostTask("task-c"); position != 2 {
+		t.Fatalf("expected the boost to report queue position 2, got %d", position)
+	}
+	if c.QueuePosition != 2 || b.QueuePosition != 3 || mgr.running["a"].paused {
+		t.Fatalf("expected c behind i and a still running, got c=%d b=%d", c.QueuePosition, b.QueuePosition)
+	}
+	if len(events) != 1 || events[0] != "c: boosted to queue position 2" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	// 在转码加入队列之前到达的boost在排队时生效
+	if position := mgr.BoostTask("task-d"); position != 0 {
+		t.Fatalf("expected no queue position for a task without a queued transcode, got %d", position)
+	}
+	d := queue("d", false)
+	if !d.Options.Interactive || d.QueuePosition != 3 || b.QueuePosition != 4 {
+		t.Fatalf("expected d to queue as interactive behind c, got d=%d b=%d", d.QueuePosition, b.QueuePosition)
+	}
+	mgr.mutex.Lock()
+	mgr.unqueueLocked("d")
+	mgr.forgetBoostLocked("task-d")
+	boosted := mgr.boosted["task-d"]
+	mgr.mutex.Unlock()
+	if boosted {
+		t.Fatal("expected the boost of a task without transcodes to be forgotten")
+	}
+
+	// 开启抢占后暂停普通任务a，交互任务按顺序运行，之后先恢复a再开始b
+	mgr.mutex.Lock()
+	mgr.preempt = true
+	var queueEvents []queueEvent
+	mgr.preemptLocked(&queueEvents)
+	mgr.mutex.Unlock()
+	if !mgr.running["a"].paused {
+		t.Fatalf("expected a to be paused for the interactive task")
+	}
+	for _, want := range []*TranscodeTask{i, c} {
+		ready := take()
+		if len(ready) != 1 || ready[0] != want {
+			t.Fatalf("expected %s to start, got %v", want.ID, ready)
+		}
+		mgr.mutex.Lock()
+		delete(mgr.running, want.ID)
+		mgr.mutex.Unlock()
+	}
+	if ready := take(); len(ready) != 0 || mgr.running["a"].paused || b.QueuePosition != 1 {
+		t.Fatalf("expected a to resume before b starts, got %v", ready)
+	}
+	if last := events[len(events)-1]; last != "a: resumed" {
+		t.Fatalf("expected the resume to be reported, got %v", events)
+	}
+}
+
+func TestTranscodeQueueDefersJobsDuringQuietHours(t *testing.T) {
+	mgr := New(t.TempDir(), t.TempDir())
+	mgr.maxTasks = 2
+	task := &TranscodeTask{ID: "a", Status: domain.TranscodeStatusPending, Metadata: map[string]string{}}
+	var queueEvents []queueEvent
+
+	mgr.mutex.Lock()
+	mgr.quiet = true
+	mgr.tasks["a"] = task
+	mgr.enqueueLocked(task)
+	ready := mgr.takeRunnableLocked(&queueEvents)
+	mgr.mutex.Unlock()
+	if len(ready) != 0 || task.QueuePosition != 1 {
+		t.Fatalf("expected a to wait in the queue during quiet hours, got %v", ready)
+	}
+
+	mgr.mutex.Lock()
+	mgr.quiet = false
+	ready = mgr.takeRunnableLocked(&queueEvents)
+	mgr.mutex.Unlock()
+	if len(ready) != 1 || ready[0] != task {
+		t.Fatalf("expected a to start after quiet hours, got %v", ready)
+	}
+}
+
+func TestTranscodeQueueSnapshot(t *testing.T) {
+	mgr := New(t.TempDir(), t.TempDir())
+	mgr.maxTasks = 1
+	queue := func(id, taskID string, interactive bool) *TranscodeTask {
+		task := &TranscodeTask{ID: id, Status: domain.TranscodeStatusPending, Metadata: map[string]string{}, Options: Options{TaskID: taskID, Interactive: interactive}}
+		mgr.mutex.Lock()
+		mgr.tasks[id] = task
+		mgr.enqueueLocked(task)
+		mgr.mutex.Unlock()
+		return task
+	}
+
+	queue("a", "task-a", false).Progress = 40
+	var queueEvents []queueEvent
+	mgr.mutex.Lock()
+	mgr.takeRunnableLocked(&queueEvents)
+	mgr.mutex.Unlock()
+	queue("b", "task-b", false)
+	queue("i", "task-i", true)
+
+	want := QueueSnapshot{
+		MaxTasks: 1,
+		Running:  []QueueEntry{{TranscodeID: "a", TaskID: "task-a", Progress: 40}},
+		Pending: []QueueEntry{
+			{TranscodeID: "i", TaskID: "task-i", Interactive: true, Position: 1},
+			{TranscodeID: "b", TaskID: "task-b", Position: 2},
+		},
+	}
+	if snapshot := mgr.QueueSnapshot(); !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("expected %+v, got %+v", want, snapshot)
+	}
+}
+
+func TestProgressWriterParsesFFmpegProgress(t *testing.T) {
+	var reported []time.Duration
+	writer := &progressWriter{onProgress: func(processed time.Duration) { reported = append(reported, processed) }}
+
+	output := "frame=0\nout_time_us=N/A\nout_time=N/A\nprogress=continue\n" +
+		"frame=240\nout_time_us=10000000\nout_time_ms=10000000\nout_time=00:00:10.000000\nprogress=continue\n" +
+		"frame=480\nout_time=00:01:20.500000\nprogress=continue\n" +
+		"out_time=-577014:32:22.771653\nprogress=continue\n" +
+		"out_time_us=125000000\nprogress=end\n"
+	// 按任意边界切开写入，模拟管道的分块读取
+	for len(output) > 0 {
+		n := 7
+		if n > len(output) {
+			n = len(output)
+		}
+		writer.Write([]byte(output[:n]))
+		output = output[n:]
+	}
+
+	want := []time.Duration{10 * time.Second, 80*time.Second + 500*time.Millisecond, 125 * time.Second}
+	if !reflect.DeepEqual(reported, want) {
+		t.Fatalf("expected %v, got %v", want, reported)
+	}
+
+	for _, tc := range []struct {
+		processed, duration time.Duration
+		want                int
+	}{
+		{30 * time.Second, 2 * time.Minute, 25},
+		{3 * time.Minute, 2 * time.Minute, 99},
+		{30 * time.Second, 0, -1},
+	} {
+		if got := progressPercent(tc.processed, tc.duration); got != tc.want {
+			t.Fatalf("progressPercent(%v, %v): expected %d, got %d", tc.processed, tc.duration, tc.want, got)
+		}
+	}
+}
+
+func TestReportProgressThrottlesStatusUpdates(t *testing.T) {
+	mgr := New(t.TempDir(), t.TempDir())
+	task := &TranscodeTask{ID: "a", Status: domain.TranscodeStatusProcessing, UpdatedAt: time.Now().Add(-time.Minute)}
+
+	mgr.reportProgress(task, 10, time.Minute)
+	mgr.reportProgress(task, 20, 2*time.Minute) // 距上次不到progressInterval
+	task.UpdatedAt = time.Now().Add(-time.Minute)
+	mgr.reportProgress(task, 10, time.Minute) // 进度没有变化
+	mgr.reportProgress(task, -1, 3*time.Minute)
+
+	var updates []TranscodeTask
+	for len(mgr.statusChan) > 0 {
+		updates = append(updates, *<-mgr.statusChan)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("expected two updates, got %+v", updates)
+	}
+	if updates[0].Progress != 10 || updates[0].ProgressIndeterminate || updates[0].ProcessedSeconds != 60 {
+		t.Fatalf("unexpected first update: %+v", updates[0])
+	}
+	if updates[1].Progress != 10 || !updates[1].ProgressIndeterminate || updates[1].ProcessedSeconds != 180 {
+		t.Fatalf("expected an indeterminate update keeping the last percentage, got %+v", updates[1])
+	}
+}
+
+func TestVerifySegmentDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXTINF:4.000000,\nindex0.ts\n#EXTINF:4.000000,\nindex1.ts\n" +
+		"#EXTINF:4.000000,\nindex2.ts\n#EXTINF:4.000000,\nindex3.ts\n" +
+		"#EXTINF:2.500000,\nindex4.ts\n#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(packets int) []byte {
+		data := make([]byte, packets*tsPacketSize)
+		for i := 0; i < len(data); i += tsPacketSize {
+			data[i] = 0x47
+		}
+		return data
+	}
+	files := map[string][]byte{
+		"index0.ts": segment(100),
+		"index1.ts": segment(100),
+		"index2.ts": segment(100)[:1000], // 写到一半
+		"index3.ts": segment(10),         // 截断在包边界
+		"index4.ts": segment(60),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := ParsePlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatalf("ParsePlaylist: %v", err)
+	}
+	if len(segments) != 5 || segments[4].Start != 16 || segments[4].Duration != 2.5 {
+		t.Fatalf("unexpected segments: %+v", segments)
+	}
+
+	for i, healthy := range []bool{true, true, false, false, true} {
+		if check := VerifySegment(dir, segments, i); check.Healthy != healthy {
+			t.Errorf("segment %d: healthy=%v (%s), want %v", i, check.Healthy, check.Reason, healthy)
+		}
+	}
+
+	if err := writeSegmentChecksums(dir, nil); err != nil {
+		t.Fatalf("writeSegmentChecksums: %v", err)
+	}
+	corrupted := segment(100)
+	corrupted[tsPacketSize+5] = 0xff
+	if err := os.WriteFile(filepath.Join(dir, "index1.ts"), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := VerifySegment(dir, segments, 1); check.Healthy || check.Reason != "checksum mismatch" {
+		t.Fatalf("expected checksum mismatch, got %+v", check)
+	}
+	if check := VerifySegment(dir, segments, 0); !check.Healthy {
+		t.Fatalf("segment with matching checksum reported bad: %+v", check)
+	}
+}
+
+func TestSubtitleFilesCarryLanguage(t *testing.T) {
+	if got := subtitleFileName(subtitleStream{index: "2", format: "subrip", lang: "jpn"}); got != "subtitle_jpn_2.srt" {
+		t.Fatalf("unexpected file name %q", got)
+	}
+	if got := subtitleFileName(subtitleStream{index: "3", format: "ass"}); got != "subtitle_und_3.ass" {
+		t.Fatalf("expected und for an unknown language, got %q", got)
+	}
+
+	cases := map[string]SubtitleInfo{
+		"/out/subtitle_jpn_2.srt":   {Path: "/out/subtitle_jpn_2.srt", Language: "jpn", Index: "2", Format: "srt"},
+		"/out/subtitle_und_4.vtt":   {Path: "/out/subtitle_und_4.vtt", Language: "und", Index: "4", Format: "vtt"},
+		"/out/subtitle_3.srt":       {Path: "/out/subtitle_3.srt", Index: "3", Format: "srt"},
+		"/out/movie.zh-CN.srt":      {Path: "/out/movie.zh-CN.srt", Language: "zh-CN", Format: "srt"},
+		"/out/subtitle_extra.srt":   {Path: "/out/subtitle_extra.srt", Format: "srt"},
+		"/out/Movie.2019.1080p.srt": {Path: "/out/Movie.2019.1080p.srt", Format: "srt"},
+	}
+	for path, want := range cases {
+		if got := SubtitleInfoFromPath(path); got != want {
+			t.Fatalf("%s: expected %+v, got %+v", path, want, got)
+		}
+	}
+}
+
+func TestConvertSubtitleTranscodesToUTF8(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "chs.utf8.srt"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	cases := map[string]string{
+		"chs.gbk.srt":     "gb18030",
+		"chs.utf16le.srt": "utf-16le",
+		"chs.utf8.srt":    "utf-8",
+	}
+	downloadDir := t.TempDir()
+	for name, charset := range cases {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("read fixture %s: %v", name, err)
+		}
+		if got := DetectTextEncoding(data, ""); got != charset {
+			t.Fatalf("%s: expected %s, got %s", name, charset, got)
+		}
+		if err := os.WriteFile(filepath.Join(downloadDir, name), data, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	// BOM之后的UTF-8内容去掉BOM
+	if err := os.WriteFile(filepath.Join(downloadDir, "chs.bom.srt"), append([]byte{0xEF, 0xBB, 0xBF}, want...), 0644); err != nil {
+		t.Fatalf("write bom fixture: %v", err)
+	}
+
+	mgr := New(t.TempDir(), t.TempDir())
+	taskDir := t.TempDir()
+	subtitles, err := mgr.legacyManager.ConvertSubtitle(taskDir, downloadDir)
+	if err != nil {
+		t.Fatalf("convert subtitles: %v", err)
+	}
+	if len(subtitles) != 4 {
+		t.Fatalf("expected 4 converted subtitles, got %v", subtitles)
+	}
+	for _, path := range subtitles {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("%s: expected UTF-8 without BOM %q, got %q", filepath.Base(path), want, got)
+		}
+	}
+
+	// 配置的默认编码只用于既没有BOM、又不是UTF-8的文本
+	if got := DetectTextEncoding(want, "big5"); got != "utf-8" {
+		t.Fatalf("expected valid UTF-8 to ignore the fallback, got %s", got)
+	}
+	gbk, _ := os.ReadFile(filepath.Join("testdata", "chs.gbk.srt"))
+	if got := DetectTextEncoding(gbk, "GBK"); got != "gbk" {
+		t.Fatalf("expected the configured fallback, got %s", got)
+	}
+}
@@ -0,0 +1,123 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo 通过ffprobe获取的媒体信息
+type MediaInfo struct {
+	DurationSeconds   float64  `json:"duration_seconds"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	VideoCodec        string   `json:"video_codec"`
+	AudioCodec        string   `json:"audio_codec"`
+	SubtitleLanguages []string `json:"subtitle_languages"`
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string            `json:"codec_type"`
+		CodecName string            `json:"codec_name"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+// ProbeMedia 读取媒体文件的时长、分辨率、编码与字幕语言
+func ProbeMedia(inputPath string) (*MediaInfo, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration:stream=codec_type,codec_name,width,height:stream_tags=language",
+		"-of", "json",
+		inputPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe执行失败: %w", err)
+	}
+
+	return parseProbeOutput(output)
+}
+
+func parseProbeOutput(output []byte) (*MediaInfo, error) {
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("解析ffprobe输出失败: %w", err)
+	}
+
+	info := &MediaInfo{SubtitleLanguages: []string{}}
+	if probe.Format.Duration != "" {
+		if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+			info.DurationSeconds = duration
+		}
+	}
+
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if info.VideoCodec == "" {
+				info.VideoCodec = stream.CodecName
+				info.Width = stream.Width
+				info.Height = stream.Height
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+		case "subtitle":
+			lang := stream.Tags["language"]
+			if lang == "" {
+				lang = "und"
+			}
+			info.SubtitleLanguages = append(info.SubtitleLanguages, lang)
+		}
+	}
+
+	return info, nil
+}
+
+// ToolVersion 返回ffmpeg/ffprobe等工具 -version 输出的第一行
+func ToolVersion(tool string) (string, error) {
+	output, err := exec.Command(tool, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s不可用: %w", tool, err)
+	}
+
+	line := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if line == "" {
+		return "", fmt.Errorf("%s -version 没有输出", tool)
+	}
+	return line, nil
+}
+
+// GenerateTestPattern 使用lavfi生成一段短小的测试视频，用于自检转码链路
+func GenerateTestPattern(outputPath string, seconds int) error {
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	cmd := exec.Command("ffmpeg",
+		"-y",
+		"-f", "lavfi",
+		"-i", fmt.Sprintf("testsrc=duration=%d:size=160x120:rate=10", seconds),
+		"-pix_fmt", "yuv420p",
+		"-c:v", "libx264",
+		outputPath,
+	)
+
+	stderrTail := newTailBuffer(ffmpegTailBytes)
+	cmd.Stderr = stderrTail
+	if err := cmd.Run(); err != nil {
+		return &FFmpegError{Err: err, Tail: stderrTail.String()}
+	}
+	return nil
+}
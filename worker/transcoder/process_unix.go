@@ -0,0 +1,19 @@
+//go:build !windows
+
+package transcoder
+
+import (
+	"os"
+	"syscall"
+)
+
+// canPauseProcesses 当前平台能否用SIGSTOP/SIGCONT暂停和恢复ffmpeg
+const canPauseProcesses = true
+
+func stopProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGSTOP)
+}
+
+func continueProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGCONT)
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package transcoder
+
+import (
+	"errors"
+	"os"
+)
+
+// canPauseProcesses Windows没有SIGSTOP，不支持抢占
+const canPauseProcesses = false
+
+var errPauseUnsupported = errors.New("pausing processes is not supported on windows")
+
+func stopProcess(*os.Process) error {
+	return errPauseUnsupported
+}
+
+func continueProcess(*os.Process) error {
+	return errPauseUnsupported
+}
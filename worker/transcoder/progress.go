@@ -0,0 +1,138 @@
+package transcoder
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressInterval 转码进度通过状态通道上报的最小间隔
+const progressInterval = 2 * time.Second
+
+// ProgressFunc 接收转码进度：percent为0-99的百分比，片源时长未知时为-1（进度不确定），
+// processed为已输出的媒体时长
+type ProgressFunc func(percent int, processed time.Duration)
+
+// progressArgs 需要进度时让ffmpeg把 -progress 的key=value输出写到stdout
+func progressArgs(config HLSConfig) []string {
+	if config.OnProgress == nil {
+		return nil
+	}
+	return []string{"-progress", "pipe:1"}
+}
+
+// progressOutput 需要进度时解析ffmpeg的stdout，否则原样输出
+func progressOutput(config HLSConfig) io.Writer {
+	if config.OnProgress == nil {
+		return os.Stdout
+	}
+	return &progressWriter{onProgress: func(processed time.Duration) {
+		config.OnProgress(progressPercent(processed, config.Duration), processed)
+	}}
+}
+
+// progressPercent 已输出时长占片源时长的百分比，最多99，完成由转码结束确认；时长未知时为-1
+func progressPercent(processed, duration time.Duration) int {
+	if duration <= 0 {
+		return -1
+	}
+	percent := int(processed * 100 / duration)
+	switch {
+	case percent < 0:
+		return 0
+	case percent > 99:
+		return 99
+	}
+	return percent
+}
+
+// progressWriter 解析ffmpeg -progress 输出的key=value行，每个进度块以progress=行结束，
+// 此时以块中的out_time回调onProgress。out_time为N/A或负数的块不回调
+type progressWriter struct {
+	onProgress func(processed time.Duration)
+	partial    []byte
+	outTime    time.Duration
+	known      bool
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	for {
+		end := bytes.IndexByte(p.partial, '\n')
+		if end < 0 {
+			break
+		}
+		p.parseLine(strings.TrimSpace(string(p.partial[:end])))
+		p.partial = p.partial[end+1:]
+	}
+	return len(data), nil
+}
+
+func (p *progressWriter) parseLine(line string) {
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return
+	}
+	switch key {
+	case "out_time_us", "out_time_ms":
+		// 两者的单位都是微秒（out_time_ms是ffmpeg的历史遗留命名）
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.outTime, p.known = time.Duration(us)*time.Microsecond, true
+		}
+	case "out_time":
+		if !p.known {
+			if d, ok := parseClock(value); ok {
+				p.outTime, p.known = d, true
+			}
+		}
+	case "progress":
+		if p.known {
+			p.onProgress(p.outTime)
+		}
+		p.known = false
+	}
+}
+
+// parseClock 解析HH:MM:SS.micro格式的时长
+func parseClock(value string) (time.Duration, bool) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil || hours < 0 || minutes < 0 || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// reportProgress 更新转码任务的进度，间隔progressInterval以上且进度有变化时上报一份快照。
+// 状态通道满时丢弃这次进度，不阻塞ffmpeg
+func (m *Manager) reportProgress(task *TranscodeTask, percent int, processed time.Duration) {
+	m.mutex.Lock()
+	indeterminate := percent < 0
+	if indeterminate {
+		percent = task.Progress
+	}
+	unchanged := !indeterminate && !task.ProgressIndeterminate && percent == task.Progress
+	if unchanged || time.Since(task.UpdatedAt) < progressInterval {
+		m.mutex.Unlock()
+		return
+	}
+	task.Progress = percent
+	task.ProgressIndeterminate = indeterminate
+	task.ProcessedSeconds = processed.Seconds()
+	task.UpdatedAt = time.Now()
+	update := *task
+	m.mutex.Unlock()
+
+	select {
+	case m.statusChan <- &update:
+	default:
+	}
+}
@@ -0,0 +1,352 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// runningJob 占用或暂时让出名额的转码任务
+type runningJob struct {
+	task    *TranscodeTask
+	started time.Time
+	process *os.Process // 当前的ffmpeg进程，两次调用ffmpeg之间为nil
+	paused  bool        // 被交互任务抢占，进程已SIGSTOP，不占用名额
+	// quietStopped 静默时段内进程已SIGSTOP，时段结束时恢复；仍占用名额
+	quietStopped bool
+}
+
+// enqueueLocked 将任务加入等待队列：交互任务排在其它交互任务之后、普通任务之前，
+// 普通任务排在队尾。所属任务已被BoostTask标记时按交互任务排队。调用方持有m.mutex
+func (m *Manager) enqueueLocked(task *TranscodeTask) {
+	if task.Options.TaskID != "" && m.boosted[task.Options.TaskID] {
+		task.Options.Interactive = true
+	}
+	at := len(m.pending)
+	if task.Options.Interactive {
+		at = 0
+		for at < len(m.pending) && m.pending[at].Options.Interactive {
+			at++
+		}
+	}
+	m.pending = append(m.pending, nil)
+	copy(m.pending[at+1:], m.pending[at:])
+	m.pending[at] = task
+	m.renumberLocked()
+}
+
+// unqueueLocked 将任务移出等待队列，返回任务是否在队列中。调用方持有m.mutex
+func (m *Manager) unqueueLocked(transcodeID string) bool {
+	for i, task := range m.pending {
+		if task.ID == transcodeID {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			task.QueuePosition = 0
+			m.renumberLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// renumberLocked 更新等待任务的QueuePosition（从1开始）。调用方持有m.mutex
+func (m *Manager) renumberLocked() {
+	for i, task := range m.pending {
+		task.QueuePosition = i + 1
+	}
+}
+
+// activeJobsLocked 占用名额（未被暂停）的任务数。调用方持有m.mutex
+func (m *Manager) activeJobsLocked() int {
+	active := 0
+	for _, job := range m.running {
+		if !job.paused {
+			active++
+		}
+	}
+	return active
+}
+
+// takeRunnableLocked 在名额允许的范围内决定接下来运行的任务：先取等待的交互任务，
+// 再恢复被抢占的任务，最后按顺序取普通任务。返回需要新启动的任务。调用方持有m.mutex
+func (m *Manager) takeRunnableLocked(events *[]queueEvent) []*TranscodeTask {
+	if m.quiet {
+		// 静默时段结束后由SetQuiet开始
+		return nil
+	}
+	var ready []*TranscodeTask
+	for m.activeJobsLocked() < m.maxTasks {
+		if len(m.pending) > 0 && m.pending[0].Options.Interactive {
+			ready = append(ready, m.startNextLocked())
+			continue
+		}
+		if job := m.pausedJobLocked(); job != nil {
+			m.resumeLocked(job, events)
+			continue
+		}
+		if len(m.pending) == 0 {
+			break
+		}
+		ready = append(ready, m.startNextLocked())
+	}
+	return ready
+}
+
+// startNextLocked 取出队首任务并占用名额。调用方持有m.mutex
+func (m *Manager) startNextLocked() *TranscodeTask {
+	task := m.pending[0]
+	m.pending = m.pending[1:]
+	task.QueuePosition = 0
+	m.renumberLocked()
+	m.running[task.ID] = &runningJob{task: task, started: time.Now()}
+	return task
+}
+
+// pausedJobLocked 最早开始的被暂停任务，没有时返回nil。调用方持有m.mutex
+func (m *Manager) pausedJobLocked() *runningJob {
+	var oldest *runningJob
+	for _, job := range m.running {
+		if job.paused && (oldest == nil || job.started.Before(oldest.started)) {
+			oldest = job
+		}
+	}
+	return oldest
+}
+
+// preemptLocked 交互任务在排队且名额已满时，暂停最近开始的一个普通任务为其让出名额。
+// 暂停的任务保留进度，名额空出后优先恢复。调用方持有m.mutex
+func (m *Manager) preemptLocked(events *[]queueEvent) {
+	if !m.preempt || m.quiet || len(m.pending) == 0 || !m.pending[0].Options.Interactive || m.activeJobsLocked() < m.maxTasks {
+		return
+	}
+	var victim *runningJob
+	for _, job := range m.running {
+		if job.paused || job.task.Options.Interactive {
+			continue
+		}
+		if victim == nil || job.started.After(victim.started) {
+			victim = job
+		}
+	}
+	if victim == nil {
+		return
+	}
+	if victim.process != nil {
+		if err := stopProcess(victim.process); err != nil {
+			log.Printf("Failed to pause transcode %s: %v", victim.task.ID, err)
+			return
+		}
+	}
+	victim.paused = true
+	*events = append(*events, queueEvent{victim.task, fmt.Sprintf("paused to make room for interactive transcode %s", m.pending[0].ID)})
+}
+
+// resumeLocked 恢复被暂停的任务。调用方持有m.mutex
+func (m *Manager) resumeLocked(job *runningJob, events *[]queueEvent) {
+	job.paused = false
+	if job.process != nil {
+		if err := continueProcess(job.process); err != nil {
+			log.Printf("Failed to resume transcode %s: %v", job.task.ID, err)
+		}
+	}
+	*events = append(*events, queueEvent{job.task, "resumed"})
+}
+
+// processStarted 记录任务当前的ffmpeg进程；任务已被暂停时立即暂停新进程
+func (m *Manager) processStarted(transcodeID string, process *os.Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	job, exists := m.running[transcodeID]
+	if !exists {
+		return
+	}
+	job.process = process
+	if process == nil {
+		return
+	}
+	if m.quiet && m.quietSuspend && !job.paused {
+		job.quietStopped = true
+	}
+	if job.paused || job.quietStopped {
+		if err := stopProcess(process); err != nil {
+			log.Printf("Failed to pause transcode %s: %v", transcodeID, err)
+		}
+	}
+}
+
+// releaseSlot 转码结束后释放名额，并开始或恢复下一个任务
+func (m *Manager) releaseSlot(task *TranscodeTask) {
+	var events []queueEvent
+	m.mutex.Lock()
+	delete(m.running, task.ID)
+	m.forgetBoostLocked(task.Options.TaskID)
+	ready := m.takeRunnableLocked(&events)
+	m.mutex.Unlock()
+	m.notify(events)
+	m.launch(ready)
+}
+
+// launch 开始转码已占用名额的任务
+func (m *Manager) launch(tasks []*TranscodeTask) {
+	for _, task := range tasks {
+		go m.transcodeTask(task)
+	}
+}
+
+// BoostTask 标记任务有观众在等待：任务等待中的转码移到交互任务队列，正在运行的转码标记为交互任务，
+// 之后不会被抢占，并在允许抢占时为其暂停一个普通任务。标记在持有队列锁时记录，任务之后加入队列的
+// 转码（如刚读完任务选项、尚未排队的转码）也按交互任务排队。返回任务的转码在等待队列中
+// 最靠前的位置，没有排队的转码时返回0
+func (m *Manager) BoostTask(taskID string) int {
+	var events []queueEvent
+	m.mutex.Lock()
+	m.boosted[taskID] = true
+	var boosted []*TranscodeTask
+	for _, task := range m.pending {
+		if task.Options.TaskID == taskID && !task.Options.Interactive {
+			boosted = append(boosted, task)
+		}
+	}
+	for _, task := range boosted {
+		m.unqueueLocked(task.ID)
+		m.enqueueLocked(task)
+		events = append(events, queueEvent{task, fmt.Sprintf("boosted to queue position %d", task.QueuePosition)})
+	}
+	for _, job := range m.running {
+		if job.task.Options.TaskID == taskID && !job.task.Options.Interactive {
+			job.task.Options.Interactive = true
+			events = append(events, queueEvent{job.task, "boosted while running"})
+		}
+	}
+	m.preemptLocked(&events)
+	ready := m.takeRunnableLocked(&events)
+	position := 0
+	for _, task := range m.pending {
+		if task.Options.TaskID == taskID {
+			position = task.QueuePosition
+			break
+		}
+	}
+	m.mutex.Unlock()
+	m.notify(events)
+	m.launch(ready)
+	return position
+}
+
+// forgetBoostLocked 任务没有等待或运行中的转码时清除BoostTask的标记。调用方持有m.mutex
+func (m *Manager) forgetBoostLocked(taskID string) {
+	if !m.boosted[taskID] {
+		return
+	}
+	for _, task := range m.pending {
+		if task.Options.TaskID == taskID {
+			return
+		}
+	}
+	for _, job := range m.running {
+		if job.task.Options.TaskID == taskID {
+			return
+		}
+	}
+	delete(m.boosted, taskID)
+}
+
+// queueEvent 排队决策，通知给SetQueueEventHandler设置的回调
+type queueEvent struct {
+	task    *TranscodeTask
+	message string
+}
+
+// SetQueueEventHandler 设置排队、插队、抢占和恢复时的回调，回调中不应再调用Manager的方法
+func (m *Manager) SetQueueEventHandler(handler func(task *TranscodeTask, event string)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queueHandler = handler
+}
+
+// notify 在释放m.mutex之后调用回调
+func (m *Manager) notify(events []queueEvent) {
+	m.mutex.RLock()
+	handler := m.queueHandler
+	m.mutex.RUnlock()
+	for _, event := range events {
+		log.Printf("Transcode %s %s", event.task.ID, event.message)
+		if handler != nil {
+			handler(event.task, event.message)
+		}
+	}
+}
+
+// SetMaxTasks 设置同时转码的任务数，超出的任务排队等待。应在Start之前调用
+func (m *Manager) SetMaxTasks(maxTasks int) {
+	if maxTasks <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	m.maxTasks = maxTasks
+	m.mutex.Unlock()
+}
+
+// SetPreemptForInteractive 设置交互任务排队时是否暂停（SIGSTOP）一个正在运行的普通任务，
+// 不支持暂停进程的平台上该设置无效
+func (m *Manager) SetPreemptForInteractive(enabled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.preempt = enabled && canPauseProcesses
+}
+
+// QueueEntry 转码队列中的一个任务
+type QueueEntry struct {
+	TranscodeID string `json:"transcode_id"`
+	TaskID      string `json:"task_id,omitempty"`
+	Interactive bool   `json:"interactive,omitempty"`
+	Position    int    `json:"position,omitempty"` // 在等待队列中的位置，从1开始；已开始的任务为0
+	Paused      bool   `json:"paused,omitempty"`   // 被交互任务抢占，暂不占用名额
+	Progress    int    `json:"progress"`
+}
+
+// QueueSnapshot 转码名额与等待队列的快照
+type QueueSnapshot struct {
+	MaxTasks int          `json:"max_tasks"`
+	Running  []QueueEntry `json:"running"` // 按开始时间排列，含被抢占暂停的任务
+	Pending  []QueueEntry `json:"pending"` // 按开始的先后顺序，交互任务在前
+}
+
+// QueueSnapshot 返回已开始的转码和等待队列
+func (m *Manager) QueueSnapshot() QueueSnapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	jobs := make([]*runningJob, 0, len(m.running))
+	for _, job := range m.running {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].started.Before(jobs[j].started) })
+
+	snapshot := QueueSnapshot{
+		MaxTasks: m.maxTasks,
+		Running:  make([]QueueEntry, 0, len(jobs)),
+		Pending:  make([]QueueEntry, 0, len(m.pending)),
+	}
+	for _, job := range jobs {
+		entry := queueEntry(job.task)
+		entry.Paused = job.paused
+		snapshot.Running = append(snapshot.Running, entry)
+	}
+	for i, task := range m.pending {
+		entry := queueEntry(task)
+		entry.Position = i + 1
+		snapshot.Pending = append(snapshot.Pending, entry)
+	}
+	return snapshot
+}
+
+func queueEntry(task *TranscodeTask) QueueEntry {
+	return QueueEntry{
+		TranscodeID: task.ID,
+		TaskID:      task.Options.TaskID,
+		Interactive: task.Options.Interactive,
+		Progress:    task.Progress,
+	}
+}
@@ -0,0 +1,43 @@
+package transcoder
+
+import "log"
+
+// SetQuiet 进入静默时段时等待的转码不再开始；suspend为true时同时用SIGSTOP暂停正在运行的ffmpeg
+// （不支持暂停进程的平台上只推迟排队的转码）。离开时恢复暂停的进程并开始等待的转码
+func (m *Manager) SetQuiet(quiet, suspend bool) {
+	var events []queueEvent
+	var ready []*TranscodeTask
+	m.mutex.Lock()
+	if m.quiet == quiet {
+		m.mutex.Unlock()
+		return
+	}
+	m.quiet = quiet
+	m.quietSuspend = suspend && canPauseProcesses
+	for _, job := range m.running {
+		if quiet && m.quietSuspend && !job.paused && job.process != nil {
+			if err := stopProcess(job.process); err != nil {
+				log.Printf("Failed to suspend transcode %s for quiet hours: %v", job.task.ID, err)
+				continue
+			}
+			job.quietStopped = true
+			events = append(events, queueEvent{job.task, "suspended for quiet hours"})
+		}
+		if !quiet && job.quietStopped {
+			job.quietStopped = false
+			// 被交互任务抢占的任务仍保持暂停，等名额空出时恢复
+			if !job.paused && job.process != nil {
+				if err := continueProcess(job.process); err != nil {
+					log.Printf("Failed to resume transcode %s after quiet hours: %v", job.task.ID, err)
+				}
+			}
+			events = append(events, queueEvent{job.task, "resumed after quiet hours"})
+		}
+	}
+	if !quiet {
+		ready = m.takeRunnableLocked(&events)
+	}
+	m.mutex.Unlock()
+	m.notify(events)
+	m.launch(ready)
+}
@@ -0,0 +1,316 @@
+package transcoder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HLSQualitySingle 只输出一路码流（默认），尽量直接复制视频流
+	HLSQualitySingle = "single"
+	// HLSQualityMulti 按码率阶梯输出多路码流和主播放列表，播放器按带宽自适应切换
+	HLSQualityMulti = "multi"
+
+	// MasterPlaylistName 多码率输出的主播放列表文件名
+	MasterPlaylistName = "master.m3u8"
+)
+
+// VariantSpec 多码率输出中的一路码流。画面按Height等比缩放，Width只在片源分辨率未知时
+// 写入主播放列表的RESOLUTION。码率使用ffmpeg的写法，如"2800k"、"5M"
+type VariantSpec struct {
+	Name         string `json:"name"` // 子目录名，如"720p"
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoBitrate string `json:"video_bitrate"`
+	AudioBitrate string `json:"audio_bitrate"`
+}
+
+// RenditionInfo 转码完成后一路码流的信息
+type RenditionInfo struct {
+	Name     string `json:"name"`
+	M3U8Path string `json:"m3u8_path"`
+	Bitrate  int    `json:"bitrate"` // 音视频码率之和（bps），即主播放列表中的BANDWIDTH
+}
+
+// DefaultRenditions 默认的码率阶梯，从高到低排列
+func DefaultRenditions() []VariantSpec {
+	return []VariantSpec{
+		{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: "5000k", AudioBitrate: "192k"},
+		{Name: "720p", Width: 1280, Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k"},
+		{Name: "480p", Width: 854, Height: 480, VideoBitrate: "1400k", AudioBitrate: "128k"},
+		{Name: "360p", Width: 640, Height: 360, VideoBitrate: "800k", AudioBitrate: "96k"},
+	}
+}
+
+// parseBitrate 将ffmpeg写法的码率（"800k"、"5M"或纯数字）转换为bps
+func parseBitrate(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "M"), strings.HasSuffix(value, "m"):
+		multiplier = 1000 * 1000
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", value)
+	}
+	return int(n * float64(multiplier)), nil
+}
+
+// bandwidth 该码流的音视频码率之和（bps）
+func (r VariantSpec) bandwidth() (int, error) {
+	video, err := parseBitrate(r.VideoBitrate)
+	if err != nil {
+		return 0, fmt.Errorf("rendition %s: video %w", r.Name, err)
+	}
+	audio, err := parseBitrate(r.AudioBitrate)
+	if err != nil {
+		return 0, fmt.Errorf("rendition %s: audio %w", r.Name, err)
+	}
+	return video + audio, nil
+}
+
+// validateRenditions 检查码流名称可作为子目录名且不重复，分辨率和码率有效
+func validateRenditions(renditions []VariantSpec) error {
+	seen := make(map[string]bool, len(renditions))
+	for _, r := range renditions {
+		if r.Name == "" || r.Name == "." || r.Name == ".." || strings.ContainsAny(r.Name, `/\`) {
+			return fmt.Errorf("invalid rendition name %q", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("duplicate rendition %q", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Width <= 0 || r.Height <= 0 {
+			return fmt.Errorf("rendition %s: invalid resolution %dx%d", r.Name, r.Width, r.Height)
+		}
+		if _, err := r.bandwidth(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fitRenditions 去掉高于片源分辨率的码流（放大画面只会浪费码率），至少保留最低的一路。
+// sourceHeight未知（0）时全部保留。
+func fitRenditions(renditions []VariantSpec, sourceHeight int) []VariantSpec {
+	if sourceHeight <= 0 {
+		return renditions
+	}
+	var fitted []VariantSpec
+	lowest := 0
+	for i, r := range renditions {
+		if r.Height <= sourceHeight {
+			fitted = append(fitted, r)
+		}
+		if r.Height < renditions[lowest].Height {
+			lowest = i
+		}
+	}
+	if len(fitted) == 0 && len(renditions) > 0 {
+		fitted = append(fitted, renditions[lowest])
+	}
+	return fitted
+}
+
+// 片源的音频情况，决定多码率输出是否映射音频
+const (
+	audioUnknown = iota // 探测失败，按可选映射第一路音频
+	audioPresent
+	audioAbsent
+)
+
+// ladderArgs 构建一次输出全部码流的ffmpeg参数：每路码流各映射一次视频和音频，
+// 按-var_stream_map输出到<outputDir>/<name>/index.m3u8。各路码流都重新编码，画面按高度等比缩放，
+// 并在切片边界强制关键帧，保证切片时间对齐，播放器切换码流时不会跳帧。片源没有音频时只映射视频，
+// 音频情况未知时音频按可选映射
+func ladderArgs(inputPath, outputDir string, config HLSConfig, variants []VariantSpec, audio int, subtitleTrack int) []string {
+	hasAudio := audio != audioAbsent
+	audioMap := "0:a:0"
+	if audio == audioUnknown {
+		audioMap = "0:a:0?"
+	}
+	args := append(progressArgs(config), "-i", inputPath)
+	streams := make([]string, len(variants))
+	for i, v := range variants {
+		args = append(args, "-map", "0:v:0")
+		streams[i] = fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			args = append(args, "-map", audioMap)
+			streams[i] += fmt.Sprintf(",a:%d", i)
+		}
+		streams[i] += ",name:" + v.Name
+	}
+
+	args = append(args, "-c:v", "libx264", "-preset", "veryfast")
+	if hasAudio {
+		args = append(args, "-c:a", "aac")
+	}
+	for i, v := range variants {
+		// 宽度取-2：按片源宽高比计算并取偶数，不拉伸画面
+		filter := fmt.Sprintf("scale=-2:%d", v.Height)
+		if subtitleTrack >= 0 {
+			filter = burnFilter(inputPath, subtitleTrack) + "," + filter
+		}
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), filter,
+			fmt.Sprintf("-b:v:%d", i), v.VideoBitrate,
+		)
+		if hasAudio {
+			args = append(args, fmt.Sprintf("-b:a:%d", i), v.AudioBitrate)
+		}
+	}
+	args = append(args, "-force_key_frames", forceKeyframesExpr(config.SegmentDuration), "-sn")
+
+	return append(args,
+		"-start_number", "0",
+		"-hls_time", fmt.Sprintf("%d", config.SegmentDuration),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", config.PlaylistType,
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", "index%d.ts"),
+		"-var_stream_map", strings.Join(streams, " "),
+		"-f", "hls",
+		filepath.Join(outputDir, "%v", "index.m3u8"),
+	)
+}
+
+// scaledWidth 按片源宽高比缩放到height时的宽度，与scale=-2一样取偶数
+func scaledWidth(height, sourceWidth, sourceHeight int) int {
+	width := int(math.Round(float64(height) * float64(sourceWidth) / float64(sourceHeight) / 2))
+	return width * 2
+}
+
+// masterPlaylist 生成引用各路码流播放列表的主播放列表，码流按给定顺序排列
+func masterPlaylist(renditions []VariantSpec) (string, error) {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		bandwidth, err := r.bandwidth()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/index.m3u8\n", bandwidth, r.Width, r.Height, r.Name)
+	}
+	return b.String(), nil
+}
+
+// convertRenditions 按config.Variants调用一次ffmpeg输出全部码流到<outputDir>/<name>/index.m3u8，
+// 再在outputDir写入主播放列表master.m3u8并返回其路径。index.m3u8是主播放列表的副本，
+// 供直接打开index.m3u8的播放器使用。失败时删除已输出的码流目录。
+func convertRenditions(inputPath, outputDir string, config HLSConfig, subtitleTrack int) (masterPath string, err error) {
+	renditions := config.Variants
+	if err := validateRenditions(renditions); err != nil {
+		return "", err
+	}
+	audio := audioUnknown
+	if info, err := ProbeMedia(inputPath); err != nil {
+		log.Printf("警告: 无法获取片源分辨率，按全部码流输出: %v", err)
+	} else {
+		renditions = fitRenditions(renditions, info.Height)
+		if info.Width > 0 && info.Height > 0 {
+			// 主播放列表中的RESOLUTION按缩放后的实际宽度填写
+			scaled := make([]VariantSpec, len(renditions))
+			for i, rendition := range renditions {
+				rendition.Width = scaledWidth(rendition.Height, info.Width, info.Height)
+				scaled[i] = rendition
+			}
+			renditions = scaled
+		}
+		audio = audioAbsent
+		if info.AudioCodec != "" {
+			audio = audioPresent
+		}
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, rendition := range renditions {
+			os.RemoveAll(filepath.Join(outputDir, rendition.Name))
+		}
+		os.Remove(filepath.Join(outputDir, MasterPlaylistName))
+	}()
+
+	for _, rendition := range renditions {
+		if err := os.MkdirAll(filepath.Join(outputDir, rendition.Name), 0755); err != nil {
+			return "", fmt.Errorf("创建码流目录失败: %w", err)
+		}
+	}
+
+	log.Printf("开始输出%d路码流: %s -> %s", len(renditions), inputPath, outputDir)
+	err = runLadder(inputPath, outputDir, config, renditions, audio, subtitleTrack)
+	if err != nil && audio == audioUnknown {
+		// 可选映射的音频不存在时-var_stream_map引用不到音频流，按没有音频重新输出
+		log.Printf("警告: 按可选音频输出失败，按没有音频重新输出: %v", err)
+		err = runLadder(inputPath, outputDir, config, renditions, audioAbsent, subtitleTrack)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	master, err := masterPlaylist(renditions)
+	if err != nil {
+		return "", err
+	}
+	masterPath = filepath.Join(outputDir, MasterPlaylistName)
+	for _, path := range []string{masterPath, filepath.Join(outputDir, "index.m3u8")} {
+		if err := os.WriteFile(path, []byte(master), 0644); err != nil {
+			return "", fmt.Errorf("写入主播放列表失败: %w", err)
+		}
+	}
+	return masterPath, nil
+}
+
+// runLadder 运行一次输出全部码流的ffmpeg
+func runLadder(inputPath, outputDir string, config HLSConfig, renditions []VariantSpec, audio int, subtitleTrack int) error {
+	args := ladderArgs(inputPath, outputDir, config, renditions, audio, subtitleTrack)
+
+	stderrTail := newTailBuffer(ffmpegTailBytes)
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = progressOutput(config)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderrTail)
+
+	log.Printf("处理参数: %v", args)
+	if err := runCommand(cmd, config.OnStart); err != nil {
+		return &FFmpegError{Err: fmt.Errorf("multi-quality: %w", err), Tail: stderrTail.String()}
+	}
+	return nil
+}
+
+// collectRenditions 列出outputDir中已输出的码流，按码率阶梯的顺序排列。
+// 高于片源分辨率而被跳过的码流没有播放列表，不会列出
+func collectRenditions(outputDir string, renditions []VariantSpec) []RenditionInfo {
+	var infos []RenditionInfo
+	for _, rendition := range renditions {
+		playlist := filepath.Join(outputDir, rendition.Name, "index.m3u8")
+		if _, err := os.Stat(playlist); err != nil {
+			continue
+		}
+		bandwidth, _ := rendition.bandwidth()
+		infos = append(infos, RenditionInfo{Name: rendition.Name, M3U8Path: playlist, Bitrate: bandwidth})
+	}
+	return infos
+}
+
+// SetRenditions 设置hls_quality为multi时的码率阶梯，为空时使用默认阶梯
+func (m *Manager) SetRenditions(renditions []VariantSpec) {
+	if len(renditions) == 0 {
+		renditions = DefaultRenditions()
+	}
+	m.legacyManager.mu.Lock()
+	defer m.legacyManager.mu.Unlock()
+	m.legacyManager.renditions = append([]VariantSpec(nil), renditions...)
+}
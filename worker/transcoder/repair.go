@@ -0,0 +1,301 @@
+package transcoder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SegmentChecksumsName 转码完成后记录各切片SHA-256的文件，格式与sha256sum的输出相同
+	SegmentChecksumsName = "segments.sha256"
+	// tsPacketSize MPEG-TS包长度，完整写入的切片总是它的整数倍
+	tsPacketSize = 188
+	// minBitrateRatio 切片的字节率低于其它切片中位数的这个比例时视为损坏
+	minBitrateRatio = 0.25
+)
+
+// PlaylistSegment 媒体播放列表中的一个切片
+type PlaylistSegment struct {
+	Name     string
+	Start    float64 // 在视频中的起始时间（秒），为之前各切片时长之和
+	Duration float64
+}
+
+// SegmentCheck 切片检查结果
+type SegmentCheck struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// ParsePlaylist 解析媒体播放列表，返回各切片及其起始时间
+func ParsePlaylist(path string) ([]PlaylistSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var segments []PlaylistSegment
+	var start, duration float64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			segments = append(segments, PlaylistSegment{Name: line, Start: start, Duration: duration})
+			start += duration
+			duration = 0
+		}
+	}
+	return segments, scanner.Err()
+}
+
+// VerifySegment 检查播放列表中第index个切片：文件存在、按整数个TS包完整写入、以同步字节开头、
+// 与记录的校验和一致（有记录时），并且字节率不明显低于其它切片（按时长估算的截断）
+func VerifySegment(dir string, segments []PlaylistSegment, index int) SegmentCheck {
+	segment := segments[index]
+	path := filepath.Join(dir, segment.Name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return SegmentCheck{Reason: "missing"}
+	}
+	check := SegmentCheck{Size: info.Size()}
+	if info.Size() == 0 || info.Size()%tsPacketSize != 0 {
+		check.Reason = fmt.Sprintf("size %d is not a whole number of TS packets", info.Size())
+		return check
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		check.Reason = fmt.Sprintf("unreadable: %v", err)
+		return check
+	}
+	defer file.Close()
+	sync := make([]byte, 1)
+	if _, err := file.Read(sync); err != nil || sync[0] != 0x47 {
+		check.Reason = "missing TS sync byte"
+		return check
+	}
+
+	if expected, ok := readSegmentChecksums(dir)[segment.Name]; ok {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			check.Reason = fmt.Sprintf("unreadable: %v", err)
+			return check
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			check.Reason = fmt.Sprintf("unreadable: %v", err)
+			return check
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != expected {
+			check.Reason = "checksum mismatch"
+			return check
+		}
+	}
+
+	if median, ok := medianBitrate(dir, segments, index); ok && segment.Duration > 0 {
+		if rate := float64(info.Size()) / segment.Duration; rate < median*minBitrateRatio {
+			check.Reason = fmt.Sprintf("%.0f bytes/s is far below the typical %.0f bytes/s for its duration", rate, median)
+			return check
+		}
+	}
+
+	check.Healthy = true
+	return check
+}
+
+// medianBitrate 除第skip个以外各切片字节率（字节/秒）的中位数，可用的切片少于3个时不作判断
+func medianBitrate(dir string, segments []PlaylistSegment, skip int) (float64, bool) {
+	var rates []float64
+	for i, segment := range segments {
+		if i == skip || segment.Duration <= 0 {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, segment.Name))
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		rates = append(rates, float64(info.Size())/segment.Duration)
+	}
+	if len(rates) < 3 {
+		return 0, false
+	}
+	sort.Float64s(rates)
+	return rates[len(rates)/2], true
+}
+
+// RegenerateSegment 从源文件重新生成一个切片：用-ss/-t截取该切片的时间段，按strategy的编码参数
+// 重新编码（直接复制视频的策略改为重新编码，截取的起点不一定是关键帧），并用-output_ts_offset
+// 保持原有的时间戳。先写入临时文件，完成后原子替换原切片，有校验和记录时同时更新
+func RegenerateSegment(inputPath, dir string, segment PlaylistSegment, strategy Strategy) error {
+	args := []string{"-map", "0:v:0", "-map", "0:a:0?"}
+	args = append(args, reencodeStrategy(strategy).codecArgs("")...)
+	return regenerateSegment(inputPath, dir, segment, append(args, "-sn"))
+}
+
+// RepairStrategy 重新生成切片时使用的编码参数：优先使用生成任务输出的策略name（任务元数据
+// transcode_attempts中成功的一次），在转码链和内置预设中按名称查找；找不到时使用转码链中
+// 第一个重新编码视频的策略，转码链都直接复制视频时使用默认的重新编码参数
+func (m *Manager) RepairStrategy(name string) Strategy {
+	m.mutex.RLock()
+	chain := append([]Strategy(nil), m.strategies...)
+	m.mutex.RUnlock()
+	if len(chain) == 0 {
+		chain = DefaultStrategies()
+	}
+
+	if name != "" {
+		for _, strategy := range append(chain, BuiltinPresets()...) {
+			if strategy.Name == name {
+				return strategy
+			}
+		}
+	}
+	for _, strategy := range chain {
+		if strategy.VideoCodec != "" && strategy.VideoCodec != VideoCodecAuto && strategy.VideoCodec != "copy" {
+			return strategy
+		}
+	}
+	defaults := DefaultStrategies()
+	return defaults[len(defaults)-1]
+}
+
+// RegenerateAudioSegment 重新生成纯音频任务曲目中的一个切片，与切片时一样只保留第一路音频，
+// 按源文件的音频编码决定复制还是重新编码
+func RegenerateAudioSegment(inputPath, dir string, segment PlaylistSegment) error {
+	codec := ""
+	if info, err := ProbeMedia(inputPath); err == nil {
+		codec = info.AudioCodec
+	}
+	return regenerateSegment(inputPath, dir, segment, append([]string{"-map", "0:a:0", "-vn", "-sn"}, audioCodecArgs(codec)...))
+}
+
+// regenerateSegment 按streamArgs（流选择与编码参数）重新生成切片
+func regenerateSegment(inputPath, dir string, segment PlaylistSegment, streamArgs []string) error {
+	if segment.Duration <= 0 {
+		return fmt.Errorf("segment %s has no duration in the playlist", segment.Name)
+	}
+	target := filepath.Join(dir, segment.Name)
+	tmp := target + ".repair"
+	start := strconv.FormatFloat(segment.Start, 'f', 3, 64)
+	args := []string{
+		"-y",
+		"-ss", start,
+		"-i", inputPath,
+		"-t", strconv.FormatFloat(segment.Duration, 'f', 3, 64),
+	}
+	args = append(args, streamArgs...)
+	args = append(args,
+		"-output_ts_offset", start,
+		"-muxdelay", "0",
+		"-f", "mpegts",
+		tmp,
+	)
+
+	stderrTail := newTailBuffer(ffmpegTailBytes)
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = stderrTail
+	log.Printf("重新生成切片 %s: %v", target, args)
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return &FFmpegError{Err: err, Tail: stderrTail.String()}
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replace segment %s: %w", segment.Name, err)
+	}
+	if readSegmentChecksums(dir) != nil {
+		if err := writeSegmentChecksums(dir, []string{segment.Name}); err != nil {
+			log.Printf("更新切片校验和失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// readSegmentChecksums 读取目录中记录的切片校验和，没有记录时返回nil
+func readSegmentChecksums(dir string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(dir, SegmentChecksumsName))
+	if err != nil {
+		return nil
+	}
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		sum, name, ok := strings.Cut(strings.TrimSpace(line), "  ")
+		if ok {
+			checksums[name] = sum
+		}
+	}
+	return checksums
+}
+
+// writeSegmentChecksums 计算names中切片的SHA-256并写入校验和记录，保留其它切片的已有记录。
+// names为空时记录目录中的全部切片
+func writeSegmentChecksums(dir string, names []string) error {
+	if len(names) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".ts") {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	checksums := readSegmentChecksums(dir)
+	if checksums == nil {
+		checksums = make(map[string]string, len(names))
+	}
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	sorted := make([]string, 0, len(checksums))
+	for name := range checksums {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var b strings.Builder
+	for _, name := range sorted {
+		fmt.Fprintf(&b, "%s  %s\n", checksums[name], name)
+	}
+	tmp := filepath.Join(dir, SegmentChecksumsName+".tmp")
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, SegmentChecksumsName))
+}
+
+// SetSegmentChecksums 设置转码完成后是否记录各切片的SHA-256，供切片修复时校验
+func (m *Manager) SetSegmentChecksums(enabled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.segmentChecksums = enabled
+}
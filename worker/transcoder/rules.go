@@ -0,0 +1,95 @@
+package transcoder
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Rule 按文件扩展名和/或视频编码指定转码预设，在按探测结果自动判断之前生效。
+// Preset为转码链中的策略名或内置预设名；只按扩展名匹配的规则不需要ffprobe。
+type Rule struct {
+	Extensions []string `json:"extensions,omitempty"` // 如".mp4"，不区分大小写
+	Codecs     []string `json:"codecs,omitempty"`     // ffprobe报告的视频编码名，如"h264"
+	Preset     string   `json:"preset"`
+}
+
+// BuiltinPresets 规则可直接引用的内置预设。"copy"不探测编码，直接复制音视频流。
+func BuiltinPresets() []Strategy {
+	return append([]Strategy{{Name: "copy", VideoCodec: "copy", AudioCodec: "copy"}}, DefaultStrategies()...)
+}
+
+// selectStrategies 按规则决定本次使用的转码链。命中规则时从对应策略开始尝试，
+// 链中其后的策略仍作为回退；引用的是链外的内置预设时，整条链作为回退。
+// 只有扩展名已匹配且规则要求编码时才调用probe。
+func selectStrategies(inputPath string, rules []Rule, chain []Strategy, probe func(string) (string, error)) []Strategy {
+	if len(chain) == 0 {
+		chain = DefaultStrategies()
+	}
+	ext := strings.ToLower(filepath.Ext(inputPath))
+
+	codec, probed := "", false
+	for _, rule := range rules {
+		if len(rule.Extensions) > 0 && !matchesExtension(rule.Extensions, ext) {
+			continue
+		}
+		if len(rule.Codecs) > 0 {
+			if !probed {
+				probed = true
+				detected, err := probe(inputPath)
+				if err != nil {
+					log.Printf("规则匹配时无法检测视频编码: %v", err)
+				}
+				codec = detected
+			}
+			if codec == "" || !containsFold(rule.Codecs, codec) {
+				continue
+			}
+		}
+
+		if strategies := strategiesFrom(chain, rule.Preset); strategies != nil {
+			log.Printf("文件 %s 命中转码规则，使用预设 %s", filepath.Base(inputPath), rule.Preset)
+			return strategies
+		}
+		log.Printf("转码规则引用了未知预设 %s，已忽略", rule.Preset)
+	}
+	return chain
+}
+
+// strategiesFrom 返回从指定预设开始的转码链，预设不存在时返回nil
+func strategiesFrom(chain []Strategy, preset string) []Strategy {
+	for i, strategy := range chain {
+		if strategy.Name == preset {
+			return chain[i:]
+		}
+	}
+	for _, strategy := range BuiltinPresets() {
+		if strategy.Name == preset {
+			return append([]Strategy{strategy}, chain...)
+		}
+	}
+	return nil
+}
+
+// matchesExtension 比较扩展名，规则中的扩展名可省略前导点
+func matchesExtension(extensions []string, ext string) bool {
+	for _, e := range extensions {
+		e = strings.TrimSpace(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VideoCodecAuto 表示按源编码自动选择：H.264直接复制，其它编码转为H.264
+const VideoCodecAuto = "auto"
+
+// Strategy 一种HLS切片方式。VideoCodec/AudioCodec为ffmpeg编码器名称，
+// "copy"表示直接复制流，VideoCodec为"auto"时保持原有的自动判断行为。
+type Strategy struct {
+	Name       string `json:"name"`
+	VideoCodec string `json:"video_codec"`
+	AudioCodec string `json:"audio_codec"`
+	Preset     string `json:"preset,omitempty"`
+	CRF        int    `json:"crf,omitempty"`
+}
+
+// Attempt 记录转码链中一次尝试的结果
+type Attempt struct {
+	Strategy   string `json:"strategy"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// DefaultStrategies 默认转码链：先尝试直接封装，失败后重新编码音视频
+func DefaultStrategies() []Strategy {
+	return []Strategy{
+		{Name: "remux", VideoCodec: VideoCodecAuto, AudioCodec: "copy"},
+		{Name: "transcode", VideoCodec: "libx264", AudioCodec: "aac", Preset: "veryfast", CRF: 23},
+	}
+}
+
+// codecArgs 生成该策略对应的ffmpeg编码参数
+func (s Strategy) codecArgs(sourceCodec string) []string {
+	videoCodec := s.VideoCodec
+	if videoCodec == "" || videoCodec == VideoCodecAuto {
+		if sourceCodec == "h264" {
+			videoCodec = "copy"
+		} else {
+			videoCodec = "libx264"
+		}
+	}
+
+	audioCodec := s.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "copy"
+	}
+
+	if videoCodec == "copy" && audioCodec == "copy" {
+		return []string{"-c", "copy"}
+	}
+
+	args := []string{"-c:v", videoCodec}
+	if videoCodec != "copy" {
+		if s.Preset != "" {
+			args = append(args, "-preset", s.Preset)
+		}
+		if s.CRF > 0 {
+			args = append(args, "-crf", strconv.Itoa(s.CRF))
+		}
+	}
+	return append(args, "-c:a", audioCodec)
+}
+
+// convertWithFallback 依次尝试转码链中的策略，直到有一个成功。
+// 每次失败后清理残留的播放列表和切片，避免下一次尝试误用不完整的输出。
+func convertWithFallback(inputPath, outputDir string, config HLSConfig, strategies []Strategy) (string, []Attempt, error) {
+	if len(strategies) == 0 {
+		strategies = DefaultStrategies()
+	}
+
+	var attempts []Attempt
+	var lastErr error
+	for i := range strategies {
+		strategy := strategies[i]
+		config.Strategy = &strategy
+
+		start := time.Now()
+		m3u8Path, err := ConvertToHLS(inputPath, outputDir, config)
+		attempt := Attempt{
+			Strategy:   strategy.Name,
+			Success:    err == nil,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err == nil {
+			attempts = append(attempts, attempt)
+			return m3u8Path, attempts, nil
+		}
+
+		attempt.Error = err.Error()
+		attempts = append(attempts, attempt)
+		lastErr = err
+		log.Printf("转码策略 %s 失败: %v", strategy.Name, err)
+
+		if err := removeHLSOutput(outputDir); err != nil {
+			log.Printf("清理失败的切片输出失败: %v", err)
+		}
+	}
+
+	return "", attempts, fmt.Errorf("all %d transcode strategies failed: %w", len(strategies), lastErr)
+}
+
+// convertMultiQuality 输出多码率HLS，记录为一次名为multi的尝试
+func convertMultiQuality(inputPath, outputDir string, config HLSConfig) (string, []Attempt, error) {
+	start := time.Now()
+	m3u8Path, err := ConvertToHLS(inputPath, outputDir, config)
+	attempt := Attempt{
+		Strategy:   HLSQualityMulti,
+		Success:    err == nil,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		return "", []Attempt{attempt}, fmt.Errorf("multi-quality transcode failed: %w", err)
+	}
+	return m3u8Path, []Attempt{attempt}, nil
+}
+
+// removeHLSOutput 删除目录中的播放列表和切片，保留字幕等其它文件
+func removeHLSOutput(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if ext == ".m3u8" || ext == ".ts" {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package transcoder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"worker/models"
+)
+
+// SubtitleInfo 字幕文件及其语言、流序号与格式
+type SubtitleInfo = models.SubtitleInfo
+
+// undeterminedLanguage ffprobe没有给出语言时提取字幕文件名中使用的语言标记（ISO 639-2）
+const undeterminedLanguage = "und"
+
+// subtitleExtensions 常见字幕编码对应的文件扩展名，其它编码直接用编码名
+var subtitleExtensions = map[string]string{
+	"subrip": "srt",
+	"webvtt": "vtt",
+}
+
+// subtitleFileName 提取的字幕文件名subtitle_<语言>_<流序号>.<格式>，如subtitle_jpn_2.srt；语言未知时为und
+func subtitleFileName(stream subtitleStream) string {
+	lang := stream.lang
+	if lang == "" {
+		lang = undeterminedLanguage
+	}
+	ext := stream.format
+	if mapped, ok := subtitleExtensions[ext]; ok {
+		ext = mapped
+	}
+	return fmt.Sprintf("subtitle_%s_%s.%s", lang, stream.index, ext)
+}
+
+// SubtitleInfoFromPath 由文件名得到字幕信息：subtitle_<语言>_<流序号>为从视频中提取的字幕，
+// 旧版本提取的subtitle_<流序号>语言未知；其它文件取文件名最后一段作为语言标记，如movie.chi.srt得到chi
+func SubtitleInfoFromPath(path string) SubtitleInfo {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(filepath.Base(path), ext)
+	info := SubtitleInfo{Path: path, Format: strings.TrimPrefix(ext, ".")}
+
+	if rest, ok := strings.CutPrefix(base, "subtitle_"); ok {
+		if isDigits(rest) {
+			info.Index = rest
+			return info
+		}
+		if sep := strings.LastIndex(rest, "_"); sep > 0 && isDigits(rest[sep+1:]) {
+			info.Language = rest[:sep]
+			info.Index = rest[sep+1:]
+			return info
+		}
+	}
+	info.Language = languageFromFileName(base)
+	return info
+}
+
+// languageFromFileName 取文件名最后一段作为语言标记，如"movie.chi"得到"chi"、"movie.zh-CN"得到"zh-CN"
+func languageFromFileName(base string) string {
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return ""
+	}
+	tag := base[dot+1:]
+	if !isLanguageTag(tag) {
+		return ""
+	}
+	return tag
+}
+
+// isLanguageTag 判断是否像语言标记：2到8个字母，可含连字符
+func isLanguageTag(tag string) bool {
+	if len(tag) < 2 || len(tag) > 8 {
+		return false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
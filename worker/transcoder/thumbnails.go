@@ -0,0 +1,184 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ThumbnailsVTTName 缩略图索引文件名，与播放列表放在同一输出目录
+const ThumbnailsVTTName = "thumbnails.vtt"
+
+// thumbnailSpritePattern 雪碧图文件名，ffmpeg按顺序从1开始编号
+const thumbnailSpritePattern = "thumbnails_%03d.jpg"
+
+// ThumbnailOptions 拖动进度条时预览用的缩略图。每隔Interval截取一帧，
+// 按Columns×Rows拼成雪碧图，并生成WebVTT索引把时间段映射到图中的区域。
+type ThumbnailOptions struct {
+	Enabled  bool
+	Interval time.Duration // 相邻两张缩略图的时间间隔
+	Columns  int           // 每张雪碧图的列数
+	Rows     int           // 每张雪碧图的行数
+	Width    int           // 单张缩略图宽度，高度按视频比例计算
+}
+
+// thumbnailLayout 确定了尺寸的缩略图网格
+type thumbnailLayout struct {
+	interval time.Duration
+	columns  int
+	rows     int
+	width    int
+	height   int
+}
+
+// SetThumbnails 设置转码完成后是否生成缩略图雪碧图
+func (m *Manager) SetThumbnails(options ThumbnailOptions) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.thumbnails = options
+}
+
+// generateThumbnails 为输入视频生成雪碧图和WebVTT索引，返回索引文件路径。
+// run执行ffmpeg，测试中可替换。
+func generateThumbnails(inputPath, outputDir string, options ThumbnailOptions, info *MediaInfo, run func(args []string) error) (string, error) {
+	if options.Interval <= 0 || options.Columns <= 0 || options.Rows <= 0 || options.Width <= 0 {
+		return "", fmt.Errorf("invalid thumbnail options: %+v", options)
+	}
+	if info == nil || info.DurationSeconds <= 0 {
+		return "", errors.New("unknown video duration")
+	}
+
+	layout := thumbnailLayout{
+		interval: options.Interval,
+		columns:  options.Columns,
+		rows:     options.Rows,
+		width:    options.Width,
+		height:   thumbnailHeight(options.Width, info.Width, info.Height),
+	}
+
+	// 重新转码时清掉上次的雪碧图，避免残留多余的图片
+	if stale, err := filepath.Glob(filepath.Join(outputDir, "thumbnails_*.jpg")); err == nil {
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+
+	if err := run(thumbnailArgs(inputPath, outputDir, layout)); err != nil {
+		return "", err
+	}
+
+	duration := time.Duration(info.DurationSeconds * float64(time.Second))
+	sheets := (thumbnailCount(duration, layout.interval) + layout.columns*layout.rows - 1) / (layout.columns * layout.rows)
+	for sheet := 1; sheet <= sheets; sheet++ {
+		name := fmt.Sprintf(thumbnailSpritePattern, sheet)
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			return "", fmt.Errorf("sprite %s was not generated: %w", name, err)
+		}
+	}
+
+	path := filepath.Join(outputDir, ThumbnailsVTTName)
+	if err := os.WriteFile(path, []byte(thumbnailVTT(duration, layout)), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// thumbnailHeight 按视频宽高比计算缩略图高度，取偶数；分辨率未知时按16:9处理
+func thumbnailHeight(width, videoWidth, videoHeight int) int {
+	if videoWidth <= 0 || videoHeight <= 0 {
+		videoWidth, videoHeight = 16, 9
+	}
+	height := int(math.Round(float64(width)*float64(videoHeight)/float64(videoWidth)/2)) * 2
+	if height < 2 {
+		height = 2
+	}
+	return height
+}
+
+// thumbnailCount 覆盖整个时长所需的缩略图数量
+func thumbnailCount(duration, interval time.Duration) int {
+	return int((duration + interval - 1) / interval)
+}
+
+// thumbnailArgs 构建截帧并拼接雪碧图的ffmpeg参数
+func thumbnailArgs(inputPath, outputDir string, layout thumbnailLayout) []string {
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d",
+		layout.interval.Seconds(), layout.width, layout.height, layout.columns, layout.rows)
+	return []string{
+		"-y",
+		"-i", inputPath,
+		"-an", "-sn",
+		"-vf", filter,
+		"-q:v", "5",
+		filepath.Join(outputDir, thumbnailSpritePattern),
+	}
+}
+
+// thumbnailVTT 生成WebVTT索引：第i张缩略图覆盖[i*interval, (i+1)*interval)，
+// 最后一段截止到视频结尾。每条记录指向雪碧图中的区域（媒体片段#xywh）。
+func thumbnailVTT(duration time.Duration, layout thumbnailLayout) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+
+	perSheet := layout.columns * layout.rows
+	for i := 0; i < thumbnailCount(duration, layout.interval); i++ {
+		start := time.Duration(i) * layout.interval
+		end := start + layout.interval
+		if end > duration {
+			end = duration
+		}
+		cell := i % perSheet
+		fmt.Fprintf(&b, "\n%s --> %s\n", vttTimestamp(start), vttTimestamp(end))
+		fmt.Fprintf(&b, thumbnailSpritePattern+"#xywh=%d,%d,%d,%d\n",
+			i/perSheet+1,
+			(cell%layout.columns)*layout.width,
+			(cell/layout.columns)*layout.height,
+			layout.width, layout.height)
+	}
+	return b.String()
+}
+
+// vttTimestamp 格式化为WebVTT时间戳 HH:MM:SS.mmm
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// runFFmpeg 执行ffmpeg，失败时附带stderr末尾输出
+func runFFmpeg(args []string) error {
+	stderrTail := newTailBuffer(ffmpegTailBytes)
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = stderrTail
+	if err := cmd.Run(); err != nil {
+		return &FFmpegError{Err: err, Tail: stderrTail.String()}
+	}
+	return nil
+}
+
+// addThumbnails 转码成功后按配置生成缩略图，失败只记录日志，不影响播放
+func (m *Manager) addThumbnails(task *TranscodeTask) {
+	m.mutex.RLock()
+	options := m.thumbnails
+	m.mutex.RUnlock()
+	if !options.Enabled {
+		return
+	}
+
+	info, err := ProbeMedia(task.InputPath)
+	if err != nil {
+		log.Printf("Skipping thumbnails for task %s: %v", task.ID, err)
+		return
+	}
+	path, err := generateThumbnails(task.InputPath, task.OutputPath, options, info, runFFmpeg)
+	if err != nil {
+		log.Printf("Failed to generate thumbnails for task %s: %v", task.ID, err)
+		return
+	}
+	task.Thumbnails = path
+}
@@ -0,0 +1,100 @@
+package webrtc
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"worker/tasklog"
+)
+
+// SegmentAccess 任务切片访问的汇总统计，只保留计数不保留逐条记录
+type SegmentAccess struct {
+	TaskID       string    `json:"task_id"`
+	Sessions     int       `json:"sessions"`     // 请求过切片的不同会话数
+	Segments     int64     `json:"segments"`     // 已发送的切片数
+	Bytes        int64     `json:"bytes"`        // 已发送的切片字节数
+	LastSegment  string    `json:"last_segment"` // 最近一次发送的切片
+	LastAccessAt time.Time `json:"last_access_at"`
+}
+
+// taskAccess 单个任务的访问统计，由Manager.accessMu保护。sessions只记录仍在连接的会话，
+// 会话关闭时移除，Sessions是累计的不同会话数
+type taskAccess struct {
+	SegmentAccess
+	sessions map[string]struct{}
+}
+
+// isSegmentFile 判断是否为媒体切片；播放列表、字幕等附属文件不计入访问统计
+func isSegmentFile(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".ts", ".m4s", ".aac":
+		return true
+	}
+	return false
+}
+
+// recordSegmentAccess 记录一次成功发送的切片请求。开启详细日志时同时写入任务日志
+func (m *Manager) recordSegmentAccess(taskID, sessionID, fileName string, n int64) {
+	if !isSegmentFile(fileName) {
+		return
+	}
+
+	// 持有m.mutex直到记下会话，避免与removeSession交错：已关闭的会话不再记入sessions
+	m.mutex.RLock()
+	_, live := m.sessions[sessionID]
+	m.accessMu.Lock()
+	access, exists := m.access[taskID]
+	if !exists {
+		access = &taskAccess{
+			SegmentAccess: SegmentAccess{TaskID: taskID},
+			sessions:      make(map[string]struct{}),
+		}
+		m.access[taskID] = access
+	}
+	if _, seen := access.sessions[sessionID]; !seen && live {
+		access.sessions[sessionID] = struct{}{}
+		access.Sessions++
+	}
+	m.mutex.RUnlock()
+	access.Segments++
+	access.Bytes += n
+	access.LastSegment = fileName
+	access.LastAccessAt = m.now()
+	detailed := m.accessLog
+	m.accessMu.Unlock()
+
+	if detailed {
+		m.taskLog.Info(taskID, tasklog.SourceWebRTC, "served segment %s to session %s (%d bytes)", fileName, sessionID, n)
+	}
+}
+
+// forgetSessionAccess 会话关闭时从各任务的会话集合中移除，累计的会话数不变。
+// 调用方持有m.mutex
+func (m *Manager) forgetSessionAccess(sessionID string) {
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+
+	for _, access := range m.access {
+		delete(access.sessions, sessionID)
+	}
+}
+
+// SegmentAccess 返回任务本次运行期间的切片访问统计
+func (m *Manager) SegmentAccess(taskID string) (SegmentAccess, bool) {
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+
+	access, exists := m.access[taskID]
+	if !exists {
+		return SegmentAccess{TaskID: taskID}, false
+	}
+	return access.SegmentAccess, true
+}
+
+// SetSegmentAccessLog 设置是否把每次切片请求写入任务日志
+func (m *Manager) SetSegmentAccessLog(enabled bool) {
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+	m.accessLog = enabled
+}
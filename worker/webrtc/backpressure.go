@@ -0,0 +1,102 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// DefaultBufferedHighWater 数据通道待发送字节数的默认高水位，超过后暂停发送
+	DefaultBufferedHighWater = 1024 * 1024
+	// bufferedPollInterval 等待缓冲回落时的兜底检查间隔，防止错过OnBufferedAmountLow
+	bufferedPollInterval = 100 * time.Millisecond
+)
+
+// SetBufferedHighWater 设置数据通道的高水位（字节），待发送的数据超过后暂停发送，
+// 回落到一半以下时继续。<=0时使用DefaultBufferedHighWater
+func (m *Manager) SetBufferedHighWater(bytes int) {
+	if bytes <= 0 {
+		bytes = DefaultBufferedHighWater
+	}
+	m.bufferMu.Lock()
+	defer m.bufferMu.Unlock()
+	m.highWater = uint64(bytes)
+}
+
+// watchBufferedAmount 在数据通道上设置低水位回调，待发送的数据回落到高水位一半时唤醒发送
+func (m *Manager) watchBufferedAmount(sessionID string, dataChannel *webrtc.DataChannel) {
+	m.bufferMu.Lock()
+	lowWater := m.highWater / 2
+	m.bufferMu.Unlock()
+
+	dataChannel.SetBufferedAmountLowThreshold(lowWater)
+	dataChannel.OnBufferedAmountLow(func() { m.bufferedLow(sessionID) })
+}
+
+// bufferedLow 唤醒等待缓冲回落的发送。会话已移除时drainedChan返回nil，通知直接丢弃
+func (m *Manager) bufferedLow(sessionID string) {
+	select {
+	case m.drainedChan(sessionID) <- struct{}{}:
+	default:
+	}
+}
+
+// drainedChan 返回会话的缓冲回落通知通道，容量为1，多次通知合并为一次。会话已移除时返回nil，
+// 不再为它创建通道：数据通道关闭后迟到的OnBufferedAmountLow回调不会留下无人清理的条目。
+// 持有m.mutex检查会话，与removeSession中的forgetBuffered互斥
+func (m *Manager) drainedChan(sessionID string) chan struct{} {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if _, exists := m.sessions[sessionID]; !exists {
+		return nil
+	}
+	m.bufferMu.Lock()
+	defer m.bufferMu.Unlock()
+
+	drained, ok := m.drained[sessionID]
+	if !ok {
+		drained = make(chan struct{}, 1)
+		m.drained[sessionID] = drained
+	}
+	return drained
+}
+
+// waitBuffered 发送下一个分块前，待发送的数据超过高水位时等待回落；会话已移除时直接返回，
+// 之后的发送会因会话不存在而失败
+func (m *Manager) waitBuffered(sessionID string) {
+	for {
+		buffered, ok := m.bufferedAmount(sessionID)
+		m.bufferMu.Lock()
+		highWater := m.highWater
+		m.bufferMu.Unlock()
+		if !ok || buffered <= highWater {
+			return
+		}
+		select {
+		case <-m.drainedChan(sessionID):
+		case <-time.After(bufferedPollInterval):
+		}
+	}
+}
+
+// sessionBufferedAmount 返回会话数据通道中待发送的字节数
+func (m *Manager) sessionBufferedAmount(sessionID string) (uint64, bool) {
+	m.mutex.RLock()
+	session, exists := m.sessions[sessionID]
+	m.mutex.RUnlock()
+	if !exists {
+		return 0, false
+	}
+	if session.DataChan == nil {
+		return 0, true
+	}
+	return session.DataChan.BufferedAmount(), true
+}
+
+// forgetBuffered 会话结束后释放其通知通道
+func (m *Manager) forgetBuffered(sessionID string) {
+	m.bufferMu.Lock()
+	defer m.bufferMu.Unlock()
+	delete(m.drained, sessionID)
+}
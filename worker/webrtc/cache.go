@@ -0,0 +1,93 @@
+package webrtc
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultSegmentCacheBytes 切片缓存的默认容量
+const defaultSegmentCacheBytes = 64 * 1024 * 1024
+
+// segmentCache 按字节数限制容量的LRU切片缓存，键为切片文件路径
+type segmentCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List // 最近使用的在前
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	path string
+	data []byte
+}
+
+func newSegmentCache(capacity int64) *segmentCache {
+	return &segmentCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get 返回缓存的切片内容并将其标记为最近使用
+func (c *segmentCache) get(path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).data, true
+}
+
+// contains 判断切片是否已缓存，不影响淘汰顺序
+func (c *segmentCache) contains(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[path]
+	return ok
+}
+
+// put 缓存切片，超出容量时淘汰最久未使用的切片。超过总容量的切片不缓存。
+func (c *segmentCache) put(path string, data []byte) {
+	size := int64(len(data))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[path]; ok {
+		entry := element.Value.(*cacheEntry)
+		c.size += size - int64(len(entry.data))
+		entry.data = data
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[path] = c.order.PushFront(&cacheEntry{path: path, data: data})
+		c.size += size
+	}
+
+	for c.size > c.capacity {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.path)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// remove 移除缓存的切片
+func (c *segmentCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[path]; ok {
+		c.order.Remove(element)
+		delete(c.entries, path)
+		c.size -= int64(len(element.Value.(*cacheEntry).data))
+	}
+}
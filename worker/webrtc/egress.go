@@ -0,0 +1,67 @@
+package webrtc
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// minEgressBurst 限速器的最小突发量，需容纳一个编码后的分块消息（16KB数据的base64约22KB）
+const minEgressBurst = 64 * 1024
+
+// SetEgressLimits 设置数据通道发送的总限速与单会话限速（字节/秒），0表示不限速。
+// 可在运行中随时调整，对进行中的传输立即生效。
+func (m *Manager) SetEgressLimits(totalBytesPerSec, sessionBytesPerSec int) {
+	m.egressMu.Lock()
+	defer m.egressMu.Unlock()
+
+	limit, burst := egressLimit(totalBytesPerSec)
+	m.egress.SetLimit(limit)
+	m.egress.SetBurst(burst)
+
+	m.sessionLimit, m.sessionBurst = egressLimit(sessionBytesPerSec)
+	for _, limiter := range m.sessionEgress {
+		limiter.SetLimit(m.sessionLimit)
+		limiter.SetBurst(m.sessionBurst)
+	}
+}
+
+// egressLimit 将字节/秒换算为限速器参数，突发量为一秒的额度且不小于minEgressBurst
+func egressLimit(bytesPerSec int) (rate.Limit, int) {
+	if bytesPerSec <= 0 {
+		return rate.Inf, minEgressBurst
+	}
+	burst := bytesPerSec
+	if burst < minEgressBurst {
+		burst = minEgressBurst
+	}
+	return rate.Limit(bytesPerSec), burst
+}
+
+// waitEgress 发送n字节前等待会话与全局额度
+func (m *Manager) waitEgress(sessionID string, n int) {
+	m.egressMu.Lock()
+	session, ok := m.sessionEgress[sessionID]
+	if !ok {
+		session = rate.NewLimiter(m.sessionLimit, m.sessionBurst)
+		m.sessionEgress[sessionID] = session
+	}
+	global := m.egress
+	m.egressMu.Unlock()
+
+	// 额度调整后n可能超过突发量，此时按突发量等待，避免WaitN直接报错
+	for _, limiter := range []*rate.Limiter{session, global} {
+		wait := n
+		if burst := limiter.Burst(); wait > burst {
+			wait = burst
+		}
+		limiter.WaitN(context.Background(), wait)
+	}
+}
+
+// removeSessionEgress 会话结束后释放其限速器
+func (m *Manager) removeSessionEgress(sessionID string) {
+	m.egressMu.Lock()
+	defer m.egressMu.Unlock()
+	delete(m.sessionEgress, sessionID)
+}
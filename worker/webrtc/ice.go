@@ -0,0 +1,125 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultICEGatherTimeout 应答Offer后等待本地ICE候选者的默认时长
+const DefaultICEGatherTimeout = 10 * time.Second
+
+// reasonNoICECandidates 收集完成却没有任何本地候选者时的失败原因，通常是网络或STUN/TURN配置有误
+const reasonNoICECandidates = "no ICE candidates gathered"
+
+// ICEResend 重发本地ICE候选者的结果
+type ICEResend struct {
+	Candidates     int    // 重新发送的候选者数量
+	GatheringState string // 本地候选者收集状态：new、gathering或complete
+}
+
+// onLocalCandidate 记录会话新收集到的本地候选者并发送给客户端
+func (m *Manager) onLocalCandidate(sessionID string, candidate *webrtc.ICECandidate) {
+	m.candidatesMu.Lock()
+	m.candidates[sessionID] = append(m.candidates[sessionID], candidate)
+	m.candidatesMu.Unlock()
+
+	log.Printf("New ICE candidate for session %s: %s", sessionID, candidate.String())
+	// 通过回调发送ICE候选者到客户端
+	if m.iceCandidateHandler != nil {
+		m.iceCandidateHandler(sessionID, candidate)
+	}
+}
+
+// ResendICECandidates 按收集顺序重新发送会话已收集的全部本地候选者。
+// 信令中丢失的候选者会让协商停在negotiating，重发可在不重新Offer的情况下恢复；
+// pion只在ICE重启时重新收集，因此收集尚未完成时，之后收集到的候选者仍会照常发送。
+func (m *Manager) ResendICECandidates(sessionID string) (ICEResend, error) {
+	m.mutex.RLock()
+	session, exists := m.sessions[sessionID]
+	m.mutex.RUnlock()
+	if !exists {
+		return ICEResend{}, fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	m.candidatesMu.Lock()
+	candidates := append([]*webrtc.ICECandidate(nil), m.candidates[sessionID]...)
+	m.candidatesMu.Unlock()
+
+	result := ICEResend{Candidates: len(candidates), GatheringState: webrtc.ICEGatheringStateNew.String()}
+	if session.PeerConn != nil {
+		result.GatheringState = session.PeerConn.ICEGatheringState().String()
+	}
+
+	if m.iceCandidateHandler != nil {
+		for _, candidate := range candidates {
+			m.iceCandidateHandler(sessionID, candidate)
+		}
+	}
+	log.Printf("Re-sent %d ICE candidates for session %s (gathering %s)", result.Candidates, sessionID, result.GatheringState)
+	return result, nil
+}
+
+// forgetCandidates 会话结束后丢弃记录的候选者
+func (m *Manager) forgetCandidates(sessionID string) {
+	m.candidatesMu.Lock()
+	delete(m.candidates, sessionID)
+	m.candidatesMu.Unlock()
+}
+
+// SetICEGatherTimeout 设置应答Offer后等待本地候选者的时长，0表示不检查
+func (m *Manager) SetICEGatherTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.iceGatherTimeout = timeout
+}
+
+// SetOfferFailedHandler 设置Offer无法建立连接时的回调，reason说明原因
+func (m *Manager) SetOfferFailedHandler(handler func(sessionID, reason string)) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.offerFailedHandler = handler
+}
+
+// watchICEGathering 等待会话的本地候选者收集完成，最多等iceGatherTimeout。
+// 收集完成或超时时一个候选者都没有，连接不可能建立：关闭会话并回调offerFailedHandler，
+// 让客户端立即得到原因而不是等到自己超时。会话已被关闭或重新协商时不处理
+func (m *Manager) watchICEGathering(session *Session, gathered <-chan struct{}) {
+	m.configMu.RLock()
+	timeout := m.iceGatherTimeout
+	handler := m.offerFailedHandler
+	m.configMu.RUnlock()
+	if timeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	reason := reasonNoICECandidates
+	select {
+	case <-gathered:
+	case <-timer.C:
+		reason = fmt.Sprintf("%s within %s", reasonNoICECandidates, timeout)
+	}
+
+	m.candidatesMu.Lock()
+	count := len(m.candidates[session.ID])
+	m.candidatesMu.Unlock()
+	m.mutex.RLock()
+	current := m.sessions[session.ID]
+	m.mutex.RUnlock()
+	if count > 0 || current != session {
+		return
+	}
+
+	log.Printf("WebRTC offer for session %s failed: %s", session.ID, reason)
+	m.removeSession(session.ID)
+	if handler != nil {
+		handler(session.ID, reason)
+	}
+}
@@ -1,17 +1,23 @@
 package webrtc
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"worker/tasklog"
+	"worker/transcoder"
 
 	"github.com/pion/webrtc/v3"
+	"golang.org/x/time/rate"
 )
 
 // Service 抽象WebRTC管理器行为，以便依赖注入。
@@ -19,14 +25,25 @@ type Service interface {
 	Start() error
 	Stop()
 	HandleOffer(sessionID, sdp string) (string, error)
+	HandleProbe(sessionID, sdp string) (string, error)
 	AddICECandidate(sessionID, candidateStr string) error
+	ResendICECandidates(sessionID string) (ICEResend, error)
+	CloseSession(sessionID string) bool
 	GetSession(sessionID string) (*Session, bool)
 	GetAllSessions() []*Session
 	SetICECandidateHandler(handler func(sessionID string, candidate *webrtc.ICECandidate))
 	SetConnectionStateHandler(handler func(sessionID string, state webrtc.PeerConnectionState))
 	UpdateConfiguration(config webrtc.Configuration)
+	SetServedBytesHandler(handler func(taskID string, n int64))
 	SendData(sessionID string, data []byte) error
 	BroadcastData(data []byte)
+	SetSegmentRepairHandler(handler func(taskID, name string) (string, error))
+	SetOfferFailedHandler(handler func(sessionID, reason string))
+	SetProbeResultHandler(handler func(ProbeResult))
+	ForgetFile(taskID, fileName string)
+	SessionStats(sessionID string) (SessionStats, bool)
+	AggregateStats() AggregateStats
+	SegmentAccess(taskID string) (SegmentAccess, bool)
 }
 
 // Session WebRTC会话
@@ -36,6 +53,7 @@ type Session struct {
 	DataChan  *webrtc.DataChannel        `json:"-"`
 	State     webrtc.PeerConnectionState `json:"state"`
 	CreatedAt int64                      `json:"created_at"`
+	Stats     SessionStats               `json:"stats"` // 每5秒采集一次，由Manager.statsMu保护
 }
 
 // Manager WebRTC管理器
@@ -46,6 +64,55 @@ type Manager struct {
 	configMu               sync.RWMutex
 	iceCandidateHandler    func(sessionID string, candidate *webrtc.ICECandidate) // ICE候选者处理回调
 	connectionStateHandler func(sessionID string, state webrtc.PeerConnectionState)
+	taskLog                *tasklog.Logger
+	sendData               func(sessionID string, data []byte) error // 数据通道发送，测试时可替换
+	bufferedAmount         func(sessionID string) (uint64, bool)     // 数据通道待发送的字节数，测试时可替换
+	mediaRoot              string                                    // 转码输出根目录，其下每个任务一个目录
+	textCharset            string                                    // 文本文件没有BOM且不是UTF-8时假定的编码
+	servePathPrefix        string                                    // 文件请求路径中<taskID>之前的前缀
+
+	candidatesMu sync.Mutex
+	candidates   map[string][]*webrtc.ICECandidate // 各会话已收集的本地候选者，用于重发
+
+	// 应答后iceGatherTimeout内没有收集到本地候选者时回调offerFailedHandler，由configMu保护
+	iceGatherTimeout   time.Duration
+	offerFailedHandler func(sessionID, reason string)
+
+	trafficMu          sync.Mutex
+	servedBytesHandler func(taskID string, n int64)
+
+	accessMu  sync.Mutex
+	access    map[string]*taskAccess // 各任务的切片访问统计
+	accessLog bool                   // 为true时每次切片请求都写入任务日志
+
+	cache   *segmentCache          // 最近发送与预取的切片
+	hintsMu sync.Mutex             // 保护hints
+	hints   map[string]sessionHint // 各会话最近一次播放提示
+	now     func() time.Time
+
+	pausedMu sync.Mutex
+	paused   map[string]chan struct{} // 已暂停的会话，恢复时关闭通道
+
+	egressMu      sync.Mutex
+	egress        *rate.Limiter            // 所有会话共享的发送限速
+	sessionEgress map[string]*rate.Limiter // 各会话的发送限速
+	sessionLimit  rate.Limit
+	sessionBurst  int
+
+	repairMu      sync.RWMutex
+	repairHandler func(taskID, name string) (string, error) // 处理播放器报告的损坏切片
+
+	statsMu sync.RWMutex // 保护各会话的Stats
+
+	bufferMu  sync.Mutex
+	highWater uint64                   // 数据通道待发送字节数的高水位
+	drained   map[string]chan struct{} // 各会话的缓冲回落通知
+
+	probeMu      sync.Mutex
+	probes       map[string]*probeState // 进行中的测速会话
+	maxProbes    int
+	probeEgress  *rate.Limiter // 所有测速会话共享的发送限速
+	probeHandler func(ProbeResult)
 }
 
 // New 创建新的WebRTC管理器
@@ -58,13 +125,54 @@ func New() *Manager {
 		},
 	}
 
-	return &Manager{
+	m := &Manager{
 		sessions:            make(map[string]*Session),
 		config:              config,
 		iceCandidateHandler: nil,
+		mediaRoot:           defaultMediaRoot,
+		servePathPrefix:     DefaultServePathPrefix,
+		candidates:          make(map[string][]*webrtc.ICECandidate),
+		access:              make(map[string]*taskAccess),
+		cache:               newSegmentCache(defaultSegmentCacheBytes),
+		hints:               make(map[string]sessionHint),
+		now:                 time.Now,
+		paused:              make(map[string]chan struct{}),
+		egress:              rate.NewLimiter(rate.Inf, minEgressBurst),
+		sessionEgress:       make(map[string]*rate.Limiter),
+		sessionLimit:        rate.Inf,
+		sessionBurst:        minEgressBurst,
+		iceGatherTimeout:    DefaultICEGatherTimeout,
+		probes:              make(map[string]*probeState),
+		maxProbes:           DefaultMaxProbes,
+		probeEgress:         probeLimiter(DefaultProbeBandwidth),
+		highWater:           DefaultBufferedHighWater,
+		drained:             make(map[string]chan struct{}),
+	}
+	m.sendData = m.SendData
+	m.bufferedAmount = m.sessionBufferedAmount
+	return m
+}
+
+// defaultMediaRoot 默认的转码输出根目录，与配置中storage.m3u8_path的默认值一致
+const defaultMediaRoot = "data/m3u8"
+
+// SetMediaRoot 设置转码输出根目录（storage.m3u8_path）
+func (m *Manager) SetMediaRoot(root string) {
+	if root != "" {
+		m.mediaRoot = root
 	}
 }
 
+// SetServePathPrefix 设置文件请求路径中<taskID>之前的前缀（network.serve_path_prefix），为空时为/
+func (m *Manager) SetServePathPrefix(prefix string) {
+	m.servePathPrefix = NormalizeServePathPrefix(prefix)
+}
+
+// SetTextCharset 设置文本文件没有BOM且不是UTF-8时假定的编码，为空时使用transcoder.DefaultTextCharset
+func (m *Manager) SetTextCharset(charset string) {
+	m.textCharset = charset
+}
+
 // Start 启动WebRTC管理器
 func (m *Manager) Start() error {
 	log.Printf("WebRTC manager started")
@@ -84,6 +192,9 @@ func (m *Manager) Stop() {
 	}
 
 	m.sessions = make(map[string]*Session)
+	m.candidatesMu.Lock()
+	m.candidates = make(map[string][]*webrtc.ICECandidate)
+	m.candidatesMu.Unlock()
 	log.Printf("WebRTC manager stopped")
 }
 
@@ -108,6 +219,8 @@ func (m *Manager) HandleOffer(sessionID, sdp string) (string, error) {
 	}
 
 	m.sessions[sessionID] = session
+	m.forgetCandidates(sessionID) // 同一会话重新协商时丢弃上一次的候选者
+	go m.monitorStats(session)
 
 	// 设置连接状态变化回调
 	peerConn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
@@ -126,11 +239,7 @@ func (m *Manager) HandleOffer(sessionID, sdp string) (string, error) {
 	// 设置ICE候选者回调
 	peerConn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate != nil {
-			log.Printf("New ICE candidate for session %s: %s", sessionID, candidate.String())
-			// 通过回调发送ICE候选者到客户端
-			if m.iceCandidateHandler != nil {
-				m.iceCandidateHandler(sessionID, candidate)
-			}
+			m.onLocalCandidate(sessionID, candidate)
 		}
 	})
 
@@ -139,6 +248,7 @@ func (m *Manager) HandleOffer(sessionID, sdp string) (string, error) {
 		if dataChannel.Label() == "filePathChannel" {
 			log.Printf("Received data channel from client for session %s: %s", sessionID, dataChannel.Label())
 			session.DataChan = dataChannel
+			m.watchBufferedAmount(sessionID, dataChannel)
 
 			// 设置数据通道回调
 			dataChannel.OnOpen(func() {
@@ -147,8 +257,7 @@ func (m *Manager) HandleOffer(sessionID, sdp string) (string, error) {
 
 			dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
 				log.Printf("Received message on data channel for session %s: %s", sessionID, string(msg.Data))
-				// 处理文件请求消息
-				go m.handleFileRequest(sessionID, msg.Data)
+				m.onDataChannelMessage(sessionID, msg.Data)
 			})
 
 			dataChannel.OnClose(func() {
@@ -177,12 +286,14 @@ func (m *Manager) HandleOffer(sessionID, sdp string) (string, error) {
 		return "", fmt.Errorf("failed to create answer: %v", err)
 	}
 
-	// 设置本地描述
+	// 设置本地描述，开始收集本地候选者
+	gathered := webrtc.GatheringCompletePromise(peerConn)
 	if err := peerConn.SetLocalDescription(answer); err != nil {
 		peerConn.Close()
 		delete(m.sessions, sessionID)
 		return "", fmt.Errorf("failed to set local description: %v", err)
 	}
+	go m.watchICEGathering(session, gathered)
 
 	log.Printf("Created WebRTC answer for session: %s", sessionID)
 	return answer.SDP, nil
@@ -256,6 +367,18 @@ func (m *Manager) GetAllSessions() []*Session {
 	return sessions
 }
 
+// CloseSession 关闭并移除会话，返回会话是否存在。网关在客户端断开且未重连时调用
+func (m *Manager) CloseSession(sessionID string) bool {
+	m.mutex.RLock()
+	_, exists := m.sessions[sessionID]
+	m.mutex.RUnlock()
+	if !exists {
+		return false
+	}
+	m.removeSession(sessionID)
+	return true
+}
+
 // removeSession 移除会话（内部方法）
 func (m *Manager) removeSession(sessionID string) {
 	m.mutex.Lock()
@@ -268,6 +391,18 @@ func (m *Manager) removeSession(sessionID string) {
 		delete(m.sessions, sessionID)
 		log.Printf("Removed WebRTC session: %s", sessionID)
 	}
+	m.forgetSessionAccess(sessionID)
+
+	m.hintsMu.Lock()
+	delete(m.hints, sessionID)
+	m.hintsMu.Unlock()
+	m.forgetCandidates(sessionID)
+
+	// 释放暂停中挂起的传输，之后的发送会因会话不存在而失败
+	m.resumeSession(sessionID)
+	m.removeSessionEgress(sessionID)
+	m.forgetProbe(sessionID)
+	m.forgetBuffered(sessionID)
 }
 
 // SendData 通过数据通道发送数据
@@ -301,6 +436,11 @@ func (m *Manager) SetConnectionStateHandler(handler func(sessionID string, state
 	m.connectionStateHandler = handler
 }
 
+// SetTaskLogger 设置按任务划分的日志记录器
+func (m *Manager) SetTaskLogger(logger *tasklog.Logger) {
+	m.taskLog = logger
+}
+
 // BroadcastData 向所有会话广播数据
 func (m *Manager) BroadcastData(data []byte) {
 	m.mutex.RLock()
@@ -326,6 +466,54 @@ func (m *Manager) UpdateConfiguration(config webrtc.Configuration) {
 }
 
 // 获取当前配置（内部使用）
+// GatherCandidates 使用当前ICE配置创建临时PeerConnection并收集本地候选者类型，
+// 用于检查STUN/TURN是否可达（出现srflx/relay候选者即表示可达）
+func (m *Manager) GatherCandidates(timeout time.Duration) ([]string, error) {
+	peerConn, err := webrtc.NewPeerConnection(m.getConfiguration())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %v", err)
+	}
+	defer peerConn.Close()
+
+	if _, err := peerConn.CreateDataChannel("probe", nil); err != nil {
+		return nil, fmt.Errorf("failed to create data channel: %v", err)
+	}
+
+	offer, err := peerConn.CreateOffer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create offer: %v", err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConn)
+	if err := peerConn.SetLocalDescription(offer); err != nil {
+		return nil, fmt.Errorf("failed to set local description: %v", err)
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(timeout):
+	}
+
+	var types []string
+	if desc := peerConn.LocalDescription(); desc != nil {
+		for _, line := range strings.Split(desc.SDP, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "a=candidate:") {
+				continue
+			}
+			fields := strings.Fields(line)
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "typ" {
+					types = append(types, fields[i+1])
+					break
+				}
+			}
+		}
+	}
+
+	return types, nil
+}
+
 func (m *Manager) getConfiguration() webrtc.Configuration {
 	m.configMu.RLock()
 	defer m.configMu.RUnlock()
@@ -338,6 +526,11 @@ type FileRequest struct {
 	Type string `json:"type"`
 	TS   string `json:"ts"`
 	ID   string `json:"id"`
+	// Quality 多码率任务中要取的码流名，如"720p"；为空或"auto"时按请求的路径取文件
+	Quality string `json:"quality,omitempty"`
+	// Start、End 只发送文件的[start, end)字节，end超出文件末尾时截到末尾；都没有给出时发送整个文件
+	Start *int64 `json:"start,omitempty"`
+	End   *int64 `json:"end,omitempty"`
 }
 
 // FileResponse 文件响应结构
@@ -348,12 +541,30 @@ type FileResponse struct {
 	TotalSliceNum int    `json:"totalSliceNum"`
 	TotalLength   int    `json:"totalLength"`
 	Payload       string `json:"payload"`
+	// Charset 文本响应检测到的编码不是UTF-8时给出，如gb18030、utf-16le，客户端据此解码
+	Charset string `json:"charset,omitempty"`
+	// 按范围发送时TotalLength为范围的长度，RangeStart为范围在文件中的起点，FileLength为文件的总长度
+	RangeStart int `json:"rangeStart,omitempty"`
+	FileLength int `json:"fileLength,omitempty"`
 }
 
 const (
 	ServerChunkSize = 16 * 1024 // 16KB chunks
 )
 
+// onDataChannelMessage 处理数据通道上的一条消息。pion按到达顺序逐条调用回调，暂停与恢复只修改会话状态，
+// 直接在回调中处理，同一会话快速的暂停、恢复按发送顺序生效；文件请求要读文件并发送，在单独的协程中处理
+func (m *Manager) onDataChannelMessage(sessionID string, data []byte) {
+	var control struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(data, &control) == nil && (control.Type == "hijackPause" || control.Type == "hijackResume") {
+		m.handleFileRequest(sessionID, data)
+		return
+	}
+	go m.handleFileRequest(sessionID, data)
+}
+
 // handleFileRequest 处理文件请求
 func (m *Manager) handleFileRequest(sessionID string, data []byte) {
 	var request FileRequest
@@ -365,145 +576,247 @@ func (m *Manager) handleFileRequest(sessionID string, data []byte) {
 	log.Printf("Processing file request for session %s: type=%s, ts=%s, id=%s",
 		sessionID, request.Type, request.TS, request.ID)
 
-	if request.Type != "hijackReq" {
+	switch request.Type {
+	case "hijackReq":
+		if m.isProbe(sessionID) {
+			m.sendFileError(sessionID, request.ID, "Probe sessions do not serve files")
+			return
+		}
+	case "playbackHint":
+		m.handlePlaybackHint(sessionID, data)
+		return
+	case "hijackPause":
+		m.pauseSession(sessionID)
+		return
+	case "hijackResume":
+		m.resumeSession(sessionID)
+		return
+	case "repairSegment":
+		m.handleRepairRequest(sessionID, data)
+		return
+	case "speedProbe":
+		m.handleSpeedProbe(sessionID, request)
+		return
+	case "speedProbeAck":
+		m.handleSpeedProbeAck(sessionID, request)
+		return
+	default:
 		log.Printf("Unknown request type: %s", request.Type)
 		return
 	}
 
-	// 解析URL并提取路径
-	var filePath string
-	if u, err := url.Parse(request.TS); err == nil && u.Scheme != "" && u.Host != "" {
-		filePath = u.Path
-	} else {
-		filePath = request.TS
-	}
-
-	// 处理文件路径，移除前缀
-	filePath = strings.TrimPrefix(filePath, "/video/")
+	// 会话暂停期间不开始新的传输
+	m.waitIfPaused(sessionID)
 
-	// 解析任务ID和文件名
-	parts := strings.Split(filePath, "/")
-	if len(parts) < 2 {
-		log.Printf("Invalid file path format: %s", filePath)
+	// 解析任务ID和文件名。文件名可以带子目录，如多视频任务的video01/index.m3u8，但不能跳出任务目录
+	taskID, fileName, err := parseFilePath(request.TS, m.servePathPrefix)
+	if err != nil {
+		log.Printf("Refusing file request %q: %v", request.TS, err)
 		m.sendFileError(sessionID, request.ID, "Invalid file path")
 		return
 	}
 
-	taskID := parts[0]
-	fileName := parts[1]
+	if resolved, ok := m.qualityFile(taskID, fileName, request.Quality); ok {
+		fileName = resolved
+	} else {
+		log.Printf("Unknown quality %q requested for task %s", request.Quality, taskID)
+		m.sendFileError(sessionID, request.ID, "Unknown quality")
+		return
+	}
 
 	log.Printf("Parsed request: taskID=%s, fileName=%s", taskID, fileName)
 
-	// 构建实际文件路径 - 先尝试直接匹配taskID目��
-	var actualPath string
-	var found bool
+	window, err := requestRange(request)
+	if err != nil {
+		log.Printf("Invalid range in request %s: start=%v end=%v", request.ID, request.Start, request.End)
+		m.sendFileError(sessionID, request.ID, "Invalid range")
+		return
+	}
 
-	// 方法1：尝试直接匹配taskID目录
-	if strings.HasSuffix(fileName, ".m3u8") {
-		actualPath = filepath.Join("data", "m3u8", taskID, fileName)
-	} else if strings.HasSuffix(fileName, ".ts") || strings.HasSuffix(fileName, ".vtt") {
-		actualPath = filepath.Join("data", "m3u8", taskID, fileName)
+	actualPath, found := m.ResolveFile(taskID, fileName)
+	if !found {
+		log.Printf("File not found after searching: taskID=%s, fileName=%s", taskID, fileName)
+		m.taskLog.Warn(taskID, tasklog.SourceWebRTC, "session %s requested missing file %s", sessionID, fileName)
+		m.sendFileError(sessionID, request.ID, "File not found")
+		return
 	}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(actualPath); err == nil {
-		found = true
-	} else {
-		// 方法2：如果直接匹配失败，搜索m3u8目录下的所有子目录
-		m3u8BaseDir := "data/m3u8"
-		entries, err := os.ReadDir(m3u8BaseDir)
-		if err != nil {
-			log.Printf("Failed to read m3u8 directory: %v", err)
-			m.sendFileError(sessionID, request.ID, "M3U8 directory not accessible")
-			return
+	// 预取过的切片直接从缓存发送，其余文件边读边发，未命中缓存的冷数据在其它会话缓冲不足时让路
+	size, err := m.serveFile(sessionID, request.ID, actualPath, fileName, window)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		log.Printf("Range of request %s starts past the end of %s", request.ID, actualPath)
+		m.sendFileError(sessionID, request.ID, "Range not satisfiable")
+	} else if err != nil {
+		log.Printf("Failed to send %s to session %s: %v", actualPath, sessionID, err)
+		m.taskLog.Error(taskID, tasklog.SourceWebRTC, "failed to send %s to session %s: %v", fileName, sessionID, err)
+		if errors.Is(err, errReadFile) {
+			m.sendFileError(sessionID, request.ID, "Failed to read file")
 		}
+	} else {
+		log.Printf("Sent %s (%d bytes) to session %s", actualPath, size, sessionID)
+		m.recordServedBytes(taskID, size)
+		m.recordSegmentAccess(taskID, sessionID, fileName, size)
+	}
+}
 
-		// 遍历所有目录，寻找包含目标文件的目录
-		for _, entry := range entries {
-			if entry.IsDir() {
-				testPath := filepath.Join(m3u8BaseDir, entry.Name(), fileName)
-				if _, err := os.Stat(testPath); err == nil {
-					actualPath = testPath
-					found = true
-					log.Printf("Found file in directory: %s -> %s", entry.Name(), actualPath)
-					break
-				}
-			}
+// errReadFile 读取文件失败，包括发送期间文件变短。最后一个分块尚未发出，客户端仍在等待，回复hijackError
+var errReadFile = errors.New("failed to read file")
+
+// serveFile 发送文件或其中window指定的范围，返回发送的字节数。缓存中的切片直接发送；
+// 文本文件较小且需要整体判断编码，一次读入；其余文件从范围起点按分块流式读取，内存占用与文件大小无关。
+// 完整发送的、缓存容量以内的.ts切片在发送的同时收集起来，发送成功后放入缓存
+func (m *Manager) serveFile(sessionID, requestID, path, fileName string, window *byteRange) (int64, error) {
+	if data, ok := m.cache.get(path); ok {
+		return m.sendFileRange(sessionID, requestID, data, fileName, window, false)
+	}
+	if isTextFile(fileName) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, fmt.Errorf("%w %s: %v", errReadFile, path, err)
 		}
+		return m.sendFileRange(sessionID, requestID, data, fileName, window, true)
 	}
 
-	if !found {
-		log.Printf("File not found after searching: taskID=%s, fileName=%s", taskID, fileName)
-		m.sendFileError(sessionID, request.ID, "File not found")
-		return
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w %s: %v", errReadFile, path, err)
 	}
-
-	// 读取文件内容
-	fileData, err := os.ReadFile(actualPath)
+	defer file.Close()
+	info, err := file.Stat()
 	if err != nil {
-		log.Printf("Failed to read file %s: %v", actualPath, err)
-		m.sendFileError(sessionID, request.ID, "Failed to read file")
-		return
+		return 0, fmt.Errorf("%w %s: %v", errReadFile, path, err)
 	}
 
-	// 发送文件数据
-	if err := m.sendFileData(sessionID, request.ID, fileData, fileName); err != nil {
-		log.Printf("Failed to send file data: %v", err)
-	} else {
-		log.Printf("Successfully sent file %s to session %s", actualPath, sessionID)
+	header := FileResponse{Type: "hijackRespData"}
+	start, end := int64(0), info.Size()
+	if window != nil {
+		if start, end, err = window.resolve(info.Size()); err != nil {
+			return 0, err
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("%w %s: %v", errReadFile, path, err)
+		}
+		header.RangeStart, header.FileLength = int(start), int(info.Size())
 	}
+
+	var reader io.Reader = file
+	var collected *bytes.Buffer
+	if window == nil && strings.HasSuffix(fileName, ".ts") && info.Size() <= m.cache.capacity {
+		collected = bytes.NewBuffer(make([]byte, 0, info.Size()))
+		reader = io.TeeReader(file, collected)
+	}
+	if err := m.sendChunks(sessionID, requestID, reader, int(end-start), header, true); err != nil {
+		return 0, err
+	}
+	if collected != nil {
+		m.cache.put(path, collected.Bytes())
+	}
+	return end - start, nil
 }
 
-// sendFileData 发送文件数据
-func (m *Manager) sendFileData(sessionID, requestID string, data []byte, fileName string) error {
-	totalLength := len(data)
-	totalSlices := (totalLength + ServerChunkSize - 1) / ServerChunkSize
+// isTextFile 判断是否以hijackRespText发送的文本文件
+func isTextFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".m3u8") || strings.HasSuffix(fileName, ".vtt") ||
+		strings.HasSuffix(fileName, ".json") || strings.HasSuffix(fileName, ".srt")
+}
 
-	log.Printf("Sending file data: size=%d bytes, slices=%d", totalLength, totalSlices)
+// ResolveFile 返回任务输出文件在磁盘上的路径，查找规则见ResolveSegmentPath
+func (m *Manager) ResolveFile(taskID, fileName string) (string, bool) {
+	path, err := ResolveSegmentPath(taskID, fileName, m.mediaRoot)
+	return path, err == nil
+}
 
-	// 确定响应类型
-	responseType := "hijackRespData"
-	if strings.HasSuffix(fileName, ".m3u8") || strings.HasSuffix(fileName, ".vtt") {
-		responseType = "hijackRespText"
-	}
+// sendFileData 发送内存中的整个文件
+func (m *Manager) sendFileData(sessionID, requestID string, data []byte, fileName string, cold bool) error {
+	_, err := m.sendFileRange(sessionID, requestID, data, fileName, nil, cold)
+	return err
+}
 
-	// 分片发送
-	for i := 0; i < totalSlices; i++ {
-		start := i * ServerChunkSize
-		end := start + ServerChunkSize
-		if end > totalLength {
-			end = totalLength
+// sendFileRange 发送内存中的文件数据或其中window指定的范围，返回发送的字节数。文本文件以hijackRespText发送，
+// 原样发送的文本（如旧版本复制的GBK字幕）不是UTF-8时带上charset，编码按整个文件判断
+func (m *Manager) sendFileRange(sessionID, requestID string, data []byte, fileName string, window *byteRange, cold bool) (int64, error) {
+	header := FileResponse{Type: "hijackRespData"}
+	if isTextFile(fileName) {
+		header.Type = "hijackRespText"
+		if detected := transcoder.DetectTextEncoding(data, m.textCharset); detected != "utf-8" {
+			header.Charset = detected
 		}
+	}
+	if window != nil {
+		start, end, err := window.resolve(int64(len(data)))
+		if err != nil {
+			return 0, err
+		}
+		header.RangeStart, header.FileLength = int(start), len(data)
+		data = data[start:end]
+	}
+	return int64(len(data)), m.sendChunks(sessionID, requestID, bytes.NewReader(data), len(data), header, cold)
+}
 
-		chunk := data[start:end]
-
-		// Base64编码
-		payload := base64.StdEncoding.EncodeToString(chunk)
+// sendChunks 从r读取totalLength字节，按ServerChunkSize分块发送，每个分块以header为模板填入序号与数据；
+// 长度为0时发送一个空分块。会话暂停时在分块之间挂起；数据通道待发送的数据超过高水位时等待回落；
+// cold为true时，若其它正在播放的会话缓冲不足，每个分块之间稍作等待。读取失败（如文件在发送期间变短）时返回errReadFile。
+// 不逐块记录日志，整个文件发送完成或失败时由handleFileRequest记录一次
+func (m *Manager) sendChunks(sessionID, requestID string, r io.Reader, totalLength int, header FileResponse, cold bool) error {
+	totalSlices := (totalLength + ServerChunkSize - 1) / ServerChunkSize
+	if totalSlices == 0 {
+		totalSlices = 1
+	}
 
-		response := FileResponse{
-			Type:          responseType,
-			ID:            requestID,
-			SliceNum:      i,
-			TotalSliceNum: totalSlices,
-			TotalLength:   totalLength,
-			Payload:       payload,
+	buf := make([]byte, ServerChunkSize)
+	for i := 0; i < totalSlices; i++ {
+		chunk := buf
+		if remaining := totalLength - i*ServerChunkSize; remaining < ServerChunkSize {
+			chunk = buf[:remaining]
 		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("%w: chunk %d: %v", errReadFile, i, err)
+		}
+
+		response := header
+		response.ID = requestID
+		response.SliceNum = i
+		response.TotalSliceNum = totalSlices
+		response.TotalLength = totalLength
+		response.Payload = base64.StdEncoding.EncodeToString(chunk)
 
 		responseData, err := json.Marshal(response)
 		if err != nil {
 			return fmt.Errorf("failed to marshal response: %v", err)
 		}
 
-		if err := m.SendData(sessionID, responseData); err != nil {
-			return fmt.Errorf("failed to send chunk %d: %v", i, err)
+		m.waitIfPaused(sessionID)
+		if cold && i > 0 && m.shouldYield(sessionID) {
+			time.Sleep(coldChunkDelay)
+		}
+		m.waitEgress(sessionID, len(responseData))
+		m.waitBuffered(sessionID)
+		if err := m.sendData(sessionID, responseData); err != nil {
+			return fmt.Errorf("failed to send chunk %d/%d: %v", i+1, totalSlices, err)
 		}
-
-		log.Printf("Sent chunk %d/%d for request %s", i+1, totalSlices, requestID)
 	}
 
 	return nil
 }
 
+// recordServedBytes 把任务的服务流量交给外部持久化
+func (m *Manager) recordServedBytes(taskID string, n int64) {
+	m.trafficMu.Lock()
+	handler := m.servedBytesHandler
+	m.trafficMu.Unlock()
+
+	if handler != nil {
+		handler(taskID, n)
+	}
+}
+
+// SetServedBytesHandler 设置服务流量回调，用于持久化
+func (m *Manager) SetServedBytesHandler(handler func(taskID string, n int64)) {
+	m.trafficMu.Lock()
+	defer m.trafficMu.Unlock()
+	m.servedBytesHandler = handler
+}
+
 // sendFileError 发送文件错误响应
 func (m *Manager) sendFileError(sessionID, requestID, errorMsg string) {
 	errorResponse := map[string]interface{}{
@@ -518,7 +831,7 @@ func (m *Manager) sendFileError(sessionID, requestID, errorMsg string) {
 		return
 	}
 
-	if err := m.SendData(sessionID, responseData); err != nil {
+	if err := m.sendData(sessionID, responseData); err != nil {
 		log.Printf("Failed to send error response: %v", err)
 	}
 }
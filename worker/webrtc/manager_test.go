@@ -1,7 +1,16 @@
 package webrtc
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	webrtcLib "github.com/pion/webrtc/v3"
 )
@@ -24,3 +33,1021 @@ func TestManagerIceCandidateHandler(t *testing.T) {
 		t.Fatalf("expected ICE candidate handler to be stored")
 	}
 }
+
+func TestManagerResendsICECandidatesForExistingSession(t *testing.T) {
+	mgr := New()
+	peerConn, err := webrtcLib.NewPeerConnection(webrtcLib.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+	t.Cleanup(func() { peerConn.Close() })
+	mgr.sessions["session-1"] = &Session{ID: "session-1", PeerConn: peerConn}
+
+	var sent []string
+	mgr.SetICECandidateHandler(func(sessionID string, candidate *webrtcLib.ICECandidate) {
+		sent = append(sent, sessionID+" "+candidate.Address)
+	})
+
+	// 收集阶段发出的候选者
+	mgr.onLocalCandidate("session-1", &webrtcLib.ICECandidate{Address: "192.0.2.1", Port: 50000, Protocol: webrtcLib.ICEProtocolUDP, Typ: webrtcLib.ICECandidateTypeHost})
+	mgr.onLocalCandidate("session-1", &webrtcLib.ICECandidate{Address: "198.51.100.7", Port: 50001, Protocol: webrtcLib.ICEProtocolUDP, Typ: webrtcLib.ICECandidateTypeSrflx})
+	mgr.onLocalCandidate("session-2", &webrtcLib.ICECandidate{Address: "203.0.113.9", Port: 50002, Protocol: webrtcLib.ICEProtocolUDP, Typ: webrtcLib.ICECandidateTypeHost})
+	sent = nil
+
+	result, err := mgr.ResendICECandidates("session-1")
+	if err != nil {
+		t.Fatalf("resend: %v", err)
+	}
+	if result.Candidates != 2 || result.GatheringState != "new" {
+		t.Fatalf("unexpected resend result %+v", result)
+	}
+	if want := []string{"session-1 192.0.2.1", "session-1 198.51.100.7"}; !reflect.DeepEqual(sent, want) {
+		t.Fatalf("expected the session's candidates re-emitted in order, got %v", sent)
+	}
+
+	if _, err := mgr.ResendICECandidates("missing"); err == nil {
+		t.Fatalf("expected an error for an unknown session")
+	}
+
+	mgr.removeSession("session-1")
+	if _, err := mgr.ResendICECandidates("session-1"); err == nil {
+		t.Fatalf("expected an error after the session was removed")
+	}
+	if _, kept := mgr.candidates["session-1"]; kept {
+		t.Fatalf("expected candidates of a removed session to be dropped")
+	}
+}
+
+func TestManagerReportsOfferWithoutICECandidates(t *testing.T) {
+	mgr := New()
+	var failed []string
+	mgr.SetOfferFailedHandler(func(sessionID, reason string) {
+		failed = append(failed, sessionID+": "+reason)
+	})
+	gathered := make(chan struct{})
+	close(gathered)
+
+	// 收集完成却没有任何候选者：关闭会话并报告原因
+	empty := &Session{ID: "empty"}
+	mgr.sessions["empty"] = empty
+	mgr.watchICEGathering(empty, gathered)
+	if want := []string{"empty: no ICE candidates gathered"}; !reflect.DeepEqual(failed, want) {
+		t.Fatalf("expected the empty gathering to be reported, got %v", failed)
+	}
+	if _, exists := mgr.sessions["empty"]; exists {
+		t.Fatalf("expected the session without candidates to be closed")
+	}
+
+	// 收集到候选者的会话、已被重新协商的会话不报告
+	connected := &Session{ID: "connected"}
+	mgr.sessions["connected"] = connected
+	mgr.onLocalCandidate("connected", &webrtcLib.ICECandidate{Address: "192.0.2.1", Port: 50000, Protocol: webrtcLib.ICEProtocolUDP, Typ: webrtcLib.ICECandidateTypeHost})
+	mgr.watchICEGathering(connected, gathered)
+	replaced := &Session{ID: "replaced"}
+	mgr.sessions["replaced"] = &Session{ID: "replaced"}
+	mgr.watchICEGathering(replaced, gathered)
+	if len(failed) != 1 {
+		t.Fatalf("expected no further reports, got %v", failed)
+	}
+
+	// 收集一直没有完成时按超时报告
+	mgr.SetICEGatherTimeout(20 * time.Millisecond)
+	stuck := &Session{ID: "stuck"}
+	mgr.sessions["stuck"] = stuck
+	mgr.watchICEGathering(stuck, make(chan struct{}))
+	if len(failed) != 2 || failed[1] != "stuck: no ICE candidates gathered within 20ms" {
+		t.Fatalf("expected the gathering timeout to be reported, got %v", failed)
+	}
+}
+
+func TestManagerAccountsServedBytesPerTask(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	segments := map[string]int{"index0.ts": 40 * 1024, "index1.ts": 1500}
+	taskDir := filepath.Join("data", "m3u8", "task-1")
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, size := range segments {
+		if err := os.WriteFile(filepath.Join(taskDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	mgr := New()
+	mgr.sendData = func(string, []byte) error { return nil }
+
+	reported := make(map[string]int64)
+	mgr.SetServedBytesHandler(func(taskID string, n int64) {
+		reported[taskID] += n
+	})
+
+	request := func(ts string) {
+		data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: ts, ID: "req"})
+		mgr.handleFileRequest("session-1", data)
+	}
+	request("http://localhost/video/task-1/index0.ts")
+	request("http://localhost/video/task-1/index1.ts")
+	request("/video/task-1/index0.ts")
+	request("/video/task-1/missing.ts")
+
+	want := int64(2*segments["index0.ts"] + segments["index1.ts"])
+	if reported["task-1"] != want {
+		t.Fatalf("expected handler to receive %d bytes, got %d", want, reported["task-1"])
+	}
+	if got := reported["task-2"]; got != 0 {
+		t.Fatalf("expected no bytes for unrelated task, got %d", got)
+	}
+}
+
+func TestManagerAggregatesSegmentAccessPerTask(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"task-1/index0.ts":  1000,
+		"task-1/index1.ts":  500,
+		"task-1/index.m3u8": 100,
+		"task-2/index0.ts":  300,
+	}
+	for path, size := range files {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, make([]byte, size), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	mgr.sendData = func(string, []byte) error { return nil }
+	for _, sessionID := range []string{"session-1", "session-2", "session-3"} {
+		mgr.sessions[sessionID] = &Session{ID: sessionID}
+	}
+	request := func(sessionID, ts string) {
+		data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: ts, ID: "req"})
+		mgr.handleFileRequest(sessionID, data)
+	}
+
+	if _, found := mgr.SegmentAccess("task-1"); found {
+		t.Fatal("expected no access statistics before any request")
+	}
+	request("session-1", "/video/task-1/index.m3u8")
+	request("session-1", "/video/task-1/index0.ts")
+	request("session-1", "/video/task-1/index1.ts")
+	request("session-2", "/video/task-1/index0.ts")
+	request("session-2", "/video/task-1/missing.ts")
+	request("session-2", "/video/task-2/index0.ts")
+
+	access, found := mgr.SegmentAccess("task-1")
+	if !found {
+		t.Fatal("expected access statistics for task-1")
+	}
+	if access.Sessions != 2 || access.Segments != 3 || access.Bytes != 2500 {
+		t.Fatalf("expected 2 sessions, 3 segments and 2500 bytes for task-1, got %+v", access)
+	}
+	if access.LastSegment != "index0.ts" || access.LastAccessAt.IsZero() {
+		t.Fatalf("expected the last served segment to be recorded, got %+v", access)
+	}
+
+	access, _ = mgr.SegmentAccess("task-2")
+	if access.Sessions != 1 || access.Segments != 1 || access.Bytes != 300 {
+		t.Fatalf("expected task-2 to be counted separately, got %+v", access)
+	}
+
+	// 关闭的会话从集合中移除，累计会话数不变；之后的新会话继续计入
+	mgr.removeSession("session-1")
+	mgr.removeSession("session-2")
+	mgr.accessMu.Lock()
+	remembered := len(mgr.access["task-1"].sessions) + len(mgr.access["task-2"].sessions)
+	mgr.accessMu.Unlock()
+	if remembered != 0 {
+		t.Fatalf("expected closed sessions to be pruned, %d left", remembered)
+	}
+	request("session-3", "/video/task-1/index1.ts")
+	request("session-1", "/video/task-1/index1.ts")
+	access, _ = mgr.SegmentAccess("task-1")
+	if access.Sessions != 3 || access.Segments != 5 {
+		t.Fatalf("expected 3 sessions and 5 segments after the sessions closed, got %+v", access)
+	}
+}
+
+func TestManagerSpeedProbeMeasuresThroughput(t *testing.T) {
+	mgr := New()
+	mgr.SetProbeLimits(1, 0)
+	clock := time.Unix(1700000000, 0)
+	mgr.now = func() time.Time { return clock }
+
+	var sent []map[string]interface{}
+	mgr.sendData = func(sessionID string, data []byte) error {
+		var message map[string]interface{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		sent = append(sent, message)
+		return nil
+	}
+	var results []ProbeResult
+	mgr.SetProbeResultHandler(func(result ProbeResult) {
+		results = append(results, result)
+	})
+
+	mgr.sessions["probe"] = &Session{ID: "probe"}
+	mgr.sessions["viewer"] = &Session{ID: "viewer"}
+	mgr.probes["probe"] = &probeState{}
+	if _, err := mgr.HandleProbe("second", "v=0"); err != ErrTooManyProbes {
+		t.Fatalf("expected the probe cap to refuse a second probe, got %v", err)
+	}
+	if got := mgr.AggregateStats().ActiveSessionCount; got != 1 {
+		t.Fatalf("expected probe sessions to be excluded from session stats, got %d sessions", got)
+	}
+
+	request := func(kind, id string) {
+		data, _ := json.Marshal(FileRequest{Type: kind, TS: "/video/task-1/index0.ts", ID: id})
+		mgr.handleFileRequest("probe", data)
+	}
+	request("hijackReq", "file")
+	if len(sent) != 1 || sent[0]["type"] != "hijackError" {
+		t.Fatalf("expected probe sessions to refuse file requests, got %v", sent)
+	}
+
+	sent = nil
+	request("speedProbe", "probe-1")
+	var received int
+	for _, message := range sent {
+		if message["type"] != "speedProbeData" {
+			t.Fatalf("unexpected message during the probe: %v", message)
+		}
+		payload, _ := base64.StdEncoding.DecodeString(message["payload"].(string))
+		received += len(payload)
+	}
+	if received != ProbePayloadBytes {
+		t.Fatalf("expected %d probe bytes, got %d", ProbePayloadBytes, received)
+	}
+
+	sent = nil
+	clock = clock.Add(time.Second)
+	request("speedProbeAck", "other")
+	if len(results) != 0 {
+		t.Fatalf("expected an ack for another request to be ignored, got %v", results)
+	}
+	request("speedProbeAck", "probe-1")
+	if len(results) != 1 {
+		t.Fatalf("expected one probe result, got %v", results)
+	}
+	if got := results[0]; got.SessionID != "probe" || got.DurationMs != 1000 || got.ThroughputKbps != float64(ProbePayloadBytes)*8/1000 {
+		t.Fatalf("unexpected probe result %+v", got)
+	}
+	if len(sent) != 1 || sent[0]["type"] != "speedProbeResult" {
+		t.Fatalf("expected the result to be sent to the client, got %v", sent)
+	}
+
+	sent = nil
+	request("speedProbe", "probe-2")
+	if len(sent) != 1 || sent[0]["type"] != "hijackError" {
+		t.Fatalf("expected a probe session to measure only once, got %d messages", len(sent))
+	}
+}
+
+func TestManagerServesFilesInTaskSubdirectories(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"task-1/video02/index0.ts", "task-2/index0.ts", "legacy/video03/index0.ts"} {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, make([]byte, 1000), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	mgr.sendData = func(string, []byte) error { return nil }
+	served := make(map[string]int64)
+	mgr.SetServedBytesHandler(func(taskID string, n int64) { served[taskID] += n })
+	request := func(ts string) {
+		data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: ts, ID: "req"})
+		mgr.handleFileRequest("session-1", data)
+	}
+
+	request("/video/task-1/video02/index0.ts")
+	if got := served["task-1"]; got != 1000 {
+		t.Fatalf("expected the segment in the video02 subdirectory to be served, got %d bytes", got)
+	}
+	request("/video/task-1/../task-2/index0.ts")
+	request("/video/task-1/video02")
+	if got := served["task-1"]; got != 1000 {
+		t.Fatalf("expected paths leaving the task directory and directories to be refused, got %d bytes", got)
+	}
+	if _, found := mgr.ResolveFile("task-1", "video03/index0.ts"); found {
+		t.Fatal("a path with a subdirectory must not be looked up in other tasks' directories")
+	}
+}
+
+func TestParseFilePathRejectsTraversal(t *testing.T) {
+	for _, ts := range []string{
+		"/video/task-1/index.m3u8",
+		"/video/task-1/video01/index3.ts",
+		"https://worker.example/video/task-1/thumbnails.vtt?t=1",
+		"/video/task-1/movie.chi.srt",
+	} {
+		if _, _, err := parseFilePath(ts, DefaultServePathPrefix); err != nil {
+			t.Fatalf("expected %q to be accepted: %v", ts, err)
+		}
+	}
+
+	for _, ts := range []string{
+		"/video/../config/worker.db",
+		"/video/task-1/../../config/worker.db",
+		"/video/..",
+		"/video/task-1/..",
+		"/video/task-1/./index.m3u8",
+		"/video/task-1//index.m3u8",
+		"/etc/passwd",
+		"//video/task-1/index.m3u8",
+		"/video/task-1/%2e%2e/%2e%2e/config/worker.db",
+		"/video/task-1/%2E%2E%2Fworker.db",
+		"/video/task-1/..%2f..%2fworker.db",
+		"/video/task-1/index%00.m3u8",
+		`/video/task-1/..\..\config\worker.m3u8`,
+		`/video/task-1\index.m3u8`,
+		"/video/task-1/%5c..%5cindex.m3u8",
+		"/video/task-1/worker.db",
+		"/video/task-1/info.json",
+		"/video/task-1/poster.jpg",
+		"/video/task-1/index.m3u8.bak",
+		"/video/task-1/video02",
+		"/video/task-1/bad%zz.ts",
+	} {
+		if taskID, fileName, err := parseFilePath(ts, DefaultServePathPrefix); err == nil {
+			t.Fatalf("expected %q to be refused, got task %q file %q", ts, taskID, fileName)
+		}
+	}
+}
+
+func TestParseFilePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		ts       string
+		taskID   string
+		fileName string
+		err      error
+	}{
+		{name: "video prefix", prefix: "/video/", ts: "/video/task-1/index.m3u8", taskID: "task-1", fileName: "index.m3u8"},
+		{name: "rendition subdirectory", prefix: "/video/", ts: "/video/task-1/720p/index0.ts", taskID: "task-1", fileName: "720p/index0.ts"},
+		{name: "full URL", prefix: "/video/", ts: "https://worker.example:8443/video/task-1/index3.ts?t=1#x", taskID: "task-1", fileName: "index3.ts"},
+		{name: "escaped name", prefix: "/video/", ts: "/video/task-1/%E4%B8%AD%E6%96%87.srt", taskID: "task-1", fileName: "中文.srt"},
+		{name: "custom prefix", prefix: "/media/hls/", ts: "https://proxy.example/media/hls/task-1/index.m3u8", taskID: "task-1", fileName: "index.m3u8"},
+		{name: "root prefix", prefix: "/", ts: "/task-1/index.m3u8", taskID: "task-1", fileName: "index.m3u8"},
+		{name: "other prefix", prefix: "/video/", ts: "/media/task-1/index.m3u8", err: errOutsidePrefix},
+		{name: "relative path", prefix: "/video/", ts: "task-1/index.m3u8", err: errOutsidePrefix},
+		{name: "prefix nested in another path", prefix: "/video/", ts: "/proxy/video/task-1/index.m3u8", err: errOutsidePrefix},
+		{name: "scheme-relative URL", prefix: "/video/", ts: "//video/task-1/index.m3u8", err: errOutsidePrefix},
+		{name: "empty", prefix: "/video/", ts: "", err: errOutsidePrefix},
+		{name: "bad escape", prefix: "/video/", ts: "/video/task-1/bad%zz.ts", err: errUnparsablePath},
+		{name: "missing file name", prefix: "/video/", ts: "/video/task-1", err: errIncompletePath},
+		{name: "missing task ID", prefix: "/video/", ts: "/video//index.m3u8", err: errIncompletePath},
+		{name: "trailing slash", prefix: "/video/", ts: "/video/task-1/", err: errIncompletePath},
+		{name: "traversal", prefix: "/video/", ts: "/video/task-1/../secret.m3u8", err: errUnsafePath},
+		{name: "unserved type", prefix: "/video/", ts: "/video/task-1/worker.db", err: errUnservedType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskID, fileName, err := parseFilePath(tt.ts, tt.prefix)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) || !errors.Is(err, errInvalidPath) {
+					t.Fatalf("expected %v, got task %q file %q err %v", tt.err, taskID, fileName, err)
+				}
+				return
+			}
+			if err != nil || taskID != tt.taskID || fileName != tt.fileName {
+				t.Fatalf("expected task %q file %q, got %q %q err %v", tt.taskID, tt.fileName, taskID, fileName, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeServePathPrefix(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":            "/",
+		"/":           "/",
+		"video":       "/video/",
+		"/video":      "/video/",
+		" /media/hls": "/media/hls/",
+		"media/hls//": "/media/hls/",
+	} {
+		if got := NormalizeServePathPrefix(prefix); got != want {
+			t.Fatalf("NormalizeServePathPrefix(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestResolveFileStaysUnderMediaRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "m3u8")
+	for _, path := range []string{"m3u8/task-1/index.m3u8", "secret/index.m3u8"} {
+		full := filepath.Join(base, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte("#EXTM3U"), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	if _, found := mgr.ResolveFile("task-1", "index.m3u8"); !found {
+		t.Fatal("expected a file inside the media root to be found")
+	}
+	for _, tc := range []struct{ taskID, fileName string }{
+		{"..", "secret/index.m3u8"},
+		{"task-1", "../../secret/index.m3u8"},
+		{"../secret", "index.m3u8"},
+	} {
+		if path, found := mgr.ResolveFile(tc.taskID, tc.fileName); found {
+			t.Fatalf("expected %s/%s to be refused, got %s", tc.taskID, tc.fileName, path)
+		}
+	}
+
+	var sent []FileResponse
+	mgr.sendData = func(_ string, data []byte) error {
+		var response FileResponse
+		json.Unmarshal(data, &response)
+		sent = append(sent, response)
+		return nil
+	}
+	data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: "/video/task-1/%2e%2e/%2e%2e/secret/index.m3u8", ID: "req"})
+	mgr.handleFileRequest("session-1", data)
+	if len(sent) != 1 || sent[0].Type != "hijackError" {
+		t.Fatalf("expected an encoded traversal to be answered with hijackError, got %+v", sent)
+	}
+}
+
+func TestManagerServesRequestedQualityVariant(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"task-1/index.m3u8":       100,
+		"task-1/720p/index.m3u8":  200,
+		"task-1/720p/index3.ts":   7200,
+		"task-1/360p/index.m3u8":  300,
+		"task-1/360p/index3.ts":   3600,
+		"task-1/master.m3u8":      100,
+		"task-2/video01/index.ts": 10,
+	}
+	for path, size := range files {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, make([]byte, size), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	var sent []FileResponse
+	mgr.sendData = func(_ string, data []byte) error {
+		var response FileResponse
+		json.Unmarshal(data, &response)
+		sent = append(sent, response)
+		return nil
+	}
+	request := func(ts, quality string) FileResponse {
+		sent = nil
+		data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: ts, ID: "req", Quality: quality})
+		mgr.handleFileRequest("session-1", data)
+		if len(sent) == 0 {
+			t.Fatalf("%s (%s): nothing sent", ts, quality)
+		}
+		return sent[0]
+	}
+
+	for _, tc := range []struct {
+		ts, quality string
+		length      int
+	}{
+		{"/video/task-1/index.m3u8", "", 100},
+		{"/video/task-1/index.m3u8", "auto", 100},
+		{"/video/task-1/index.m3u8", "720p", 200},
+		{"/video/task-1/index.m3u8", "360p", 300},
+		{"/video/task-1/master.m3u8", "", 100},
+		{"/video/task-1/master.m3u8", "720p", 200},
+		// 从720p切换到360p时沿用720p播放列表中的切片路径
+		{"/video/task-1/720p/index3.ts", "360p", 3600},
+		{"/video/task-1/index3.ts", "720p", 7200},
+	} {
+		if response := request(tc.ts, tc.quality); response.Type == "hijackError" || response.TotalLength != tc.length {
+			t.Fatalf("%s (%s): expected %d bytes, got %+v", tc.ts, tc.quality, tc.length, response)
+		}
+	}
+
+	for _, quality := range []string{"1080p", "..", "../task-2/video01"} {
+		if response := request("/video/task-1/index.m3u8", quality); response.Type != "hijackError" {
+			t.Fatalf("expected quality %q to be refused, got %+v", quality, response)
+		}
+	}
+}
+
+func TestPrefetchTargetsSkipsCachedSegments(t *testing.T) {
+	hint := PlaybackHint{TaskID: "task-1", Rendition: "index", Sequence: 4, BufferLength: 6}
+	next5 := filepath.Join("data", "m3u8", "task-1", "index5.ts")
+	next6 := filepath.Join("data", "m3u8", "task-1", "index6.ts")
+
+	got := prefetchTargets(defaultMediaRoot, hint, func(string) bool { return false })
+	if !reflect.DeepEqual(got, []string{next5, next6}) {
+		t.Fatalf("expected next two segments, got %v", got)
+	}
+
+	got = prefetchTargets(defaultMediaRoot, hint, func(path string) bool { return path == next5 })
+	if !reflect.DeepEqual(got, []string{next6}) {
+		t.Fatalf("expected cached segment to be skipped, got %v", got)
+	}
+
+	for _, bad := range []PlaybackHint{
+		{TaskID: "../etc", Rendition: "index", Sequence: 1},
+		{TaskID: "task-1", Rendition: "..", Sequence: 1},
+		{TaskID: "task-1", Rendition: "index", Sequence: -1},
+		{Rendition: "index", Sequence: 1},
+	} {
+		if got := prefetchTargets(defaultMediaRoot, bad, func(string) bool { return false }); len(got) != 0 {
+			t.Fatalf("expected no targets for %+v, got %v", bad, got)
+		}
+	}
+}
+
+func TestManagerYieldsColdTransfersToStarvingSession(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	mgr := New()
+	mgr.now = func() time.Time { return now }
+
+	if mgr.shouldYield("idle") {
+		t.Fatalf("expected no yielding without any hints")
+	}
+
+	mgr.handlePlaybackHint("player", []byte(`{"type":"playbackHint","taskId":"task-1","rendition":"index","sequence":0,"bufferLength":2}`))
+	if !mgr.shouldYield("idle") {
+		t.Fatalf("expected hintless session to yield while another session is starving")
+	}
+	if mgr.shouldYield("player") {
+		t.Fatalf("expected the starving session itself not to yield")
+	}
+
+	mgr.handlePlaybackHint("player", []byte(`{"type":"playbackHint","taskId":"task-1","rendition":"index","sequence":3,"bufferLength":25}`))
+	if mgr.shouldYield("idle") {
+		t.Fatalf("expected no yielding once the player has enough buffer")
+	}
+
+	mgr.handlePlaybackHint("player", []byte(`{"type":"playbackHint","taskId":"task-1","rendition":"index","sequence":4,"bufferLength":1}`))
+	now = now.Add(hintTTL + time.Second)
+	if mgr.shouldYield("idle") {
+		t.Fatalf("expected stale hints to be ignored")
+	}
+}
+
+func TestManagerPlaybackHintPrefetchesIntoCache(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	taskDir := filepath.Join("data", "m3u8", "task-1")
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, name := range []string{"index1.ts", "index2.ts", "index3.ts"} {
+		if err := os.WriteFile(filepath.Join(taskDir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	mgr := New()
+	mgr.handlePlaybackHint("session-1", []byte(`{"type":"playbackHint","taskId":"task-1","rendition":"index","sequence":0,"bufferLength":4}`))
+
+	for name, want := range map[string]bool{"index1.ts": true, "index2.ts": true, "index3.ts": false} {
+		if got := mgr.cache.contains(filepath.Join(taskDir, name)); got != want {
+			t.Fatalf("expected cached(%s)=%v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestManagerPausedSessionStopsSendingChunks(t *testing.T) {
+	mgr := New()
+
+	var mu sync.Mutex
+	var sent []int
+	mgr.sendData = func(sessionID string, data []byte) error {
+		var response FileResponse
+		json.Unmarshal(data, &response)
+		mu.Lock()
+		sent = append(sent, response.SliceNum)
+		mu.Unlock()
+		// 播放器在收到第一个分块后切到后台
+		if response.SliceNum == 0 {
+			mgr.handleFileRequest(sessionID, []byte(`{"type":"hijackPause"}`))
+		}
+		return nil
+	}
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mgr.sendFileData("session-1", "req", make([]byte, 3*ServerChunkSize), "index0.ts", false)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := sentCount(); got != 1 {
+		t.Fatalf("expected transfer to stop after the first chunk, sent %d", got)
+	}
+	select {
+	case <-done:
+		t.Fatalf("expected paused transfer to stay suspended")
+	default:
+	}
+
+	// 其它会话不受影响
+	if err := mgr.sendFileData("session-2", "other", []byte("playlist"), "index.m3u8", false); err != nil {
+		t.Fatalf("send on another session: %v", err)
+	}
+
+	mgr.handleFileRequest("session-1", []byte(`{"type":"hijackResume"}`))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("resumed transfer failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected transfer to finish after resume")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(sent, []int{0, 0, 1, 2}) {
+		t.Fatalf("expected the remaining chunks in order after resume, got %v", sent)
+	}
+}
+
+func TestManagerEgressLimitCapsAggregateRate(t *testing.T) {
+	const limit = 256 * 1024 // 字节/秒
+
+	mgr := New()
+	mgr.SetEgressLimits(limit, 0)
+
+	var mu sync.Mutex
+	var sent int
+	mgr.sendData = func(_ string, data []byte) error {
+		mu.Lock()
+		sent += len(data)
+		mu.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(session string) {
+			defer wg.Done()
+			mgr.sendFileData(session, "req", make([]byte, 8*ServerChunkSize), "index0.ts", false)
+		}(fmt.Sprintf("session-%d", i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+
+	// 初始突发额度可以立即发送，其余数据受限速约束
+	if max := float64(limit)*elapsed + float64(limit); float64(sent) > max {
+		t.Fatalf("sent %d bytes in %.2fs, exceeding the %d B/s cap", sent, elapsed, limit)
+	}
+	if elapsed < float64(sent-limit)/limit*0.9 {
+		t.Fatalf("expected sending to be throttled, finished %d bytes in %.2fs", sent, elapsed)
+	}
+
+	// 运行中取消限速后立即以全速发送
+	mgr.SetEgressLimits(0, 0)
+	start = time.Now()
+	mgr.sendFileData("session-0", "req", make([]byte, 12*ServerChunkSize), "index0.ts", false)
+	if time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("expected unlimited sending after lifting the cap, took %v", time.Since(start))
+	}
+}
+
+func TestManagerAppliesPauseAndResumeInOrder(t *testing.T) {
+	mgr := New()
+	// 快速切换前后台时暂停与恢复紧挨着到达，恢复必须在暂停之后生效
+	for i := 0; i < 100; i++ {
+		mgr.onDataChannelMessage("session-1", []byte(`{"type":"hijackPause"}`))
+		mgr.onDataChannelMessage("session-1", []byte(`{"type":"hijackResume"}`))
+		mgr.pausedMu.Lock()
+		_, paused := mgr.paused["session-1"]
+		mgr.pausedMu.Unlock()
+		if paused {
+			t.Fatalf("expected the session resumed after pause then resume, iteration %d", i)
+		}
+	}
+
+	mgr.onDataChannelMessage("session-1", []byte(`{"type":"hijackResume"}`))
+	mgr.onDataChannelMessage("session-1", []byte(`{"type":"hijackPause"}`))
+	mgr.pausedMu.Lock()
+	_, paused := mgr.paused["session-1"]
+	mgr.pausedMu.Unlock()
+	if !paused {
+		t.Fatalf("expected the session paused after resume then pause")
+	}
+}
+
+func TestManagerWaitsForDataChannelToDrain(t *testing.T) {
+	mgr := New()
+	mgr.SetBufferedHighWater(4 * ServerChunkSize)
+	mgr.sessions["session-1"] = &Session{ID: "session-1"}
+
+	var mu sync.Mutex
+	var buffered uint64
+	var sent int
+	mgr.bufferedAmount = func(string) (uint64, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buffered, true
+	}
+	mgr.sendData = func(_ string, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		buffered += uint64(len(data))
+		sent++
+		return nil
+	}
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mgr.sendFileData("session-1", "req", make([]byte, 10*ServerChunkSize), "index0.ts", false)
+	}()
+
+	// base64后每个分块约22KB，超过高水位后停止发送
+	time.Sleep(50 * time.Millisecond)
+	if got := sentCount(); got != 3 {
+		t.Fatalf("expected sending to stop above the high-water mark, sent %d chunks", got)
+	}
+
+	// 数据通道发出缓冲的数据后继续
+	mu.Lock()
+	buffered = 0
+	mu.Unlock()
+	mgr.bufferedLow("session-1")
+	time.Sleep(50 * time.Millisecond)
+	if got := sentCount(); got != 6 {
+		t.Fatalf("expected sending to resume until the buffer fills again, sent %d chunks", got)
+	}
+
+	mgr.SetBufferedHighWater(100 * ServerChunkSize)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("transfer failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected transfer to finish after raising the high-water mark")
+	}
+	if got := sentCount(); got != 10 {
+		t.Fatalf("expected all 10 chunks, sent %d", got)
+	}
+
+	// 会话移除后迟到的回落通知不再留下通知通道
+	mgr.removeSession("session-1")
+	mgr.bufferedLow("session-1")
+	if _, kept := mgr.drained["session-1"]; kept {
+		t.Fatalf("expected a late buffered-low callback not to recreate the drained channel")
+	}
+}
+
+func TestManagerReportsSegmentShrinkingMidStream(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "task-1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	segment := filepath.Join(root, "task-1", "index0.ts")
+	if err := os.WriteFile(segment, make([]byte, 3*ServerChunkSize), 0o644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	var responses []FileResponse
+	mgr.sendData = func(_ string, data []byte) error {
+		var response FileResponse
+		json.Unmarshal(data, &response)
+		responses = append(responses, response)
+		// 第一个分块发出后切片被重新生成得更短
+		if len(responses) == 1 {
+			os.Truncate(segment, ServerChunkSize+10)
+		}
+		return nil
+	}
+	mgr.handleFileRequest("session-1", []byte(`{"type":"hijackReq","id":"req","ts":"/video/task-1/index0.ts"}`))
+
+	if len(responses) != 2 || responses[0].Type != "hijackRespData" || responses[1].Type != "hijackError" || responses[1].ID != "req" {
+		t.Fatalf("expected one chunk followed by hijackError, got %+v", responses)
+	}
+}
+
+func TestManagerStreamsSegmentsLargerThanCache(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, 3*ServerChunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "task-1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	segment := filepath.Join(root, "task-1", "index0.ts")
+	if err := os.WriteFile(segment, content, 0o644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	mgr.cache = newSegmentCache(ServerChunkSize)
+	var served int64
+	mgr.SetServedBytesHandler(func(_ string, n int64) { served += n })
+
+	var received []byte
+	mgr.sendData = func(_ string, data []byte) error {
+		var response FileResponse
+		json.Unmarshal(data, &response)
+		chunk, _ := base64.StdEncoding.DecodeString(response.Payload)
+		received = append(received, chunk...)
+		return nil
+	}
+	mgr.handleFileRequest("session-1", []byte(`{"type":"hijackReq","id":"req","ts":"/video/task-1/index0.ts"}`))
+
+	if !reflect.DeepEqual(received, content) {
+		t.Fatalf("expected streamed segment to match the file, got %d bytes", len(received))
+	}
+	if mgr.cache.contains(segment) {
+		t.Fatalf("expected a segment larger than the cache not to be cached")
+	}
+	if served != int64(len(content)) {
+		t.Fatalf("expected %d served bytes, got %d", len(content), served)
+	}
+}
+
+func TestManagerServesRequestedByteRanges(t *testing.T) {
+	root := t.TempDir()
+	size := 3*ServerChunkSize + 100
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "task-1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	segment := filepath.Join(root, "task-1", "index0.ts")
+	if err := os.WriteFile(segment, content, 0o644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		rangeJSON  string
+		start, end int // 期望发送的[start, end)
+		slices     int
+		err        string
+	}{
+		{name: "whole file", start: 0, end: size, slices: 4},
+		{name: "window", rangeJSON: `,"start":100,"end":200`, start: 100, end: 200, slices: 1},
+		{name: "crossing a chunk boundary of the file", rangeJSON: `,"start":16380,"end":16400`, start: 16380, end: 16400, slices: 1},
+		{name: "one byte past a full chunk", rangeJSON: fmt.Sprintf(`,"start":10,"end":%d`, 11+ServerChunkSize), start: 10, end: 11 + ServerChunkSize, slices: 2},
+		{name: "crossing the last chunk boundary", rangeJSON: fmt.Sprintf(`,"start":%d`, 3*ServerChunkSize-10), start: 3*ServerChunkSize - 10, end: size, slices: 1},
+		{name: "end past the end of the file", rangeJSON: fmt.Sprintf(`,"start":%d,"end":%d`, 2*ServerChunkSize, 10*size), start: 2 * ServerChunkSize, end: size, slices: 2},
+		{name: "only end", rangeJSON: `,"end":10`, start: 0, end: 10, slices: 1},
+		{name: "zero length", rangeJSON: `,"start":500,"end":500`, start: 500, end: 500, slices: 1},
+		{name: "zero length at the end", rangeJSON: fmt.Sprintf(`,"start":%d`, size), start: size, end: size, slices: 1},
+		{name: "start past the end", rangeJSON: fmt.Sprintf(`,"start":%d`, size+1), err: "Range not satisfiable"},
+		{name: "end before start", rangeJSON: `,"start":200,"end":100`, err: "Invalid range"},
+		{name: "negative start", rangeJSON: `,"start":-1`, err: "Invalid range"},
+	}
+
+	for _, cached := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s cached=%v", tt.name, cached), func(t *testing.T) {
+				mgr := New()
+				mgr.SetMediaRoot(root)
+				if cached {
+					mgr.cache.put(segment, content)
+				}
+
+				var responses []map[string]interface{}
+				var received []byte
+				mgr.sendData = func(_ string, data []byte) error {
+					var response map[string]interface{}
+					json.Unmarshal(data, &response)
+					responses = append(responses, response)
+					payload, _ := response["payload"].(string)
+					chunk, _ := base64.StdEncoding.DecodeString(payload)
+					received = append(received, chunk...)
+					return nil
+				}
+				mgr.handleFileRequest("session-1", []byte(`{"type":"hijackReq","id":"req","ts":"/video/task-1/index0.ts"`+tt.rangeJSON+`}`))
+
+				if tt.err != "" {
+					if len(responses) != 1 || responses[0]["type"] != "hijackError" || responses[0]["error"] != tt.err {
+						t.Fatalf("expected a %q error, got %v", tt.err, responses)
+					}
+					return
+				}
+				if len(responses) != tt.slices {
+					t.Fatalf("expected %d slices, got %d", tt.slices, len(responses))
+				}
+				if !reflect.DeepEqual(received, content[tt.start:tt.end]) && !(len(received) == 0 && tt.start == tt.end) {
+					t.Fatalf("expected bytes [%d, %d), got %d bytes", tt.start, tt.end, len(received))
+				}
+				first := responses[0]
+				if first["totalLength"] != float64(tt.end-tt.start) || first["totalSliceNum"] != float64(tt.slices) {
+					t.Fatalf("expected totalLength %d in %d slices, got %v", tt.end-tt.start, tt.slices, first)
+				}
+				if tt.rangeJSON == "" {
+					if _, ok := first["fileLength"]; ok {
+						t.Fatalf("expected a whole-file response without fileLength, got %v", first)
+					}
+				} else if first["fileLength"] != float64(size) || first["rangeStart"] != float64(tt.start) && tt.start != 0 {
+					t.Fatalf("expected rangeStart %d and fileLength %d, got %v", tt.start, size, first)
+				}
+				if !cached && tt.rangeJSON != "" && mgr.cache.contains(segment) {
+					t.Fatalf("expected a partial read not to be cached")
+				}
+			})
+		}
+	}
+}
+
+func TestManagerMarksNonUTF8TextWithCharset(t *testing.T) {
+	root := t.TempDir()
+	gbk, err := os.ReadFile(filepath.Join("..", "transcoder", "testdata", "chs.gbk.srt"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	utf8Text, err := os.ReadFile(filepath.Join("..", "transcoder", "testdata", "chs.utf8.srt"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "task-1"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, data := range map[string][]byte{"legacy.srt": gbk, "movie.srt": utf8Text} {
+		if err := os.WriteFile(filepath.Join(root, "task-1", name), data, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	mgr := New()
+	mgr.SetMediaRoot(root)
+	var responses []FileResponse
+	mgr.sendData = func(_ string, data []byte) error {
+		var response FileResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			return err
+		}
+		responses = append(responses, response)
+		return nil
+	}
+	request := func(ts string) FileResponse {
+		responses = nil
+		data, _ := json.Marshal(FileRequest{Type: "hijackReq", TS: ts, ID: "req"})
+		mgr.handleFileRequest("session-1", data)
+		if len(responses) == 0 {
+			t.Fatalf("expected a response for %s", ts)
+		}
+		return responses[0]
+	}
+
+	if response := request("/video/task-1/legacy.srt"); response.Type != "hijackRespText" || response.Charset != "gb18030" {
+		t.Fatalf("expected a gb18030 text response, got %+v", response)
+	}
+	if response := request("/video/task-1/movie.srt"); response.Charset != "" {
+		t.Fatalf("expected no charset for UTF-8 text, got %q", response.Charset)
+	}
+}
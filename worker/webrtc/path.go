@@ -0,0 +1,154 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultServePathPrefix 数据通道文件请求的默认路径前缀，与info.json等处生成的播放地址一致
+const DefaultServePathPrefix = "/video/"
+
+// errInvalidPath 请求的路径不合法，以下各错误都包装它，日志中说明具体原因
+var (
+	errInvalidPath    = errors.New("invalid file path")
+	errUnparsablePath = fmt.Errorf("%w: not a valid URI", errInvalidPath)
+	errOutsidePrefix  = fmt.Errorf("%w: outside the served path prefix", errInvalidPath)
+	errIncompletePath = fmt.Errorf("%w: missing task ID or file name", errInvalidPath)
+	errUnsafePath     = fmt.Errorf("%w: empty, . or .. segment, backslash or NUL", errInvalidPath)
+	errUnservedType   = fmt.Errorf("%w: file type is not served", errInvalidPath)
+)
+
+// servedExtensions 数据通道允许读取的文件类型：播放列表、切片与字幕
+var servedExtensions = map[string]bool{
+	".m3u8": true,
+	".ts":   true,
+	".vtt":  true,
+	".srt":  true,
+}
+
+// NormalizeServePathPrefix 规范化路径前缀，保证以/开头和结尾；为空时为/，即请求形如/<taskID>/<fileName>
+func NormalizeServePathPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return "/"
+	}
+	return "/" + prefix + "/"
+}
+
+// parseFilePath 从hijackReq的ts字段解析任务ID和文件名。ts可以是完整URL或只有路径，路径按URL解码后
+// 必须以prefix开头（见NormalizeServePathPrefix），其后为<taskID>/<fileName>，查询参数忽略。
+// 不合法时返回包装errInvalidPath的错误，说明请求为何被拒绝
+func parseFilePath(ts, prefix string) (taskID, fileName string, err error) {
+	u, err := url.Parse(ts)
+	if err != nil {
+		return "", "", errUnparsablePath
+	}
+	// url.Parse已解码%2e%2e%2f之类的转义
+	rest, ok := strings.CutPrefix(u.Path, prefix)
+	if !ok {
+		return "", "", errOutsidePrefix
+	}
+	taskID, fileName, found := strings.Cut(rest, "/")
+	if !found || taskID == "" || fileName == "" {
+		return "", "", errIncompletePath
+	}
+	if err := checkSegmentPath(taskID, fileName); err != nil {
+		return "", "", err
+	}
+	return taskID, fileName, nil
+}
+
+// checkSegmentPath 任务ID必须是单级名字，文件名可以带子目录（如video01/index.m3u8）；
+// 任何一段为空、为.或含有..、路径中出现反斜杠和NUL都不合法，扩展名必须在servedExtensions中
+func checkSegmentPath(taskID, fileName string) error {
+	if strings.ContainsAny(taskID+fileName, "\\\x00") {
+		return errUnsafePath
+	}
+	for _, part := range append([]string{taskID}, strings.Split(fileName, "/")...) {
+		if part == "" || part == "." || strings.Contains(part, "..") {
+			return errUnsafePath
+		}
+	}
+	if !servedExtensions[strings.ToLower(filepath.Ext(fileName))] {
+		return errUnservedType
+	}
+	return nil
+}
+
+// ResolveTaskFilePath 返回任务输出文件<m3u8Dir>/<taskID>/<fileName>的路径，只在任务自己的目录中查找。
+// 网关的HTTP直通（file_fetch）按任务核对播放令牌，只能读取该任务的文件，因此使用它而不是ResolveSegmentPath。
+// 路径不合法或解析出的路径不在m3u8Dir之下时返回包装errInvalidPath的错误，找不到文件时返回os.ErrNotExist
+func ResolveTaskFilePath(taskID, fileName, m3u8Dir string) (string, error) {
+	if err := checkSegmentPath(taskID, fileName); err != nil {
+		return "", err
+	}
+	actualPath := filepath.Join(m3u8Dir, taskID, filepath.FromSlash(fileName))
+	if !withinRoot(m3u8Dir, actualPath) {
+		return "", errInvalidPath
+	}
+	if info, err := os.Stat(actualPath); err != nil || info.IsDir() {
+		return "", os.ErrNotExist
+	}
+	return actualPath, nil
+}
+
+// ResolveSegmentPath 返回数据通道请求的文件在m3u8Dir下的路径。先按ResolveTaskFilePath查找，
+// 转码输出按任务ID存放时总能在这里找到；找不到时为兼容按视频文件名命名的旧目录，
+// 在m3u8Dir的各个子目录中查找（附属文件和带子目录的文件名除外）。错误与ResolveTaskFilePath相同
+func ResolveSegmentPath(taskID, fileName, m3u8Dir string) (string, error) {
+	actualPath, err := ResolveTaskFilePath(taskID, fileName, m3u8Dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		return actualPath, err
+	}
+	if isSidecarFile(fileName) || strings.Contains(fileName, "/") {
+		return "", os.ErrNotExist
+	}
+
+	entries, err := os.ReadDir(m3u8Dir)
+	if err != nil {
+		log.Printf("Failed to read m3u8 directory: %v", err)
+		return "", os.ErrNotExist
+	}
+	// 遍历所有目录，寻找包含目标文件的目录
+	for _, entry := range entries {
+		if entry.IsDir() {
+			testPath := filepath.Join(m3u8Dir, entry.Name(), fileName)
+			if !withinRoot(m3u8Dir, testPath) {
+				continue
+			}
+			if info, err := os.Stat(testPath); err == nil && !info.IsDir() {
+				log.Printf("Found file in directory: %s -> %s", entry.Name(), testPath)
+				return testPath, nil
+			}
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// isSidecarFile 判断是否为任务目录中的附属文件。每个任务目录都有同名的缩略图索引，
+// 种子自带的字幕也按任务存放，不能像切片那样到其它任务的目录中查找。
+func isSidecarFile(fileName string) bool {
+	return fileName == "thumbnails.vtt" || strings.EqualFold(filepath.Ext(fileName), ".srt")
+}
+
+// withinRoot 判断path解析为绝对路径后仍在root之下
+func withinRoot(root, path string) bool {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,39 @@
+package webrtc
+
+import "log"
+
+// pauseSession 暂停会话的切片传输。进行中的传输在下一个分块前挂起，新的请求在读取文件前挂起。
+func (m *Manager) pauseSession(sessionID string) {
+	m.pausedMu.Lock()
+	defer m.pausedMu.Unlock()
+
+	if _, paused := m.paused[sessionID]; !paused {
+		m.paused[sessionID] = make(chan struct{})
+		log.Printf("Paused transfers for session %s", sessionID)
+	}
+}
+
+// resumeSession 恢复会话的传输，唤醒所有挂起的发送
+func (m *Manager) resumeSession(sessionID string) {
+	m.pausedMu.Lock()
+	defer m.pausedMu.Unlock()
+
+	if resumed, paused := m.paused[sessionID]; paused {
+		close(resumed)
+		delete(m.paused, sessionID)
+		log.Printf("Resumed transfers for session %s", sessionID)
+	}
+}
+
+// waitIfPaused 会话暂停时阻塞直到恢复或会话被移除
+func (m *Manager) waitIfPaused(sessionID string) {
+	for {
+		m.pausedMu.Lock()
+		resumed, paused := m.paused[sessionID]
+		m.pausedMu.Unlock()
+		if !paused {
+			return
+		}
+		<-resumed
+	}
+}
@@ -0,0 +1,101 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// prefetchSegments 收到播放提示后预取的后续切片数
+	prefetchSegments = 2
+	// lowBufferSeconds 缓冲低于该值的会话视为即将卡顿
+	lowBufferSeconds = 10.0
+	// hintTTL 播放提示的有效期，超时的会话不再视为正在播放
+	hintTTL = 30 * time.Second
+	// coldChunkDelay 让路时冷数据传输每个分块之间的等待时间
+	coldChunkDelay = 20 * time.Millisecond
+)
+
+// PlaybackHint 播放器通过数据通道上报的播放状态。提示仅作参考，
+// 缺失或过期时服务行为与没有提示时完全一致。
+type PlaybackHint struct {
+	Type         string  `json:"type"`
+	TaskID       string  `json:"taskId"`
+	Rendition    string  `json:"rendition"`    // 当前码率的播放列表名，不含扩展名，如"index"
+	Sequence     int     `json:"sequence"`     // 当前播放的切片序号
+	BufferLength float64 `json:"bufferLength"` // 已缓冲的秒数
+}
+
+type sessionHint struct {
+	hint       PlaybackHint
+	receivedAt time.Time
+}
+
+// handlePlaybackHint 记录会话的播放状态，并把当前码率接下来的切片预取到缓存
+func (m *Manager) handlePlaybackHint(sessionID string, data []byte) {
+	var hint PlaybackHint
+	if err := json.Unmarshal(data, &hint); err != nil {
+		log.Printf("Failed to parse playback hint: %v", err)
+		return
+	}
+
+	m.hintsMu.Lock()
+	m.hints[sessionID] = sessionHint{hint: hint, receivedAt: m.now()}
+	m.hintsMu.Unlock()
+
+	for _, path := range prefetchTargets(m.mediaRoot, hint, m.cache.contains) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// 切片可能尚未生成，下次提示时再试
+			continue
+		}
+		m.cache.put(path, data)
+	}
+}
+
+// prefetchTargets 返回提示对应码率中接下来需要预取的切片路径，已缓存的切片跳过
+func prefetchTargets(root string, hint PlaybackHint, cached func(path string) bool) []string {
+	if hint.TaskID == "" || hint.Rendition == "" || hint.Sequence < 0 {
+		return nil
+	}
+	// 拒绝包含路径分隔符的任务ID或码率名，避免越出切片目录
+	if filepath.Base(hint.TaskID) != hint.TaskID || filepath.Base(hint.Rendition) != hint.Rendition ||
+		hint.TaskID == ".." || hint.Rendition == ".." {
+		return nil
+	}
+
+	var targets []string
+	for i := 1; i <= prefetchSegments; i++ {
+		name := fmt.Sprintf("%s%d.ts", hint.Rendition, hint.Sequence+i)
+		path := filepath.Join(root, hint.TaskID, name)
+		if !cached(path) {
+			targets = append(targets, path)
+		}
+	}
+	return targets
+}
+
+// shouldYield 判断会话的冷数据传输是否应为其它会话让路：
+// 该会话没有有效的播放提示，而另一个正在播放的会话缓冲不足。
+func (m *Manager) shouldYield(sessionID string) bool {
+	m.hintsMu.Lock()
+	defer m.hintsMu.Unlock()
+
+	now := m.now()
+	if own, ok := m.hints[sessionID]; ok && now.Sub(own.receivedAt) <= hintTTL {
+		return false
+	}
+	for id, other := range m.hints {
+		if id == sessionID || now.Sub(other.receivedAt) > hintTTL {
+			continue
+		}
+		if other.hint.BufferLength < lowBufferSeconds {
+			return true
+		}
+	}
+	return false
+}
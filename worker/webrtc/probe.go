@@ -0,0 +1,229 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ProbePayloadBytes 测速时发送的随机数据量
+	ProbePayloadBytes = 2 * 1024 * 1024
+	// DefaultMaxProbes 同时进行的测速会话上限
+	DefaultMaxProbes = 2
+	// DefaultProbeBandwidth 所有测速会话共享的发送限速（字节/秒），即100Mbps
+	DefaultProbeBandwidth = 100 * 1000 * 1000 / 8
+
+	// probeTimeout 测速会话的最长存活时间，超时后关闭并释放名额
+	probeTimeout = 30 * time.Second
+	// probeLinger 发送测速结果后等待片刻再关闭会话，让结果消息送达
+	probeLinger = time.Second
+)
+
+// ErrTooManyProbes 同时进行的测速会话已达上限
+var ErrTooManyProbes = errors.New("too many concurrent speed probes")
+
+// ProbeResult 一次测速的结果。吞吐量按发送第一个分块到收到客户端确认的时间计算
+type ProbeResult struct {
+	SessionID      string  `json:"session_id"`
+	Bytes          int     `json:"bytes"`
+	DurationMs     int64   `json:"duration_ms"`
+	ThroughputKbps float64 `json:"throughput_kbps"`
+	RTTMs          float64 `json:"rtt_ms"`
+}
+
+// probeState 测速会话的进度，由Manager.probeMu保护
+type probeState struct {
+	requestID string
+	started   time.Time // 开始发送的时间，为零表示尚未开始
+	done      bool      // 已收到客户端确认，会话即将关闭
+}
+
+var (
+	probePayloadOnce sync.Once
+	probePayload     []byte
+)
+
+// probeData 返回测速用的随机数据，所有测速共用一份
+func probeData() []byte {
+	probePayloadOnce.Do(func() {
+		probePayload = make([]byte, ProbePayloadBytes)
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(probePayload)
+	})
+	return probePayload
+}
+
+// HandleProbe 为测速创建会话并返回应答。测速会话不提供文件，不计入会话统计，
+// 超过probeTimeout自动关闭；同时进行的测速达到上限时返回ErrTooManyProbes
+func (m *Manager) HandleProbe(sessionID, sdp string) (string, error) {
+	m.probeMu.Lock()
+	if _, exists := m.probes[sessionID]; !exists && len(m.probes) >= m.maxProbes {
+		m.probeMu.Unlock()
+		return "", ErrTooManyProbes
+	}
+	m.probes[sessionID] = &probeState{}
+	m.probeMu.Unlock()
+
+	answer, err := m.HandleOffer(sessionID, sdp)
+	if err != nil {
+		m.forgetProbe(sessionID)
+		return "", err
+	}
+	time.AfterFunc(probeTimeout, func() {
+		if m.isProbe(sessionID) {
+			m.CloseSession(sessionID)
+		}
+	})
+	return answer, nil
+}
+
+// SetProbeLimits 设置同时进行的测速会话上限与测速总限速（字节/秒）。
+// 上限为0时使用DefaultMaxProbes，限速为0表示不限速
+func (m *Manager) SetProbeLimits(maxProbes, bytesPerSec int) {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+
+	if maxProbes <= 0 {
+		maxProbes = DefaultMaxProbes
+	}
+	m.maxProbes = maxProbes
+	limit, burst := egressLimit(bytesPerSec)
+	m.probeEgress.SetLimit(limit)
+	m.probeEgress.SetBurst(burst)
+}
+
+// SetProbeResultHandler 设置测速完成回调，用于上报网关
+func (m *Manager) SetProbeResultHandler(handler func(ProbeResult)) {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	m.probeHandler = handler
+}
+
+// isProbe 判断会话是否为测速会话
+func (m *Manager) isProbe(sessionID string) bool {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	_, exists := m.probes[sessionID]
+	return exists
+}
+
+// forgetProbe 会话结束后释放测速名额
+func (m *Manager) forgetProbe(sessionID string) {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	delete(m.probes, sessionID)
+}
+
+// handleSpeedProbe 客户端请求开始测速，按文件传输的分块格式发送speedProbeData。
+// 每个测速会话只测一次
+func (m *Manager) handleSpeedProbe(sessionID string, request FileRequest) {
+	m.probeMu.Lock()
+	state, exists := m.probes[sessionID]
+	if !exists || !state.started.IsZero() {
+		m.probeMu.Unlock()
+		m.sendFileError(sessionID, request.ID, "Speed probe not available on this session")
+		return
+	}
+	state.requestID = request.ID
+	state.started = m.now()
+	limiter := m.probeEgress
+	m.probeMu.Unlock()
+
+	data := probeData()
+	totalSlices := (len(data) + ServerChunkSize - 1) / ServerChunkSize
+	for i := 0; i < totalSlices; i++ {
+		start := i * ServerChunkSize
+		end := start + ServerChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		responseData, err := json.Marshal(FileResponse{
+			Type:          "speedProbeData",
+			ID:            request.ID,
+			SliceNum:      i,
+			TotalSliceNum: totalSlices,
+			TotalLength:   len(data),
+			Payload:       base64.StdEncoding.EncodeToString(data[start:end]),
+		})
+		if err != nil {
+			log.Printf("Failed to marshal speed probe chunk: %v", err)
+			return
+		}
+
+		wait := len(responseData)
+		if burst := limiter.Burst(); wait > burst {
+			wait = burst
+		}
+		if err := limiter.WaitN(context.Background(), wait); err != nil {
+			log.Printf("Speed probe for session %s stopped: %v", sessionID, err)
+			m.sendFileError(sessionID, request.ID, "Speed probe failed")
+			return
+		}
+		m.waitEgress(sessionID, len(responseData))
+		if err := m.sendData(sessionID, responseData); err != nil {
+			log.Printf("Failed to send speed probe chunk %d to session %s: %v", i, sessionID, err)
+			return
+		}
+	}
+}
+
+// handleSpeedProbeAck 客户端收齐测速数据后确认，计算吞吐量与RTT，
+// 通过数据通道回复speedProbeResult并上报，随后关闭会话
+func (m *Manager) handleSpeedProbeAck(sessionID string, request FileRequest) {
+	m.probeMu.Lock()
+	state, exists := m.probes[sessionID]
+	if !exists || state.started.IsZero() || state.done || state.requestID != request.ID {
+		m.probeMu.Unlock()
+		log.Printf("Ignoring unexpected speed probe ack for session %s", sessionID)
+		return
+	}
+	duration := m.now().Sub(state.started)
+	handler := m.probeHandler
+	state.done = true
+	m.probeMu.Unlock()
+
+	result := ProbeResult{
+		SessionID:  sessionID,
+		Bytes:      ProbePayloadBytes,
+		DurationMs: duration.Milliseconds(),
+	}
+	if duration > 0 {
+		result.ThroughputKbps = float64(ProbePayloadBytes) * 8 / 1000 / duration.Seconds()
+	}
+	if stats, ok := m.SessionStats(sessionID); ok {
+		result.RTTMs = stats.RTTMs
+	}
+	log.Printf("Speed probe for session %s: %d bytes in %dms (%.0f kbps, rtt %.1fms)",
+		sessionID, result.Bytes, result.DurationMs, result.ThroughputKbps, result.RTTMs)
+
+	responseData, err := json.Marshal(map[string]interface{}{
+		"type":   "speedProbeResult",
+		"id":     request.ID,
+		"result": result,
+	})
+	if err == nil {
+		err = m.sendData(sessionID, responseData)
+	}
+	if err != nil {
+		log.Printf("Failed to send speed probe result to session %s: %v", sessionID, err)
+	}
+	if handler != nil {
+		handler(result)
+	}
+
+	time.AfterFunc(probeLinger, func() { m.CloseSession(sessionID) })
+}
+
+// probeLimiter 创建测速共享的限速器
+func probeLimiter(bytesPerSec int) *rate.Limiter {
+	limit, burst := egressLimit(bytesPerSec)
+	return rate.NewLimiter(limit, burst)
+}
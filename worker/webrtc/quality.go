@@ -0,0 +1,45 @@
+package webrtc
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"worker/transcoder"
+)
+
+// qualityAuto 由播放器按主播放列表自行选择码流，与不带quality相同
+const qualityAuto = "auto"
+
+// qualityFile 把请求的文件换成所选码流目录（多码率输出的<任务目录>/<码流名>/）中的同名文件。
+// 请求的文件已在某个码流目录中时（如720p/index3.ts）换到同级的所选码流目录，
+// 否则在文件所在目录下查找码流目录。附属文件不区分码流，原样返回。
+// 码流名不是单个路径元素或任务中没有该码流时返回false
+func (m *Manager) qualityFile(taskID, fileName, quality string) (string, bool) {
+	if quality == "" || quality == qualityAuto || isSidecarFile(fileName) {
+		return fileName, true
+	}
+	if quality == "." || quality == ".." || strings.ContainsAny(quality, `/\`) {
+		return "", false
+	}
+
+	dir, base := path.Split(fileName)
+	dir = strings.TrimSuffix(dir, "/")
+	if base == transcoder.MasterPlaylistName {
+		// 主播放列表对应各码流目录中的index.m3u8
+		base = "index.m3u8"
+	}
+	candidates := []string{dir}
+	if dir != "" {
+		candidates = append(candidates, path.Dir(dir))
+	}
+	for _, parent := range candidates {
+		renditionDir := path.Join(parent, quality)
+		info, err := os.Stat(filepath.Join(m.mediaRoot, taskID, filepath.FromSlash(renditionDir)))
+		if err == nil && info.IsDir() {
+			return path.Join(renditionDir, base), true
+		}
+	}
+	return "", false
+}
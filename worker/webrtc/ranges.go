@@ -0,0 +1,44 @@
+package webrtc
+
+import "errors"
+
+var (
+	// errInvalidRange 请求的范围本身不合法：偏移为负，或end小于start
+	errInvalidRange = errors.New("invalid range")
+	// errRangeNotSatisfiable 请求范围的起点超出文件末尾
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// byteRange hijackReq请求的字节范围[start, end)，end为nil表示到文件末尾
+type byteRange struct {
+	start int64
+	end   *int64
+}
+
+// requestRange 取出请求中的范围，start和end都没有给出时返回nil，即发送整个文件
+func requestRange(request FileRequest) (*byteRange, error) {
+	if request.Start == nil && request.End == nil {
+		return nil, nil
+	}
+	window := &byteRange{end: request.End}
+	if request.Start != nil {
+		window.start = *request.Start
+	}
+	if window.start < 0 || (window.end != nil && *window.end < window.start) {
+		return nil, errInvalidRange
+	}
+	return window, nil
+}
+
+// resolve 按文件大小确定实际发送的[start, end)。end超出文件末尾时截到末尾；
+// start等于end时为空范围，start超出文件末尾时返回errRangeNotSatisfiable
+func (r *byteRange) resolve(size int64) (int64, int64, error) {
+	if r.start > size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	end := size
+	if r.end != nil && *r.end < size {
+		end = *r.end
+	}
+	return r.start, end, nil
+}
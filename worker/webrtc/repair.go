@@ -0,0 +1,62 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// RepairRequest 播放器报告无法解码的切片，请求Worker检查并重新生成
+type RepairRequest struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	TaskID string `json:"taskId"`
+	Name   string `json:"name"` // 切片文件名，如"index5.ts"
+}
+
+// handleRepairRequest 调用SetSegmentRepairHandler设置的回调修复切片，并回复repairSegmentResult
+func (m *Manager) handleRepairRequest(sessionID string, data []byte) {
+	var request RepairRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		log.Printf("Failed to parse repair request: %v", err)
+		return
+	}
+
+	m.repairMu.RLock()
+	handler := m.repairHandler
+	m.repairMu.RUnlock()
+
+	response := map[string]interface{}{
+		"type": "repairSegmentResult",
+		"id":   request.ID,
+	}
+	if handler == nil {
+		response["error"] = "segment repair not supported"
+	} else if status, err := handler(request.TaskID, request.Name); err != nil {
+		response["error"] = err.Error()
+	} else {
+		response["status"] = status
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal repair response: %v", err)
+		return
+	}
+	if err := m.sendData(sessionID, responseData); err != nil {
+		log.Printf("Failed to send repair response: %v", err)
+	}
+}
+
+// SetSegmentRepairHandler 设置切片修复回调，返回修复结果（healthy、repaired或needs_retranscode）
+func (m *Manager) SetSegmentRepairHandler(handler func(taskID, name string) (string, error)) {
+	m.repairMu.Lock()
+	defer m.repairMu.Unlock()
+	m.repairHandler = handler
+}
+
+// ForgetFile 从切片缓存中移除任务的文件，切片在磁盘上被替换后调用
+func (m *Manager) ForgetFile(taskID, fileName string) {
+	if path, found := m.ResolveFile(taskID, fileName); found {
+		m.cache.remove(path)
+	}
+}
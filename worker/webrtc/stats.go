@@ -0,0 +1,136 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// statsInterval 会话统计的采集间隔
+var statsInterval = 5 * time.Second
+
+// SessionStats 会话的传输统计，由PeerConnection.GetStats定期采集
+type SessionStats struct {
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	RTTMs         float64   `json:"rtt_ms"`      // 当前使用的候选者对的往返时间（毫秒）
+	PacketLoss    float64   `json:"packet_loss"` // 丢包比例（0-1），只有媒体流时才有
+	LastUpdated   time.Time `json:"last_updated"`
+}
+
+// AggregateStats 所有会话的统计汇总，随心跳上报
+type AggregateStats struct {
+	TotalBytesSent     int64   `json:"total_bytes_sent"`
+	AvgRTTMs           float64 `json:"avg_rtt_ms"` // 有RTT测量的会话的平均值
+	ActiveSessionCount int     `json:"active_session_count"`
+}
+
+// summarizeStats 从统计报告中提取收发字节数、RTT和丢包率。媒体流的字节数取RTP统计，
+// 只有数据通道时取传输层统计；RTT优先取已提名的候选者对，丢包率取对端RTCP报告
+func summarizeStats(report webrtc.StatsReport) SessionStats {
+	var stats, transport SessionStats
+	var rtpSeen bool
+	var lost, received int64
+	for _, s := range report {
+		switch s := s.(type) {
+		case webrtc.InboundRTPStreamStats:
+			rtpSeen = true
+			stats.BytesReceived += int64(s.BytesReceived)
+			lost += int64(s.PacketsLost)
+			received += int64(s.PacketsReceived)
+		case webrtc.OutboundRTPStreamStats:
+			rtpSeen = true
+			stats.BytesSent += int64(s.BytesSent)
+		case webrtc.RemoteInboundRTPStreamStats:
+			if s.FractionLost > stats.PacketLoss {
+				stats.PacketLoss = s.FractionLost
+			}
+			if stats.RTTMs == 0 && s.RoundTripTime > 0 {
+				stats.RTTMs = s.RoundTripTime * 1000
+			}
+		case webrtc.TransportStats:
+			transport.BytesSent += int64(s.BytesSent)
+			transport.BytesReceived += int64(s.BytesReceived)
+		case webrtc.ICECandidatePairStats:
+			if s.Nominated && s.CurrentRoundTripTime > 0 {
+				stats.RTTMs = s.CurrentRoundTripTime * 1000
+			}
+		}
+	}
+	if !rtpSeen {
+		stats.BytesSent = transport.BytesSent
+		stats.BytesReceived = transport.BytesReceived
+	}
+	if received+lost > 0 && lost > 0 {
+		if loss := float64(lost) / float64(received+lost); loss > stats.PacketLoss {
+			stats.PacketLoss = loss
+		}
+	}
+	return stats
+}
+
+// monitorStats 每statsInterval采集一次会话统计，会话被移除或替换后退出
+func (m *Manager) monitorStats(session *Session) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mutex.RLock()
+		current := m.sessions[session.ID]
+		m.mutex.RUnlock()
+		if current != session {
+			return
+		}
+		m.updateStats(session)
+	}
+}
+
+// updateStats 采集一次会话统计并保存
+func (m *Manager) updateStats(session *Session) SessionStats {
+	stats := summarizeStats(session.PeerConn.GetStats())
+	stats.LastUpdated = m.now()
+	m.statsMu.Lock()
+	session.Stats = stats
+	m.statsMu.Unlock()
+	return stats
+}
+
+// SessionStats 立即采集并返回会话的统计，会话不存在时返回false
+func (m *Manager) SessionStats(sessionID string) (SessionStats, bool) {
+	m.mutex.RLock()
+	session, exists := m.sessions[sessionID]
+	m.mutex.RUnlock()
+	if !exists || session.PeerConn == nil {
+		return SessionStats{}, false
+	}
+	return m.updateStats(session), true
+}
+
+// AggregateStats 汇总所有会话最近一次采集的统计
+func (m *Manager) AggregateStats() AggregateStats {
+	m.mutex.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		if !m.isProbe(session.ID) {
+			sessions = append(sessions, session)
+		}
+	}
+	m.mutex.RUnlock()
+
+	var aggregate AggregateStats
+	var rttSum float64
+	var rttCount int
+	m.statsMu.RLock()
+	for _, session := range sessions {
+		aggregate.ActiveSessionCount++
+		aggregate.TotalBytesSent += session.Stats.BytesSent
+		if session.Stats.RTTMs > 0 {
+			rttSum += session.Stats.RTTMs
+			rttCount++
+		}
+	}
+	m.statsMu.RUnlock()
+	if rttCount > 0 {
+		aggregate.AvgRTTMs = rttSum / float64(rttCount)
+	}
+	return aggregate
+}
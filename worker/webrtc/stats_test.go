@@ -0,0 +1,99 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	webrtcLib "github.com/pion/webrtc/v3"
+)
+
+func TestSessionStatsAfterDataSent(t *testing.T) {
+	mgr := New()
+	t.Cleanup(mgr.Stop)
+
+	client, err := webrtcLib.NewPeerConnection(webrtcLib.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	received := make(chan struct{}, 1)
+	channel, err := client.CreateDataChannel("filePathChannel", nil)
+	if err != nil {
+		t.Fatalf("create data channel: %v", err)
+	}
+	opened := make(chan struct{})
+	channel.OnOpen(func() { close(opened) })
+	channel.OnMessage(func(webrtcLib.DataChannelMessage) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+
+	// Worker的候选者直接交给客户端，客户端在收集完成后才发送offer
+	mgr.SetICECandidateHandler(func(_ string, candidate *webrtcLib.ICECandidate) {
+		if err := client.AddICECandidate(candidate.ToJSON()); err != nil {
+			t.Errorf("add worker candidate: %v", err)
+		}
+	})
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer: %v", err)
+	}
+	gathered := webrtcLib.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("set local description: %v", err)
+	}
+	<-gathered
+
+	answer, err := mgr.HandleOffer("session-1", client.LocalDescription().SDP)
+	if err != nil {
+		t.Fatalf("handle offer: %v", err)
+	}
+	if err := client.SetRemoteDescription(webrtcLib.SessionDescription{Type: webrtcLib.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatalf("set remote description: %v", err)
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("data channel did not open")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if session, ok := mgr.GetSession("session-1"); ok && session.DataChan != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker did not receive the data channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	payload := make([]byte, 8*1024)
+	if err := mgr.SendData("session-1", payload); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("client did not receive the data")
+	}
+
+	stats, ok := mgr.SessionStats("session-1")
+	if !ok {
+		t.Fatalf("expected stats for the session")
+	}
+	if stats.BytesSent < int64(len(payload)) || stats.BytesReceived == 0 || stats.LastUpdated.IsZero() {
+		t.Fatalf("expected non-zero stats after sending %d bytes, got %+v", len(payload), stats)
+	}
+
+	aggregate := mgr.AggregateStats()
+	if aggregate.ActiveSessionCount != 1 || aggregate.TotalBytesSent != stats.BytesSent {
+		t.Fatalf("unexpected aggregate %+v for session stats %+v", aggregate, stats)
+	}
+	if _, ok := mgr.SessionStats("missing"); ok {
+		t.Fatalf("expected no stats for an unknown session")
+	}
+}